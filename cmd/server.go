@@ -1,35 +1,372 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/mail"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
-	"github.com/joho/godotenv"
-	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/vedrankolka/donation-server/pkg/address"
+	"github.com/vedrankolka/donation-server/pkg/adminui"
+	"github.com/vedrankolka/donation-server/pkg/anomaly"
+	"github.com/vedrankolka/donation-server/pkg/auditlog"
+	"github.com/vedrankolka/donation-server/pkg/auth"
+	"github.com/vedrankolka/donation-server/pkg/autorefund"
+	"github.com/vedrankolka/donation-server/pkg/backup"
+	"github.com/vedrankolka/donation-server/pkg/clientip"
+	"github.com/vedrankolka/donation-server/pkg/clock"
+	"github.com/vedrankolka/donation-server/pkg/cloudevents"
+	"github.com/vedrankolka/donation-server/pkg/compress"
+	"github.com/vedrankolka/donation-server/pkg/config"
+	"github.com/vedrankolka/donation-server/pkg/cors"
+	"github.com/vedrankolka/donation-server/pkg/currency"
+	"github.com/vedrankolka/donation-server/pkg/deadletter"
+	"github.com/vedrankolka/donation-server/pkg/digest"
+	"github.com/vedrankolka/donation-server/pkg/doctor"
+	"github.com/vedrankolka/donation-server/pkg/duplicate"
+	"github.com/vedrankolka/donation-server/pkg/errcatalog"
+	"github.com/vedrankolka/donation-server/pkg/fault"
+	"github.com/vedrankolka/donation-server/pkg/feature"
+	"github.com/vedrankolka/donation-server/pkg/funnel"
+	"github.com/vedrankolka/donation-server/pkg/geoblock"
 	"github.com/vedrankolka/donation-server/pkg/handler"
+	"github.com/vedrankolka/donation-server/pkg/health"
+	"github.com/vedrankolka/donation-server/pkg/httpcache"
+	"github.com/vedrankolka/donation-server/pkg/jobs"
+	"github.com/vedrankolka/donation-server/pkg/killswitch"
+	"github.com/vedrankolka/donation-server/pkg/kiosk"
+	"github.com/vedrankolka/donation-server/pkg/leader"
+	"github.com/vedrankolka/donation-server/pkg/lifecycle"
+	"github.com/vedrankolka/donation-server/pkg/loadshed"
+	"github.com/vedrankolka/donation-server/pkg/logging"
+	"github.com/vedrankolka/donation-server/pkg/metrics"
+	"github.com/vedrankolka/donation-server/pkg/notifier"
+	"github.com/vedrankolka/donation-server/pkg/notifier/email"
 	"github.com/vedrankolka/donation-server/pkg/notifier/kafka"
+	"github.com/vedrankolka/donation-server/pkg/notifier/sqs"
+	"github.com/vedrankolka/donation-server/pkg/notifier/webhook"
+	"github.com/vedrankolka/donation-server/pkg/oauth"
+	"github.com/vedrankolka/donation-server/pkg/partner"
+	"github.com/vedrankolka/donation-server/pkg/payments"
+	"github.com/vedrankolka/donation-server/pkg/payments/fake"
+	"github.com/vedrankolka/donation-server/pkg/pii"
+	"github.com/vedrankolka/donation-server/pkg/ratelimit"
+	"github.com/vedrankolka/donation-server/pkg/receipt"
+	"github.com/vedrankolka/donation-server/pkg/recurring"
+	"github.com/vedrankolka/donation-server/pkg/report"
+	"github.com/vedrankolka/donation-server/pkg/requestid"
+	"github.com/vedrankolka/donation-server/pkg/retention"
+	"github.com/vedrankolka/donation-server/pkg/rollup"
+	"github.com/vedrankolka/donation-server/pkg/router"
+	"github.com/vedrankolka/donation-server/pkg/schema"
+	"github.com/vedrankolka/donation-server/pkg/screening"
+	"github.com/vedrankolka/donation-server/pkg/secheaders"
+	"github.com/vedrankolka/donation-server/pkg/shadow"
+	"github.com/vedrankolka/donation-server/pkg/sla"
+	"github.com/vedrankolka/donation-server/pkg/static"
+	"github.com/vedrankolka/donation-server/pkg/store"
+	"github.com/vedrankolka/donation-server/pkg/stripeip"
+	"github.com/vedrankolka/donation-server/pkg/stripetax"
+	"github.com/vedrankolka/donation-server/pkg/subscription"
+	"github.com/vedrankolka/donation-server/pkg/tracing"
+	"github.com/vedrankolka/donation-server/pkg/vat"
+	"go.uber.org/zap"
 )
 
 func main() {
-	for _, envFile := range os.Args[1:] {
-		if err := godotenv.Load(envFile); err != nil {
-			log.Printf("Error loading %s: %v", envFile, err)
+	// "donation-server doctor [flags] [env files]" checks the configuration instead of serving,
+	// "donation-server config [flags] [env files]" prints it,
+	// "donation-server verify-audit-log [flags] [env files]" checks the chain of the audit log, and
+	// "donation-server backup|restore|verify-backup <location> [flags] [env files]" backs up the donations, and
+	// "donation-server reencrypt-pii [flags] [env files]" encrypts the donors' data with the first PII key.
+	args := os.Args[1:]
+	var command, location string
+	if len(args) > 0 {
+		switch args[0] {
+		case "doctor", "config", "verify-audit-log", "reencrypt-pii":
+			command, args = args[0], args[1:]
+		case "backup", "restore", "verify-backup":
+			if len(args) < 2 {
+				fmt.Fprintf(os.Stderr, "usage: donation-server %s <file, directory or s3://bucket/key> [flags] [env files]\n", args[0])
+				os.Exit(2)
+			}
+			command, location, args = args[0], args[1], args[2:]
+		}
+	}
+	doctorMode := command == "doctor"
+	// Settings come from flags, the environment and .env files, and a YAML file.
+	var err error
+	if cfg, err = config.Load(strings.TrimSpace("donation-server "+command), args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	for _, warning := range cfg.Warnings {
+		log.Printf("[WARN] %s\n", warning)
+	}
+	switch command {
+	case "verify-audit-log":
+		os.Exit(verifyAuditLog(os.Stdout))
+	case "backup", "restore", "verify-backup":
+		os.Exit(runBackup(command, location, os.Stdout))
+	case "reencrypt-pii":
+		os.Exit(reencryptPII(os.Stdout))
+	case "config":
+		if err := cfg.Write(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Structured logging, also of the lines of the log package.
+	logger, err := logging.New(cfg.Get("DONATION_SERVER_LOG_LEVEL"), cfg.Get("DONATION_SERVER_LOG_FORMAT"))
+	if err != nil {
+		log.Fatalf("Could not configure logging: %v", err)
+	}
+	defer logger.Sync()
+	zap.ReplaceGlobals(logger)
+	logging.RedirectStdLog(logger)
+
+	// Settings the server cannot run without, the doctor reports them instead.
+	if !doctorMode {
+		required := []string{"DONATION_SERVER_PORT"}
+		if cfg.Get("DONATION_SERVER_PAYMENT_PROVIDER") != "fake" {
+			required = append(required, "STRIPE_PUBLISHABLE_KEY", "STRIPE_SECRET_KEY", "STRIPE_WEBHOOK_SECRET")
+		}
+		if err := cfg.Require(required...); err != nil {
+			log.Fatalf("Invalid configuration: %v", err)
 		}
 	}
 
 	// Stripe variables.
-	publishableKey := os.Getenv("STRIPE_PUBLISHABLE_KEY")
-	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
-	webhookSecret := os.Getenv("STRIPE_WEBHOOK_SECRET")
-	port := os.Getenv("DONATION_SERVER_PORT")
-	// Kafka (Upstash) variables.
-	bootstrapServers := os.Getenv("UPSTASH_KAFKA_BOOTSTRAP_SERVERS")
-	customersTopic := os.Getenv("DONATION_SERVER_CUSTOMERS_TOPIC")
-	kafkaUsername := os.Getenv("UPSTASH_KAFKA_SCRAM_USERNAME")
-	kafkaPassword := os.Getenv("UPSTASH_KAFKA_SCRAM_PASSWORD")
+	publishableKey := cfg.Get("STRIPE_PUBLISHABLE_KEY")
+	webhookSecret := cfg.Get("STRIPE_WEBHOOK_SECRET")
+	port := cfg.Get("DONATION_SERVER_PORT")
+	// Kafka (Upstash) variables, the rest are read by newNotifier.
+	bootstrapServers := cfg.Get("UPSTASH_KAFKA_BOOTSTRAP_SERVERS")
+	// HTTP webhook variables, used instead of Kafka if set.
+	webhookNotifierURL := cfg.Get("DONATION_SERVER_WEBHOOK_NOTIFIER_URL")
+	// AWS SQS queue or SNS topic, used instead of Kafka if set.
+	sqsQueueURL, snsTopicARN := cfg.Get("DONATION_SERVER_SQS_QUEUE_URL"), cfg.Get("DONATION_SERVER_SNS_TOPIC_ARN")
+	// Environment of the server, e.g. production or staging.
+	environment := cfg.Get("DONATION_SERVER_ENVIRONMENT")
+
+	// Feature flags from the environment, a file and/or a flag service, in that order of precedence.
+	featureProviders := []feature.Provider{feature.EnvProvider{}}
+	if path := cfg.Get("DONATION_SERVER_FEATURES_FILE"); path != "" {
+		fileProvider, err := feature.NewFileProvider(path)
+		if err != nil {
+			log.Fatalf("Could not load feature flags: %v", err)
+		}
+		featureProviders = append(featureProviders, fileProvider)
+	}
+	if url := cfg.Get("DONATION_SERVER_FEATURES_URL"); url != "" {
+		featureProviders = append(featureProviders, feature.NewRemoteProvider(url, &http.Client{Timeout: 5 * time.Second}))
+	}
+	features := feature.NewFlags(environment, featureProviders...)
+
+	stripeTimeout := configureStripe(environment)
+	provider, fakeProvider := newProvider(webhookSecret, stripeTimeout, environment, port, features)
+
+	// Optional CloudEvents envelope of the notifications.
+	var cloudEvents *cloudevents.Config
+	if mode := cfg.Get("DONATION_SERVER_CLOUDEVENTS_MODE"); mode != "" {
+		cloudEvents, err = cloudevents.NewConfig(mode, cfg.Get("DONATION_SERVER_CLOUDEVENTS_SOURCE"),
+			cfg.Get("DONATION_SERVER_CLOUDEVENTS_TYPE_PREFIX"), cfg.Get("DONATION_SERVER_PUBLIC_URL"))
+		if err != nil {
+			log.Fatalf("Could not configure CloudEvents: %v", err)
+		}
+		log.Printf("Notifications are sent as CloudEvents in %s mode.\n", cloudEvents.Mode)
+	}
+
+	// Kafka client or HTTP webhook for sending events about confirmed payments.
+	primaryNotifier := cfg.Get("DONATION_SERVER_NOTIFIER")
+	if primaryNotifier == "" {
+		switch {
+		case webhookNotifierURL != "":
+			primaryNotifier = "webhook"
+		case sqsQueueURL != "":
+			primaryNotifier = "sqs"
+		case snsTopicARN != "":
+			primaryNotifier = "sns"
+		default:
+			primaryNotifier = "kafka"
+		}
+	}
+	if doctorMode {
+		if !doctor.Run(context.Background(), os.Stdout, doctorChecks(primaryNotifier, cloudEvents)) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// The server runs until SIGINT or SIGTERM, then stops accepting requests,
+	// finishes those in flight, stops the background jobs and closes the
+	// notifiers and stores, in that order.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	shutdownTimeout := DefaultShutdownTimeout
+	if cfg.Get("DONATION_SERVER_SHUTDOWN_TIMEOUT") != "" {
+		if shutdownTimeout = cfg.Duration("DONATION_SERVER_SHUTDOWN_TIMEOUT"); shutdownTimeout <= 0 {
+			log.Fatalf("DONATION_SERVER_SHUTDOWN_TIMEOUT must be a duration like 25s")
+		}
+	}
+	var background sync.WaitGroup
+	goBackground := func(run func(ctx context.Context)) {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			run(ctx)
+		}()
+	}
+	flushTimeout := DefaultFlushTimeout
+	if cfg.Get("DONATION_SERVER_FLUSH_TIMEOUT") != "" {
+		if flushTimeout = cfg.Duration("DONATION_SERVER_FLUSH_TIMEOUT"); flushTimeout <= 0 {
+			log.Fatalf("DONATION_SERVER_FLUSH_TIMEOUT must be a duration like 4s")
+		}
+	}
+	var closers teardown
+	// Spans are exported until the server stops, after the notifiers flushed.
+	traceExporter, err := newTraceExporter(environment)
+	if err != nil {
+		log.Fatalf("Invalid tracing settings: %v", err)
+	}
+	if traceExporter != nil {
+		closers.addStore("trace exporter", traceExporter)
+	}
+	if fakeProvider != nil {
+		goBackground(fakeProvider.Run)
+	}
+
+	// Degraded dependencies are reported in /config and /healthz.
+	c := &components{
+		stores:         newStores(&closers),
+		features:       features,
+		monitor:        health.NewMonitor(),
+		clientIPHeader: newClientIPHeader(),
+		goBackground:   goBackground,
+	}
+	donationNotifier, dualWriter, err := newDonationNotifier(primaryNotifier, cloudEvents, c.stores.deadLetters, c.monitor)
+	if err != nil {
+		log.Printf("Could not construct %v\n", err)
+		return
+	}
+	c.dualWriter = dualWriter
+	c.monitor.Add(health.Component{Name: "store", Impact: health.ImpactDonationsDelayed, Check: c.stores.donations.Ping})
+	goBackground(c.monitor.Run)
+
+	c.scheduled = startJobs(c, provider, cloudEvents, &closers)
+	handlerOptions := paymentOptions(c, provider, stripeTimeout, cloudEvents, &closers)
+	handlerOptions = append(handlerOptions, handler.WithLogger(logger.Named("handler")), handler.WithHealth(c.monitor))
+
+	// Events are also delivered to the webhook subscriptions of third parties.
+	donationNotifier = subscription.NewNotifier(donationNotifier, c.scheduled.dispatcher)
+	// Donation events are rolled out to the v2 schema by Stripe event.
+	donationNotifier = schema.NewVersionNotifier(donationNotifier, func(ctx context.Context) bool {
+		return features.Enabled(ctx, feature.EventSchemaV2, notifier.EventID(ctx))
+	})
+	// Dead letters are redriven inline, so the result of a redrive is known.
+	c.redriveNotifier = donationNotifier
+	// Webhooks may only queue their notifications, for workers to deliver.
+	if cfg.Get("DONATION_SERVER_ASYNC_WORKERS") != "" {
+		async, err := newAsyncNotifier(int(cfg.Int("DONATION_SERVER_ASYNC_WORKERS")), donationNotifier, handler.DeadLetterFunc(c.stores.deadLetters), features)
+		if err != nil {
+			log.Fatalf("Could not start the asynchronous notifications: %v", err)
+		}
+		donationNotifier = async
+	}
+
+	c.donationHandler, err = handler.NewHandler(publishableKey, webhookSecret, donationNotifier, handlerOptions...)
+	if err != nil {
+		log.Fatalf("Could not create DonationHandler: %v", err)
+	}
+	// Closing the notifier of donations closes all notifiers it wraps.
+	closers.addNotifier(primaryNotifier+" notifier", donationNotifier)
+
+	// Every route answers HEAD and OPTIONS requests, and other methods than
+	// its own with 405 Method Not Allowed, with the methods in Allow.
+	routes := router.New(http.DefaultServeMux)
+	secure, embeddable := securityMiddleware()
+	linkHandler, campaignHandler := publicRoutes(routes, c, embeddable)
+	adminRoutes(routes, c, linkHandler, campaignHandler)
+	if bootstrapServers != "" || webhookNotifierURL != "" || sqsQueueURL != "" || snsTopicARN != "" || primaryNotifier == "email" {
+		webhookRoute(routes, c)
+	}
+
+	httpServer := &http.Server{Addr: "0.0.0.0:" + port, Handler: newServerHandler(secure)}
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Println("server running at " + httpServer.Addr)
+		serverErr <- httpServer.ListenAndServe()
+	}()
+	var failed bool
+	select {
+	case err := <-serverErr:
+		log.Printf("The server failed: %v\n", err)
+		failed = true
+	case <-ctx.Done():
+		log.Printf("Shutting down, waiting up to %v for requests in flight...\n", shutdownTimeout)
+	}
+	// Another signal kills the server at once.
+	stop()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("[WARN] Requests still in flight were cut off: %v\n", err)
+	}
+	if !c.donationHandler.Drain(shutdownCtx) {
+		log.Println("[WARN] Notifications over the webhook budget did not finish in time, they stay dead letters.")
+	}
+	if !wait(shutdownCtx, &background) {
+		log.Println("[WARN] Background jobs did not stop in time.")
+	}
+	closers.close(flushTimeout)
+	log.Println("The server stopped.")
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// components are the parts of the server main wires together, shared by the
+// helpers setting up its jobs, payments and routes.
+type components struct {
+	stores          *stores
+	features        *feature.Flags
+	monitor         *health.Monitor
+	clientIPHeader  clientip.Header
+	scheduled       *scheduledJobs
+	dualWriter      *shadow.DualWriter
+	redriveNotifier notifier.Notifier
+	donationHandler *handler.DonationHandler
+	// Set by paymentOptions.
+	currencies    []currency.Currency
+	killSwitch    *killswitch.Switch
+	funnelTracker *funnel.Tracker
+	kioskGate     *kiosk.Gate
+	// goBackground runs a function until the server stops.
+	goBackground func(run func(ctx context.Context))
+}
 
+// configureStripe sets up the Stripe client and returns how long a call to
+// Stripe may take.
+func configureStripe(environment string) time.Duration {
+	stripe.Key = cfg.Get("STRIPE_SECRET_KEY")
 	// For sample support and debugging, not required for production:
 	stripe.SetAppInfo(&stripe.AppInfo{
 		Name:    "stripe-samples/accept-a-payment/payment-element",
@@ -37,33 +374,2111 @@ func main() {
 		URL:     "https://github.com/vedrankolka/donation-server",
 	})
 
-	// Kafka client for sending events about confirmed payments.
-	notifier, err := kafka.NewKafkaNotifier(strings.Split(bootstrapServers, ","), customersTopic, kafkaUsername, kafkaPassword)
+	// Fault injection into Stripe calls, for resilience testing outside of production.
+	var stripeTransport http.RoundTripper = http.DefaultTransport
+	if stripeFaults := newFaultInjector("stripe", environment); stripeFaults != nil {
+		stripeTransport = &fault.Transport{Base: stripeTransport, Injector: stripeFaults}
+	}
+	// The latency of Stripe calls is recorded on /metrics.
+	stripe.SetBackend(stripe.APIBackend, stripe.GetBackendWithConfig(stripe.APIBackend, &stripe.BackendConfig{
+		HTTPClient: &http.Client{
+			Timeout:   80 * time.Second,
+			Transport: &payments.Transport{Base: stripeTransport},
+		},
+	}))
+
+	// Every call to Stripe is limited, so a slow Stripe API cannot hold webhooks and donors waiting.
+	stripeTimeout := payments.DefaultTimeout
+	if cfg.Get("DONATION_SERVER_STRIPE_TIMEOUT") != "" {
+		if stripeTimeout = cfg.Duration("DONATION_SERVER_STRIPE_TIMEOUT"); stripeTimeout <= 0 {
+			log.Fatalf("DONATION_SERVER_STRIPE_TIMEOUT must be a duration like 10s")
+		}
+	}
+	return stripeTimeout
+}
+
+// stores are the stores of the server. Donations, dead letters and the state
+// of jobs are kept in memory, and in Postgres too if there is a database.
+type stores struct {
+	// memory keeps the event log, tags, interactions, rollups and reports.
+	memory    *store.MemoryStore
+	database  *store.PostgresStore
+	donations store.DonationStore
+	customers store.CustomerStore
+	jobs      store.JobStore
+	// Partners, kiosks, donation links, campaigns, invoices, receipts, OAuth
+	// clients and webhook subscriptions are kept in Postgres too, so they
+	// work on every instance and after restarts.
+	partners      store.PartnerStore
+	kiosks        store.KioskStore
+	links         store.LinkStore
+	campaigns     store.CampaignStore
+	invoices      store.InvoiceStore
+	receipts      store.ReceiptStore
+	oauth         store.OAuthStore
+	subscriptions store.SubscriptionStore
+	// Notifications that could not be delivered are dead-lettered, durably
+	// in a sink if there is one, so their webhook events are acknowledged.
+	deadLetters        store.DeadLetterStore
+	durableDeadLetters bool
+}
+
+// newStores opens the stores of the server, which the teardown closes.
+func newStores(closers *teardown) *stores {
+	memory := store.NewMemoryStore()
+	closers.addStore("memory store", memory)
+	st := &stores{
+		memory:        memory,
+		donations:     memory,
+		customers:     memory,
+		jobs:          memory,
+		partners:      memory,
+		kiosks:        memory,
+		links:         memory,
+		campaigns:     memory,
+		invoices:      memory,
+		receipts:      memory,
+		oauth:         memory,
+		subscriptions: memory,
+		deadLetters:   memory,
+	}
+	if url := cfg.Get("DONATION_SERVER_DATABASE_URL"); url != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		database, err := store.OpenPostgres(ctx, url)
+		cancel()
+		if err != nil {
+			log.Fatalf("Could not open the database: %v", err)
+		}
+		st.database = database
+	}
+	if kind := cfg.Get("DONATION_SERVER_DEAD_LETTER_SINK"); kind != "" {
+		deadLetterStore, err := newDeadLetterStore(kind, memory, st.database)
+		if err != nil {
+			log.Fatalf("Could not open the dead-letter sink: %v", err)
+		}
+		closers.addStore("dead-letter sink", deadLetterStore)
+		st.deadLetters = deadLetterStore
+		st.durableDeadLetters = true
+	}
+
+	// Ledger of all donations, durable in Postgres if there is a database.
+	piiKeys, err := newPIIKeys()
+	if err != nil {
+		log.Fatalf("Invalid PII keys: %v", err)
+	}
+	if piiKeys != nil && st.database == nil {
+		log.Println("[WARN] PII keys are set without DONATION_SERVER_DATABASE_URL, donations are only kept in memory and not encrypted.")
+	}
+	if database := st.database; database != nil {
+		// Donors' names, emails and addresses are encrypted in the database if there are keys.
+		var durable store.DonationStore = database
+		if piiKeys != nil {
+			durable = pii.NewDonationStore(database, piiKeys)
+			log.Printf("Personal data of donors is encrypted in the database with key %s.\n", piiKeys.Primary())
+		}
+		ledger := store.NewLedger(memory, durable)
+		closers.addStore("Postgres ledger", ledger)
+		st.donations, st.customers = ledger, ledger
+		st.jobs = database
+		log.Println("Donations are recorded in Postgres.")
+
+		st.partners, st.kiosks, st.links, st.campaigns = database, database, database, database
+		st.invoices, st.receipts, st.oauth, st.subscriptions = database, database, database, database
+	}
+	// Financially relevant changes are appended to a hash-chained log for audits.
+	if path := cfg.Get("DONATION_SERVER_AUDIT_LOG"); path != "" {
+		auditLog, err := auditlog.Open(path)
+		if err != nil {
+			log.Fatalf("Could not open the audit log: %v", err)
+		}
+		st.donations = auditlog.NewDonationStore(st.donations, auditLog)
+		st.invoices = auditlog.NewInvoiceStore(st.invoices, auditLog)
+		entries, head := auditLog.Head()
+		log.Printf("Donations and invoices are audited to %s, %d entries up to %.12s.\n", path, entries, head)
+	}
+	return st
+}
+
+// newDonationNotifier returns the notifier of donations: every notifier of
+// DONATION_SERVER_NOTIFIER, each checked by the monitor and tracked against
+// its SLA, with the dual-write, shadow and validation wrapping them. The
+// dual writer is nil without a dual-write.
+func newDonationNotifier(primaryNotifier string, cloudEvents *cloudevents.Config, deadLetters store.DeadLetterStore, monitor *health.Monitor) (notifier.Notifier, *shadow.DualWriter, error) {
+	// Delivery success rates and latencies of the notifiers, alerted when below their SLA.
+	slaTracker, err := newSLATracker()
+	if err != nil {
+		log.Fatalf("Could not configure notifier SLAs: %v", err)
+	}
+	notifierFaults := newFaultInjector("notifier", cfg.Get("DONATION_SERVER_ENVIRONMENT"))
+	retryOptions, err := newRetryOptions()
+	if err != nil {
+		log.Fatalf("Could not configure notifier retries: %v", err)
+	}
+	var sinks []notifier.Sink
+	for _, kind := range notifierKinds(primaryNotifier) {
+		n, err := newNotifier(kind, cloudEvents, handler.DeadLetterFunc(deadLetters))
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s notifier: %w", kind, err)
+		}
+		monitor.Add(health.Component{
+			Name:   kind + " notifier",
+			Impact: health.ImpactReceiptsDelayed,
+			Check:  notifierHealthCheck(kind, n, slaTracker),
+		})
+		if notifierFaults != nil {
+			n = fault.NewNotifier(n, notifierFaults)
+		}
+		// Retries are tracked as one notification, delivered or failed, and traced as one span.
+		n = notifier.WithTracing(notifier.WithRetry(n, retryOptions...), kind)
+		sinks = append(sinks, notifier.Sink{Name: kind, Notifier: slaTracker.Track(kind, n)})
+	}
+	var donationNotifier notifier.Notifier = sinks[0].Notifier
+	if len(sinks) > 1 {
+		var opts []notifier.MultiOption
+		switch mode := cfg.Get("DONATION_SERVER_NOTIFIER_MODE"); mode {
+		case "", "best-effort":
+		case "fail-fast":
+			opts = append(opts, notifier.FailFast())
+		default:
+			log.Fatalf("DONATION_SERVER_NOTIFIER_MODE must be best-effort or fail-fast, not %q", mode)
+		}
+		log.Printf("Notifications are sent to %s.\n", strings.Join(notifierKinds(primaryNotifier), ", "))
+		donationNotifier = notifier.NewMulti(sinks, opts...)
+	}
+	// Optional dual-write to a second notifier, to migrate between them.
+	var dualWriter *shadow.DualWriter
+	if secondaryNotifier := cfg.Get("DONATION_SERVER_DUAL_WRITE_NOTIFIER"); secondaryNotifier != "" {
+		secondary, err := newNotifier(secondaryNotifier, cloudEvents, handler.DeadLetterFunc(deadLetters))
+		if err != nil {
+			log.Fatalf("Could not construct %s notifier: %v", secondaryNotifier, err)
+		}
+		log.Printf("Notifications are written to %s and %s.\n", primaryNotifier, secondaryNotifier)
+		secondary = notifier.WithRetry(secondary, retryOptions...)
+		dualWriter = shadow.NewDualWriter(primaryNotifier, donationNotifier, secondaryNotifier, slaTracker.Track(secondaryNotifier, secondary))
+		donationNotifier = dualWriter
+	}
+	if url := cfg.Get("DONATION_SERVER_SHADOW_NOTIFIER_URL"); url != "" {
+		var opts []webhook.Option
+		if cloudEvents != nil {
+			opts = append(opts, webhook.WithCloudEvents(cloudEvents))
+		}
+		shadowNotifier, err := webhook.NewWebhookNotifier(url, opts...)
+		if err != nil {
+			log.Fatalf("Could not construct shadow notifier: %v", err)
+		}
+		log.Println("Notifications are mirrored to the shadow notifier.")
+		donationNotifier = shadow.NewNotifier(donationNotifier, shadowNotifier)
+	}
+	if cfg.Bool("DONATION_SERVER_DEBUG") {
+		log.Println("Debug mode: events are validated against their JSON Schemas.")
+		donationNotifier = schema.NewValidatingNotifier(donationNotifier)
+	}
+	return donationNotifier, dualWriter, nil
+}
+
+// scheduledJobs are the background jobs of the server, with the engines the
+// admin API manages. The report scheduler, retention engine and auto-refund
+// engine are nil unless they are configured.
+type scheduledJobs struct {
+	dispatcher  *subscription.Dispatcher
+	reports     *report.Scheduler
+	aggregator  *rollup.Aggregator
+	retention   *retention.Engine
+	autoRefunds *autorefund.Engine
+}
+
+// startJobs starts the background jobs of the server. They run on every
+// instance, or only on the leader if replicas elect one.
+func startJobs(c *components, provider payments.Provider, cloudEvents *cloudevents.Config, closers *teardown) *scheduledJobs {
+	st := c.stores
+	var elector *leader.Elector
+	if cfg.Bool("DONATION_SERVER_LEADER_ELECTION") {
+		// The lease must be shared by the replicas, every one would be the
+		// leader of its own memory store.
+		if st.database == nil {
+			log.Fatalf("DONATION_SERVER_LEADER_ELECTION requires DONATION_SERVER_DATABASE_URL")
+		}
+		elector = leader.NewElector(st.database, leader.Holder(cfg.Get("DONATION_SERVER_INSTANCE_ID")))
+	}
+	runJob := func(job func(ctx context.Context)) {
+		if elector != nil {
+			elector.Go(job)
+			return
+		}
+		c.goBackground(job)
+	}
+	// Jobs of the scheduler run at their times from their state in the store,
+	// each on one instance at a time, delayed by a random jitter.
+	jobScheduler := jobs.NewScheduler(st.jobs, leader.Holder(cfg.Get("DONATION_SERVER_INSTANCE_ID")))
+	jobJitter := time.Minute
+	if cfg.Get("DONATION_SERVER_JOB_JITTER") != "" {
+		if jobJitter = cfg.Duration("DONATION_SERVER_JOB_JITTER"); jobJitter < 0 {
+			log.Fatalf("DONATION_SERVER_JOB_JITTER must be a duration like 1m")
+		}
+	}
+	scheduleJob := func(job jobs.Job) {
+		job.Jitter = jobJitter
+		jobScheduler.Add(job)
+	}
+	scheduled := &scheduledJobs{}
+
+	// Events are delivered to the webhook subscriptions of third parties.
+	scheduled.dispatcher = subscription.NewDispatcher(st.subscriptions)
+	runJob(scheduled.dispatcher.Run)
+
+	// Scheduled reports, delivered only with a report notifier.
+	if kind := cfg.Get("DONATION_SERVER_REPORT_NOTIFIER"); kind != "" {
+		n, err := newNotifier(kind, cloudEvents, nil)
+		if err != nil {
+			log.Fatalf("Could not create report notifier: %v", err)
+		}
+		closers.addNotifier(kind+" report notifier", n)
+		reportNotifier, ok := n.(notifier.ReportNotifier)
+		if !ok {
+			log.Fatalf("The %s notifier cannot deliver reports", kind)
+		}
+		scheduled.reports = report.NewScheduler(st.memory, st.donations, reportNotifier)
+		jobScheduler.Add(scheduled.reports.Job())
+		log.Printf("Scheduled reports are delivered with the %s notifier.\n", kind)
+	}
+
+	// Hourly and daily rollups of donations, backfilled on startup, answer the statistics endpoints.
+	// Refunds of donations older than its refresh window recompute their day.
+	scheduled.aggregator = rollup.NewAggregator(st.donations, st.memory)
+	runJob(scheduled.aggregator.Run)
+
+	// Retention policies archiving old donations, scheduled as dry runs unless disabled.
+	if path := cfg.Get("DONATION_SERVER_RETENTION_POLICIES"); path != "" {
+		policies, err := retention.LoadPolicies(path)
+		if err != nil {
+			log.Fatalf("Could not load retention policies: %v", err)
+		}
+		dir := cfg.Get("DONATION_SERVER_ARCHIVE_DIR")
+		if dir == "" {
+			log.Fatalf("DONATION_SERVER_ARCHIVE_DIR is required with retention policies")
+		}
+		dryRun := cfg.Bool("DONATION_SERVER_RETENTION_DRY_RUN")
+		var retentionOptions []retention.Option
+		if expr := cfg.Get("DONATION_SERVER_RETENTION_SCHEDULE"); expr != "" {
+			schedule, err := clock.ParseCron(expr)
+			if err != nil {
+				log.Fatalf("DONATION_SERVER_RETENTION_SCHEDULE: %v", err)
+			}
+			retentionOptions = append(retentionOptions, retention.WithSchedule(schedule))
+		}
+		scheduled.retention = retention.NewEngine(st.donations, &retention.FileSink{Dir: dir}, policies, dryRun, retentionOptions...)
+		scheduleJob(scheduled.retention.Job())
+		log.Printf("%d retention policies archive donations to %s (dry run: %t).\n", len(policies), dir, dryRun)
+	}
+
+	// Rules refunding donations of blocked countries and donations reviewers cancel, audited to a file.
+	if path := cfg.Get("DONATION_SERVER_AUTO_REFUND_RULES"); path != "" {
+		rules, err := autorefund.LoadRules(path)
+		if err != nil {
+			log.Fatalf("Could not load auto-refund rules: %v", err)
+		}
+		auditLog := cfg.Get("DONATION_SERVER_AUTO_REFUND_AUDIT_LOG")
+		if auditLog == "" {
+			log.Fatalf("DONATION_SERVER_AUTO_REFUND_AUDIT_LOG is required with auto-refund rules")
+		}
+		scheduled.autoRefunds = autorefund.NewEngine(provider, st.donations, &autorefund.FileAuditLog{Path: auditLog}, rules)
+		log.Printf("%d auto-refund rules refund donations, audited to %s.\n", len(rules), auditLog)
+	}
+
+	// Daily digest of the previous day's donations, posted to a chat webhook.
+	if url := cfg.Get("DONATION_SERVER_DIGEST_WEBHOOK_URL"); url != "" {
+		schedule, err := dailySchedule("DONATION_SERVER_DIGEST", 7*time.Hour)
+		if err != nil {
+			log.Fatalf("Could not schedule the digest: %v", err)
+		}
+		digestScheduler := digest.NewScheduler(st.donations, st.customers, &sla.WebhookAlerter{URL: url}, schedule)
+		scheduleJob(digestScheduler.Job())
+		log.Printf("The digest is sent at %q UTC.\n", schedule)
+	}
+
+	// Early warning of fraud or broken donation pages.
+	if cfg.Bool("DONATION_SERVER_ANOMALY_DETECTION") {
+		detector, err := newAnomalyDetector(st.donations)
+		if err != nil {
+			log.Fatalf("Could not set up anomaly detection: %v", err)
+		}
+		scheduleJob(detector.Job())
+		log.Printf("The donations of the last %v are checked for anomalies.\n", detector.Window())
+	}
+
+	// Anniversary and milestone emails to donors, rendered here and sent by a notifier.
+	if kind := cfg.Get("DONATION_SERVER_LIFECYCLE_NOTIFIER"); kind != "" {
+		n, err := newNotifier(kind, cloudEvents, nil)
+		if err != nil {
+			log.Fatalf("Could not create lifecycle notifier: %v", err)
+		}
+		closers.addNotifier(kind+" lifecycle notifier", n)
+		emailNotifier, ok := n.(notifier.EmailNotifier)
+		if !ok {
+			log.Fatalf("The %s notifier cannot send emails", kind)
+		}
+		lifecycleScheduler, err := newLifecycleScheduler(st.customers, emailNotifier)
+		if err != nil {
+			log.Fatalf("Could not configure lifecycle emails: %v", err)
+		}
+		scheduleJob(lifecycleScheduler.Job())
+		log.Printf("Lifecycle emails are sent with the %s notifier.\n", kind)
+	}
+	if jobScheduler.Len() > 0 {
+		runJob(jobScheduler.Run)
+	}
+	if elector != nil {
+		c.goBackground(elector.Run)
+	}
+	return scheduled
+}
+
+// paymentOptions returns the options of the donation handler about taking
+// payments: its stores, checks of donors, taxes, currencies, payment methods
+// and the ways donors pay. It sets the currencies, kill switch, funnel
+// tracker and kiosk gate of the components.
+func paymentOptions(c *components, provider payments.Provider, stripeTimeout time.Duration, cloudEvents *cloudevents.Config, closers *teardown) []handler.Option {
+	st := c.stores
+	handlerOptions := []handler.Option{
+		handler.WithProvider(provider),
+		handler.WithStore(st.donations),
+		handler.WithEventLog(st.memory),
+		handler.WithDeadLetters(st.deadLetters),
+		handler.WithCampaigns(st.campaigns),
+		handler.WithRollups(c.scheduled.aggregator),
+		handler.WithClientIPHeader(c.clientIPHeader),
+	}
+	if c.scheduled.autoRefunds != nil {
+		handlerOptions = append(handlerOptions, handler.WithAutoRefunds(c.scheduled.autoRefunds))
+	}
+	if st.durableDeadLetters {
+		handlerOptions = append(handlerOptions, handler.WithDeadLetterAcks())
+	}
+	// Stripe is answered in time even if a notifier is slow, the
+	// notifications are kept as dead letters until they are delivered.
+	if cfg.Get("DONATION_SERVER_WEBHOOK_BUDGET") != "" {
+		d := cfg.Duration("DONATION_SERVER_WEBHOOK_BUDGET")
+		if d <= 0 {
+			log.Fatalf("DONATION_SERVER_WEBHOOK_BUDGET must be a duration like 1s")
+		}
+		if !st.durableDeadLetters {
+			log.Fatalf("DONATION_SERVER_WEBHOOK_BUDGET requires a DONATION_SERVER_DEAD_LETTER_SINK")
+		}
+		handlerOptions = append(handlerOptions, handler.WithWebhookBudget(d))
+		log.Printf("Webhook notifications taking longer than %v are finished after acknowledging the event.\n", d)
+	}
+
+	if path := cfg.Get("DONATION_SERVER_DENIED_PARTIES_CSV"); path != "" {
+		deniedParties, err := screening.LoadCSVList(path)
+		if err != nil {
+			log.Fatalf("Could not load denied-party list: %v", err)
+		}
+		log.Printf("Screening customers against %d denied-party list entries.\n", deniedParties.Len())
+		handlerOptions = append(handlerOptions, handler.WithScreening(deniedParties))
+	}
+	var validator address.Validator = address.BasicValidator{}
+	if url := cfg.Get("DONATION_SERVER_ADDRESS_VALIDATION_URL"); url != "" {
+		validator = address.Chain{validator, &address.HTTPValidator{URL: url}}
+	}
+	requireAddress := cfg.Bool("DONATION_SERVER_REQUIRE_ADDRESS")
+	handlerOptions = append(handlerOptions, handler.WithAddressValidation(validator, requireAddress))
+
+	var vatConfig *vat.Config
+	if path := cfg.Get("DONATION_SERVER_VAT_CONFIG"); path != "" {
+		var err error
+		if vatConfig, err = vat.LoadConfig(path); err != nil {
+			log.Fatalf("Could not load VAT config: %v", err)
+		}
+		log.Printf("Purchases of %d products are enabled.\n", len(vatConfig.Products))
+	}
+	if cfg.Bool("DONATION_SERVER_STRIPE_TAX") {
+		if vatConfig == nil {
+			log.Println("[WARN] Stripe Tax is enabled without a VAT config, invoices will have no seller.")
+			vatConfig = &vat.Config{}
+		}
+		calculator := &stripetax.Calculator{
+			Config:          vatConfig,
+			DonationTaxCode: cfg.Get("DONATION_SERVER_STRIPE_TAX_DONATION_CODE"),
+			Behavior:        cfg.Get("DONATION_SERVER_STRIPE_TAX_BEHAVIOR"),
+			Timeout:         stripeTimeout,
+		}
+		log.Println("Taxes are calculated by Stripe Tax.")
+		handlerOptions = append(handlerOptions, handler.WithVAT(vatConfig, calculator, st.invoices), handler.WithTaxedDonations())
+	} else if vatConfig != nil {
+		calculator := &vat.InternalCalculator{Config: vatConfig}
+		handlerOptions = append(handlerOptions, handler.WithVAT(vatConfig, calculator, st.invoices))
+	}
+	// Donations are taken in EUR unless other currencies are allowed, the first is the default,
+	// within Stripe's minimum amounts unless narrower limits are configured.
+	currencies, err := newCurrencies()
+	if err != nil {
+		log.Fatalf("Invalid currencies: %v", err)
+	}
+	if currencies != nil {
+		c.currencies = currencies
+		handlerOptions = append(handlerOptions, handler.WithCurrencies(currencies))
+		for _, cur := range currencies {
+			limits := "from " + currency.Format(cur.MinimumAmount, cur.Code)
+			if cur.MaximumAmount > 0 {
+				limits += " to " + currency.Format(cur.MaximumAmount, cur.Code)
+			}
+			log.Printf("Donations are taken in %s %s.\n", cur.Code, limits)
+		}
+	}
+	if path := cfg.Get("DONATION_SERVER_ERROR_CATALOG"); path != "" {
+		catalog, err := errcatalog.Load(path)
+		if err != nil {
+			log.Fatalf("Invalid DONATION_SERVER_ERROR_CATALOG: %v", err)
+		}
+		log.Printf("Donors get payment errors in %s.\n", strings.Join(catalog.Languages(), ", "))
+		handlerOptions = append(handlerOptions, handler.WithErrorCatalog(catalog))
+	}
+	// Donations through the provider or some of its payment methods can be
+	// paused by admins, e.g. during an incident of the provider.
+	if c.killSwitch, err = newKillSwitch(); err != nil {
+		log.Fatalf("Could not configure the kill switch: %v", err)
+	}
+	handlerOptions = append(handlerOptions, handler.WithKillSwitch(c.killSwitch))
+	if cfg.Bool("DONATION_SERVER_PAYMENT_INTENT_FALLBACK") {
+		log.Println("Payment intents Stripe rejects are retried with cards only.")
+		handlerOptions = append(handlerOptions, handler.WithPaymentIntentFallback())
+	}
+	// Cookie-free analytics of how many donors drop off before paying.
+	if cfg.Bool("DONATION_SERVER_FUNNEL_ANALYTICS") {
+		c.funnelTracker = funnel.NewTracker()
+		handlerOptions = append(handlerOptions, handler.WithFunnel(c.funnelTracker))
+		log.Println("The anonymous sessions of the donation page are counted in the donation funnel.")
+	}
+	// Likely accidental duplicate donations are flagged, and their donors offered a refund by email.
+	if cfg.Get("DONATION_SERVER_DUPLICATE_WINDOW") != "" {
+		option, emails, err := newDuplicateDetection(cfg.Duration("DONATION_SERVER_DUPLICATE_WINDOW"), cloudEvents)
+		if err != nil {
+			log.Fatalf("Could not configure duplicate detection: %v", err)
+		}
+		if emails != nil {
+			closers.addNotifier("duplicate refund notifier", emails)
+		}
+		handlerOptions = append(handlerOptions, option)
+	}
+	// Receipts of donations, emailed to donors or written to a directory.
+	if cfg.Get("DONATION_SERVER_RECEIPT_NOTIFIER") != "" || cfg.Get("DONATION_SERVER_RECEIPT_DIR") != "" {
+		issuer, emails, err := newReceiptIssuer(cloudEvents)
+		if err != nil {
+			log.Fatalf("Could not configure receipts: %v", err)
+		}
+		if emails != nil {
+			closers.addNotifier("receipt notifier", emails)
+		}
+		handlerOptions = append(handlerOptions, handler.WithReceipts(issuer, st.receipts))
+	}
+	if path := cfg.Get("DONATION_SERVER_RECURRING_CONFIG"); path != "" {
+		recurringConfig, err := recurring.LoadConfig(path)
+		if err != nil {
+			log.Fatalf("Could not load recurring donation config: %v", err)
+		}
+		log.Printf("Donors can subscribe to %d tiers of recurring donations.\n", len(recurringConfig.Tiers))
+		handlerOptions = append(handlerOptions, handler.WithRecurring(recurringConfig))
+	}
+
+	// Donors can be redirected to a payment page hosted by Stripe Checkout instead.
+	if successURL := cfg.Get("DONATION_SERVER_CHECKOUT_SUCCESS_URL"); successURL != "" {
+		cancelURL, err := checkoutCancelURL(successURL)
+		if err != nil {
+			log.Fatalf("Could not configure Checkout: %v", err)
+		}
+		log.Println("Donors can pay on Stripe Checkout with /create-checkout-session.")
+		handlerOptions = append(handlerOptions, handler.WithCheckout(successURL, cancelURL))
+	}
+
+	// Donations at physical events are paid with Stripe Terminal card readers.
+	if location := cfg.Get("DONATION_SERVER_TERMINAL_LOCATION"); location != "" {
+		log.Printf("Staff can take in-person donations with the card readers of %s.\n", location)
+		handlerOptions = append(handlerOptions, handler.WithTerminal(location, cfg.Get("DONATION_SERVER_TERMINAL_CUSTOMER")))
+	}
+	// Donation tablets at venues authenticate with their device keys, see /admin/kiosks.
+	c.kioskGate = kiosk.NewGate(st.kiosks)
+	handlerOptions = append(handlerOptions, handler.WithKiosks(st.kiosks, c.kioskGate))
+	// Donations made with donation links are attributed to them and count their uses.
+	handlerOptions = append(handlerOptions, handler.WithLinks(st.links))
+	return handlerOptions
+}
+
+// securityMiddleware returns the middleware setting security headers on
+// every response, and the one of pages embedded on other sites, which may be
+// framed.
+func securityMiddleware() (secure, embeddable func(http.HandlerFunc) http.HandlerFunc) {
+	if !cfg.Bool("DONATION_SERVER_SECURITY_HEADERS") {
+		return passThrough, passThrough
+	}
+	policy, embedPolicy, err := securityPolicies()
+	if err != nil {
+		log.Fatalf("Invalid security headers: %v", err)
+	}
+	return secheaders.Middleware(policy), secheaders.Middleware(embedPolicy)
+}
+
+// publicRoutes registers the routes of donors, partners and kiosks, and of
+// monitoring, and returns the handlers of donation links and campaigns whose
+// admin routes adminRoutes registers.
+func publicRoutes(routes *router.Router, c *components, embeddable func(http.HandlerFunc) http.HandlerFunc) (*handler.LinkHandler, *handler.CampaignHandler) {
+	dh := c.donationHandler
+	blocker, err := newBlocker(c.clientIPHeader)
+	if err != nil {
+		log.Fatalf("Could not configure IP and country blocking: %v", err)
+	}
+	if blocker.Enabled() {
+		log.Println("IP and country blocking is enabled for /create-payment-intent.")
+	}
+	// Clients over the rate limit get 429 Too Many Requests. Requests with a
+	// partner key are limited by the partner's own limits instead.
+	limiter, err := newRateLimiter(c.clientIPHeader)
+	if err != nil {
+		log.Fatalf("Could not configure rate limiting: %v", err)
+	}
+	rateLimit := func(next http.HandlerFunc) http.HandlerFunc {
+		if limiter == nil {
+			return next
+		}
+		limited := limiter.Middleware(next)
+		return func(w http.ResponseWriter, r *http.Request) {
+			if partner.ID(r.Context()) != "" {
+				next(w, r)
+				return
+			}
+			limited(w, r)
+		}
+	}
+
+	// Public read endpoints are cacheable, their content only changes with a restart.
+	cacheMaxAge := httpcache.DefaultMaxAge
+	if cfg.Get("DONATION_SERVER_CACHE_MAX_AGE") != "" {
+		cacheMaxAge = cfg.Duration("DONATION_SERVER_CACHE_MAX_AGE")
+	}
+	cache := httpcache.Middleware(cacheMaxAge, time.Now())
+
+	routes.HandleFunc("/config", cache(dh.HandleConfig), http.MethodGet)
+	// Donations made with a partner's API key are attributed to the partner.
+	partnerGate := partner.NewGate(c.stores.partners)
+	routes.HandleFunc("/create-payment-intent", blocker.Middleware(partnerGate.Middleware(rateLimit(dh.HandleCreatePaymentIntent))), http.MethodPost)
+	routes.HandleFunc("/create-checkout-session", blocker.Middleware(partnerGate.Middleware(rateLimit(dh.HandleCreateCheckoutSession))), http.MethodPost)
+	routes.HandleFunc("/create-subscription", blocker.Middleware(partnerGate.Middleware(rateLimit(dh.HandleCreateSubscription))), http.MethodPost)
+	roundUp := c.features.Middleware(feature.RoundUp, func(r *http.Request) string {
+		return clientip.FromRequest(r, c.clientIPHeader).String()
+	})
+	routes.HandleFunc("/round-up", roundUp(blocker.Middleware(partnerGate.Middleware(rateLimit(dh.HandleRoundUp)))), http.MethodGet, http.MethodPost)
+	routes.HandleFunc("/kiosk/config", c.kioskGate.Middleware(dh.HandleKioskConfig), http.MethodGet)
+	routes.HandleFunc("/kiosk/payment-intents", c.kioskGate.Middleware(rateLimit(dh.HandleKioskPayment)), http.MethodPost)
+	routes.HandleFunc("/kiosk/reconcile", c.kioskGate.Middleware(dh.HandleKioskReconcile), http.MethodPost)
+	routes.HandleFunc("/kiosk/refunds", c.kioskGate.Middleware(rateLimit(dh.HandleKioskRefund)), http.MethodPost)
+	// Donation links pre-configure the donation page, e.g. for appeals. Their
+	// short URLs record clicks, with countries known to the blocker.
+	linkHandler := handler.NewLinkHandler(c.stores.links, cfg.Get("DONATION_SERVER_PUBLIC_URL"), c.currencies, blocker.Country)
+	routes.HandleFunc("/links/", linkHandler.HandleLink, http.MethodGet)
+	// Donations in other currencies count towards campaign targets with exchange rates.
+	var exchangeRates *currency.ExchangeRates
+	if url := cfg.Get("DONATION_SERVER_EXCHANGE_RATES_URL"); url != "" {
+		exchangeRates = currency.NewExchangeRates(url)
+	}
+	campaignHandler := handler.NewCampaignHandler(c.stores.campaigns, exchangeRates)
+	// Progress changes with every donation, so it is cached briefly and
+	// without a Last-Modified, which would be the start of the server.
+	progressCache := httpcache.Middleware(handler.ProgressMaxAge, time.Time{})
+	routes.HandleFunc("/campaigns/", progressCache(campaignHandler.HandleProgress), http.MethodGet, http.MethodHead)
+	routes.HandleFunc("/d/", linkHandler.HandleRedirect, http.MethodGet, http.MethodHead)
+	routes.HandleFunc(handler.DuplicateRefundPath, dh.HandleRefundDuplicate, http.MethodGet, http.MethodPost)
+	routes.HandleFunc("/", embeddable(static.HandleIndex), http.MethodGet, http.MethodHead)
+	routes.HandleFunc(static.Prefix, embeddable(static.Handler), http.MethodGet, http.MethodHead)
+	// Metrics require the credentials of the admin API unless they are made public.
+	if cfg.Bool("DONATION_SERVER_METRICS_PUBLIC") {
+		routes.HandleFunc("/metrics", metrics.Handler, http.MethodGet)
+	}
+	routes.HandleFunc("/healthz", c.monitor.Handler, http.MethodGet, http.MethodHead)
+	routes.HandleFunc("/schemas", cache(schema.Handler), http.MethodGet)
+	routes.HandleFunc("/schemas/", cache(schema.Handler), http.MethodGet)
+	return linkHandler, campaignHandler
+}
+
+// adminRoutes registers the routes of the administrative API, only enabled
+// with an API key or JWTs.
+func adminRoutes(routes *router.Router, c *components, linkHandler *handler.LinkHandler, campaignHandler *handler.CampaignHandler) {
+	metricsPublic := cfg.Bool("DONATION_SERVER_METRICS_PUBLIC")
+	authOptions, err := newAdminAuth()
 	if err != nil {
-		log.Printf("Could not construct KafkaNotifier: %v\n", err)
+		log.Fatalf("Invalid admin API authentication: %v", err)
+	}
+	if authOptions == nil {
+		if !metricsPublic {
+			log.Println("[WARN] /metrics is disabled, it requires an admin API key or JWTs unless DONATION_SERVER_METRICS_PUBLIC=true.")
+		}
+		log.Println("[WARN] Neither DONATION_SERVER_ADMIN_API_KEY nor JWT keys are set, the admin API is disabled.")
 		return
 	}
 
-	donationHandler, err := handler.NewHandler(publishableKey, webhookSecret, notifier)
+	st, dh := c.stores, c.donationHandler
+	// Third-party tools get scoped tokens from the OAuth server instead of the API key.
+	var oauthServer *oauth.Server
+	if cfg.Bool("DONATION_SERVER_OAUTH") {
+		log.Println("OAuth tokens are accepted by the admin API.")
+		oauthServer = oauth.NewServer(st.oauth, auth.NewAuthenticator(auth.WithAPIKeys(adminAPIKeys()...)).MatchAPIKey)
+		authOptions = append(authOptions, auth.WithFallback(oauthServer.Require))
+	}
+	requireAdmin := auth.NewAuthenticator(authOptions...).Require
+	if oauthServer != nil {
+		routes.HandleFunc("/oauth/token", oauthServer.HandleToken, http.MethodPost)
+		routes.HandleFunc("/oauth/authorize", oauthServer.HandleAuthorize, http.MethodGet, http.MethodPost)
+		routes.HandleFunc("/oauth/revoke", oauthServer.HandleRevoke, http.MethodPost)
+		oauthClientHandler := handler.NewOAuthClientHandler(st.oauth)
+		routes.HandleFunc("/admin/oauth/clients", requireAdmin(oauthClientHandler.HandleClients), http.MethodGet, http.MethodPost)
+		routes.HandleFunc("/admin/oauth/clients/", requireAdmin(oauthClientHandler.HandleClients), http.MethodGet, http.MethodPost, http.MethodDelete)
+	}
+	if !metricsPublic {
+		routes.HandleFunc("/metrics", requireAdmin(metrics.Handler), http.MethodGet)
+	}
+	eventLogHandler := handler.NewEventLogHandler(st.memory)
+	routes.HandleFunc("/admin/events", requireAdmin(eventLogHandler.HandleListEvents), http.MethodGet)
+	routes.HandleFunc("/admin/events/", requireAdmin(eventLogHandler.HandleGetEvent), http.MethodGet)
+	ledgerHandler := handler.NewLedgerHandler(st.donations, st.customers, st.memory)
+	routes.HandleFunc("/admin/donations", requireAdmin(ledgerHandler.HandleListDonations), http.MethodGet)
+	routes.HandleFunc("/admin/donations/", requireAdmin(ledgerHandler.HandleDonation), http.MethodGet, http.MethodPut, http.MethodDelete)
+	routes.HandleFunc("/admin/customers", requireAdmin(ledgerHandler.HandleListCustomers), http.MethodGet)
+	routes.HandleFunc("/admin/customers/export", requireAdmin(ledgerHandler.HandleExportCustomers), http.MethodGet)
+	routes.HandleFunc("/admin/donors/search", requireAdmin(ledgerHandler.HandleSearchDonors), http.MethodGet)
+	supportHandler := handler.NewSupportHandler(st.donations)
+	routes.HandleFunc("/support/lookup-charge", requireAdmin(supportHandler.HandleLookupCharge), http.MethodGet)
+	donorHandler := handler.NewDonorHandler(st.customers, st.memory, st.memory)
+	routes.HandleFunc("/admin/donors/", requireAdmin(donorHandler.HandleDonors), http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete)
+	routes.HandleFunc("/admin/features", requireAdmin(c.features.Handler), http.MethodGet)
+	paymentMethodHandler := handler.NewPaymentMethodHandler(c.killSwitch)
+	routes.HandleFunc("/admin/payment-methods", requireAdmin(paymentMethodHandler.HandlePaymentMethods), http.MethodGet)
+	routes.HandleFunc("/admin/payment-methods/", requireAdmin(paymentMethodHandler.HandlePaymentMethods), http.MethodPut)
+	statsHandler := handler.NewStatsHandler(st.memory)
+	routes.HandleFunc("/admin/stats", requireAdmin(statsHandler.HandleStats), http.MethodGet)
+	routes.HandleFunc("/admin/stats/", requireAdmin(statsHandler.HandleStats), http.MethodGet)
+	routes.HandleFunc("/admin/reviews/", requireAdmin(dh.HandleReview), http.MethodPost)
+	routes.HandleFunc("/admin/refunds/", requireAdmin(dh.HandleRefund), http.MethodPost)
+	routes.HandleFunc("/admin/payment-links", requireAdmin(dh.HandleCreatePaymentLink), http.MethodPost)
+	routes.HandleFunc("/admin/terminal/connection-token", requireAdmin(dh.HandleTerminalConnectionToken), http.MethodPost)
+	routes.HandleFunc("/admin/terminal/readers", requireAdmin(dh.HandleRegisterReader), http.MethodPost)
+	routes.HandleFunc("/admin/terminal/payment-intents", requireAdmin(dh.HandleCreateTerminalPayment), http.MethodPost)
+	if c.scheduled.autoRefunds != nil {
+		autoRefundHandler := handler.NewAutoRefundHandler(c.scheduled.autoRefunds)
+		routes.HandleFunc("/admin/auto-refunds", requireAdmin(autoRefundHandler.HandleAutoRefunds), http.MethodGet)
+		routes.HandleFunc("/admin/auto-refunds/", requireAdmin(autoRefundHandler.HandleAutoRefunds), http.MethodGet, http.MethodPost)
+	}
+	if c.scheduled.retention != nil {
+		retentionHandler := handler.NewRetentionHandler(c.scheduled.retention)
+		routes.HandleFunc("/admin/retention", requireAdmin(retentionHandler.HandleRetention), http.MethodGet)
+		routes.HandleFunc("/admin/retention/", requireAdmin(retentionHandler.HandleRetention), http.MethodGet, http.MethodPost)
+	}
+	jobHandler := handler.NewJobHandler(st.jobs)
+	routes.HandleFunc("/admin/jobs", requireAdmin(jobHandler.HandleJobs), http.MethodGet)
+	routes.HandleFunc("/admin/jobs/", requireAdmin(jobHandler.HandleJobs), http.MethodGet, http.MethodPost)
+	invoiceHandler := handler.NewInvoiceHandler(st.invoices)
+	routes.HandleFunc("/admin/invoices", requireAdmin(invoiceHandler.HandleInvoices), http.MethodGet)
+	routes.HandleFunc("/admin/invoices/", requireAdmin(invoiceHandler.HandleInvoices), http.MethodGet)
+	if c.funnelTracker != nil {
+		funnelHandler := handler.NewFunnelHandler(c.funnelTracker)
+		routes.HandleFunc("/admin/funnel", requireAdmin(funnelHandler.HandleFunnel), http.MethodGet)
+	}
+	digestHandler := handler.NewDigestHandler(st.donations, st.customers)
+	routes.HandleFunc("/admin/digest", requireAdmin(digestHandler.HandleDigest), http.MethodGet)
+	routes.HandleFunc("/admin/links", requireAdmin(linkHandler.HandleLinks), http.MethodGet, http.MethodPost)
+	routes.HandleFunc("/admin/links/", requireAdmin(linkHandler.HandleLinks), http.MethodGet, http.MethodPost, http.MethodDelete)
+	routes.HandleFunc("/admin/campaigns", requireAdmin(campaignHandler.HandleCampaigns), http.MethodGet, http.MethodPost)
+	routes.HandleFunc("/admin/campaigns/", requireAdmin(campaignHandler.HandleCampaigns), http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete)
+	tagHandler := handler.NewTagHandler(st.memory)
+	routes.HandleFunc("/admin/tags", requireAdmin(tagHandler.HandleTags), http.MethodGet, http.MethodPost)
+	routes.HandleFunc("/admin/tags/", requireAdmin(tagHandler.HandleTags), http.MethodGet, http.MethodPost, http.MethodDelete)
+	partnerHandler := handler.NewPartnerHandler(st.partners)
+	routes.HandleFunc("/admin/partners", requireAdmin(partnerHandler.HandlePartners), http.MethodGet, http.MethodPost)
+	routes.HandleFunc("/admin/partners/", requireAdmin(partnerHandler.HandlePartners), http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete)
+	kioskHandler := handler.NewKioskHandler(st.kiosks, c.currencies)
+	routes.HandleFunc("/admin/kiosks", requireAdmin(kioskHandler.HandleKiosks), http.MethodGet, http.MethodPost)
+	routes.HandleFunc("/admin/kiosks/", requireAdmin(kioskHandler.HandleKiosks), http.MethodGet, http.MethodPut, http.MethodDelete)
+	subscriptionHandler := handler.NewSubscriptionHandler(st.subscriptions, c.scheduled.dispatcher)
+	routes.HandleFunc("/admin/subscriptions", requireAdmin(subscriptionHandler.HandleSubscriptions), http.MethodGet, http.MethodPost)
+	routes.HandleFunc("/admin/subscriptions/", requireAdmin(subscriptionHandler.HandleSubscriptions), http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete)
+	reportHandler := handler.NewReportHandler(st.memory, st.donations, c.scheduled.reports)
+	routes.HandleFunc("/admin/reports", requireAdmin(reportHandler.HandleReports), http.MethodGet, http.MethodPost)
+	routes.HandleFunc("/admin/reports/", requireAdmin(reportHandler.HandleReports), http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete)
+	if c.dualWriter != nil {
+		routes.HandleFunc("/admin/notifiers/comparison", requireAdmin(c.dualWriter.HandleReport), http.MethodGet)
+	}
+	deadLetterHandler := handler.NewDeadLetterHandler(st.deadLetters, c.redriveNotifier)
+	routes.HandleFunc("/admin/dead-letters", requireAdmin(deadLetterHandler.HandleDeadLetters), http.MethodGet)
+	routes.HandleFunc("/admin/dead-letters/", requireAdmin(deadLetterHandler.HandleDeadLetters), http.MethodGet, http.MethodPost)
+	// The dashboard holds no data, its API calls send the API key.
+	routes.HandleFunc(adminui.Prefix, adminui.Handler, http.MethodGet, http.MethodHead)
+	log.Printf("The admin dashboard is served at %s.\n", adminui.Prefix)
+}
+
+// webhookRoute registers the route of Stripe's webhooks.
+func webhookRoute(routes *router.Router, c *components) {
+	webhookHandler := c.donationHandler.HandleWebhook
+	if url := cfg.Get("DONATION_SERVER_SHADOW_WEBHOOK_URL"); url != "" {
+		log.Println("Stripe webhooks are mirrored to the shadow endpoint.")
+		webhookHandler = shadow.NewMirror(url).Middleware(webhookHandler)
+	}
+	// Stripe retries webhooks refused during overload instead of waiting for them to time out.
+	maxInFlight := loadshed.DefaultMaxInFlight
+	if cfg.Get("DONATION_SERVER_WEBHOOK_MAX_IN_FLIGHT") != "" {
+		if maxInFlight = int(cfg.Int("DONATION_SERVER_WEBHOOK_MAX_IN_FLIGHT")); maxInFlight < 1 {
+			log.Fatalf("DONATION_SERVER_WEBHOOK_MAX_IN_FLIGHT must be a positive number")
+		}
+	}
+	webhookHandler = loadshed.NewShedder("/webhook", maxInFlight).Middleware(webhookHandler)
+	// Optionally only Stripe's IP addresses may send webhooks, refreshed daily.
+	if cfg.Bool("DONATION_SERVER_STRIPE_IP_ALLOWLIST") {
+		allowlist := stripeip.NewAllowlist(stripeip.URL, &http.Client{Timeout: 10 * time.Second}, c.clientIPHeader)
+		c.goBackground(allowlist.Run)
+		webhookHandler = allowlist.Middleware(webhookHandler)
+		log.Println("Webhooks are only accepted from Stripe's IP addresses.")
+	}
+	routes.HandleFunc("/webhook", webhookHandler, http.MethodPost)
+}
+
+// newServerHandler returns the handler of the server: the routes of the
+// default mux with the middleware every request goes through.
+func newServerHandler(secure func(http.HandlerFunc) http.HandlerFunc) http.Handler {
+	// Responses are compressed unless a proxy in front of the server does it.
+	var server http.Handler = http.DefaultServeMux
+	if cfg.Bool("DONATION_SERVER_COMPRESSION") {
+		server = compress.Middleware(compress.DefaultMinSize, compress.DefaultContentTypes)(http.DefaultServeMux.ServeHTTP)
+	}
+	server = secure(server.ServeHTTP)
+	// Pages on other sites, like those embedding the widget, call the server.
+	corsPolicy, err := newCORSPolicy()
 	if err != nil {
-		log.Fatalf("Could not create DonationHandler: %v", err)
+		log.Fatalf("Invalid CORS settings: %v", err)
+	}
+	server = cors.Middleware(corsPolicy)(server.ServeHTTP)
+	// Requests are traced with their ID, continuing the trace of a traceparent header.
+	server = tracing.Middleware(http.DefaultServeMux)(server.ServeHTTP)
+	// Every request gets an ID, in responses and logs.
+	server = requestid.Middleware(server.ServeHTTP)
+	// Request durations are recorded on /metrics by route.
+	return metrics.Middleware(http.DefaultServeMux)(server.ServeHTTP)
+}
+
+// cfg holds the settings of the server, loaded by main.
+var cfg *config.Config
+
+// DefaultShutdownTimeout is how long the server waits for requests in flight
+// and background jobs when it stops, less than the 30 seconds Fly.io and
+// Kubernetes wait before killing it.
+const DefaultShutdownTimeout = 25 * time.Second
+
+// DefaultFlushTimeout is how long the notifiers may write the events they
+// queued when the server stops, after the requests and jobs, so the default
+// timeouts add up to less than 30 seconds.
+const DefaultFlushTimeout = 4 * time.Second
+
+// teardown closes the notifiers and then the stores of the server when it
+// stops, so notifications sent during the shutdown are delivered before the
+// stores are closed.
+type teardown struct {
+	notifiers []namedCloser
+	stores    []namedCloser
+}
+
+type namedCloser struct {
+	name string
+	io.Closer
+}
+
+func (t *teardown) addNotifier(name string, n io.Closer) {
+	t.notifiers = append(t.notifiers, namedCloser{name, n})
+}
+
+func (t *teardown) addStore(name string, s io.Closer) {
+	t.stores = append(t.stores, namedCloser{name, s})
+}
+
+// close closes the notifiers in the order they were added, writing the
+// events they queued for up to flushTimeout in total, then the stores in the
+// reverse order, as they may wrap each other. Queued events that are not
+// written are dead-lettered in the stores.
+func (t *teardown) close(flushTimeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+	for _, n := range t.notifiers {
+		s, ok := n.Closer.(notifier.Shutdowner)
+		if !ok {
+			if err := n.Close(); err != nil {
+				log.Printf("Could not close the %s: %v\n", n.name, err)
+			}
+			continue
+		}
+		report, err := s.Shutdown(ctx)
+		if report != (notifier.FlushReport{}) {
+			log.Printf("The %s wrote %d queued events and dead-lettered %d.\n", n.name, report.Flushed, report.DeadLettered)
+		}
+		if err != nil {
+			log.Printf("Could not close the %s: %v\n", n.name, err)
+		}
 	}
+	for i := len(t.stores) - 1; i >= 0; i-- {
+		if err := t.stores[i].Close(); err != nil {
+			log.Printf("Could not close the %s: %v\n", t.stores[i].name, err)
+		}
+	}
+}
 
-	http.HandleFunc("/config", allowCors(donationHandler.HandleConfig))
-	http.HandleFunc("/create-payment-intent", allowCors(donationHandler.HandleCreatePaymentIntent))
-	if bootstrapServers != "" {
-		http.HandleFunc("/webhook", donationHandler.HandleWebhook)
+// wait waits for the group until the context is done, and reports whether
+// the group finished.
+func wait(ctx context.Context, group *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		group.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
 	}
+}
 
-	log.Println("server running at 0.0.0.0:" + port)
-	if err := http.ListenAndServe("0.0.0.0:"+port, nil); err != nil {
-		log.Fatal(err)
+// doctorChecks returns the checks of the configuration, printed by the doctor command.
+func doctorChecks(primaryNotifier string, cloudEvents *cloudevents.Config) []doctor.Check {
+	webhookEvents := []string{"charge.succeeded"}
+	if cfg.Get("DONATION_SERVER_RECURRING_CONFIG") != "" {
+		webhookEvents = append(webhookEvents, "invoice.paid")
+	}
+	checks := []doctor.Check{
+		doctor.StripeKey(stripe.Key),
+		doctor.StripePublishableKey(cfg.Get("STRIPE_PUBLISHABLE_KEY")),
+		doctor.WebhookSecret(cfg.Get("STRIPE_WEBHOOK_SECRET")),
+		doctor.WebhookEndpoint(webhookEvents...),
+	}
+	checked := make(map[string]bool)
+	for _, kind := range notifierKinds(primaryNotifier) {
+		checks = append(checks, notifierCheck(kind, cloudEvents))
+		checked[kind] = true
+	}
+	for _, kind := range []string{cfg.Get("DONATION_SERVER_DUAL_WRITE_NOTIFIER"), cfg.Get("DONATION_SERVER_REPORT_NOTIFIER"), cfg.Get("DONATION_SERVER_LIFECYCLE_NOTIFIER"), cfg.Get("DONATION_SERVER_DUPLICATE_NOTIFIER"), cfg.Get("DONATION_SERVER_RECEIPT_NOTIFIER")} {
+		if kind != "" && !checked[kind] {
+			checks = append(checks, notifierCheck(kind, cloudEvents))
+			checked[kind] = true
+		}
 	}
+
+	return append(checks,
+		doctor.Check{Name: "webhook notifier templates", Run: func(ctx context.Context) error {
+			dir := cfg.Get("DONATION_SERVER_WEBHOOK_NOTIFIER_TEMPLATES")
+			if dir == "" {
+				return doctor.Skip("DONATION_SERVER_WEBHOOK_NOTIFIER_TEMPLATES is not set")
+			}
+			templates, err := webhook.LoadTemplates(dir)
+			if err != nil {
+				return err
+			}
+			return templates.Check()
+		}},
+		doctor.Check{Name: "lifecycle emails", Run: func(ctx context.Context) error {
+			if cfg.Get("DONATION_SERVER_LIFECYCLE_NOTIFIER") == "" {
+				return doctor.Skip("DONATION_SERVER_LIFECYCLE_NOTIFIER is not set")
+			}
+			_, err := newLifecycleScheduler(store.NewMemoryStore(), nil)
+			return err
+		}},
+		doctor.Check{Name: "duplicate detection", Run: func(ctx context.Context) error {
+			if cfg.Get("DONATION_SERVER_DUPLICATE_WINDOW") == "" {
+				return doctor.Skip("DONATION_SERVER_DUPLICATE_WINDOW is not set")
+			}
+			_, emails, err := newDuplicateDetection(cfg.Duration("DONATION_SERVER_DUPLICATE_WINDOW"), cloudEvents)
+			if emails != nil {
+				emails.Close()
+			}
+			return err
+		}},
+		doctor.Check{Name: "receipts", Run: func(ctx context.Context) error {
+			if cfg.Get("DONATION_SERVER_RECEIPT_NOTIFIER") == "" && cfg.Get("DONATION_SERVER_RECEIPT_DIR") == "" {
+				return doctor.Skip("DONATION_SERVER_RECEIPT_NOTIFIER and DONATION_SERVER_RECEIPT_DIR are not set")
+			}
+			_, emails, err := newReceiptIssuer(cloudEvents)
+			if emails != nil {
+				emails.Close()
+			}
+			return err
+		}},
+		doctor.Check{Name: "audit log", Run: func(ctx context.Context) error {
+			path := cfg.Get("DONATION_SERVER_AUDIT_LOG")
+			if path == "" {
+				return doctor.Skip("DONATION_SERVER_AUDIT_LOG is not set")
+			}
+			_, err := auditlog.Open(path)
+			return err
+		}},
+		doctor.Check{Name: "backup key", Run: func(ctx context.Context) error {
+			key := cfg.Get("DONATION_SERVER_BACKUP_KEY")
+			if key == "" {
+				return doctor.Skip("DONATION_SERVER_BACKUP_KEY is not set, backups cannot be made")
+			}
+			_, err := backup.ParseKey(key)
+			return err
+		}},
+		doctor.Check{Name: "PII keys", Run: func(ctx context.Context) error {
+			keys, err := newPIIKeys()
+			if err == nil && keys == nil {
+				return doctor.Skip("DONATION_SERVER_PII_KEYS is not set, personal data of donors is not encrypted")
+			}
+			return err
+		}},
+		doctor.Check{Name: "currencies", Run: func(ctx context.Context) error {
+			currencies, err := newCurrencies()
+			if err == nil && currencies == nil {
+				return doctor.Skip("DONATION_SERVER_CURRENCIES is not set, donations are taken in " + handler.Currency)
+			}
+			return err
+		}},
+		doctor.Check{Name: "IP and country blocking", Run: func(ctx context.Context) error {
+			_, err := newBlocker(newClientIPHeader())
+			return err
+		}},
+		doctor.Check{Name: "rate limiting", Run: func(ctx context.Context) error {
+			limiter, err := newRateLimiter(newClientIPHeader())
+			if err == nil && limiter == nil {
+				return doctor.Skip("DONATION_SERVER_RATE_LIMIT is not set")
+			}
+			return err
+		}},
+		doctor.Check{Name: "VAT config", Run: func(ctx context.Context) error {
+			path := cfg.Get("DONATION_SERVER_VAT_CONFIG")
+			if path == "" {
+				return doctor.Skip("DONATION_SERVER_VAT_CONFIG is not set")
+			}
+			_, err := vat.LoadConfig(path)
+			return err
+		}},
+		doctor.Check{Name: "recurring donation config", Run: func(ctx context.Context) error {
+			path := cfg.Get("DONATION_SERVER_RECURRING_CONFIG")
+			if path == "" {
+				return doctor.Skip("DONATION_SERVER_RECURRING_CONFIG is not set")
+			}
+			_, err := recurring.LoadConfig(path)
+			return err
+		}},
+		doctor.Check{Name: "auto-refund rules", Run: func(ctx context.Context) error {
+			path := cfg.Get("DONATION_SERVER_AUTO_REFUND_RULES")
+			if path == "" {
+				return doctor.Skip("DONATION_SERVER_AUTO_REFUND_RULES is not set")
+			}
+			if cfg.Get("DONATION_SERVER_AUTO_REFUND_AUDIT_LOG") == "" {
+				return fmt.Errorf("DONATION_SERVER_AUTO_REFUND_AUDIT_LOG is not set")
+			}
+			_, err := autorefund.LoadRules(path)
+			return err
+		}},
+		doctor.Check{Name: "denied-party list", Run: func(ctx context.Context) error {
+			path := cfg.Get("DONATION_SERVER_DENIED_PARTIES_CSV")
+			if path == "" {
+				return doctor.Skip("DONATION_SERVER_DENIED_PARTIES_CSV is not set")
+			}
+			_, err := screening.LoadCSVList(path)
+			return err
+		}},
+		doctor.Check{Name: "database migrations", Run: func(ctx context.Context) error {
+			url := cfg.Get("DONATION_SERVER_DATABASE_URL")
+			if url == "" {
+				return doctor.Skip("DONATION_SERVER_DATABASE_URL is not set, donations are kept in memory")
+			}
+			// The database is only read, the server applies the migrations when it starts.
+			database, err := store.ConnectPostgres(ctx, url)
+			if err != nil {
+				return err
+			}
+			defer database.Close()
+			pending, total, err := database.PendingMigrations(ctx)
+			if err != nil {
+				return err
+			}
+			if pending > 0 {
+				return fmt.Errorf("%d of %d migrations are not applied yet, the server applies them when it starts", pending, total)
+			}
+			return nil
+		}},
+		doctor.Check{Name: "SMTP login", Run: func(ctx context.Context) error {
+			if cfg.Get("DONATION_SERVER_SENDGRID_API_KEY") != "" {
+				return doctor.Skip("emails are sent with SendGrid")
+			}
+			sender := newSMTPSender()
+			if sender == nil {
+				return doctor.Skip("DONATION_SERVER_SMTP_ADDR is not set")
+			}
+			return sender.Check(ctx)
+		}},
+	)
+}
+
+// notifierCheck creates the notifier of the kind and checks it, if it can be checked.
+func notifierCheck(kind string, cloudEvents *cloudevents.Config) doctor.Check {
+	return doctor.Check{Name: kind + " notifier", Run: func(ctx context.Context) error {
+		n, err := newNotifier(kind, cloudEvents, nil)
+		if err != nil {
+			return err
+		}
+		defer n.Close()
+		if checker, ok := n.(doctor.Checker); ok {
+			return checker.Check(ctx)
+		}
+		return nil
+	}}
 }
 
-func allowCors(next func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		next(w, r)
+// notifierHealthCheck checks that the named notifier can be reached, if it
+// can be checked, and that its deliveries meet their SLA.
+func notifierHealthCheck(name string, n notifier.Notifier, slaTracker *sla.Tracker) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		if checker, ok := n.(doctor.Checker); ok {
+			if err := checker.Check(ctx); err != nil {
+				return err
+			}
+		}
+		return slaTracker.Check(name)
+	}
+}
+
+// newLifecycleScheduler creates a lifecycle.Scheduler from the
+// DONATION_SERVER_LIFECYCLE_* variables.
+func newLifecycleScheduler(customers store.CustomerStore, n notifier.EmailNotifier) (*lifecycle.Scheduler, error) {
+	schedule, err := dailySchedule("DONATION_SERVER_LIFECYCLE", 10*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	milestones := lifecycle.DefaultMilestones
+	if list := cfg.Get("DONATION_SERVER_LIFECYCLE_MILESTONES"); list != "" {
+		milestones = nil
+		for _, s := range strings.Split(list, ",") {
+			m, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+			if err != nil || m <= 0 {
+				return nil, fmt.Errorf("DONATION_SERVER_LIFECYCLE_MILESTONES must be amounts like 100,250,500")
+			}
+			milestones = append(milestones, m*100)
+		}
+	}
+
+	templates := lifecycle.DefaultTemplates()
+	if dir := cfg.Get("DONATION_SERVER_LIFECYCLE_TEMPLATES"); dir != "" {
+		var err error
+		if templates, err = lifecycle.LoadTemplates(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	return lifecycle.NewScheduler(customers, n, templates, milestones, schedule), nil
+}
+
+// newCurrencies returns the currencies of DONATION_SERVER_CURRENCIES, the
+// default Currency if empty, with the limits of DONATION_SERVER_AMOUNT_LIMITS
+// or of the file DONATION_SERVER_AMOUNT_LIMITS_FILE. It returns nil if none
+// of them is set.
+func newCurrencies() ([]currency.Currency, error) {
+	list := cfg.Get("DONATION_SERVER_CURRENCIES")
+	limitsList, limitsFile := cfg.Get("DONATION_SERVER_AMOUNT_LIMITS"), cfg.Get("DONATION_SERVER_AMOUNT_LIMITS_FILE")
+	if list == "" && limitsList == "" && limitsFile == "" {
+		return nil, nil
+	}
+	if list == "" {
+		list = handler.Currency
+	}
+	currencies, err := currency.ParseList(list)
+	if err != nil {
+		return nil, err
+	}
+
+	var limits map[string]currency.Limits
+	switch {
+	case limitsList != "" && limitsFile != "":
+		return nil, fmt.Errorf("only one of DONATION_SERVER_AMOUNT_LIMITS and DONATION_SERVER_AMOUNT_LIMITS_FILE can be set")
+	case limitsList != "":
+		limits, err = currency.ParseLimits(limitsList)
+	case limitsFile != "":
+		limits, err = currency.LoadLimits(limitsFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return currency.ApplyLimits(currencies, limits)
+}
+
+// dailySchedule returns the schedule of a job from the cron expression of the
+// <prefix>_SCHEDULE variable, or else from the UTC time of day of the
+// <prefix>_TIME variable, at defaultTime if neither is set.
+func dailySchedule(prefix string, defaultTime time.Duration) (clock.Schedule, error) {
+	if expr := cfg.Get(prefix + "_SCHEDULE"); expr != "" {
+		schedule, err := clock.ParseCron(expr)
+		if err != nil {
+			return nil, fmt.Errorf("%s_SCHEDULE: %v", prefix, err)
+		}
+		return schedule, nil
+	}
+	at := defaultTime
+	if timeOfDay := cfg.Get(prefix + "_TIME"); timeOfDay != "" {
+		t, err := time.Parse("15:04", timeOfDay)
+		if err != nil {
+			return nil, fmt.Errorf("%s_TIME must be a UTC time like %s", prefix, time.Time{}.Add(defaultTime).Format("15:04"))
+		}
+		at = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	return clock.Daily(at), nil
+}
+
+// newDuplicateDetection configures the detection of duplicate donations
+// within the window from the DONATION_SERVER_DUPLICATE_* variables.
+// The notifier emailing refund links is returned too, if there is one, to be
+// closed with the server.
+func newDuplicateDetection(window time.Duration, cloudEvents *cloudevents.Config) (handler.Option, notifier.Notifier, error) {
+	policy := duplicate.Policy{Window: window}
+	if policy.Window <= 0 {
+		return nil, nil, fmt.Errorf("DONATION_SERVER_DUPLICATE_WINDOW must be a duration like 10m")
+	}
+
+	kind := cfg.Get("DONATION_SERVER_DUPLICATE_NOTIFIER")
+	if kind == "" {
+		log.Printf("Donations within %v of the same donation are flagged as duplicates.\n", policy.Window)
+		return handler.WithDuplicateDetection(policy, nil, nil, ""), nil, nil
+	}
+
+	policy.RefundWindow = duplicate.DefaultRefundWindow
+	if cfg.Get("DONATION_SERVER_DUPLICATE_REFUND_WINDOW") != "" {
+		if policy.RefundWindow = cfg.Duration("DONATION_SERVER_DUPLICATE_REFUND_WINDOW"); policy.RefundWindow <= 0 {
+			return nil, nil, fmt.Errorf("DONATION_SERVER_DUPLICATE_REFUND_WINDOW must be a duration like 168h")
+		}
+	}
+	if cfg.Get("DONATION_SERVER_DUPLICATE_MAX_REFUND") != "" {
+		amount := cfg.Int("DONATION_SERVER_DUPLICATE_MAX_REFUND")
+		if amount <= 0 {
+			return nil, nil, fmt.Errorf("DONATION_SERVER_DUPLICATE_MAX_REFUND must be an amount like 500")
+		}
+		policy.MaxRefund = amount * 100
+	}
+	secret := cfg.Get("DONATION_SERVER_DUPLICATE_SECRET")
+	if len(secret) < 32 {
+		return nil, nil, fmt.Errorf("DONATION_SERVER_DUPLICATE_SECRET must have at least 32 characters to sign refund links")
+	}
+	publicURL := cfg.Get("DONATION_SERVER_PUBLIC_URL")
+	if publicURL == "" {
+		return nil, nil, fmt.Errorf("DONATION_SERVER_PUBLIC_URL is required to link to refunds")
+	}
+
+	n, err := newNotifier(kind, cloudEvents, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	emails, ok := n.(notifier.EmailNotifier)
+	if !ok {
+		n.Close()
+		return nil, nil, fmt.Errorf("the %s notifier cannot send emails", kind)
+	}
+	log.Printf("Donations within %v of the same donation are flagged as duplicates, and refundable for %v with the link emailed by the %s notifier.\n",
+		policy.Window, policy.RefundWindow, kind)
+	return handler.WithDuplicateDetection(policy, []byte(secret), emails, publicURL), n, nil
+}
+
+// newReceiptIssuer creates the receipt.Issuer from the DONATION_SERVER_RECEIPT_*
+// variables, delivering receipts with the notifier of
+// DONATION_SERVER_RECEIPT_NOTIFIER, which is returned to be closed with the
+// server, or to DONATION_SERVER_RECEIPT_DIR.
+func newReceiptIssuer(cloudEvents *cloudevents.Config) (*receipt.Issuer, notifier.Notifier, error) {
+	var opts []receipt.Option
+	if dir := cfg.Get("DONATION_SERVER_RECEIPT_TEMPLATES"); dir != "" {
+		templates, err := receipt.LoadTemplates(dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		opts = append(opts, receipt.WithTemplates(templates))
+	}
+	opts = append(opts, receipt.WithPrefix(cfg.Get("DONATION_SERVER_RECEIPT_PREFIX")))
+	// The charity is named like the sender of the emails, unless it is set.
+	organization := cfg.Get("DONATION_SERVER_RECEIPT_ORGANIZATION")
+	if from, err := mail.ParseAddress(cfg.Get("DONATION_SERVER_EMAIL_FROM")); organization == "" && err == nil {
+		organization = from.Name
+	}
+	opts = append(opts, receipt.WithOrganization(organization))
+
+	if kind := cfg.Get("DONATION_SERVER_RECEIPT_NOTIFIER"); kind != "" {
+		n, err := newNotifier(kind, cloudEvents, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		emails, ok := n.(notifier.EmailNotifier)
+		if !ok {
+			n.Close()
+			return nil, nil, fmt.Errorf("the %s notifier cannot send emails", kind)
+		}
+		log.Printf("Receipts of donations are emailed by the %s notifier.\n", kind)
+		return receipt.NewIssuer(receipt.EmailDeliverer{Notifier: emails}, opts...), n, nil
+	}
+	dir := cfg.Get("DONATION_SERVER_RECEIPT_DIR")
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, nil, err
+	}
+	log.Printf("Receipts of donations are written to %s.\n", dir)
+	return receipt.NewIssuer(receipt.DirDeliverer{Dir: dir}, opts...), nil, nil
+}
+
+// passThrough is a middleware doing nothing.
+func passThrough(next http.HandlerFunc) http.HandlerFunc {
+	return next
+}
+
+// securityPolicies returns the secheaders policies of responses and of pages
+// embedded on other sites, overridden by the DONATION_SERVER_CONTENT_SECURITY_POLICY,
+// DONATION_SERVER_HSTS_MAX_AGE, DONATION_SERVER_REFERRER_POLICY and
+// DONATION_SERVER_FRAME_ANCESTORS variables.
+func securityPolicies() (secheaders.Policy, secheaders.Policy, error) {
+	policy := secheaders.Default()
+	if csp := cfg.Get("DONATION_SERVER_CONTENT_SECURITY_POLICY"); csp != "" {
+		if strings.Contains(csp, "frame-ancestors") {
+			return policy, policy, fmt.Errorf("DONATION_SERVER_CONTENT_SECURITY_POLICY cannot set frame-ancestors, set DONATION_SERVER_FRAME_ANCESTORS")
+		}
+		policy.ContentSecurityPolicy = csp
+	}
+	if cfg.Get("DONATION_SERVER_HSTS_MAX_AGE") != "" {
+		policy.HSTSMaxAge = cfg.Duration("DONATION_SERVER_HSTS_MAX_AGE")
+	}
+	if referrerPolicy := cfg.Get("DONATION_SERVER_REFERRER_POLICY"); referrerPolicy != "" {
+		policy.ReferrerPolicy = referrerPolicy
+	}
+
+	frameAncestors := strings.Fields(cfg.Get("DONATION_SERVER_FRAME_ANCESTORS"))
+	if len(frameAncestors) == 0 {
+		frameAncestors = []string{"*"}
+	}
+	return policy, policy.Embed(frameAncestors...), nil
+}
+
+// verifyAuditLog verifies the chain of DONATION_SERVER_AUDIT_LOG and returns
+// the exit code of the verify-audit-log command.
+func verifyAuditLog(w io.Writer) int {
+	path := cfg.Get("DONATION_SERVER_AUDIT_LOG")
+	if path == "" {
+		fmt.Fprintln(w, "DONATION_SERVER_AUDIT_LOG is not set.")
+		return 2
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(w, "Could not open the audit log: %v\n", err)
+		return 2
+	}
+	defer f.Close()
+	entries, head, err := auditlog.Verify(f)
+	if err != nil {
+		fmt.Fprintf(w, "FAIL %v, %d entries before are intact.\n", err, entries)
+		return 1
+	}
+	fmt.Fprintf(w, "OK %d entries, the last hash is %s.\n", entries, head)
+	return 0
+}
+
+// runBackup runs the backup, restore or verify-backup command with the
+// location of the snapshot and returns the exit code.
+func runBackup(command, location string, w io.Writer) int {
+	key, err := backup.ParseKey(cfg.Get("DONATION_SERVER_BACKUP_KEY"))
+	if err != nil {
+		fmt.Fprintf(w, "DONATION_SERVER_BACKUP_KEY: %v\n", err)
+		return 2
+	}
+	s3 := newBackupS3()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+
+	if command == "verify-backup" {
+		data, err := backup.Load(ctx, location, s3)
+		if err != nil {
+			fmt.Fprintf(w, "Could not read the snapshot: %v\n", err)
+			return 2
+		}
+		header, _, err := backup.Open(data, key)
+		if err != nil {
+			fmt.Fprintf(w, "FAIL %v.\n", err)
+			return 1
+		}
+		fmt.Fprintf(w, "OK %d donations, taken at %s.\n", header.Donations, header.CreatedAt.Format(time.RFC3339))
+		return 0
+	}
+
+	url := cfg.Get("DONATION_SERVER_DATABASE_URL")
+	if url == "" {
+		fmt.Fprintln(w, "DONATION_SERVER_DATABASE_URL is not set, donations kept in memory cannot be backed up or restored.")
+		return 2
+	}
+	database, err := store.OpenPostgres(ctx, url)
+	if err != nil {
+		fmt.Fprintf(w, "Could not open the database: %v\n", err)
+		return 2
+	}
+	defer database.Close()
+
+	if command == "backup" {
+		data, header, err := backup.Snapshot(ctx, database, key, time.Now())
+		if err != nil {
+			fmt.Fprintf(w, "Could not take a snapshot: %v\n", err)
+			return 1
+		}
+		where, err := backup.Save(ctx, location, backup.Name(header.CreatedAt), data, s3)
+		if err != nil {
+			fmt.Fprintf(w, "Could not store the snapshot: %v\n", err)
+			return 1
+		}
+		// The stored snapshot is read back, so a backup is only reported if it can be restored.
+		stored, err := backup.Load(ctx, where, s3)
+		if err == nil {
+			_, _, err = backup.Open(stored, key)
+		}
+		if err != nil {
+			fmt.Fprintf(w, "FAIL the snapshot stored at %s cannot be read back: %v.\n", where, err)
+			return 1
+		}
+		fmt.Fprintf(w, "OK %d donations backed up to %s.\n", header.Donations, where)
+		return 0
+	}
+
+	data, err := backup.Load(ctx, location, s3)
+	if err != nil {
+		fmt.Fprintf(w, "Could not read the snapshot: %v\n", err)
+		return 2
+	}
+	header, donations, err := backup.Open(data, key)
+	if err != nil {
+		fmt.Fprintf(w, "FAIL %v, nothing was restored.\n", err)
+		return 1
+	}
+	// Restored donations are audited like any other change.
+	var target store.DonationStore = database
+	if path := cfg.Get("DONATION_SERVER_AUDIT_LOG"); path != "" {
+		auditLog, err := auditlog.Open(path)
+		if err != nil {
+			fmt.Fprintf(w, "Could not open the audit log: %v\n", err)
+			return 2
+		}
+		target = auditlog.NewDonationStore(target, auditLog)
+	}
+	if err := backup.Restore(ctx, target, donations); err != nil {
+		fmt.Fprintf(w, "FAIL %v.\n", err)
+		return 1
+	}
+	fmt.Fprintf(w, "OK %d donations restored from the snapshot taken at %s.\n", header.Donations, header.CreatedAt.Format(time.RFC3339))
+	return 0
+}
+
+// checkoutCancelURL checks the success URL of Checkout and returns the cancel
+// URL, DONATION_SERVER_CHECKOUT_CANCEL_URL or else DONATION_SERVER_PUBLIC_URL.
+func checkoutCancelURL(successURL string) (string, error) {
+	cancelURL := cfg.Get("DONATION_SERVER_CHECKOUT_CANCEL_URL")
+	if cancelURL == "" {
+		cancelURL = cfg.Get("DONATION_SERVER_PUBLIC_URL")
+	}
+	if cancelURL == "" {
+		return "", errors.New("DONATION_SERVER_CHECKOUT_CANCEL_URL or DONATION_SERVER_PUBLIC_URL is required")
+	}
+	for name, value := range map[string]string{"success": successURL, "cancel": cancelURL} {
+		if u, err := url.Parse(value); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return "", fmt.Errorf("the %s URL %q is not an absolute http(s) URL", name, value)
+		}
+	}
+	return cancelURL, nil
+}
+
+// newPIIKeys returns the keyring of DONATION_SERVER_PII_KEYS, or of the file at
+// DONATION_SERVER_PII_KEYS_FILE, e.g. written by the agent of a KMS, or nil if
+// neither is set.
+func newPIIKeys() (*pii.Keyring, error) {
+	keys := cfg.Get("DONATION_SERVER_PII_KEYS")
+	if path := cfg.Get("DONATION_SERVER_PII_KEYS_FILE"); path != "" {
+		if keys != "" {
+			return nil, errors.New("only one of DONATION_SERVER_PII_KEYS and DONATION_SERVER_PII_KEYS_FILE can be set")
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		keys = string(data)
+	}
+	if keys == "" {
+		return nil, nil
+	}
+	return pii.ParseKeys(keys)
+}
+
+// reencryptPII encrypts the personal data of the donations in the database
+// with the first PII key and returns the exit code.
+func reencryptPII(w io.Writer) int {
+	keys, err := newPIIKeys()
+	if err == nil && keys == nil {
+		err = errors.New("DONATION_SERVER_PII_KEYS is not set")
+	}
+	if err != nil {
+		fmt.Fprintf(w, "Invalid PII keys: %v\n", err)
+		return 2
+	}
+	url := cfg.Get("DONATION_SERVER_DATABASE_URL")
+	if url == "" {
+		fmt.Fprintln(w, "DONATION_SERVER_DATABASE_URL is not set, donations kept in memory are not encrypted.")
+		return 2
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+	database, err := store.OpenPostgres(ctx, url)
+	if err != nil {
+		fmt.Fprintf(w, "Could not open the database: %v\n", err)
+		return 2
+	}
+	defer database.Close()
+
+	n, err := pii.Reencrypt(ctx, database, keys)
+	if err != nil {
+		fmt.Fprintf(w, "FAIL %v, %d donations were re-encrypted before.\n", err, n)
+		return 1
+	}
+	fmt.Fprintf(w, "OK %d donations re-encrypted with key %s, keys other than %s can be removed.\n", n, keys.Primary(), keys.Primary())
+	return 0
+}
+
+// newBackupS3 returns the S3 client of the AWS_* and DONATION_SERVER_BACKUP_S3_ENDPOINT
+// variables, or nil if no credentials are set.
+func newBackupS3() *backup.S3 {
+	accessKeyID := cfg.Get("AWS_ACCESS_KEY_ID")
+	if accessKeyID == "" {
+		return nil
+	}
+	region := cfg.Get("AWS_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &backup.S3{
+		Endpoint:        cfg.Get("DONATION_SERVER_BACKUP_S3_ENDPOINT"),
+		Region:          region,
+		AccessKeyID:     accessKeyID,
+		SecretAccessKey: cfg.Get("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    cfg.Get("AWS_SESSION_TOKEN"),
+		Client:          &http.Client{Timeout: 10 * time.Minute},
+	}
+}
+
+// adminAPIKeys returns the API keys of the admin API: DONATION_SERVER_ADMIN_API_KEY
+// and those of DONATION_SERVER_ADMIN_API_KEYS, e.g. the previous key during a
+// rotation.
+func adminAPIKeys() []string {
+	var keys []string
+	if key := cfg.Get("DONATION_SERVER_ADMIN_API_KEY"); key != "" {
+		keys = append(keys, key)
+	}
+	for _, key := range strings.Split(cfg.Get("DONATION_SERVER_ADMIN_API_KEYS"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// newAdminAuth returns the options of the authenticator of the admin API,
+// its API keys and the verifier of JWTs signed with DONATION_SERVER_JWT_SECRETS
+// or the keys of DONATION_SERVER_JWT_PUBLIC_KEYS_FILE, or nil if there are
+// neither.
+func newAdminAuth() ([]auth.Option, error) {
+	keys := adminAPIKeys()
+	var jwtOptions []auth.JWTOption
+	var secrets []string
+	for _, secret := range strings.Split(cfg.Get("DONATION_SERVER_JWT_SECRETS"), ",") {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			if len(secret) < 32 {
+				return nil, fmt.Errorf("DONATION_SERVER_JWT_SECRETS must have at least 32 characters each")
+			}
+			secrets = append(secrets, secret)
+		}
+	}
+	if len(secrets) > 0 {
+		jwtOptions = append(jwtOptions, auth.WithSecrets(secrets...))
+	}
+	if file := cfg.Get("DONATION_SERVER_JWT_PUBLIC_KEYS_FILE"); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		publicKeys, err := auth.ParsePublicKeys(data)
+		if err != nil {
+			return nil, fmt.Errorf("DONATION_SERVER_JWT_PUBLIC_KEYS_FILE: %v", err)
+		}
+		jwtOptions = append(jwtOptions, auth.WithPublicKeys(publicKeys...))
+	}
+	if len(keys) == 0 && len(jwtOptions) == 0 {
+		return nil, nil
+	}
+
+	// JWTs are scoped like OAuth tokens.
+	options := []auth.Option{auth.WithAPIKeys(keys...), auth.WithScopes(oauth.RequiredScope, oauth.Allows)}
+	if len(jwtOptions) > 0 {
+		if issuer := cfg.Get("DONATION_SERVER_JWT_ISSUER"); issuer != "" {
+			jwtOptions = append(jwtOptions, auth.WithIssuer(issuer))
+		}
+		if audience := cfg.Get("DONATION_SERVER_JWT_AUDIENCE"); audience != "" {
+			jwtOptions = append(jwtOptions, auth.WithAudience(audience))
+		}
+		log.Println("JWTs are accepted by the admin API.")
+		options = append(options, auth.WithJWT(auth.NewJWTVerifier(jwtOptions...)))
+	}
+	if len(keys) > 1 {
+		log.Printf("The admin API accepts %d API keys.\n", len(keys))
+	}
+	return options, nil
+}
+
+// newCORSPolicy returns the cors.Policy of the DONATION_SERVER_CORS_* variables,
+// lists separated by spaces or commas.
+func newCORSPolicy() (cors.Policy, error) {
+	policy := cors.Default()
+	fields := func(s string) []string {
+		return strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' })
+	}
+	if origins := fields(cfg.Get("DONATION_SERVER_CORS_ORIGINS")); len(origins) > 0 {
+		for _, origin := range origins {
+			if origin != "*" && !strings.HasPrefix(origin, "https://") && !strings.HasPrefix(origin, "http://") {
+				return policy, fmt.Errorf("DONATION_SERVER_CORS_ORIGINS must be origins like https://example.org, not %q", origin)
+			}
+		}
+		policy.Origins = origins
+	}
+	if methods := fields(cfg.Get("DONATION_SERVER_CORS_METHODS")); len(methods) > 0 {
+		policy.Methods = methods
+	}
+	if headers := fields(cfg.Get("DONATION_SERVER_CORS_HEADERS")); len(headers) > 0 {
+		policy.Headers = headers
+	}
+	policy.MaxAge = cfg.Duration("DONATION_SERVER_CORS_MAX_AGE")
+	return policy, nil
+}
+
+// newTraceExporter enables tracing with DONATION_SERVER_OTLP_ENDPOINT, setting
+// tracing.Default, and returns the exporter of the spans, or nil if it is
+// not set.
+func newTraceExporter(environment string) (*tracing.OTLPExporter, error) {
+	endpoint := cfg.Get("DONATION_SERVER_OTLP_ENDPOINT")
+	if endpoint == "" {
+		return nil, nil
+	}
+	headers, err := tracing.ParseHeaders(cfg.Get("DONATION_SERVER_OTLP_HEADERS"))
+	if err != nil {
+		return nil, fmt.Errorf("DONATION_SERVER_OTLP_HEADERS: %v", err)
+	}
+	sampleRate := 1.0
+	if cfg.Get("DONATION_SERVER_TRACE_SAMPLE_RATE") != "" {
+		if sampleRate = cfg.Float("DONATION_SERVER_TRACE_SAMPLE_RATE"); sampleRate < 0 || sampleRate > 1 {
+			return nil, fmt.Errorf("DONATION_SERVER_TRACE_SAMPLE_RATE must be a number between 0 and 1")
+		}
+	}
+	resource := []tracing.Attribute{
+		tracing.String("service.name", "donation-server"),
+		tracing.String("service.instance.id", leader.Holder(cfg.Get("DONATION_SERVER_INSTANCE_ID"))),
+	}
+	if environment != "" {
+		resource = append(resource, tracing.String("deployment.environment", environment))
+	}
+	exporter := tracing.NewOTLPExporter(endpoint, headers, resource...)
+	tracing.Default = tracing.NewTracer(exporter, sampleRate)
+	log.Printf("Traces are exported to %s, %g of those started by the server.\n", endpoint, sampleRate)
+	return exporter, nil
+}
+
+// newSLATracker creates the sla.Tracker of the DONATION_SERVER_SLA_* variables,
+// alerting to DONATION_SERVER_ALERT_WEBHOOK_URL if it is set.
+func newSLATracker() (*sla.Tracker, error) {
+	var thresholds sla.Thresholds
+	if cfg.Get("DONATION_SERVER_SLA_MIN_SUCCESS_RATE") != "" {
+		if thresholds.MinSuccessRate = cfg.Float("DONATION_SERVER_SLA_MIN_SUCCESS_RATE"); thresholds.MinSuccessRate < 0 || thresholds.MinSuccessRate > 1 {
+			return nil, fmt.Errorf("DONATION_SERVER_SLA_MIN_SUCCESS_RATE must be between 0 and 1")
+		}
+	}
+	thresholds.MaxLatency = cfg.Duration("DONATION_SERVER_SLA_MAX_LATENCY")
+
+	var alerter sla.Alerter
+	if url := cfg.Get("DONATION_SERVER_ALERT_WEBHOOK_URL"); url != "" {
+		alerter = &sla.WebhookAlerter{URL: url}
+	}
+	return sla.NewTracker(thresholds, alerter), nil
+}
+
+// newDeadLetterStore creates the store of dead letters kept in memory and
+// saved to the sink of the kind, file, kafka or table, and restores the
+// pending ones of the sink.
+func newDeadLetterStore(kind string, memory store.DeadLetterStore, database *store.PostgresStore) (*deadletter.Store, error) {
+	var sink deadletter.Sink
+	switch kind {
+	case "file":
+		path := cfg.Get("DONATION_SERVER_DEAD_LETTER_FILE")
+		if path == "" {
+			return nil, fmt.Errorf("DONATION_SERVER_DEAD_LETTER_FILE is required with the file sink")
+		}
+		fileSink, err := deadletter.OpenFile(path)
+		if err != nil {
+			return nil, err
+		}
+		sink = fileSink
+		log.Printf("Dead letters are saved to %s.\n", path)
+	case "kafka":
+		topic := cfg.Get("DONATION_SERVER_DEAD_LETTER_TOPIC")
+		if topic == "" {
+			return nil, fmt.Errorf("DONATION_SERVER_DEAD_LETTER_TOPIC is required with the kafka sink")
+		}
+		writer, err := kafka.NewTopicWriter(
+			strings.Split(cfg.Get("UPSTASH_KAFKA_BOOTSTRAP_SERVERS"), ","),
+			topic,
+			cfg.Get("UPSTASH_KAFKA_SCRAM_USERNAME"),
+			cfg.Get("UPSTASH_KAFKA_SCRAM_PASSWORD"),
+		)
+		if err != nil {
+			return nil, err
+		}
+		sink = deadletter.NewTopicSink(writer)
+		log.Printf("Dead letters are written to the Kafka topic %s.\n", topic)
+	case "table":
+		if database == nil {
+			return nil, fmt.Errorf("DONATION_SERVER_DATABASE_URL is required with the table sink")
+		}
+		sink = deadletter.NewTableSink(database)
+		log.Println("Dead letters are saved to the dead_letters table.")
+	default:
+		return nil, fmt.Errorf("DONATION_SERVER_DEAD_LETTER_SINK must be file, kafka or table, not %q", kind)
+	}
+
+	s := deadletter.NewStore(memory, sink)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	restored, err := s.Restore(ctx)
+	if err != nil {
+		sink.Close()
+		return nil, fmt.Errorf("could not restore the dead letters: %v", err)
+	}
+	if restored > 0 {
+		log.Printf("%d pending dead letters were restored.\n", restored)
+	}
+	return s, nil
+}
+
+// newRetryOptions returns the retries of notifications of
+// DONATION_SERVER_NOTIFIER_RETRIES and DONATION_SERVER_NOTIFIER_RETRY_BACKOFF.
+func newRetryOptions() ([]notifier.RetryOption, error) {
+	var opts []notifier.RetryOption
+	if retries := cfg.Get("DONATION_SERVER_NOTIFIER_RETRIES"); retries != "" {
+		attempts := int(cfg.Int("DONATION_SERVER_NOTIFIER_RETRIES"))
+		if attempts < 1 {
+			return nil, fmt.Errorf("DONATION_SERVER_NOTIFIER_RETRIES must be a positive number, not %q", retries)
+		}
+		opts = append(opts, notifier.RetryAttempts(attempts))
+	}
+	if cfg.Get("DONATION_SERVER_NOTIFIER_RETRY_BACKOFF") != "" {
+		backoff := cfg.Duration("DONATION_SERVER_NOTIFIER_RETRY_BACKOFF")
+		if backoff <= 0 {
+			return nil, fmt.Errorf("DONATION_SERVER_NOTIFIER_RETRY_BACKOFF must be a duration like 100ms")
+		}
+		max := notifier.DefaultMaxRetryBackoff
+		if backoff > max {
+			max = backoff
+		}
+		opts = append(opts, notifier.RetryBackoff(backoff, max))
+	}
+	return opts, nil
+}
+
+// newAsyncNotifier creates the notifier queueing notifications for the given
+// number of workers delivering them with next, in the journal of
+// DONATION_SERVER_ASYNC_JOURNAL if it is set. Only the notifications of
+// Stripe events the async-webhooks feature flag is on for are queued.
+func newAsyncNotifier(workers int, next notifier.Notifier, deadLetter notifier.DeadLetterFunc, features *feature.Flags) (*notifier.AsyncNotifier, error) {
+	if workers < 1 {
+		return nil, fmt.Errorf("DONATION_SERVER_ASYNC_WORKERS must be a positive number, not %d", workers)
+	}
+	opts := []notifier.AsyncOption{notifier.AsyncWorkers(workers), notifier.AsyncDeadLetters(deadLetter),
+		notifier.AsyncIf(func(ctx context.Context) bool {
+			return features.Enabled(ctx, feature.AsyncWebhooks, notifier.EventID(ctx))
+		})}
+	if value := cfg.Get("DONATION_SERVER_ASYNC_QUEUE_SIZE"); value != "" {
+		size := int(cfg.Int("DONATION_SERVER_ASYNC_QUEUE_SIZE"))
+		if size < 1 {
+			return nil, fmt.Errorf("DONATION_SERVER_ASYNC_QUEUE_SIZE must be a positive number, not %q", value)
+		}
+		opts = append(opts, notifier.AsyncQueueSize(size))
+	}
+	path := cfg.Get("DONATION_SERVER_ASYNC_JOURNAL")
+	if path != "" {
+		journal, err := notifier.OpenJournal(path)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, notifier.AsyncJournal(journal))
+	}
+	async, err := notifier.NewAsync(next, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if path != "" {
+		log.Printf("Notifications are delivered by %d workers, queued in %s.\n", workers, path)
+	} else {
+		log.Printf("Notifications are delivered by %d workers, queued in memory only.\n", workers)
+	}
+	return async, nil
+}
+
+// newAnomalyDetector creates the detector of anomalies in the donations with
+// the thresholds of the DONATION_SERVER_ANOMALY_* settings, alerting to
+// DONATION_SERVER_ALERT_WEBHOOK_URL if it is set.
+func newAnomalyDetector(donations store.DonationStore) (*anomaly.Detector, error) {
+	thresholds := anomaly.DefaultThresholds
+	for name, max := range map[string]*int{
+		"DONATION_SERVER_ANOMALY_MAX_PER_IP":    &thresholds.MaxPerIP,
+		"DONATION_SERVER_ANOMALY_MAX_PER_EMAIL": &thresholds.MaxPerEmail,
+	} {
+		if value := cfg.Get(name); value != "" {
+			if *max = int(cfg.Int(name)); *max < 0 {
+				return nil, fmt.Errorf("%s must be a number of donations, not %q", name, value)
+			}
+		}
+	}
+	if factor := cfg.Get("DONATION_SERVER_ANOMALY_SPIKE_FACTOR"); factor != "" {
+		if thresholds.SpikeFactor = cfg.Float("DONATION_SERVER_ANOMALY_SPIKE_FACTOR"); thresholds.SpikeFactor < 0 {
+			return nil, fmt.Errorf("DONATION_SERVER_ANOMALY_SPIKE_FACTOR must be a positive number, not %q", factor)
+		}
+	}
+	window := anomaly.DefaultWindow
+	if cfg.Get("DONATION_SERVER_ANOMALY_WINDOW") != "" {
+		if window = cfg.Duration("DONATION_SERVER_ANOMALY_WINDOW"); window < 4*time.Minute {
+			return nil, fmt.Errorf("DONATION_SERVER_ANOMALY_WINDOW must be a duration of at least 4m, like 1h")
+		}
+	}
+
+	var alerter anomaly.Alerter
+	if url := cfg.Get("DONATION_SERVER_ALERT_WEBHOOK_URL"); url != "" {
+		alerter = &sla.WebhookAlerter{URL: url}
+	}
+	return anomaly.NewDetector(donations, alerter, thresholds, window), nil
+}
+
+// newKillSwitch creates the kill switch of the payment provider and of the
+// payment methods of DONATION_SERVER_PAYMENT_METHODS, with those of
+// DONATION_SERVER_PAUSED_PAYMENTS paused.
+func newKillSwitch() (*killswitch.Switch, error) {
+	provider := cfg.Get("DONATION_SERVER_PAYMENT_PROVIDER")
+	if provider == "" {
+		provider = "stripe"
+	}
+	list := func(r rune) bool { return r == ',' || r == ' ' }
+	s := killswitch.New(provider, strings.FieldsFunc(cfg.Get("DONATION_SERVER_PAYMENT_METHODS"), list))
+	for _, name := range strings.FieldsFunc(cfg.Get("DONATION_SERVER_PAUSED_PAYMENTS"), list) {
+		if err := s.Pause(name, "", ""); err != nil {
+			return nil, fmt.Errorf("DONATION_SERVER_PAUSED_PAYMENTS: %s: %v", name, err)
+		}
+	}
+	return s, nil
+}
+
+// newProvider creates the Stripe provider, or the fake provider of package
+// fake with DONATION_SERVER_PAYMENT_PROVIDER=fake in testEnvironments, which
+// is also returned to be run.
+func newProvider(webhookSecret string, stripeTimeout time.Duration, environment, port string, features *feature.Flags) (payments.Provider, *fake.Provider) {
+	switch kind := cfg.Get("DONATION_SERVER_PAYMENT_PROVIDER"); kind {
+	case "", "stripe":
+		return payments.NewStripe(stripe.Key, webhookSecret, payments.WithTimeout(stripeTimeout)), nil
+	case "fake":
+	default:
+		log.Fatalf("Unknown DONATION_SERVER_PAYMENT_PROVIDER %q, it must be stripe or fake", kind)
+	}
+	if !features.Enabled(context.Background(), feature.PaymentProviders, "") {
+		log.Fatalf("Payment providers other than Stripe are off by the %s feature flag", feature.PaymentProviders)
+	}
+	if !testEnvironment(environment) {
+		log.Fatalf("The fake payment provider cannot be used in the %q environment, only in %s", environment, strings.Join(testEnvironments, ", "))
+	}
+
+	var opts []fake.Option
+	if cfg.Get("DONATION_SERVER_FAKE_DELAY") != "" {
+		d := cfg.Duration("DONATION_SERVER_FAKE_DELAY")
+		if d < 0 {
+			log.Fatalf("DONATION_SERVER_FAKE_DELAY must be a duration like 3s")
+		}
+		opts = append(opts, fake.WithDelay(d))
+	}
+	for variable, option := range map[string]func(float64) fake.Option{
+		"DONATION_SERVER_FAKE_DECLINE_RATE": fake.WithDeclineRate,
+		"DONATION_SERVER_FAKE_ERROR_RATE":   fake.WithErrorRate,
+	} {
+		if cfg.Get(variable) != "" {
+			rate := cfg.Float(variable)
+			if rate < 0 || rate > 1 {
+				log.Fatalf("%s must be a number between 0 and 1", variable)
+			}
+			opts = append(opts, option(rate))
+		}
+	}
+	if cfg.Get("DONATION_SERVER_FAKE_SEED") != "" {
+		opts = append(opts, fake.WithSeed(cfg.Int("DONATION_SERVER_FAKE_SEED")))
+	}
+	webhookURL := cfg.Get("DONATION_SERVER_FAKE_WEBHOOK_URL")
+	if webhookURL == "" {
+		webhookURL = "http://localhost:" + port + "/webhook"
+	}
+
+	log.Printf("[FAKE] Payments are simulated, their webhooks are delivered to %s.\n", webhookURL)
+	p := fake.New(webhookURL, webhookSecret, opts...)
+	return p, p
+}
+
+// testEnvironments are the environments simulated payments and injected
+// faults are allowed in. Any other, including production or an unnamed or
+// misspelled one, refuses them.
+var testEnvironments = []string{"dev", "test", "staging"}
+
+// testEnvironment reports whether the environment is one of testEnvironments.
+func testEnvironment(environment string) bool {
+	for _, e := range testEnvironments {
+		if environment == e {
+			return true
+		}
+	}
+	return false
+}
+
+// newFaultInjector creates the fault.Injector of the target from its
+// DONATION_SERVER_FAULTS_<TARGET> variable, or returns nil if it is not set.
+// Faults are only injected in testEnvironments.
+func newFaultInjector(target, environment string) *fault.Injector {
+	variable := "DONATION_SERVER_FAULTS_" + strings.ToUpper(target)
+	faults := cfg.Get(variable)
+	if faults == "" {
+		return nil
+	}
+	if !testEnvironment(environment) {
+		log.Printf("[WARN] %s is ignored in the %q environment, faults are only injected in %s.\n", variable, environment, strings.Join(testEnvironments, ", "))
+		return nil
+	}
+	config, err := fault.ParseConfig(faults)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", variable, err)
+	}
+	return fault.NewInjector(target, config)
+}
+
+// newClientIPHeader returns the header of the client IP from
+// DONATION_SERVER_CLIENT_IP_HEADER and DONATION_SERVER_CLIENT_IP_HOPS.
+func newClientIPHeader() clientip.Header {
+	hops := cfg.Int("DONATION_SERVER_CLIENT_IP_HOPS")
+	if hops < 0 {
+		log.Fatalf("DONATION_SERVER_CLIENT_IP_HOPS must not be negative")
+	}
+	return clientip.Header{Name: cfg.Get("DONATION_SERVER_CLIENT_IP_HEADER"), TrustedHops: int(hops)}
+}
+
+// newBlocker creates a geoblock.Blocker from the DONATION_SERVER_*_CIDRS and
+// DONATION_SERVER_*_COUNTRIES variables.
+func newBlocker(clientIPHeader clientip.Header) (*geoblock.Blocker, error) {
+	config := geoblock.Config{
+		ClientIPHeader: clientIPHeader,
+		CountryHeader:  cfg.Get("DONATION_SERVER_COUNTRY_HEADER"),
+	}
+
+	var err error
+	if config.AllowedCIDRs, err = geoblock.ParseCIDRs(cfg.Get("DONATION_SERVER_ALLOWED_CIDRS")); err != nil {
+		return nil, err
+	}
+	if config.BlockedCIDRs, err = geoblock.ParseCIDRs(cfg.Get("DONATION_SERVER_BLOCKED_CIDRS")); err != nil {
+		return nil, err
+	}
+	if config.AllowedCountries, err = geoblock.ParseCountries(cfg.Get("DONATION_SERVER_ALLOWED_COUNTRIES")); err != nil {
+		return nil, err
+	}
+	if config.BlockedCountries, err = geoblock.ParseCountries(cfg.Get("DONATION_SERVER_BLOCKED_COUNTRIES")); err != nil {
+		return nil, err
+	}
+
+	if path := cfg.Get("DONATION_SERVER_GEOIP_CSV"); path != "" {
+		resolver, err := geoblock.LoadCSVResolver(path)
+		if err != nil {
+			return nil, err
+		}
+		config.Resolver = resolver
+	}
+
+	return geoblock.NewBlocker(config), nil
+}
+
+// newRateLimiter creates a ratelimit.Limiter from the DONATION_SERVER_RATE_LIMIT*
+// variables, or returns nil if DONATION_SERVER_RATE_LIMIT is not set.
+func newRateLimiter(clientIPHeader clientip.Header) (*ratelimit.Limiter, error) {
+	limit := cfg.Get("DONATION_SERVER_RATE_LIMIT")
+	if limit == "" {
+		return nil, nil
+	}
+	config := ratelimit.Config{ClientIPHeader: clientIPHeader}
+
+	var err error
+	if config.Rate, err = ratelimit.ParseRate(limit); err != nil {
+		return nil, fmt.Errorf("invalid DONATION_SERVER_RATE_LIMIT: %v", err)
+	}
+	if cfg.Get("DONATION_SERVER_RATE_LIMIT_BURST") != "" {
+		if config.Burst = int(cfg.Int("DONATION_SERVER_RATE_LIMIT_BURST")); config.Burst < 1 {
+			return nil, fmt.Errorf("DONATION_SERVER_RATE_LIMIT_BURST must be a positive number")
+		}
+	}
+	if config.AllowedCIDRs, err = geoblock.ParseCIDRs(cfg.Get("DONATION_SERVER_RATE_LIMIT_ALLOWED_CIDRS")); err != nil {
+		return nil, err
+	}
+	for _, origin := range strings.FieldsFunc(cfg.Get("DONATION_SERVER_RATE_LIMIT_ALLOWED_ORIGINS"), func(r rune) bool { return r == ',' || r == ' ' }) {
+		if !strings.HasPrefix(origin, "https://") && !strings.HasPrefix(origin, "http://") {
+			return nil, fmt.Errorf("DONATION_SERVER_RATE_LIMIT_ALLOWED_ORIGINS must be origins like https://example.org, not %q", origin)
+		}
+		config.AllowedOrigins = append(config.AllowedOrigins, origin)
+	}
+
+	return ratelimit.NewLimiter(config), nil
+}
+
+// notifierKinds returns the notifiers of a comma-separated list, like
+// "kafka,email".
+func notifierKinds(list string) []string {
+	kinds := strings.Split(list, ",")
+	for i, kind := range kinds {
+		kinds[i] = strings.TrimSpace(kind)
+	}
+	return kinds
+}
+
+// newNotifier creates the "kafka", "webhook", "sqs", "sns" or "email"
+// notifier from the UPSTASH_KAFKA_*, DONATION_SERVER_WEBHOOK_NOTIFIER_*,
+// AWS or email variables. Events a batching Kafka notifier cannot write are
+// dead-lettered with deadLetters, if it is not nil.
+func newNotifier(kind string, cloudEvents *cloudevents.Config, deadLetters notifier.DeadLetterFunc) (notifier.Notifier, error) {
+	switch kind {
+	case "kafka":
+		opts := []kafka.Option{kafka.WithLogger(zap.L().Named("kafka"))}
+		if cloudEvents != nil {
+			opts = append(opts, kafka.WithCloudEvents(cloudEvents))
+		}
+		if size := cfg.Get("DONATION_SERVER_KAFKA_BATCH_SIZE"); size != "" {
+			batchSize := int(cfg.Int("DONATION_SERVER_KAFKA_BATCH_SIZE"))
+			if batchSize < 1 {
+				return nil, fmt.Errorf("DONATION_SERVER_KAFKA_BATCH_SIZE must be a positive number, not %q", size)
+			}
+			batchTimeout := time.Second
+			if cfg.Get("DONATION_SERVER_KAFKA_BATCH_TIMEOUT") != "" {
+				if batchTimeout = cfg.Duration("DONATION_SERVER_KAFKA_BATCH_TIMEOUT"); batchTimeout <= 0 {
+					return nil, fmt.Errorf("DONATION_SERVER_KAFKA_BATCH_TIMEOUT must be a duration like 100ms")
+				}
+			}
+			opts = append(opts, kafka.WithBatching(batchSize, batchTimeout))
+		}
+		if deadLetters != nil {
+			opts = append(opts, kafka.WithDeadLetters(deadLetters))
+		}
+		return kafka.NewKafkaNotifier(
+			strings.Split(cfg.Get("UPSTASH_KAFKA_BOOTSTRAP_SERVERS"), ","),
+			cfg.Get("DONATION_SERVER_CUSTOMERS_TOPIC"),
+			cfg.Get("UPSTASH_KAFKA_SCRAM_USERNAME"),
+			cfg.Get("UPSTASH_KAFKA_SCRAM_PASSWORD"),
+			opts...,
+		)
+	case "webhook":
+		opts := []webhook.Option{webhook.WithLogger(zap.L().Named("webhook"))}
+		if cloudEvents != nil {
+			opts = append(opts, webhook.WithCloudEvents(cloudEvents))
+		}
+		if dir := cfg.Get("DONATION_SERVER_WEBHOOK_NOTIFIER_TEMPLATES"); dir != "" {
+			templates, err := webhook.LoadTemplates(dir)
+			if err != nil {
+				return nil, err
+			}
+			log.Printf("Webhook notifier templates for events: %s\n", strings.Join(templates.Types(), ", "))
+			opts = append(opts, webhook.WithTemplates(templates))
+		}
+		return webhook.NewWebhookNotifier(cfg.Get("DONATION_SERVER_WEBHOOK_NOTIFIER_URL"), opts...)
+	case "sqs", "sns":
+		return newSQSNotifier(kind, cloudEvents)
+	case "email":
+		return newEmailNotifier()
+	default:
+		return nil, fmt.Errorf("unknown notifier %q", kind)
+	}
+}
+
+// newSQSNotifier creates the "sqs" or "sns" notifier from the
+// DONATION_SERVER_SQS_QUEUE_URL or DONATION_SERVER_SNS_TOPIC_ARN,
+// DONATION_SERVER_SQS_REGION and AWS_* variables. Without an access key, the
+// credentials of the IAM role of the server are used.
+func newSQSNotifier(kind string, cloudEvents *cloudevents.Config) (*sqs.SQSNotifier, error) {
+	target := cfg.Get("DONATION_SERVER_SQS_QUEUE_URL")
+	if kind == "sns" {
+		target = cfg.Get("DONATION_SERVER_SNS_TOPIC_ARN")
+	}
+	if target == "" {
+		return nil, fmt.Errorf("the %s notifier requires DONATION_SERVER_SQS_QUEUE_URL or DONATION_SERVER_SNS_TOPIC_ARN", kind)
+	}
+
+	opts := []sqs.Option{sqs.WithLogger(zap.L().Named(kind)), sqs.WithClient(&http.Client{Timeout: 10 * time.Second})}
+	if region := cfg.Get("DONATION_SERVER_SQS_REGION"); region != "" {
+		opts = append(opts, sqs.WithRegion(region))
+	}
+	if endpoint := cfg.Get("DONATION_SERVER_SNS_ENDPOINT"); endpoint != "" {
+		opts = append(opts, sqs.WithEndpoint(endpoint))
+	}
+	if keyID := cfg.Get("AWS_ACCESS_KEY_ID"); keyID != "" {
+		opts = append(opts, sqs.WithCredentials(sqs.StaticCredentials{
+			AccessKeyID:     keyID,
+			SecretAccessKey: cfg.Get("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    cfg.Get("AWS_SESSION_TOKEN"),
+		}))
+	}
+	if cloudEvents != nil {
+		opts = append(opts, sqs.WithCloudEvents(cloudEvents))
+	}
+	return sqs.NewSQSNotifier(target, opts...)
+}
+
+// newSMTPSender creates the sender of DONATION_SERVER_SMTP_ADDR and its
+// credentials, or returns nil if it is not set.
+func newSMTPSender() *email.SMTPSender {
+	addr := cfg.Get("DONATION_SERVER_SMTP_ADDR")
+	if addr == "" {
+		return nil
+	}
+	return &email.SMTPSender{
+		Addr:     addr,
+		Username: cfg.Get("DONATION_SERVER_SMTP_USERNAME"),
+		Password: cfg.Get("DONATION_SERVER_SMTP_PASSWORD"),
+	}
+}
+
+// newEmailNotifier creates an email.EmailNotifier from the
+// DONATION_SERVER_EMAIL_*, DONATION_SERVER_SMTP_* and
+// DONATION_SERVER_SENDGRID_API_KEY variables. CloudEvents do not apply to emails.
+func newEmailNotifier() (*email.EmailNotifier, error) {
+	var sender email.Sender
+	if key := cfg.Get("DONATION_SERVER_SENDGRID_API_KEY"); key != "" {
+		sender = &email.SendGridSender{APIKey: key, Client: &http.Client{Timeout: 10 * time.Second}}
+	} else if smtpSender := newSMTPSender(); smtpSender != nil {
+		sender = smtpSender
+	} else {
+		return nil, fmt.Errorf("DONATION_SERVER_SMTP_ADDR or DONATION_SERVER_SENDGRID_API_KEY is required to send emails")
+	}
+
+	opts := []email.Option{email.WithLogger(zap.L().Named("email"))}
+	if list := cfg.Get("DONATION_SERVER_EMAIL_ADMINS"); list != "" {
+		admins, err := mail.ParseAddressList(list)
+		if err != nil {
+			return nil, fmt.Errorf("DONATION_SERVER_EMAIL_ADMINS must be a list of addresses: %v", err)
+		}
+		addresses := make([]mail.Address, len(admins))
+		for i, admin := range admins {
+			addresses[i] = *admin
+		}
+		opts = append(opts, email.WithAdmins(addresses...))
+	}
+	if dir := cfg.Get("DONATION_SERVER_EMAIL_TEMPLATES"); dir != "" {
+		templates, err := email.LoadTemplates(dir)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, email.WithTemplates(templates))
 	}
+	return email.NewEmailNotifier(cfg.Get("DONATION_SERVER_EMAIL_FROM"), sender, opts...)
 }
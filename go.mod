@@ -3,9 +3,14 @@ module github.com/vedrankolka/donation-server
 go 1.17
 
 require (
+	github.com/andybalholm/brotli v1.0.5
 	github.com/joho/godotenv v1.4.0
+	github.com/lib/pq v1.10.9
 	github.com/segmentio/kafka-go v0.4.40
-	github.com/stripe/stripe-go/v72 v72.77.0
+	github.com/stripe/stripe-go/v76 v76.25.0
+	go.uber.org/zap v1.21.0
+	golang.org/x/text v0.3.8
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -14,5 +19,6 @@ require (
 	github.com/xdg-go/pbkdf2 v1.0.0 // indirect
 	github.com/xdg-go/scram v1.1.2 // indirect
 	github.com/xdg-go/stringprep v1.0.4 // indirect
-	golang.org/x/text v0.3.8 // indirect
+	go.uber.org/atomic v1.7.0 // indirect
+	go.uber.org/multierr v1.6.0 // indirect
 )
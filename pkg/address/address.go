@@ -0,0 +1,128 @@
+package address
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Address is a donor's billing or mailing address.
+type Address struct {
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2,omitempty"`
+	City       string `json:"city"`
+	PostalCode string `json:"postalCode"`
+	State      string `json:"state,omitempty"`
+	// Country is an ISO 3166-1 alpha-2 country code.
+	Country string `json:"country"`
+}
+
+// IsEmpty reports whether no field of the address is set.
+func (a Address) IsEmpty() bool {
+	return a == Address{}
+}
+
+// ValidationError describes why an address is invalid.
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid address %s: %s", e.Field, e.Message)
+}
+
+// Validator validates an address and returns its normalized form.
+type Validator interface {
+	Validate(ctx context.Context, a Address) (Address, error)
+}
+
+var (
+	countryPattern = regexp.MustCompile(`^[A-Z]{2}$`)
+
+	// postalCodePatterns holds postal code formats of countries we commonly
+	// receive donations from. Other countries only get a length check.
+	postalCodePatterns = map[string]*regexp.Regexp{
+		"AT": regexp.MustCompile(`^\d{4}$`),
+		"BE": regexp.MustCompile(`^\d{4}$`),
+		"BA": regexp.MustCompile(`^\d{5}$`),
+		"CA": regexp.MustCompile(`^[A-Z]\d[A-Z] ?\d[A-Z]\d$`),
+		"CH": regexp.MustCompile(`^\d{4}$`),
+		"DE": regexp.MustCompile(`^\d{5}$`),
+		"ES": regexp.MustCompile(`^\d{5}$`),
+		"FR": regexp.MustCompile(`^\d{5}$`),
+		"GB": regexp.MustCompile(`^[A-Z]{1,2}\d[A-Z\d]? ?\d[A-Z]{2}$`),
+		"HR": regexp.MustCompile(`^\d{5}$`),
+		"HU": regexp.MustCompile(`^\d{4}$`),
+		"IT": regexp.MustCompile(`^\d{5}$`),
+		"NL": regexp.MustCompile(`^\d{4} ?[A-Z]{2}$`),
+		"PL": regexp.MustCompile(`^\d{2}-\d{3}$`),
+		"RS": regexp.MustCompile(`^\d{5}$`),
+		"SI": regexp.MustCompile(`^\d{4}$`),
+		"US": regexp.MustCompile(`^\d{5}(-\d{4})?$`),
+	}
+)
+
+// BasicValidator performs format checks only: required fields are set, the
+// country is a two letter code and the postal code matches the country format.
+type BasicValidator struct{}
+
+// Validate trims all fields, upper-cases the country and postal code and
+// checks the format of the address.
+func (BasicValidator) Validate(ctx context.Context, a Address) (Address, error) {
+	a = Address{
+		Line1:      strings.TrimSpace(a.Line1),
+		Line2:      strings.TrimSpace(a.Line2),
+		City:       strings.TrimSpace(a.City),
+		PostalCode: strings.ToUpper(strings.TrimSpace(a.PostalCode)),
+		State:      strings.TrimSpace(a.State),
+		Country:    strings.ToUpper(strings.TrimSpace(a.Country)),
+	}
+
+	if a.Line1 == "" {
+		return a, &ValidationError{Field: "line1", Message: "is required"}
+	}
+	if a.City == "" {
+		return a, &ValidationError{Field: "city", Message: "is required"}
+	}
+	if !countryPattern.MatchString(a.Country) {
+		return a, &ValidationError{Field: "country", Message: "must be a two letter country code"}
+	}
+
+	for field, value := range map[string]string{"line1": a.Line1, "line2": a.Line2, "city": a.City, "state": a.State} {
+		if len(value) > 200 {
+			return a, &ValidationError{Field: field, Message: "is too long"}
+		}
+	}
+
+	if pattern, ok := postalCodePatterns[a.Country]; ok {
+		if !pattern.MatchString(a.PostalCode) {
+			return a, &ValidationError{Field: "postalCode", Message: "does not match the format of " + a.Country}
+		}
+	} else if len(a.PostalCode) > 12 {
+		return a, &ValidationError{Field: "postalCode", Message: "is too long"}
+	}
+
+	if a.Country == "US" && a.State == "" {
+		return a, &ValidationError{Field: "state", Message: "is required for US addresses"}
+	}
+
+	return a, nil
+}
+
+// Chain runs the validators in order, each on the output of the previous one.
+// It is used to run a provider after the BasicValidator.
+type Chain []Validator
+
+// Validate runs all validators in the chain.
+func (c Chain) Validate(ctx context.Context, a Address) (Address, error) {
+	for _, v := range c {
+		var err error
+		if a, err = v.Validate(ctx, a); err != nil {
+			return a, err
+		}
+	}
+
+	return a, nil
+}
@@ -0,0 +1,65 @@
+package address
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// HTTPValidator delegates validation to an external service, e.g. an adapter
+// in front of a commercial address verification API.
+//
+// The address is POSTed as JSON to URL. The service responds with 200 and the
+// normalized address, or with 422 and a {"field": "...", "message": "..."}
+// object describing why the address is invalid.
+type HTTPValidator struct {
+	URL    string
+	Client *http.Client
+}
+
+// Validate sends the address to the validation service.
+func (v *HTTPValidator) Validate(ctx context.Context, a Address) (Address, error) {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return a, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.URL, bytes.NewReader(body))
+	if err != nil {
+		return a, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := v.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return a, fmt.Errorf("address validation service: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var normalized Address
+		if err := json.NewDecoder(resp.Body).Decode(&normalized); err != nil {
+			return a, fmt.Errorf("address validation service: %w", err)
+		}
+		return normalized, nil
+	case http.StatusUnprocessableEntity:
+		var validationErr struct {
+			Field   string `json:"field"`
+			Message string `json:"message"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&validationErr); err != nil {
+			return a, fmt.Errorf("address validation service: %w", err)
+		}
+		return a, &ValidationError{Field: validationErr.Field, Message: validationErr.Message}
+	default:
+		return a, fmt.Errorf("address validation service responded with %s", resp.Status)
+	}
+}
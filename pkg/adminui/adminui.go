@@ -0,0 +1,47 @@
+// Package adminui serves a small admin dashboard, embedded in the binary, over
+// the admin API: donations with refunds, campaign progress, the webhook event
+// log and dead letters.
+//
+// The pages hold no data. The dashboard asks for the admin API key, keeps it
+// for the browser session and sends it with every API call, so the API stays
+// the only thing to protect.
+package adminui
+
+import (
+	"bytes"
+	"embed"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Prefix is the path the dashboard is served at.
+const Prefix = "/admin/ui/"
+
+//go:embed assets
+var files embed.FS
+
+// loaded is when the assets were loaded, their modification time.
+var loaded = time.Now()
+
+// Handler serves the dashboard at Prefix and its assets under it.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, Prefix)
+	if name == "" {
+		name = "index.html"
+	}
+	content, err := files.ReadFile("assets/" + name)
+	if err != nil || strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	// The dashboard is small and changes with every release.
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, name, loaded, bytes.NewReader(content))
+}
@@ -0,0 +1,241 @@
+// Admin dashboard over the admin API. The API key is kept in the session
+// storage of the browser and sent with every request, so the dashboard itself
+// needs no login of its own.
+(function () {
+  var storageKey = "donation-server-admin-key";
+  var login = document.getElementById("login");
+  var app = document.getElementById("app");
+  var errorMessage = document.getElementById("error");
+
+  function apiKey() {
+    return window.sessionStorage.getItem(storageKey);
+  }
+
+  function request(method, path, body) {
+    var init = {
+      method: method,
+      headers: { Authorization: "Bearer " + apiKey() },
+    };
+    if (body) {
+      init.headers["Content-Type"] = "application/json";
+      init.body = JSON.stringify(body);
+    }
+    return fetch(path, init).then(function (resp) {
+      if (resp.status === 401) {
+        signOut("The API key was not accepted.");
+        throw new Error(resp.statusText);
+      }
+      return resp.text().then(function (text) {
+        var data = text ? JSON.parse(text) : {};
+        if (!resp.ok) {
+          throw new Error((data.error && data.error.message) || data.error || resp.statusText);
+        }
+        return data;
+      });
+    });
+  }
+
+  function showError(err) {
+    errorMessage.textContent = err ? err.message : "";
+  }
+
+  // money formats an amount in the smallest unit of its currency.
+  function money(amount, currency) {
+    var digits = zeroDecimal.indexOf(currency) >= 0 ? 0 : 2;
+    return (amount / Math.pow(10, digits)).toFixed(digits) + " " + currency;
+  }
+  var zeroDecimal = ["BIF", "CLP", "DJF", "GNF", "JPY", "KMF", "KRW", "MGA", "PYG", "RWF", "UGX", "VND", "VUV", "XAF", "XOF", "XPF"];
+
+  function date(value) {
+    return value ? new Date(value).toLocaleString() : "";
+  }
+
+  function cell(row, text, className) {
+    var td = document.createElement("td");
+    td.textContent = text === undefined || text === null ? "" : String(text);
+    if (className) {
+      td.className = className;
+    }
+    row.appendChild(td);
+    return td;
+  }
+
+  function button(td, label, onClick) {
+    var b = document.createElement("button");
+    b.textContent = label;
+    b.addEventListener("click", onClick);
+    td.appendChild(b);
+    return b;
+  }
+
+  // list shows a paginated admin list in the section, with the filters of
+  // its form, adding a row per item with render.
+  function list(section, path, render) {
+    var tbody = section.querySelector("tbody");
+    var more = section.querySelector(".more");
+    var form = section.querySelector(".filters");
+    var cursor = "";
+
+    function load(reset) {
+      var params = new URLSearchParams();
+      if (form) {
+        new FormData(form).forEach(function (value, name) {
+          if (value) {
+            params.set(name, name === "currency" ? value.toUpperCase() : value);
+          }
+        });
+      }
+      if (reset) {
+        cursor = "";
+      }
+      if (cursor) {
+        params.set("cursor", cursor);
+      }
+      return request("GET", path + "?" + params).then(function (page) {
+        if (reset) {
+          tbody.textContent = "";
+        }
+        (page.data || []).forEach(function (item) {
+          var row = document.createElement("tr");
+          render(row, item, reload);
+          tbody.appendChild(row);
+        });
+        cursor = page.nextCursor || "";
+        more.hidden = !page.hasMore;
+      }).catch(showError);
+    }
+
+    function reload() {
+      showError(null);
+      return load(true);
+    }
+
+    if (form) {
+      form.addEventListener("submit", function (e) {
+        e.preventDefault();
+        reload();
+      });
+    }
+    more.addEventListener("click", function () {
+      load(false);
+    });
+    return reload;
+  }
+
+  var tabs = {
+    donations: list(document.getElementById("donations"), "/admin/donations", function (row, d, reload) {
+      cell(row, date(d.createdAt));
+      cell(row, d.id);
+      cell(row, d.customerName || d.customerEmail);
+      cell(row, money(d.amount, d.currency), "number");
+      cell(row, d.campaign);
+      cell(row, d.status);
+      var actions = cell(row, "");
+      if (d.status === "succeeded") {
+        button(actions, "Refund", function () {
+          if (!window.confirm("Refund " + money(d.amount, d.currency) + " to " + (d.customerName || d.customerEmail) + "?")) {
+            return;
+          }
+          request("POST", "/admin/refunds/" + encodeURIComponent(d.id), { reason: "requested_by_customer" })
+            .then(reload)
+            .catch(showError);
+        });
+      }
+    }),
+
+    campaigns: function () {
+      showError(null);
+      var tbody = document.querySelector("#campaigns tbody");
+      return request("GET", "/admin/stats/campaigns").then(function (stats) {
+        tbody.textContent = "";
+        (stats.data || []).forEach(function (c) {
+          var row = document.createElement("tr");
+          cell(row, c.campaign);
+          cell(row, c.donations, "number");
+          cell(row, money(c.amount, c.currency), "number");
+          tbody.appendChild(row);
+        });
+      }).catch(showError);
+    },
+
+    events: list(document.getElementById("events"), "/admin/events", function (row, e) {
+      cell(row, date(e.receivedAt));
+      var id = cell(row, "");
+      button(id, e.id, function () {
+        request("GET", "/admin/events/" + encodeURIComponent(e.id)).then(function (record) {
+          document.getElementById("event").textContent = JSON.stringify(record, null, 2);
+        }).catch(showError);
+      });
+      cell(row, e.type);
+      cell(row, e.outcome);
+      cell(row, e.retries, "number");
+    }),
+
+    "dead-letters": list(document.getElementById("dead-letters"), "/admin/dead-letters", function (row, dl, reload) {
+      cell(row, date(dl.failedAt));
+      cell(row, dl.eventID);
+      cell(row, dl.type);
+      cell(row, dl.error ? dl.reason + ": " + dl.error : dl.reason);
+      cell(row, dl.attempts, "number");
+      cell(row, dl.status);
+      var actions = cell(row, "");
+      if (dl.status === "pending") {
+        ["redrive", "discard"].forEach(function (action) {
+          button(actions, action === "redrive" ? "Redrive" : "Discard", function () {
+            request("POST", "/admin/dead-letters/" + encodeURIComponent(dl.id) + "/" + action)
+              .then(reload)
+              .catch(showError);
+          });
+        });
+      }
+    }),
+  };
+
+  function show(name) {
+    Object.keys(tabs).forEach(function (tab) {
+      document.getElementById(tab).hidden = tab !== name;
+    });
+    document.querySelectorAll("nav button").forEach(function (b) {
+      if (b.dataset.tab === name) {
+        b.setAttribute("aria-current", "page");
+      } else {
+        b.removeAttribute("aria-current");
+      }
+    });
+    tabs[name]();
+  }
+
+  function signOut(message) {
+    window.sessionStorage.removeItem(storageKey);
+    app.hidden = true;
+    login.hidden = false;
+    document.getElementById("login-error").textContent = message || "";
+  }
+
+  function signIn() {
+    login.hidden = true;
+    app.hidden = false;
+    show("donations");
+  }
+
+  document.querySelectorAll("nav button").forEach(function (b) {
+    b.addEventListener("click", function () {
+      show(b.dataset.tab);
+    });
+  });
+  document.getElementById("logout").addEventListener("click", function () {
+    signOut();
+  });
+  login.addEventListener("submit", function (e) {
+    e.preventDefault();
+    window.sessionStorage.setItem(storageKey, login.key.value);
+    login.reset();
+    signIn();
+  });
+
+  if (apiKey()) {
+    signIn();
+  } else {
+    signOut();
+  }
+})();
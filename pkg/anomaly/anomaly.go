@@ -0,0 +1,371 @@
+// Package anomaly flags unusual patterns in the stream of donations, like a
+// burst of donations from one client IP or email, a spike in volume, or
+// amounts distributed unlike before, as an early warning of fraud such as
+// card testing, or of a broken donation page.
+package anomaly
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/clock"
+	"github.com/vedrankolka/donation-server/pkg/jobs"
+	"github.com/vedrankolka/donation-server/pkg/listing"
+	"github.com/vedrankolka/donation-server/pkg/metrics"
+	"github.com/vedrankolka/donation-server/pkg/store"
+)
+
+// Kinds of findings.
+const (
+	// KindIP is a burst of donations from one client IP.
+	KindIP = "ip"
+	// KindEmail is a burst of donations from one email address.
+	KindEmail = "email"
+	// KindVolume is a spike in the number of donations.
+	KindVolume = "volume"
+	// KindAmounts is a distribution of amounts unlike the usual one.
+	KindAmounts = "amounts"
+)
+
+var kinds = []string{KindIP, KindEmail, KindVolume, KindAmounts}
+
+const (
+	// DefaultWindow is the span of recent donations checked.
+	DefaultWindow = time.Hour
+	// Baseline is the week of donations before the window it is compared with.
+	Baseline = 7 * 24 * time.Hour
+	// MinSamples is the number of donations needed to compare the
+	// distribution of their amounts.
+	MinSamples = 30
+)
+
+var anomalies = metrics.NewGaugeVec(
+	"donation_server_anomalies",
+	"Anomalies found in the recent donations at the last check, by kind (ip, email, volume or amounts).",
+	"kind",
+)
+
+// Thresholds tell what is unusual. Zero values are not checked.
+type Thresholds struct {
+	// MaxPerIP and MaxPerEmail are the most donations one client IP or email
+	// address makes in the window.
+	MaxPerIP    int
+	MaxPerEmail int
+	// SpikeFactor is how many times the average number of donations of a
+	// window of the baseline the window may have.
+	SpikeFactor float64
+	// MinSpike is the fewest donations of a spike, so a quiet baseline does
+	// not make a handful of donations one.
+	MinSpike int
+	// MaxChiSquare is the highest chi-square statistic of the first digits
+	// of the amounts in the window against those of the baseline.
+	MaxChiSquare float64
+}
+
+// DefaultThresholds flag what is rare for donations. 20.09 is the chi-square
+// of eight degrees of freedom that is exceeded by chance once in a hundred.
+var DefaultThresholds = Thresholds{
+	MaxPerIP:     5,
+	MaxPerEmail:  5,
+	SpikeFactor:  5,
+	MinSpike:     20,
+	MaxChiSquare: 20.09,
+}
+
+// Finding is an anomaly.
+type Finding struct {
+	Kind string `json:"kind"`
+	// Key is the IP or email address of bursts.
+	Key     string `json:"key,omitempty"`
+	Count   int    `json:"count"`
+	Message string `json:"message"`
+}
+
+// Alerter sends alerts about anomalies, e.g. sla.WebhookAlerter to Slack.
+type Alerter interface {
+	Alert(ctx context.Context, message string) error
+}
+
+// Detector checks the recent donations for anomalies.
+type Detector struct {
+	donations  store.DonationStore
+	alerter    Alerter
+	thresholds Thresholds
+	window     time.Duration
+
+	mu sync.Mutex
+	// alertedAt keeps when findings were alerted, so overlapping windows
+	// alert each once.
+	alertedAt map[string]time.Time
+}
+
+// NewDetector creates a Detector of anomalies in the donations of the last
+// window, alerted with the alerter, or only logged if it is nil.
+func NewDetector(donations store.DonationStore, alerter Alerter, thresholds Thresholds, window time.Duration) *Detector {
+	return &Detector{
+		donations:  donations,
+		alerter:    alerter,
+		thresholds: thresholds,
+		window:     window,
+		alertedAt:  make(map[string]time.Time),
+	}
+}
+
+// Window returns the span of recent donations checked.
+func (d *Detector) Window() time.Duration {
+	return d.window
+}
+
+// Job returns the job checking the donations four times per window, to run
+// with a jobs.Scheduler.
+func (d *Detector) Job() jobs.Job {
+	return jobs.Job{
+		Name:     "anomaly",
+		Schedule: clock.Every(d.window / 4),
+		Run: func(ctx context.Context, due time.Time) error {
+			return d.Check(ctx, due)
+		},
+	}
+}
+
+// Check detects the anomalies of the window before now, sets their metrics
+// and alerts those that were not alerted in the window before.
+func (d *Detector) Check(ctx context.Context, now time.Time) error {
+	findings, err := d.Detect(ctx, now)
+	if err != nil {
+		return err
+	}
+
+	counts := make(map[string]int)
+	for _, f := range findings {
+		counts[f.Kind]++
+	}
+	for _, kind := range kinds {
+		anomalies.Set(float64(counts[kind]), kind)
+	}
+
+	for _, f := range findings {
+		key := f.Kind + "/" + f.Key
+		d.mu.Lock()
+		alerted := now.Sub(d.alertedAt[key]) < d.window
+		if !alerted {
+			d.alertedAt[key] = now
+		}
+		d.mu.Unlock()
+		if alerted {
+			continue
+		}
+
+		log.Printf("[ANOMALY] %s\n", f.Message)
+		if d.alerter == nil {
+			continue
+		}
+		if err := d.alerter.Alert(ctx, "Anomaly: "+f.Message); err != nil {
+			log.Printf("Could not send anomaly alert: %v\n", err)
+		}
+	}
+
+	d.mu.Lock()
+	for key, at := range d.alertedAt {
+		if now.Sub(at) >= d.window {
+			delete(d.alertedAt, key)
+		}
+	}
+	d.mu.Unlock()
+	return nil
+}
+
+// Detect returns the anomalies of the donations of the window before now,
+// compared with the Baseline before the window.
+func (d *Detector) Detect(ctx context.Context, now time.Time) ([]Finding, error) {
+	from := now.Add(-d.window)
+	var recent, baseline []*store.Donation
+	err := d.each(ctx, from.Add(-Baseline), now, func(donation *store.Donation) {
+		if donation.CreatedAt.Before(from) {
+			baseline = append(baseline, donation)
+		} else {
+			recent = append(recent, donation)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var findings []Finding
+	findings = append(findings, d.bursts(KindIP, recent, d.thresholds.MaxPerIP, func(donation *store.Donation) string {
+		return donation.ClientIP
+	})...)
+	findings = append(findings, d.bursts(KindEmail, recent, d.thresholds.MaxPerEmail, func(donation *store.Donation) string {
+		return donation.CustomerEmail
+	})...)
+	if f, ok := d.spike(recent, baseline); ok {
+		findings = append(findings, f)
+	}
+	if f, ok := d.amounts(recent, baseline); ok {
+		findings = append(findings, f)
+	}
+	return findings, nil
+}
+
+// bursts finds the keys of more than max donations, most first.
+func (d *Detector) bursts(kind string, recent []*store.Donation, max int, key func(*store.Donation) string) []Finding {
+	if max <= 0 {
+		return nil
+	}
+	counts := make(map[string]int)
+	for _, donation := range recent {
+		if k := key(donation); k != "" {
+			counts[k]++
+		}
+	}
+
+	var findings []Finding
+	for k, count := range counts {
+		if count > max {
+			findings = append(findings, Finding{
+				Kind:    kind,
+				Key:     k,
+				Count:   count,
+				Message: fmt.Sprintf("%d donations from %s %s in the last %v.", count, kindName(kind), k, d.window),
+			})
+		}
+	}
+	sort.Slice(findings, func(i, j int) bool {
+		if findings[i].Count != findings[j].Count {
+			return findings[i].Count > findings[j].Count
+		}
+		return findings[i].Key < findings[j].Key
+	})
+	return findings
+}
+
+func kindName(kind string) string {
+	if kind == KindIP {
+		return "IP"
+	}
+	return kind
+}
+
+// spike finds more donations in the window than SpikeFactor times those of
+// an average window of the baseline.
+func (d *Detector) spike(recent, baseline []*store.Donation) (Finding, bool) {
+	if d.thresholds.SpikeFactor <= 0 || len(recent) < d.thresholds.MinSpike {
+		return Finding{}, false
+	}
+	usual := float64(len(baseline)) * float64(d.window) / float64(Baseline)
+	if float64(len(recent)) <= d.thresholds.SpikeFactor*math.Max(usual, 1) {
+		return Finding{}, false
+	}
+	return Finding{
+		Kind:    KindVolume,
+		Count:   len(recent),
+		Message: fmt.Sprintf("%d donations in the last %v, usually %.1f.", len(recent), d.window, usual),
+	}, true
+}
+
+// amounts compares the first digits of the amounts in the window with those
+// of the baseline, or with Benford's law if the baseline is too small.
+// Donation amounts cluster at the amounts donation pages suggest, so they
+// follow Benford's law loosely, and their own history is the better
+// reference.
+func (d *Detector) amounts(recent, baseline []*store.Donation) (Finding, bool) {
+	if d.thresholds.MaxChiSquare <= 0 || len(recent) < MinSamples {
+		return Finding{}, false
+	}
+	expected := benford
+	reference := "Benford's law"
+	if len(baseline) >= MinSamples {
+		expected = distribution(firstDigits(baseline))
+		reference = "the week before"
+	}
+
+	observed := firstDigits(recent)
+	var chiSquare float64
+	for digit := 1; digit <= 9; digit++ {
+		e := expected[digit] * float64(len(recent))
+		chiSquare += (observed[digit] - e) * (observed[digit] - e) / e
+	}
+	if chiSquare <= d.thresholds.MaxChiSquare {
+		return Finding{}, false
+	}
+	top := 1
+	for digit := 2; digit <= 9; digit++ {
+		if observed[digit] > observed[top] {
+			top = digit
+		}
+	}
+	return Finding{
+		Kind:  KindAmounts,
+		Count: len(recent),
+		Message: fmt.Sprintf("The amounts of the %d donations in the last %v are distributed unlike those of %s (chi-square %.1f), %.0f%% start with %d.",
+			len(recent), d.window, reference, chiSquare, observed[top]*100/float64(len(recent)), top),
+	}, true
+}
+
+// benford is the share of numbers starting with each digit by Benford's law.
+var benford = func() [10]float64 {
+	var p [10]float64
+	for digit := 1; digit <= 9; digit++ {
+		p[digit] = math.Log10(1 + 1/float64(digit))
+	}
+	return p
+}()
+
+// firstDigits counts the donations by the first digit of their amount.
+func firstDigits(donations []*store.Donation) [10]float64 {
+	var counts [10]float64
+	for _, donation := range donations {
+		if donation.Amount > 0 {
+			counts[strconv.FormatInt(donation.Amount, 10)[0]-'0']++
+		}
+	}
+	return counts
+}
+
+// distribution returns the shares of the counts, smoothed so no digit is
+// impossible.
+func distribution(counts [10]float64) [10]float64 {
+	var total float64
+	for digit := 1; digit <= 9; digit++ {
+		total += counts[digit]
+	}
+	var p [10]float64
+	for digit := 1; digit <= 9; digit++ {
+		p[digit] = (counts[digit] + 1) / (total + 9)
+	}
+	return p
+}
+
+// each calls fn with every donation created in [from, to).
+func (d *Detector) each(ctx context.Context, from, to time.Time, fn func(*store.Donation)) error {
+	q, err := store.DonationListSpec.Parse(url.Values{})
+	if err != nil {
+		return err
+	}
+	q.Limit = listing.MaxLimit
+	q.Filter.CreatedGTE = from
+	q.Filter.CreatedLTE = to.Add(-time.Nanosecond)
+
+	for {
+		page, next, err := d.donations.ListDonations(ctx, q)
+		if err != nil {
+			return err
+		}
+		for _, donation := range page {
+			fn(donation)
+		}
+		if next == "" {
+			return nil
+		}
+		if q.Cursor, err = listing.DecodeCursor(next); err != nil {
+			return err
+		}
+	}
+}
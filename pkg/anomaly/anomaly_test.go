@@ -0,0 +1,100 @@
+package anomaly
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/store"
+)
+
+var now = time.Date(2024, 11, 29, 12, 0, 0, 0, time.UTC)
+
+type alerts []string
+
+func (a *alerts) Alert(ctx context.Context, message string) error {
+	*a = append(*a, message)
+	return nil
+}
+
+// newStore returns a store with a donation every two hours of the baseline,
+// with amounts following Benford's law.
+func newStore(t *testing.T) *store.MemoryStore {
+	s := store.NewMemoryStore()
+	amounts := []int64{1000, 1500, 2000, 2500, 3000, 1000, 4000, 5000, 1200, 6000, 1000, 2000, 7000, 8000, 1000, 9000, 3000, 2000, 1000, 1500}
+	for i := 0; i < int(Baseline/(2*time.Hour)); i++ {
+		save(t, s, &store.Donation{
+			ID:            fmt.Sprintf("ch_b%d", i),
+			CustomerEmail: fmt.Sprintf("donor%d@example.org", i),
+			Amount:        amounts[i%len(amounts)],
+			CreatedAt:     now.Add(-DefaultWindow - time.Duration(i)*2*time.Hour - time.Minute),
+		})
+	}
+	return s
+}
+
+func save(t *testing.T, s *store.MemoryStore, d *store.Donation) {
+	t.Helper()
+	d.Currency = "eur"
+	d.Status = store.StatusSucceeded
+	if err := s.SaveDonation(context.Background(), d); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDetectNothingUsual(t *testing.T) {
+	s := newStore(t)
+	save(t, s, &store.Donation{ID: "ch_1", ClientIP: "203.0.113.7", Amount: 2000, CreatedAt: now.Add(-time.Minute)})
+	findings, err := NewDetector(s, nil, DefaultThresholds, DefaultWindow).Detect(context.Background(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 0 {
+		t.Errorf("Detect = %+v, want no findings", findings)
+	}
+}
+
+func TestDetectCardTesting(t *testing.T) {
+	s := newStore(t)
+	for i := 0; i < 40; i++ {
+		save(t, s, &store.Donation{
+			ID:            fmt.Sprintf("ch_%d", i),
+			ClientIP:      "203.0.113.7",
+			CustomerEmail: fmt.Sprintf("tester%d@example.org", i%2),
+			Amount:        100,
+			CreatedAt:     now.Add(-time.Duration(i+1) * time.Minute),
+		})
+	}
+
+	var sent alerts
+	d := NewDetector(s, &sent, DefaultThresholds, DefaultWindow)
+	findings, err := d.Detect(context.Background(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]int)
+	for _, f := range findings {
+		found[f.Kind]++
+	}
+	if found[KindIP] != 1 || found[KindEmail] != 2 || found[KindVolume] != 1 || found[KindAmounts] != 1 {
+		t.Errorf("Detect = %+v, want a burst from the IP and both emails, a spike and unusual amounts", findings)
+	}
+	if findings[0].Key != "203.0.113.7" || findings[0].Count != 40 {
+		t.Errorf("the IP finding is %+v", findings[0])
+	}
+
+	if err := d.Check(context.Background(), now); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != len(findings) || !strings.Contains(sent[0], "40 donations from IP 203.0.113.7") {
+		t.Errorf("alerts %q", sent)
+	}
+	if err := d.Check(context.Background(), now.Add(DefaultWindow/4)); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != len(findings) {
+		t.Errorf("the findings were alerted again in the same window: %q", sent)
+	}
+}
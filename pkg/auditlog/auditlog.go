@@ -0,0 +1,170 @@
+// Package auditlog keeps an append-only log of the financially relevant
+// events of the server, like recorded and refunded donations and issued
+// invoices, for external audits. Every entry carries the hash of the entry
+// before it, so changing, removing or reordering entries breaks the chain,
+// which Verify detects from the first broken entry on.
+//
+// The log is a file of JSON lines. Every instance of the server needs a file
+// of its own, as the chain of a file shared by several writers would fork.
+package auditlog
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxLine is the size of the longest entry Verify reads.
+const maxLine = 1 << 20
+
+// Entry is an event in the log.
+type Entry struct {
+	// Seq numbers the entries from 1, without gaps.
+	Seq  int64     `json:"seq"`
+	Time time.Time `json:"time"`
+	// Type is the kind of event, e.g. "donation.refunded".
+	Type string `json:"type"`
+	// Subject is what the event is about, e.g. the ID of the donation.
+	Subject string          `json:"subject"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	// Prev is the hash of the entry before, empty for the first one.
+	Prev string `json:"prev"`
+	Hash string `json:"hash"`
+}
+
+// hash returns the hash of the entry, of all its fields but Hash.
+func (e *Entry) hash() string {
+	h := sha256.New()
+	for _, field := range []string{
+		strconv.FormatInt(e.Seq, 10), e.Time.UTC().Format(time.RFC3339Nano),
+		e.Type, e.Subject, string(e.Data), e.Prev,
+	} {
+		// Fields are prefixed with their length, so moving bytes from one
+		// field to the next changes the hash.
+		fmt.Fprintf(h, "%d:%s", len(field), field)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ChainError is the error of a log whose chain is broken at an entry.
+type ChainError struct {
+	// Line is the line of the first broken entry, from 1.
+	Line   int64
+	Reason string
+}
+
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("the audit log is broken at line %d: %s", e.Line, e.Reason)
+}
+
+// Verify reads a log and checks its chain. It returns the number of entries
+// and the hash of the last one, which an auditor may keep to detect a log
+// truncated or rewritten as a whole later, or a *ChainError.
+func Verify(r io.Reader) (n int64, head string, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), maxLine)
+	for scanner.Scan() {
+		line := n + 1
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return n, head, &ChainError{Line: line, Reason: "invalid JSON: " + err.Error()}
+		}
+		switch {
+		case e.Seq != line:
+			return n, head, &ChainError{Line: line, Reason: fmt.Sprintf("the entry is number %d", e.Seq)}
+		case e.Prev != head:
+			return n, head, &ChainError{Line: line, Reason: "the entry does not follow the one before"}
+		case e.Hash != e.hash():
+			return n, head, &ChainError{Line: line, Reason: "the entry was changed"}
+		}
+		n, head = line, e.Hash
+	}
+	if err := scanner.Err(); err != nil {
+		return n, head, err
+	}
+	return n, head, nil
+}
+
+// Log appends entries to a file.
+type Log struct {
+	path string
+	now  func() time.Time
+
+	// mu guards the file and the head of the chain.
+	mu   sync.Mutex
+	seq  int64
+	head string
+}
+
+// Open opens the log at path, creating it if it does not exist. The chain of
+// an existing log is verified, so entries are never appended to a log that
+// was tampered with.
+func Open(path string) (*Log, error) {
+	l := &Log{path: path, now: time.Now}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if l.seq, l.head, err = Verify(f); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Head returns the number of entries and the hash of the last one.
+func (l *Log) Head() (int64, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.seq, l.head
+}
+
+// Append appends an entry of the event with its data, marshalled to JSON, if
+// not nil. The entry is synced to disk before Append returns.
+func (l *Log) Append(ctx context.Context, eventType, subject string, data interface{}) (*Entry, error) {
+	var raw json.RawMessage
+	if data != nil {
+		var err error
+		if raw, err = json.Marshal(data); err != nil {
+			return nil, err
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e := &Entry{
+		Seq:     l.seq + 1,
+		Time:    l.now().UTC(),
+		Type:    eventType,
+		Subject: subject,
+		Data:    raw,
+		Prev:    l.head,
+	}
+	e.Hash = e.hash()
+
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := json.NewEncoder(f).Encode(e); err != nil {
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	l.seq, l.head = e.Seq, e.Hash
+	return e, nil
+}
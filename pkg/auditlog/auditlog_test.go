@@ -0,0 +1,102 @@
+package auditlog
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/store"
+)
+
+// newLog opens a log in a temporary directory.
+func newLog(t *testing.T) (*Log, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l, path
+}
+
+func TestDonationStoreLogsChanges(t *testing.T) {
+	ctx := context.Background()
+	l, path := newLog(t)
+	donations := NewDonationStore(store.NewMemoryStore(), l)
+
+	d := &store.Donation{ID: "ch_1", CustomerID: "cus_1", Amount: 1000, Currency: "eur",
+		Status: store.StatusSucceeded, CreatedAt: time.Now()}
+	for _, save := range []func(){
+		func() {},
+		// A redelivered event saves the donation again.
+		func() {},
+		func() { d.Tags = []string{"gala"} },
+		func() { d.Status, d.RefundID = store.StatusRefunded, "re_1" },
+	} {
+		save()
+		if err := donations.SaveDonation(ctx, d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := donations.DeleteDonation(ctx, d.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, head, err := Verify(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq, want := l.Head(); n != 3 || seq != 3 || head != want {
+		t.Errorf("Verify returned %d entries up to %s, want 3 up to %s", n, head, want)
+	}
+	for i, want := range []string{TypeDonationRecorded, TypeDonationRefunded, TypeDonationDeleted} {
+		if line := bytes.Split(data, []byte("\n"))[i]; !bytes.Contains(line, []byte(`"type":"`+want+`"`)) {
+			t.Errorf("entry %d is %s, want %s", i+1, line, want)
+		}
+	}
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	ctx := context.Background()
+	l, path := newLog(t)
+	for _, subject := range []string{"ch_1", "ch_2", "ch_3"} {
+		if _, err := l.Append(ctx, TypeDonationRecorded, subject, map[string]int64{"amount": 1000}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+
+	for name, tc := range map[string]struct {
+		log  []byte
+		line int64
+	}{
+		"changed":   {bytes.Replace(data, []byte(`"amount":1000`), []byte(`"amount":10`), 1), 1},
+		"removed":   {bytes.Join([][]byte{lines[0], lines[2]}, nil), 2},
+		"reordered": {bytes.Join([][]byte{lines[1], lines[0], lines[2]}, nil), 1},
+	} {
+		_, _, err := Verify(bytes.NewReader(tc.log))
+		var chainErr *ChainError
+		if !errors.As(err, &chainErr) || chainErr.Line != tc.line {
+			t.Errorf("%s: Verify returned %v, want the chain broken at line %d", name, err, tc.line)
+		}
+	}
+
+	if err := os.WriteFile(path, lines[1], 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path); err == nil {
+		t.Error("Open accepted a tampered log")
+	}
+}
@@ -0,0 +1,136 @@
+package auditlog
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/store"
+	"github.com/vedrankolka/donation-server/pkg/vat"
+)
+
+// Types of entries.
+const (
+	TypeDonationRecorded = "donation.recorded"
+	TypeDonationRefunded = "donation.refunded"
+	// TypeDonationUpdated is a change of the amounts, status or invoice of a
+	// donation other than a refund.
+	TypeDonationUpdated = "donation.updated"
+	TypeDonationDeleted = "donation.deleted"
+	TypeInvoiceIssued   = "invoice.issued"
+)
+
+// donationData is the data of donation entries. Donors are only referenced
+// by their customer ID, as the log is never changed to erase them.
+type donationData struct {
+	ID             string    `json:"id"`
+	CustomerID     string    `json:"customerID"`
+	Amount         int64     `json:"amount"`
+	Currency       string    `json:"currency"`
+	Status         string    `json:"status"`
+	CreatedAt      time.Time `json:"createdAt"`
+	DonationAmount int64     `json:"donationAmount,omitempty"`
+	PurchaseAmount int64     `json:"purchaseAmount,omitempty"`
+	VATAmount      int64     `json:"vatAmount,omitempty"`
+	InvoiceNumber  string    `json:"invoiceNumber,omitempty"`
+	Campaign       string    `json:"campaign,omitempty"`
+	RefundID       string    `json:"refundID,omitempty"`
+}
+
+func newDonationData(d *store.Donation) donationData {
+	return donationData{
+		ID:             d.ID,
+		CustomerID:     d.CustomerID,
+		Amount:         d.Amount,
+		Currency:       d.Currency,
+		Status:         d.Status,
+		CreatedAt:      d.CreatedAt.UTC(),
+		DonationAmount: d.DonationAmount,
+		PurchaseAmount: d.PurchaseAmount,
+		VATAmount:      d.VATAmount,
+		InvoiceNumber:  d.InvoiceNumber,
+		Campaign:       d.Campaign,
+		RefundID:       d.RefundID,
+	}
+}
+
+// DonationStore is a store.DonationStore appending the financially relevant
+// changes of donations to a log. Entries are appended before the changes are
+// saved, so no saved change is missing from the log, though a change whose
+// save failed may be logged twice when it is retried.
+type DonationStore struct {
+	store.DonationStore
+	log *Log
+}
+
+// NewDonationStore returns the store logging the changes of the donations.
+func NewDonationStore(donations store.DonationStore, log *Log) *DonationStore {
+	return &DonationStore{DonationStore: donations, log: log}
+}
+
+// SaveDonation logs the donation if it is new, refunded or its amounts,
+// status or invoice changed, and saves it.
+func (s *DonationStore) SaveDonation(ctx context.Context, d *store.Donation) error {
+	data := newDonationData(d)
+	eventType := TypeDonationRecorded
+	prev, err := s.DonationStore.GetDonation(ctx, d.ID)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+	case err != nil:
+		return err
+	case newDonationData(prev) == data:
+		eventType = ""
+	case d.Status == store.StatusRefunded && prev.Status != store.StatusRefunded:
+		eventType = TypeDonationRefunded
+	default:
+		eventType = TypeDonationUpdated
+	}
+	if eventType != "" {
+		if _, err := s.log.Append(ctx, eventType, d.ID, data); err != nil {
+			return err
+		}
+	}
+	return s.DonationStore.SaveDonation(ctx, d)
+}
+
+// DeleteDonation logs the deletion of the donation and deletes it.
+func (s *DonationStore) DeleteDonation(ctx context.Context, id string) error {
+	if _, err := s.DonationStore.GetDonation(ctx, id); err != nil {
+		return err
+	}
+	if _, err := s.log.Append(ctx, TypeDonationDeleted, id, nil); err != nil {
+		return err
+	}
+	return s.DonationStore.DeleteDonation(ctx, id)
+}
+
+// InvoiceStore is a store.InvoiceStore appending issued invoices to a log.
+type InvoiceStore struct {
+	store.InvoiceStore
+	log *Log
+}
+
+// NewInvoiceStore returns the store logging the invoices issued.
+func NewInvoiceStore(invoices store.InvoiceStore, log *Log) *InvoiceStore {
+	return &InvoiceStore{InvoiceStore: invoices, log: log}
+}
+
+// SaveInvoice logs the invoice and saves it.
+func (s *InvoiceStore) SaveInvoice(ctx context.Context, invoice *vat.Invoice) error {
+	data := struct {
+		Number    string    `json:"number"`
+		IssuedAt  time.Time `json:"issuedAt"`
+		ChargeID  string    `json:"chargeID"`
+		Currency  string    `json:"currency"`
+		Net       int64     `json:"net"`
+		VAT       int64     `json:"vat"`
+		Gross     int64     `json:"gross"`
+		Donation  int64     `json:"donation"`
+		TotalPaid int64     `json:"totalPaid"`
+	}{invoice.Number, invoice.IssuedAt, invoice.ChargeID, invoice.Currency, invoice.Net,
+		invoice.VAT, invoice.Gross, invoice.Donation, invoice.TotalPaid}
+	if _, err := s.log.Append(ctx, TypeInvoiceIssued, invoice.Number, data); err != nil {
+		return err
+	}
+	return s.InvoiceStore.SaveInvoice(ctx, invoice)
+}
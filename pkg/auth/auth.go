@@ -0,0 +1,173 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/requestid"
+)
+
+// AdminPrincipal is the principal of requests authorized with the admin API key.
+const AdminPrincipal = "admin"
+
+// JWTPrincipalPrefix starts the principal of requests authorized with a JWT,
+// followed by its subject, so no JWT makes requests as AdminPrincipal.
+const JWTPrincipalPrefix = "jwt:"
+
+type principalKey struct{}
+
+// WithPrincipal returns a context of a request made by the principal.
+func WithPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// Principal returns who made the request of the context, or "" if it was not authorized.
+func Principal(ctx context.Context) string {
+	principal, _ := ctx.Value(principalKey{}).(string)
+	return principal
+}
+
+// RequireAPIKey allows only requests authorized with the API key, sent as
+// "Authorization: Bearer <key>". Other requests get 401 Unauthorized.
+// Authorized requests are made by AdminPrincipal.
+func RequireAPIKey(key string) func(http.HandlerFunc) http.HandlerFunc {
+	return NewAuthenticator(WithAPIKeys(key)).Require
+}
+
+// Authenticator authorizes requests to the admin API with bearer tokens:
+// static API keys, JWTs, or the tokens of a fallback, e.g. OAuth tokens.
+type Authenticator struct {
+	keys [][]byte
+	jwt  *JWTVerifier
+	// requiredScope and allows check the scopes of JWTs, see WithScopes.
+	requiredScope func(*http.Request) string
+	allows        func(granted []string, scope string) bool
+	fallback      func(http.HandlerFunc) http.HandlerFunc
+}
+
+// Option configures an Authenticator.
+type Option func(*Authenticator)
+
+// WithAPIKeys accepts the API keys, made by AdminPrincipal. Empty keys are
+// ignored. Keys are rotated by accepting the old and the new one until
+// every client has the new one.
+func WithAPIKeys(keys ...string) Option {
+	return func(a *Authenticator) {
+		for _, key := range keys {
+			if key != "" {
+				a.keys = append(a.keys, []byte(key))
+			}
+		}
+	}
+}
+
+// WithJWT accepts the JWTs of the verifier, made by JWTPrincipalPrefix and
+// their subject.
+func WithJWT(v *JWTVerifier) Option {
+	return func(a *Authenticator) {
+		a.jwt = v
+	}
+}
+
+// WithScopes checks that the scopes of JWTs allow a request: allows the
+// granted scopes of the scope required for the request. Without it JWTs
+// allow every request.
+func WithScopes(requiredScope func(*http.Request) string, allows func(granted []string, scope string) bool) Option {
+	return func(a *Authenticator) {
+		a.requiredScope, a.allows = requiredScope, allows
+	}
+}
+
+// WithFallback authorizes the requests with other tokens with require.
+func WithFallback(require func(http.HandlerFunc) http.HandlerFunc) Option {
+	return func(a *Authenticator) {
+		a.fallback = require
+	}
+}
+
+// NewAuthenticator creates an Authenticator. Without options, it refuses
+// every request.
+func NewAuthenticator(opts ...Option) *Authenticator {
+	a := &Authenticator{}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// MatchAPIKey reports whether the key is one of the API keys, comparing it
+// with each in constant time.
+func (a *Authenticator) MatchAPIKey(key string) bool {
+	matched := 0
+	for _, k := range a.keys {
+		matched |= subtle.ConstantTimeCompare([]byte(key), k)
+	}
+	return key != "" && matched == 1
+}
+
+// Require allows only authorized requests. Requests without a valid token
+// get 401 Unauthorized, and JWTs without the scope of the request 403
+// Forbidden.
+func (a *Authenticator) Require(next http.HandlerFunc) http.HandlerFunc {
+	var fallback http.HandlerFunc
+	if a.fallback != nil {
+		fallback = a.fallback(next)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := BearerToken(r)
+		if a.MatchAPIKey(token) {
+			next(w, r.WithContext(WithPrincipal(r.Context(), AdminPrincipal)))
+			return
+		}
+		// JWTs have three segments, API keys and OAuth tokens none.
+		if a.jwt != nil && strings.Count(token, ".") == 2 {
+			claims, err := a.jwt.Verify(token, time.Now())
+			if err == nil {
+				a.serveJWT(w, r, claims, next)
+				return
+			}
+			if fallback == nil {
+				requestid.Printf(r.Context(), "Unauthorized request to %s: %v\n", r.URL.Path, err)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="donation-server", error="invalid_token"`)
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+		}
+		if fallback != nil {
+			fallback(w, r)
+			return
+		}
+
+		requestid.Printf(r.Context(), "Unauthorized request to %s\n", r.URL.Path)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="donation-server"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	}
+}
+
+// serveJWT serves a request authorized with a JWT of the claims, if its
+// scopes allow it.
+func (a *Authenticator) serveJWT(w http.ResponseWriter, r *http.Request, claims *Claims, next http.HandlerFunc) {
+	if a.requiredScope != nil {
+		scope := a.requiredScope(r)
+		if !a.allows(claims.Scopes, scope) {
+			requestid.Printf(r.Context(), "Request of %s to %s without the %s scope\n", claims.Subject, r.URL.Path, scope)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="donation-server", error="insufficient_scope", scope="`+scope+`"`)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+	}
+	next(w, r.WithContext(WithPrincipal(r.Context(), JWTPrincipalPrefix+claims.Subject)))
+}
+
+// BearerToken returns the bearer token of the request's Authorization header.
+func BearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(header[len(prefix):])
+}
@@ -0,0 +1,243 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Leeway is the clock skew allowed between the issuer of JWTs and the server.
+const Leeway = time.Minute
+
+// ErrInvalidToken is returned by JWTVerifier.Verify for tokens that are not
+// well-formed, signed by a key of the verifier, or valid at the time.
+var ErrInvalidToken = errors.New("invalid token")
+
+// Claims are the claims of a verified JWT.
+type Claims struct {
+	Subject string
+	// Scopes are the space separated scopes of the scope claim, or those of
+	// the scp claim, as some issuers send them.
+	Scopes    []string
+	ExpiresAt time.Time
+}
+
+// JWTVerifier verifies JWTs signed with HS256 by one of its secrets or with
+// RS256 by one of its public keys, so keys can be rotated by verifying with
+// the old and the new one for a while.
+type JWTVerifier struct {
+	secrets    [][]byte
+	publicKeys []*rsa.PublicKey
+	// issuer and audience of the tokens, not checked if empty.
+	issuer   string
+	audience string
+}
+
+// JWTOption configures a JWTVerifier.
+type JWTOption func(*JWTVerifier)
+
+// WithSecrets verifies HS256 tokens with the secrets.
+func WithSecrets(secrets ...string) JWTOption {
+	return func(v *JWTVerifier) {
+		for _, secret := range secrets {
+			v.secrets = append(v.secrets, []byte(secret))
+		}
+	}
+}
+
+// WithPublicKeys verifies RS256 tokens with the RSA public keys.
+func WithPublicKeys(keys ...*rsa.PublicKey) JWTOption {
+	return func(v *JWTVerifier) {
+		v.publicKeys = append(v.publicKeys, keys...)
+	}
+}
+
+// WithIssuer accepts only tokens of the issuer, their iss claim.
+func WithIssuer(issuer string) JWTOption {
+	return func(v *JWTVerifier) {
+		v.issuer = issuer
+	}
+}
+
+// WithAudience accepts only tokens for the audience, one of their aud claim.
+func WithAudience(audience string) JWTOption {
+	return func(v *JWTVerifier) {
+		v.audience = audience
+	}
+}
+
+// NewJWTVerifier creates a JWTVerifier. It verifies no token without secrets
+// or public keys.
+func NewJWTVerifier(opts ...JWTOption) *JWTVerifier {
+	v := &JWTVerifier{}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+// ParsePublicKeys parses the RSA public keys of PEM blocks, PUBLIC KEY or RSA
+// PUBLIC KEY.
+func ParsePublicKeys(data []byte) ([]*rsa.PublicKey, error) {
+	var keys []*rsa.PublicKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		var key interface{}
+		var err error
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("public key %d: %v", len(keys)+1, err)
+		}
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("public key %d is not an RSA key", len(keys)+1)
+		}
+		keys = append(keys, rsaKey)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no public keys")
+	}
+	return keys, nil
+}
+
+// jwtHeader is the header of a JWT.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+}
+
+// jwtClaims are the claims of a JWT the verifier reads.
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *int64          `json:"exp"`
+	NotBefore *int64          `json:"nbf"`
+	Scope     string          `json:"scope"`
+	Scp       []string        `json:"scp"`
+}
+
+// Verify checks the signature of the token and that it is valid at now, and
+// returns its claims. Tokens must have a subject and expire.
+func (v *JWTVerifier) Verify(token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	// The algorithm is one the verifier has keys of, never "none".
+	switch header.Alg {
+	case "HS256":
+		if !v.verifyHMAC(signed, signature) {
+			return nil, ErrInvalidToken
+		}
+	case "RS256":
+		if !v.verifyRSA(signed, signature) {
+			return nil, ErrInvalidToken
+		}
+	default:
+		return nil, ErrInvalidToken
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if claims.Subject == "" || claims.ExpiresAt == nil || !now.Before(time.Unix(*claims.ExpiresAt, 0).Add(Leeway)) {
+		return nil, ErrInvalidToken
+	}
+	if claims.NotBefore != nil && now.Add(Leeway).Before(time.Unix(*claims.NotBefore, 0)) {
+		return nil, ErrInvalidToken
+	}
+	if v.issuer != "" && claims.Issuer != v.issuer {
+		return nil, ErrInvalidToken
+	}
+	if v.audience != "" && !hasAudience(claims.Audience, v.audience) {
+		return nil, ErrInvalidToken
+	}
+
+	scopes := strings.Fields(claims.Scope)
+	if len(scopes) == 0 {
+		scopes = claims.Scp
+	}
+	return &Claims{Subject: claims.Subject, Scopes: scopes, ExpiresAt: time.Unix(*claims.ExpiresAt, 0).UTC()}, nil
+}
+
+func (v *JWTVerifier) verifyHMAC(signed, signature []byte) bool {
+	valid := false
+	for _, secret := range v.secrets {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		// Every secret is tried, so the time does not tell which one matched.
+		if hmac.Equal(mac.Sum(nil), signature) {
+			valid = true
+		}
+	}
+	return valid
+}
+
+func (v *JWTVerifier) verifyRSA(signed, signature []byte) bool {
+	digest := sha256.Sum256(signed)
+	for _, key := range v.publicKeys {
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a JWT.
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// hasAudience reports whether the aud claim, a string or an array of
+// strings, has the audience.
+func hasAudience(claim json.RawMessage, audience string) bool {
+	var one string
+	if json.Unmarshal(claim, &one) == nil {
+		return one == audience
+	}
+	var many []string
+	if json.Unmarshal(claim, &many) != nil {
+		return false
+	}
+	for _, a := range many {
+		if a == audience {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var now = time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+func segment(t *testing.T, v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func signHS256(t *testing.T, secret string, claims map[string]interface{}) string {
+	signed := segment(t, jwtHeader{Alg: "HS256", Typ: "JWT"}) + "." + segment(t, claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func signRS256(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	signed := segment(t, jwtHeader{Alg: "RS256", Typ: "JWT"}) + "." + segment(t, claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func claims(overrides map[string]interface{}) map[string]interface{} {
+	c := map[string]interface{}{
+		"sub":   "ana.horvat",
+		"iss":   "https://id.example.org",
+		"aud":   []string{"donation-server"},
+		"exp":   now.Add(time.Hour).Unix(),
+		"scope": "donations:read stats:read",
+	}
+	for k, v := range overrides {
+		if v == nil {
+			delete(c, k)
+		} else {
+			c[k] = v
+		}
+	}
+	return c
+}
+
+func TestVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldSecret, newSecret := strings.Repeat("o", 32), strings.Repeat("n", 32)
+	v := NewJWTVerifier(WithSecrets(newSecret, oldSecret), WithPublicKeys(&rsaKey.PublicKey),
+		WithIssuer("https://id.example.org"), WithAudience("donation-server"))
+
+	for _, token := range []string{
+		signHS256(t, newSecret, claims(nil)),
+		signHS256(t, oldSecret, claims(nil)),
+		signRS256(t, rsaKey, claims(nil)),
+	} {
+		c, err := v.Verify(token, now)
+		if err != nil {
+			t.Fatalf("a valid token was refused: %v", err)
+		}
+		if c.Subject != "ana.horvat" || len(c.Scopes) != 2 || c.Scopes[1] != "stats:read" {
+			t.Errorf("unexpected claims %+v", c)
+		}
+	}
+
+	unsigned := segment(t, jwtHeader{Alg: "none"}) + "." + segment(t, claims(nil)) + "."
+	for name, token := range map[string]string{
+		"unknown secret":  signHS256(t, strings.Repeat("x", 32), claims(nil)),
+		"unsigned":        unsigned,
+		"expired":         signHS256(t, newSecret, claims(map[string]interface{}{"exp": now.Add(-2 * Leeway).Unix()})),
+		"without expiry":  signHS256(t, newSecret, claims(map[string]interface{}{"exp": nil})),
+		"not yet valid":   signHS256(t, newSecret, claims(map[string]interface{}{"nbf": now.Add(2 * Leeway).Unix()})),
+		"other issuer":    signHS256(t, newSecret, claims(map[string]interface{}{"iss": "https://evil.example.org"})),
+		"other audience":  signHS256(t, newSecret, claims(map[string]interface{}{"aud": "reports"})),
+		"without subject": signHS256(t, newSecret, claims(map[string]interface{}{"sub": nil})),
+	} {
+		if _, err := v.Verify(token, now); err != ErrInvalidToken {
+			t.Errorf("%s: got %v, want ErrInvalidToken", name, err)
+		}
+	}
+}
+
+func TestAuthenticatorRequire(t *testing.T) {
+	secret := strings.Repeat("s", 32)
+	a := NewAuthenticator(
+		WithAPIKeys("new-key", "old-key"),
+		WithJWT(NewJWTVerifier(WithSecrets(secret))),
+		WithScopes(func(r *http.Request) string { return "stats:read" }, func(granted []string, scope string) bool {
+			for _, g := range granted {
+				if g == scope {
+					return true
+				}
+			}
+			return false
+		}),
+	)
+	var principal string
+	handler := a.Require(func(w http.ResponseWriter, r *http.Request) {
+		principal = Principal(r.Context())
+	})
+
+	claims := claims(map[string]interface{}{"exp": time.Now().Add(time.Hour).Unix()})
+	for _, tc := range []struct {
+		token     string
+		code      int
+		principal string
+	}{
+		{"new-key", http.StatusOK, AdminPrincipal},
+		{"old-key", http.StatusOK, AdminPrincipal},
+		{"wrong-key", http.StatusUnauthorized, ""},
+		{"", http.StatusUnauthorized, ""},
+		{signHS256(t, secret, claims), http.StatusOK, JWTPrincipalPrefix + "ana.horvat"},
+		{signHS256(t, secret, map[string]interface{}{"sub": "ana.horvat", "exp": claims["exp"], "scope": "donations:read"}), http.StatusForbidden, ""},
+	} {
+		principal = ""
+		r := httptest.NewRequest("GET", "/admin/stats", nil)
+		if tc.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != tc.code || principal != tc.principal {
+			t.Errorf("token %.12s: got %d by %q, want %d by %q", tc.token, w.Code, principal, tc.code, tc.principal)
+		}
+	}
+}
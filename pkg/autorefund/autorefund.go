@@ -0,0 +1,375 @@
+// Package autorefund refunds donations by rules instead of by hand: donations
+// from countries blocked after they were made, donations above a review
+// threshold that reviewers cancel, and duplicates their donors confirmed, see
+// package duplicate. Every refund and every failed attempt is audited.
+package autorefund
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/listing"
+	"github.com/vedrankolka/donation-server/pkg/payments"
+	"github.com/vedrankolka/donation-server/pkg/store"
+)
+
+// Kinds of rules.
+const (
+	// KindCountry refunds donations whose address is in one of the countries,
+	// when they are made and in sweeps of the stored donations.
+	KindCountry = "country"
+	// KindReview holds donations of at least the threshold for review, and
+	// refunds those reviewers cancel.
+	KindReview = "review"
+)
+
+// Triggers of refunds.
+const (
+	TriggerPayment         = "payment"
+	TriggerSweep           = "sweep"
+	TriggerReviewCancelled = "review_cancelled"
+	TriggerDonorConfirmed  = "donor_confirmed"
+	// TriggerStaff refunds are made by staff in the admin API or UI.
+	TriggerStaff = "staff"
+	// TriggerKiosk refunds are made by staff at a kiosk with its PIN.
+	TriggerKiosk = "kiosk"
+)
+
+// Statuses of audit records.
+const (
+	StatusRefunded = "refunded"
+	StatusFailed   = "failed"
+	StatusDryRun   = "dry_run"
+)
+
+// maxRecords is the number of records kept for the admin API.
+const maxRecords = 200
+
+// ErrRefunded is returned for donations that are already refunded.
+var ErrRefunded = errors.New("the donation is already refunded")
+
+// Rule selects donations to refund.
+type Rule struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+	// Countries of country rules, ISO 3166-1 alpha-2 codes.
+	Countries []string `json:"countries,omitempty"`
+	// Threshold of review rules, in the smallest currency unit.
+	Threshold int64 `json:"threshold,omitempty"`
+	// Currency limits the rule to donations in the currency.
+	Currency string `json:"currency,omitempty"`
+	// Reason of the refunds, "fraudulent" or "requested_by_customer", none by default.
+	Reason string `json:"reason,omitempty"`
+}
+
+// Matches reports whether the rule selects the donation.
+func (r *Rule) Matches(d *store.Donation) bool {
+	if r.Currency != "" && !strings.EqualFold(r.Currency, d.Currency) {
+		return false
+	}
+	switch r.Kind {
+	case KindCountry:
+		if d.Address == nil {
+			return false
+		}
+		for _, country := range r.Countries {
+			if strings.EqualFold(country, d.Address.Country) {
+				return true
+			}
+		}
+		return false
+	case KindReview:
+		return d.Amount >= r.Threshold
+	default:
+		return false
+	}
+}
+
+// LoadRules reads a JSON array of rules from the file.
+func LoadRules(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("invalid auto-refund rules %s: %v", path, err)
+	}
+	names := make(map[string]bool, len(rules))
+	for i := range rules {
+		if err := Validate(&rules[i]); err != nil {
+			return nil, fmt.Errorf("invalid auto-refund rule %q: %v", rules[i].Name, err)
+		}
+		if names[rules[i].Name] {
+			return nil, fmt.Errorf("duplicate auto-refund rule %q", rules[i].Name)
+		}
+		names[rules[i].Name] = true
+	}
+	return rules, nil
+}
+
+// Validate checks the name, kind and parameters of a rule.
+func Validate(r *Rule) error {
+	if strings.TrimSpace(r.Name) == "" {
+		return errors.New("name is required")
+	}
+	switch r.Kind {
+	case KindCountry:
+		if len(r.Countries) == 0 {
+			return errors.New("countries are required")
+		}
+		for _, country := range r.Countries {
+			if len(country) != 2 {
+				return fmt.Errorf("invalid country %q", country)
+			}
+		}
+	case KindReview:
+		if r.Threshold < 1 {
+			return errors.New("threshold must be at least 1")
+		}
+	default:
+		return fmt.Errorf("kind must be %q or %q", KindCountry, KindReview)
+	}
+	switch r.Reason {
+	case "", payments.RefundReasonFraudulent, payments.RefundReasonRequestedByCustomer:
+		return nil
+	default:
+		return fmt.Errorf("invalid reason %q", r.Reason)
+	}
+}
+
+// Decision is why a donation is refunded.
+type Decision struct {
+	// Rule is the name of the rule, or of the policy, refunding the donation.
+	Rule    string
+	Trigger string
+	// Actor made the decision, the principal of a reviewer, the donor or "system".
+	Actor  string
+	Reason string
+	// Metadata is added to the refund.
+	Metadata map[string]string
+}
+
+// Record is the audit record of a refund.
+type Record struct {
+	At         time.Time `json:"at"`
+	DonationID string    `json:"donationID"`
+	CustomerID string    `json:"customerID"`
+	Amount     int64     `json:"amount"`
+	Currency   string    `json:"currency"`
+	Rule       string    `json:"rule"`
+	Trigger    string    `json:"trigger"`
+	Actor      string    `json:"actor"`
+	Reason     string    `json:"reason,omitempty"`
+	Status     string    `json:"status"`
+	RefundID   string    `json:"refundID,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// AuditLog keeps the audit trail of refunds.
+type AuditLog interface {
+	Audit(ctx context.Context, record *Record) error
+}
+
+// FileAuditLog appends records as JSON lines to a file.
+type FileAuditLog struct {
+	Path string
+}
+
+func (fa *FileAuditLog) Audit(ctx context.Context, record *Record) error {
+	f, err := os.OpenFile(fa.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := json.NewEncoder(f).Encode(record); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Engine refunds donations by its rules.
+type Engine struct {
+	provider  payments.Provider
+	donations store.DonationStore
+	audit     AuditLog
+	rules     []Rule
+
+	// mu guards records.
+	mu      sync.Mutex
+	records []Record
+}
+
+// NewEngine creates an Engine refunding donations of the store with the
+// provider and auditing the refunds in the log.
+func NewEngine(provider payments.Provider, donations store.DonationStore, audit AuditLog, rules []Rule) *Engine {
+	return &Engine{
+		provider:  provider,
+		donations: donations,
+		audit:     audit,
+		rules:     rules,
+	}
+}
+
+// Rules returns the rules of the engine.
+func (e *Engine) Rules() []Rule {
+	return e.rules
+}
+
+// Records returns the latest audit records, newest first.
+func (e *Engine) Records() []Record {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	records := make([]Record, len(e.records))
+	for i, record := range e.records {
+		records[len(records)-1-i] = record
+	}
+	return records
+}
+
+// Match returns the first rule of the kind selecting the donation, or nil.
+func (e *Engine) Match(d *store.Donation, kind string) *Rule {
+	for i := range e.rules {
+		if e.rules[i].Kind == kind && e.rules[i].Matches(d) {
+			return &e.rules[i]
+		}
+	}
+	return nil
+}
+
+// Refund refunds the donation in full, records the refund in the store and
+// audits it, or the failed attempt.
+func (e *Engine) Refund(ctx context.Context, d *store.Donation, decision Decision) (*Record, error) {
+	record := &Record{
+		At:         time.Now().UTC(),
+		DonationID: d.ID,
+		CustomerID: d.CustomerID,
+		Amount:     d.Amount,
+		Currency:   d.Currency,
+		Rule:       decision.Rule,
+		Trigger:    decision.Trigger,
+		Actor:      decision.Actor,
+		Reason:     decision.Reason,
+		Status:     StatusFailed,
+	}
+	err := e.refund(ctx, d, decision, record)
+	if err != nil {
+		record.Error = err.Error()
+	} else {
+		record.Status = StatusRefunded
+	}
+	log.Printf("[AUTO-REFUND] Donation %q by rule %q (%s, %s): %s %s\n",
+		d.ID, decision.Rule, decision.Trigger, decision.Actor, record.Status, record.Error)
+
+	if auditErr := e.audit.Audit(ctx, record); auditErr != nil {
+		log.Printf("Could not audit refund of donation %q: %v\n", d.ID, auditErr)
+	}
+	e.mu.Lock()
+	e.records = append(e.records, *record)
+	if len(e.records) > maxRecords {
+		e.records = e.records[len(e.records)-maxRecords:]
+	}
+	e.mu.Unlock()
+	return record, err
+}
+
+// RefundParams returns the parameters of the refund of a donation in full by
+// the decision. The idempotency key includes the trigger, as a retry of the
+// same refund must send the same parameters, while a refund by another
+// trigger is refused by the provider once the donation is refunded.
+func RefundParams(d *store.Donation, decision Decision) *payments.RefundParams {
+	metadata := map[string]string{"auto_refund_rule": decision.Rule, "auto_refund_trigger": decision.Trigger}
+	for key, value := range decision.Metadata {
+		metadata[key] = value
+	}
+	return &payments.RefundParams{
+		PaymentID:      d.ID,
+		Reason:         decision.Reason,
+		Metadata:       metadata,
+		IdempotencyKey: "refund-" + decision.Trigger + "-" + d.ID,
+	}
+}
+
+func (e *Engine) refund(ctx context.Context, d *store.Donation, decision Decision, record *Record) error {
+	if d.Status == store.StatusRefunded {
+		return ErrRefunded
+	}
+
+	refund, err := e.provider.Refund(ctx, RefundParams(d, decision))
+	if err != nil {
+		return err
+	}
+	record.RefundID = refund.ID
+
+	d.Status, d.RefundID = store.StatusRefunded, refund.ID
+	if err := e.donations.SaveDonation(ctx, d); err != nil {
+		return fmt.Errorf("refunded as %s, but could not record it: %w", refund.ID, err)
+	}
+	return nil
+}
+
+// Sweep refunds the stored donations country rules select, e.g. after a
+// country was blocked, or only returns them in a dry run.
+func (e *Engine) Sweep(ctx context.Context, dryRun bool) ([]Record, error) {
+	q, err := store.DonationListSpec.Parse(url.Values{"status": {store.StatusSucceeded}, "sort": {"created"}})
+	if err != nil {
+		return nil, err
+	}
+	q.Limit = listing.MaxLimit
+
+	// Refunded donations leave the list, so matches are collected first.
+	type match struct {
+		donation *store.Donation
+		rule     *Rule
+	}
+	var matches []match
+	for {
+		page, next, err := e.donations.ListDonations(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range page {
+			if rule := e.Match(d, KindCountry); rule != nil {
+				matches = append(matches, match{d, rule})
+			}
+		}
+		if next == "" {
+			break
+		}
+		if q.Cursor, err = listing.DecodeCursor(next); err != nil {
+			return nil, err
+		}
+	}
+
+	records := []Record{}
+	for _, m := range matches {
+		decision := Decision{Rule: m.rule.Name, Trigger: TriggerSweep, Actor: "system", Reason: m.rule.Reason}
+		if dryRun {
+			records = append(records, Record{
+				At:         time.Now().UTC(),
+				DonationID: m.donation.ID,
+				CustomerID: m.donation.CustomerID,
+				Amount:     m.donation.Amount,
+				Currency:   m.donation.Currency,
+				Rule:       decision.Rule,
+				Trigger:    decision.Trigger,
+				Actor:      decision.Actor,
+				Reason:     decision.Reason,
+				Status:     StatusDryRun,
+			})
+			continue
+		}
+		record, _ := e.Refund(ctx, m.donation, decision)
+		records = append(records, *record)
+	}
+	return records, nil
+}
@@ -0,0 +1,225 @@
+// Package backup writes snapshots of the donations of a store and restores
+// them, so deployments without managed database backups can keep their
+// ledger somewhere safe.
+//
+// A snapshot starts with a line naming the format and its version, followed
+// by a line of JSON, the Header, and the donations as gzipped JSON lines,
+// encrypted with AES-256-GCM. The first two lines are authenticated with the
+// donations, so a snapshot changed anywhere, or read with the wrong key, is
+// refused as a whole.
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/listing"
+	"github.com/vedrankolka/donation-server/pkg/store"
+)
+
+// Version is the version of the format snapshots are written in. Snapshots
+// of this and earlier versions can be read.
+const Version = 1
+
+// format names the format on the first line of snapshots.
+const format = "donation-server-backup"
+
+// KeySize is the size of keys, AES-256.
+const KeySize = 32
+
+// ErrInvalid is the error of a snapshot that was changed, truncated or is
+// read with the wrong key.
+var ErrInvalid = errors.New("the snapshot is corrupt or the key is wrong")
+
+// Header describes a snapshot.
+type Header struct {
+	CreatedAt time.Time `json:"createdAt"`
+	// Donations is the number of donations in the snapshot.
+	Donations int `json:"donations"`
+	// SHA256 is the hash of the donations as JSON lines, before compression.
+	SHA256 string `json:"sha256"`
+	Nonce  []byte `json:"nonce"`
+}
+
+// ParseKey parses a key of 64 hexadecimal digits, e.g. of "openssl rand -hex 32".
+func ParseKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(key) != KeySize {
+		return nil, fmt.Errorf("the key must be %d hexadecimal digits", 2*KeySize)
+	}
+	return key, nil
+}
+
+// Name returns the name of a snapshot taken at the time, which sorts by it,
+// e.g. "donations-20240501T100000Z.backup".
+func Name(at time.Time) string {
+	return "donations-" + at.UTC().Format("20060102T150405Z") + ".backup"
+}
+
+// Snapshot returns a snapshot of all donations of the store.
+func Snapshot(ctx context.Context, donations store.DonationStore, key []byte, now time.Time) ([]byte, *Header, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	q, err := store.DonationListSpec.Parse(url.Values{"sort": {"created"}})
+	if err != nil {
+		return nil, nil, err
+	}
+	q.Limit = listing.MaxLimit
+	var plain bytes.Buffer
+	hash := sha256.New()
+	zw := gzip.NewWriter(&plain)
+	enc := json.NewEncoder(io.MultiWriter(zw, hash))
+	header := &Header{CreatedAt: now.UTC()}
+	for {
+		page, next, err := donations.ListDonations(ctx, q)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not list donations: %w", err)
+		}
+		for _, d := range page {
+			if err := enc.Encode(d); err != nil {
+				return nil, nil, err
+			}
+			header.Donations++
+		}
+		if next == "" {
+			break
+		}
+		if q.Cursor, err = listing.DecodeCursor(next); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, nil, err
+	}
+	header.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	header.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(header.Nonce); err != nil {
+		return nil, nil, err
+	}
+
+	preamble, err := writePreamble(Version, header)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead.Seal(preamble, header.Nonce, plain.Bytes(), preamble), header, nil
+}
+
+// writePreamble returns the first two lines of a snapshot.
+func writePreamble(version int, header *Header) ([]byte, error) {
+	data, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	preamble := []byte(format + " " + strconv.Itoa(version) + "\n")
+	preamble = append(preamble, data...)
+	return append(preamble, '\n'), nil
+}
+
+// Open decrypts a snapshot and checks its integrity. It returns the header
+// and the donations, or ErrInvalid.
+func Open(data, key []byte) (*Header, []*store.Donation, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	line, rest, ok := cutLine(data)
+	fields := strings.Fields(string(line))
+	if !ok || len(fields) != 2 || fields[0] != format {
+		return nil, nil, errors.New("not a snapshot of donation-server")
+	}
+	version, err := strconv.Atoi(fields[1])
+	if err != nil || version < 1 {
+		return nil, nil, fmt.Errorf("invalid snapshot version %q", fields[1])
+	}
+	if version > Version {
+		return nil, nil, fmt.Errorf("the snapshot is of version %d, this server reads up to version %d", version, Version)
+	}
+	line, sealed, ok := cutLine(rest)
+	if !ok {
+		return nil, nil, ErrInvalid
+	}
+	var header Header
+	if err := json.Unmarshal(line, &header); err != nil || len(header.Nonce) != aead.NonceSize() {
+		return nil, nil, ErrInvalid
+	}
+
+	preamble := data[:len(data)-len(sealed)]
+	plain, err := aead.Open(nil, header.Nonce, sealed, preamble)
+	if err != nil {
+		return nil, nil, ErrInvalid
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(plain))
+	if err != nil {
+		return nil, nil, ErrInvalid
+	}
+	hash := sha256.New()
+	scanner := bufio.NewScanner(io.TeeReader(zr, hash))
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	var donations []*store.Donation
+	for scanner.Scan() {
+		var d store.Donation
+		if err := json.Unmarshal(scanner.Bytes(), &d); err != nil {
+			return nil, nil, fmt.Errorf("invalid donation %d: %v", len(donations)+1, err)
+		}
+		donations = append(donations, &d)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	// The checksum guards against bugs of the writer, which the encryption
+	// would faithfully preserve.
+	if hex.EncodeToString(hash.Sum(nil)) != header.SHA256 || len(donations) != header.Donations {
+		return nil, nil, fmt.Errorf("the snapshot has %d donations not matching its checksum", len(donations))
+	}
+	return &header, donations, nil
+}
+
+// Restore saves the donations in the store, replacing those with the same
+// IDs. Donations of the store missing from the snapshot are kept.
+func Restore(ctx context.Context, donations store.DonationStore, snapshot []*store.Donation) error {
+	for _, d := range snapshot {
+		if err := donations.SaveDonation(ctx, d); err != nil {
+			return fmt.Errorf("could not restore donation %q: %w", d.ID, err)
+		}
+	}
+	return nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("the key must be %d bytes", KeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// cutLine splits data after its first newline.
+func cutLine(data []byte) (line, rest []byte, ok bool) {
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		return nil, nil, false
+	}
+	return data[:i], data[i+1:], true
+}
@@ -0,0 +1,106 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// s3Scheme prefixes locations in S3, like s3://bucket/backups/.
+const s3Scheme = "s3://"
+
+// Save stores the snapshot at the location and returns where it is stored.
+// The location is a file, or a directory the snapshot is stored in under
+// its name, if it ends with a slash or is an existing directory. Locations
+// like s3://bucket/key are stored with the client, which may be nil
+// otherwise, and keys ending with a slash are prefixes of the name.
+func Save(ctx context.Context, location, name string, data []byte, client *S3) (string, error) {
+	if strings.HasPrefix(location, s3Scheme) {
+		bucket, key, err := parseS3(location, client)
+		if err != nil {
+			return "", err
+		}
+		if key == "" || strings.HasSuffix(key, "/") {
+			key += name
+		}
+		if err := client.Put(ctx, bucket, key, data); err != nil {
+			return "", err
+		}
+		return s3Scheme + bucket + "/" + key, nil
+	}
+
+	path := location
+	if info, err := os.Stat(location); strings.HasSuffix(location, "/") || (err == nil && info.IsDir()) {
+		if err := os.MkdirAll(location, 0o700); err != nil {
+			return "", err
+		}
+		path = filepath.Join(location, name)
+	}
+	// The snapshot is renamed into place, so a failed backup never leaves a
+	// truncated file behind.
+	tmp := path + ".tmp"
+	if err := writeFile(tmp, data); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return path, nil
+}
+
+func writeFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Load reads the snapshot at the location, a file or an s3://bucket/key URL.
+func Load(ctx context.Context, location string, client *S3) ([]byte, error) {
+	if strings.HasPrefix(location, s3Scheme) {
+		bucket, key, err := parseS3(location, client)
+		if err != nil {
+			return nil, err
+		}
+		if key == "" || strings.HasSuffix(key, "/") {
+			return nil, fmt.Errorf("%s is not a snapshot but a prefix", location)
+		}
+		return client.Get(ctx, bucket, key)
+	}
+
+	f, err := os.Open(location)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(io.LimitReader(f, maxObject))
+}
+
+func parseS3(location string, client *S3) (bucket, key string, err error) {
+	if client == nil {
+		return "", "", errors.New("S3 is not configured")
+	}
+	bucket = strings.TrimPrefix(location, s3Scheme)
+	if i := strings.Index(bucket, "/"); i >= 0 {
+		bucket, key = bucket[:i], bucket[i+1:]
+	}
+	if bucket == "" {
+		return "", "", fmt.Errorf("%s has no bucket", location)
+	}
+	return bucket, key, nil
+}
@@ -0,0 +1,48 @@
+package clientip
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Header is where the client IP is read from behind proxies.
+type Header struct {
+	// Name of the header, e.g. "Fly-Client-IP" or "X-Forwarded-For". It
+	// should only be set when the server runs behind a proxy that sets it.
+	Name string
+	// TrustedHops is the number of proxies in front of the server that
+	// append to a list header like X-Forwarded-For, 1 if it is 0. Entries
+	// further left were sent by the client and may be spoofed.
+	TrustedHops int
+}
+
+// FromRequest returns the IP address of the client that made the request.
+//
+// If the header is set, the address is taken from it. Of a list header, the
+// entry TrustedHops from the right is used, the one added by the outermost
+// trusted proxy, as the entries left of it can be set by the client.
+// Otherwise, or if the header is missing or has fewer entries, r.RemoteAddr
+// is used.
+func FromRequest(r *http.Request, header Header) net.IP {
+	if header.Name != "" {
+		// Proxies may append to the header or add another one.
+		entries := strings.Split(strings.Join(r.Header.Values(header.Name), ","), ",")
+		hops := header.TrustedHops
+		if hops <= 0 {
+			hops = 1
+		}
+		if hops <= len(entries) {
+			if ip := net.ParseIP(strings.TrimSpace(entries[len(entries)-hops])); ip != nil {
+				return ip
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return net.ParseIP(host)
+}
@@ -0,0 +1,39 @@
+package clientip
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFromRequest(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		header Header
+		values []string
+		want   string
+	}{
+		{"no header configured", Header{}, []string{"198.51.100.7"}, "192.0.2.1"},
+		{"missing header", Header{Name: "X-Forwarded-For"}, nil, "192.0.2.1"},
+		{"single value", Header{Name: "Fly-Client-IP"}, []string{"198.51.100.7"}, "198.51.100.7"},
+		{"proxy appended", Header{Name: "X-Forwarded-For"}, []string{"198.51.100.7"}, "198.51.100.7"},
+		{"spoofed first entry", Header{Name: "X-Forwarded-For"}, []string{"203.0.113.66, 198.51.100.7"}, "198.51.100.7"},
+		{"spoofed entries", Header{Name: "X-Forwarded-For"}, []string{"10.0.0.1,203.0.113.66 , 198.51.100.7"}, "198.51.100.7"},
+		{"spoofed header line", Header{Name: "X-Forwarded-For"}, []string{"203.0.113.66", "198.51.100.7"}, "198.51.100.7"},
+		{"two trusted hops", Header{Name: "X-Forwarded-For", TrustedHops: 2}, []string{"203.0.113.66, 198.51.100.7, 10.0.0.2"}, "198.51.100.7"},
+		{"fewer entries than hops", Header{Name: "X-Forwarded-For", TrustedHops: 2}, []string{"203.0.113.66"}, "192.0.2.1"},
+		{"spoofed garbage", Header{Name: "X-Forwarded-For"}, []string{"203.0.113.66, not-an-ip"}, "192.0.2.1"},
+		{"IPv6", Header{Name: "X-Forwarded-For"}, []string{"203.0.113.66, 2001:db8::7"}, "2001:db8::7"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = "192.0.2.1:4711"
+			for _, value := range tt.values {
+				r.Header.Add("X-Forwarded-For", value)
+				r.Header.Add("Fly-Client-IP", value)
+			}
+			if got := FromRequest(r, tt.header); got.String() != tt.want {
+				t.Errorf("FromRequest() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
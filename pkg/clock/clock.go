@@ -0,0 +1,68 @@
+// Package clock abstracts time for the background jobs of the server, like
+// the daily digest, the lifecycle emails and the retries of webhook
+// deliveries, so they can be tested with a Fake clock and scheduled
+// uniformly, with intervals or cron expressions.
+package clock
+
+import (
+	"context"
+	"time"
+)
+
+// Clock tells the time and waits for it.
+type Clock interface {
+	Now() time.Time
+	// NewTimer creates a timer sending the time on its channel after d.
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a time.Timer of a Clock.
+type Timer interface {
+	C() <-chan time.Time
+	// Stop stops the timer, reporting whether it had not fired yet.
+	Stop() bool
+}
+
+// Real is the clock of the system.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// Run calls job with the time at every time of the schedule after now,
+// until the context is done. Times passing while job runs are skipped.
+func Run(ctx context.Context, c Clock, s Schedule, job func(ctx context.Context, now time.Time)) {
+	for {
+		now := c.Now()
+		next := s.Next(now)
+		if next.IsZero() {
+			<-ctx.Done()
+			return
+		}
+
+		timer := c.NewTimer(next.Sub(now))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+
+		job(ctx, c.Now())
+	}
+}
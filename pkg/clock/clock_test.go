@@ -0,0 +1,75 @@
+package clock
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	// A Wednesday.
+	now := time.Date(2024, 1, 31, 7, 30, 15, 0, time.UTC)
+	for _, test := range []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2024, 1, 31, 7, 31, 0, 0, time.UTC)},
+		{"30 7 * * *", time.Date(2024, 2, 1, 7, 30, 0, 0, time.UTC)},
+		{"0 9 * * *", time.Date(2024, 1, 31, 9, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 1, 31, 7, 45, 0, 0, time.UTC)},
+		{"0 8 * * mon-fri", time.Date(2024, 1, 31, 8, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 2, 4, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 feb *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Either the day of the month or of the week.
+		{"0 0 15 * 5", time.Date(2024, 2, 2, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	} {
+		c, err := ParseCron(test.expr)
+		if err != nil {
+			t.Fatalf("ParseCron(%q): %v", test.expr, err)
+		}
+		if got := c.Next(now); !got.Equal(test.want) {
+			t.Errorf("%q: next run after %v is %v, want %v", test.expr, now, got, test.want)
+		}
+	}
+
+	if got, want := Daily(7*time.Hour+30*time.Minute).String(), "30 7 * * *"; got != want {
+		t.Errorf("Daily is %q, want %q", got, want)
+	}
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "0 0 0 * *", "* * * 13 *", "5-1 * * * *", "*/0 * * * *", "@often", "0 0 * * funday"} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("ParseCron(%q) succeeded, want an error", expr)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	start := time.Date(2024, 1, 31, 7, 0, 0, 0, time.UTC)
+	fake := NewFake(start)
+	ctx, cancel := context.WithCancel(context.Background())
+	runs := make(chan time.Time)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Run(ctx, fake, Every(time.Hour), func(ctx context.Context, now time.Time) {
+			runs <- now
+		})
+	}()
+
+	for i := 1; i <= 3; i++ {
+		fake.BlockUntil(1)
+		fake.Advance(time.Hour)
+		if got, want := <-runs, start.Add(time.Duration(i)*time.Hour); !got.Equal(want) {
+			t.Errorf("run %d at %v, want %v", i, got, want)
+		}
+	}
+
+	fake.BlockUntil(1)
+	cancel()
+	<-done
+}
@@ -0,0 +1,218 @@
+package clock
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule tells when a job runs.
+type Schedule interface {
+	// Next returns the first time after t the job runs, or the zero time if
+	// it never runs again.
+	Next(t time.Time) time.Time
+}
+
+// Every is a Schedule of runs an interval apart.
+type Every time.Duration
+
+func (e Every) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(e))
+}
+
+func (e Every) String() string {
+	return "every " + time.Duration(e).String()
+}
+
+// maxCronYears is how far ahead Cron.Next looks for a matching time, so
+// expressions that never match, like "0 0 30 2 *", end.
+const maxCronYears = 5
+
+// cronMacros are the shorthands of cron expressions.
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// cronField are the bounds and names of a field of cron expressions.
+type cronField struct {
+	name     string
+	min, max int
+	names    []string
+}
+
+var (
+	minuteField = cronField{name: "minute", min: 0, max: 59}
+	hourField   = cronField{name: "hour", min: 0, max: 23}
+	domField    = cronField{name: "day of month", min: 1, max: 31}
+	monthField  = cronField{name: "month", min: 1, max: 12,
+		names: []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}}
+	// Sunday is both 0 and 7.
+	dowField = cronField{name: "day of week", min: 0, max: 7,
+		names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}}
+)
+
+// Cron is a Schedule of a cron expression, in UTC.
+type Cron struct {
+	expr                          string
+	minute, hour, dom, month, dow uint64
+	// domStar and dowStar are set if the day of month or week is "*". If
+	// neither is, a day matching either runs, like in cron.
+	domStar, dowStar bool
+}
+
+// ParseCron parses a cron expression of five fields, minute, hour, day of
+// month, month and day of week, like "30 7 * * 1-5", or a shorthand like
+// "@daily". Fields are "*", numbers, ranges like "1-5", steps like "*/15" or
+// "0-30/10", and lists of them like "1,15". Months and days of the week may
+// be named, like "jan" or "mon-fri".
+func ParseCron(expr string) (*Cron, error) {
+	fields := strings.Fields(expr)
+	if len(fields) == 1 {
+		macro, ok := cronMacros[strings.ToLower(fields[0])]
+		if !ok {
+			return nil, fmt.Errorf("unknown cron shorthand %q", fields[0])
+		}
+		fields = strings.Fields(macro)
+	}
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields: minute, hour, day of month, month and day of week", expr)
+	}
+
+	c := &Cron{expr: expr, domStar: fields[2] == "*", dowStar: fields[4] == "*"}
+	var err error
+	for _, f := range []struct {
+		set   *uint64
+		field cronField
+		text  string
+	}{
+		{&c.minute, minuteField, fields[0]},
+		{&c.hour, hourField, fields[1]},
+		{&c.dom, domField, fields[2]},
+		{&c.month, monthField, fields[3]},
+		{&c.dow, dowField, fields[4]},
+	} {
+		if *f.set, err = f.field.parse(f.text); err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %v", expr, err)
+		}
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	return c, nil
+}
+
+// Daily returns the Cron of a time of day in UTC, like 7*time.Hour.
+func Daily(at time.Duration) *Cron {
+	minutes := int(at/time.Minute) % (24 * 60)
+	c, err := ParseCron(fmt.Sprintf("%d %d * * *", minutes%60, minutes/60))
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// parse returns the set of values of a field, as bits.
+func (f cronField) parse(text string) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(text, ",") {
+		rng, stepText := part, ""
+		if i := strings.Index(part, "/"); i >= 0 {
+			rng, stepText = part[:i], part[i+1:]
+		}
+
+		low, high := f.min, f.max
+		if rng != "*" {
+			var err error
+			lowText, highText := rng, ""
+			if i := strings.Index(rng, "-"); i >= 0 {
+				lowText, highText = rng[:i], rng[i+1:]
+			}
+			if low, err = f.value(lowText); err != nil {
+				return 0, err
+			}
+			high = low
+			if highText != "" {
+				if high, err = f.value(highText); err != nil {
+					return 0, err
+				}
+			} else if stepText != "" {
+				high = f.max
+			}
+			if high < low {
+				return 0, fmt.Errorf("invalid %s range %q", f.name, rng)
+			}
+		}
+
+		step := 1
+		if stepText != "" {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid %s step %q", f.name, stepText)
+			}
+		}
+		for v := low; v <= high; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+// value parses a number or name of the field.
+func (f cronField) value(text string) (int, error) {
+	for i, name := range f.names {
+		if strings.EqualFold(text, name) {
+			return f.min + i, nil
+		}
+	}
+	v, err := strconv.Atoi(text)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid %s %q, must be %d to %d", f.name, text, f.min, f.max)
+	}
+	return v, nil
+}
+
+// Next returns the first minute after t matching the expression, in UTC, or
+// the zero time if none does in the next years.
+func (c *Cron) Next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(maxCronYears, 0, 0)
+	for t.Before(end) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !c.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (c *Cron) matchesDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case c.domStar:
+		return dow
+	case c.dowStar:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+func (c *Cron) String() string {
+	return c.expr
+}
@@ -0,0 +1,150 @@
+package cloudevents
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SpecVersion is the version of the CloudEvents specification of the events.
+const SpecVersion = "1.0"
+
+// ContentType is the content type of events in structured mode.
+const ContentType = "application/cloudevents+json"
+
+// Content modes of CloudEvents.
+const (
+	// ModeStructured sends the whole event, with its attributes, as a JSON document.
+	ModeStructured = "structured"
+	// ModeBinary sends the data as is and the attributes as headers.
+	ModeBinary = "binary"
+)
+
+// Config describes how notifiers wrap their payloads in CloudEvents.
+type Config struct {
+	// Mode is ModeStructured or ModeBinary.
+	Mode string
+	// Source identifies the server, e.g. "https://donate.example.org".
+	Source string
+	// TypePrefix is prepended to event types, e.g. "org.example.donation-server."
+	TypePrefix string
+	// SchemaURL is the base URL of the published schemas. Events have no
+	// dataschema attribute if it is empty.
+	SchemaURL string
+}
+
+// NewConfig creates a Config, checking the mode and defaulting the source.
+func NewConfig(mode, source, typePrefix, schemaURL string) (*Config, error) {
+	if mode == "" {
+		mode = ModeStructured
+	}
+	if mode != ModeStructured && mode != ModeBinary {
+		return nil, fmt.Errorf("unknown CloudEvents mode %q", mode)
+	}
+	if source == "" {
+		source = "/donation-server"
+	}
+
+	return &Config{
+		Mode:       mode,
+		Source:     source,
+		TypePrefix: typePrefix,
+		SchemaURL:  strings.TrimSuffix(schemaURL, "/"),
+	}, nil
+}
+
+// Event is a CloudEvent in the JSON format.
+type Event struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            time.Time       `json:"time"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	DataSchema      string          `json:"dataschema,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+	// RequestID is an extension attribute with the ID of the request the
+	// event is about, see package requestid.
+	RequestID string `json:"requestid,omitempty"`
+}
+
+// NewEvent wraps the payload of an event. schemaVersion is the version of the
+// event type's schema, the dataschema is left out if it is empty.
+func (c *Config) NewEvent(eventType, schemaVersion, subject string, data []byte, contentType string) (*Event, error) {
+	id, err := NewID()
+	if err != nil {
+		return nil, err
+	}
+
+	event := &Event{
+		SpecVersion:     SpecVersion,
+		ID:              id,
+		Source:          c.Source,
+		Type:            c.TypePrefix + eventType,
+		Subject:         subject,
+		Time:            time.Now().UTC(),
+		DataContentType: contentType,
+		Data:            data,
+	}
+	if c.SchemaURL != "" && schemaVersion != "" {
+		event.DataSchema = c.SchemaURL + "/schemas/" + eventType + "/" + schemaVersion
+	}
+
+	return event, nil
+}
+
+// Structured returns the event in structured mode. Payloads that are not
+// JSON are embedded as JSON strings.
+func (e *Event) Structured() ([]byte, error) {
+	structured := *e
+	if !isJSON(e.DataContentType) {
+		data, err := json.Marshal(string(e.Data))
+		if err != nil {
+			return nil, err
+		}
+		structured.Data = data
+	}
+	return json.Marshal(structured)
+}
+
+// Attributes returns the attributes of the event other than the data and its
+// content type, to be sent as headers in binary mode.
+func (e *Event) Attributes() map[string]string {
+	attributes := map[string]string{
+		"specversion": e.SpecVersion,
+		"id":          e.ID,
+		"source":      e.Source,
+		"type":        e.Type,
+		"time":        e.Time.Format(time.RFC3339Nano),
+	}
+	if e.Subject != "" {
+		attributes["subject"] = e.Subject
+	}
+	if e.DataSchema != "" {
+		attributes["dataschema"] = e.DataSchema
+	}
+	if e.RequestID != "" {
+		attributes["requestid"] = e.RequestID
+	}
+	return attributes
+}
+
+// NewID returns a random (version 4) UUID.
+func NewID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+func isJSON(contentType string) bool {
+	mediaType := strings.TrimSpace(strings.Split(contentType, ";")[0])
+	return mediaType == "" || mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
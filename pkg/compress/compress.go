@@ -0,0 +1,240 @@
+// Package compress compresses responses with Brotli or gzip, whichever the
+// client prefers, reducing the bandwidth of the widget and of large exports.
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// DefaultMinSize is the size of the smallest response worth compressing.
+const DefaultMinSize = 1024
+
+// DefaultContentTypes are the compressed media types. Entries ending with
+// "/" match all subtypes, e.g. "text/".
+var DefaultContentTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/schema+json",
+	"application/cloudevents+json",
+	"image/svg+xml",
+}
+
+// brotliLevel trades compression for speed, as responses are compressed on every request.
+const brotliLevel = 5
+
+var (
+	gzipWriters = sync.Pool{New: func() interface{} {
+		w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return w
+	}}
+	brotliWriters = sync.Pool{New: func() interface{} {
+		return brotli.NewWriterLevel(nil, brotliLevel)
+	}}
+)
+
+// Middleware compresses responses of at least minSize bytes with one of the
+// contentTypes, if the client accepts "br" or "gzip". Responses that are
+// already encoded and partial responses are left alone.
+func Middleware(minSize int, contentTypes []string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+			encoding := Negotiate(r.Header.Get("Accept-Encoding"))
+			if encoding == "" || r.Method == "HEAD" {
+				next(w, r)
+				return
+			}
+
+			cw := &writer{
+				ResponseWriter: w,
+				encoding:       encoding,
+				minSize:        minSize,
+				contentTypes:   contentTypes,
+				status:         http.StatusOK,
+			}
+			defer cw.Close()
+			next(cw, r)
+		}
+	}
+}
+
+// Negotiate returns the preferred encoding of an Accept-Encoding header,
+// "br", "gzip" or "" for none.
+func Negotiate(acceptEncoding string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if coding != "br" && coding != "gzip" || q <= 0 {
+			continue
+		}
+		// Brotli wins ties, it compresses better.
+		if q > bestQ || q == bestQ && coding == "br" {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// writer buffers the start of a response until it knows whether to compress it.
+type writer struct {
+	http.ResponseWriter
+	encoding     string
+	minSize      int
+	contentTypes []string
+
+	status      int
+	wroteHeader bool
+	buf         bytes.Buffer
+	// decided is set once the response is passed through or compressed by encoder.
+	decided bool
+	encoder io.WriteCloser
+}
+
+func (cw *writer) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	cw.status = status
+	// Responses without a body are passed through right away.
+	if status < 200 || status == http.StatusNoContent || status == http.StatusNotModified {
+		cw.decide(false)
+	}
+}
+
+func (cw *writer) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.decided {
+		if cw.encoder != nil {
+			return cw.encoder.Write(b)
+		}
+		return cw.ResponseWriter.Write(b)
+	}
+
+	n, _ := cw.buf.Write(b)
+	if cw.buf.Len() >= cw.minSize {
+		if err := cw.decide(cw.compressible()); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// compressible reports whether the response can be compressed, ignoring its size.
+func (cw *writer) compressible() bool {
+	header := cw.Header()
+	if cw.status != http.StatusOK || header.Get("Content-Encoding") != "" || header.Get("Content-Range") != "" {
+		return false
+	}
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(cw.buf.Bytes())
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range cw.contentTypes {
+		if mediaType == t || strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// decide writes the header and the buffered start of the body, compressed or not.
+func (cw *writer) decide(compress bool) error {
+	cw.decided = true
+	if compress {
+		header := cw.Header()
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", cw.encoding)
+		// The compressed body is not byte-for-byte the same.
+		if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			header.Set("ETag", "W/"+etag)
+		}
+
+		if cw.encoding == "br" {
+			bw := brotliWriters.Get().(*brotli.Writer)
+			bw.Reset(cw.ResponseWriter)
+			cw.encoder = bw
+		} else {
+			gw := gzipWriters.Get().(*gzip.Writer)
+			gw.Reset(cw.ResponseWriter)
+			cw.encoder = gw
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+	if cw.buf.Len() == 0 {
+		return nil
+	}
+	var err error
+	if cw.encoder != nil {
+		_, err = cw.encoder.Write(cw.buf.Bytes())
+	} else {
+		_, err = cw.ResponseWriter.Write(cw.buf.Bytes())
+	}
+	cw.buf.Reset()
+	return err
+}
+
+// Close writes a response too small to compress, or finishes the compressed one.
+func (cw *writer) Close() error {
+	if !cw.decided {
+		if !cw.wroteHeader && cw.buf.Len() == 0 {
+			// The handler wrote nothing, net/http sends the default response.
+			return nil
+		}
+		return cw.decide(false)
+	}
+	if cw.encoder == nil {
+		return nil
+	}
+
+	err := cw.encoder.Close()
+	switch encoder := cw.encoder.(type) {
+	case *brotli.Writer:
+		brotliWriters.Put(encoder)
+	case *gzip.Writer:
+		gzipWriters.Put(encoder)
+	}
+	cw.encoder = nil
+	return err
+}
+
+// Flush sends what was written so far, e.g. of a streamed export.
+func (cw *writer) Flush() {
+	if !cw.decided {
+		cw.decide(cw.compressible())
+	}
+	if f, ok := cw.encoder.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,347 @@
+// Package config loads the settings of the server from, in order of
+// precedence, command line flags, environment variables (and .env files) and
+// a YAML file. Every setting is declared in Settings with its kind and a
+// description, values are validated when they are loaded, so the server
+// fails at startup with a message naming the setting rather than later, and
+// the effective configuration can be printed as documentation.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/vedrankolka/donation-server/pkg/feature"
+	"gopkg.in/yaml.v3"
+)
+
+// FileVariable is the environment variable of the YAML file, if the -config
+// flag is not given.
+const FileVariable = "DONATION_SERVER_CONFIG"
+
+// prefix is left out of the flag and YAML key of a setting.
+const prefix = "DONATION_SERVER_"
+
+// Families are the prefixes of variables read by other packages, like the
+// feature flags, which are not warned about.
+var Families = []string{feature.EnvPrefix}
+
+// Kind is the kind of value of a setting.
+type Kind int
+
+// Kinds of settings.
+const (
+	String Kind = iota
+	Bool
+	Int
+	Float
+	Duration
+	// URL is an absolute URL, like https://example.org/path.
+	URL
+	// Port is a TCP port number.
+	Port
+)
+
+// Setting is a setting of the server.
+type Setting struct {
+	// Name is the environment variable of the setting, e.g. DONATION_SERVER_PORT.
+	Name string
+	Kind Kind
+	// Default is the value of the setting if it is not set.
+	Default string
+	// Values, if set, are the only values the setting may have.
+	Values      []string
+	Description string
+	// Secret settings are redacted when the configuration is printed.
+	Secret bool
+}
+
+// Key returns the flag and YAML key of the setting, its name in lower case
+// with dashes and without DONATION_SERVER_, e.g. "port" or "stripe-secret-key".
+func (s Setting) Key() string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimPrefix(s.Name, prefix)), "_", "-")
+}
+
+// validate checks a value of the setting.
+func (s Setting) validate(value string) error {
+	if len(s.Values) > 0 && !contains(s.Values, value) {
+		return fmt.Errorf("must be %s, not %q", strings.Join(s.Values, " or "), value)
+	}
+	var err error
+	switch s.Kind {
+	case Bool:
+		if value != "true" && value != "false" {
+			return fmt.Errorf("must be true or false, not %q", value)
+		}
+	case Int:
+		if _, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return fmt.Errorf("must be an integer, not %q", value)
+		}
+	case Float:
+		if _, err = strconv.ParseFloat(value, 64); err != nil {
+			return fmt.Errorf("must be a number, not %q", value)
+		}
+	case Duration:
+		if _, err = time.ParseDuration(value); err != nil {
+			return fmt.Errorf("must be a duration like 10s or 1h30m, not %q", value)
+		}
+	case URL:
+		u, err := url.Parse(value)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("must be an absolute URL like https://example.org, not %q", value)
+		}
+	case Port:
+		if port, err := strconv.Atoi(value); err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("must be a port number between 1 and 65535, not %q", value)
+		}
+	}
+	return nil
+}
+
+// Sources of values.
+const (
+	SourceDefault = "default"
+	SourceFile    = "file"
+	SourceEnv     = "environment"
+	SourceFlag    = "flag"
+)
+
+// Config is the configuration of the server.
+type Config struct {
+	order    []Setting
+	settings map[string]Setting
+	values   map[string]string
+	sources  map[string]string
+	// Warnings are about settings that are likely mistakes but do not stop
+	// the server, like an unknown DONATION_SERVER_ variable.
+	Warnings []string
+}
+
+// Load loads the settings with flags of the arguments, whose remaining
+// arguments are .env files loaded into the environment, the environment and
+// the YAML file of the -config flag or DONATION_SERVER_CONFIG. The flag set
+// is named after the command, for its usage message. All invalid values are
+// reported in one error.
+func Load(command string, args []string) (*Config, error) {
+	return load(command, args, Settings, os.Environ)
+}
+
+func load(command string, args []string, settings []Setting, environ func() []string) (*Config, error) {
+	c := &Config{
+		order:    settings,
+		settings: make(map[string]Setting, len(settings)),
+		values:   make(map[string]string, len(settings)),
+		sources:  make(map[string]string, len(settings)),
+	}
+
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s [flags] [env files]\n\nFlags take precedence over environment variables, "+
+			"which take precedence over the YAML file.\n\n", command)
+		flags.PrintDefaults()
+	}
+	file := flags.String("config", "", "YAML `file` of settings, keyed like the flags (default $"+FileVariable+")")
+	flagged := make(map[string]*string, len(settings))
+	for _, s := range settings {
+		c.settings[s.Name] = s
+		usage := s.Description + " ($" + s.Name + ")"
+		flagged[s.Name] = flags.String(s.Key(), "", usage)
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	// .env files do not replace variables that are already set.
+	for _, envFile := range flags.Args() {
+		if err := godotenv.Load(envFile); err != nil {
+			return nil, fmt.Errorf("could not load %s: %v", envFile, err)
+		}
+	}
+
+	env := make(map[string]string)
+	for _, kv := range environ() {
+		if i := strings.Index(kv, "="); i > 0 {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	if *file == "" {
+		*file = env[FileVariable]
+	}
+	var fromFile map[string]string
+	if *file != "" {
+		var err error
+		if fromFile, err = readFile(*file, c.settings); err != nil {
+			return nil, err
+		}
+	}
+
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	var invalid []string
+	for _, s := range settings {
+		value, source := s.Default, SourceDefault
+		if v, ok := fromFile[s.Name]; ok {
+			value, source = v, SourceFile
+		}
+		if v, ok := env[s.Name]; ok && v != "" {
+			value, source = v, SourceEnv
+		}
+		if set[s.Key()] {
+			value, source = *flagged[s.Name], SourceFlag
+		}
+		if value != "" {
+			if err := s.validate(value); err != nil {
+				invalid = append(invalid, fmt.Sprintf("%s (%s): %v", s.Name, source, err))
+			}
+		}
+		c.values[s.Name], c.sources[s.Name] = value, source
+	}
+	if len(invalid) > 0 {
+		return nil, errors.New("invalid configuration:\n  " + strings.Join(invalid, "\n  "))
+	}
+
+	for name := range env {
+		if _, ok := c.settings[name]; !ok && strings.HasPrefix(name, prefix) && name != FileVariable && !inFamily(name) {
+			c.Warnings = append(c.Warnings, fmt.Sprintf("%s is not a setting of the server, it is ignored", name))
+		}
+	}
+	sort.Strings(c.Warnings)
+	return c, nil
+}
+
+// readFile reads the settings of a YAML file, keyed like the flags. Lists
+// are joined with commas.
+func readFile(path string, settings map[string]Setting) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file map[string]interface{}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	keys := make(map[string]string, len(settings))
+	for name, s := range settings {
+		keys[s.Key()] = name
+	}
+
+	values := make(map[string]string, len(file))
+	for key, value := range file {
+		name, ok := keys[key]
+		if !ok {
+			return nil, fmt.Errorf("invalid config file %s: unknown setting %q", path, key)
+		}
+		switch v := value.(type) {
+		case nil:
+			values[name] = ""
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			values[name] = strings.Join(items, ",")
+		case map[string]interface{}:
+			return nil, fmt.Errorf("invalid config file %s: %s must be a value or a list", path, key)
+		default:
+			values[name] = fmt.Sprint(v)
+		}
+	}
+	return values, nil
+}
+
+// setting returns the declared setting of the name, or panics, as reading
+// an undeclared setting is a mistake of the code.
+func (c *Config) setting(name string) Setting {
+	s, ok := c.settings[name]
+	if !ok {
+		panic("config: undeclared setting " + name)
+	}
+	return s
+}
+
+// Get returns the value of the setting, or "" if it is not set and has no
+// default.
+func (c *Config) Get(name string) string {
+	c.setting(name)
+	return c.values[name]
+}
+
+// Bool returns the value of a Bool setting, false if it is not set.
+func (c *Config) Bool(name string) bool {
+	return c.Get(name) == "true"
+}
+
+// Int returns the value of an Int setting, 0 if it is not set.
+func (c *Config) Int(name string) int64 {
+	v, _ := strconv.ParseInt(c.Get(name), 10, 64)
+	return v
+}
+
+// Float returns the value of a Float setting, 0 if it is not set.
+func (c *Config) Float(name string) float64 {
+	v, _ := strconv.ParseFloat(c.Get(name), 64)
+	return v
+}
+
+// Duration returns the value of a Duration setting, 0 if it is not set.
+func (c *Config) Duration(name string) time.Duration {
+	v, _ := time.ParseDuration(c.Get(name))
+	return v
+}
+
+// Require returns an error naming the settings that are not set.
+func (c *Config) Require(names ...string) error {
+	var missing []string
+	for _, name := range names {
+		if c.Get(name) == "" {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required settings: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// Write writes the configuration as an .env file, each setting with its
+// description and where its value comes from. Secrets are redacted.
+func (c *Config) Write(w io.Writer) error {
+	for _, s := range c.order {
+		value := c.Get(s.Name)
+		if s.Secret && value != "" {
+			value = "<redacted>"
+		}
+		if strings.ContainsAny(value, " \"#'") {
+			value = strconv.Quote(value)
+		}
+		if _, err := fmt.Fprintf(w, "# %s [-%s, %s]\n%s=%s\n", s.Description, s.Key(), c.sources[s.Name], s.Name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func inFamily(name string) bool {
+	for _, family := range Families {
+		if strings.HasPrefix(name, family) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
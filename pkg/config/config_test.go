@@ -0,0 +1,114 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSettings = []Setting{
+	{Name: "DONATION_SERVER_PORT", Kind: Port},
+	{Name: "DONATION_SERVER_STRIPE_TIMEOUT", Kind: Duration},
+	{Name: "DONATION_SERVER_CURRENCIES"},
+	{Name: "DONATION_SERVER_COMPRESSION", Kind: Bool, Default: "true"},
+	{Name: "DONATION_SERVER_LOG_FORMAT", Values: []string{"console", "json"}},
+	{Name: "STRIPE_SECRET_KEY", Secret: true},
+}
+
+func writeFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func environ(vars ...string) func() []string {
+	return func() []string { return vars }
+}
+
+func TestPrecedence(t *testing.T) {
+	path := writeFile(t, "port: 8080\nstripe-timeout: 5s\ncurrencies: [EUR, USD]\ncompression: false\n")
+	c, err := load("test", []string{"-config", path, "-port", "9090"}, testSettings,
+		environ("DONATION_SERVER_PORT=7070", "DONATION_SERVER_STRIPE_TIMEOUT=20s", "DONATION_SERVER_CURRENCIES=", "DONATION_SERVER_TYPO=1", "DONATION_SERVER_FEATURE_ROUND_UP=false"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Get("DONATION_SERVER_PORT"); got != "9090" {
+		t.Errorf("the port is %s, want the flag's 9090", got)
+	}
+	if got := c.Duration("DONATION_SERVER_STRIPE_TIMEOUT"); got != 20*time.Second {
+		t.Errorf("the timeout is %s, want the environment's 20s", got)
+	}
+	if got := c.Get("DONATION_SERVER_CURRENCIES"); got != "EUR,USD" {
+		t.Errorf("the currencies are %q, want the file's EUR,USD", got)
+	}
+	if c.Bool("DONATION_SERVER_COMPRESSION") {
+		t.Error("compression is on, want the file's false over the default")
+	}
+	if len(c.Warnings) != 1 || !strings.Contains(c.Warnings[0], "DONATION_SERVER_TYPO") {
+		t.Errorf("the warnings are %q, want one of DONATION_SERVER_TYPO", c.Warnings)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	_, err := load("test", []string{"-port", "http", "-log-format", "text"}, testSettings,
+		environ("DONATION_SERVER_STRIPE_TIMEOUT=10", "DONATION_SERVER_COMPRESSION=yes"))
+	if err == nil {
+		t.Fatal("load succeeded, want an error")
+	}
+	for _, name := range []string{"DONATION_SERVER_PORT (flag)", "DONATION_SERVER_STRIPE_TIMEOUT (environment)",
+		"DONATION_SERVER_COMPRESSION (environment)", "DONATION_SERVER_LOG_FORMAT (flag)"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("the error does not name %s: %v", name, err)
+		}
+	}
+
+	if _, err := load("test", []string{"-config", writeFile(t, "prot: 8080\n")}, testSettings, environ()); err == nil ||
+		!strings.Contains(err.Error(), `unknown setting "prot"`) {
+		t.Errorf("load of an unknown key = %v, want an error naming it", err)
+	}
+}
+
+func TestRequireAndWrite(t *testing.T) {
+	c, err := load("test", nil, testSettings, environ("STRIPE_SECRET_KEY=sk_test_123"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Require("STRIPE_SECRET_KEY", "DONATION_SERVER_PORT"); err == nil || !strings.Contains(err.Error(), "DONATION_SERVER_PORT") ||
+		strings.Contains(err.Error(), "STRIPE_SECRET_KEY") {
+		t.Errorf("Require = %v, want an error naming only DONATION_SERVER_PORT", err)
+	}
+
+	var buf bytes.Buffer
+	if err := c.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if out := buf.String(); strings.Contains(out, "sk_test_123") || !strings.Contains(out, "DONATION_SERVER_COMPRESSION=true") {
+		t.Errorf("the written configuration shows the secret or misses the default:\n%s", out)
+	}
+}
+
+func TestSettings(t *testing.T) {
+	names, keys := make(map[string]bool), make(map[string]bool)
+	for _, s := range Settings {
+		if names[s.Name] {
+			t.Errorf("%s is declared twice", s.Name)
+		}
+		if keys[s.Key()] {
+			t.Errorf("the key %q of %s is taken by another setting", s.Key(), s.Name)
+		}
+		names[s.Name], keys[s.Key()] = true, true
+	}
+	if t.Failed() {
+		return
+	}
+
+	// The flag set panics on a flag declared twice.
+	if _, err := load("test", nil, Settings, environ()); err != nil {
+		t.Fatalf("load of the settings of the server = %v", err)
+	}
+}
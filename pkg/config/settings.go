@@ -0,0 +1,183 @@
+package config
+
+// Settings are the settings of the server, in the order they are documented.
+var Settings = []Setting{
+	// Stripe.
+	{Name: "STRIPE_PUBLISHABLE_KEY", Description: "Stripe publishable key, pk_..."},
+	{Name: "STRIPE_SECRET_KEY", Secret: true, Description: "Stripe secret key, sk_... or rk_..."},
+	{Name: "STRIPE_WEBHOOK_SECRET", Secret: true, Description: "Secret verifying the signatures of Stripe webhooks, whsec_..."},
+	{Name: "DONATION_SERVER_STRIPE_TIMEOUT", Kind: Duration, Description: "How long a call to Stripe may take (10s by default)"},
+	{Name: "DONATION_SERVER_PAYMENT_PROVIDER", Values: []string{"stripe", "fake"}, Description: "Payment provider, fake simulates payments outside of production (stripe by default)"},
+	{Name: "DONATION_SERVER_FAKE_DELAY", Kind: Duration, Description: "Delay of the webhooks of the fake payment provider"},
+	{Name: "DONATION_SERVER_FAKE_DECLINE_RATE", Kind: Float, Description: "Share of payments the fake payment provider declines, from 0 to 1"},
+	{Name: "DONATION_SERVER_FAKE_ERROR_RATE", Kind: Float, Description: "Share of calls the fake payment provider fails, from 0 to 1"},
+	{Name: "DONATION_SERVER_FAKE_SEED", Kind: Int, Description: "Seed of the simulation of the fake payment provider"},
+	{Name: "DONATION_SERVER_FAKE_WEBHOOK_URL", Kind: URL, Description: "URL the fake payment provider sends webhooks to (http://localhost:PORT/webhook by default)"},
+	{Name: "DONATION_SERVER_PAYMENT_METHODS", Description: "Payment methods offered to donors, e.g. card,paypal, those enabled for the Stripe account if empty"},
+	{Name: "DONATION_SERVER_PAUSED_PAYMENTS", Description: "Payment provider or methods paused at startup, e.g. stripe or card"},
+	{Name: "DONATION_SERVER_PAYMENT_INTENT_FALLBACK", Kind: Bool, Default: "false", Description: "Retry payment intents Stripe rejects with cards only"},
+	{Name: "DONATION_SERVER_FUNNEL_ANALYTICS", Kind: Bool, Default: "false", Description: "Count anonymous sessions of the donation page from /config to a succeeded payment"},
+	{Name: "DONATION_SERVER_STRIPE_IP_ALLOWLIST", Kind: Bool, Default: "false", Description: "Only accept webhooks from Stripe's IP addresses"},
+	{Name: "DONATION_SERVER_STRIPE_TAX", Kind: Bool, Default: "false", Description: "Tax every payment with Stripe Tax"},
+	{Name: "DONATION_SERVER_STRIPE_TAX_BEHAVIOR", Description: "Whether Stripe Tax is inclusive (default) or exclusive of the amount"},
+	{Name: "DONATION_SERVER_STRIPE_TAX_DONATION_CODE", Description: "Stripe tax code of donations (the account's default if empty)"},
+
+	// Server.
+	{Name: "DONATION_SERVER_PORT", Kind: Port, Description: "Port the server listens on"},
+	{Name: "DONATION_SERVER_SHUTDOWN_TIMEOUT", Kind: Duration, Description: "How long the server waits for requests in flight when it stops"},
+	{Name: "DONATION_SERVER_FLUSH_TIMEOUT", Kind: Duration, Description: "How long the notifiers may write queued events when the server stops (4s by default)"},
+	{Name: "DONATION_SERVER_PUBLIC_URL", Kind: URL, Description: "Public URL of the server, used in links to it"},
+	{Name: "DONATION_SERVER_ENVIRONMENT", Description: "Environment of the server, e.g. production or staging"},
+	{Name: "DONATION_SERVER_INSTANCE_ID", Description: "Name of the instance, its hostname and process ID if empty"},
+	{Name: "DONATION_SERVER_DATABASE_URL", Secret: true, Description: "Postgres database of the donation ledger, donations are only kept in memory without it"},
+	{Name: "DONATION_SERVER_LOG_LEVEL", Description: "Log level: debug, info (default), warn or error"},
+	{Name: "DONATION_SERVER_LOG_FORMAT", Values: []string{"console", "json"}, Description: "Log format: console text (default) or json"},
+	{Name: "DONATION_SERVER_OTLP_ENDPOINT", Kind: URL, Description: "OTLP/HTTP endpoint traces are exported to, like http://otel-collector:4318, which enables tracing"},
+	{Name: "DONATION_SERVER_OTLP_HEADERS", Secret: true, Description: "Headers of the trace exports, like Authorization=Basic abc,X-Scope-OrgID=donations"},
+	{Name: "DONATION_SERVER_TRACE_SAMPLE_RATE", Kind: Float, Description: "Share of the traces started by the server that are exported, from 0 to 1 (1 by default)"},
+	{Name: "DONATION_SERVER_DEBUG", Kind: Bool, Default: "false", Description: "Validate every notification against its JSON Schema"},
+	{Name: "DONATION_SERVER_CACHE_MAX_AGE", Kind: Duration, Description: "How long browsers and CDNs may cache public read endpoints"},
+	{Name: "DONATION_SERVER_COMPRESSION", Kind: Bool, Default: "true", Description: "Compress responses with Brotli or gzip"},
+	{Name: "DONATION_SERVER_SECURITY_HEADERS", Kind: Bool, Default: "true", Description: "Set security headers on responses"},
+	{Name: "DONATION_SERVER_FRAME_ANCESTORS", Description: "Sites that may frame the donation page, space separated (* by default)"},
+	{Name: "DONATION_SERVER_CONTENT_SECURITY_POLICY", Description: "Content-Security-Policy replacing the default"},
+	{Name: "DONATION_SERVER_HSTS_MAX_AGE", Kind: Duration, Description: "Max age of Strict-Transport-Security, 0 disables it"},
+	{Name: "DONATION_SERVER_REFERRER_POLICY", Description: "Referrer-Policy replacing the default"},
+	{Name: "DONATION_SERVER_CORS_ORIGINS", Description: "Origins whose pages may call the server (* by default)"},
+	{Name: "DONATION_SERVER_CORS_METHODS", Description: "Methods pages of other origins may use"},
+	{Name: "DONATION_SERVER_CORS_HEADERS", Description: "Request headers pages of other origins may send"},
+	{Name: "DONATION_SERVER_CORS_MAX_AGE", Kind: Duration, Description: "How long browsers cache preflight answers"},
+	{Name: "DONATION_SERVER_WEBHOOK_MAX_IN_FLIGHT", Kind: Int, Description: "Stripe webhooks handled at once (32 by default)"},
+	{Name: "DONATION_SERVER_FEATURES_FILE", Description: "File of feature flags"},
+	{Name: "DONATION_SERVER_FEATURES_URL", Kind: URL, Description: "Service of feature flags"},
+	{Name: "DONATION_SERVER_FAULTS_STRIPE", Description: "Faults injected into calls to Stripe outside of production"},
+	{Name: "DONATION_SERVER_FAULTS_NOTIFIER", Description: "Faults injected into notifications outside of production"},
+
+	// Notifiers.
+	{Name: "DONATION_SERVER_NOTIFIER", Description: "Notifiers of donations: kafka, webhook, sqs, sns or email, or several separated by commas"},
+	{Name: "DONATION_SERVER_NOTIFIER_MODE", Values: []string{"best-effort", "fail-fast"}, Description: "How several notifiers are notified (best-effort by default)"},
+	{Name: "DONATION_SERVER_NOTIFIER_RETRIES", Kind: Int, Description: "Attempts of every notification, including the first (3 by default, 1 to not retry)"},
+	{Name: "DONATION_SERVER_NOTIFIER_RETRY_BACKOFF", Kind: Duration, Description: "Wait before the first retry of a notification, doubling up to 2s (100ms by default)"},
+	{Name: "DONATION_SERVER_DEAD_LETTER_SINK", Values: []string{"file", "kafka", "table"}, Description: "Durable sink of failed notifications, whose webhook events are then acknowledged"},
+	{Name: "DONATION_SERVER_DEAD_LETTER_FILE", Description: "File of the file dead-letter sink"},
+	{Name: "DONATION_SERVER_DEAD_LETTER_TOPIC", Description: "Kafka topic of the kafka dead-letter sink"},
+	{Name: "DONATION_SERVER_WEBHOOK_BUDGET", Kind: Duration, Description: "How long webhook notifications may take before the event is acknowledged and they finish in the background"},
+	{Name: "DONATION_SERVER_ASYNC_WORKERS", Kind: Int, Description: "Workers delivering the notifications of webhooks in the background (inline if empty)"},
+	{Name: "DONATION_SERVER_ASYNC_QUEUE_SIZE", Kind: Int, Description: "Notifications queued for the workers before webhooks wait (1000 by default)"},
+	{Name: "DONATION_SERVER_ASYNC_JOURNAL", Description: "File keeping the queued notifications across crashes"},
+	{Name: "DONATION_SERVER_DUAL_WRITE_NOTIFIER", Description: "Second notifier every notification is also written to"},
+	{Name: "DONATION_SERVER_CUSTOMERS_TOPIC", Description: "Kafka topic notifications are sent to"},
+	{Name: "UPSTASH_KAFKA_BOOTSTRAP_SERVERS", Description: "Kafka bootstrap servers"},
+	{Name: "UPSTASH_KAFKA_SCRAM_USERNAME", Description: "Kafka SCRAM username"},
+	{Name: "UPSTASH_KAFKA_SCRAM_PASSWORD", Secret: true, Description: "Kafka SCRAM password"},
+	{Name: "DONATION_SERVER_KAFKA_BATCH_SIZE", Kind: Int, Description: "Events written to Kafka at once, in the background if above 1"},
+	{Name: "DONATION_SERVER_KAFKA_BATCH_TIMEOUT", Kind: Duration, Description: "How long events wait for a full batch (1s by default)"},
+	{Name: "DONATION_SERVER_WEBHOOK_NOTIFIER_URL", Kind: URL, Description: "HTTP webhook receiving the notifications"},
+	{Name: "DONATION_SERVER_WEBHOOK_NOTIFIER_TEMPLATES", Description: "Directory of payload templates of the webhook notifier"},
+	{Name: "DONATION_SERVER_SQS_QUEUE_URL", Kind: URL, Description: "AWS SQS queue receiving the notifications"},
+	{Name: "DONATION_SERVER_SNS_TOPIC_ARN", Description: "AWS SNS topic receiving the notifications"},
+	{Name: "DONATION_SERVER_SQS_REGION", Description: "AWS region of the queue or topic, if not the one of its URL or ARN"},
+	{Name: "DONATION_SERVER_SNS_ENDPOINT", Kind: URL, Description: "SNS endpoint, e.g. of LocalStack, instead of SNS of the region"},
+	{Name: "DONATION_SERVER_EMAIL_FROM", Description: "Sender of emails, whose name is the charity's"},
+	{Name: "DONATION_SERVER_EMAIL_ADMINS", Description: "Administrators emailed about every donation"},
+	{Name: "DONATION_SERVER_EMAIL_TEMPLATES", Description: "Directory of email templates"},
+	{Name: "DONATION_SERVER_SMTP_ADDR", Description: "SMTP server sending emails, host:port"},
+	{Name: "DONATION_SERVER_SMTP_USERNAME", Description: "SMTP username"},
+	{Name: "DONATION_SERVER_SMTP_PASSWORD", Secret: true, Description: "SMTP password"},
+	{Name: "DONATION_SERVER_SENDGRID_API_KEY", Secret: true, Description: "SendGrid API key sending emails instead of SMTP"},
+	{Name: "DONATION_SERVER_CLOUDEVENTS_MODE", Values: []string{"structured", "binary"}, Description: "CloudEvents envelope of the notifications, disabled if empty"},
+	{Name: "DONATION_SERVER_CLOUDEVENTS_SOURCE", Description: "Source of the CloudEvents"},
+	{Name: "DONATION_SERVER_CLOUDEVENTS_TYPE_PREFIX", Description: "Prefix of the types of the CloudEvents"},
+	{Name: "DONATION_SERVER_SHADOW_WEBHOOK_URL", Kind: URL, Description: "Endpoint Stripe webhooks are mirrored to"},
+	{Name: "DONATION_SERVER_SHADOW_NOTIFIER_URL", Kind: URL, Description: "Shadow webhook notifier notifications are mirrored to"},
+	{Name: "DONATION_SERVER_SLA_MIN_SUCCESS_RATE", Kind: Float, Description: "Share of notifications that must be delivered"},
+	{Name: "DONATION_SERVER_SLA_MAX_LATENCY", Kind: Duration, Description: "How long notifications may take from the charge"},
+	{Name: "DONATION_SERVER_ALERT_WEBHOOK_URL", Kind: URL, Description: "Slack incoming webhook receiving alerts"},
+	{Name: "DONATION_SERVER_ANOMALY_DETECTION", Kind: Bool, Default: "false", Description: "Check the recent donations for bursts, spikes and unusual amounts"},
+	{Name: "DONATION_SERVER_ANOMALY_WINDOW", Kind: Duration, Description: "Span of recent donations checked for anomalies (1h by default)"},
+	{Name: "DONATION_SERVER_ANOMALY_MAX_PER_IP", Kind: Int, Description: "Most donations from one client IP in the window (5 by default, 0 to not check)"},
+	{Name: "DONATION_SERVER_ANOMALY_MAX_PER_EMAIL", Kind: Int, Description: "Most donations from one email in the window (5 by default, 0 to not check)"},
+	{Name: "DONATION_SERVER_ANOMALY_SPIKE_FACTOR", Kind: Float, Description: "How many times the usual number of donations is a spike (5 by default, 0 to not check)"},
+
+	// Donations.
+	{Name: "DONATION_SERVER_CURRENCIES", Description: "Currencies donations are taken in, the first is the default (EUR if empty)"},
+	{Name: "DONATION_SERVER_EXCHANGE_RATES_URL", Kind: URL, Description: "Exchange-rate service converting campaign totals, like https://api.frankfurter.app/latest"},
+	{Name: "DONATION_SERVER_AMOUNT_LIMITS", Description: "Minimum and maximum amounts by currency, like EUR:5-10000"},
+	{Name: "DONATION_SERVER_AMOUNT_LIMITS_FILE", Description: "JSON file of the amount limits"},
+	{Name: "DONATION_SERVER_ERROR_CATALOG", Description: "JSON file of messages donors get when Stripe refuses their payment"},
+	{Name: "DONATION_SERVER_CHECKOUT_SUCCESS_URL", Kind: URL, Description: "Where donors go after paying with Stripe Checkout, which is enabled with it"},
+	{Name: "DONATION_SERVER_CHECKOUT_CANCEL_URL", Kind: URL, Description: "Where donors go back to without paying (the public URL by default)"},
+	{Name: "DONATION_SERVER_TERMINAL_LOCATION", Description: "Stripe Terminal location of the card readers, which enables in-person donations"},
+	{Name: "DONATION_SERVER_TERMINAL_CUSTOMER", Description: "Stripe customer of in-person donations whose donor is not given"},
+	{Name: "DONATION_SERVER_RECURRING_CONFIG", Description: "JSON file of the tiers of recurring donations"},
+	{Name: "DONATION_SERVER_REQUIRE_ADDRESS", Kind: Bool, Default: "false", Description: "Require the donor's address on /create-payment-intent"},
+	{Name: "DONATION_SERVER_ADDRESS_VALIDATION_URL", Kind: URL, Description: "Service verifying donors' addresses"},
+	{Name: "DONATION_SERVER_VAT_CONFIG", Description: "JSON file of the VAT configuration of purchases"},
+	{Name: "DONATION_SERVER_DENIED_PARTIES_CSV", Description: "CSV file of denied parties new customers are screened against"},
+
+	// Client blocking and rate limiting.
+	{Name: "DONATION_SERVER_CLIENT_IP_HEADER", Description: "Header holding the client IP behind a proxy, e.g. Fly-Client-IP"},
+	{Name: "DONATION_SERVER_CLIENT_IP_HOPS", Kind: Int, Default: "1", Description: "Trusted proxies appending to a list header like X-Forwarded-For, the client IP is that many entries from the right"},
+	{Name: "DONATION_SERVER_ALLOWED_CIDRS", Description: "CIDRs bypassing the blocking rules"},
+	{Name: "DONATION_SERVER_BLOCKED_CIDRS", Description: "CIDRs refused"},
+	{Name: "DONATION_SERVER_ALLOWED_COUNTRIES", Description: "The only countries allowed"},
+	{Name: "DONATION_SERVER_BLOCKED_COUNTRIES", Description: "Countries refused"},
+	{Name: "DONATION_SERVER_GEOIP_CSV", Description: "CSV database of the countries of IP ranges"},
+	{Name: "DONATION_SERVER_COUNTRY_HEADER", Description: "Header holding the client country set by a CDN, e.g. CF-IPCountry"},
+	{Name: "DONATION_SERVER_RATE_LIMIT", Description: "Rate limit per client IP on the public endpoints, like 20/m"},
+	{Name: "DONATION_SERVER_RATE_LIMIT_BURST", Kind: Int, Description: "Requests a client can make at once (the rate's by default)"},
+	{Name: "DONATION_SERVER_RATE_LIMIT_ALLOWED_CIDRS", Description: "CIDRs never rate limited"},
+	{Name: "DONATION_SERVER_RATE_LIMIT_ALLOWED_ORIGINS", Description: "Origins never rate limited"},
+
+	// Jobs.
+	{Name: "DONATION_SERVER_LEADER_ELECTION", Kind: Bool, Default: "false", Description: "Run the scheduled jobs only on the instance elected leader"},
+	{Name: "DONATION_SERVER_JOB_JITTER", Kind: Duration, Description: "Random delay of the daily scheduled jobs"},
+	{Name: "DONATION_SERVER_RETENTION_POLICIES", Description: "JSON file of the retention policies"},
+	{Name: "DONATION_SERVER_ARCHIVE_DIR", Description: "Directory donations are archived to"},
+	{Name: "DONATION_SERVER_RETENTION_DRY_RUN", Kind: Bool, Default: "true", Description: "Only report what the retention policies would archive"},
+	{Name: "DONATION_SERVER_RETENTION_SCHEDULE", Description: "Cron expression of when the retention policies run instead of daily"},
+	{Name: "DONATION_SERVER_DIGEST_WEBHOOK_URL", Kind: URL, Description: "Slack incoming webhook receiving the daily digest"},
+	{Name: "DONATION_SERVER_DIGEST_TIME", Description: "UTC time of the daily digest (07:00 by default)"},
+	{Name: "DONATION_SERVER_DIGEST_SCHEDULE", Description: "Cron expression of the digest replacing its time"},
+	{Name: "DONATION_SERVER_LIFECYCLE_NOTIFIER", Description: "Notifier of anniversary and milestone emails, webhook or email"},
+	{Name: "DONATION_SERVER_LIFECYCLE_TIME", Description: "UTC time of the lifecycle emails (10:00 by default)"},
+	{Name: "DONATION_SERVER_LIFECYCLE_SCHEDULE", Description: "Cron expression of the lifecycle emails replacing their time"},
+	{Name: "DONATION_SERVER_LIFECYCLE_MILESTONES", Description: "Milestones of donors in the currency unit, like 100,250,500"},
+	{Name: "DONATION_SERVER_LIFECYCLE_TEMPLATES", Description: "Directory of the templates of lifecycle emails"},
+	{Name: "DONATION_SERVER_REPORT_NOTIFIER", Description: "Notifier delivering scheduled reports, webhook or email"},
+
+	// Duplicates, receipts and refunds.
+	{Name: "DONATION_SERVER_DUPLICATE_WINDOW", Kind: Duration, Description: "Window within which the same donation of a donor is a duplicate"},
+	{Name: "DONATION_SERVER_DUPLICATE_NOTIFIER", Description: "Notifier emailing donors a link to refund a duplicate"},
+	{Name: "DONATION_SERVER_DUPLICATE_REFUND_WINDOW", Kind: Duration, Description: "How long refund links are valid"},
+	{Name: "DONATION_SERVER_DUPLICATE_MAX_REFUND", Kind: Int, Description: "Largest duplicate refunded by link, in the currency unit"},
+	{Name: "DONATION_SERVER_DUPLICATE_SECRET", Secret: true, Description: "Secret signing refund links, 32+ characters"},
+	{Name: "DONATION_SERVER_RECEIPT_NOTIFIER", Description: "Notifier emailing receipts, webhook or email"},
+	{Name: "DONATION_SERVER_RECEIPT_DIR", Description: "Directory receipts are written to"},
+	{Name: "DONATION_SERVER_RECEIPT_TEMPLATES", Description: "Directory of receipt templates"},
+	{Name: "DONATION_SERVER_RECEIPT_PREFIX", Default: "R-", Description: "Prefix of receipt numbers"},
+	{Name: "DONATION_SERVER_RECEIPT_ORGANIZATION", Description: "Charity's name on receipts (the name of the email sender by default)"},
+	{Name: "DONATION_SERVER_AUTO_REFUND_RULES", Description: "JSON file of automatic refund rules"},
+	{Name: "DONATION_SERVER_AUTO_REFUND_AUDIT_LOG", Description: "File automatic refunds are audited to"},
+
+	// Data.
+	{Name: "DONATION_SERVER_AUDIT_LOG", Description: "Hash-chained audit log file"},
+	{Name: "DONATION_SERVER_BACKUP_KEY", Secret: true, Description: "Key of 64 hex digits encrypting backups"},
+	{Name: "DONATION_SERVER_BACKUP_S3_ENDPOINT", Kind: URL, Description: "S3 compatible endpoint storing backups"},
+	{Name: "AWS_REGION", Description: "S3 region (us-east-1 by default)"},
+	{Name: "AWS_ACCESS_KEY_ID", Description: "AWS access key ID of S3, SQS and SNS, the IAM role of the server is used for SQS and SNS if empty"},
+	{Name: "AWS_SECRET_ACCESS_KEY", Secret: true, Description: "AWS secret access key of S3, SQS and SNS"},
+	{Name: "AWS_SESSION_TOKEN", Secret: true, Description: "AWS session token of temporary credentials"},
+	{Name: "DONATION_SERVER_PII_KEYS", Secret: true, Description: "Keys encrypting donors' personal data, ID:64 hex digits separated by commas"},
+	{Name: "DONATION_SERVER_PII_KEYS_FILE", Description: "File of the keys encrypting donors' personal data"},
+
+	// Admin API.
+	{Name: "DONATION_SERVER_ADMIN_API_KEY", Secret: true, Description: "API key of the admin API, which is disabled without it or JWTs"},
+	{Name: "DONATION_SERVER_ADMIN_API_KEYS", Secret: true, Description: "More API keys of the admin API, comma separated, e.g. the previous key during a rotation"},
+	{Name: "DONATION_SERVER_JWT_SECRETS", Secret: true, Description: "Secrets of HS256 JWTs accepted by the admin API, comma separated, of at least 32 characters"},
+	{Name: "DONATION_SERVER_JWT_PUBLIC_KEYS_FILE", Description: "PEM file of the RSA public keys of RS256 JWTs accepted by the admin API"},
+	{Name: "DONATION_SERVER_JWT_ISSUER", Description: "Issuer (iss) of the JWTs, not checked if empty"},
+	{Name: "DONATION_SERVER_JWT_AUDIENCE", Description: "Audience (aud) of the JWTs, not checked if empty"},
+	{Name: "DONATION_SERVER_METRICS_PUBLIC", Kind: Bool, Default: "false", Description: "Serve /metrics without the credentials of the admin API, which otherwise require the metrics:read scope"},
+	{Name: "DONATION_SERVER_OAUTH", Kind: Bool, Default: "false", Description: "Accept OAuth 2.0 tokens of registered clients on the admin API"},
+}
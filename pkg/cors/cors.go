@@ -0,0 +1,157 @@
+// Package cors lets pages on other sites, like those embedding the donation
+// widget, call the server from the browser. It answers preflight requests and
+// sets the Access-Control headers of allowed origins.
+package cors
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultMaxAge is how long browsers cache the answer to a preflight request.
+const DefaultMaxAge = 10 * time.Minute
+
+var (
+	// DefaultMethods are the methods of the public endpoints.
+	DefaultMethods = []string{"GET", "HEAD", "POST"}
+	// DefaultHeaders are the request headers the widget and partners send.
+	DefaultHeaders = []string{"Content-Type", "X-Partner-Key"}
+	// DefaultExposedHeaders are the response headers scripts may read.
+	DefaultExposedHeaders = []string{"X-Request-ID"}
+)
+
+// Policy holds the origins, methods and headers allowed in requests from
+// other sites.
+type Policy struct {
+	// Origins are the allowed origins, e.g. "https://example.org", with "*"
+	// in place of subdomains, e.g. "https://*.example.org", or "*" for any.
+	Origins []string
+	Methods []string
+	// Headers are the request headers allowed besides those browsers always
+	// allow, e.g. Accept.
+	Headers        []string
+	ExposedHeaders []string
+	// MaxAge of zero lets browsers pick how long to cache preflight answers.
+	MaxAge time.Duration
+}
+
+// Default returns the policy allowing any origin to call the public endpoints.
+func Default() Policy {
+	return Policy{
+		Origins:        []string{"*"},
+		Methods:        DefaultMethods,
+		Headers:        DefaultHeaders,
+		ExposedHeaders: DefaultExposedHeaders,
+		MaxAge:         DefaultMaxAge,
+	}
+}
+
+// Allows reports whether requests from the origin are allowed.
+func (p Policy) Allows(origin string) bool {
+	for _, allowed := range p.Origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		if i := strings.Index(allowed, "://*."); i >= 0 {
+			scheme, domain := allowed[:i+3], allowed[i+4:]
+			if len(origin) > len(scheme)+len(domain) && strings.EqualFold(origin[:len(scheme)], scheme) &&
+				strings.EqualFold(origin[len(origin)-len(domain):], domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p Policy) anyOrigin() bool {
+	for _, allowed := range p.Origins {
+		if allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware answers preflight requests from allowed origins and sets the
+// Access-Control headers on responses to their requests. Preflight requests
+// never reach the handler, and requests of other origins get no headers, so
+// browsers do not let their scripts read the responses.
+func Middleware(p Policy) func(http.HandlerFunc) http.HandlerFunc {
+	methods := strings.Join(p.Methods, ", ")
+	headers := make(map[string]bool, len(p.Headers))
+	for _, h := range p.Headers {
+		headers[http.CanonicalHeaderKey(h)] = true
+	}
+	exposed := strings.Join(p.ExposedHeaders, ", ")
+	maxAge := strconv.FormatInt(int64(p.MaxAge/time.Second), 10)
+	anyOrigin := p.anyOrigin()
+
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if !anyOrigin {
+				w.Header().Add("Vary", "Origin")
+			}
+			origin := r.Header.Get("Origin")
+			preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+			if origin == "" || !p.Allows(origin) {
+				if preflight {
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+				next(w, r)
+				return
+			}
+
+			allowOrigin := origin
+			if anyOrigin {
+				allowOrigin = "*"
+			}
+			if !preflight {
+				w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+				if exposed != "" {
+					w.Header().Set("Access-Control-Expose-Headers", exposed)
+				}
+				next(w, r)
+				return
+			}
+
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			if !contains(p.Methods, r.Header.Get("Access-Control-Request-Method")) || !allowedHeaders(headers, r) {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+			w.Header().Set("Access-Control-Allow-Methods", methods)
+			if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+				w.Header().Set("Access-Control-Allow-Headers", requested)
+			}
+			if p.MaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", maxAge)
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedHeaders reports whether the headers of the preflight request are
+// all allowed.
+func allowedHeaders(allowed map[string]bool, r *http.Request) bool {
+	for _, h := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+		if h = strings.TrimSpace(h); h != "" && !allowed[http.CanonicalHeaderKey(h)] {
+			return false
+		}
+	}
+	return true
+}
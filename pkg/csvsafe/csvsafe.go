@@ -0,0 +1,25 @@
+// Package csvsafe escapes the cells of CSV files opened in spreadsheets.
+package csvsafe
+
+// Cell returns the value prefixed with ' if it starts with a character a
+// spreadsheet reads as a formula, =, +, -, @, a tab or a carriage return,
+// so names and emails of donors cannot run formulas on the admin's computer.
+func Cell(value string) string {
+	if value == "" {
+		return value
+	}
+	switch value[0] {
+	case '=', '+', '-', '@', '\t', '\r':
+		return "'" + value
+	}
+	return value
+}
+
+// Row returns the values escaped with Cell.
+func Row(values ...string) []string {
+	row := make([]string, len(values))
+	for i, value := range values {
+		row[i] = Cell(value)
+	}
+	return row
+}
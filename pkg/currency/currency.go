@@ -0,0 +1,119 @@
+// Package currency describes the currencies donations can be taken in.
+// Amounts are in the smallest unit of their currency, like Stripe's: cents of
+// EUR, but yen of JPY, a zero-decimal currency.
+package currency
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Currency is a currency donations can be taken in.
+type Currency struct {
+	// Code is the ISO 4217 code, e.g. "EUR".
+	Code string `json:"code"`
+	// Decimals is the number of digits of the smallest unit, 0 for zero-decimal currencies.
+	Decimals int `json:"decimals"`
+	// MinimumAmount is the smallest amount donated, in the smallest unit,
+	// Stripe's minimum charge unless a higher one is configured, see Limits.
+	MinimumAmount int64 `json:"minimumAmount"`
+	// MaximumAmount is the largest amount donated, in the smallest unit, or
+	// 0 for no maximum other than Stripe's.
+	MaximumAmount int64 `json:"maximumAmount,omitempty"`
+}
+
+// currencies are the settlement currencies of Stripe with their minimum
+// charge amounts, see https://stripe.com/docs/currencies#minimum-and-maximum-charge-amounts.
+var currencies = map[string]Currency{
+	"AED": {Code: "AED", Decimals: 2, MinimumAmount: 200},
+	"AUD": {Code: "AUD", Decimals: 2, MinimumAmount: 50},
+	"BGN": {Code: "BGN", Decimals: 2, MinimumAmount: 100},
+	"BRL": {Code: "BRL", Decimals: 2, MinimumAmount: 50},
+	"CAD": {Code: "CAD", Decimals: 2, MinimumAmount: 50},
+	"CHF": {Code: "CHF", Decimals: 2, MinimumAmount: 50},
+	"CZK": {Code: "CZK", Decimals: 2, MinimumAmount: 1500},
+	"DKK": {Code: "DKK", Decimals: 2, MinimumAmount: 250},
+	"EUR": {Code: "EUR", Decimals: 2, MinimumAmount: 50},
+	"GBP": {Code: "GBP", Decimals: 2, MinimumAmount: 30},
+	"HKD": {Code: "HKD", Decimals: 2, MinimumAmount: 400},
+	"HUF": {Code: "HUF", Decimals: 2, MinimumAmount: 17500},
+	"INR": {Code: "INR", Decimals: 2, MinimumAmount: 50},
+	"JPY": {Code: "JPY", Decimals: 0, MinimumAmount: 50},
+	"MXN": {Code: "MXN", Decimals: 2, MinimumAmount: 1000},
+	"MYR": {Code: "MYR", Decimals: 2, MinimumAmount: 200},
+	"NOK": {Code: "NOK", Decimals: 2, MinimumAmount: 300},
+	"NZD": {Code: "NZD", Decimals: 2, MinimumAmount: 50},
+	"PLN": {Code: "PLN", Decimals: 2, MinimumAmount: 200},
+	"RON": {Code: "RON", Decimals: 2, MinimumAmount: 200},
+	"SEK": {Code: "SEK", Decimals: 2, MinimumAmount: 300},
+	"SGD": {Code: "SGD", Decimals: 2, MinimumAmount: 50},
+	"THB": {Code: "THB", Decimals: 2, MinimumAmount: 1000},
+	"USD": {Code: "USD", Decimals: 2, MinimumAmount: 50},
+}
+
+// Lookup returns the currency with the code, in any case.
+func Lookup(code string) (Currency, bool) {
+	c, ok := currencies[strings.ToUpper(code)]
+	return c, ok
+}
+
+// ParseList parses a comma-separated list of currency codes, e.g. "EUR,USD,JPY".
+func ParseList(s string) ([]Currency, error) {
+	var list []Currency
+	seen := make(map[string]bool)
+	for _, code := range strings.Split(s, ",") {
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if code == "" || seen[code] {
+			continue
+		}
+		c, ok := currencies[code]
+		if !ok {
+			return nil, fmt.Errorf("unsupported currency %q, supported are %s", code, strings.Join(Codes(), ", "))
+		}
+		seen[code] = true
+		list = append(list, c)
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("no currencies in %q", s)
+	}
+	return list, nil
+}
+
+// Codes returns the codes of all supported currencies, sorted.
+func Codes() []string {
+	codes := make([]string, 0, len(currencies))
+	for code := range currencies {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// Format formats an amount in the smallest unit of the currency, like
+// "12.50 EUR" or "1200 JPY". Unknown currencies have two decimals.
+func Format(amount int64, code string) string {
+	return FormatNumber(amount, code) + " " + strings.ToUpper(code)
+}
+
+// FormatNumber formats an amount in the smallest unit of the currency as a
+// decimal number without the currency, like "12.50" or "1200" of JPY, e.g.
+// for CSV columns.
+func FormatNumber(amount int64, code string) string {
+	decimals := 2
+	if c, ok := currencies[strings.ToUpper(code)]; ok {
+		decimals = c.Decimals
+	}
+	sign := ""
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	if decimals == 0 {
+		return fmt.Sprintf("%s%d", sign, amount)
+	}
+	unit := int64(1)
+	for i := 0; i < decimals; i++ {
+		unit *= 10
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, amount/unit, decimals, amount%unit)
+}
@@ -0,0 +1,132 @@
+package currency
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// RatesTTL is how long exchange rates are used before they are fetched
+	// again. Reference rates change once a day.
+	RatesTTL = time.Hour
+	// RatesTimeout limits a request to the exchange-rate service.
+	RatesTimeout = 5 * time.Second
+)
+
+// Rates are exchange rates: how much of each currency one unit of Base is worth.
+type Rates struct {
+	Base string `json:"base"`
+	// Date the rates were published, if the service tells it.
+	Date  string             `json:"date,omitempty"`
+	Rates map[string]float64 `json:"rates"`
+}
+
+// rate returns the rate of the currency, 1 for the base.
+func (r Rates) rate(code string) (float64, bool) {
+	code = strings.ToUpper(code)
+	if code == r.Base {
+		return 1, true
+	}
+	rate, ok := r.Rates[code]
+	return rate, ok && rate > 0
+}
+
+// Convert converts an amount in the smallest unit of a currency to the
+// smallest unit of another, rounded, and reports whether both have rates.
+func (r Rates) Convert(amount int64, from, to string) (int64, bool) {
+	fromCurrency, ok := Lookup(from)
+	if !ok {
+		return 0, false
+	}
+	toCurrency, ok := Lookup(to)
+	if !ok {
+		return 0, false
+	}
+	fromRate, ok := r.rate(from)
+	if !ok {
+		return 0, false
+	}
+	toRate, ok := r.rate(to)
+	if !ok {
+		return 0, false
+	}
+	units := float64(amount) / math.Pow10(fromCurrency.Decimals) / fromRate * toRate
+	return int64(math.Round(units * math.Pow10(toCurrency.Decimals))), true
+}
+
+// ExchangeRates fetches exchange rates from a service answering with JSON
+// like {"base": "EUR", "date": "2024-11-29", "rates": {"USD": 1.0565}}, e.g.
+// Frankfurter's reference rates of the ECB, and keeps them for RatesTTL.
+type ExchangeRates struct {
+	url    string
+	client *http.Client
+
+	mu        sync.Mutex
+	rates     Rates
+	fetchedAt time.Time
+}
+
+// NewExchangeRates creates ExchangeRates fetched from the URL.
+func NewExchangeRates(url string) *ExchangeRates {
+	return &ExchangeRates{url: url, client: &http.Client{Timeout: RatesTimeout}}
+}
+
+// Rates returns the latest rates. If they cannot be fetched, the previous
+// rates are used until they can, as rates move little in a day.
+func (er *ExchangeRates) Rates(ctx context.Context) (Rates, error) {
+	er.mu.Lock()
+	defer er.mu.Unlock()
+	if !er.fetchedAt.IsZero() && time.Since(er.fetchedAt) < RatesTTL {
+		return er.rates, nil
+	}
+
+	rates, err := er.fetch(ctx)
+	if err != nil {
+		if er.fetchedAt.IsZero() {
+			return Rates{}, err
+		}
+		log.Printf("[WARN] Could not fetch exchange rates, using those of %s: %v\n", er.fetchedAt.Format(time.RFC3339), err)
+		return er.rates, nil
+	}
+	er.rates, er.fetchedAt = rates, time.Now()
+	return rates, nil
+}
+
+func (er *ExchangeRates) fetch(ctx context.Context) (Rates, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", er.url, nil)
+	if err != nil {
+		return Rates{}, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := er.client.Do(req)
+	if err != nil {
+		return Rates{}, fmt.Errorf("could not reach the exchange-rate service: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Rates{}, fmt.Errorf("the exchange-rate service responded with %s", resp.Status)
+	}
+
+	var rates Rates
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&rates); err != nil {
+		return Rates{}, fmt.Errorf("invalid exchange rates: %v", err)
+	}
+	if rates.Base == "" || len(rates.Rates) == 0 {
+		return Rates{}, fmt.Errorf("the exchange rates have no base or rates")
+	}
+	rates.Base = strings.ToUpper(rates.Base)
+	normalized := make(map[string]float64, len(rates.Rates))
+	for code, rate := range rates.Rates {
+		normalized[strings.ToUpper(code)] = rate
+	}
+	rates.Rates = normalized
+	return rates, nil
+}
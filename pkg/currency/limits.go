@@ -0,0 +1,167 @@
+package currency
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Limits bound the amounts of donations in a currency, in its smallest unit.
+// Zero is no bound other than Stripe's.
+type Limits struct {
+	Minimum int64
+	Maximum int64
+}
+
+// AmountError is the error of an amount out of the limits of its currency.
+type AmountError struct {
+	Amount   int64
+	Currency Currency
+}
+
+// TooLarge reports whether the amount is above the maximum rather than below
+// the minimum.
+func (e *AmountError) TooLarge() bool {
+	return e.Currency.MaximumAmount > 0 && e.Amount > e.Currency.MaximumAmount
+}
+
+func (e *AmountError) Error() string {
+	if e.TooLarge() {
+		return "amount must be at most " + Format(e.Currency.MaximumAmount, e.Currency.Code)
+	}
+	return "amount must be at least " + Format(e.Currency.MinimumAmount, e.Currency.Code)
+}
+
+// Check returns an *AmountError if the amount is below the minimum or above
+// the maximum of the currency.
+func (c Currency) Check(amount int64) error {
+	if amount < c.MinimumAmount || c.MaximumAmount > 0 && amount > c.MaximumAmount {
+		return &AmountError{Amount: amount, Currency: c}
+	}
+	return nil
+}
+
+// ParseAmount parses an amount in the unit of the currency, like "12.50" EUR,
+// into its smallest unit, 1250.
+func ParseAmount(s, code string) (int64, error) {
+	c, ok := Lookup(code)
+	if !ok {
+		return 0, fmt.Errorf("unsupported currency %q", code)
+	}
+	whole, fraction := s, ""
+	if i := strings.Index(s, "."); i >= 0 {
+		whole, fraction = s[:i], s[i+1:]
+	}
+	if len(fraction) > c.Decimals || whole == "" && fraction == "" {
+		return 0, fmt.Errorf("invalid %s amount %q", c.Code, s)
+	}
+	digits := whole + fraction + strings.Repeat("0", c.Decimals-len(fraction))
+	amount, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || amount < 0 || strings.ContainsAny(digits, "+-") {
+		return 0, fmt.Errorf("invalid %s amount %q", c.Code, s)
+	}
+	return amount, nil
+}
+
+// ParseLimits parses limits of currencies like "EUR:5-10000,JPY:500-", in the
+// unit of the currency. Either bound may be left out.
+func ParseLimits(s string) (map[string]Limits, error) {
+	limits := make(map[string]Limits)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i, j := strings.Index(entry, ":"), strings.LastIndex(entry, "-")
+		if i < 0 || j < i {
+			return nil, fmt.Errorf("invalid limits %q, must be like EUR:5-10000", entry)
+		}
+		code := strings.ToUpper(entry[:i])
+		l, err := parseLimits(code, entry[i+1:j], entry[j+1:])
+		if err != nil {
+			return nil, err
+		}
+		limits[code] = l
+	}
+	return limits, nil
+}
+
+// LoadLimits reads limits of currencies from a JSON file like
+// {"EUR": {"minimum": 5, "maximum": 10000}}, in the unit of the currency.
+func LoadLimits(path string) (map[string]Limits, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file map[string]struct {
+		Minimum json.Number `json:"minimum"`
+		Maximum json.Number `json:"maximum"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid limits file %s: %w", path, err)
+	}
+	limits := make(map[string]Limits, len(file))
+	for code, bounds := range file {
+		code = strings.ToUpper(code)
+		l, err := parseLimits(code, bounds.Minimum.String(), bounds.Maximum.String())
+		if err != nil {
+			return nil, fmt.Errorf("invalid limits file %s: %w", path, err)
+		}
+		limits[code] = l
+	}
+	return limits, nil
+}
+
+func parseLimits(code, minimum, maximum string) (Limits, error) {
+	var l Limits
+	var err error
+	if minimum != "" {
+		if l.Minimum, err = ParseAmount(minimum, code); err != nil {
+			return l, err
+		}
+	}
+	if maximum != "" {
+		if l.Maximum, err = ParseAmount(maximum, code); err != nil {
+			return l, err
+		}
+	}
+	if l.Maximum > 0 && l.Maximum < l.Minimum {
+		return l, fmt.Errorf("the maximum %s amount is below the minimum", code)
+	}
+	return l, nil
+}
+
+// ApplyLimits returns the currencies with the minimum and maximum amounts of
+// their limits. Limits of other currencies and minimums below Stripe's are
+// errors.
+func ApplyLimits(list []Currency, limits map[string]Limits) ([]Currency, error) {
+	applied := append([]Currency(nil), list...)
+	for code, l := range limits {
+		found := false
+		for i := range applied {
+			c := &applied[i]
+			if c.Code != code {
+				continue
+			}
+			found = true
+			if l.Minimum > 0 && l.Minimum < c.MinimumAmount {
+				return nil, fmt.Errorf("the minimum %s is below Stripe's minimum %s",
+					Format(l.Minimum, code), Format(c.MinimumAmount, code))
+			}
+			if l.Minimum > 0 {
+				c.MinimumAmount = l.Minimum
+			}
+			if l.Maximum > 0 && l.Maximum < c.MinimumAmount {
+				return nil, fmt.Errorf("the maximum %s is below the minimum %s",
+					Format(l.Maximum, code), Format(c.MinimumAmount, code))
+			}
+			c.MaximumAmount = l.Maximum
+		}
+		if !found {
+			return nil, fmt.Errorf("limits of %s, which donations are not taken in", code)
+		}
+	}
+	return applied, nil
+}
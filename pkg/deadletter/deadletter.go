@@ -0,0 +1,144 @@
+// Package deadletter keeps the notifications that could not be delivered in
+// a durable sink, a file, a topic or a database table, besides the store the
+// admin API lists and redrives them from, so the webhook can acknowledge
+// Stripe events whose notifications failed without losing them.
+package deadletter
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/vedrankolka/donation-server/pkg/store"
+)
+
+// Sink keeps dead letters durably.
+type Sink interface {
+	// Save saves the dead letter, replacing an earlier version of it.
+	Save(ctx context.Context, dl *store.DeadLetter) error
+	Close() error
+}
+
+// Loader is a Sink the pending dead letters can be loaded from.
+type Loader interface {
+	// Load returns the pending dead letters, oldest first.
+	Load(ctx context.Context) ([]*store.DeadLetter, error)
+}
+
+// Store is a DeadLetterStore saving every change of its dead letters to a
+// sink too.
+type Store struct {
+	store.DeadLetterStore
+	sink Sink
+}
+
+// NewStore creates a Store of the dead letters of deadLetters, saved to the sink.
+func NewStore(deadLetters store.DeadLetterStore, sink Sink) *Store {
+	return &Store{DeadLetterStore: deadLetters, sink: sink}
+}
+
+// Restore adds the pending dead letters of the sink to the store, if it is a
+// Loader, and returns how many there were.
+func (s *Store) Restore(ctx context.Context) (int, error) {
+	loader, ok := s.sink.(Loader)
+	if !ok {
+		return 0, nil
+	}
+	pending, err := loader.Load(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, dl := range pending {
+		if err := s.DeadLetterStore.AddDeadLetter(ctx, dl); err != nil {
+			return 0, err
+		}
+	}
+	return len(pending), nil
+}
+
+// AddDeadLetter adds the dead letter to the store and saves it to the sink.
+// It fails if the sink failed, as the dead letter is then not durable.
+func (s *Store) AddDeadLetter(ctx context.Context, dl *store.DeadLetter) error {
+	if err := s.DeadLetterStore.AddDeadLetter(ctx, dl); err != nil {
+		return err
+	}
+	return s.save(ctx, dl.ID)
+}
+
+// SetDeadLetterStatus changes the status in the store and saves it to the sink.
+func (s *Store) SetDeadLetterStatus(ctx context.Context, id, status string) error {
+	if err := s.DeadLetterStore.SetDeadLetterStatus(ctx, id, status); err != nil {
+		return err
+	}
+	return s.save(ctx, id)
+}
+
+func (s *Store) save(ctx context.Context, id string) error {
+	dl, err := s.DeadLetterStore.GetDeadLetter(ctx, id)
+	if err != nil {
+		return err
+	}
+	return s.sink.Save(ctx, dl)
+}
+
+func (s *Store) Close() error {
+	return s.sink.Close()
+}
+
+// MessageWriter writes keyed messages, e.g. a kafka.TopicWriter.
+type MessageWriter interface {
+	WriteMessage(ctx context.Context, key string, value []byte) error
+	Close() error
+}
+
+// TopicSink writes every version of the dead letters as JSON to a topic,
+// keyed by their ID, so a compacted topic keeps the latest. It is not a
+// Loader, consumers of the topic replay the dead letters after a restart.
+type TopicSink struct {
+	writer MessageWriter
+}
+
+// NewTopicSink creates a TopicSink writing with the writer.
+func NewTopicSink(writer MessageWriter) *TopicSink {
+	return &TopicSink{writer: writer}
+}
+
+func (ts *TopicSink) Save(ctx context.Context, dl *store.DeadLetter) error {
+	data, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	return ts.writer.WriteMessage(ctx, dl.ID, data)
+}
+
+func (ts *TopicSink) Close() error {
+	return ts.writer.Close()
+}
+
+// Table keeps dead letters in a database table, e.g. a store.PostgresStore.
+type Table interface {
+	SaveDeadLetter(ctx context.Context, dl *store.DeadLetter) error
+	LoadDeadLetters(ctx context.Context, status string) ([]*store.DeadLetter, error)
+}
+
+// TableSink saves dead letters to a table.
+type TableSink struct {
+	table Table
+}
+
+// NewTableSink creates a TableSink of the table. Closing it leaves the table
+// open, it is closed with its store.
+func NewTableSink(table Table) *TableSink {
+	return &TableSink{table: table}
+}
+
+func (ts *TableSink) Save(ctx context.Context, dl *store.DeadLetter) error {
+	return ts.table.SaveDeadLetter(ctx, dl)
+}
+
+func (ts *TableSink) Load(ctx context.Context) ([]*store.DeadLetter, error) {
+	return ts.table.LoadDeadLetters(ctx, store.DeadLetterPending)
+}
+
+func (ts *TableSink) Close() error {
+	return nil
+}
@@ -0,0 +1,62 @@
+package deadletter
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/store"
+)
+
+func TestFileSinkRestore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	sink, err := OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewStore(store.NewMemoryStore(), sink)
+	failed := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i, id := range []string{"evt_2/donation", "evt_1/donation", "evt_3/donation"} {
+		dl := &store.DeadLetter{ID: id, Type: "donation", Payload: []byte(`{}`), Reason: "timeout", Attempts: 1, FailedAt: failed.Add(-time.Duration(i) * time.Minute)}
+		if err := s.AddDeadLetter(ctx, dl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.SetDeadLetterStatus(ctx, "evt_1/donation", store.DeadLetterDelivered); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A save cut short by a crash.
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"id":"evt_4/donation","ty`)
+	file.Close()
+
+	sink, err = OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	memory := store.NewMemoryStore()
+	restored, err := NewStore(memory, sink).Restore(ctx)
+	if err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if restored != 2 {
+		t.Errorf("%d dead letters were restored, want the 2 pending ones", restored)
+	}
+	if dl, err := memory.GetDeadLetter(ctx, "evt_3/donation"); err != nil || dl.Attempts != 1 || dl.Reason != "timeout" {
+		t.Errorf("restored %+v, %v", dl, err)
+	}
+	if _, err := memory.GetDeadLetter(ctx, "evt_1/donation"); err != store.ErrNotFound {
+		t.Errorf("the delivered dead letter was restored: %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package deadletter
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/vedrankolka/donation-server/pkg/store"
+)
+
+// FileSink appends every version of the dead letters to a file as a line of
+// JSON, synced to disk before Save returns. The last line of a dead letter is
+// its latest version.
+type FileSink struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// OpenFile opens the FileSink of the file at the path, creating it if it
+// does not exist.
+func OpenFile(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{path: path, file: file}, nil
+}
+
+func (fs *FileSink) Save(ctx context.Context, dl *store.DeadLetter) error {
+	line, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, err := fs.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return fs.file.Sync()
+}
+
+func (fs *FileSink) Load(ctx context.Context) ([]*store.DeadLetter, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	file, err := os.Open(fs.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	latest := make(map[string]*store.DeadLetter)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+	var torn error
+	for n := 1; scanner.Scan(); n++ {
+		if torn != nil {
+			return nil, torn
+		}
+		var dl store.DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &dl); err != nil {
+			// Only the last line can be cut short by a crash, its save
+			// failed and the webhook was not acknowledged.
+			torn = fmt.Errorf("%s:%d: %v", fs.path, n, err)
+			continue
+		}
+		latest[dl.ID] = &dl
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var pending []*store.DeadLetter
+	for _, dl := range latest {
+		if dl.Status == store.DeadLetterPending {
+			pending = append(pending, dl)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		if !pending[i].FailedAt.Equal(pending[j].FailedAt) {
+			return pending[i].FailedAt.Before(pending[j].FailedAt)
+		}
+		return pending[i].ID < pending[j].ID
+	})
+	return pending, nil
+}
+
+func (fs *FileSink) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.file.Close()
+}
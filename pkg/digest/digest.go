@@ -0,0 +1,230 @@
+// Package digest sums up the donations of a day, e.g. to post "how did we do
+// yesterday" to a chat channel every morning.
+package digest
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/clock"
+	"github.com/vedrankolka/donation-server/pkg/currency"
+	"github.com/vedrankolka/donation-server/pkg/jobs"
+	"github.com/vedrankolka/donation-server/pkg/listing"
+	"github.com/vedrankolka/donation-server/pkg/store"
+)
+
+// Campaign sums up the donations of a campaign.
+type Campaign struct {
+	Name      string `json:"name"`
+	Donations int    `json:"donations"`
+	// Totals are the donated amounts by currency.
+	Totals map[string]int64 `json:"totals"`
+}
+
+// Digest sums up the donations of a day.
+type Digest struct {
+	Day       string `json:"day"`
+	Donations int    `json:"donations"`
+	// Totals are the donated amounts by currency.
+	Totals map[string]int64 `json:"totals"`
+	// Held is the number of donations held for review, not included above.
+	Held int `json:"held"`
+	// TopCampaign has the most donations, nil if no donation was for a campaign.
+	TopCampaign *Campaign `json:"topCampaign"`
+	// NewDonors donated for the first time, ReturningDonors donated before
+	// and NewRepeatDonors donated for the second time ever.
+	NewDonors       int `json:"newDonors"`
+	ReturningDonors int `json:"returningDonors"`
+	NewRepeatDonors int `json:"newRepeatDonors"`
+}
+
+// Day returns the UTC day before t, the one digested in the morning.
+func Day(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day()-1, 0, 0, 0, 0, time.UTC)
+}
+
+// Generate sums up the donations created on the UTC day.
+func Generate(ctx context.Context, donations store.DonationStore, customers store.CustomerStore, day time.Time) (*Digest, error) {
+	from, to := day, day.AddDate(0, 0, 1)
+	d := &Digest{
+		Day:    day.Format("2006-01-02"),
+		Totals: make(map[string]int64),
+	}
+
+	campaigns := make(map[string]*Campaign)
+	donors := make(map[string]bool)
+	err := each(ctx, store.DonationListSpec, from, to, func(q listing.Query) (string, error) {
+		page, next, err := donations.ListDonations(ctx, q)
+		for _, donation := range page {
+			if donation.Status == store.StatusHeld {
+				d.Held++
+				continue
+			}
+			if donation.Status == store.StatusRefunded {
+				continue
+			}
+			d.Donations++
+			d.Totals[donation.Currency] += donation.Amount
+			donors[donation.CustomerID] = true
+			if donation.Campaign == "" {
+				continue
+			}
+			c, ok := campaigns[donation.Campaign]
+			if !ok {
+				c = &Campaign{Name: donation.Campaign, Totals: make(map[string]int64)}
+				campaigns[donation.Campaign] = c
+			}
+			c.Donations++
+			c.Totals[donation.Currency] += donation.Amount
+		}
+		return next, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range campaigns {
+		if d.TopCampaign == nil || c.Donations > d.TopCampaign.Donations ||
+			c.Donations == d.TopCampaign.Donations && c.Name < d.TopCampaign.Name {
+			d.TopCampaign = c
+		}
+	}
+
+	// Donors are summed up from their donations before the day.
+	before := make(map[string]int)
+	err = each(ctx, store.CustomerListSpec, time.Time{}, from, func(q listing.Query) (string, error) {
+		page, next, err := customers.ListCustomers(ctx, q)
+		for _, c := range page {
+			before[c.ID] = c.Donations
+		}
+		return next, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for donor := range donors {
+		switch before[donor] {
+		case 0:
+			d.NewDonors++
+		case 1:
+			d.NewRepeatDonors++
+			d.ReturningDonors++
+		default:
+			d.ReturningDonors++
+		}
+	}
+
+	return d, nil
+}
+
+// each calls list with the query of every page of the spec's records created
+// in [from, to), from the start of time if from is zero.
+func each(ctx context.Context, spec listing.Spec, from, to time.Time, list func(q listing.Query) (string, error)) error {
+	q, err := spec.Parse(url.Values{})
+	if err != nil {
+		return err
+	}
+	q.Limit = listing.MaxLimit
+	q.Filter.CreatedGTE = from
+	q.Filter.CreatedLTE = to.Add(-time.Nanosecond)
+
+	for {
+		next, err := list(q)
+		if err != nil || next == "" {
+			return err
+		}
+		if q.Cursor, err = listing.DecodeCursor(next); err != nil {
+			return err
+		}
+	}
+}
+
+// Text formats the digest as a chat message.
+func (d *Digest) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Donations on %s: %d", d.Day, d.Donations)
+	if len(d.Totals) > 0 {
+		fmt.Fprintf(&b, " totalling %s", formatTotals(d.Totals))
+	}
+	b.WriteString(".\n")
+	if d.TopCampaign != nil {
+		fmt.Fprintf(&b, "Top campaign: %s with %d donations (%s).\n", d.TopCampaign.Name, d.TopCampaign.Donations, formatTotals(d.TopCampaign.Totals))
+	}
+	fmt.Fprintf(&b, "Donors: %d new, %d returning, of them %d donating for the second time.\n", d.NewDonors, d.ReturningDonors, d.NewRepeatDonors)
+	if d.Held > 0 {
+		fmt.Fprintf(&b, "%d donations are held for review.\n", d.Held)
+	}
+	return b.String()
+}
+
+// formatTotals formats amounts in the smallest currency unit like "12.50 EUR, 3.00 USD".
+func formatTotals(totals map[string]int64) string {
+	currencies := make([]string, 0, len(totals))
+	for code := range totals {
+		currencies = append(currencies, code)
+	}
+	sort.Strings(currencies)
+
+	parts := make([]string, len(currencies))
+	for i, code := range currencies {
+		amount := totals[code]
+		parts[i] = currency.Format(amount, code)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Sender posts the text of a digest, e.g. sla.WebhookAlerter to Slack.
+type Sender interface {
+	Alert(ctx context.Context, message string) error
+}
+
+// Scheduler sends the digest of the previous day on a schedule, usually
+// every day at a time.
+type Scheduler struct {
+	donations store.DonationStore
+	customers store.CustomerStore
+	sender    Sender
+	schedule  clock.Schedule
+}
+
+// NewScheduler creates a Scheduler sending the digest with the sender at the
+// times of the schedule, e.g. clock.Daily(7*time.Hour).
+func NewScheduler(donations store.DonationStore, customers store.CustomerStore, sender Sender, schedule clock.Schedule) *Scheduler {
+	return &Scheduler{
+		donations: donations,
+		customers: customers,
+		sender:    sender,
+		schedule:  schedule,
+	}
+}
+
+// NextRun returns when the digest is sent next after t.
+func (s *Scheduler) NextRun(t time.Time) time.Time {
+	return s.schedule.Next(t)
+}
+
+// Job returns the job sending the digest of the day of its scheduled time,
+// to run with a jobs.Scheduler.
+func (s *Scheduler) Job() jobs.Job {
+	return jobs.Job{
+		Name:     "digest",
+		Schedule: s.schedule,
+		Run: func(ctx context.Context, due time.Time) error {
+			return s.Send(ctx, Day(due))
+		},
+	}
+}
+
+// Send generates and sends the digest of the day.
+func (s *Scheduler) Send(ctx context.Context, day time.Time) error {
+	d, err := Generate(ctx, s.donations, s.customers, day)
+	if err != nil {
+		return err
+	}
+	return s.sender.Alert(ctx, d.Text())
+}
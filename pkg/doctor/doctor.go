@@ -0,0 +1,187 @@
+// Package doctor validates the configuration of the server end to end before
+// it goes live, printing a pass/fail report of its checks.
+package doctor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/charge"
+	"github.com/stripe/stripe-go/v76/customer"
+	"github.com/stripe/stripe-go/v76/paymentintent"
+	"github.com/stripe/stripe-go/v76/webhookendpoint"
+)
+
+// Timeout is how long a check may take.
+const Timeout = 10 * time.Second
+
+// Check is one step of the report.
+type Check struct {
+	Name string
+	// Run returns nil if the check passed, or an error created with Skip if
+	// it does not apply to the configuration.
+	Run func(ctx context.Context) error
+}
+
+// Checker is implemented by notifiers that can check their configuration
+// without sending anything.
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+type skipped string
+
+func (s skipped) Error() string { return string(s) }
+
+// Skip returns the error of a check that does not apply, with the reason.
+func Skip(reason string) error {
+	return skipped(reason)
+}
+
+// Run runs the checks in order, writing a line per check to w, and reports
+// whether none of them failed.
+func Run(ctx context.Context, w io.Writer, checks []Check) bool {
+	var passed, failed, skips int
+	for _, check := range checks {
+		ctx, cancel := context.WithTimeout(ctx, Timeout)
+		err := check.Run(ctx)
+		cancel()
+
+		var skip skipped
+		switch {
+		case err == nil:
+			passed++
+			fmt.Fprintf(w, "PASS  %s\n", check.Name)
+		case errors.As(err, &skip):
+			skips++
+			fmt.Fprintf(w, "SKIP  %s: %v\n", check.Name, err)
+		default:
+			failed++
+			fmt.Fprintf(w, "FAIL  %s: %v\n", check.Name, err)
+		}
+	}
+
+	fmt.Fprintf(w, "\n%d passed, %d failed, %d skipped\n", passed, failed, skips)
+	return failed == 0
+}
+
+// StripeKey checks the format of the secret key and that it can read the
+// objects the server works with, so restricted keys missing a permission
+// are caught. Write permissions are not checked, that would create objects.
+func StripeKey(key string) Check {
+	return Check{Name: "Stripe secret key", Run: func(ctx context.Context) error {
+		if key == "" {
+			return fmt.Errorf("STRIPE_SECRET_KEY is not set")
+		}
+		if !hasPrefix(key, "sk_live_", "sk_test_", "rk_live_", "rk_test_") {
+			return fmt.Errorf("STRIPE_SECRET_KEY must start with sk_live_, sk_test_, rk_live_ or rk_test_")
+		}
+
+		list := stripe.ListParams{Limit: stripe.Int64(1)}
+		list.Context = ctx
+		if err := read(paymentintent.List(&stripe.PaymentIntentListParams{ListParams: list})); err != nil {
+			return fmt.Errorf("could not read payment intents: %v", err)
+		}
+		if err := read(customer.List(&stripe.CustomerListParams{ListParams: list})); err != nil {
+			return fmt.Errorf("could not read customers: %v", err)
+		}
+		if err := read(charge.List(&stripe.ChargeListParams{ListParams: list})); err != nil {
+			return fmt.Errorf("could not read charges: %v", err)
+		}
+		return nil
+	}}
+}
+
+// read fetches the first page of a list, returning the error of the request.
+func read(iter interface {
+	Next() bool
+	Err() error
+}) error {
+	iter.Next()
+	return iter.Err()
+}
+
+// StripePublishableKey checks the format of the publishable key.
+func StripePublishableKey(key string) Check {
+	return Check{Name: "Stripe publishable key", Run: func(ctx context.Context) error {
+		if !hasPrefix(key, "pk_live_", "pk_test_") {
+			return fmt.Errorf("STRIPE_PUBLISHABLE_KEY must start with pk_live_ or pk_test_")
+		}
+		return nil
+	}}
+}
+
+// WebhookSecret checks the format of the webhook signing secret.
+func WebhookSecret(secret string) Check {
+	return Check{Name: "Stripe webhook secret", Run: func(ctx context.Context) error {
+		if !hasPrefix(secret, "whsec_") || len(secret) <= len("whsec_") {
+			return fmt.Errorf("STRIPE_WEBHOOK_SECRET must be a signing secret starting with whsec_")
+		}
+		return nil
+	}}
+}
+
+// WebhookEndpoint checks that an enabled webhook endpoint of the Stripe
+// account receives the events the server handles, of the API version the
+// server reads them as.
+func WebhookEndpoint(events ...string) Check {
+	return Check{Name: "Stripe webhook endpoint", Run: func(ctx context.Context) error {
+		params := &stripe.WebhookEndpointListParams{}
+		params.Context = ctx
+		iter := webhookendpoint.List(params)
+		var mismatched *stripe.WebhookEndpoint
+		for iter.Next() {
+			endpoint := iter.WebhookEndpoint()
+			if endpoint.Status != "enabled" || !subscribed(endpoint.EnabledEvents, events) {
+				continue
+			}
+			if endpoint.APIVersion == stripe.APIVersion {
+				return nil
+			}
+			mismatched = endpoint
+		}
+		if err := iter.Err(); err != nil {
+			return fmt.Errorf("could not list webhook endpoints: %v", err)
+		}
+		if mismatched != nil {
+			version := mismatched.APIVersion
+			if version == "" {
+				version = "the account's default"
+			}
+			return fmt.Errorf("webhook endpoint %s sends events of API version %s, but the server reads %s; create an endpoint with api_version %s",
+				mismatched.URL, version, stripe.APIVersion, stripe.APIVersion)
+		}
+		return fmt.Errorf("no enabled webhook endpoint receives %s", strings.Join(events, ", "))
+	}}
+}
+
+// subscribed reports whether the enabled events include all the events.
+func subscribed(enabled, events []string) bool {
+	for _, event := range events {
+		found := false
+		for _, e := range enabled {
+			if e == "*" || e == event {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func hasPrefix(s string, prefixes ...string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+// Package duplicate detects donations donors likely made twice by accident,
+// e.g. by submitting the donation form again when it seemed stuck, and signs
+// the links donors refund them with themselves.
+//
+// A donation is a likely duplicate of an earlier donation of the same
+// customer, amount and currency made at most Policy.Window before it. The
+// policy also decides which duplicates donors may refund, and for how long.
+package duplicate
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/listing"
+	"github.com/vedrankolka/donation-server/pkg/store"
+)
+
+// EmailKind is the kind of emails offering donors to refund a duplicate.
+const EmailKind = "duplicate"
+
+const (
+	// DefaultWindow is how soon after a donation the same donation is a
+	// likely duplicate by default.
+	DefaultWindow = 10 * time.Minute
+	// DefaultRefundWindow is how long donors can refund a duplicate by default.
+	DefaultRefundWindow = 7 * 24 * time.Hour
+)
+
+// Errors of refund link tokens.
+var (
+	ErrInvalidToken = errors.New("the refund link is invalid")
+	ErrExpiredToken = errors.New("the refund link has expired")
+)
+
+// Policy governs the detection and self-service refunds of duplicates.
+type Policy struct {
+	// Window is how soon after a donation the same donation is a likely duplicate.
+	Window time.Duration
+	// RefundWindow is how long after a duplicate was made the donor can refund
+	// it. Zero disables self-service refunds.
+	RefundWindow time.Duration
+	// MaxRefund is the largest amount, in the smallest currency unit, donors
+	// can refund themselves. Zero allows any amount.
+	MaxRefund int64
+}
+
+// Refundable reports whether the donor can refund the donation at the time:
+// it is a duplicate, not refunded or held, made within the refund window and
+// at most MaxRefund.
+func (p Policy) Refundable(d *store.Donation, now time.Time) bool {
+	return d.DuplicateOf != "" && d.Status == store.StatusSucceeded && p.RefundWindow > 0 &&
+		now.Before(d.CreatedAt.Add(p.RefundWindow)) && (p.MaxRefund == 0 || d.Amount <= p.MaxRefund)
+}
+
+// RefundDeadline returns the time until which the donor can refund the duplicate.
+func (p Policy) RefundDeadline(d *store.Donation) time.Time {
+	return d.CreatedAt.Add(p.RefundWindow)
+}
+
+// Find returns the earliest donation in the store the donation likely
+// duplicates, or nil if there is none. Refunded donations are not duplicated.
+func (p Policy) Find(ctx context.Context, donations store.DonationStore, d *store.Donation) (*store.Donation, error) {
+	if d.CustomerID == "" || p.Window <= 0 {
+		return nil, nil
+	}
+
+	q, err := store.DonationListSpec.Parse(url.Values{"sort": {"created"}})
+	if err != nil {
+		return nil, err
+	}
+	q.Limit = listing.MaxLimit
+	q.Filter.AmountGTE, q.Filter.AmountLTE = &d.Amount, &d.Amount
+	q.Filter.Currency = d.Currency
+	q.Filter.CreatedGTE = d.CreatedAt.Add(-p.Window)
+	q.Filter.CreatedLTE = d.CreatedAt
+
+	for {
+		page, next, err := donations.ListDonations(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		for _, earlier := range page {
+			if earlier.ID != d.ID && earlier.CustomerID == d.CustomerID && earlier.Status != store.StatusRefunded {
+				return earlier, nil
+			}
+		}
+		if next == "" {
+			return nil, nil
+		}
+		if q.Cursor, err = listing.DecodeCursor(next); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Sign returns the token of the refund link of a donation, valid until expires.
+func Sign(secret []byte, donationID string, expires time.Time) string {
+	timestamp := strconv.FormatInt(expires.Unix(), 10)
+	return timestamp + "." + hex.EncodeToString(mac(secret, donationID, timestamp))
+}
+
+// Verify checks that the token was signed for the donation and has not
+// expired at the time.
+func Verify(secret []byte, donationID, token string, now time.Time) error {
+	i := strings.IndexByte(token, '.')
+	if i < 0 {
+		return ErrInvalidToken
+	}
+	timestamp, signature := token[:i], token[i+1:]
+	expires, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidToken
+	}
+	sum, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(sum, mac(secret, donationID, timestamp)) {
+		return ErrInvalidToken
+	}
+	if !now.Before(time.Unix(expires, 0)) {
+		return ErrExpiredToken
+	}
+	return nil
+}
+
+func mac(secret []byte, donationID, timestamp string) []byte {
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte(timestamp + "." + donationID))
+	return m.Sum(nil)
+}
@@ -0,0 +1,237 @@
+// Package errcatalog maps the errors of the payment provider to messages
+// donors understand, in their language, with an action they can take. The
+// provider's own messages are meant for developers, may reveal why a card
+// was declined, e.g. that it was reported stolen, and are only logged.
+package errcatalog
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vedrankolka/donation-server/pkg/payments"
+)
+
+// DefaultLanguage is the language of donors who accept none of the catalog,
+// which must have a message of every code in it.
+const DefaultLanguage = "en"
+
+// Codes of the catalog.
+const (
+	// CodeCardDeclined is a card declined for a reason donors are not told,
+	// or without one.
+	CodeCardDeclined         = "card_declined"
+	CodeInsufficientFunds    = "insufficient_funds"
+	CodeExpiredCard          = "expired_card"
+	CodeIncorrectCVC         = "incorrect_cvc"
+	CodeIncorrectNumber      = "incorrect_number"
+	CodeAuthenticationNeeded = "authentication_required"
+	CodeProcessingError      = "processing_error"
+	CodeAmountTooSmall       = payments.ErrorCodeAmountTooSmall
+	CodeAmountTooLarge       = payments.ErrorCodeAmountTooLarge
+	CodeInvalidRequest       = "invalid_request"
+	CodePaymentUnavailable   = "payment_unavailable"
+)
+
+// aliases are the catalog codes of the error and decline codes of the
+// provider with another one. Declines for fraud, lost or stolen cards and the
+// like are deliberately generic, as Stripe recommends.
+var aliases = map[string]string{
+	"generic_decline":                       CodeCardDeclined,
+	"do_not_honor":                          CodeCardDeclined,
+	"fraudulent":                            CodeCardDeclined,
+	"lost_card":                             CodeCardDeclined,
+	"stolen_card":                           CodeCardDeclined,
+	"pickup_card":                           CodeCardDeclined,
+	"restricted_card":                       CodeCardDeclined,
+	"merchant_blacklist":                    CodeCardDeclined,
+	"security_violation":                    CodeCardDeclined,
+	"card_velocity_exceeded":                CodeInsufficientFunds,
+	"withdrawal_count_limit_exceeded":       CodeInsufficientFunds,
+	"invalid_cvc":                           CodeIncorrectCVC,
+	"invalid_number":                        CodeIncorrectNumber,
+	"invalid_expiry_month":                  CodeExpiredCard,
+	"invalid_expiry_year":                   CodeExpiredCard,
+	"authentication_not_handled":            CodeAuthenticationNeeded,
+	"payment_intent_authentication_failure": CodeAuthenticationNeeded,
+	"try_again_later":                       CodeProcessingError,
+	"issuer_not_available":                  CodeProcessingError,
+	"rate_limit":                            CodePaymentUnavailable,
+}
+
+// Message is the message of an error for a donor.
+type Message struct {
+	// Code identifies the error for clients, e.g. "insufficient_funds".
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Action is what the donor can do about it, if anything.
+	Action string `json:"action,omitempty"`
+	// Language of the message and action.
+	Language string `json:"-"`
+}
+
+// entry is a message of a catalog file.
+type entry struct {
+	Message string `json:"message"`
+	Action  string `json:"action,omitempty"`
+}
+
+// Catalog holds the messages of the codes by language.
+type Catalog struct {
+	messages map[string]map[string]entry
+}
+
+// New returns the built-in catalog, in English, German, French, Spanish and
+// Croatian.
+func New() *Catalog {
+	c := &Catalog{messages: make(map[string]map[string]entry, len(defaultMessages))}
+	for lang, messages := range defaultMessages {
+		c.messages[lang] = make(map[string]entry, len(messages))
+		for code, e := range messages {
+			c.messages[lang][code] = e
+		}
+	}
+	return c
+}
+
+// Load returns the built-in catalog with the messages of a JSON file like
+// {"de": {"insufficient_funds": {"message": "...", "action": "..."}}},
+// which replace or add to them. A new language may leave codes out, they
+// are answered in DefaultLanguage.
+func Load(path string) (*Catalog, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file map[string]map[string]entry
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid error catalog %s: %w", path, err)
+	}
+	c := New()
+	for lang, messages := range file {
+		lang = strings.ToLower(lang)
+		if _, ok := c.messages[lang]; !ok {
+			c.messages[lang] = make(map[string]entry, len(messages))
+		}
+		for code, e := range messages {
+			if _, ok := defaultMessages[DefaultLanguage][code]; !ok {
+				return nil, fmt.Errorf("invalid error catalog %s: unknown code %q, it must be one of %s", path, code, strings.Join(Codes(), ", "))
+			}
+			if e.Message == "" {
+				return nil, fmt.Errorf("invalid error catalog %s: %s %s has no message", path, lang, code)
+			}
+			c.messages[lang][code] = e
+		}
+	}
+	return c, nil
+}
+
+// Codes returns the codes of the catalog, sorted.
+func Codes() []string {
+	codes := make([]string, 0, len(defaultMessages[DefaultLanguage]))
+	for code := range defaultMessages[DefaultLanguage] {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// Languages returns the languages of the catalog, sorted.
+func (c *Catalog) Languages() []string {
+	langs := make([]string, 0, len(c.messages))
+	for lang := range c.messages {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// Lookup returns the message of the code in the language of an
+// Accept-Language header the catalog has it in, or DefaultLanguage. Unknown
+// codes get the message of CodeInvalidRequest.
+func (c *Catalog) Lookup(code, acceptLanguage string) Message {
+	if _, ok := c.messages[DefaultLanguage][code]; !ok {
+		code = CodeInvalidRequest
+	}
+	lang := DefaultLanguage
+	for _, accepted := range parseAcceptLanguage(acceptLanguage) {
+		if _, ok := c.messages[accepted][code]; ok {
+			lang = accepted
+			break
+		}
+	}
+	e := c.messages[lang][code]
+	return Message{Code: code, Message: e.Message, Action: e.Action, Language: lang}
+}
+
+// ProviderError returns the message of an error of the payment provider.
+func (c *Catalog) ProviderError(err *payments.Error, acceptLanguage string) Message {
+	return c.Lookup(Code(err), acceptLanguage)
+}
+
+// Code returns the catalog code of an error of the payment provider, by its
+// decline code, its code and then its type.
+func Code(err *payments.Error) string {
+	for _, code := range []string{err.DeclineCode, err.Code} {
+		if code == "" {
+			continue
+		}
+		if alias, ok := aliases[code]; ok {
+			return alias
+		}
+		if _, ok := defaultMessages[DefaultLanguage][code]; ok {
+			return code
+		}
+	}
+	switch err.Type {
+	case payments.ErrorTypeCard:
+		return CodeCardDeclined
+	case payments.ErrorTypeAPI:
+		return CodePaymentUnavailable
+	}
+	return CodeInvalidRequest
+}
+
+// parseAcceptLanguage returns the languages of an Accept-Language header
+// like "de-AT,de;q=0.9,en;q=0.5" by preference, lower case and without
+// their region, which is also tried after the full tag.
+func parseAcceptLanguage(header string) []string {
+	type weighted struct {
+		lang string
+		q    float64
+	}
+	var accepted []weighted
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		lang := strings.ToLower(strings.TrimSpace(fields[0]))
+		if lang == "" || lang == "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[len("q="):], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+		accepted = append(accepted, weighted{lang, q})
+	}
+	sort.SliceStable(accepted, func(i, j int) bool { return accepted[i].q > accepted[j].q })
+
+	langs := make([]string, 0, 2*len(accepted))
+	for _, a := range accepted {
+		langs = append(langs, a.lang)
+		if i := strings.IndexAny(a.lang, "-_"); i > 0 {
+			langs = append(langs, a.lang[:i])
+		}
+	}
+	return langs
+}
@@ -0,0 +1,84 @@
+package errcatalog
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vedrankolka/donation-server/pkg/payments"
+)
+
+func TestCode(t *testing.T) {
+	for _, test := range []struct {
+		err  payments.Error
+		want string
+	}{
+		{payments.Error{Type: payments.ErrorTypeCard, Code: "card_declined", DeclineCode: "insufficient_funds"}, CodeInsufficientFunds},
+		{payments.Error{Type: payments.ErrorTypeCard, Code: "card_declined", DeclineCode: "stolen_card"}, CodeCardDeclined},
+		{payments.Error{Type: payments.ErrorTypeCard, Code: "incorrect_cvc"}, CodeIncorrectCVC},
+		{payments.Error{Type: payments.ErrorTypeCard, Code: "something_new"}, CodeCardDeclined},
+		{payments.Error{Type: payments.ErrorTypeInvalidRequest, Code: payments.ErrorCodeAmountTooSmall}, CodeAmountTooSmall},
+		{payments.Error{Type: payments.ErrorTypeInvalidRequest, Code: "parameter_unknown"}, CodeInvalidRequest},
+		{payments.Error{Type: payments.ErrorTypeAPI}, CodePaymentUnavailable},
+	} {
+		if got := Code(&test.err); got != test.want {
+			t.Errorf("Code(%+v) = %s, want %s", test.err, got, test.want)
+		}
+	}
+}
+
+func TestDefaultMessages(t *testing.T) {
+	for lang, messages := range defaultMessages {
+		for _, code := range Codes() {
+			if e := messages[code]; e.Message == "" || e.Action == "" {
+				t.Errorf("%s has no message or action of %s", lang, code)
+			}
+		}
+		if len(messages) != len(Codes()) {
+			t.Errorf("%s has %d messages, want %d", lang, len(messages), len(Codes()))
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	c := New()
+	for header, want := range map[string]string{
+		"":                        "en",
+		"de-AT,de;q=0.9,en;q=0.5": "de",
+		"it,fr;q=0.8":             "fr",
+		"en;q=0.1,hr;q=0.9":       "hr",
+		"es;q=0,it":               "en",
+		"pt-BR, *;q=0.5":          "en",
+	} {
+		if got := c.Lookup(CodeExpiredCard, header); got.Language != want || got.Message != defaultMessages[want][CodeExpiredCard].Message {
+			t.Errorf("Lookup(%q) = %+v, want the message in %s", header, got, want)
+		}
+	}
+	if got := c.Lookup("unknown", "de"); got.Code != CodeInvalidRequest {
+		t.Errorf("Lookup of an unknown code = %+v, want %s", got, CodeInvalidRequest)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "catalog.json")
+	if err := os.WriteFile(path, []byte(`{"IT": {"card_declined": {"message": "La carta è stata rifiutata."}}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Lookup(CodeCardDeclined, "it"); got.Language != "it" || got.Message != "La carta è stata rifiutata." {
+		t.Errorf("the added message is %+v", got)
+	}
+	if got := c.Lookup(CodeExpiredCard, "it"); got.Language != DefaultLanguage {
+		t.Errorf("a code missing in the added language is answered in %s", got.Language)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"de": {"card_stolen": {"message": "Gestohlen"}}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Error("Load of an unknown code succeeded, want an error")
+	}
+}
@@ -0,0 +1,70 @@
+package errcatalog
+
+// defaultMessages are the built-in messages, by language and code.
+var defaultMessages = map[string]map[string]entry{
+	"en": {
+		CodeCardDeclined:         {"Your card was declined.", "Please try another card or payment method, or contact your bank."},
+		CodeInsufficientFunds:    {"Your card has insufficient funds or reached its limit.", "Please try a smaller amount or another card."},
+		CodeExpiredCard:          {"Your card has expired.", "Please check the expiry date or use another card."},
+		CodeIncorrectCVC:         {"The security code of your card is incorrect.", "Please check the 3 or 4 digits on your card."},
+		CodeIncorrectNumber:      {"The card number is incorrect.", "Please check the number and try again."},
+		CodeAuthenticationNeeded: {"Your bank could not confirm the payment.", "Please try again and complete the verification of your bank."},
+		CodeProcessingError:      {"Your payment could not be processed.", "Please try again in a moment."},
+		CodeAmountTooSmall:       {"The amount is too small.", "Please choose a larger amount."},
+		CodeAmountTooLarge:       {"The amount is too large.", "Please choose a smaller amount."},
+		CodeInvalidRequest:       {"Your donation could not be started.", "Please check the details and try again."},
+		CodePaymentUnavailable:   {"Payments are temporarily unavailable.", "Please try again in a few minutes."},
+	},
+	"de": {
+		CodeCardDeclined:         {"Ihre Karte wurde abgelehnt.", "Bitte verwenden Sie eine andere Karte oder Zahlungsmethode oder wenden Sie sich an Ihre Bank."},
+		CodeInsufficientFunds:    {"Ihre Karte ist nicht ausreichend gedeckt oder hat ihr Limit erreicht.", "Bitte wählen Sie einen kleineren Betrag oder eine andere Karte."},
+		CodeExpiredCard:          {"Ihre Karte ist abgelaufen.", "Bitte prüfen Sie das Ablaufdatum oder verwenden Sie eine andere Karte."},
+		CodeIncorrectCVC:         {"Der Sicherheitscode Ihrer Karte ist falsch.", "Bitte prüfen Sie die 3 oder 4 Ziffern auf Ihrer Karte."},
+		CodeIncorrectNumber:      {"Die Kartennummer ist falsch.", "Bitte prüfen Sie die Nummer und versuchen Sie es erneut."},
+		CodeAuthenticationNeeded: {"Ihre Bank konnte die Zahlung nicht bestätigen.", "Bitte versuchen Sie es erneut und schließen Sie die Bestätigung Ihrer Bank ab."},
+		CodeProcessingError:      {"Ihre Zahlung konnte nicht verarbeitet werden.", "Bitte versuchen Sie es gleich noch einmal."},
+		CodeAmountTooSmall:       {"Der Betrag ist zu klein.", "Bitte wählen Sie einen größeren Betrag."},
+		CodeAmountTooLarge:       {"Der Betrag ist zu groß.", "Bitte wählen Sie einen kleineren Betrag."},
+		CodeInvalidRequest:       {"Ihre Spende konnte nicht gestartet werden.", "Bitte prüfen Sie Ihre Angaben und versuchen Sie es erneut."},
+		CodePaymentUnavailable:   {"Zahlungen sind vorübergehend nicht möglich.", "Bitte versuchen Sie es in einigen Minuten erneut."},
+	},
+	"fr": {
+		CodeCardDeclined:         {"Votre carte a été refusée.", "Veuillez essayer une autre carte ou un autre moyen de paiement, ou contacter votre banque."},
+		CodeInsufficientFunds:    {"Le solde de votre carte est insuffisant ou son plafond est atteint.", "Veuillez choisir un montant plus petit ou une autre carte."},
+		CodeExpiredCard:          {"Votre carte a expiré.", "Veuillez vérifier la date d'expiration ou utiliser une autre carte."},
+		CodeIncorrectCVC:         {"Le code de sécurité de votre carte est incorrect.", "Veuillez vérifier les 3 ou 4 chiffres figurant sur votre carte."},
+		CodeIncorrectNumber:      {"Le numéro de carte est incorrect.", "Veuillez vérifier le numéro et réessayer."},
+		CodeAuthenticationNeeded: {"Votre banque n'a pas pu confirmer le paiement.", "Veuillez réessayer et terminer la vérification de votre banque."},
+		CodeProcessingError:      {"Votre paiement n'a pas pu être traité.", "Veuillez réessayer dans un instant."},
+		CodeAmountTooSmall:       {"Le montant est trop petit.", "Veuillez choisir un montant plus élevé."},
+		CodeAmountTooLarge:       {"Le montant est trop élevé.", "Veuillez choisir un montant plus petit."},
+		CodeInvalidRequest:       {"Votre don n'a pas pu être initié.", "Veuillez vérifier vos informations et réessayer."},
+		CodePaymentUnavailable:   {"Les paiements sont temporairement indisponibles.", "Veuillez réessayer dans quelques minutes."},
+	},
+	"es": {
+		CodeCardDeclined:         {"Su tarjeta ha sido rechazada.", "Pruebe con otra tarjeta u otro método de pago, o contacte con su banco."},
+		CodeInsufficientFunds:    {"Su tarjeta no tiene fondos suficientes o ha alcanzado su límite.", "Pruebe con un importe menor o con otra tarjeta."},
+		CodeExpiredCard:          {"Su tarjeta ha caducado.", "Compruebe la fecha de caducidad o use otra tarjeta."},
+		CodeIncorrectCVC:         {"El código de seguridad de su tarjeta es incorrecto.", "Compruebe los 3 o 4 dígitos de su tarjeta."},
+		CodeIncorrectNumber:      {"El número de tarjeta es incorrecto.", "Compruebe el número e inténtelo de nuevo."},
+		CodeAuthenticationNeeded: {"Su banco no ha podido confirmar el pago.", "Inténtelo de nuevo y complete la verificación de su banco."},
+		CodeProcessingError:      {"No se ha podido procesar su pago.", "Inténtelo de nuevo en un momento."},
+		CodeAmountTooSmall:       {"El importe es demasiado pequeño.", "Elija un importe mayor."},
+		CodeAmountTooLarge:       {"El importe es demasiado grande.", "Elija un importe menor."},
+		CodeInvalidRequest:       {"No se ha podido iniciar su donación.", "Compruebe los datos e inténtelo de nuevo."},
+		CodePaymentUnavailable:   {"Los pagos no están disponibles temporalmente.", "Inténtelo de nuevo en unos minutos."},
+	},
+	"hr": {
+		CodeCardDeclined:         {"Vaša kartica je odbijena.", "Pokušajte s drugom karticom ili načinom plaćanja ili se obratite svojoj banci."},
+		CodeInsufficientFunds:    {"Na vašoj kartici nema dovoljno sredstava ili je dosegnut limit.", "Pokušajte s manjim iznosom ili drugom karticom."},
+		CodeExpiredCard:          {"Vašoj kartici je istekao rok valjanosti.", "Provjerite datum isteka ili upotrijebite drugu karticu."},
+		CodeIncorrectCVC:         {"Sigurnosni kod vaše kartice nije ispravan.", "Provjerite 3 ili 4 znamenke na svojoj kartici."},
+		CodeIncorrectNumber:      {"Broj kartice nije ispravan.", "Provjerite broj i pokušajte ponovno."},
+		CodeAuthenticationNeeded: {"Vaša banka nije mogla potvrditi plaćanje.", "Pokušajte ponovno i dovršite provjeru svoje banke."},
+		CodeProcessingError:      {"Vaše plaćanje nije moglo biti obrađeno.", "Pokušajte ponovno za trenutak."},
+		CodeAmountTooSmall:       {"Iznos je premalen.", "Odaberite veći iznos."},
+		CodeAmountTooLarge:       {"Iznos je prevelik.", "Odaberite manji iznos."},
+		CodeInvalidRequest:       {"Vaša donacija nije mogla započeti.", "Provjerite podatke i pokušajte ponovno."},
+		CodePaymentUnavailable:   {"Plaćanja trenutno nisu dostupna.", "Pokušajte ponovno za nekoliko minuta."},
+	},
+}
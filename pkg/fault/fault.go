@@ -0,0 +1,180 @@
+// Package fault injects latency and errors into Stripe calls and notifier
+// writes, so the retry and dead-letter paths can be exercised in staging.
+// It must never be enabled in production.
+package fault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/metrics"
+	"github.com/vedrankolka/donation-server/pkg/notifier"
+)
+
+// ErrInjected is the error of injected failures.
+var ErrInjected = errors.New("injected fault")
+
+var injected = metrics.NewCounterVec(
+	"donation_server_injected_faults_total",
+	"Faults injected into Stripe calls and notifier writes, by target and kind (latency or error).",
+	"target", "kind",
+)
+
+// Config sets the faults to inject.
+type Config struct {
+	// Latency is added to the share LatencyRate (0 to 1) of calls.
+	Latency     time.Duration
+	LatencyRate float64
+	// ErrorRate is the share of calls failing with ErrInjected.
+	ErrorRate float64
+}
+
+// ParseConfig parses a config like "latency=2s,latency_rate=0.5,error_rate=0.1".
+// If latency is set without latency_rate, every call is delayed.
+func ParseConfig(s string) (Config, error) {
+	var config Config
+	latencyRate := false
+	for _, field := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			return Config{}, fmt.Errorf("invalid fault %q, expected key=value", field)
+		}
+		var err error
+		switch kv[0] {
+		case "latency":
+			config.Latency, err = time.ParseDuration(kv[1])
+		case "latency_rate":
+			config.LatencyRate, err = parseRate(kv[1])
+			latencyRate = true
+		case "error_rate":
+			config.ErrorRate, err = parseRate(kv[1])
+		default:
+			return Config{}, fmt.Errorf("unknown fault %q", kv[0])
+		}
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid %s: %v", kv[0], err)
+		}
+	}
+	if config.Latency > 0 && !latencyRate {
+		config.LatencyRate = 1
+	}
+	return config, nil
+}
+
+func parseRate(s string) (float64, error) {
+	rate, err := strconv.ParseFloat(s, 64)
+	if err == nil && (rate < 0 || rate > 1) {
+		err = fmt.Errorf("%s is not between 0 and 1", s)
+	}
+	return rate, err
+}
+
+func (c Config) String() string {
+	return fmt.Sprintf("%v latency on %.0f%% and errors on %.0f%% of calls", c.Latency, c.LatencyRate*100, c.ErrorRate*100)
+}
+
+// Injector injects the faults of its config into calls to a target.
+type Injector struct {
+	target string
+	config Config
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// NewInjector creates an Injector of faults into calls to the target, e.g. "stripe".
+func NewInjector(target string, config Config) *Injector {
+	log.Printf("[FAULT] Injecting %s to %s.\n", config, target)
+	return &Injector{
+		target: target,
+		config: config,
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Inject waits the latency and returns ErrInjected, if the dice say so.
+func (in *Injector) Inject(ctx context.Context) error {
+	in.mu.Lock()
+	delay := in.rand.Float64() < in.config.LatencyRate
+	fail := in.rand.Float64() < in.config.ErrorRate
+	in.mu.Unlock()
+
+	if delay && in.config.Latency > 0 {
+		injected.Inc(in.target, "latency")
+		timer := time.NewTimer(in.config.Latency)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if fail {
+		injected.Inc(in.target, "error")
+		return fmt.Errorf("%s: %w", in.target, ErrInjected)
+	}
+	return nil
+}
+
+// Transport injects faults into the requests of an HTTP client, e.g. the
+// one of the Stripe API backend. Failed requests return an error as if the
+// connection failed.
+type Transport struct {
+	Base     http.RoundTripper
+	Injector *Injector
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.Injector.Inject(req.Context()); err != nil {
+		return nil, err
+	}
+	return t.Base.RoundTrip(req)
+}
+
+// Notifier injects faults into the writes of a notifier.
+type Notifier struct {
+	next     notifier.Notifier
+	injector *Injector
+}
+
+// NewNotifier creates a Notifier injecting faults into the writes of next.
+func NewNotifier(next notifier.Notifier, injector *Injector) *Notifier {
+	return &Notifier{next: next, injector: injector}
+}
+
+func (n *Notifier) Notify(ctx context.Context, event notifier.DonationEvent) error {
+	if err := n.injector.Inject(ctx); err != nil {
+		return err
+	}
+	return n.next.Notify(ctx, event)
+}
+
+func (n *Notifier) NotifyRecurring(ctx context.Context, event notifier.RecurringDonationEvent) error {
+	if err := n.injector.Inject(ctx); err != nil {
+		return err
+	}
+	return n.next.NotifyRecurring(ctx, event)
+}
+
+func (n *Notifier) NotifyPayment(ctx context.Context, event notifier.PaymentEvent) error {
+	if err := n.injector.Inject(ctx); err != nil {
+		return err
+	}
+	return n.next.NotifyPayment(ctx, event)
+}
+
+func (n *Notifier) Close() error {
+	return n.next.Close()
+}
+
+func (n *Notifier) Shutdown(ctx context.Context) (notifier.FlushReport, error) {
+	return notifier.Shutdown(ctx, n.next)
+}
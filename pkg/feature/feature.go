@@ -0,0 +1,346 @@
+// Package feature gates risky behaviors behind flags, so they can ship dark
+// and be turned on per environment or for a percentage of requests.
+package feature
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EnvPrefix starts the variables of EnvProvider, e.g. DONATION_SERVER_FEATURE_ROUND_UP.
+const EnvPrefix = "DONATION_SERVER_FEATURE_"
+
+// Flags of the server.
+const (
+	// RoundUp enables the /round-up endpoint.
+	RoundUp = "round-up"
+	// EventSchemaV2 sends donation events of the v2 schema, with the donor's
+	// message and choices, by Stripe event. Events are sent as v1 while it is off.
+	EventSchemaV2 = "event-schema-v2"
+	// AsyncWebhooks queues the notifications of webhooks for the workers of
+	// DONATION_SERVER_ASYNC_WORKERS, by Stripe event. They are sent while
+	// the webhook waits while it is off.
+	AsyncWebhooks = "async-webhooks"
+	// PaymentProviders allows payment providers other than Stripe, checked
+	// when the server starts.
+	PaymentProviders = "payment-providers"
+)
+
+// Defaults are the configurations of the flags no provider configures. Flags
+// missing here are off.
+var Defaults = map[string]Flag{
+	RoundUp:          {Enabled: true},
+	EventSchemaV2:    {Enabled: true},
+	AsyncWebhooks:    {Enabled: true},
+	PaymentProviders: {Enabled: true, Environments: []string{"dev", "test", "staging"}},
+}
+
+// Flag is the configuration of a feature flag.
+type Flag struct {
+	Enabled bool `json:"enabled"`
+	// Environments the flag is on in, every environment if empty.
+	Environments []string `json:"environments,omitempty"`
+	// Percentage of keys (e.g. clients) the flag is on for, all if nil.
+	Percentage *int `json:"percentage,omitempty"`
+}
+
+// On reports whether the flag is on in the environment for the key. The
+// same key always gets the same answer for a percentage.
+func (f Flag) On(name, environment, key string) bool {
+	if !f.Enabled {
+		return false
+	}
+	if len(f.Environments) > 0 && !contains(f.Environments, environment) {
+		return false
+	}
+	if f.Percentage == nil || *f.Percentage >= 100 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name + ":" + key))
+	return int(h.Sum32()%100) < *f.Percentage
+}
+
+// Provider is a source of flag configurations.
+type Provider interface {
+	// Flags returns the flags the provider configures.
+	Flags(ctx context.Context) (map[string]Flag, error)
+}
+
+// Flags evaluates feature flags. The first provider configuring a flag
+// decides its state, flags no provider configures have their default.
+type Flags struct {
+	environment string
+	providers   []Provider
+}
+
+// NewFlags creates Flags of the environment, e.g. "production".
+func NewFlags(environment string, providers ...Provider) *Flags {
+	return &Flags{environment: environment, providers: providers}
+}
+
+// Enabled reports whether the flag is on for the key.
+func (fs *Flags) Enabled(ctx context.Context, name, key string) bool {
+	flag, _ := fs.lookup(ctx, name)
+	return flag.On(name, fs.environment, key)
+}
+
+// lookup returns the configuration of the flag and the name of the provider
+// configuring it, "default" if none does.
+func (fs *Flags) lookup(ctx context.Context, name string) (Flag, string) {
+	for _, provider := range fs.providers {
+		flags, err := provider.Flags(ctx)
+		if err != nil {
+			log.Printf("Could not get %s feature flags: %v\n", sourceOf(provider), err)
+			continue
+		}
+		if flag, ok := flags[name]; ok {
+			return flag, sourceOf(provider)
+		}
+	}
+	return Defaults[name], "default"
+}
+
+// sourceOf returns the name of a provider shown by Handler.
+func sourceOf(provider Provider) string {
+	switch provider.(type) {
+	case EnvProvider:
+		return "env"
+	case *FileProvider:
+		return "file"
+	case *RemoteProvider:
+		return "remote"
+	default:
+		return fmt.Sprintf("%T", provider)
+	}
+}
+
+// Middleware responds with 404 Not Found while the flag is off for the
+// client, as if the endpoint did not exist. key returns the client of a request.
+func (fs *Flags) Middleware(name string, key func(r *http.Request) string) func(next http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if !fs.Enabled(r.Context(), name, key(r)) {
+				http.NotFound(w, r)
+				return
+			}
+			next(w, r)
+		}
+	}
+}
+
+// state is a flag in the response of Handler.
+type state struct {
+	Name string `json:"name"`
+	Flag
+	Source string `json:"source"`
+}
+
+// Handler lists the flags known to the server or configured by a provider,
+// with their configuration and where it comes from.
+func (fs *Flags) Handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	names := make(map[string]bool, len(Defaults))
+	for name := range Defaults {
+		names[name] = true
+	}
+	for _, provider := range fs.providers {
+		flags, _ := provider.Flags(r.Context())
+		for name := range flags {
+			names[name] = true
+		}
+	}
+
+	states := make([]state, 0, len(names))
+	for name := range names {
+		flag, source := fs.lookup(r.Context(), name)
+		states = append(states, state{Name: name, Flag: flag, Source: source})
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Name < states[j].Name })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"environment": fs.environment,
+		"data":        states,
+	})
+}
+
+// EnvProvider configures flags with DONATION_SERVER_FEATURE_<NAME> variables,
+// the name upper-cased with dashes as underscores. The values are "true",
+// "false" or a percentage like "25%".
+type EnvProvider struct{}
+
+func (EnvProvider) Flags(ctx context.Context) (map[string]Flag, error) {
+	flags := make(map[string]Flag)
+	for _, kv := range os.Environ() {
+		i := strings.Index(kv, "=")
+		if i < 0 || !strings.HasPrefix(kv[:i], EnvPrefix) {
+			continue
+		}
+		name := strings.ReplaceAll(strings.ToLower(strings.TrimPrefix(kv[:i], EnvPrefix)), "_", "-")
+		flag, err := ParseFlag(kv[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", kv[:i], err)
+		}
+		flags[name] = flag
+	}
+	return flags, nil
+}
+
+// ParseFlag parses "true", "false" or a percentage like "25%".
+func ParseFlag(s string) (Flag, error) {
+	if p := strings.TrimSuffix(s, "%"); p != s {
+		percentage, err := strconv.Atoi(p)
+		if err != nil || percentage < 0 || percentage > 100 {
+			return Flag{}, fmt.Errorf("invalid percentage %q", s)
+		}
+		return Flag{Enabled: true, Percentage: &percentage}, nil
+	}
+	enabled, err := strconv.ParseBool(s)
+	if err != nil {
+		return Flag{}, fmt.Errorf("must be true, false or a percentage, not %q", s)
+	}
+	return Flag{Enabled: enabled}, nil
+}
+
+// cache keeps the flags of a provider loading them from somewhere slow,
+// reloading them at most every ttl. The flags are loaded while the caller
+// waits only the first time; after that the last flags are served while they
+// are reloaded in the background, and kept if reloading fails.
+type cache struct {
+	ttl  time.Duration
+	load func(ctx context.Context) (map[string]Flag, error)
+
+	mu        sync.Mutex
+	flags     map[string]Flag
+	err       error
+	loadedAt  time.Time
+	reloading bool
+}
+
+func (c *cache) Flags(ctx context.Context) (map[string]Flag, error) {
+	c.mu.Lock()
+	flags, err := c.flags, c.err
+	reload := time.Since(c.loadedAt) >= c.ttl && !c.reloading
+	if reload {
+		c.reloading = true
+	}
+	c.mu.Unlock()
+
+	switch {
+	case flags == nil && reload:
+		return c.reload(ctx)
+	case flags == nil && err == nil:
+		return nil, errors.New("the feature flags are being loaded")
+	case flags == nil:
+		return nil, err
+	case reload:
+		go c.reload(context.Background())
+	}
+	return flags, nil
+}
+
+// reload loads the flags, without holding the lock, and keeps them.
+func (c *cache) reload(ctx context.Context) (map[string]Flag, error) {
+	flags, err := c.load(ctx)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Retry after the ttl too, rather than on every evaluation.
+	c.loadedAt, c.reloading = time.Now(), false
+	if err != nil {
+		if c.flags != nil {
+			log.Printf("[WARN] Could not reload feature flags, keeping the last ones: %v\n", err)
+			return c.flags, nil
+		}
+		c.err = err
+		return nil, err
+	}
+	c.flags, c.err = flags, nil
+	return flags, nil
+}
+
+// FileProvider configures flags with a JSON file of flags by name, e.g.
+// {"round-up": {"enabled": true, "environments": ["staging"], "percentage": 10}}.
+// Changes of the file apply within FileReloadInterval.
+type FileProvider struct {
+	cache
+}
+
+// FileReloadInterval is how often FileProvider reads its file.
+const FileReloadInterval = 10 * time.Second
+
+// NewFileProvider creates a FileProvider of the file, checking that it can be read.
+func NewFileProvider(path string) (*FileProvider, error) {
+	fp := &FileProvider{cache{ttl: FileReloadInterval, load: func(ctx context.Context) (map[string]Flag, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var flags map[string]Flag
+		if err := json.Unmarshal(data, &flags); err != nil {
+			return nil, fmt.Errorf("invalid feature flags file %s: %v", path, err)
+		}
+		return flags, nil
+	}}}
+	if _, err := fp.Flags(context.Background()); err != nil {
+		return nil, err
+	}
+	return fp, nil
+}
+
+// RemoteProvider configures flags with the JSON of a FileProvider fetched
+// from a URL, e.g. of a flag service, every RemoteReloadInterval.
+type RemoteProvider struct {
+	cache
+}
+
+// RemoteReloadInterval is how often RemoteProvider fetches its URL.
+const RemoteReloadInterval = time.Minute
+
+// NewRemoteProvider creates a RemoteProvider fetching the URL with the client.
+func NewRemoteProvider(url string, client *http.Client) *RemoteProvider {
+	return &RemoteProvider{cache{ttl: RemoteReloadInterval, load: func(ctx context.Context) (map[string]Flag, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("feature flags service responded with %s", resp.Status)
+		}
+		var flags map[string]Flag
+		if err := json.NewDecoder(resp.Body).Decode(&flags); err != nil {
+			return nil, fmt.Errorf("invalid feature flags: %v", err)
+		}
+		return flags, nil
+	}}}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,437 @@
+// Package fixtures builds realistic Stripe webhook events, signed like Stripe
+// signs them, for tests of the server and of services consuming its
+// notifications:
+//
+//	payload := fixtures.ChargeSucceeded(fixtures.Amount(2500, "eur"), fixtures.Country("HR"))
+//	req := fixtures.WebhookRequest("/webhook", payload, "whsec_test")
+//
+// Events have the fields of the API version of the server's Stripe library,
+// and random IDs, so every event is a new one unless an ID is set.
+package fixtures
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/webhook"
+	"github.com/vedrankolka/donation-server/pkg/address"
+	"github.com/vedrankolka/donation-server/pkg/payments"
+)
+
+// Charge describes the charge of an event. Options change the defaults of
+// NewCharge, a card donation of 10.00 EUR from a donor in Croatia.
+type Charge struct {
+	ID              string
+	PaymentIntentID string
+	CustomerID      string
+	// Amount in the smallest currency unit.
+	Amount   int64
+	Currency string
+	Name     string
+	Email    string
+	// Address is the billing address, none if nil.
+	Address  *address.Address
+	Metadata map[string]string
+	// Invoice is the invoice the charge pays, of a recurring donation.
+	Invoice string
+	Last4   string
+	Created time.Time
+}
+
+// Option changes a Charge.
+type Option func(*Charge)
+
+// ID sets the ID of the charge, e.g. to redeliver an event.
+func ID(id string) Option {
+	return func(c *Charge) {
+		c.ID = id
+	}
+}
+
+// PaymentIntent sets the ID of the payment intent of the charge.
+func PaymentIntent(id string) Option {
+	return func(c *Charge) {
+		c.PaymentIntentID = id
+	}
+}
+
+// Customer sets the ID of the Stripe customer of the charge, none by default.
+func Customer(id string) Option {
+	return func(c *Charge) {
+		c.CustomerID = id
+	}
+}
+
+// Amount sets the amount, in the smallest unit of the currency.
+func Amount(amount int64, currency string) Option {
+	return func(c *Charge) {
+		c.Amount, c.Currency = amount, currency
+	}
+}
+
+// Donor sets the billing name and email.
+func Donor(name, email string) Option {
+	return func(c *Charge) {
+		c.Name, c.Email = name, email
+	}
+}
+
+// Address sets the billing address, nil removes it.
+func Address(a *address.Address) Option {
+	return func(c *Charge) {
+		c.Address = a
+	}
+}
+
+// Country sets the country of the billing address.
+func Country(country string) Option {
+	return func(c *Charge) {
+		if c.Address == nil {
+			c.Address = &address.Address{}
+		}
+		c.Address.Country = country
+	}
+}
+
+// Metadata sets a metadata value of the charge, e.g. the campaign.
+func Metadata(key, value string) Option {
+	return func(c *Charge) {
+		if c.Metadata == nil {
+			c.Metadata = make(map[string]string)
+		}
+		c.Metadata[key] = value
+	}
+}
+
+// Invoice makes the charge pay an invoice of a recurring donation.
+func Invoice(id string) Option {
+	return func(c *Charge) {
+		c.Invoice = id
+	}
+}
+
+// Created sets when the charge was made, now by default.
+func Created(t time.Time) Option {
+	return func(c *Charge) {
+		c.Created = t
+	}
+}
+
+// NewCharge returns the default charge with the options applied.
+func NewCharge(opts ...Option) *Charge {
+	c := &Charge{
+		ID:              NewID("ch"),
+		PaymentIntentID: NewID("pi"),
+		Amount:          1000,
+		Currency:        "eur",
+		Name:            "Ana Horvat",
+		Email:           "ana.horvat@example.com",
+		Address: &address.Address{
+			Line1:      "Ilica 1",
+			City:       "Zagreb",
+			PostalCode: "10000",
+			Country:    "HR",
+		},
+		Last4:   "4242",
+		Created: time.Now(),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// NewID returns a random ID with the prefix of a Stripe object, e.g. "ch".
+func NewID(prefix string) string {
+	return prefix + "_" + randomHex()
+}
+
+func randomHex() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Object returns the charge as Stripe's charge object.
+func (c *Charge) Object() map[string]interface{} {
+	metadata := map[string]interface{}{}
+	for key, value := range c.Metadata {
+		metadata[key] = value
+	}
+	billingDetails := map[string]interface{}{
+		"name":    nullable(c.Name),
+		"email":   nullable(c.Email),
+		"phone":   nil,
+		"address": nil,
+	}
+	country := interface{}(nil)
+	if a := c.Address; a != nil {
+		billingDetails["address"] = map[string]interface{}{
+			"line1":       nullable(a.Line1),
+			"line2":       nullable(a.Line2),
+			"city":        nullable(a.City),
+			"postal_code": nullable(a.PostalCode),
+			"state":       nullable(a.State),
+			"country":     nullable(a.Country),
+		}
+		country = nullable(a.Country)
+	}
+
+	return map[string]interface{}{
+		"id":                  c.ID,
+		"object":              "charge",
+		"amount":              c.Amount,
+		"amount_captured":     c.Amount,
+		"amount_refunded":     0,
+		"balance_transaction": NewID("txn"),
+		"billing_details":     billingDetails,
+		"captured":            true,
+		"created":             c.Created.Unix(),
+		"currency":            c.Currency,
+		"customer":            nullable(c.CustomerID),
+		"description":         nil,
+		"disputed":            false,
+		"invoice":             nullable(c.Invoice),
+		"livemode":            false,
+		"metadata":            metadata,
+		"outcome": map[string]interface{}{
+			"network_status": "approved_by_network",
+			"risk_level":     "normal",
+			"seller_message": "Payment complete.",
+			"type":           "authorized",
+		},
+		"paid":           true,
+		"payment_intent": nullable(c.PaymentIntentID),
+		"payment_method": NewID("pm"),
+		"payment_method_details": map[string]interface{}{
+			"type": "card",
+			"card": map[string]interface{}{
+				"brand":     "visa",
+				"country":   country,
+				"exp_month": 12,
+				"exp_year":  c.Created.Year() + 3,
+				"funding":   "credit",
+				"last4":     c.Last4,
+				"network":   "visa",
+			},
+		},
+		"receipt_email": nullable(c.Email),
+		"refunded":      false,
+		"refunds": map[string]interface{}{
+			"object":   "list",
+			"data":     []interface{}{},
+			"has_more": false,
+			"url":      "/v1/charges/" + c.ID + "/refunds",
+		},
+		"status": "succeeded",
+	}
+}
+
+// Event returns the payload of a Stripe event of the type about the object.
+func Event(eventType string, object map[string]interface{}) []byte {
+	payload, err := json.Marshal(map[string]interface{}{
+		"id":          NewID("evt"),
+		"object":      "event",
+		"api_version": stripe.APIVersion,
+		"created":     time.Now().Unix(),
+		"data": map[string]interface{}{
+			"object": object,
+		},
+		"livemode":         false,
+		"pending_webhooks": 1,
+		"request": map[string]interface{}{
+			"id":              NewID("req"),
+			"idempotency_key": nil,
+		},
+		"type": eventType,
+	})
+	if err != nil {
+		panic(fmt.Sprintf("fixtures: %v", err))
+	}
+	return payload
+}
+
+// ThinEvent returns the thin payload of an event of an event destination,
+// e.g. ThinEvent("v1.charge.succeeded", "charge", "ch_123"), which references
+// the object instead of holding it.
+func ThinEvent(eventType, objectType, id string) []byte {
+	payload, err := json.Marshal(map[string]interface{}{
+		"id":       NewID("evt"),
+		"object":   "v2.core.event",
+		"type":     eventType,
+		"livemode": false,
+		"created":  time.Now().UTC().Format(time.RFC3339Nano),
+		"related_object": map[string]interface{}{
+			"id":   id,
+			"type": objectType,
+			"url":  "/v1/" + objectType + "s/" + id,
+		},
+		"context": nil,
+	})
+	if err != nil {
+		panic(fmt.Sprintf("fixtures: %v", err))
+	}
+	return payload
+}
+
+// ChargeSucceeded returns a charge.succeeded event.
+func ChargeSucceeded(opts ...Option) []byte {
+	return Event("charge.succeeded", NewCharge(opts...).Object())
+}
+
+// PaymentIntentSucceeded returns a payment_intent.succeeded event of the
+// payment intent of the charge.
+func PaymentIntentSucceeded(opts ...Option) []byte {
+	c := NewCharge(opts...)
+	charge := c.Object()
+	metadata := charge["metadata"]
+	return Event("payment_intent.succeeded", map[string]interface{}{
+		"id":                c.PaymentIntentID,
+		"object":            "payment_intent",
+		"amount":            c.Amount,
+		"amount_capturable": 0,
+		"amount_received":   c.Amount,
+		"capture_method":    "automatic",
+		"charges": map[string]interface{}{
+			"object":   "list",
+			"data":     []interface{}{charge},
+			"has_more": false,
+			"url":      "/v1/charges?payment_intent=" + c.PaymentIntentID,
+		},
+		"client_secret":        c.PaymentIntentID + "_secret_" + randomHex(),
+		"confirmation_method":  "automatic",
+		"created":              c.Created.Unix(),
+		"currency":             c.Currency,
+		"customer":             nullable(c.CustomerID),
+		"invoice":              nullable(c.Invoice),
+		"livemode":             false,
+		"metadata":             metadata,
+		"payment_method":       charge["payment_method"],
+		"payment_method_types": []string{"card"},
+		"receipt_email":        nullable(c.Email),
+		"status":               "succeeded",
+	})
+}
+
+// PaymentFailed returns a payment_intent.payment_failed event of the payment
+// intent of the charge, declined for the decline code, e.g. "insufficient_funds".
+func PaymentFailed(declineCode string, opts ...Option) []byte {
+	c := NewCharge(opts...)
+	charge := c.Object()
+	return Event("payment_intent.payment_failed", map[string]interface{}{
+		"id":                c.PaymentIntentID,
+		"object":            "payment_intent",
+		"amount":            c.Amount,
+		"amount_capturable": 0,
+		"amount_received":   0,
+		"capture_method":    "automatic",
+		"client_secret":     c.PaymentIntentID + "_secret_" + randomHex(),
+		"created":           c.Created.Unix(),
+		"currency":          c.Currency,
+		"customer":          nullable(c.CustomerID),
+		"last_payment_error": map[string]interface{}{
+			"type":         "card_error",
+			"code":         "card_declined",
+			"decline_code": nullable(declineCode),
+			"message":      "Your card was declined.",
+			"payment_method": map[string]interface{}{
+				"id":              charge["payment_method"],
+				"object":          "payment_method",
+				"billing_details": charge["billing_details"],
+				"type":            "card",
+			},
+		},
+		"livemode":             false,
+		"metadata":             charge["metadata"],
+		"payment_method":       nil,
+		"payment_method_types": []string{"card"},
+		"receipt_email":        nil,
+		"status":               "requires_payment_method",
+	})
+}
+
+// ChargeRefunded returns a charge.refunded event of the charge refunded in
+// full, for the reason, e.g. payments.RefundReasonFraudulent, or none.
+func ChargeRefunded(reason string, opts ...Option) []byte {
+	c := NewCharge(opts...)
+	charge := c.Object()
+	refund := map[string]interface{}{
+		"id":                  NewID("re"),
+		"object":              "refund",
+		"amount":              c.Amount,
+		"balance_transaction": NewID("txn"),
+		"charge":              c.ID,
+		"created":             time.Now().Unix(),
+		"currency":            c.Currency,
+		"metadata":            map[string]interface{}{},
+		"payment_intent":      nullable(c.PaymentIntentID),
+		"reason":              nullable(reason),
+		"status":              "succeeded",
+	}
+	charge["amount_refunded"] = c.Amount
+	charge["refunded"] = true
+	charge["refunds"].(map[string]interface{})["data"] = []interface{}{refund}
+	return Event("charge.refunded", charge)
+}
+
+// DisputeCreated returns a charge.dispute.created event of a dispute of the
+// charge, for a reason like "fraudulent" or "product_not_received".
+func DisputeCreated(reason string, opts ...Option) []byte {
+	c := NewCharge(opts...)
+	now := time.Now()
+	return Event("charge.dispute.created", map[string]interface{}{
+		"id":                   NewID("dp"),
+		"object":               "dispute",
+		"amount":               c.Amount,
+		"balance_transactions": []interface{}{},
+		"charge":               c.ID,
+		"created":              now.Unix(),
+		"currency":             c.Currency,
+		"evidence_details": map[string]interface{}{
+			"due_by":           now.Add(7 * 24 * time.Hour).Unix(),
+			"has_evidence":     false,
+			"past_due":         false,
+			"submission_count": 0,
+		},
+		"is_charge_refundable": false,
+		"livemode":             false,
+		"metadata":             map[string]interface{}{},
+		"payment_intent":       nullable(c.PaymentIntentID),
+		"reason":               reason,
+		"status":               "needs_response",
+	})
+}
+
+// Signature returns the Stripe-Signature header of the payload signed at the
+// time with the signing secret of a webhook endpoint.
+func Signature(payload []byte, secret string, at time.Time) string {
+	return fmt.Sprintf("t=%d,v1=%s", at.Unix(), hex.EncodeToString(webhook.ComputeSignature(at, payload, secret)))
+}
+
+// WebhookRequest returns a POST request of the payload to the path, signed
+// now with the secret, like Stripe delivers webhooks.
+func WebhookRequest(path string, payload []byte, secret string) *http.Request {
+	req, err := http.NewRequest("POST", path, bytes.NewReader(payload))
+	if err != nil {
+		panic(fmt.Sprintf("fixtures: %v", err))
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set(payments.SignatureHeader, Signature(payload, secret, time.Now()))
+	return req
+}
+
+// nullable returns nil for empty strings, which Stripe sends as null.
+func nullable(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,270 @@
+// Package funnel measures how many donors drop off on the way from loading
+// the donation page to a succeeded payment, without cookies or third-party
+// trackers. The frontend makes up a random session token when the page
+// loads and sends it with its requests; the server keeps only keyed hashes
+// of the tokens, for a few days, and daily counts of the sessions reaching
+// each step.
+package funnel
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/clock"
+	"github.com/vedrankolka/donation-server/pkg/metrics"
+)
+
+// Steps of the funnel, in order.
+const (
+	// StepConfig is the donation page fetching /config.
+	StepConfig = "config"
+	// StepIntent is the donor choosing an amount and a payment intent being created.
+	StepIntent = "intent"
+	// StepSucceeded is the payment succeeding.
+	StepSucceeded = "succeeded"
+)
+
+// Steps are the steps of the funnel in order.
+var Steps = []string{StepConfig, StepIntent, StepSucceeded}
+
+const (
+	// SessionParam is the query parameter of the session token.
+	SessionParam = "funnel_session"
+	// SessionTTL is how long the steps of a session are linked, long enough
+	// for payment methods that take days to succeed, like SEPA debits.
+	SessionTTL = 7 * 24 * time.Hour
+	// DaysKept is how many days of counts are kept.
+	DaysKept = 90
+)
+
+// sessionPattern matches session tokens, e.g. 32 random hex digits.
+var sessionPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{16,64}$`)
+
+var sessions = metrics.NewCounterVec(
+	"donation_server_funnel_sessions_total",
+	"Anonymous sessions of the donation page reaching each step of the funnel (config, intent or succeeded).",
+	"step",
+)
+
+// Session returns the valid session token of the request, or "" if it has
+// none or the donor opted out of tracking with Global Privacy Control or Do
+// Not Track.
+func Session(r *http.Request) string {
+	if r.Header.Get("Sec-GPC") == "1" || r.Header.Get("DNT") == "1" {
+		return ""
+	}
+	return ValidSession(r.URL.Query().Get(SessionParam))
+}
+
+// ValidSession returns the token if it is a valid session token, or else "".
+func ValidSession(token string) string {
+	if !sessionPattern.MatchString(token) {
+		return ""
+	}
+	return token
+}
+
+// Option configures a Tracker.
+type Option func(*Tracker)
+
+// WithClock makes the tracker use the clock instead of the real one.
+func WithClock(c clock.Clock) Option {
+	return func(t *Tracker) {
+		t.clock = c
+	}
+}
+
+// session is what is kept of a session: the day it started and the steps
+// it reached, as bits of their index in Steps.
+type session struct {
+	day   time.Time
+	steps uint8
+}
+
+// Tracker records the steps sessions reach and counts them by the UTC day
+// the sessions started.
+type Tracker struct {
+	clock clock.Clock
+	// key of the hashes of session tokens, random for every process so the
+	// hashes cannot be linked to the tokens afterwards.
+	key []byte
+
+	mu       sync.Mutex
+	sessions map[[sha256.Size]byte]*session
+	days     map[time.Time]*[3]int
+	// expiredAt is when old sessions and counts were last forgotten.
+	expiredAt time.Time
+}
+
+// NewTracker creates a Tracker.
+func NewTracker(opts ...Option) *Tracker {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic("funnel: " + err.Error())
+	}
+	t := &Tracker{
+		clock:    clock.Real,
+		key:      key,
+		sessions: make(map[[sha256.Size]byte]*session),
+		days:     make(map[time.Time]*[3]int),
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+// Track records that the session reached the step. Reaching a step counts
+// the steps before it too, e.g. a page whose /config came from a cache
+// still fetched it. Payments succeeding in sessions that are not known,
+// e.g. ones started more than SessionTTL ago or before a restart, are not
+// counted, as the day the session started is unknown.
+func (t *Tracker) Track(token, step string) {
+	index := stepIndex(step)
+	if token == "" || index < 0 {
+		return
+	}
+	mac := hmac.New(sha256.New, t.key)
+	mac.Write([]byte(token))
+	var id [sha256.Size]byte
+	copy(id[:], mac.Sum(nil))
+
+	now := t.clock.Now().UTC()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expire(now)
+
+	s, ok := t.sessions[id]
+	if !ok {
+		if index == len(Steps)-1 {
+			return
+		}
+		s = &session{day: day(now)}
+		t.sessions[id] = s
+	}
+	counts, ok := t.days[s.day]
+	if !ok {
+		counts = new([3]int)
+		t.days[s.day] = counts
+	}
+	for i := 0; i <= index; i++ {
+		if s.steps&(1<<i) == 0 {
+			s.steps |= 1 << i
+			counts[i]++
+			sessions.Inc(Steps[i])
+		}
+	}
+}
+
+// expire forgets the sessions older than SessionTTL and the counts older
+// than DaysKept, hourly.
+func (t *Tracker) expire(now time.Time) {
+	if now.Sub(t.expiredAt) < time.Hour {
+		return
+	}
+	t.expiredAt = now
+	for id, s := range t.sessions {
+		if now.Sub(s.day) > SessionTTL+24*time.Hour {
+			delete(t.sessions, id)
+		}
+	}
+	oldest := day(now).AddDate(0, 0, -DaysKept)
+	for d := range t.days {
+		if d.Before(oldest) {
+			delete(t.days, d)
+		}
+	}
+}
+
+// StepReport counts the sessions reaching a step.
+type StepReport struct {
+	Step     string `json:"step"`
+	Sessions int    `json:"sessions"`
+	// Conversion is the share of the sessions of the previous step reaching
+	// this one, and Overall the share of those of the first step. Both are 1
+	// for the first step, or 0 without sessions.
+	Conversion float64 `json:"conversion"`
+	Overall    float64 `json:"overall"`
+}
+
+// DayReport is the funnel of the sessions started on a UTC day.
+type DayReport struct {
+	Day   string       `json:"day"`
+	Steps []StepReport `json:"steps"`
+}
+
+// Report is the funnel of the sessions started in a range of days.
+type Report struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Steps sums up the days.
+	Steps []StepReport `json:"steps"`
+	Days  []DayReport  `json:"days"`
+}
+
+// Report returns the funnel of the sessions started from the UTC day of
+// from to that of to, both included. Days without sessions are left out.
+func (t *Tracker) Report(from, to time.Time) Report {
+	from, to = day(from), day(to)
+	report := Report{From: from.Format("2006-01-02"), To: to.Format("2006-01-02"), Days: []DayReport{}}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var total [3]int
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		counts, ok := t.days[d]
+		if !ok {
+			continue
+		}
+		for i := range total {
+			total[i] += counts[i]
+		}
+		report.Days = append(report.Days, DayReport{Day: d.Format("2006-01-02"), Steps: stepReports(*counts)})
+	}
+	report.Steps = stepReports(total)
+	return report
+}
+
+func stepReports(counts [3]int) []StepReport {
+	reports := make([]StepReport, len(Steps))
+	for i, step := range Steps {
+		previous := counts[0]
+		if i > 0 {
+			previous = counts[i-1]
+		}
+		reports[i] = StepReport{
+			Step:       step,
+			Sessions:   counts[i],
+			Conversion: share(counts[i], previous),
+			Overall:    share(counts[i], counts[0]),
+		}
+	}
+	return reports
+}
+
+func share(part, whole int) float64 {
+	if whole == 0 {
+		return 0
+	}
+	return float64(part) / float64(whole)
+}
+
+func stepIndex(step string) int {
+	for i, s := range Steps {
+		if s == step {
+			return i
+		}
+	}
+	return -1
+}
+
+// day returns the start of the UTC day of t.
+func day(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,62 @@
+package funnel
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/clock"
+)
+
+func TestTracker(t *testing.T) {
+	c := clock.NewFake(time.Date(2024, 3, 1, 23, 0, 0, 0, time.UTC))
+	tracker := NewTracker(WithClock(c))
+	sessions := []string{"aaaaaaaaaaaaaaaa", "bbbbbbbbbbbbbbbb", "cccccccccccccccc", "dddddddddddddddd"}
+	for _, s := range sessions {
+		tracker.Track(s, StepConfig)
+	}
+	tracker.Track(sessions[0], StepConfig)
+	tracker.Track(sessions[0], StepIntent)
+	tracker.Track(sessions[1], StepIntent)
+	// A page whose /config came from a cache.
+	tracker.Track("eeeeeeeeeeeeeeee", StepIntent)
+	// The payment succeeds the next day, it counts for the day of the session.
+	c.Advance(2 * time.Hour)
+	tracker.Track(sessions[0], StepSucceeded)
+	tracker.Track(sessions[0], StepSucceeded)
+	tracker.Track("ffffffffffffffff", StepSucceeded)
+
+	report := tracker.Report(c.Now().AddDate(0, 0, -1), c.Now())
+	if len(report.Days) != 1 || report.Days[0].Day != "2024-03-01" {
+		t.Fatalf("Days = %+v, want only 2024-03-01", report.Days)
+	}
+	want := []StepReport{
+		{Step: StepConfig, Sessions: 5, Conversion: 1, Overall: 1},
+		{Step: StepIntent, Sessions: 3, Conversion: 0.6, Overall: 0.6},
+		{Step: StepSucceeded, Sessions: 1, Conversion: 1.0 / 3, Overall: 0.2},
+	}
+	for i, step := range report.Steps {
+		if step != want[i] {
+			t.Errorf("step %d = %+v, want %+v", i, step, want[i])
+		}
+	}
+}
+
+func TestSession(t *testing.T) {
+	for target, want := range map[string]string{
+		"/config?funnel_session=0123456789abcdef":   "0123456789abcdef",
+		"/config?funnel_session=short":              "",
+		"/config?funnel_session=a@b.example.org-xx": "",
+		"/config": "",
+	} {
+		if got := Session(httptest.NewRequest("GET", target, nil)); got != want {
+			t.Errorf("Session(%s) = %q, want %q", target, got, want)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/config?funnel_session=0123456789abcdef", nil)
+	r.Header.Set("Sec-GPC", "1")
+	if got := Session(r); got != "" {
+		t.Errorf("the session of a request with Global Privacy Control is %q", got)
+	}
+}
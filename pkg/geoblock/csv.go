@@ -0,0 +1,100 @@
+package geoblock
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+type ipRange struct {
+	start   net.IP
+	end     net.IP
+	country string
+}
+
+// CSVResolver resolves countries from a CSV database of IP ranges in the
+// "start_ip,end_ip,country_code" format used by the free DB-IP and IP2Location
+// country databases. Both IPv4 and IPv6 ranges are supported.
+type CSVResolver struct {
+	ranges []ipRange
+}
+
+// LoadCSVResolver reads the CSV database at path.
+func LoadCSVResolver(path string) (*CSVResolver, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return NewCSVResolver(f)
+}
+
+// NewCSVResolver reads a CSV database from r.
+func NewCSVResolver(r io.Reader) (*CSVResolver, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+
+	var ranges []ipRange
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) < 3 {
+			return nil, fmt.Errorf("line %d: expected at least 3 fields, got %d", line, len(record))
+		}
+
+		start := net.ParseIP(strings.TrimSpace(record[0])).To16()
+		end := net.ParseIP(strings.TrimSpace(record[1])).To16()
+		if start == nil || end == nil {
+			// Skip headers and malformed rows.
+			continue
+		}
+
+		ranges = append(ranges, ipRange{
+			start:   start,
+			end:     end,
+			country: strings.ToUpper(strings.TrimSpace(record[2])),
+		})
+	}
+
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].start, ranges[j].start) < 0
+	})
+
+	return &CSVResolver{ranges: ranges}, nil
+}
+
+// Country returns the country of the range containing ip.
+func (cr *CSVResolver) Country(ip net.IP) (string, bool) {
+	ip = ip.To16()
+	if ip == nil {
+		return "", false
+	}
+
+	// Find the last range starting at or before ip.
+	i := sort.Search(len(cr.ranges), func(i int) bool {
+		return bytes.Compare(cr.ranges[i].start, ip) > 0
+	}) - 1
+	if i < 0 || bytes.Compare(ip, cr.ranges[i].end) > 0 {
+		return "", false
+	}
+
+	country := cr.ranges[i].country
+	// "ZZ" and "-" denote unassigned ranges in the common databases.
+	if country == "" || country == "ZZ" || country == "-" {
+		return "", false
+	}
+
+	return country, true
+}
@@ -0,0 +1,233 @@
+package geoblock
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/vedrankolka/donation-server/pkg/clientip"
+	"github.com/vedrankolka/donation-server/pkg/metrics"
+	"github.com/vedrankolka/donation-server/pkg/requestid"
+)
+
+// Reasons reported when a request is blocked.
+const (
+	ReasonBlockedIP       = "blocked_ip"
+	ReasonBlockedCountry  = "blocked_country"
+	ReasonCountryNotAllow = "country_not_allowed"
+	ReasonUnknownCountry  = "unknown_country"
+	ReasonUnknownIP       = "unknown_ip"
+)
+
+var blockedRequests = metrics.NewCounterVec(
+	"donation_server_blocked_requests_total",
+	"Number of requests refused by the IP and country block lists.",
+	"reason", "country",
+)
+
+// CountryResolver maps an IP address to an ISO 3166-1 alpha-2 country code.
+type CountryResolver interface {
+	// Country returns the country code of ip, or false if it is unknown.
+	Country(ip net.IP) (string, bool)
+}
+
+// Config describes which clients are allowed to make requests.
+type Config struct {
+	// AllowedCIDRs are always allowed, regardless of any other rule.
+	AllowedCIDRs []*net.IPNet
+	// BlockedCIDRs are always refused.
+	BlockedCIDRs []*net.IPNet
+	// BlockedCountries are refused.
+	BlockedCountries []string
+	// AllowedCountries, if not empty, are the only countries that are allowed.
+	// Clients whose country cannot be determined are refused in that case.
+	AllowedCountries []string
+	// ClientIPHeader is the header holding the client IP when running behind a proxy.
+	ClientIPHeader clientip.Header
+	// CountryHeader is a header holding the client country set by a CDN (e.g. CF-IPCountry).
+	// It takes precedence over the Resolver.
+	CountryHeader string
+	// Resolver is used to look up the country of the client IP. May be nil.
+	Resolver CountryResolver
+}
+
+// Blocker refuses requests from blocked IP ranges and countries.
+type Blocker struct {
+	config           Config
+	blockedCountries map[string]bool
+	allowedCountries map[string]bool
+}
+
+// NewBlocker creates a Blocker from the given config.
+func NewBlocker(config Config) *Blocker {
+	return &Blocker{
+		config:           config,
+		blockedCountries: countrySet(config.BlockedCountries),
+		allowedCountries: countrySet(config.AllowedCountries),
+	}
+}
+
+// Enabled reports whether the blocker has any rules configured.
+func (b *Blocker) Enabled() bool {
+	return len(b.config.BlockedCIDRs) > 0 || len(b.blockedCountries) > 0 || len(b.allowedCountries) > 0
+}
+
+// Check decides whether a request from ip, optionally with a country already
+// known from a header, is allowed. If not, the reason is returned.
+func (b *Blocker) Check(ip net.IP, country string) (allowed bool, reason string) {
+	if ip == nil {
+		// Without an address only the country rules can be applied.
+		if len(b.config.BlockedCIDRs) > 0 && country == "" {
+			return false, ReasonUnknownIP
+		}
+	} else {
+		if containsIP(b.config.AllowedCIDRs, ip) {
+			return true, ""
+		}
+		if containsIP(b.config.BlockedCIDRs, ip) {
+			return false, ReasonBlockedIP
+		}
+	}
+
+	if len(b.blockedCountries) == 0 && len(b.allowedCountries) == 0 {
+		return true, ""
+	}
+
+	country = strings.ToUpper(country)
+	if country == "" && ip != nil && b.config.Resolver != nil {
+		if c, ok := b.config.Resolver.Country(ip); ok {
+			country = strings.ToUpper(c)
+		}
+	}
+
+	if country == "" {
+		if len(b.allowedCountries) > 0 {
+			return false, ReasonUnknownCountry
+		}
+		return true, ""
+	}
+
+	if b.blockedCountries[country] {
+		return false, ReasonBlockedCountry
+	}
+	if len(b.allowedCountries) > 0 && !b.allowedCountries[country] {
+		return false, ReasonCountryNotAllow
+	}
+
+	return true, ""
+}
+
+// Middleware refuses blocked requests with 403 Forbidden.
+func (b *Blocker) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := clientip.FromRequest(r, b.config.ClientIPHeader)
+
+		var country string
+		if b.config.CountryHeader != "" {
+			country = r.Header.Get(b.config.CountryHeader)
+		}
+
+		if allowed, reason := b.Check(ip, country); !allowed {
+			if country == "" && ip != nil && b.config.Resolver != nil {
+				country, _ = b.config.Resolver.Country(ip)
+			}
+			blockedRequests.Inc(reason, strings.ToUpper(country))
+			requestid.Printf(r.Context(), "Blocked request from %v (country %q): %s\n", ip, country, reason)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// Country returns the country of a request, upper case, from the country
+// header or the resolver, or "" if it is unknown.
+func (b *Blocker) Country(r *http.Request) string {
+	if b.config.CountryHeader != "" {
+		if country := r.Header.Get(b.config.CountryHeader); country != "" {
+			return strings.ToUpper(country)
+		}
+	}
+	if b.config.Resolver == nil {
+		return ""
+	}
+	ip := clientip.FromRequest(r, b.config.ClientIPHeader)
+	if ip == nil {
+		return ""
+	}
+	country, _ := b.config.Resolver.Country(ip)
+	return strings.ToUpper(country)
+}
+
+// ParseCIDRs parses a comma separated list of CIDRs or single IP addresses.
+func ParseCIDRs(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range splitList(list) {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", s, err)
+		}
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+// ParseCountries parses a comma separated list of ISO 3166-1 alpha-2 country codes.
+func ParseCountries(list string) ([]string, error) {
+	var countries []string
+	for _, s := range splitList(list) {
+		if len(s) != 2 {
+			return nil, fmt.Errorf("invalid country code %q", s)
+		}
+		countries = append(countries, strings.ToUpper(s))
+	}
+
+	return countries, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func countrySet(countries []string) map[string]bool {
+	set := make(map[string]bool, len(countries))
+	for _, c := range countries {
+		set[strings.ToUpper(c)] = true
+	}
+
+	return set
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			items = append(items, s)
+		}
+	}
+
+	return items
+}
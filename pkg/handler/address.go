@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/vedrankolka/donation-server/pkg/address"
+	"github.com/vedrankolka/donation-server/pkg/payments"
+)
+
+// Query parameters and metadata keys of the donor address. The metadata is
+// set on the payment intent, which Stripe copies to its charges.
+var addressFields = []struct {
+	param string
+	get   func(a *address.Address) *string
+}{
+	{"address_line1", func(a *address.Address) *string { return &a.Line1 }},
+	{"address_line2", func(a *address.Address) *string { return &a.Line2 }},
+	{"address_city", func(a *address.Address) *string { return &a.City }},
+	{"address_postal_code", func(a *address.Address) *string { return &a.PostalCode }},
+	{"address_state", func(a *address.Address) *string { return &a.State }},
+	{"address_country", func(a *address.Address) *string { return &a.Country }},
+}
+
+// getAddress reads and validates the optional donor address from the
+// address_* query parameters.
+func (dh *DonationHandler) getAddress(r *http.Request) (*address.Address, error) {
+	var a address.Address
+	query := r.URL.Query()
+	for _, f := range addressFields {
+		*f.get(&a) = query.Get(f.param)
+	}
+
+	if a.IsEmpty() {
+		if dh.requireAddress {
+			return nil, &address.ValidationError{Field: "address", Message: "is required"}
+		}
+		return nil, nil
+	}
+
+	validated, err := dh.validator.Validate(r.Context(), a)
+	if err != nil {
+		return nil, err
+	}
+
+	return &validated, nil
+}
+
+func addAddressMetadata(params *payments.IntentParams, a address.Address) {
+	for _, f := range addressFields {
+		if value := *f.get(&a); value != "" {
+			params.AddMetadata(f.param, value)
+		}
+	}
+}
+
+// chargeAddress returns the donor address of the charge in the event: the one
+// entered on the donation form, or else the billing address collected by Stripe.
+func chargeAddress(event *payments.Event) *address.Address {
+	var a address.Address
+	for _, f := range addressFields {
+		*f.get(&a) = event.Charge.Metadata[f.param]
+	}
+
+	if a.IsEmpty() {
+		a = event.Charge.BillingDetails.Address
+	}
+
+	// A country alone (collected by the Payment Element) is not an address.
+	if a.Line1 == "" {
+		return nil
+	}
+
+	return &a
+}
+
+// updateCustomerAddress stores the address on the customer if it differs.
+func (dh *DonationHandler) updateCustomerAddress(ctx context.Context, customer *payments.Customer, a address.Address) error {
+	if current := customer.Address; current.Line1 == a.Line1 && current.Line2 == a.Line2 &&
+		current.City == a.City && current.PostalCode == a.PostalCode && current.State == a.State && current.Country == a.Country {
+		return nil
+	}
+
+	_, err := dh.provider.UpdateCustomer(ctx, customer.ID, &payments.CustomerParams{Address: &a})
+	return err
+}
@@ -0,0 +1,192 @@
+package handler
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/auth"
+	"github.com/vedrankolka/donation-server/pkg/csvsafe"
+	"github.com/vedrankolka/donation-server/pkg/currency"
+	"github.com/vedrankolka/donation-server/pkg/store"
+	"go.uber.org/zap"
+)
+
+const (
+	// maxRecipients is the number of recipients of a bulk request.
+	maxRecipients = 10000
+	// maxRecipientList is the size of the CSV list of a bulk request.
+	maxRecipientList = 5 << 20
+)
+
+// Columns of recipient lists.
+const (
+	recipientEmailColumn = "email"
+	recipientCodeColumn  = "code"
+	recipientURLColumn   = "url"
+)
+
+// bulk creates a link per recipient of the CSV list in the body, which has a
+// header row and an "email" column, for tracked email appeals. The other
+// fields of the links are taken from the query, e.g.
+// ?campaign=spring-appeal&amount=2500&maxUses=1. It responds with the list,
+// adding the "code" and "url" columns, ready for a mail merge.
+func (lh *LinkHandler) bulk(w http.ResponseWriter, r *http.Request) {
+	template, err := linkTemplate(r.URL.Query(), lh.currencies)
+	if err != nil {
+		writeJSONErrorMessage(w, "invalid link: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	header, rows, err := readRecipients(http.MaxBytesReader(w, r.Body, maxRecipientList))
+	if err != nil {
+		writeJSONErrorMessage(w, "invalid recipient list: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	emailColumn := indexOf(header, recipientEmailColumn)
+	createdBy, createdAt := auth.Principal(r.Context()), time.Now().UTC()
+	for i, row := range rows {
+		link := template
+		link.Recipient = strings.TrimSpace(row[emailColumn])
+		link.CreatedBy, link.CreatedAt = createdBy, createdAt
+		if err := lh.insert(r.Context(), &link); err != nil {
+			// The links created so far stay, the admin may delete them by the campaign.
+			requestLogger(r.Context()).Error("Could not create a link of a bulk request", zap.Int("row", i+1), zap.Int("rows", len(rows)), zap.Error(err))
+			writeJSONErrorMessage(w, fmt.Sprintf("Could not create links, %d of %d were created", i, len(rows)), http.StatusInternalServerError)
+			return
+		}
+		rows[i] = append(row, link.Code, lh.response(&link).URL)
+	}
+	requestLogger(r.Context()).Info("Created links for an appeal", zap.String("campaign", template.Campaign), zap.Int("links", len(rows)))
+
+	filename := "links.csv"
+	if template.Campaign != "" {
+		filename = "links-" + strings.Map(func(r rune) rune {
+			if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+				return r
+			}
+			return '-'
+		}, template.Campaign) + ".csv"
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	cw := csv.NewWriter(w)
+	cw.Write(append(header, recipientCodeColumn, recipientURLColumn))
+	for _, row := range rows {
+		// The recipients may come from sign-up forms, they are escaped for spreadsheets.
+		cw.Write(csvsafe.Row(row...))
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		requestLogger(r.Context()).Error("Could not write links", zap.Error(err))
+	}
+}
+
+// insert creates a link, generating its code if it has none, or returns
+// store.ErrExists if its chosen code is taken.
+func (lh *LinkHandler) insert(ctx context.Context, link *store.Link) error {
+	chosen := link.Code != ""
+	var err error
+	// Generated codes are retried in the unlikely case they are taken.
+	for attempt := 0; attempt < 3; attempt++ {
+		if !chosen {
+			if link.Code, err = newLinkCode(); err != nil {
+				return err
+			}
+		}
+		if err = lh.links.CreateLink(ctx, link); !errors.Is(err, store.ErrExists) || chosen {
+			return err
+		}
+	}
+	return err
+}
+
+// linkTemplate returns the link of the query parameters "amount", "currency",
+// "campaign", "locale", "expiresAt" and "maxUses", validated.
+func linkTemplate(query url.Values, currencies []currency.Currency) (store.Link, error) {
+	link := store.Link{
+		Currency: query.Get("currency"),
+		Campaign: query.Get("campaign"),
+		Locale:   query.Get("locale"),
+	}
+	var err error
+	if s := query.Get("amount"); s != "" {
+		if link.Amount, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return link, fmt.Errorf("amount must be a number of cents")
+		}
+	}
+	if s := query.Get("expiresAt"); s != "" {
+		expiresAt, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return link, fmt.Errorf("expiresAt must be a time like 2024-06-01T00:00:00Z")
+		}
+		link.ExpiresAt = &expiresAt
+	}
+	if s := query.Get("maxUses"); s != "" {
+		if link.MaxUses, err = strconv.Atoi(s); err != nil {
+			return link, fmt.Errorf("maxUses must be a number")
+		}
+	}
+	return link, validateLink(&link, currencies)
+}
+
+// readRecipients reads a CSV list of recipients with a header row and an
+// "email" column, checking the emails are valid and unique.
+func readRecipients(body io.Reader) ([]string, [][]string, error) {
+	records, err := csv.NewReader(body).ReadAll()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil, fmt.Errorf("the list is empty")
+	}
+	header, rows := records[0], records[1:]
+	for i := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(header[i]))
+	}
+	emailColumn := indexOf(header, recipientEmailColumn)
+	if emailColumn < 0 {
+		return nil, nil, fmt.Errorf("the header has no %q column", recipientEmailColumn)
+	}
+	if indexOf(header, recipientCodeColumn) >= 0 || indexOf(header, recipientURLColumn) >= 0 {
+		return nil, nil, fmt.Errorf("the %q and %q columns are added to the list", recipientCodeColumn, recipientURLColumn)
+	}
+	if len(rows) == 0 {
+		return nil, nil, fmt.Errorf("the list has no recipients")
+	}
+	if len(rows) > maxRecipients {
+		return nil, nil, fmt.Errorf("the list can have at most %d recipients", maxRecipients)
+	}
+
+	seen := make(map[string]int, len(rows))
+	for i, row := range rows {
+		line := i + 2
+		email := strings.TrimSpace(row[emailColumn])
+		if address, err := mail.ParseAddress(email); err != nil || address.Address != email {
+			return nil, nil, fmt.Errorf("line %d: invalid email %q", line, email)
+		}
+		if first, ok := seen[strings.ToLower(email)]; ok {
+			return nil, nil, fmt.Errorf("line %d: %s is on line %d too", line, email, first)
+		}
+		seen[strings.ToLower(email)] = line
+	}
+	return header, rows, nil
+}
+
+func indexOf(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,320 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/vedrankolka/donation-server/pkg/auth"
+	"github.com/vedrankolka/donation-server/pkg/autorefund"
+	"github.com/vedrankolka/donation-server/pkg/notifier"
+	"github.com/vedrankolka/donation-server/pkg/payments"
+	"github.com/vedrankolka/donation-server/pkg/store"
+	"go.uber.org/zap"
+)
+
+// Decisions of reviews of held donations.
+const (
+	ReviewApprove = "approve"
+	ReviewCancel  = "cancel"
+)
+
+// WithAutoRefunds refunds donations by the rules of the engine: donations
+// from blocked countries when they are made, and donations held for review
+// when reviewers cancel them. All refunds, including those of duplicates,
+// are audited by the engine.
+func WithAutoRefunds(engine *autorefund.Engine) Option {
+	return func(dh *DonationHandler) {
+		dh.autoRefunds = engine
+	}
+}
+
+// holdForReview holds a donation a review rule selects, and reports whether it did.
+func (dh *DonationHandler) holdForReview(ctx context.Context, donation *store.Donation) bool {
+	if dh.autoRefunds == nil || donation.Status != store.StatusSucceeded {
+		return false
+	}
+	rule := dh.autoRefunds.Match(donation, autorefund.KindReview)
+	if rule == nil {
+		return false
+	}
+	donation.Status = store.StatusHeld
+	dh.logger(ctx).Info("Donation is held for review", zap.String("event", "review"),
+		zap.String("donation", donation.ID), zap.String("customer", donation.CustomerID), zap.String("rule", rule.Name))
+	return true
+}
+
+// autoRefund refunds a new donation a country rule selects, and reports
+// whether it did. A failed refund is audited, and the donation is notified
+// as usual until a sweep refunds it.
+func (dh *DonationHandler) autoRefund(ctx context.Context, donation *store.Donation) bool {
+	if dh.autoRefunds == nil || donation.Status != store.StatusSucceeded {
+		return false
+	}
+	rule := dh.autoRefunds.Match(donation, autorefund.KindCountry)
+	if rule == nil {
+		return false
+	}
+	_, err := dh.autoRefunds.Refund(ctx, donation, autorefund.Decision{
+		Rule:    rule.Name,
+		Trigger: autorefund.TriggerPayment,
+		Actor:   "system",
+		Reason:  rule.Reason,
+	})
+	if err != nil {
+		dh.logger(ctx).Error("Could not refund donation", zap.String("donation", donation.ID),
+			zap.String("rule", rule.Name), zap.Error(err))
+		return false
+	}
+	return true
+}
+
+// refund refunds a donation in full and records the refund, through the
+// auto-refund engine if there is one, so the refund is audited. Both send the
+// same parameters, see autorefund.RefundParams.
+func (dh *DonationHandler) refund(ctx context.Context, donation *store.Donation, decision autorefund.Decision) (string, error) {
+	if dh.autoRefunds != nil {
+		record, err := dh.autoRefunds.Refund(ctx, donation, decision)
+		return record.RefundID, err
+	}
+
+	refund, err := dh.provider.Refund(ctx, autorefund.RefundParams(donation, decision))
+	if err != nil {
+		return "", err
+	}
+	donation.Status, donation.RefundID = store.StatusRefunded, refund.ID
+	if dh.store != nil {
+		if err := dh.store.SaveDonation(ctx, donation); err != nil {
+			return refund.ID, fmt.Errorf("refunded as %s, but could not record it: %w", refund.ID, err)
+		}
+	}
+	return refund.ID, nil
+}
+
+// newDonationEvent returns the notification of a donation.
+func newDonationEvent(donation *store.Donation) notifier.DonationEvent {
+	donationEvent := notifier.DonationEvent{
+		CustomerID:      donation.CustomerID,
+		CustomerName:    donation.CustomerName,
+		CustomerEmail:   donation.CustomerEmail,
+		Amount:          float64(donation.Amount),
+		Currency:        donation.Currency,
+		Message:         donation.Message,
+		DisplayName:     donation.DisplayName,
+		Anonymous:       donation.Anonymous,
+		NewsletterOptIn: donation.NewsletterOptIn,
+	}
+	if donation.DonationAmount != 0 || donation.PurchaseAmount != 0 {
+		donationEvent.DonationAmount = float64(donation.DonationAmount)
+		donationEvent.PurchaseAmount = float64(donation.PurchaseAmount)
+		donationEvent.VATAmount = float64(donation.VATAmount)
+		donationEvent.InvoiceNumber = donation.InvoiceNumber
+		for _, rate := range donation.TaxRates {
+			donationEvent.TaxRates = append(donationEvent.TaxRates, notifier.TaxRate{
+				Rate:         rate.Rate,
+				Jurisdiction: rate.Jurisdiction,
+				Taxable:      float64(rate.Net),
+				Amount:       float64(rate.VAT),
+			})
+		}
+	}
+	return donationEvent
+}
+
+// HandleReview decides on a held donation, POST /admin/reviews/{chargeID}
+// with {"decision": "approve"} or {"decision": "cancel"}. Approved donations
+// are notified, cancelled donations are refunded.
+func (dh *DonationHandler) HandleReview(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/reviews/"), "/")
+	if id == "" || strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if dh.store == nil {
+		writeJSONErrorMessage(w, "Donations are not recorded", http.StatusNotFound)
+		return
+	}
+
+	var review struct {
+		Decision string `json:"decision"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+		writeJSONErrorMessage(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if review.Decision != ReviewApprove && review.Decision != ReviewCancel {
+		writeJSONErrorMessage(w, fmt.Sprintf("decision must be %q or %q", ReviewApprove, ReviewCancel), http.StatusBadRequest)
+		return
+	}
+
+	donation, err := dh.store.GetDonation(r.Context(), id)
+	if errors.Is(err, store.ErrNotFound) {
+		writeJSONErrorMessage(w, fmt.Sprintf("donation %q does not exist", id), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		dh.logger(r.Context()).Error("Could not get donation", zap.String("donation", id), zap.Error(err))
+		writeJSONErrorMessage(w, "Could not get donation", http.StatusInternalServerError)
+		return
+	}
+	if donation.Status != store.StatusHeld {
+		writeJSONErrorMessage(w, fmt.Sprintf("donation %q is %s, not held", id, donation.Status), http.StatusConflict)
+		return
+	}
+
+	reviewer := auth.Principal(r.Context())
+	logger := dh.logger(r.Context()).With(zap.String("donation", id), zap.String("reviewer", reviewer))
+	if review.Decision == ReviewApprove {
+		// The donation stays held if it cannot be notified, so the review can be repeated.
+		if err := dh.notifier.Notify(notifier.WithChargedAt(r.Context(), donation.CreatedAt), newDonationEvent(donation)); err != nil {
+			logger.Error("Failed to notify about approved donation", zap.Error(err))
+			writeJSONErrorMessage(w, "Could not notify about the donation", http.StatusBadGateway)
+			return
+		}
+		donation.Status = store.StatusSucceeded
+		if err := dh.store.SaveDonation(r.Context(), donation); err != nil {
+			logger.Error("Could not record approval of donation", zap.Error(err))
+			writeJSONErrorMessage(w, "Could not record the approval", http.StatusInternalServerError)
+			return
+		}
+		logger.Info("Donation was approved", zap.String("event", "review"))
+		writeJSON(w, donation)
+		return
+	}
+
+	decision := autorefund.Decision{Rule: "review", Trigger: autorefund.TriggerReviewCancelled, Actor: reviewer}
+	if dh.autoRefunds != nil {
+		if rule := dh.autoRefunds.Match(donation, autorefund.KindReview); rule != nil {
+			decision.Rule, decision.Reason = rule.Name, rule.Reason
+		}
+	}
+	if _, err := dh.refund(r.Context(), donation, decision); err != nil {
+		logger.Error("Could not refund cancelled donation", zap.Error(err))
+		var providerErr *payments.Error
+		if errors.As(err, &providerErr) {
+			writeJSONErrorMessage(w, providerErr.Error(), http.StatusBadGateway)
+		} else {
+			writeJSONErrorMessage(w, "Could not refund the donation", http.StatusInternalServerError)
+		}
+		return
+	}
+	logger.Info("Donation was cancelled and refunded", zap.String("event", "review"))
+	writeJSON(w, donation)
+}
+
+// HandleRefund refunds a donation in full, POST /admin/refunds/{chargeID}
+// with an optional {"reason": "requested_by_customer"}, "duplicate" or
+// "fraudulent". The refund is audited like automatic ones, with the staff
+// member as the actor.
+func (dh *DonationHandler) HandleRefund(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/refunds/"), "/")
+	if id == "" || strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if dh.store == nil {
+		writeJSONErrorMessage(w, "Donations are not recorded", http.StatusNotFound)
+		return
+	}
+
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		writeJSONErrorMessage(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	switch body.Reason {
+	case "", payments.RefundReasonDuplicate, payments.RefundReasonFraudulent, payments.RefundReasonRequestedByCustomer:
+	default:
+		writeJSONErrorMessage(w, fmt.Sprintf("reason must be %q, %q or %q", payments.RefundReasonRequestedByCustomer,
+			payments.RefundReasonDuplicate, payments.RefundReasonFraudulent), http.StatusBadRequest)
+		return
+	}
+
+	donation, err := dh.store.GetDonation(r.Context(), id)
+	if errors.Is(err, store.ErrNotFound) {
+		writeJSONErrorMessage(w, fmt.Sprintf("donation %q does not exist", id), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		dh.logger(r.Context()).Error("Could not get donation", zap.String("donation", id), zap.Error(err))
+		writeJSONErrorMessage(w, "Could not get donation", http.StatusInternalServerError)
+		return
+	}
+	if donation.Status == store.StatusRefunded {
+		writeJSONErrorMessage(w, fmt.Sprintf("donation %q is refunded already", id), http.StatusConflict)
+		return
+	}
+
+	staff := auth.Principal(r.Context())
+	logger := dh.logger(r.Context()).With(zap.String("donation", id), zap.String("staff", staff))
+	decision := autorefund.Decision{Rule: "staff", Trigger: autorefund.TriggerStaff, Actor: staff, Reason: body.Reason}
+	if _, err := dh.refund(r.Context(), donation, decision); err != nil {
+		logger.Error("Could not refund donation", zap.Error(err))
+		var providerErr *payments.Error
+		if errors.As(err, &providerErr) {
+			writeJSONErrorMessage(w, providerErr.Error(), http.StatusBadGateway)
+		} else {
+			writeJSONErrorMessage(w, "Could not refund the donation", http.StatusInternalServerError)
+		}
+		return
+	}
+	logger.Info("Donation was refunded", zap.String("event", "refund"))
+	writeJSON(w, donation)
+}
+
+// AutoRefundHandler serves the admin API of auto-refund rules.
+type AutoRefundHandler struct {
+	engine *autorefund.Engine
+}
+
+// NewAutoRefundHandler creates an AutoRefundHandler of the engine's rules.
+func NewAutoRefundHandler(engine *autorefund.Engine) *AutoRefundHandler {
+	return &AutoRefundHandler{engine: engine}
+}
+
+// HandleAutoRefunds routes the /admin/auto-refunds endpoints:
+//
+//	GET  /admin/auto-refunds         shows the rules and the latest refunds
+//	POST /admin/auto-refunds/sweep   refunds stored donations of blocked countries, only listing them with dry_run=true
+func (ah *AutoRefundHandler) HandleAutoRefunds(w http.ResponseWriter, r *http.Request) {
+	switch path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/auto-refunds"), "/"); {
+	case path == "" && r.Method == "GET":
+		writeJSON(w, map[string]interface{}{
+			"rules":   ah.engine.Rules(),
+			"refunds": ah.engine.Records(),
+		})
+	case path == "sweep" && r.Method == "POST":
+		dryRun, err := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+		if err != nil {
+			writeJSONErrorMessage(w, "dry_run must be true or false", http.StatusBadRequest)
+			return
+		}
+		records, err := ah.engine.Sweep(r.Context(), dryRun)
+		if err != nil {
+			requestLogger(r.Context()).Error("Could not sweep donations", zap.Error(err))
+			writeJSONErrorMessage(w, "Could not sweep donations", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, map[string]interface{}{
+			"dryRun":  dryRun,
+			"refunds": records,
+		})
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,146 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/metrics"
+	"github.com/vedrankolka/donation-server/pkg/payments"
+	"go.uber.org/zap"
+)
+
+// ReasonBudget is the failure reason of dead letters of notifications that
+// outlasted the webhook budget and were still being sent when the event was
+// acknowledged.
+const ReasonBudget = "budget"
+
+// errOverBudget is the error of the dead letters of notifications that
+// outlasted the webhook budget.
+var errOverBudget = errors.New("the notification outlasted the webhook budget")
+
+var webhookBudgetBreaches = metrics.NewCounterVec(
+	"donation_server_webhook_budget_breaches_total",
+	"Notifications of webhook events that outlasted the processing budget and were finished after acknowledging the event, by type and result.",
+	"type", "result",
+)
+
+// WithWebhookBudget acknowledges webhook events whose notifications are not
+// sent within the budget, measured from the start of the request, and
+// finishes sending them in the background, so a slow notifier does not make
+// Stripe mark the endpoint as failing. Such notifications are saved as
+// pending dead letters first, so the dead-letter store should keep them
+// durably, see package deadletter. Drain waits for them.
+func WithWebhookBudget(budget time.Duration) Option {
+	return func(dh *DonationHandler) {
+		dh.budget = budget
+	}
+}
+
+type webhookStartKey struct{}
+
+// withWebhookStart returns a context of a webhook request started at start.
+func withWebhookStart(ctx context.Context, start time.Time) context.Context {
+	return context.WithValue(ctx, webhookStartKey{}, start)
+}
+
+// budgetLeft returns the time left of the budget of the webhook request of
+// the context.
+func (dh *DonationHandler) budgetLeft(ctx context.Context) time.Duration {
+	start, ok := ctx.Value(webhookStartKey{}).(time.Time)
+	if !ok {
+		return dh.budget
+	}
+	return dh.budget - time.Since(start)
+}
+
+// detachedContext has the values of a context, but not its deadline and
+// cancellation, for work that outlives a request.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// notifyWithinBudget sends a notification of the event with send. Without a
+// budget, or when send returns within the budget left, it returns its error.
+// Otherwise the notification is saved as a pending dead letter and it
+// reports that the notification was deferred: it is finished in the
+// background, which records it and resolves the dead letter if it is
+// delivered. If the dead letter cannot be saved, it waits for send.
+func (dh *DonationHandler) notifyWithinBudget(ctx context.Context, event *payments.Event, notificationType string, payload interface{}, key string, send func(ctx context.Context) error) (deferred bool, err error) {
+	if dh.budget <= 0 || dh.deadLetters == nil {
+		return false, send(ctx)
+	}
+
+	sendCtx, cancel := context.WithTimeout(detachedContext{ctx}, Timeout)
+	done := make(chan error, 1)
+	dh.deferred.Add(1)
+	go func() {
+		defer dh.deferred.Done()
+		defer cancel()
+		done <- send(sendCtx)
+	}()
+
+	timer := time.NewTimer(dh.budgetLeft(ctx))
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return false, err
+	case <-timer.C:
+	}
+
+	logger := dh.logger(ctx).With(zap.String("event_id", event.ID), zap.String("type", notificationType))
+	data, err := json.Marshal(payload)
+	if err == nil {
+		breach := fmt.Errorf("%w of %v", errOverBudget, dh.budget)
+		err = addDeadLetter(dh.deadLetters, deadLetterID(event.ID, notificationType), event.ID, notificationType, data, breach)
+	}
+	if err != nil {
+		logger.Error("Could not save the notification over budget, waiting for it", zap.Error(err))
+		webhookBudgetBreaches.Inc(notificationType, "waited")
+		return false, <-done
+	}
+	logger.Warn("The notification outlasted the webhook budget, the event is acknowledged",
+		zap.String("event", "budget"), zap.Duration("budget", dh.budget))
+
+	dh.deferred.Add(1)
+	go func() {
+		defer dh.deferred.Done()
+		ctx, cancel := context.WithTimeout(detachedContext{ctx}, Timeout)
+		defer cancel()
+		if err := <-done; err != nil {
+			// The dead letter stays pending, to be redriven.
+			notificationFailures.Inc(notificationType, FailureReason(err))
+			logger.Error("The notification over budget failed", zap.Error(err))
+			webhookBudgetBreaches.Inc(notificationType, "failed")
+			return
+		}
+		dh.recordNotification(ctx, event, notificationType, key)
+		dh.resolveDeadLetter(ctx, event, notificationType)
+		logger.Info("The notification over budget was delivered")
+		webhookBudgetBreaches.Inc(notificationType, "delivered")
+	}()
+	return true, nil
+}
+
+// Drain waits until the notifications of acknowledged webhook events that
+// outlasted the budget are finished, or the context is done, and reports
+// whether they finished. Those that did not stay pending dead letters.
+func (dh *DonationHandler) Drain(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		dh.deferred.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,383 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/auth"
+	"github.com/vedrankolka/donation-server/pkg/currency"
+	"github.com/vedrankolka/donation-server/pkg/store"
+	"go.uber.org/zap"
+)
+
+// campaignID is the format of campaign IDs, which end up in URLs and metadata.
+var campaignID = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// ProgressMaxAge is how long shared caches may keep the progress of a
+// campaign, which changes with every donation.
+const ProgressMaxAge = 10 * time.Second
+
+// CampaignHandler serves the admin API of campaigns and their public progress.
+type CampaignHandler struct {
+	campaigns store.CampaignStore
+	rates     *currency.ExchangeRates
+}
+
+// NewCampaignHandler creates a CampaignHandler managing the campaigns in the
+// store. Donations in other currencies than a campaign's count towards its
+// target converted with the rates, or not at all if they are nil.
+func NewCampaignHandler(campaigns store.CampaignStore, rates *currency.ExchangeRates) *CampaignHandler {
+	return &CampaignHandler{campaigns: campaigns, rates: rates}
+}
+
+// campaignProgress is the progress of a campaign towards its target.
+type campaignProgress struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Currency string `json:"currency"`
+	Target   int64  `json:"target"`
+	Raised   int64  `json:"raised"`
+	// Remaining is what is missing to reach the target, zero once it is reached.
+	Remaining int64 `json:"remaining"`
+	// Percent of the target raised, over 100 if it was exceeded.
+	Percent   int        `json:"percent"`
+	Donations int        `json:"donations"`
+	StartsAt  time.Time  `json:"startsAt"`
+	EndsAt    *time.Time `json:"endsAt,omitempty"`
+	Active    bool       `json:"active"`
+	// Currencies are the totals and sub-goals by currency, if donations were
+	// made in other currencies than the campaign's or it has sub-goals.
+	Currencies []currencyProgress `json:"currencies,omitempty"`
+	// RatesDate is the date of the exchange rates the totals were converted with.
+	RatesDate string `json:"ratesDate,omitempty"`
+}
+
+// currencyProgress is what a campaign raised in a currency, towards its
+// sub-goal in the currency if it has one.
+type currencyProgress struct {
+	Currency string `json:"currency"`
+	Raised   int64  `json:"raised"`
+	// Converted is Raised in the currency of the campaign, if there is a rate.
+	Converted *int64 `json:"converted,omitempty"`
+	// Target, Remaining and Percent are of the sub-goal, zero without one.
+	Target    int64 `json:"target"`
+	Remaining int64 `json:"remaining"`
+	Percent   int   `json:"percent"`
+}
+
+// newCampaignProgress returns the progress of the campaign. Its totals in
+// other currencies are converted with the rates, or left out if they are nil.
+func newCampaignProgress(c *store.Campaign, now time.Time, rates *currency.Rates) campaignProgress {
+	p := campaignProgress{
+		ID:        c.ID,
+		Name:      c.Name,
+		Currency:  c.Currency,
+		Target:    c.Target,
+		Donations: c.Donations,
+		StartsAt:  c.StartsAt,
+		EndsAt:    c.EndsAt,
+		Active:    c.Active(now),
+	}
+	// Charges have lower case currencies.
+	byCurrency := make(map[string]*currencyProgress)
+	progressIn := func(code string) *currencyProgress {
+		code = strings.ToUpper(code)
+		if byCurrency[code] == nil {
+			byCurrency[code] = &currencyProgress{Currency: code}
+		}
+		return byCurrency[code]
+	}
+	for code, total := range c.Totals {
+		progressIn(code).Raised += total
+	}
+	for code, target := range c.Goals {
+		progressIn(code).Target = target
+	}
+
+	for code, cp := range byCurrency {
+		if code == c.Currency {
+			p.Raised += cp.Raised
+		} else if rates != nil && cp.Raised > 0 {
+			if converted, ok := rates.Convert(cp.Raised, code, c.Currency); ok {
+				cp.Converted = &converted
+				p.Raised += converted
+				p.RatesDate = rates.Date
+			}
+		}
+		cp.Remaining, cp.Percent = remaining(cp.Raised, cp.Target)
+		p.Currencies = append(p.Currencies, *cp)
+	}
+	p.Remaining, p.Percent = remaining(p.Raised, p.Target)
+	if len(p.Currencies) == 1 && p.Currencies[0].Currency == c.Currency && p.Currencies[0].Target == 0 {
+		// The campaign's currency alone is its total.
+		p.Currencies = nil
+	}
+	sort.Slice(p.Currencies, func(i, j int) bool { return p.Currencies[i].Currency < p.Currencies[j].Currency })
+	return p
+}
+
+// remaining returns what is missing to reach the target, zero once it is
+// reached, and the percent of the target raised.
+func remaining(raised, target int64) (int64, int) {
+	if target <= 0 {
+		return 0, 0
+	}
+	var missing int64
+	if raised < target {
+		missing = target - raised
+	}
+	return missing, int(raised * 100 / target)
+}
+
+// HandleCampaigns routes the /admin/campaigns endpoints:
+//
+//	GET    /admin/campaigns                  lists campaigns with the totals of their donations
+//	POST   /admin/campaigns                  creates a campaign
+//	GET    /admin/campaigns/{id}             shows a campaign
+//	PUT    /admin/campaigns/{id}             replaces a campaign
+//	DELETE /admin/campaigns/{id}             deletes a campaign, its donations keep their campaign
+//	GET    /admin/campaigns/{id}/progress    shows the progress of a campaign
+func (ch *CampaignHandler) HandleCampaigns(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/campaigns"), "/")
+	id, sub := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		id, sub = path[:i], path[i+1:]
+	}
+
+	switch {
+	case id == "" && r.Method == "GET":
+		ch.list(w, r)
+	case id == "" && r.Method == "POST":
+		ch.save(w, r, nil)
+	case id != "" && sub == "":
+		ch.campaign(w, r, id)
+	case id != "" && sub == "progress" && r.Method == "GET":
+		ch.progress(w, r, id)
+	case sub != "" && sub != "progress":
+		http.NotFound(w, r)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleProgress serves GET /campaigns/{id}/progress, the progress of a
+// campaign for donation pages.
+func (ch *CampaignHandler) HandleProgress(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.Trim(strings.TrimPrefix(r.URL.Path, "/campaigns"), "/"), "/progress")
+	if id == "" || strings.Contains(id, "/") || !strings.HasSuffix(r.URL.Path, "/progress") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	ch.progress(w, r, id)
+}
+
+func (ch *CampaignHandler) list(w http.ResponseWriter, r *http.Request) {
+	q, ok := parseListQuery(w, r, store.CampaignListSpec)
+	if !ok {
+		return
+	}
+
+	campaigns, next, err := ch.campaigns.ListCampaigns(r.Context(), q)
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not list campaigns", zap.Error(err))
+		writeJSONErrorMessage(w, "Could not list campaigns", http.StatusInternalServerError)
+		return
+	}
+
+	writeList(w, campaigns, next)
+}
+
+// get writes the error response if the campaign cannot be found.
+func (ch *CampaignHandler) get(w http.ResponseWriter, r *http.Request, id string) (*store.Campaign, bool) {
+	c, err := ch.campaigns.GetCampaign(r.Context(), id)
+	if errors.Is(err, store.ErrNotFound) {
+		writeJSONErrorMessage(w, fmt.Sprintf("campaign %q does not exist", id), http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not get campaign", zap.String("campaign", id), zap.Error(err))
+		writeJSONErrorMessage(w, "Could not get campaign", http.StatusInternalServerError)
+		return nil, false
+	}
+	return c, true
+}
+
+func (ch *CampaignHandler) campaign(w http.ResponseWriter, r *http.Request, id string) {
+	c, ok := ch.get(w, r, id)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, c)
+	case "PUT":
+		ch.save(w, r, c)
+	case "DELETE":
+		if err := ch.campaigns.DeleteCampaign(r.Context(), id); err != nil {
+			requestLogger(r.Context()).Error("Could not delete campaign", zap.String("campaign", id), zap.Error(err))
+			writeJSONErrorMessage(w, "Could not delete campaign", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (ch *CampaignHandler) progress(w http.ResponseWriter, r *http.Request, id string) {
+	c, ok := ch.get(w, r, id)
+	if !ok {
+		return
+	}
+	writeJSON(w, newCampaignProgress(c, time.Now(), ch.exchangeRates(r.Context(), c)))
+}
+
+// exchangeRates returns the rates to convert the totals of the campaign in
+// other currencies with, or nil if there are none or the rates are unknown.
+func (ch *CampaignHandler) exchangeRates(ctx context.Context, c *store.Campaign) *currency.Rates {
+	if ch.rates == nil {
+		return nil
+	}
+	for code := range c.Totals {
+		if strings.EqualFold(code, c.Currency) {
+			continue
+		}
+		rates, err := ch.rates.Rates(ctx)
+		if err != nil {
+			requestLogger(ctx).Warn("Could not get exchange rates, the campaign only counts donations in its currency",
+				zap.String("campaign", c.ID), zap.String("currency", c.Currency), zap.Error(err))
+			return nil
+		}
+		return &rates
+	}
+	return nil
+}
+
+// save creates a campaign, or replaces existing if it is not nil.
+func (ch *CampaignHandler) save(w http.ResponseWriter, r *http.Request, existing *store.Campaign) {
+	var c store.Campaign
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		writeJSONErrorMessage(w, "invalid campaign: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := time.Now().UTC()
+	if existing != nil {
+		c.ID = existing.ID
+	} else if c.StartsAt.IsZero() {
+		c.StartsAt = now
+	}
+	if err := validateCampaign(&c); err != nil {
+		writeJSONErrorMessage(w, "invalid campaign: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if existing != nil {
+		c.CreatedBy, c.CreatedAt = existing.CreatedBy, existing.CreatedAt
+	} else {
+		_, err := ch.campaigns.GetCampaign(r.Context(), c.ID)
+		if err == nil {
+			writeJSONErrorMessage(w, fmt.Sprintf("campaign %q exists already", c.ID), http.StatusConflict)
+			return
+		}
+		if !errors.Is(err, store.ErrNotFound) {
+			requestLogger(r.Context()).Error("Could not get campaign", zap.String("campaign", c.ID), zap.Error(err))
+			writeJSONErrorMessage(w, "Could not save campaign", http.StatusInternalServerError)
+			return
+		}
+		c.CreatedBy, c.CreatedAt = auth.Principal(r.Context()), now
+	}
+	c.UpdatedAt = now
+
+	if err := ch.campaigns.SaveCampaign(r.Context(), &c); err != nil {
+		requestLogger(r.Context()).Error("Could not save campaign", zap.Error(err))
+		writeJSONErrorMessage(w, "Could not save campaign", http.StatusInternalServerError)
+		return
+	}
+
+	if existing != nil {
+		c.Donations, c.Totals = existing.Donations, existing.Totals
+		writeJSON(w, c)
+		return
+	}
+	c.Totals = map[string]int64{}
+	writeJSONError(w, c, http.StatusCreated)
+}
+
+// validateCampaign checks the ID, name, target and dates of a campaign, and
+// normalizes its currency.
+func validateCampaign(c *store.Campaign) error {
+	if !campaignID.MatchString(c.ID) {
+		return fmt.Errorf("id must be up to 64 lower case letters, digits, dashes and underscores")
+	}
+	if strings.TrimSpace(c.Name) == "" {
+		return fmt.Errorf("name is required")
+	}
+	if c.Target <= 0 {
+		return fmt.Errorf("target must be a positive amount in the smallest currency unit")
+	}
+	cur, ok := currency.Lookup(c.Currency)
+	if !ok {
+		return fmt.Errorf("currency %q is not supported", c.Currency)
+	}
+	c.Currency = cur.Code
+	goals := make(map[string]int64, len(c.Goals))
+	for code, target := range c.Goals {
+		cur, ok := currency.Lookup(code)
+		if !ok {
+			return fmt.Errorf("currency %q of a goal is not supported", code)
+		}
+		if target <= 0 {
+			return fmt.Errorf("the goal in %s must be a positive amount in the smallest currency unit", cur.Code)
+		}
+		goals[cur.Code] = target
+	}
+	c.Goals = nil
+	if len(goals) > 0 {
+		c.Goals = goals
+	}
+	if c.StartsAt.IsZero() {
+		return fmt.Errorf("startsAt is required")
+	}
+	if c.EndsAt != nil && !c.EndsAt.After(c.StartsAt) {
+		return fmt.Errorf("endsAt must be after startsAt")
+	}
+	return nil
+}
+
+// checkCampaign returns the error the donor is told if the campaign is
+// registered but does not take donations now. Campaigns that are not
+// registered are labels of donations as before, and the campaign is not
+// checked if the store fails.
+func (dh *DonationHandler) checkCampaign(ctx context.Context, id string) error {
+	if dh.campaigns == nil || id == "" {
+		return nil
+	}
+	c, err := dh.campaigns.GetCampaign(ctx, id)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		dh.logger(ctx).Warn("Could not check campaign", zap.String("campaign", id), zap.Error(err))
+		return nil
+	}
+	now := time.Now()
+	if now.Before(c.StartsAt) {
+		return fmt.Errorf("the campaign %s has not started yet", c.Name)
+	}
+	if !c.Active(now) {
+		return fmt.Errorf("the campaign %s has ended", c.Name)
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+
+	"github.com/vedrankolka/donation-server/pkg/currency"
+	"github.com/vedrankolka/donation-server/pkg/metrics"
+	"github.com/vedrankolka/donation-server/pkg/partner"
+	"github.com/vedrankolka/donation-server/pkg/payments"
+	"go.uber.org/zap"
+)
+
+// CheckoutItemName is the name of the line item of Checkout sessions.
+const CheckoutItemName = "Donation"
+
+var checkoutSessions = metrics.NewCounterVec(
+	"donation_server_checkout_sessions_total",
+	"Checkout sessions created or failed, by currency and outcome.",
+	"currency", "outcome",
+)
+
+// checkoutURLs are where donors are redirected from Checkout.
+type checkoutURLs struct {
+	success string
+	cancel  string
+}
+
+// WithCheckout lets sites redirect donors to a payment page hosted by Stripe
+// Checkout with /create-checkout-session, instead of embedding the Payment
+// Element. Donors are redirected to successURL after paying, where Stripe
+// replaces {CHECKOUT_SESSION_ID} with the ID of the session, and to cancelURL
+// if they go back.
+func WithCheckout(successURL, cancelURL string) Option {
+	return func(dh *DonationHandler) {
+		dh.checkout = &checkoutURLs{success: successURL, cancel: cancelURL}
+	}
+}
+
+// HandleCreateCheckoutSession creates a Checkout session of a donation with
+// the amount, currency, donor_email, message and campaign of the query, a
+// JSON body like /create-payment-intent, or an HTML form. Forms are
+// redirected to the page of the session with 303 See Other, other requests
+// get its {"id", "url"}.
+func (dh *DonationHandler) HandleCreateCheckoutSession(w http.ResponseWriter, r *http.Request) {
+	logger := dh.logger(r.Context())
+	if dh.checkout == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	form := isForm(r)
+	var err error
+	if form {
+		r, err = readCheckoutForm(r)
+	} else {
+		r, err = readIntentBody(r)
+	}
+	if err != nil {
+		var reqErr *requestError
+		errors.As(err, &reqErr)
+		logger.Info("Invalid request body", zap.Error(err))
+		writeJSONErrorMessage(w, reqErr.message, reqErr.status)
+		return
+	}
+	if !dh.checkPaused(w) {
+		return
+	}
+	query := r.URL.Query()
+	if query.Get("items") != "" {
+		writeJSONErrorMessage(w, "purchases are not supported with Checkout, use /create-payment-intent", http.StatusBadRequest)
+		return
+	}
+
+	donationCurrency, err := findCurrency(dh.currencies, query.Get("currency"))
+	if err != nil {
+		writeJSONErrorMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	amount, err := getAmount(r)
+	if err != nil {
+		logger.Info("Amount was not set correctly", zap.Error(err))
+		writeJSONErrorMessage(w, "amount must be a number in the smallest currency unit", http.StatusBadRequest)
+		return
+	}
+	if err := donationCurrency.Check(amount); err != nil {
+		writeAmountError(w, err.(*currency.AmountError))
+		return
+	}
+
+	donorEmail := query.Get(DonorEmailParam)
+	if parsed, err := mail.ParseAddress(donorEmail); donorEmail != "" && (err != nil || parsed.Address != donorEmail) {
+		writeJSONErrorMessage(w, "the donor email is not a valid email address", http.StatusBadRequest)
+		return
+	}
+	message := query.Get(MessageParam)
+	if len(message) > maxMetadataValue {
+		writeJSONErrorMessage(w, fmt.Sprintf("the message must be at most %d bytes", maxMetadataValue), http.StatusBadRequest)
+		return
+	}
+	choices, err := donorChoices(r)
+	if err != nil {
+		writeJSONErrorMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	params := &payments.CheckoutParams{
+		Amount:        amount,
+		Currency:      donationCurrency.Code,
+		ItemName:      CheckoutItemName,
+		CustomerEmail: donorEmail,
+		SuccessURL:    dh.checkout.success,
+		CancelURL:     dh.checkout.cancel,
+		Metadata:      map[string]string{},
+		// The page offers only the payment methods that are not paused.
+		PaymentMethodTypes: dh.paymentMethods(),
+	}
+	if message != "" {
+		params.Metadata[MessageKey] = message
+	}
+	for key, value := range choices {
+		params.Metadata[key] = value
+	}
+	if campaign := query.Get(CampaignKey); campaign != "" && len(campaign) <= maxMetadataValue {
+		if err := dh.checkCampaign(r.Context(), campaign); err != nil {
+			writeJSONErrorMessage(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		params.Metadata[CampaignKey] = campaign
+	}
+	if partnerID := partner.ID(r.Context()); partnerID != "" {
+		params.Metadata[PartnerKey] = partnerID
+	}
+	if code := query.Get(LinkParam); code != "" {
+		if err := dh.checkLink(r.Context(), code); err != nil {
+			writeJSONErrorMessage(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		params.Metadata[LinkKey] = code
+	}
+	if params.IdempotencyKey, err = dh.requestIdempotencyKey(r, "checkout-session", params); err != nil {
+		writeJSONErrorMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	session, err := dh.provider.CreateCheckoutSession(r.Context(), params)
+	if err != nil {
+		checkoutSessions.Inc(donationCurrency.Code, "failed")
+		var providerErr *payments.Error
+		if errors.As(err, &providerErr) {
+			logger.Warn("The payment provider refused the checkout session", providerErrorFields(providerErr)...)
+			dh.writeProviderError(w, r, providerErr)
+		} else {
+			logger.Error("Could not create checkout session", zap.Error(err))
+			writeJSONErrorMessage(w, "Unknown server error", http.StatusInternalServerError)
+		}
+		return
+	}
+	checkoutSessions.Inc(donationCurrency.Code, "created")
+	logger.Debug("Created checkout session", zap.String("checkout_session", session.ID))
+
+	if form {
+		http.Redirect(w, r, session.URL, http.StatusSeeOther)
+		return
+	}
+	writeJSON(w, struct {
+		ID  string `json:"id"`
+		URL string `json:"url"`
+	}{session.ID, session.URL})
+}
+
+// isForm reports whether the body of the request is an HTML form.
+func isForm(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/x-www-form-urlencoded"
+}
+
+// readCheckoutForm returns the request with the fields of its form as query
+// parameters, overriding those of the URL.
+func readCheckoutForm(r *http.Request) (*http.Request, error) {
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxIntentBody+1))
+	if err != nil {
+		return nil, &requestError{http.StatusBadRequest, "could not read the body"}
+	}
+	if len(data) > maxIntentBody {
+		return nil, &requestError{http.StatusRequestEntityTooLarge, fmt.Sprintf("the body must be at most %d bytes", maxIntentBody)}
+	}
+	fields, err := url.ParseQuery(string(data))
+	if err != nil {
+		return nil, &requestError{http.StatusBadRequest, "the body is not a valid form"}
+	}
+
+	query := r.URL.Query()
+	for name, values := range fields {
+		// Empty fields, like an optional email left blank, are not set.
+		if len(values) > 0 && strings.TrimSpace(values[0]) != "" {
+			query[name] = values
+		}
+	}
+	r = r.Clone(r.Context())
+	r.URL.RawQuery = query.Encode()
+	return r, nil
+}
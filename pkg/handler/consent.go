@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/vedrankolka/donation-server/pkg/payments"
+	"github.com/vedrankolka/donation-server/pkg/store"
+	"go.uber.org/zap"
+)
+
+// Query parameters of the donor's choices, taken by /create-payment-intent,
+// also in its JSON body, and /create-checkout-session.
+const (
+	// NewsletterParam is "true" if the donor subscribes to the newsletter.
+	NewsletterParam = "newsletter"
+	// AnonymousParam is "true" if the donor's name must not be shown publicly.
+	AnonymousParam = "anonymous"
+	// DisplayNameParam is the name shown publicly instead of the donor's.
+	DisplayNameParam = "display_name"
+)
+
+// Metadata keys of the donor's choices, on the payment and, for the
+// newsletter, on the customer.
+const (
+	NewsletterKey   = "newsletter_opt_in"
+	NewsletterAtKey = "newsletter_opt_in_at"
+	AnonymousKey    = "anonymous"
+	DisplayNameKey  = "display_name"
+)
+
+// maxDisplayName is the maximum number of characters of a display name.
+const maxDisplayName = 100
+
+// donorChoices returns the metadata of the donor's choices in the query: the
+// newsletter opt-in, the anonymous flag and the display name. Only choices
+// the donor made are kept, so "false" is not stored.
+func donorChoices(r *http.Request) (map[string]string, error) {
+	query := r.URL.Query()
+	metadata := make(map[string]string)
+	for _, choice := range []struct{ param, key string }{
+		{NewsletterParam, NewsletterKey},
+		{AnonymousParam, AnonymousKey},
+	} {
+		value := query.Get(choice.param)
+		if value == "" {
+			continue
+		}
+		chosen, err := parseChoice(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be true or false", choice.param)
+		}
+		if chosen {
+			metadata[choice.key] = "true"
+		}
+	}
+	if name := query.Get(DisplayNameParam); name != "" {
+		if !utf8.ValidString(name) || utf8.RuneCountInString(name) > maxDisplayName || len(name) > maxMetadataValue {
+			return nil, fmt.Errorf("the display name must be at most %d characters", maxDisplayName)
+		}
+		metadata[DisplayNameKey] = name
+	}
+	return metadata, nil
+}
+
+// parseChoice parses a boolean choice, also "on" of HTML checkboxes.
+func parseChoice(value string) (bool, error) {
+	if value == "on" {
+		return true, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// addDonorChoices sets the donation's choices from the metadata of the charge.
+func addDonorChoices(donation *store.Donation, metadata map[string]string) {
+	donation.Message = metadata[MessageKey]
+	donation.DisplayName = metadata[DisplayNameKey]
+	donation.Anonymous = metadata[AnonymousKey] == "true"
+	donation.NewsletterOptIn = metadata[NewsletterKey] == "true"
+}
+
+// recordNewsletterConsent records on the customer that it subscribed to the
+// newsletter, and when, the first time a donation opts in. The consent stays
+// on the customer, so it is kept for later donations that do not ask again.
+func (dh *DonationHandler) recordNewsletterConsent(ctx context.Context, customer *payments.Customer, donation *store.Donation, logger *zap.Logger) {
+	if !donation.NewsletterOptIn || customer.Metadata[NewsletterKey] == "true" {
+		return
+	}
+	_, err := dh.provider.UpdateCustomer(ctx, customer.ID, &payments.CustomerParams{Metadata: map[string]string{
+		NewsletterKey:   "true",
+		NewsletterAtKey: donation.CreatedAt.UTC().Format(time.RFC3339),
+	}})
+	if err != nil {
+		logger.Warn("Could not record newsletter consent of customer", zap.Error(err))
+	}
+}
@@ -0,0 +1,390 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/listing"
+	"github.com/vedrankolka/donation-server/pkg/metrics"
+	"github.com/vedrankolka/donation-server/pkg/notifier"
+	"github.com/vedrankolka/donation-server/pkg/payments"
+	"github.com/vedrankolka/donation-server/pkg/store"
+	"go.uber.org/zap"
+)
+
+// Failure reasons of dead letters.
+const (
+	ReasonTimeout  = "timeout"
+	ReasonCanceled = "canceled"
+	ReasonNetwork  = "network"
+	ReasonDelivery = "delivery"
+)
+
+// Types of notifications.
+const (
+	// NotificationDonation is the type of notifications about donations.
+	NotificationDonation = notifier.EventTypeDonation
+	// NotificationRecurringDonation is the type of notifications about
+	// payments of recurring donations.
+	NotificationRecurringDonation = notifier.EventTypeRecurringDonation
+	// NotificationPaymentFailed, NotificationRefund and NotificationDispute
+	// are the types of notifications about failed payments, refunds and
+	// disputes.
+	NotificationPaymentFailed = notifier.EventTypePaymentFailed
+	NotificationRefund        = notifier.EventTypeRefund
+	NotificationDispute       = notifier.EventTypeDispute
+)
+
+var notificationFailures = metrics.NewCounterVec(
+	"donation_server_notification_failures_total",
+	"Notifications of webhook events the notifier failed to deliver, by type and failure reason.",
+	"type", "reason",
+)
+
+// WithDeadLetters saves notifications that could not be delivered in the
+// dead-letter store, so they can be inspected and redriven.
+func WithDeadLetters(deadLetters store.DeadLetterStore) Option {
+	return func(dh *DonationHandler) {
+		dh.deadLetters = deadLetters
+	}
+}
+
+// WithDeadLetterAcks acknowledges webhook events whose notifications failed
+// once they are saved as dead letters, instead of failing them so Stripe
+// redelivers them, for dead-letter stores that keep them durably, see
+// package deadletter. They are delivered by redriving them.
+func WithDeadLetterAcks() Option {
+	return func(dh *DonationHandler) {
+		dh.ackDeadLetters = true
+	}
+}
+
+// FailureReason categorizes a notification error.
+func FailureReason(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errOverBudget):
+		return ReasonBudget
+	case errors.Is(err, context.DeadlineExceeded):
+		return ReasonTimeout
+	case errors.Is(err, context.Canceled):
+		return ReasonCanceled
+	case errors.As(err, &netErr):
+		if netErr.Timeout() {
+			return ReasonTimeout
+		}
+		return ReasonNetwork
+	default:
+		return ReasonDelivery
+	}
+}
+
+func deadLetterID(eventID, notificationType string) string {
+	return eventID + ":" + notificationType
+}
+
+// deadLetter counts a notification of the event that could not be delivered
+// and saves it. It reports whether the webhook acknowledges the event, see
+// WithDeadLetterAcks.
+func (dh *DonationHandler) deadLetter(reqCtx context.Context, event *payments.Event, notificationType string, payload interface{}, notifyErr error) bool {
+	notificationFailures.Inc(notificationType, FailureReason(notifyErr))
+	if dh.deadLetters == nil {
+		return false
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		dh.logger(reqCtx).Error("Could not marshal dead letter", zap.String("event_id", event.ID), zap.Error(err))
+		return false
+	}
+	id := deadLetterID(event.ID, notificationType)
+	if err := addDeadLetter(dh.deadLetters, id, event.ID, notificationType, data, notifyErr); err != nil {
+		dh.logger(reqCtx).Error("Could not save dead letter", zap.String("dead_letter", id), zap.Error(err))
+		return false
+	}
+	if dh.ackDeadLetters {
+		dh.logger(reqCtx).Warn("The notification was dead-lettered, the event is acknowledged",
+			zap.String("event", "dead_letter"), zap.String("dead_letter", id))
+	}
+	return dh.ackDeadLetters
+}
+
+// DeadLetterFunc returns a function counting and saving the events notifiers
+// queued but could not deliver, like the notifications that failed in the
+// webhook. Events of an unknown Stripe event are identified by their payload.
+func DeadLetterFunc(deadLetters store.DeadLetterStore) notifier.DeadLetterFunc {
+	return func(eventID, eventType string, payload []byte, notifyErr error) {
+		notificationFailures.Inc(eventType, FailureReason(notifyErr))
+		id := deadLetterID(eventID, eventType)
+		if eventID == "" {
+			sum := sha256.Sum256(payload)
+			id = deadLetterID("queued-"+hex.EncodeToString(sum[:8]), eventType)
+		}
+		if err := addDeadLetter(deadLetters, id, eventID, eventType, payload, notifyErr); err != nil {
+			zap.L().Error("Could not save dead letter", zap.String("dead_letter", id), zap.Error(err))
+		}
+	}
+}
+
+// addDeadLetter saves a notification that could not be delivered.
+func addDeadLetter(deadLetters store.DeadLetterStore, id, eventID, notificationType string, payload []byte, notifyErr error) error {
+	now := time.Now().UTC()
+	dl := &store.DeadLetter{
+		ID:        id,
+		EventID:   eventID,
+		Type:      notificationType,
+		Payload:   payload,
+		Reason:    FailureReason(notifyErr),
+		Error:     notifyErr.Error(),
+		Attempts:  1,
+		FailedAt:  now,
+		UpdatedAt: now,
+	}
+
+	// The request context is likely done after a timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+	return deadLetters.AddDeadLetter(ctx, dl)
+}
+
+// resolveDeadLetter marks a dead letter of the event as delivered after the
+// notification was delivered by a redelivery of the event.
+func (dh *DonationHandler) resolveDeadLetter(ctx context.Context, event *payments.Event, notificationType string) {
+	if dh.deadLetters == nil {
+		return
+	}
+
+	id := deadLetterID(event.ID, notificationType)
+	dl, err := dh.deadLetters.GetDeadLetter(ctx, id)
+	if err != nil || dl.Status != store.DeadLetterPending {
+		return
+	}
+	if err := dh.deadLetters.SetDeadLetterStatus(ctx, id, store.DeadLetterDelivered); err != nil {
+		dh.logger(ctx).Warn("Could not resolve dead letter", zap.String("dead_letter", id), zap.Error(err))
+	}
+}
+
+// DeadLetterHandler serves the admin API for dead-lettered notifications.
+type DeadLetterHandler struct {
+	deadLetters store.DeadLetterStore
+	notifier    notifier.Notifier
+}
+
+// NewDeadLetterHandler creates a DeadLetterHandler redriving notifications with the notifier.
+func NewDeadLetterHandler(deadLetters store.DeadLetterStore, notifier notifier.Notifier) *DeadLetterHandler {
+	return &DeadLetterHandler{
+		deadLetters: deadLetters,
+		notifier:    notifier,
+	}
+}
+
+// batchRequest selects dead letters for a batch operation, either by ID or by filter.
+type batchRequest struct {
+	IDs    []string `json:"ids"`
+	Status string   `json:"status"`
+	Reason string   `json:"reason"`
+	Type   string   `json:"type"`
+}
+
+type batchResult struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// HandleDeadLetters routes the /admin/dead-letters endpoints:
+//
+//	GET  /admin/dead-letters?status=&reason=&type=  lists dead letters, see store.DeadLetterListSpec
+//	GET  /admin/dead-letters/{id}                   shows a dead letter
+//	POST /admin/dead-letters/{id}/redrive           sends it again
+//	POST /admin/dead-letters/{id}/discard           drops it
+//	POST /admin/dead-letters/redrive                redrives a batch
+//	POST /admin/dead-letters/discard                discards a batch
+//
+// Batches are selected by a JSON body with either "ids" or the filters
+// "status" (pending by default), "reason" and "type".
+func (dlh *DeadLetterHandler) HandleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/dead-letters"), "/")
+	parts := strings.Split(path, "/")
+
+	switch {
+	case path == "" && r.Method == "GET":
+		dlh.list(w, r)
+	case len(parts) == 1 && (parts[0] == "redrive" || parts[0] == "discard") && r.Method == "POST":
+		dlh.batch(w, r, parts[0])
+	case len(parts) == 1 && r.Method == "GET":
+		dlh.get(w, r, parts[0])
+	case len(parts) == 2 && (parts[1] == "redrive" || parts[1] == "discard") && r.Method == "POST":
+		result := dlh.apply(r.Context(), parts[0], parts[1], r.URL.Query().Get("force") == "true")
+		code := http.StatusOK
+		if result.Error != "" {
+			code = http.StatusConflict
+		}
+		if result.Status == "" {
+			code = http.StatusNotFound
+		}
+		writeJSONError(w, result, code)
+	default:
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	}
+}
+
+func (dlh *DeadLetterHandler) list(w http.ResponseWriter, r *http.Request) {
+	q, ok := parseListQuery(w, r, store.DeadLetterListSpec)
+	if !ok {
+		return
+	}
+
+	list, next, err := dlh.deadLetters.ListDeadLetters(r.Context(), q)
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not list dead letters", zap.Error(err))
+		writeJSONErrorMessage(w, "Could not list dead letters", http.StatusInternalServerError)
+		return
+	}
+
+	writeList(w, list, next)
+}
+
+func (dlh *DeadLetterHandler) get(w http.ResponseWriter, r *http.Request, id string) {
+	dl, err := dlh.deadLetters.GetDeadLetter(r.Context(), id)
+	if errors.Is(err, store.ErrNotFound) {
+		writeJSONErrorMessage(w, fmt.Sprintf("dead letter %q does not exist", id), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not get dead letter", zap.String("dead_letter", id), zap.Error(err))
+		writeJSONErrorMessage(w, "Could not get dead letter", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, dl)
+}
+
+func (dlh *DeadLetterHandler) batch(w http.ResponseWriter, r *http.Request, operation string) {
+	var req batchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONErrorMessage(w, "invalid batch request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ids := req.IDs
+	if len(ids) == 0 {
+		q := listing.Query{
+			Limit:  listing.MaxLimit,
+			Sort:   listing.ParseSort(store.DeadLetterListSpec.DefaultSort),
+			Filter: listing.Filter{Status: req.Status, Reason: req.Reason, Type: req.Type},
+		}
+		if q.Filter.Status == "" {
+			q.Filter.Status = store.DeadLetterPending
+		}
+		for {
+			list, next, err := dlh.deadLetters.ListDeadLetters(r.Context(), q)
+			if err != nil {
+				requestLogger(r.Context()).Error("Could not list dead letters", zap.Error(err))
+				writeJSONErrorMessage(w, "Could not list dead letters", http.StatusInternalServerError)
+				return
+			}
+			for _, dl := range list {
+				ids = append(ids, dl.ID)
+			}
+			if next == "" {
+				break
+			}
+			if q.Cursor, err = listing.DecodeCursor(next); err != nil {
+				requestLogger(r.Context()).Error("Could not list dead letters", zap.Error(err))
+				writeJSONErrorMessage(w, "Could not list dead letters", http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	results := make([]batchResult, 0, len(ids))
+	for _, id := range ids {
+		results = append(results, dlh.apply(r.Context(), id, operation, r.URL.Query().Get("force") == "true"))
+	}
+
+	writeJSON(w, struct {
+		Results []batchResult `json:"results"`
+	}{
+		Results: results,
+	})
+}
+
+// apply redrives or discards a dead letter. Only pending dead letters are
+// redriven unless force is set, so notifications are not duplicated by accident.
+func (dlh *DeadLetterHandler) apply(ctx context.Context, id, operation string, force bool) batchResult {
+	dl, err := dlh.deadLetters.GetDeadLetter(ctx, id)
+	if err != nil {
+		return batchResult{ID: id, Error: err.Error()}
+	}
+
+	if operation == "discard" {
+		if err := dlh.deadLetters.SetDeadLetterStatus(ctx, id, store.DeadLetterDiscarded); err != nil {
+			return batchResult{ID: id, Status: dl.Status, Error: err.Error()}
+		}
+		requestLogger(ctx).Info("Discarded dead letter", zap.String("dead_letter", id))
+		return batchResult{ID: id, Status: store.DeadLetterDiscarded}
+	}
+
+	if dl.Status != store.DeadLetterPending && !force {
+		return batchResult{ID: id, Status: dl.Status, Error: "only pending dead letters are redriven without force=true"}
+	}
+
+	if err := dlh.redrive(ctx, dl); err != nil {
+		requestLogger(ctx).Warn("Redrive of dead letter failed", zap.String("dead_letter", id), zap.Error(err))
+		dl.Reason = FailureReason(err)
+		dl.Error = err.Error()
+		dl.Attempts = 1
+		dl.UpdatedAt = time.Now().UTC()
+		if err := dlh.deadLetters.AddDeadLetter(ctx, dl); err != nil {
+			requestLogger(ctx).Error("Could not update dead letter", zap.String("dead_letter", id), zap.Error(err))
+		}
+		return batchResult{ID: id, Status: store.DeadLetterPending, Error: err.Error()}
+	}
+
+	if err := dlh.deadLetters.SetDeadLetterStatus(ctx, id, store.DeadLetterDelivered); err != nil {
+		return batchResult{ID: id, Status: dl.Status, Error: err.Error()}
+	}
+	requestLogger(ctx).Info("Redrove dead letter", zap.String("dead_letter", id))
+	return batchResult{ID: id, Status: store.DeadLetterDelivered}
+}
+
+func (dlh *DeadLetterHandler) redrive(ctx context.Context, dl *store.DeadLetter) error {
+	ctx = notifier.WithEventID(ctx, dl.EventID)
+	switch dl.Type {
+	case NotificationDonation:
+		var event notifier.DonationEvent
+		if err := json.Unmarshal(dl.Payload, &event); err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(ctx, Timeout)
+		defer cancel()
+		return dlh.notifier.Notify(ctx, event)
+	case NotificationRecurringDonation:
+		var event notifier.RecurringDonationEvent
+		if err := json.Unmarshal(dl.Payload, &event); err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(ctx, Timeout)
+		defer cancel()
+		return dlh.notifier.NotifyRecurring(ctx, event)
+	case NotificationPaymentFailed, NotificationRefund, NotificationDispute:
+		var event notifier.PaymentEvent
+		if err := json.Unmarshal(dl.Payload, &event); err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(ctx, Timeout)
+		defer cancel()
+		return dlh.notifier.NotifyPayment(ctx, event)
+	default:
+		return fmt.Errorf("cannot redrive notifications of type %q", dl.Type)
+	}
+}
@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/digest"
+	"github.com/vedrankolka/donation-server/pkg/store"
+	"go.uber.org/zap"
+)
+
+// DigestHandler serves the daily digest of donations.
+type DigestHandler struct {
+	donations store.DonationStore
+	customers store.CustomerStore
+}
+
+// NewDigestHandler creates a DigestHandler of the donations in the stores.
+func NewDigestHandler(donations store.DonationStore, customers store.CustomerStore) *DigestHandler {
+	return &DigestHandler{donations: donations, customers: customers}
+}
+
+// HandleDigest serves GET /admin/digest?day=YYYY-MM-DD, the digest of the
+// UTC day, yesterday by default.
+func (dh *DigestHandler) HandleDigest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	day := digest.Day(time.Now())
+	if s := r.URL.Query().Get("day"); s != "" {
+		var err error
+		if day, err = time.Parse("2006-01-02", s); err != nil {
+			writeJSONErrorMessage(w, "day must be a date like 2024-01-31", http.StatusBadRequest)
+			return
+		}
+	}
+
+	d, err := digest.Generate(r.Context(), dh.donations, dh.customers, day)
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not generate digest", zap.Error(err))
+		writeJSONErrorMessage(w, "Could not generate digest", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, d)
+}
@@ -0,0 +1,186 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/auth"
+	"github.com/vedrankolka/donation-server/pkg/store"
+	"go.uber.org/zap"
+)
+
+// maxInteractionText is the maximum length of the text of an interaction.
+const maxInteractionText = 10000
+
+// DonorHandler serves the admin API of donor records and their interaction history.
+type DonorHandler struct {
+	customers    store.CustomerStore
+	interactions store.InteractionStore
+	tags         store.TagStore
+}
+
+// NewDonorHandler creates a DonorHandler reading from and writing to the stores.
+func NewDonorHandler(customers store.CustomerStore, interactions store.InteractionStore, tags store.TagStore) *DonorHandler {
+	return &DonorHandler{
+		customers:    customers,
+		interactions: interactions,
+		tags:         tags,
+	}
+}
+
+// interactionRequest is the body of a new interaction.
+type interactionRequest struct {
+	Type   string `json:"type"`
+	Text   string `json:"text"`
+	Author string `json:"author"`
+	// OccurredAt defaults to now.
+	OccurredAt *time.Time `json:"occurredAt"`
+}
+
+// HandleDonors routes the /admin/donors/{customerID} endpoints:
+//
+//	GET    /admin/donors/{customerID}                     the donor's summary
+//	GET    /admin/donors/{customerID}/interactions        lists notes and interactions, see store.InteractionListSpec
+//	POST   /admin/donors/{customerID}/interactions        adds a note or logs an interaction
+//	GET    /admin/donors/{customerID}/interactions/{id}   shows one
+//	DELETE /admin/donors/{customerID}/interactions/{id}   deletes one
+//	PUT    /admin/donors/{customerID}/tags/{tag}          tags the donor
+//	DELETE /admin/donors/{customerID}/tags/{tag}          untags the donor
+func (dh *DonorHandler) HandleDonors(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/donors/"), "/")
+	parts := strings.Split(path, "/")
+	if path == "" || (len(parts) > 1 && parts[1] != "interactions" && parts[1] != "tags") || len(parts) > 3 ||
+		(parts[len(parts)-1] == "tags") {
+		http.NotFound(w, r)
+		return
+	}
+
+	customer, err := dh.customers.GetCustomer(r.Context(), parts[0])
+	if errors.Is(err, store.ErrNotFound) {
+		writeJSONErrorMessage(w, fmt.Sprintf("donor %q does not exist", parts[0]), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not get donor", zap.String("customer", parts[0]), zap.Error(err))
+		writeJSONErrorMessage(w, "Could not get donor", http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case len(parts) == 3 && parts[1] == "tags":
+		handleTagging(w, r, dh.tags, store.TaggedDonor, customer.ID, parts[2])
+	case len(parts) == 1 && r.Method == "GET":
+		writeJSON(w, customer)
+	case len(parts) == 2 && r.Method == "GET":
+		dh.listInteractions(w, r, customer.ID)
+	case len(parts) == 2 && r.Method == "POST":
+		dh.addInteraction(w, r, customer.ID)
+	case len(parts) == 3 && (r.Method == "GET" || r.Method == "DELETE"):
+		dh.interaction(w, r, customer.ID, parts[2])
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (dh *DonorHandler) listInteractions(w http.ResponseWriter, r *http.Request, customerID string) {
+	q, ok := parseListQuery(w, r, store.InteractionListSpec)
+	if !ok {
+		return
+	}
+
+	interactions, next, err := dh.interactions.ListInteractions(r.Context(), customerID, q)
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not list interactions", zap.String("customer", customerID), zap.Error(err))
+		writeJSONErrorMessage(w, "Could not list interactions", http.StatusInternalServerError)
+		return
+	}
+
+	writeList(w, interactions, next)
+}
+
+func (dh *DonorHandler) addInteraction(w http.ResponseWriter, r *http.Request, customerID string) {
+	var req interactionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONErrorMessage(w, "invalid interaction: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Type == "" {
+		req.Type = store.InteractionNote
+	}
+	if err := validateInteraction(req); err != nil {
+		writeJSONErrorMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC()
+	interaction := &store.Interaction{
+		CustomerID: customerID,
+		Type:       req.Type,
+		Text:       req.Text,
+		Author:     strings.TrimSpace(req.Author),
+		CreatedBy:  auth.Principal(r.Context()),
+		OccurredAt: now,
+		CreatedAt:  now,
+	}
+	if req.OccurredAt != nil {
+		interaction.OccurredAt = req.OccurredAt.UTC()
+	}
+
+	if err := dh.interactions.AddInteraction(r.Context(), interaction); err != nil {
+		requestLogger(r.Context()).Error("Could not add interaction", zap.String("customer", customerID), zap.Error(err))
+		writeJSONErrorMessage(w, "Could not add interaction", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSONError(w, interaction, http.StatusCreated)
+}
+
+func validateInteraction(req interactionRequest) error {
+	valid := false
+	for _, kind := range store.InteractionKinds {
+		valid = valid || req.Type == kind
+	}
+	switch {
+	case !valid:
+		return fmt.Errorf("type must be one of %s", strings.Join(store.InteractionKinds, ", "))
+	case strings.TrimSpace(req.Text) == "":
+		return fmt.Errorf("text is required")
+	case len(req.Text) > maxInteractionText:
+		return fmt.Errorf("text is longer than %d bytes", maxInteractionText)
+	case strings.TrimSpace(req.Author) == "":
+		return fmt.Errorf("author is required")
+	case req.OccurredAt != nil && req.OccurredAt.After(time.Now().Add(time.Minute)):
+		return fmt.Errorf("occurredAt is in the future")
+	}
+	return nil
+}
+
+func (dh *DonorHandler) interaction(w http.ResponseWriter, r *http.Request, customerID, id string) {
+	var interaction *store.Interaction
+	var err error
+	if r.Method == "DELETE" {
+		err = dh.interactions.DeleteInteraction(r.Context(), customerID, id)
+	} else {
+		interaction, err = dh.interactions.GetInteraction(r.Context(), customerID, id)
+	}
+
+	if errors.Is(err, store.ErrNotFound) {
+		writeJSONErrorMessage(w, fmt.Sprintf("interaction %q does not exist", id), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not change interaction", zap.String("method", r.Method), zap.String("interaction", id), zap.Error(err))
+		writeJSONErrorMessage(w, "Could not access interaction", http.StatusInternalServerError)
+		return
+	}
+
+	if interaction == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, interaction)
+}
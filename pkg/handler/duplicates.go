@@ -0,0 +1,214 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/autorefund"
+	"github.com/vedrankolka/donation-server/pkg/currency"
+	"github.com/vedrankolka/donation-server/pkg/duplicate"
+	"github.com/vedrankolka/donation-server/pkg/notifier"
+	"github.com/vedrankolka/donation-server/pkg/payments"
+	"github.com/vedrankolka/donation-server/pkg/store"
+	"go.uber.org/zap"
+)
+
+// DuplicateRefundPath is the path of the page donors refund duplicates on.
+const DuplicateRefundPath = "/duplicates/refund"
+
+// duplicates is the configuration of duplicate detection.
+type duplicates struct {
+	policy duplicate.Policy
+	// secret signs the refund links.
+	secret []byte
+	// emails offers donors to refund duplicates, nil if they are only flagged.
+	emails    notifier.EmailNotifier
+	publicURL string
+}
+
+// WithDuplicateDetection flags donations that likely duplicate an earlier
+// one by the policy, see package duplicate. If emails is set, donors are
+// offered to refund refundable duplicates on a page linked from the email,
+// signed with the secret, under the public URL of the server.
+func WithDuplicateDetection(policy duplicate.Policy, secret []byte, emails notifier.EmailNotifier, publicURL string) Option {
+	return func(dh *DonationHandler) {
+		dh.duplicates = &duplicates{
+			policy:    policy,
+			secret:    secret,
+			emails:    emails,
+			publicURL: strings.TrimSuffix(publicURL, "/"),
+		}
+	}
+}
+
+// flagDuplicate sets DuplicateOf of a donation that likely duplicates one in
+// the store. Detection is best effort, a failure only leaves the donation unflagged.
+func (dh *DonationHandler) flagDuplicate(ctx context.Context, donation *store.Donation) {
+	if dh.duplicates == nil || dh.store == nil || donation.Status != store.StatusSucceeded {
+		return
+	}
+	original, err := dh.duplicates.policy.Find(ctx, dh.store, donation)
+	if err != nil {
+		dh.logger(ctx).Warn("Could not look for a duplicate of donation", zap.String("donation", donation.ID), zap.Error(err))
+		return
+	}
+	if original != nil {
+		donation.DuplicateOf = original.ID
+		dh.logger(ctx).Info("Donation likely duplicates another", zap.String("event", "duplicate"),
+			zap.String("donation", donation.ID), zap.String("duplicate_of", original.ID), zap.String("customer", donation.CustomerID))
+	}
+}
+
+// offerDuplicateRefund emails the donor of a refundable duplicate a link to
+// refund it. The email has the same ID for redelivered events, so receivers
+// can drop repeats.
+func (dh *DonationHandler) offerDuplicateRefund(ctx context.Context, donation *store.Donation) {
+	if dh.duplicates == nil || dh.duplicates.emails == nil || donation.CustomerEmail == "" ||
+		!dh.duplicates.policy.Refundable(donation, time.Now()) {
+		return
+	}
+
+	deadline := dh.duplicates.policy.RefundDeadline(donation)
+	link := dh.duplicates.publicURL + DuplicateRefundPath + "?" + url.Values{
+		"donation": {donation.ID},
+		"token":    {duplicate.Sign(dh.duplicates.secret, donation.ID, deadline)},
+	}.Encode()
+	name := donation.CustomerName
+	if name == "" {
+		name = "donor"
+	}
+	email := notifier.Email{
+		ID:      duplicate.EmailKind + "-" + donation.ID,
+		Kind:    duplicate.EmailKind,
+		To:      donation.CustomerEmail,
+		Name:    donation.CustomerName,
+		Subject: "Did you mean to donate twice?",
+		Body: fmt.Sprintf(`Dear %s,
+
+We received two donations of %s from you within a few minutes, the second on %s UTC.
+If you donated twice by mistake, you can refund the second donation here:
+
+%s
+
+The link is valid until %s UTC. If you meant to donate twice, thank you, there is nothing to do.
+`, name, currency.Format(donation.Amount, donation.Currency), donation.CreatedAt.Format("January 2, 2006 at 15:04"),
+			link, deadline.Format("January 2, 2006 at 15:04")),
+	}
+	if err := dh.duplicates.emails.NotifyEmail(ctx, email); err != nil {
+		dh.logger(ctx).Warn("Could not offer a refund of duplicate donation", zap.String("donation", donation.ID), zap.Error(err))
+		return
+	}
+	dh.logger(ctx).Info("Offered a refund of duplicate donation", zap.String("donation", donation.ID),
+		zap.String("customer", donation.CustomerID))
+}
+
+var duplicateRefundPage = template.Must(template.New("refund").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1"><title>Refund a duplicate donation</title></head>
+<body>
+<h1>Refund a duplicate donation</h1>
+{{if .Message}}<p>{{.Message}}</p>{{else}}
+<p>Your donation of {{.Amount}} on {{.Date}} UTC was made a few minutes after another donation of the same amount.</p>
+<form method="post">
+<input type="hidden" name="donation" value="{{.Donation}}">
+<input type="hidden" name="token" value="{{.Token}}">
+<button type="submit">Refund this donation</button>
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+// HandleRefundDuplicate serves the page donors refund a duplicate donation on,
+// DuplicateRefundPath?donation=ch_123&token=..., linked from the email
+// offering the refund. GET shows the donation and POST refunds it, so link
+// scanners of mail servers opening the link refund nothing.
+func (dh *DonationHandler) HandleRefundDuplicate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page := struct {
+		Donation, Token, Amount, Date, Message string
+	}{Donation: r.Form.Get("donation"), Token: r.Form.Get("token")}
+	status := http.StatusOK
+	render := func() {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.WriteHeader(status)
+		if err := duplicateRefundPage.Execute(w, page); err != nil {
+			dh.logger(r.Context()).Warn("Could not render the duplicate refund page", zap.Error(err))
+		}
+	}
+
+	if dh.duplicates == nil || dh.store == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if err := duplicate.Verify(dh.duplicates.secret, page.Donation, page.Token, time.Now()); err != nil {
+		page.Message, status = "The link is invalid.", http.StatusForbidden
+		if err == duplicate.ErrExpiredToken {
+			page.Message = "The link has expired, please contact us."
+		}
+		render()
+		return
+	}
+	donation, err := dh.store.GetDonation(r.Context(), page.Donation)
+	if errors.Is(err, store.ErrNotFound) {
+		page.Message, status = "The donation was not found.", http.StatusNotFound
+		render()
+		return
+	}
+	if err != nil {
+		dh.logger(r.Context()).Error("Could not get donation", zap.String("donation", page.Donation), zap.Error(err))
+		page.Message, status = "Something went wrong, please try again later.", http.StatusInternalServerError
+		render()
+		return
+	}
+	page.Amount = currency.Format(donation.Amount, donation.Currency)
+	page.Date = donation.CreatedAt.Format("January 2, 2006 at 15:04")
+
+	switch {
+	case donation.Status == store.StatusRefunded:
+		page.Message = "The donation was refunded."
+	case !dh.duplicates.policy.Refundable(donation, time.Now()):
+		page.Message, status = "The donation can no longer be refunded here, please contact us.", http.StatusConflict
+	case r.Method == "POST":
+		if err := dh.refundDuplicate(r.Context(), donation); err != nil {
+			dh.logger(r.Context()).Error("Could not refund duplicate donation", zap.String("donation", donation.ID), zap.Error(err))
+			page.Message, status = "The donation could not be refunded, please try again later.", http.StatusBadGateway
+		} else {
+			page.Message = "The donation was refunded. It can take a few days until you see the refund on your statement."
+		}
+	}
+	render()
+}
+
+// refundDuplicate refunds a duplicate donation the donor confirmed.
+func (dh *DonationHandler) refundDuplicate(ctx context.Context, donation *store.Donation) error {
+	refundID, err := dh.refund(ctx, donation, autorefund.Decision{
+		Rule:     duplicate.EmailKind,
+		Trigger:  autorefund.TriggerDonorConfirmed,
+		Actor:    "donor " + donation.CustomerID,
+		Reason:   payments.RefundReasonDuplicate,
+		Metadata: map[string]string{"duplicate_of": donation.DuplicateOf},
+	})
+	if err != nil {
+		return err
+	}
+	dh.logger(ctx).Info("Customer refunded duplicate donation", zap.String("event", "duplicate"),
+		zap.String("donation", donation.ID), zap.String("customer", donation.CustomerID), zap.String("refund", refundID))
+	return nil
+}
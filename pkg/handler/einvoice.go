@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/vedrankolka/donation-server/pkg/address"
+	"github.com/vedrankolka/donation-server/pkg/payments"
+)
+
+// Query parameters of /create-payment-intent requesting an invoice for the
+// donation, e.g. by a company whose procurement needs e-invoices.
+const (
+	// InvoiceNameParam is the legal name of the buyer, which requests the
+	// invoice.
+	InvoiceNameParam = "invoice_name"
+	// InvoiceVATIDParam is the VAT identifier of the buyer.
+	InvoiceVATIDParam = "invoice_vat_id"
+	// InvoiceElectronicAddressParam is the Peppol participant ID the buyer
+	// receives e-invoices at, e.g. "0088:7300010000001".
+	InvoiceElectronicAddressParam = "invoice_electronic_address"
+	// InvoiceReferenceParam is the reference the buyer is invoiced with, e.g.
+	// a purchase order number.
+	InvoiceReferenceParam = "invoice_reference"
+)
+
+// InvoiceBuyerKey is the metadata key of a requested invoice, the JSON of its
+// buyer.
+const InvoiceBuyerKey = "invoice_buyer"
+
+// invoiceRequest is the buyer of a requested invoice.
+type invoiceRequest struct {
+	Name              string `json:"name"`
+	VATID             string `json:"vatID,omitempty"`
+	ElectronicAddress string `json:"electronicAddress,omitempty"`
+	Reference         string `json:"reference,omitempty"`
+}
+
+// getInvoiceRequest reads the requested invoice from the query parameters.
+// It returns nil if none is requested.
+func (dh *DonationHandler) getInvoiceRequest(r *http.Request, donorAddress *address.Address) (*invoiceRequest, error) {
+	query := r.URL.Query()
+	req := &invoiceRequest{
+		Name:              strings.TrimSpace(query.Get(InvoiceNameParam)),
+		VATID:             strings.TrimSpace(query.Get(InvoiceVATIDParam)),
+		ElectronicAddress: strings.TrimSpace(query.Get(InvoiceElectronicAddressParam)),
+		Reference:         strings.TrimSpace(query.Get(InvoiceReferenceParam)),
+	}
+	if req.Name == "" {
+		if req.VATID != "" || req.ElectronicAddress != "" || req.Reference != "" {
+			return nil, fmt.Errorf("%s is required to request an invoice", InvoiceNameParam)
+		}
+		return nil, nil
+	}
+	if dh.vatConfig == nil {
+		return nil, errors.New("invoices are not issued")
+	}
+	if donorAddress == nil || donorAddress.Country == "" {
+		return nil, errors.New("an address with a country is required to request an invoice")
+	}
+	if i := strings.Index(req.ElectronicAddress, ":"); req.ElectronicAddress != "" && (i <= 0 || i == len(req.ElectronicAddress)-1) {
+		return nil, fmt.Errorf("%s must be a Peppol participant ID like 0088:7300010000001", InvoiceElectronicAddressParam)
+	}
+	if data, _ := json.Marshal(req); len(data) > maxMetadataValue {
+		return nil, fmt.Errorf("the invoice details must be at most %d bytes", maxMetadataValue)
+	}
+	return req, nil
+}
+
+func addInvoiceMetadata(params *payments.IntentParams, req *invoiceRequest) {
+	data, _ := json.Marshal(req)
+	params.AddMetadata(InvoiceBuyerKey, string(data))
+}
+
+// chargeInvoiceRequest returns the invoice requested for the charge of the
+// event, or nil.
+func chargeInvoiceRequest(event *payments.Event) (*invoiceRequest, error) {
+	data := event.Charge.Metadata[InvoiceBuyerKey]
+	if data == "" {
+		return nil, nil
+	}
+	var req invoiceRequest
+	if err := json.Unmarshal([]byte(data), &req); err != nil {
+		return nil, fmt.Errorf("invalid %s metadata: %w", InvoiceBuyerKey, err)
+	}
+	return &req, nil
+}
@@ -0,0 +1,45 @@
+package handler
+
+import (
+	"time"
+)
+
+// Bounds of numbers read from webhook events. Values out of them are ignored
+// like missing values.
+const (
+	// maxEventAmount is the largest amount, in the smallest currency unit,
+	// that float64 holds exactly, as amounts are notified as float64.
+	// Stripe's maximum is 99999999.
+	maxEventAmount = 1 << 53
+	// maxEventTime is the last second of year 9999, the last time JSON and
+	// RFC 3339 can represent.
+	maxEventTime = 253402300799
+)
+
+// eventAmount returns the amount of a field of an event, if it is
+// non-negative and at most maxEventAmount.
+func eventAmount(amount int64) (int64, bool) {
+	if amount < 0 || amount > maxEventAmount {
+		return 0, false
+	}
+	return amount, true
+}
+
+// eventTime returns the time of a Unix timestamp field of an event, if it is
+// set and before year 10000. Zero is a missing timestamp.
+func eventTime(t int64) (time.Time, bool) {
+	if t <= 0 || t > maxEventTime {
+		return time.Time{}, false
+	}
+	return time.Unix(t, 0).UTC(), true
+}
+
+// eventCreated returns when the event was created, or now if its timestamp is
+// out of the bounds of eventTime.
+func eventCreated(created int64) time.Time {
+	t, ok := eventTime(created)
+	if !ok {
+		return time.Now().UTC()
+	}
+	return t
+}
@@ -0,0 +1,173 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/metrics"
+	"github.com/vedrankolka/donation-server/pkg/payments"
+	"github.com/vedrankolka/donation-server/pkg/requestid"
+	"github.com/vedrankolka/donation-server/pkg/store"
+	"go.uber.org/zap"
+)
+
+// maxRecordedError is the maximum length of an error response kept in the event log.
+const maxRecordedError = 500
+
+var webhookEvents = metrics.NewCounterVec(
+	"donation_server_webhook_events_total",
+	"Verified Stripe events received by the webhook, by type and outcome.",
+	"type", "outcome",
+)
+
+// WithEventLog records how every verified Stripe event was processed.
+func WithEventLog(events store.EventStore) Option {
+	return func(dh *DonationHandler) {
+		dh.events = events
+	}
+}
+
+// responseRecorder remembers the status code and error body of a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	rr.status = status
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	if rr.status >= http.StatusBadRequest && rr.body.Len() < maxRecordedError {
+		rr.body.Write(b)
+	}
+	return rr.ResponseWriter.Write(b)
+}
+
+// recordAttempt counts the outcome of processing the event and saves it in
+// the event log.
+func (dh *DonationHandler) recordAttempt(reqCtx context.Context, event *payments.Event, start time.Time, rr *responseRecorder, outcome string) {
+	attempt := store.EventAttempt{
+		At:         start.UTC(),
+		Outcome:    outcome,
+		StatusCode: rr.status,
+		Duration:   time.Since(start),
+		RequestID:  requestid.FromContext(reqCtx),
+	}
+	if attempt.StatusCode == 0 {
+		attempt.StatusCode = http.StatusOK
+	}
+	if attempt.StatusCode >= http.StatusBadRequest {
+		attempt.Outcome = store.OutcomeFailed
+		attempt.Error = strings.TrimSpace(rr.body.String())
+		if len(attempt.Error) > maxRecordedError {
+			attempt.Error = attempt.Error[:maxRecordedError]
+		}
+	}
+	webhookEvents.Inc(event.Type, attempt.Outcome)
+	if dh.events == nil {
+		return
+	}
+
+	// The request context may be done already, the record should still be saved.
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+
+	if err := dh.events.RecordEventAttempt(ctx, event.ID, event.Type, attempt); err != nil {
+		dh.logger(reqCtx).Error("Could not record processing of event", zap.String("event_id", event.ID), zap.Error(err))
+	}
+}
+
+// recordNotification adds a sent notification to the log of the event.
+func (dh *DonationHandler) recordNotification(ctx context.Context, event *payments.Event, notificationType, key string) {
+	if dh.events == nil {
+		return
+	}
+
+	notification := store.EmittedNotification{
+		At:       time.Now().UTC(),
+		Notifier: notifierName(dh.notifier),
+		Type:     notificationType,
+		Key:      key,
+	}
+	if err := dh.events.RecordNotification(ctx, event.ID, notification); err != nil {
+		dh.logger(ctx).Error("Could not record notification of event", zap.String("event_id", event.ID), zap.Error(err))
+	}
+}
+
+// notifierName returns the type name of a notifier, e.g. "kafka.KafkaNotifier".
+func notifierName(n interface{}) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", n), "*")
+}
+
+// EventLogHandler serves the log of processed Stripe events.
+type EventLogHandler struct {
+	events store.EventStore
+}
+
+// NewEventLogHandler creates an EventLogHandler reading from the event store.
+func NewEventLogHandler(events store.EventStore) *EventLogHandler {
+	return &EventLogHandler{events: events}
+}
+
+// HandleGetEvent returns how the event in the path /admin/events/{stripeEventID}
+// was processed: when it was received, the outcome of every delivery attempt and
+// the notifications it caused.
+func (eh *EventLogHandler) HandleGetEvent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/admin/events/")
+	if id == "" || strings.Contains(id, "/") {
+		writeJSONErrorMessage(w, "an event ID is required", http.StatusBadRequest)
+		return
+	}
+
+	record, err := eh.events.GetEvent(r.Context(), id)
+	if errors.Is(err, store.ErrNotFound) {
+		writeJSONErrorMessage(w, fmt.Sprintf("event %q was not received", id), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not get event", zap.String("event_id", id), zap.Error(err))
+		writeJSONErrorMessage(w, "Could not get event", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, record)
+}
+
+// HandleListEvents returns a page of processed events on GET /admin/events,
+// see store.EventListSpec for the sort fields and filters.
+func (eh *EventLogHandler) HandleListEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	q, ok := parseListQuery(w, r, store.EventListSpec)
+	if !ok {
+		return
+	}
+
+	records, next, err := eh.events.ListEvents(r.Context(), q)
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not list events", zap.Error(err))
+		writeJSONErrorMessage(w, "Could not list events", http.StatusInternalServerError)
+		return
+	}
+
+	writeList(w, records, next)
+}
@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/vedrankolka/donation-server/pkg/metrics"
+	"github.com/vedrankolka/donation-server/pkg/payments"
+	"go.uber.org/zap"
+)
+
+// FallbackPaymentMethodTypes are the payment methods of payment intents
+// created by the fallback, instead of automatic payment methods.
+var FallbackPaymentMethodTypes = []string{"card"}
+
+var paymentIntents = metrics.NewCounterVec(
+	"donation_server_payment_intents_total",
+	"Payment intents created or failed, by currency and outcome.",
+	"currency", "outcome",
+)
+
+var paymentIntentFallbacks = metrics.NewCounterVec(
+	"donation_server_payment_intent_fallbacks_total",
+	"Payment intents Stripe rejected, retried with the fallback configuration, by outcome.",
+	"outcome",
+)
+
+// WithPaymentIntentFallback retries creating payment intents Stripe rejects
+// with a simplified configuration, taking only FallbackPaymentMethodTypes, so
+// donations are still taken during incidents of Stripe's newer features.
+func WithPaymentIntentFallback() Option {
+	return func(dh *DonationHandler) {
+		dh.paymentIntentFallback = true
+	}
+}
+
+// createPaymentIntent creates a payment intent with automatic payment methods,
+// or those not paused if the kill switch knows the payment methods, or, if
+// automatic payment methods are rejected and the fallback is enabled, with the
+// fallback configuration.
+func (dh *DonationHandler) createPaymentIntent(ctx context.Context, params *payments.IntentParams) (*payments.Intent, error) {
+	if params.PaymentMethodTypes == nil {
+		params.PaymentMethodTypes = dh.paymentMethods()
+	}
+	pi, err := dh.createPaymentIntentWithFallback(ctx, params)
+	if err != nil {
+		paymentIntents.Inc(strings.ToUpper(params.Currency), "failed")
+		return nil, err
+	}
+	paymentIntents.Inc(strings.ToUpper(params.Currency), "created")
+	return pi, nil
+}
+
+func (dh *DonationHandler) createPaymentIntentWithFallback(ctx context.Context, params *payments.IntentParams) (*payments.Intent, error) {
+	pi, err := dh.provider.CreateIntent(ctx, params)
+	// Payment methods the kill switch chose are not replaced by the fallback's.
+	if err == nil || !dh.paymentIntentFallback || !fallbackApplies(err) || params.PaymentMethodTypes != nil {
+		return pi, err
+	}
+
+	logger := dh.logger(ctx)
+	logger.Warn("Stripe rejected the payment intent with automatic payment methods, retrying with the fallback configuration",
+		zap.String("event", "fallback"), zap.Strings("payment_method_types", FallbackPaymentMethodTypes), zap.Error(err))
+	fallback := *params
+	fallback.PaymentMethodTypes = FallbackPaymentMethodTypes
+	// A key is only valid with the parameters it was first used with.
+	if params.IdempotencyKey != "" {
+		fallback.IdempotencyKey = params.IdempotencyKey + "-fallback"
+	}
+
+	pi, fallbackErr := dh.provider.CreateIntent(ctx, &fallback)
+	if fallbackErr != nil {
+		paymentIntentFallbacks.Inc("failed")
+		logger.Warn("The fallback configuration was rejected too", zap.String("event", "fallback"), zap.Error(fallbackErr))
+		// The original error tells what went wrong first.
+		return nil, err
+	}
+	paymentIntentFallbacks.Inc("succeeded")
+	logger.Info("Created payment intent with the fallback configuration", zap.String("event", "fallback"), zap.String("payment_intent", pi.ID))
+	return pi, nil
+}
+
+// fallbackApplies reports whether a simplified configuration may succeed
+// where the error occurred: Stripe failed, or rejected the request other than
+// for its amount or currency, which the fallback does not change.
+func fallbackApplies(err error) bool {
+	var providerErr *payments.Error
+	if !errors.As(err, &providerErr) {
+		return false
+	}
+	switch providerErr.Type {
+	case payments.ErrorTypeAPI:
+		return true
+	case payments.ErrorTypeInvalidRequest:
+		return providerErr.Param != "amount" && providerErr.Param != "currency" &&
+			providerErr.Code != payments.ErrorCodeAmountTooSmall && providerErr.Code != payments.ErrorCodeAmountTooLarge
+	default:
+		return false
+	}
+}
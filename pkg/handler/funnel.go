@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/funnel"
+)
+
+// defaultFunnelPeriod is the period of /admin/funnel without from.
+const defaultFunnelPeriod = 30 * 24 * time.Hour
+
+// WithFunnel tracks the anonymous sessions of the donation page with the
+// tracker, from fetching /config to a succeeded payment.
+func WithFunnel(tracker *funnel.Tracker) Option {
+	return func(dh *DonationHandler) {
+		dh.funnel = tracker
+	}
+}
+
+// trackFunnel records that the session of the request reached the step.
+func (dh *DonationHandler) trackFunnel(r *http.Request, step string) {
+	if dh.funnel != nil {
+		dh.funnel.Track(funnel.Session(r), step)
+	}
+}
+
+// FunnelHandler serves the conversion rates of the donation funnel.
+type FunnelHandler struct {
+	tracker *funnel.Tracker
+}
+
+// NewFunnelHandler creates a FunnelHandler of the sessions of the tracker.
+func NewFunnelHandler(tracker *funnel.Tracker) *FunnelHandler {
+	return &FunnelHandler{tracker: tracker}
+}
+
+// HandleFunnel serves GET /admin/funnel?from=2024-03-01&to=2024-03-31, the
+// sessions reaching each step of the funnel and their conversion rates, in
+// total and by the UTC day the sessions started. It defaults to the last 30
+// days.
+func (fh *FunnelHandler) HandleFunnel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	to := time.Now()
+	from := to.Add(-defaultFunnelPeriod)
+	for param, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		if s := r.URL.Query().Get(param); s != "" {
+			var err error
+			if *t, err = time.Parse("2006-01-02", s); err != nil {
+				writeJSONErrorMessage(w, param+" must be a date like 2024-01-31", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if to.Before(from) {
+		writeJSONErrorMessage(w, "from must not be after to", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, fh.tracker.Report(from, to))
+}
@@ -8,22 +8,55 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"net/mail"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/stripe/stripe-go/v72"
-	"github.com/stripe/stripe-go/v72/client"
-	"github.com/stripe/stripe-go/v72/paymentintent"
-	"github.com/stripe/stripe-go/v72/webhook"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/vedrankolka/donation-server/pkg/address"
+	"github.com/vedrankolka/donation-server/pkg/autorefund"
+	"github.com/vedrankolka/donation-server/pkg/clientip"
+	"github.com/vedrankolka/donation-server/pkg/currency"
+	"github.com/vedrankolka/donation-server/pkg/errcatalog"
+	"github.com/vedrankolka/donation-server/pkg/funnel"
+	"github.com/vedrankolka/donation-server/pkg/health"
+	"github.com/vedrankolka/donation-server/pkg/killswitch"
 	"github.com/vedrankolka/donation-server/pkg/notifier"
+	"github.com/vedrankolka/donation-server/pkg/partner"
+	"github.com/vedrankolka/donation-server/pkg/payments"
+	"github.com/vedrankolka/donation-server/pkg/recurring"
+	"github.com/vedrankolka/donation-server/pkg/requestid"
+	"github.com/vedrankolka/donation-server/pkg/rollup"
+	"github.com/vedrankolka/donation-server/pkg/screening"
+	"github.com/vedrankolka/donation-server/pkg/store"
+	"github.com/vedrankolka/donation-server/pkg/tracing"
+	"github.com/vedrankolka/donation-server/pkg/vat"
+	"go.uber.org/zap"
 )
 
 // ErrorResponseMessage represents the structure of the error
 // object sent in failed responses.
 type ErrorResponseMessage struct {
 	Message string `json:"message"`
+	// Code identifies errors clients handle, e.g. "amount_too_small".
+	Code string `json:"code,omitempty"`
+	// Action tells donors what they can do about errors of the payment
+	// provider, e.g. "Please try another card".
+	Action string `json:"action,omitempty"`
+	// RequestID identifies the request in logs, see package requestid.
+	RequestID string `json:"requestId,omitempty"`
+	// AmountLimits are set for amounts out of the limits of their currency.
+	*AmountLimits
+}
+
+// AmountLimits are the limits of amounts in a currency, in its smallest unit.
+type AmountLimits struct {
+	Currency      string `json:"currency"`
+	MinimumAmount int64  `json:"minimumAmount"`
+	MaximumAmount int64  `json:"maximumAmount,omitempty"`
 }
 
 // ErrorResponse represents the structure of the error object sent
@@ -34,226 +67,772 @@ type ErrorResponse struct {
 
 type DonationHandler struct {
 	publishableKey string
-	webhookSecret  string
-	stripeClient   *client.API
+	provider       payments.Provider
 	notifier       notifier.Notifier
+	screener       screening.Provider
+	validator      address.Validator
+	requireAddress bool
+	store          store.DonationStore
+	vatConfig      *vat.Config
+	vatCalculator  vat.Calculator
+	invoices       store.InvoiceStore
+	taxDonations   bool
+	clientIPHeader clientip.Header
+	events         store.EventStore
+	deadLetters    store.DeadLetterStore
+	ackDeadLetters bool
+	// budget of webhook notifications, see WithWebhookBudget, and the
+	// notifications finished after it.
+	budget      time.Duration
+	deferred    sync.WaitGroup
+	health      *health.Monitor
+	duplicates  *duplicates
+	recurring   *recurring.Config
+	autoRefunds *autorefund.Engine
+	campaigns   store.CampaignStore
+	links       store.LinkStore
+	checkout    *checkoutURLs
+	terminal    *terminalConfig
+	kiosks      *kiosks
+	receipts    *receipts
+	killSwitch  *killswitch.Switch
+	funnel      *funnel.Tracker
+	rollups     *rollup.Aggregator
+	// currencies donations are taken in, the first is the default.
+	currencies []currency.Currency
+	// paymentIntentFallback retries rejected payment intents with a simpler configuration.
+	paymentIntentFallback bool
+	// errorCatalog has the messages donors get for errors of the payment provider.
+	errorCatalog *errcatalog.Catalog
+	log          *zap.Logger
+}
+
+// Option configures optional features of a DonationHandler.
+type Option func(*DonationHandler)
+
+// WithHealth reports the status of the server in /config, so the frontend
+// can tell donors what is degraded.
+func WithHealth(monitor *health.Monitor) Option {
+	return func(dh *DonationHandler) {
+		dh.health = monitor
+	}
+}
+
+// WithScreening screens customers against a denied-party list before their
+// first donation is notified. Donations of matching customers are held for review.
+func WithScreening(provider screening.Provider) Option {
+	return func(dh *DonationHandler) {
+		dh.screener = provider
+	}
+}
+
+// WithAddressValidation validates donor addresses with the given validator
+// instead of the address.BasicValidator. If required is set, payment intents
+// are only created for donations with an address.
+func WithAddressValidation(validator address.Validator, required bool) Option {
+	return func(dh *DonationHandler) {
+		dh.validator = validator
+		dh.requireAddress = required
+	}
+}
+
+// WithProvider takes payments with the given provider instead of Stripe.
+func WithProvider(provider payments.Provider) Option {
+	return func(dh *DonationHandler) {
+		dh.provider = provider
+	}
+}
+
+// WithCurrencies takes donations in the currencies instead of only in
+// Currency. The first is the default, in which purchases are priced.
+func WithCurrencies(currencies []currency.Currency) Option {
+	return func(dh *DonationHandler) {
+		dh.currencies = currencies
+	}
+}
+
+// WithErrorCatalog replaces the built-in messages donors get when the payment
+// provider refuses their payment.
+func WithErrorCatalog(catalog *errcatalog.Catalog) Option {
+	return func(dh *DonationHandler) {
+		dh.errorCatalog = catalog
+	}
+}
+
+// WithLogger logs with the logger instead of the global logger of zap.
+func WithLogger(l *zap.Logger) Option {
+	return func(dh *DonationHandler) {
+		dh.log = l
+	}
+}
+
+// WithCampaigns takes donations for the registered campaigns only while they
+// run. Campaigns that are not registered are still taken as free labels.
+func WithCampaigns(campaigns store.CampaignStore) Option {
+	return func(dh *DonationHandler) {
+		dh.campaigns = campaigns
+	}
+}
+
+// WithStore records every donation in the given store.
+func WithStore(s store.DonationStore) Option {
+	return func(dh *DonationHandler) {
+		dh.store = s
+	}
 }
 
 const (
+	// Currency is the default currency of donations.
 	Currency = "EUR"
 	Timeout  = 2 * time.Second
+	// ScreeningStatusKey is the metadata key holding the screening status of
+	// customers and charges.
+	ScreeningStatusKey = "screening_status"
+	// ScreeningMatchesKey is the metadata key describing denied-party list matches.
+	ScreeningMatchesKey = "screening_matches"
+	// CampaignKey is the metadata key of the campaign a payment is for.
+	CampaignKey = "campaign"
+	// PartnerKey is the metadata key of the partner a payment is attributed to.
+	PartnerKey = "partner"
+	// MessageKey is the metadata key of the donor's message.
+	MessageKey = "message"
+	// ClientIPKey is the metadata key of the IP a payment was started from.
+	ClientIPKey = "client_ip"
+	// LinkKey is the metadata key of the donation link a payment was made with.
+	LinkKey = "link"
+	// FunnelSessionKey is the metadata key of the anonymous session of the
+	// donation page a payment was started in, see package funnel.
+	FunnelSessionKey = "funnel_session"
+	// maxMetadataValue is the maximum length of a Stripe metadata value.
+	maxMetadataValue = 500
 )
 
-func NewHandler(publishableKey, webhookSecret string, notifier notifier.Notifier) (*DonationHandler, error) {
+func NewHandler(publishableKey, webhookSecret string, notifier notifier.Notifier, opts ...Option) (*DonationHandler, error) {
 	if publishableKey == "" {
 		return nil, errors.New("a publishableKey cannot be empty.")
 	}
 
+	dh := &DonationHandler{
+		publishableKey: publishableKey,
+		provider:       payments.NewStripe(stripe.Key, webhookSecret),
+		notifier:       notifier,
+		validator:      address.BasicValidator{},
+		currencies:     defaultCurrencies(),
+		errorCatalog:   errcatalog.New(),
+		log:            zap.L(),
+	}
+	for _, opt := range opts {
+		opt(dh)
+	}
+
 	if webhookSecret == "" {
-		log.Println("[WARN] webhookSecret is not set.")
+		dh.log.Warn("webhookSecret is not set")
 	}
 
-	return &DonationHandler{
-		publishableKey: publishableKey,
-		webhookSecret:  webhookSecret,
-		stripeClient:   client.New(stripe.Key, nil),
-		notifier:       notifier,
-	}, nil
+	return dh, nil
+}
+
+// logger returns the logger of the handler with the ID of the request and
+// of the trace of the context.
+func (dh *DonationHandler) logger(ctx context.Context) *zap.Logger {
+	return contextLogger(ctx, dh.log)
+}
+
+// requestLogger returns the global logger with the request and trace IDs of
+// the context, for the handlers without a logger of their own.
+func requestLogger(ctx context.Context) *zap.Logger {
+	return contextLogger(ctx, zap.L())
+}
+
+func contextLogger(ctx context.Context, l *zap.Logger) *zap.Logger {
+	logger := requestid.Logger(ctx, l)
+	if sc := tracing.FromContext(ctx); sc.IsValid() {
+		logger = logger.With(zap.String(tracing.LogField, sc.TraceIDString()))
+	}
+	return logger
 }
 
 // HandleConfig returns the public key for creating a PaymentIntent.
 func (dh *DonationHandler) HandleConfig(w http.ResponseWriter, r *http.Request) {
-	log.Println("/config called.")
+	dh.logger(r.Context()).Debug("/config called")
 	if r.Method != "GET" {
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return
 	}
-	dh.writeJSON(w, struct {
-		PublishableKey string `json:"publishableKey"`
+	dh.trackFunnel(r, funnel.StepConfig)
+	resp := struct {
+		PublishableKey string              `json:"publishableKey"`
+		Currency       string              `json:"currency"`
+		Currencies     []currency.Currency `json:"currencies"`
+		RecurringTiers []recurring.Tier    `json:"recurringTiers,omitempty"`
+		// Payments tells what is paused, see WithKillSwitch.
+		Payments *killswitch.Status `json:"payments,omitempty"`
+		*health.Report
 	}{
 		PublishableKey: dh.publishableKey,
-	})
+		Currency:       dh.currencies[0].Code,
+		Currencies:     dh.currencies,
+	}
+	if dh.recurring != nil {
+		resp.RecurringTiers = dh.recurring.Tiers
+	}
+	if dh.killSwitch != nil {
+		status := dh.killSwitch.Status()
+		resp.Payments = &status
+		// Caches revalidating with If-Modified-Since learn of pauses.
+		if changed := dh.killSwitch.Changed(); !changed.IsZero() {
+			w.Header().Set("Last-Modified", changed.Format(http.TimeFormat))
+		}
+	}
+	if dh.health != nil {
+		report := dh.health.Report(false)
+		resp.Report = &report
+	}
+	writeJSON(w, resp)
 }
 
-// HandleCreatePaymentIntent creates a payment intent.
+// HandleCreatePaymentIntent creates a payment intent, of the query
+// parameters or of a JSON body.
 func (dh *DonationHandler) HandleCreatePaymentIntent(w http.ResponseWriter, r *http.Request) {
+	logger := dh.logger(r.Context())
+	bodyRequest, err := readIntentBody(r)
+	if err != nil {
+		var reqErr *requestError
+		errors.As(err, &reqErr)
+		logger.Info("Invalid request body", zap.Error(err))
+		writeJSONErrorMessage(w, reqErr.message, reqErr.status)
+		return
+	}
+	r = bodyRequest
+	if !dh.checkPaused(w) {
+		return
+	}
+
+	donationCurrency, err := findCurrency(dh.currencies, r.URL.Query().Get("currency"))
+	if err != nil {
+		writeJSONErrorMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	amount, err := getAmount(r)
-	if err != nil || amount < 1 {
-		log.Printf("Amount was not set correctly %v\n", err)
+	if err != nil {
+		logger.Info("Amount was not set correctly", zap.Error(err))
+		writeJSONErrorMessage(w, "amount must be a number in the smallest currency unit", http.StatusBadRequest)
+		return
+	}
+	// The donated amount may be zero if something is bought, the total is
+	// checked with the breakdown.
+	items := r.URL.Query().Get("items") != ""
+	if amount < 0 {
+		writeAmountError(w, &currency.AmountError{Amount: amount, Currency: donationCurrency})
 		return
 	}
+	if !items {
+		if err := donationCurrency.Check(amount); err != nil {
+			writeAmountError(w, err.(*currency.AmountError))
+			return
+		}
+	}
 
-	log.Printf("amount = %d\n", amount)
+	logger.Debug("Creating payment intent", zap.Int64("amount", amount), zap.String("currency", donationCurrency.Code))
 
-	params := &stripe.PaymentIntentParams{
-		Amount:   stripe.Int64(amount),
-		Currency: stripe.String(Currency),
-		AutomaticPaymentMethods: &stripe.PaymentIntentAutomaticPaymentMethodsParams{
-			Enabled: stripe.Bool(true),
-		},
+	donorEmail := r.URL.Query().Get(DonorEmailParam)
+	if parsed, err := mail.ParseAddress(donorEmail); donorEmail != "" && (err != nil || parsed.Address != donorEmail) {
+		writeJSONErrorMessage(w, "the donor email is not a valid email address", http.StatusBadRequest)
+		return
+	}
+	message := r.URL.Query().Get(MessageParam)
+	if len(message) > maxMetadataValue {
+		writeJSONErrorMessage(w, fmt.Sprintf("the message must be at most %d bytes", maxMetadataValue), http.StatusBadRequest)
+		return
+	}
+	choices, err := donorChoices(r)
+	if err != nil {
+		writeJSONErrorMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	donorAddress, err := dh.getAddress(r)
+	if err != nil {
+		var validationErr *address.ValidationError
+		if errors.As(err, &validationErr) {
+			logger.Info("Invalid address", zap.Error(err))
+			writeJSONErrorMessage(w, err.Error(), http.StatusBadRequest)
+		} else {
+			logger.Error("Could not validate address", zap.Error(err))
+			writeJSONErrorMessage(w, "Could not validate address", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	breakdown, err := dh.getBreakdown(r, amount, donationCurrency.Code, donorAddress)
+	if err != nil {
+		// Stripe Tax's errors are answered like those of payment intents.
+		var providerErr *payments.Error
+		if errors.As(err, &providerErr) {
+			logger.Warn("Could not calculate taxes", providerErrorFields(providerErr)...)
+			dh.writeProviderError(w, r, providerErr)
+			return
+		}
+		// Stripe Tax could not be reached or did not answer in time.
+		switch FailureReason(err) {
+		case ReasonTimeout:
+			logger.Warn("Tax calculation timed out", zap.Error(err))
+			writeJSONErrorMessage(w, "The tax calculation timed out", http.StatusGatewayTimeout)
+			return
+		case ReasonNetwork, ReasonCanceled:
+			logger.Warn("Could not calculate taxes", zap.Error(err))
+			writeJSONErrorMessage(w, "The tax calculation failed", http.StatusBadGateway)
+			return
+		}
+		logger.Info("Invalid purchase", zap.Error(err))
+		writeJSONErrorMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	invoice, err := dh.getInvoiceRequest(r, donorAddress)
+	if err != nil {
+		writeJSONErrorMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	total := amount
+	if breakdown != nil {
+		total = breakdown.Total
+	}
+	if err := donationCurrency.Check(total); err != nil {
+		writeAmountError(w, err.(*currency.AmountError))
+		return
+	}
+
+	params := &payments.IntentParams{
+		Amount:       total,
+		Currency:     donationCurrency.Code,
+		ReceiptEmail: donorEmail,
+	}
+	if message != "" {
+		params.AddMetadata(MessageKey, message)
+	}
+	for key, value := range choices {
+		params.AddMetadata(key, value)
+	}
+	if donorAddress != nil {
+		addAddressMetadata(params, *donorAddress)
+	}
+	if breakdown != nil {
+		addBreakdownMetadata(params, r.URL.Query().Get("items"), breakdown)
+	}
+	if invoice != nil {
+		addInvoiceMetadata(params, invoice)
+	}
+	if campaign := r.URL.Query().Get(CampaignKey); campaign != "" && len(campaign) <= maxMetadataValue {
+		if err := dh.checkCampaign(r.Context(), campaign); err != nil {
+			writeJSONErrorMessage(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		params.AddMetadata(CampaignKey, campaign)
+	}
+	if partnerID := partner.ID(r.Context()); partnerID != "" {
+		params.AddMetadata(PartnerKey, partnerID)
+	}
+	if code := r.URL.Query().Get(LinkParam); code != "" {
+		if err := dh.checkLink(r.Context(), code); err != nil {
+			writeJSONErrorMessage(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		params.AddMetadata(LinkKey, code)
+	}
+	if ip := clientip.FromRequest(r, dh.clientIPHeader); ip != nil {
+		params.AddMetadata(ClientIPKey, ip.String())
+	}
+	if dh.funnel != nil {
+		if session := funnel.Session(r); session != "" {
+			params.AddMetadata(FunnelSessionKey, session)
+		}
+	}
+	key, err := dh.requestIdempotencyKey(r, "payment-intent", params)
+	if err != nil {
+		writeJSONErrorMessage(w, err.Error(), http.StatusBadRequest)
+		return
 	}
+	params.IdempotencyKey = key
 
-	pi, err := paymentintent.New(params)
+	pi, err := dh.createPaymentIntent(r.Context(), params)
 	if err != nil {
-		// Try to safely cast a generic error to a stripe.Error so that we can get at
-		// some additional Stripe-specific information about what went wrong.
-		if stripeErr, ok := err.(*stripe.Error); ok {
-			fmt.Printf("Other Stripe error occurred: %v\n", stripeErr.Error())
-			dh.writeJSONErrorMessage(w, stripeErr.Error(), 400)
+		// Errors of the provider tell the donor what went wrong, e.g. that the
+		// amount is too small, in the words of the error catalog.
+		var providerErr *payments.Error
+		if errors.As(err, &providerErr) {
+			logger.Warn("The payment provider refused the payment intent", providerErrorFields(providerErr)...)
+			dh.writeProviderError(w, r, providerErr)
 		} else {
-			fmt.Printf("Other error occurred: %v\n", err.Error())
-			dh.writeJSONErrorMessage(w, "Unknown server error", 500)
+			logger.Error("Could not create payment intent", zap.Error(err))
+			writeJSONErrorMessage(w, "Unknown server error", 500)
 		}
 
 		return
 	}
+	dh.trackFunnel(r, funnel.StepIntent)
 
-	dh.writeJSON(w, struct {
-		ClientSecret string `json:"clientSecret"`
+	writeJSON(w, struct {
+		ClientSecret string         `json:"clientSecret"`
+		Amount       int64          `json:"amount"`
+		Currency     string         `json:"currency"`
+		Breakdown    *vat.Breakdown `json:"breakdown,omitempty"`
 	}{
 		ClientSecret: pi.ClientSecret,
+		Amount:       total,
+		Currency:     donationCurrency.Code,
+		Breakdown:    breakdown,
 	})
 }
 
-// HandleWebhook handles an event of a completed checkout.
+// HandleWebhook handles the Stripe events of eventHandlers, and ignores others.
 func (dh *DonationHandler) HandleWebhook(w http.ResponseWriter, r *http.Request) {
-	log.Println("Webhook is called.")
+	logger := dh.logger(r.Context())
+	logger.Debug("Webhook is called")
 	if r.Method != "POST" {
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
-		log.Printf("Tried to access with %q method", r.Method)
+		logger.Info("Webhook called with another method", zap.String("method", r.Method))
 		return
 	}
 
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
-		log.Printf("ioutil.ReadAll: %v", err)
+		logger.Warn("Could not read webhook body", zap.Error(err))
 		return
 	}
 
-	event, err := webhook.ConstructEvent(b, r.Header.Get("Stripe-Signature"), dh.webhookSecret)
+	event, err := dh.provider.VerifyWebhook(r.Context(), b, r.Header)
+	if errors.Is(err, payments.ErrObjectUnavailable) {
+		// Stripe retries the event until the object can be fetched.
+		http.Error(w, "Could not fetch the object of the event", http.StatusInternalServerError)
+		logger.Error("Could not fetch the object of a thin event", zap.Error(err))
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
-		log.Printf("webhook.ConstructEvent: %v", err)
+		logger.Warn("Could not verify webhook", zap.Error(err))
+		return
+	}
+	logger = logger.With(zap.String("event_id", event.ID), zap.String("event_type", event.Type))
+	tracing.SpanFromContext(r.Context()).SetAttributes(tracing.String("stripe.event_id", event.ID), tracing.String("stripe.event_type", event.Type))
+	// Notifiers that queue the notifications dead-letter them by the event.
+	r = r.WithContext(notifier.WithEventID(r.Context(), event.ID))
+	start := time.Now()
+	r = r.WithContext(withWebhookStart(r.Context(), start))
+
+	rr := &responseRecorder{ResponseWriter: w}
+	w = rr
+	outcome := store.OutcomeProcessed
+	defer func() {
+		dh.recordAttempt(r.Context(), event, start, rr, outcome)
+	}()
+
+	handler, ok := eventHandlers[event.Type]
+	switch {
+	case !ok:
+		logger.Debug("The webhook does not handle events of the type")
+		outcome = store.OutcomeIgnored
+	case !handler.hasObject(event):
+		http.Error(w, "The event has no object.", http.StatusBadRequest)
+		logger.Warn("Event has no object")
+		outcome = store.OutcomeIgnored
 		return
+	default:
+		if outcome = handler.handle(dh, w, r, event, logger); outcome == store.OutcomeFailed {
+			return
+		}
 	}
 
-	if event.Type != "charge.succeeded" {
-		log.Printf("This webhook handles charge.succeeded, but got %q\n", event.Type)
-	} else {
-		log.Println("charge.succeeded!")
+	writeJSON(w, nil)
+}
+
+// handleInvoicePaid notifies the payment of a recurring donation.
+func (dh *DonationHandler) handleInvoicePaid(w http.ResponseWriter, r *http.Request, event *payments.Event, logger *zap.Logger) string {
+	if dh.recurring == nil || !isSubscriptionInvoice(event) {
+		logger.Debug("Invoice is not of a recurring donation", zap.String("invoice", event.Invoice.ID))
+		return store.OutcomeIgnored
+	}
+	return dh.notifyRecurring(w, r, event, logger)
+}
 
-		// Get the customer if it exists.
-		customer, err := dh.getCustomer(event)
+// handleChargeSucceeded records and notifies a donation.
+func (dh *DonationHandler) handleChargeSucceeded(w http.ResponseWriter, r *http.Request, event *payments.Event, logger *zap.Logger) string {
+	// Get the customer if it exists.
+	customer, err := dh.getCustomer(r.Context(), event)
+	if err != nil {
+		logger.Error("Could not get customer of event", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return store.OutcomeFailed
+	}
+	// If the customer does not exist, create it.
+	if customer == nil {
+		customer, err = dh.createCustomer(r.Context(), event)
 		if err != nil {
-			log.Printf("Could not fetch customer received event: %v\n", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			logger.Warn("Could not create customer", zap.Error(err))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return store.OutcomeFailed
 		}
-		// If the customer does not exist, create it.
-		if customer == nil {
-			customer, err = dh.createCustomer(event)
-			if err != nil {
-				log.Printf("Could not create customer: %v", err)
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
 
-			log.Printf("Created new customer with id %q and email %q\n", customer.ID, customer.Email)
-		} else {
-			log.Printf("Found existing customer with id %q and email %q\n", customer.ID, customer.Email)
-		}
+		logger.Info("Created customer", zap.String("customer", customer.ID))
+	} else {
+		logger.Debug("Found existing customer", zap.String("customer", customer.ID))
+	}
+	logger = logger.With(zap.String("customer", customer.ID))
+
+	ctx, cancel := context.WithTimeout(r.Context(), Timeout)
+	defer cancel()
+
+	held, err := dh.screenCustomer(ctx, customer, event)
+	if err != nil {
+		logger.Error("Could not screen customer", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return store.OutcomeFailed
+	}
 
-		donationEvent := notifier.DonationEvent{
-			CustomerID:    customer.ID,
-			CustomerName:  customer.Name,
-			CustomerEmail: customer.Email,
-			Amount:        event.Data.Object["amount"].(float64),
-			Currency:      event.Data.Object["currency"].(string),
+	donorAddress := chargeAddress(event)
+	if donorAddress != nil {
+		if err := dh.updateCustomerAddress(ctx, customer, *donorAddress); err != nil {
+			logger.Warn("Could not store address of customer", zap.Error(err))
 		}
+	}
 
-		ctx, cancel := context.WithTimeout(r.Context(), Timeout)
-		defer cancel()
+	donation := newDonation(event, customer, donorAddress, held)
+	dh.recordNewsletterConsent(ctx, customer, donation, logger)
+	if _, err := dh.splitPayment(ctx, event, customer, donation); err != nil {
+		logger.Error("Could not split payment", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return store.OutcomeFailed
+	}
 
-		if err := dh.notifier.Notify(ctx, donationEvent); err != nil {
-			log.Printf("Failed to notify about donation: %v\n", err)
+	// A redelivered event keeps what happened to its donation since, e.g. a
+	// refund or a review, rather than starting over.
+	stored := dh.recorded(ctx, donation.ID)
+	if stored != nil {
+		donation.Status, donation.RefundID, donation.DuplicateOf = stored.Status, stored.RefundID, stored.DuplicateOf
+		held = stored.Status == store.StatusHeld
+	} else {
+		dh.flagDuplicate(ctx, donation)
+		if !held {
+			held = dh.holdForReview(ctx, donation)
+		}
+	}
+	if dh.store != nil {
+		if err := dh.store.SaveDonation(ctx, donation); err != nil {
+			logger.Error("Could not record donation", zap.String("donation", donation.ID), zap.Error(err))
 			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return store.OutcomeFailed
 		}
 	}
+	if dh.funnel != nil {
+		dh.funnel.Track(funnel.ValidSession(event.Charge.Metadata[FunnelSessionKey]), funnel.StepSucceeded)
+	}
+	dh.updateKioskPayment(ctx, event.Charge.Metadata, store.KioskPaymentSucceeded, donation.ID, logger)
+	if stored == nil {
+		dh.useLink(ctx, donation, logger)
+	}
 
-	dh.writeJSON(w, nil)
-}
-
-func (dh *DonationHandler) createCustomer(event stripe.Event) (*stripe.Customer, error) {
-	billingDetails, ok := event.Data.Object["billing_details"].(map[string]interface{})
-	if !ok {
-		return nil, errors.New(fmt.Sprintf("Could not read billing_details: %v", billingDetails))
+	if held {
+		logger.Info("Donation is held for review", zap.String("event", "review"), zap.String("donation", donation.ID))
+		return store.OutcomeHeld
+	}
+	if donation.Status == store.StatusRefunded || (stored == nil && dh.autoRefund(ctx, donation)) {
+		logger.Info("Donation was refunded, it is not notified", zap.String("donation", donation.ID))
+		return store.OutcomeProcessed
+	}
+	if stored == nil {
+		dh.sendReceipt(ctx, donation)
+	}
+	if invoice := event.Charge.InvoiceID; invoice != "" && dh.recurring != nil {
+		logger.Debug("Donation pays an invoice, which is notified when it is paid", zap.String("donation", donation.ID), zap.String("invoice", invoice))
+		return store.OutcomeProcessed
 	}
 
-	email, ok := billingDetails["email"].(string)
-	if !ok {
-		return nil, errors.New("Email could not be read from billing_details.")
+	donationEvent := newDonationEvent(donation)
+	deferred, err := dh.notifyWithinBudget(ctx, event, NotificationDonation, donationEvent, donationEvent.CustomerID, func(ctx context.Context) error {
+		return dh.notifier.Notify(notifier.WithChargedAt(ctx, donation.CreatedAt), donationEvent)
+	})
+	if deferred {
+		return store.OutcomeDeferred
 	}
-	name, ok := billingDetails["name"].(string)
-	if !ok {
-		return nil, errors.New("Name could not be read from billing_details.")
+	if err != nil {
+		logger.Error("Failed to notify about donation", zap.String("donation", donation.ID), zap.Error(err))
+		if dh.deadLetter(ctx, event, NotificationDonation, donationEvent, err) {
+			return store.OutcomeDeadLettered
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return store.OutcomeFailed
 	}
+	dh.recordNotification(ctx, event, NotificationDonation, donationEvent.CustomerID)
+	dh.resolveDeadLetter(ctx, event, NotificationDonation)
+	dh.offerDuplicateRefund(ctx, donation)
+	return store.OutcomeProcessed
+}
 
+func (dh *DonationHandler) createCustomer(ctx context.Context, event *payments.Event) (*payments.Customer, error) {
+	email := event.Charge.BillingDetails.Email
+	name := event.Charge.BillingDetails.Name
 	if email == "" || name == "" {
 		return nil, errors.New("Cannot create customer with no email address and name.")
 	}
 
-	return dh.stripeClient.Customers.New(&stripe.CustomerParams{
-		Email: stripe.String(email),
-		Name:  stripe.String(name),
+	return dh.provider.CreateCustomer(ctx, &payments.CustomerParams{
+		Email: email,
+		Name:  name,
+		// Redelivered events create the customer once.
+		IdempotencyKey: idempotencyKey("customer", event.ID),
 	})
 }
 
-func (dh *DonationHandler) getCustomer(event stripe.Event) (*stripe.Customer, error) {
-	var customer *stripe.Customer
+// recorded returns the donation of the ID if it is in the store already,
+// e.g. of a redelivered event, or nil.
+func (dh *DonationHandler) recorded(ctx context.Context, id string) *store.Donation {
+	if dh.store == nil {
+		return nil
+	}
+	donation, err := dh.store.GetDonation(ctx, id)
+	if err != nil {
+		return nil
+	}
+	return donation
+}
+
+// newDonation creates the ledger record of the charge in the event.
+func newDonation(event *payments.Event, customer *payments.Customer, donorAddress *address.Address, held bool) *store.Donation {
+	donation := &store.Donation{
+		CustomerID:    customer.ID,
+		CustomerName:  customer.Name,
+		CustomerEmail: customer.Email,
+		Status:        store.StatusSucceeded,
+		Address:       donorAddress,
+		CreatedAt:     eventCreated(event.Created),
+	}
+	charge := event.Charge
+	donation.ID = charge.ID
+	donation.PaymentIntentID = charge.PaymentIntentID
+	donation.Currency = charge.Currency
+	donation.Campaign = charge.Metadata[CampaignKey]
+	donation.Partner = charge.Metadata[PartnerKey]
+	donation.Link = charge.Metadata[LinkKey]
+	donation.ClientIP = charge.Metadata[ClientIPKey]
+	donation.RoundUpOrder = charge.Metadata[RoundUpOrderKey]
+	donation.Channel = charge.Metadata[ChannelKey]
+	if purchase, ok := charge.Metadata[RoundUpPurchaseAmountKey]; ok {
+		donation.RoundUpPurchaseAmount, _ = strconv.ParseInt(purchase, 10, 64)
+	}
+	if amount, ok := eventAmount(charge.Amount); ok {
+		donation.Amount = amount
+	}
+	donation.CardLast4 = charge.CardLast4
+	addDonorChoices(donation, charge.Metadata)
+	if created, ok := eventTime(charge.Created); ok {
+		donation.CreatedAt = created
+	}
+	if held {
+		donation.Status = store.StatusHeld
+	}
+
+	return donation
+}
+
+// screenCustomer screens a customer that was not screened yet and records the
+// outcome in its metadata. It reports whether the donation in the event should
+// be held for review, in which case the charge is marked as held too.
+func (dh *DonationHandler) screenCustomer(ctx context.Context, customer *payments.Customer, event *payments.Event) (bool, error) {
+	if dh.screener == nil {
+		return false, nil
+	}
+
+	status := customer.Metadata[ScreeningStatusKey]
+	if status == "" {
+		party := screening.Party{
+			Name:    customer.Name,
+			Email:   customer.Email,
+			Country: billingCountry(event),
+		}
+		matches, err := dh.screener.Screen(ctx, party)
+		if err != nil {
+			return false, err
+		}
+
+		status = screening.Status(matches)
+		metadata := map[string]string{ScreeningStatusKey: status}
+		if len(matches) > 0 {
+			metadata[ScreeningMatchesKey] = describeMatches(matches)
+			dh.logger(ctx).Warn("Customer matched the denied-party list", zap.String("event", "review"),
+				zap.String("customer", customer.ID), zap.String("matches", describeMatches(matches)))
+		}
+		if _, err := dh.provider.UpdateCustomer(ctx, customer.ID, &payments.CustomerParams{Metadata: metadata}); err != nil {
+			return false, fmt.Errorf("could not store screening status: %w", err)
+		}
+	}
+
+	if status != screening.StatusHeld {
+		return false, nil
+	}
+
+	if chargeID := event.Charge.ID; chargeID != "" {
+		metadata := map[string]string{ScreeningStatusKey: screening.StatusHeld}
+		if err := dh.provider.UpdatePaymentMetadata(ctx, chargeID, metadata); err != nil {
+			return false, fmt.Errorf("could not mark charge as held: %w", err)
+		}
+	}
+
+	return true, nil
+}
+
+func billingCountry(event *payments.Event) string {
+	return event.Charge.BillingDetails.Address.Country
+}
+
+func describeMatches(matches []screening.Match) string {
+	descriptions := make([]string, len(matches))
+	for i, m := range matches {
+		descriptions[i] = fmt.Sprintf("%s:%s", m.Field, m.Entry)
+		if m.Source != "" {
+			descriptions[i] += " (" + m.Source + ")"
+		}
+	}
+
+	description := strings.Join(descriptions, "; ")
+	if len(description) > maxMetadataValue {
+		description = description[:maxMetadataValue]
+	}
+	return description
+}
+
+func (dh *DonationHandler) getCustomer(ctx context.Context, event *payments.Event) (*payments.Customer, error) {
+	var customer *payments.Customer
 	// Try to get the customer by ID.
-	customerId, ok := event.Data.Object["customer"].(string)
-	if ok {
+	if customerId := event.Charge.CustomerID; customerId != "" {
 		var err error
-		customer, err = dh.stripeClient.Customers.Get(customerId, &stripe.CustomerParams{})
+		customer, err = dh.provider.GetCustomer(ctx, customerId)
 		if err != nil {
 			return nil, errors.New(fmt.Sprintf("Could not fetch customer by ID %q", customerId))
 		}
 	} else {
 		// Try to get customer by email.
-		billingDetails, ok := event.Data.Object["billing_details"].(map[string]interface{})
-		if !ok {
-			return nil, errors.New("Could not read billing_detials from event.")
-		}
-
-		email, ok := billingDetails["email"].(string)
-		if !ok {
+		billingDetails := event.Charge.BillingDetails
+		email := billingDetails.Email
+		if email == "" {
 			return nil, errors.New("Could not read email from billing_details.")
 		}
 
-		iter := dh.stripeClient.Customers.List(&stripe.CustomerListParams{
-			Email: stripe.String(email),
-		})
-
-		if iter.Err() != nil {
-			return nil, errors.New(fmt.Sprintf("Could not fetch customers by email %q: %v", email, iter.Err()))
+		customerList, err := dh.provider.FindCustomers(ctx, email)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not fetch customers by email %q: %v", email, err))
 		}
 
-		customerList := iter.CustomerList().Data
 		if len(customerList) == 0 {
 			return nil, nil
 		} else if len(customerList) == 1 {
 			return customerList[0], nil
 		} else {
 			// Find the first on with the entered name.
-			name, ok := billingDetails["email"].(string)
-			if !ok {
-				return nil, errors.New("Could not read name from billing_details.")
-			}
-
 			for _, c := range customerList {
-				if c.Name == name {
+				if c.Name == billingDetails.Name {
 					return c, nil
 				}
 			}
@@ -266,34 +845,103 @@ func (dh *DonationHandler) getCustomer(event stripe.Event) (*stripe.Customer, er
 	return customer, nil
 }
 
-func (dh *DonationHandler) writeJSON(w http.ResponseWriter, v interface{}) {
+func writeJSON(w http.ResponseWriter, v interface{}) {
 	var buf bytes.Buffer
 	if err := json.NewEncoder(&buf).Encode(v); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("json.NewEncoder.Encode: %v", err)
+		zap.L().Error("Could not encode the response", zap.Error(err))
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if _, err := io.Copy(w, &buf); err != nil {
-		log.Printf("io.Copy: %v", err)
+		zap.L().Error("Could not write the response", zap.Error(err))
 		return
 	}
 }
 
-func (dh *DonationHandler) writeJSONError(w http.ResponseWriter, v interface{}, code int) {
+func writeJSONError(w http.ResponseWriter, v interface{}, code int) {
+	// Headers must be set before the status code is written.
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
-	dh.writeJSON(w, v)
+	writeJSON(w, v)
 	return
 }
 
-func (dh *DonationHandler) writeJSONErrorMessage(w http.ResponseWriter, message string, code int) {
+func writeJSONErrorMessage(w http.ResponseWriter, message string, code int) {
 	resp := &ErrorResponse{
 		Error: &ErrorResponseMessage{
-			Message: message,
+			Message:   message,
+			RequestID: w.Header().Get(requestid.Header),
+		},
+	}
+	writeJSONError(w, resp, code)
+}
+
+// writeProviderError answers 400 Bad Request to a request the payment
+// provider refused, with the message of the error catalog in the language of
+// the donor. The provider's own message is only logged.
+func (dh *DonationHandler) writeProviderError(w http.ResponseWriter, r *http.Request, err *payments.Error) {
+	msg := dh.errorCatalog.ProviderError(err, r.Header.Get("Accept-Language"))
+	w.Header().Set("Content-Language", msg.Language)
+	w.Header().Add("Vary", "Accept-Language")
+	writeJSONError(w, &ErrorResponse{
+		Error: &ErrorResponseMessage{
+			Message:   msg.Message,
+			Code:      msg.Code,
+			Action:    msg.Action,
+			RequestID: w.Header().Get(requestid.Header),
+		},
+	}, http.StatusBadRequest)
+}
+
+// providerErrorFields are the log fields of an error of the payment provider.
+func providerErrorFields(err *payments.Error) []zap.Field {
+	return []zap.Field{zap.Error(err), zap.String("error_type", err.Type), zap.String("error_code", err.Code),
+		zap.String("decline_code", err.DeclineCode), zap.String("param", err.Param), zap.String("provider_request_id", err.RequestID)}
+}
+
+// writeAmountError answers 422 Unprocessable Entity to an amount out of the
+// limits of its currency, with the limits.
+func writeAmountError(w http.ResponseWriter, err *currency.AmountError) {
+	code := payments.ErrorCodeAmountTooSmall
+	if err.TooLarge() {
+		code = payments.ErrorCodeAmountTooLarge
+	}
+	writeJSONError(w, &ErrorResponse{
+		Error: &ErrorResponseMessage{
+			Message:   err.Error(),
+			Code:      code,
+			RequestID: w.Header().Get(requestid.Header),
+			AmountLimits: &AmountLimits{
+				Currency:      err.Currency.Code,
+				MinimumAmount: err.Currency.MinimumAmount,
+				MaximumAmount: err.Currency.MaximumAmount,
+			},
 		},
+	}, http.StatusUnprocessableEntity)
+}
+
+// defaultCurrencies returns the currencies of handlers taking only Currency.
+func defaultCurrencies() []currency.Currency {
+	c, _ := currency.Lookup(Currency)
+	return []currency.Currency{c}
+}
+
+// findCurrency returns the allowed currency with the code, the default, the
+// first, if the code is empty.
+func findCurrency(allowed []currency.Currency, code string) (currency.Currency, error) {
+	if code == "" {
+		return allowed[0], nil
+	}
+	codes := make([]string, len(allowed))
+	for i, c := range allowed {
+		if strings.EqualFold(c.Code, code) {
+			return c, nil
+		}
+		codes[i] = c.Code
 	}
-	dh.writeJSONError(w, resp, code)
+	return currency.Currency{}, fmt.Errorf("currency must be one of %s", strings.Join(codes, ", "))
 }
 
 func getAmount(r *http.Request) (int64, error) {
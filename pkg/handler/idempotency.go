@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/clientip"
+	"github.com/vedrankolka/donation-server/pkg/partner"
+)
+
+// IdempotencyKeyParam is the query parameter of a key the client generates
+// for an attempt to donate, e.g. the widget, so retried requests create a
+// single payment intent.
+const IdempotencyKeyParam = "idempotency_key"
+
+// Lengths of idempotency keys of clients. They must be too long to guess, as
+// a request with the key of another gets its payment intent.
+const (
+	minIdempotencyKey = 16
+	maxIdempotencyKey = 128
+)
+
+// idempotencyKey returns the Stripe idempotency key of an operation on an
+// object, e.g. "customer-evt_123" for the customer created for an event.
+func idempotencyKey(operation, id string) string {
+	return operation + "-" + id
+}
+
+// contentKeyWindow is how long requests of the same content from the same
+// client share the idempotency key derived from it.
+const contentKeyWindow = 10 * time.Minute
+
+// requestIdempotencyKey returns the Stripe idempotency key of an operation of
+// the request, from the client's key if it sent one. Otherwise it is derived
+// from the content of the operation, e.g. its parameters, the client's IP
+// address and user agent and the contentKeyWindow the request falls in, so a
+// client retrying the same request meanwhile gets the same object. Keys of
+// partners' requests include the partner, so they cannot collide with keys
+// of others.
+func (dh *DonationHandler) requestIdempotencyKey(r *http.Request, operation string, content interface{}) (string, error) {
+	key := r.URL.Query().Get(IdempotencyKeyParam)
+	if key == "" {
+		return contentIdempotencyKey(r, operation, content, clientip.FromRequest(r, dh.clientIPHeader), time.Now())
+	}
+	if len(key) < minIdempotencyKey || len(key) > maxIdempotencyKey || !isIdempotencyKey(key) {
+		return "", fmt.Errorf("%s must have %d to %d letters, digits, dashes or underscores", IdempotencyKeyParam, minIdempotencyKey, maxIdempotencyKey)
+	}
+	if partnerID := partner.ID(r.Context()); partnerID != "" {
+		key = partnerID + "-" + key
+	}
+	return idempotencyKey(operation, key), nil
+}
+
+// contentIdempotencyKey returns the idempotency key of an operation of the
+// content, e.g. "payment-intent-<hash>", for requests of the client at the time.
+func contentIdempotencyKey(r *http.Request, operation string, content interface{}, ip net.IP, at time.Time) (string, error) {
+	data, err := json.Marshal(content)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n%d\n", partner.ID(r.Context()), ip, r.UserAgent(), at.Truncate(contentKeyWindow).Unix())
+	h.Write(data)
+	return idempotencyKey(operation, hex.EncodeToString(h.Sum(nil))[:32]), nil
+}
+
+func isIdempotencyKey(key string) bool {
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/payments"
+)
+
+// TestContentIdempotencyKey checks that retries of a request without a
+// client key share its key, and that other requests do not.
+func TestContentIdempotencyKey(t *testing.T) {
+	at := time.Date(2024, 11, 29, 12, 3, 0, 0, time.UTC)
+	ip := net.ParseIP("198.51.100.7")
+	params := &payments.IntentParams{Amount: 2500, Currency: "eur"}
+	key := func(params *payments.IntentParams, ip net.IP, at time.Time, userAgent string) string {
+		r := httptest.NewRequest("POST", "/create-payment-intent", nil)
+		r.Header.Set("User-Agent", userAgent)
+		key, err := contentIdempotencyKey(r, "payment-intent", params, ip, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+
+	first := key(params, ip, at, "Firefox")
+	if retry := key(&payments.IntentParams{Amount: 2500, Currency: "eur"}, ip, at.Add(5*time.Minute), "Firefox"); retry != first {
+		t.Errorf("a retry got the key %s, want %s", retry, first)
+	}
+	for name, other := range map[string]string{
+		"another amount":     key(&payments.IntentParams{Amount: 5000, Currency: "eur"}, ip, at, "Firefox"),
+		"another client":     key(params, net.ParseIP("203.0.113.66"), at, "Firefox"),
+		"another user agent": key(params, ip, at, "Safari"),
+		"a later window":     key(params, ip, at.Add(contentKeyWindow), "Firefox"),
+	} {
+		if other == first {
+			t.Errorf("%s got the key %s of the first request", name, other)
+		}
+	}
+}
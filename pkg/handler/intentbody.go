@@ -0,0 +1,168 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/vedrankolka/donation-server/pkg/address"
+	"github.com/vedrankolka/donation-server/pkg/funnel"
+)
+
+// Query parameters of /create-payment-intent, also taken in its JSON body.
+const (
+	// DonorEmailParam is the email Stripe sends the receipt to.
+	DonorEmailParam = "donor_email"
+	// MessageParam is a message of the donor, kept in the MessageKey metadata.
+	MessageParam = "message"
+)
+
+// maxIntentBody is the maximum size of a JSON body of /create-payment-intent.
+const maxIntentBody = 16 << 10
+
+// intentBody is the JSON body /create-payment-intent takes instead of query
+// parameters, e.g. {"amount": 500, "currency": "eur"}.
+type intentBody struct {
+	Amount         *int64           `json:"amount"`
+	Currency       string           `json:"currency"`
+	DonorEmail     string           `json:"donorEmail"`
+	Message        string           `json:"message"`
+	Items          string           `json:"items"`
+	Campaign       string           `json:"campaign"`
+	IdempotencyKey string           `json:"idempotencyKey"`
+	FunnelSession  string           `json:"funnelSession"`
+	Address        *address.Address `json:"address"`
+	Invoice        *invoiceRequest  `json:"invoice"`
+	Newsletter     *bool            `json:"newsletter"`
+	Anonymous      *bool            `json:"anonymous"`
+	DisplayName    string           `json:"displayName"`
+}
+
+// requestError is an invalid request, answered with its status.
+type requestError struct {
+	status  int
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+// readIntentBody returns the request with the fields of its JSON body as
+// query parameters, overriding those of the URL, so requests with a body and
+// with query parameters are handled alike. Requests without a body are
+// returned as they are.
+func readIntentBody(r *http.Request) (*http.Request, error) {
+	if !acceptsJSON(r.Header.Get("Accept")) {
+		return nil, &requestError{http.StatusNotAcceptable, "responses are application/json"}
+	}
+	contentType := r.Header.Get("Content-Type")
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 && contentType == "" {
+		return r, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		return nil, &requestError{http.StatusUnsupportedMediaType, "the body must be application/json"}
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxIntentBody+1))
+	if err != nil {
+		return nil, &requestError{http.StatusBadRequest, "could not read the body"}
+	}
+	if len(data) > maxIntentBody {
+		return nil, &requestError{http.StatusRequestEntityTooLarge, fmt.Sprintf("the body must be at most %d bytes", maxIntentBody)}
+	}
+
+	var body intentBody
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&body); err != nil {
+		return nil, &requestError{http.StatusBadRequest, bodyErrorMessage(err)}
+	}
+	if decoder.More() {
+		return nil, &requestError{http.StatusBadRequest, "the body must be a single JSON object"}
+	}
+
+	query := r.URL.Query()
+	set := func(param, value string) {
+		if value != "" {
+			query.Set(param, value)
+		}
+	}
+	if body.Amount != nil {
+		query.Set("amount", strconv.FormatInt(*body.Amount, 10))
+	}
+	set("currency", body.Currency)
+	set(DonorEmailParam, body.DonorEmail)
+	set(MessageParam, body.Message)
+	set("items", body.Items)
+	set(CampaignKey, body.Campaign)
+	set(IdempotencyKeyParam, body.IdempotencyKey)
+	set(funnel.SessionParam, body.FunnelSession)
+	set(DisplayNameParam, body.DisplayName)
+	if body.Newsletter != nil {
+		query.Set(NewsletterParam, strconv.FormatBool(*body.Newsletter))
+	}
+	if body.Anonymous != nil {
+		query.Set(AnonymousParam, strconv.FormatBool(*body.Anonymous))
+	}
+	if body.Address != nil {
+		for _, f := range addressFields {
+			query.Del(f.param)
+			set(f.param, *f.get(body.Address))
+		}
+	}
+
+	if body.Invoice != nil {
+		set(InvoiceNameParam, body.Invoice.Name)
+		set(InvoiceVATIDParam, body.Invoice.VATID)
+		set(InvoiceElectronicAddressParam, body.Invoice.ElectronicAddress)
+		set(InvoiceReferenceParam, body.Invoice.Reference)
+	}
+
+	r = r.Clone(r.Context())
+	r.URL.RawQuery = query.Encode()
+	return r, nil
+}
+
+// bodyErrorMessage describes why a JSON body could not be decoded.
+func bodyErrorMessage(err error) string {
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &typeErr) && typeErr.Field == "amount":
+		return "amount must be a number in the smallest currency unit"
+	case errors.As(err, &typeErr):
+		return fmt.Sprintf("%s must be a %s", typeErr.Field, typeErr.Type)
+	case errors.Is(err, io.EOF):
+		return "the body is empty"
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return "unknown field " + strings.TrimPrefix(err.Error(), "json: unknown field ")
+	default:
+		return "the body is not valid JSON"
+	}
+}
+
+// acceptsJSON reports whether a response of application/json is acceptable
+// by the Accept header.
+func acceptsJSON(accept string) bool {
+	if accept == "" {
+		return true
+	}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || params["q"] == "0" || params["q"] == "0.0" {
+			continue
+		}
+		switch mediaType {
+		case "*/*", "application/*", "application/json":
+			return true
+		}
+	}
+	return false
+}
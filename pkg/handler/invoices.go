@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/vedrankolka/donation-server/pkg/store"
+	"github.com/vedrankolka/donation-server/pkg/vat"
+	"go.uber.org/zap"
+)
+
+// InvoiceHandler serves the admin API of issued invoices.
+type InvoiceHandler struct {
+	invoices store.InvoiceStore
+}
+
+// NewInvoiceHandler creates an InvoiceHandler of the invoices in the store.
+func NewInvoiceHandler(invoices store.InvoiceStore) *InvoiceHandler {
+	return &InvoiceHandler{invoices: invoices}
+}
+
+// HandleInvoices routes the /admin/invoices endpoints:
+//
+//	GET /admin/invoices/{number}       shows an invoice
+//	GET /admin/invoices/{number}.xml   exports it as a Peppol BIS Billing 3.0 e-invoice
+//	GET /admin/invoices?charge=        shows the invoice of a charge
+func (ih *InvoiceHandler) HandleInvoices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	number := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/invoices"), "/")
+	ubl := strings.HasSuffix(number, ".xml")
+	number = strings.TrimSuffix(number, ".xml")
+	var invoice *vat.Invoice
+	var err error
+	switch chargeID := r.URL.Query().Get("charge"); {
+	case number != "":
+		invoice, err = ih.invoices.GetInvoice(r.Context(), number)
+	case chargeID != "":
+		invoice, err = ih.invoices.GetInvoiceByCharge(r.Context(), chargeID)
+	default:
+		writeJSONErrorMessage(w, "An invoice number or the charge parameter is required", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, store.ErrNotFound) {
+		writeJSONErrorMessage(w, "No such invoice", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not get invoice", zap.Error(err))
+		writeJSONErrorMessage(w, "Could not get the invoice", http.StatusInternalServerError)
+		return
+	}
+	if !ubl {
+		writeJSON(w, invoice)
+		return
+	}
+
+	data, err := invoice.UBL()
+	if err != nil {
+		// The seller or buyer lacks what e-invoices require.
+		requestLogger(r.Context()).Error("Could not export invoice", zap.String("invoice", invoice.Number), zap.Error(err))
+		writeJSONErrorMessage(w, "The invoice cannot be an e-invoice: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+invoice.Number+`.xml"`)
+	w.Write(data)
+}
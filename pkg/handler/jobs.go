@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/store"
+	"go.uber.org/zap"
+)
+
+// JobHandler serves the admin API of scheduled jobs.
+type JobHandler struct {
+	jobs store.JobStore
+}
+
+// NewJobHandler creates a JobHandler of the jobs in the store.
+func NewJobHandler(jobs store.JobStore) *JobHandler {
+	return &JobHandler{jobs: jobs}
+}
+
+// HandleJobs routes the /admin/jobs endpoints:
+//
+//	GET  /admin/jobs              lists the jobs with their last and next runs
+//	POST /admin/jobs/{name}/run   makes the job due now
+func (jh *JobHandler) HandleJobs(w http.ResponseWriter, r *http.Request) {
+	switch path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/jobs"), "/"); {
+	case path == "" && r.Method == "GET":
+		jobs, err := jh.jobs.ListJobs(r.Context())
+		if err != nil {
+			requestLogger(r.Context()).Error("Could not list jobs", zap.Error(err))
+			writeJSONErrorMessage(w, "Could not list jobs", http.StatusInternalServerError)
+			return
+		}
+		writeList(w, jobs, "")
+	case strings.HasSuffix(path, "/run") && r.Method == "POST":
+		name := strings.TrimSuffix(path, "/run")
+		err := jh.jobs.TriggerJob(r.Context(), name, time.Now())
+		if errors.Is(err, store.ErrNotFound) {
+			writeJSONErrorMessage(w, "No such job", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			requestLogger(r.Context()).Error("Could not trigger job", zap.String("job", name), zap.Error(err))
+			writeJSONErrorMessage(w, "Could not trigger the job", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
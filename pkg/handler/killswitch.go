@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/vedrankolka/donation-server/pkg/auth"
+	"github.com/vedrankolka/donation-server/pkg/killswitch"
+	"github.com/vedrankolka/donation-server/pkg/requestid"
+)
+
+// PausedCode is the error code of donations refused because the payment
+// provider, or every payment method, is paused.
+const PausedCode = "payments_paused"
+
+// WithKillSwitch refuses donations while the payment provider is paused, and
+// offers donors only the payment methods that are not. /config reports what is
+// paused, so the frontend can hide it.
+func WithKillSwitch(s *killswitch.Switch) Option {
+	return func(dh *DonationHandler) {
+		dh.killSwitch = s
+	}
+}
+
+// checkPaused answers 503 Service Unavailable with the reason of the pause
+// and returns false if donations cannot be taken.
+func (dh *DonationHandler) checkPaused(w http.ResponseWriter) bool {
+	if dh.killSwitch == nil {
+		return true
+	}
+	state, paused := dh.killSwitch.Paused()
+	if !paused {
+		return true
+	}
+	message := state.Reason
+	if message == "" {
+		message = "Donations are paused, please try again later"
+	}
+	writeJSONError(w, &ErrorResponse{Error: &ErrorResponseMessage{
+		Message:   message,
+		Code:      PausedCode,
+		RequestID: w.Header().Get(requestid.Header),
+	}}, http.StatusServiceUnavailable)
+	return false
+}
+
+// paymentMethods returns the payment methods donations are taken with, nil
+// for those the provider chooses.
+func (dh *DonationHandler) paymentMethods() []string {
+	if dh.killSwitch == nil {
+		return nil
+	}
+	methods, _ := dh.killSwitch.Available()
+	return methods
+}
+
+// PaymentMethodHandler serves the admin API of the kill switch.
+type PaymentMethodHandler struct {
+	killSwitch *killswitch.Switch
+}
+
+// NewPaymentMethodHandler creates a PaymentMethodHandler of the switch.
+func NewPaymentMethodHandler(s *killswitch.Switch) *PaymentMethodHandler {
+	return &PaymentMethodHandler{killSwitch: s}
+}
+
+// HandlePaymentMethods routes the /admin/payment-methods endpoints:
+//
+//	GET /admin/payment-methods          shows the provider and its payment methods, and what is paused
+//	PUT /admin/payment-methods/{name}   pauses or resumes the provider or a payment method with {"paused", "reason"}
+func (ph *PaymentMethodHandler) HandlePaymentMethods(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/payment-methods"), "/")
+
+	switch {
+	case name == "" && r.Method == "GET":
+		writeJSON(w, ph.killSwitch.Status())
+	case name != "" && !strings.Contains(name, "/") && r.Method == "PUT":
+		ph.update(w, r, name)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (ph *PaymentMethodHandler) update(w http.ResponseWriter, r *http.Request, name string) {
+	var body struct {
+		Paused *bool  `json:"paused"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Paused == nil {
+		writeJSONErrorMessage(w, `the body must be {"paused": true or false, "reason"}`, http.StatusBadRequest)
+		return
+	}
+	if len(body.Reason) > maxMetadataValue {
+		writeJSONErrorMessage(w, "the reason is too long", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	if *body.Paused {
+		err = ph.killSwitch.Pause(name, body.Reason, auth.Principal(r.Context()))
+	} else {
+		err = ph.killSwitch.Resume(name)
+	}
+	if errors.Is(err, killswitch.ErrUnknown) {
+		writeJSONErrorMessage(w, "No such payment provider or payment method", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, ph.killSwitch.Status())
+}
@@ -0,0 +1,439 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/autorefund"
+	"github.com/vedrankolka/donation-server/pkg/currency"
+	"github.com/vedrankolka/donation-server/pkg/kiosk"
+	"github.com/vedrankolka/donation-server/pkg/metrics"
+	"github.com/vedrankolka/donation-server/pkg/payments"
+	"github.com/vedrankolka/donation-server/pkg/store"
+	"go.uber.org/zap"
+)
+
+// Metadata keys of the payments of kiosks.
+const (
+	KioskKey          = "kiosk"
+	KioskOfflineIDKey = "kiosk_offline_id"
+)
+
+const (
+	// KioskQueueExpiry is how long after it was queued offline a payment can
+	// still be started. Older ones are expired, the donor has left.
+	KioskQueueExpiry = 24 * time.Hour
+	// KioskRefundWindow is how long after it was started a payment can be
+	// refunded at its kiosk, e.g. when the donor picked the wrong amount.
+	KioskRefundWindow = 24 * time.Hour
+	// maxKioskReconcile is the number of entries a kiosk reconciles at once.
+	maxKioskReconcile = 100
+)
+
+// Statuses of queued entries only the kiosk knows.
+const (
+	kioskEntryUnknown = "unknown"
+	kioskEntryExpired = "expired"
+)
+
+// offlineID is the ID a kiosk gives a payment in its queue.
+var offlineID = regexp.MustCompile(`^[A-Za-z0-9_-]{8,64}$`)
+
+var kioskPayments = metrics.NewCounterVec(
+	"donation_server_kiosk_payments_total",
+	"Payments of kiosks started, failed to start, expired in their offline queue or refunded.",
+	"outcome",
+)
+
+// kiosks are the kiosks donations are taken with.
+type kiosks struct {
+	store store.KioskStore
+	gate  *kiosk.Gate
+}
+
+// WithKiosks takes donations with the kiosks of the store, whose PINs are
+// checked with the gate.
+func WithKiosks(kioskStore store.KioskStore, gate *kiosk.Gate) Option {
+	return func(dh *DonationHandler) {
+		dh.kiosks = &kiosks{store: kioskStore, gate: gate}
+	}
+}
+
+// HandleKioskConfig returns the configuration of the kiosk of the request,
+// GET /kiosk/config: its {"id", "name", "campaign", "currency", "presets",
+// "customAmounts", "reader"} and the "minimumAmount" and "maximumAmount" of
+// its currency.
+func (dh *DonationHandler) HandleKioskConfig(w http.ResponseWriter, r *http.Request) {
+	k := dh.kiosk(w, r)
+	if k == nil {
+		return
+	}
+	c, err := findCurrency(dh.currencies, k.Currency)
+	if err != nil {
+		writeJSONErrorMessage(w, "the currency of the kiosk is no longer accepted", http.StatusConflict)
+		return
+	}
+	writeJSON(w, struct {
+		ID            string  `json:"id"`
+		Name          string  `json:"name"`
+		Campaign      string  `json:"campaign,omitempty"`
+		Currency      string  `json:"currency"`
+		Presets       []int64 `json:"presets"`
+		CustomAmounts bool    `json:"customAmounts"`
+		Reader        string  `json:"reader,omitempty"`
+		MinimumAmount int64   `json:"minimumAmount"`
+		MaximumAmount int64   `json:"maximumAmount,omitempty"`
+	}{k.ID, k.Name, k.Campaign, c.Code, k.Presets, k.CustomAmounts, k.Reader, c.MinimumAmount, c.MaximumAmount})
+}
+
+// kioskPaymentRequest is the body of POST /kiosk/payment-intents.
+type kioskPaymentRequest struct {
+	Amount int64 `json:"amount"`
+	// OfflineID is the ID of the payment in the kiosk's queue, and QueuedAt
+	// when it was queued, now if it is zero.
+	OfflineID  string    `json:"offlineID"`
+	QueuedAt   time.Time `json:"queuedAt"`
+	DonorEmail string    `json:"donorEmail"`
+}
+
+// HandleKioskPayment starts a payment at the kiosk of the request, POST
+// /kiosk/payment-intents with {"amount": 2500, "offlineID": "q-0001",
+// "queuedAt": "2024-05-01T18:03:00Z"}. The amount must be a preset unless
+// the kiosk takes custom amounts. It returns {"id", "clientSecret",
+// "offlineID", "reader"}.
+//
+// The offline ID makes the request idempotent, so a kiosk replaying its
+// queue after it lost the connection starts every payment once. Payments
+// queued more than KioskQueueExpiry ago are refused with 410 Gone. Kiosks
+// with a reader hand the payment to it, as in-person donations.
+func (dh *DonationHandler) HandleKioskPayment(w http.ResponseWriter, r *http.Request) {
+	k := dh.kiosk(w, r)
+	if k == nil {
+		return
+	}
+	var body kioskPaymentRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxIntentBody)).Decode(&body); err != nil {
+		writeJSONErrorMessage(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if !offlineID.MatchString(body.OfflineID) {
+		writeJSONErrorMessage(w, "offlineID must have 8 to 64 letters, digits, dashes or underscores", http.StatusBadRequest)
+		return
+	}
+	now := time.Now().UTC()
+	if body.QueuedAt.IsZero() || body.QueuedAt.After(now) {
+		body.QueuedAt = now
+	}
+	logger := dh.logger(r.Context()).With(zap.String("kiosk", k.ID), zap.String("offline_id", body.OfflineID))
+
+	// A replayed payment that was started already is answered as it was.
+	existing, err := dh.kiosks.store.GetKioskPayment(r.Context(), k.ID, body.OfflineID)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		logger.Error("Could not get kiosk payment", zap.Error(err))
+		writeJSONErrorMessage(w, "Could not get the payment", http.StatusInternalServerError)
+		return
+	}
+	if existing == nil && now.Sub(body.QueuedAt) > KioskQueueExpiry {
+		kioskPayments.Inc("expired")
+		writeJSONErrorMessage(w, fmt.Sprintf("the payment was queued more than %v ago", KioskQueueExpiry), http.StatusGone)
+		return
+	}
+	if !dh.checkPaused(w) {
+		return
+	}
+
+	c, err := findCurrency(dh.currencies, k.Currency)
+	if err != nil {
+		writeJSONErrorMessage(w, "the currency of the kiosk is no longer accepted", http.StatusConflict)
+		return
+	}
+	if !k.CustomAmounts && !containsAmount(k.Presets, body.Amount) {
+		writeJSONErrorMessage(w, "amount must be one of the presets of the kiosk", http.StatusBadRequest)
+		return
+	}
+	if err := c.Check(body.Amount); err != nil {
+		writeAmountError(w, err.(*currency.AmountError))
+		return
+	}
+	if existing != nil && existing.Amount != body.Amount {
+		writeJSONErrorMessage(w, fmt.Sprintf("payment %q was started with another amount", body.OfflineID), http.StatusConflict)
+		return
+	}
+
+	params := &payments.IntentParams{
+		Amount:         body.Amount,
+		Currency:       c.Code,
+		ReceiptEmail:   body.DonorEmail,
+		IdempotencyKey: idempotencyKey("kiosk-payment", k.ID+"-"+body.OfflineID),
+	}
+	params.AddMetadata(KioskKey, k.ID)
+	params.AddMetadata(KioskOfflineIDKey, body.OfflineID)
+	if k.Campaign != "" {
+		params.AddMetadata(CampaignKey, k.Campaign)
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), Timeout)
+	defer cancel()
+	if k.Reader != "" {
+		if dh.terminal == nil {
+			writeJSONErrorMessage(w, "in-person donations are not configured", http.StatusConflict)
+			return
+		}
+		params.PaymentMethodTypes = []string{payments.PaymentMethodCardPresent}
+		params.AddMetadata(ChannelKey, ChannelInPerson)
+		params.AddMetadata(TerminalReaderKey, k.Reader)
+		if body.DonorEmail == "" && dh.terminal.customer == "" {
+			writeJSONErrorMessage(w, "donorEmail is required", http.StatusBadRequest)
+			return
+		}
+		customer, err := dh.terminalCustomer(ctx, terminalPaymentRequest{DonorEmail: body.DonorEmail}, params.IdempotencyKey)
+		if err != nil {
+			kioskPayments.Inc("failed")
+			dh.writeTerminalError(w, r, "Could not find the customer of the donor", err)
+			return
+		}
+		params.CustomerID = customer
+	}
+
+	intent, err := dh.provider.CreateIntent(ctx, params)
+	if err != nil {
+		kioskPayments.Inc("failed")
+		dh.writeTerminalError(w, r, "Could not create the payment intent", err)
+		return
+	}
+	if k.Reader != "" && existing == nil {
+		if err := dh.provider.ProcessPayment(ctx, k.Reader, intent.ID); err != nil {
+			kioskPayments.Inc("failed")
+			dh.writeTerminalError(w, r, "Could not hand the payment to the reader", err)
+			return
+		}
+	}
+	if existing == nil {
+		payment := &store.KioskPayment{
+			KioskID:         k.ID,
+			OfflineID:       body.OfflineID,
+			PaymentIntentID: intent.ID,
+			Amount:          body.Amount,
+			Currency:        c.Code,
+			Status:          store.KioskPaymentCreated,
+			QueuedAt:        body.QueuedAt,
+			CreatedAt:       now,
+			UpdatedAt:       now,
+		}
+		if err := dh.kiosks.store.SaveKioskPayment(ctx, payment); err != nil {
+			// The intent is created again with the same key when the kiosk retries.
+			logger.Error("Could not save kiosk payment", zap.Error(err))
+			writeJSONErrorMessage(w, "Could not save the payment", http.StatusInternalServerError)
+			return
+		}
+		kioskPayments.Inc("started")
+		logger.Info("Kiosk started a payment", zap.String("payment_intent", intent.ID), zap.Int64("amount", body.Amount))
+	}
+
+	writeJSON(w, struct {
+		ID           string `json:"id"`
+		ClientSecret string `json:"clientSecret"`
+		OfflineID    string `json:"offlineID"`
+		Reader       string `json:"reader,omitempty"`
+	}{intent.ID, intent.ClientSecret, body.OfflineID, k.Reader})
+}
+
+// kioskEntry is an entry of a kiosk's offline queue, as the server knows it.
+type kioskEntry struct {
+	OfflineID     string `json:"offlineID"`
+	Status        string `json:"status"`
+	PaymentIntent string `json:"paymentIntent,omitempty"`
+	Donation      string `json:"donation,omitempty"`
+}
+
+// HandleKioskReconcile tells the kiosk of the request what became of the
+// payments in its offline queue, POST /kiosk/reconcile with {"entries":
+// [{"offlineID": "q-0001", "queuedAt": "2024-05-01T18:03:00Z"}]}. Every
+// entry is answered with its "status": "created", "succeeded", "failed" or
+// "refunded" with the "paymentIntent" and "donation", "unknown" if the
+// payment was not started yet, to be replayed, or "expired" if it is too old
+// to be, to be dropped.
+func (dh *DonationHandler) HandleKioskReconcile(w http.ResponseWriter, r *http.Request) {
+	k := dh.kiosk(w, r)
+	if k == nil {
+		return
+	}
+	var body struct {
+		Entries []struct {
+			OfflineID string    `json:"offlineID"`
+			QueuedAt  time.Time `json:"queuedAt"`
+		} `json:"entries"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxIntentBody)).Decode(&body); err != nil {
+		writeJSONErrorMessage(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if len(body.Entries) > maxKioskReconcile {
+		writeJSONErrorMessage(w, fmt.Sprintf("at most %d entries can be reconciled at once", maxKioskReconcile), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC()
+	entries := make([]kioskEntry, 0, len(body.Entries))
+	for _, e := range body.Entries {
+		entry := kioskEntry{OfflineID: e.OfflineID, Status: kioskEntryUnknown}
+		payment, err := dh.kiosks.store.GetKioskPayment(r.Context(), k.ID, e.OfflineID)
+		switch {
+		case err == nil:
+			entry.Status, entry.PaymentIntent, entry.Donation = payment.Status, payment.PaymentIntentID, payment.DonationID
+		case !errors.Is(err, store.ErrNotFound):
+			dh.logger(r.Context()).Error("Could not get kiosk payment", zap.String("kiosk", k.ID), zap.String("offline_id", e.OfflineID), zap.Error(err))
+			writeJSONErrorMessage(w, "Could not get the payments", http.StatusInternalServerError)
+			return
+		case !e.QueuedAt.IsZero() && now.Sub(e.QueuedAt) > KioskQueueExpiry:
+			entry.Status = kioskEntryExpired
+		}
+		entries = append(entries, entry)
+	}
+	writeJSON(w, struct {
+		Entries []kioskEntry `json:"entries"`
+	}{entries})
+}
+
+// HandleKioskRefund refunds a payment of the kiosk of the request, POST
+// /kiosk/refunds with {"offlineID": "q-0001", "pin": "4711"}, e.g. when the
+// donor picked the wrong amount. Only succeeded payments started within
+// KioskRefundWindow can be refunded. Wrong PINs get 403, and lock the PIN
+// after kiosk.MaxPINAttempts with 429. It returns the entry of the payment.
+func (dh *DonationHandler) HandleKioskRefund(w http.ResponseWriter, r *http.Request) {
+	k := dh.kiosk(w, r)
+	if k == nil {
+		return
+	}
+	var body struct {
+		OfflineID string `json:"offlineID"`
+		PIN       string `json:"pin"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxIntentBody)).Decode(&body); err != nil {
+		writeJSONErrorMessage(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	logger := dh.logger(r.Context()).With(zap.String("kiosk", k.ID), zap.String("offline_id", body.OfflineID))
+	now := time.Now().UTC()
+	switch err := dh.kiosks.gate.CheckPIN(k, body.PIN, now); err {
+	case nil:
+	case kiosk.ErrLocked:
+		logger.Warn("The PIN of the kiosk is locked", zap.String("event", "kiosk"))
+		w.Header().Set("Retry-After", strconv.Itoa(int(kiosk.LockoutPeriod.Seconds())))
+		writeJSONErrorMessage(w, err.Error(), http.StatusTooManyRequests)
+		return
+	default:
+		logger.Warn("A wrong PIN was entered at the kiosk", zap.String("event", "kiosk"))
+		writeJSONErrorMessage(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if dh.store == nil {
+		writeJSONErrorMessage(w, "Donations are not recorded", http.StatusNotFound)
+		return
+	}
+
+	payment, err := dh.kiosks.store.GetKioskPayment(r.Context(), k.ID, body.OfflineID)
+	if errors.Is(err, store.ErrNotFound) {
+		writeJSONErrorMessage(w, fmt.Sprintf("payment %q does not exist", body.OfflineID), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.Error("Could not get kiosk payment", zap.Error(err))
+		writeJSONErrorMessage(w, "Could not get the payment", http.StatusInternalServerError)
+		return
+	}
+	if payment.Status != store.KioskPaymentSucceeded || payment.DonationID == "" {
+		writeJSONErrorMessage(w, fmt.Sprintf("payment %q is %s, only succeeded payments can be refunded", body.OfflineID, payment.Status), http.StatusConflict)
+		return
+	}
+	if now.Sub(payment.CreatedAt) > KioskRefundWindow {
+		writeJSONErrorMessage(w, fmt.Sprintf("payments can be refunded at the kiosk for %v, ask staff to refund it", KioskRefundWindow), http.StatusConflict)
+		return
+	}
+	donation, err := dh.store.GetDonation(r.Context(), payment.DonationID)
+	if err != nil {
+		logger.Error("Could not get donation of kiosk payment", zap.String("donation", payment.DonationID), zap.Error(err))
+		writeJSONErrorMessage(w, "Could not get the donation", http.StatusInternalServerError)
+		return
+	}
+
+	decision := autorefund.Decision{Rule: "kiosk", Trigger: autorefund.TriggerKiosk, Actor: k.ID, Reason: payments.RefundReasonRequestedByCustomer}
+	if donation.Status != store.StatusRefunded {
+		if _, err := dh.refund(r.Context(), donation, decision); err != nil {
+			logger.Error("Could not refund kiosk payment", zap.Error(err))
+			var providerErr *payments.Error
+			if errors.As(err, &providerErr) {
+				writeJSONErrorMessage(w, providerErr.Error(), http.StatusBadGateway)
+			} else {
+				writeJSONErrorMessage(w, "Could not refund the payment", http.StatusInternalServerError)
+			}
+			return
+		}
+	}
+	payment.Status, payment.UpdatedAt = store.KioskPaymentRefunded, now
+	if err := dh.kiosks.store.SaveKioskPayment(r.Context(), payment); err != nil {
+		logger.Error("Could not record refund of kiosk payment", zap.Error(err))
+	}
+	kioskPayments.Inc("refunded")
+	logger.Info("Kiosk payment was refunded with the PIN", zap.String("event", "refund"), zap.String("donation", donation.ID))
+	writeJSON(w, kioskEntry{payment.OfflineID, payment.Status, payment.PaymentIntentID, payment.DonationID})
+}
+
+// kiosk returns the kiosk of the request, answering with 404 if kiosks are
+// not configured and 405 for methods other than GET of /kiosk/config and
+// POST of the others.
+func (dh *DonationHandler) kiosk(w http.ResponseWriter, r *http.Request) *store.Kiosk {
+	k := kiosk.FromContext(r.Context())
+	if dh.kiosks == nil || k == nil {
+		http.NotFound(w, r)
+		return nil
+	}
+	method := "POST"
+	if r.URL.Path == "/kiosk/config" {
+		method = "GET"
+	}
+	if r.Method != method {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return nil
+	}
+	return k
+}
+
+// updateKioskPayment records the status of a payment of a kiosk, from the
+// metadata of its charge or intent. Failures are logged, the kiosk sees the
+// payment as created until a later event.
+func (dh *DonationHandler) updateKioskPayment(ctx context.Context, metadata map[string]string, status, donationID string, logger *zap.Logger) {
+	kioskID, offlineID := metadata[KioskKey], metadata[KioskOfflineIDKey]
+	if dh.kiosks == nil || kioskID == "" || offlineID == "" {
+		return
+	}
+	payment, err := dh.kiosks.store.GetKioskPayment(ctx, kioskID, offlineID)
+	if errors.Is(err, store.ErrNotFound) {
+		return
+	}
+	if err == nil {
+		payment.Status, payment.UpdatedAt = status, time.Now().UTC()
+		if donationID != "" {
+			payment.DonationID = donationID
+		}
+		err = dh.kiosks.store.SaveKioskPayment(ctx, payment)
+	}
+	if err != nil {
+		logger.Warn("Could not record the status of the kiosk payment", zap.String("kiosk", kioskID), zap.String("offline_id", offlineID), zap.Error(err))
+	}
+}
+
+func containsAmount(amounts []int64, amount int64) bool {
+	for _, a := range amounts {
+		if a == amount {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,206 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/auth"
+	"github.com/vedrankolka/donation-server/pkg/currency"
+	"github.com/vedrankolka/donation-server/pkg/kiosk"
+	"github.com/vedrankolka/donation-server/pkg/store"
+	"go.uber.org/zap"
+)
+
+// maxKioskPresets is the number of preset amounts a kiosk can offer.
+const maxKioskPresets = 12
+
+// KioskHandler serves the admin API of kiosks.
+type KioskHandler struct {
+	kiosks store.KioskStore
+	// currencies kiosks can take donations in, the first is the default.
+	currencies []currency.Currency
+}
+
+// NewKioskHandler creates a KioskHandler managing the kiosks in the store,
+// taking donations in the currencies, only Currency if there are none.
+func NewKioskHandler(kiosks store.KioskStore, currencies []currency.Currency) *KioskHandler {
+	if len(currencies) == 0 {
+		currencies = defaultCurrencies()
+	}
+	return &KioskHandler{kiosks: kiosks, currencies: currencies}
+}
+
+// kioskRequest is the body of creating or replacing a kiosk, with the PIN
+// staff refund donations at it with.
+type kioskRequest struct {
+	store.Kiosk
+	PIN string `json:"pin"`
+}
+
+// registeredKiosk is the response to registering a kiosk, the only one with its key.
+type registeredKiosk struct {
+	*store.Kiosk
+	Key string `json:"key"`
+}
+
+// HandleKiosks routes the /admin/kiosks endpoints:
+//
+//	GET    /admin/kiosks        lists kiosks
+//	POST   /admin/kiosks        registers a kiosk, responding with its device key
+//	GET    /admin/kiosks/{id}   shows a kiosk
+//	PUT    /admin/kiosks/{id}   replaces a kiosk, keeping its key and, without a new one, its PIN
+//	DELETE /admin/kiosks/{id}   deletes a kiosk, its key stops working
+func (kh *KioskHandler) HandleKiosks(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/kiosks"), "/")
+
+	switch {
+	case id == "" && r.Method == "GET":
+		kh.list(w, r)
+	case id == "" && r.Method == "POST":
+		kh.save(w, r, nil)
+	case id != "" && !strings.Contains(id, "/"):
+		kh.kiosk(w, r, id)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (kh *KioskHandler) list(w http.ResponseWriter, r *http.Request) {
+	q, ok := parseListQuery(w, r, store.KioskListSpec)
+	if !ok {
+		return
+	}
+
+	kiosks, next, err := kh.kiosks.ListKiosks(r.Context(), q)
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not list kiosks", zap.Error(err))
+		writeJSONErrorMessage(w, "Could not list kiosks", http.StatusInternalServerError)
+		return
+	}
+
+	writeList(w, kiosks, next)
+}
+
+func (kh *KioskHandler) kiosk(w http.ResponseWriter, r *http.Request, id string) {
+	k, err := kh.kiosks.GetKiosk(r.Context(), id)
+	if errors.Is(err, store.ErrNotFound) {
+		writeJSONErrorMessage(w, fmt.Sprintf("kiosk %q does not exist", id), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not get kiosk", zap.String("kiosk", id), zap.Error(err))
+		writeJSONErrorMessage(w, "Could not get kiosk", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, k)
+	case "PUT":
+		kh.save(w, r, k)
+	case "DELETE":
+		if err := kh.kiosks.DeleteKiosk(r.Context(), id); err != nil {
+			requestLogger(r.Context()).Error("Could not delete kiosk", zap.String("kiosk", id), zap.Error(err))
+			writeJSONErrorMessage(w, "Could not delete kiosk", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// save registers a kiosk with a new device key, or replaces existing if it is not nil.
+func (kh *KioskHandler) save(w http.ResponseWriter, r *http.Request, existing *store.Kiosk) {
+	var body kioskRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONErrorMessage(w, "invalid kiosk: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	k := body.Kiosk
+	if err := validateKiosk(&k, kh.currencies); err != nil {
+		writeJSONErrorMessage(w, "invalid kiosk: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.PIN == "" && existing == nil {
+		writeJSONErrorMessage(w, "invalid kiosk: pin is required", http.StatusBadRequest)
+		return
+	}
+	if body.PIN != "" {
+		if err := kiosk.ValidatePIN(body.PIN); err != nil {
+			writeJSONErrorMessage(w, "invalid kiosk: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		hash, err := kiosk.HashPIN(body.PIN)
+		if err != nil {
+			requestLogger(r.Context()).Error("Could not hash kiosk PIN", zap.Error(err))
+			writeJSONErrorMessage(w, "Could not hash the PIN", http.StatusInternalServerError)
+			return
+		}
+		k.PINHash = hash
+	}
+
+	now := time.Now().UTC()
+	var key string
+	if existing != nil {
+		k.ID, k.KeyHash, k.KeyPrefix = existing.ID, existing.KeyHash, existing.KeyPrefix
+		k.CreatedBy, k.CreatedAt, k.LastSeenAt = existing.CreatedBy, existing.CreatedAt, existing.LastSeenAt
+		if k.PINHash == "" {
+			k.PINHash = existing.PINHash
+		}
+	} else {
+		var err error
+		if key, err = kiosk.NewKey(); err != nil {
+			requestLogger(r.Context()).Error("Could not generate kiosk key", zap.Error(err))
+			writeJSONErrorMessage(w, "Could not generate kiosk key", http.StatusInternalServerError)
+			return
+		}
+		k.ID, k.KeyHash, k.KeyPrefix = "", kiosk.Hash(key), key[:len(kiosk.KeyPrefix)+4]
+		k.CreatedBy, k.CreatedAt, k.LastSeenAt = auth.Principal(r.Context()), now, time.Time{}
+	}
+	k.UpdatedAt = now
+
+	if err := kh.kiosks.SaveKiosk(r.Context(), &k); err != nil {
+		requestLogger(r.Context()).Error("Could not save kiosk", zap.Error(err))
+		writeJSONErrorMessage(w, "Could not save kiosk", http.StatusInternalServerError)
+		return
+	}
+
+	if existing != nil {
+		writeJSON(w, k)
+		return
+	}
+	writeJSONError(w, registeredKiosk{&k, key}, http.StatusCreated)
+}
+
+// validateKiosk checks the name, currency and presets of a kiosk, defaulting
+// its currency to the first of the currencies.
+func validateKiosk(k *store.Kiosk, currencies []currency.Currency) error {
+	if strings.TrimSpace(k.Name) == "" {
+		return fmt.Errorf("name is required")
+	}
+	c, err := findCurrency(currencies, k.Currency)
+	if err != nil {
+		return err
+	}
+	k.Currency = c.Code
+	if len(k.Presets) == 0 && !k.CustomAmounts {
+		return fmt.Errorf("presets are required without customAmounts")
+	}
+	if len(k.Presets) > maxKioskPresets {
+		return fmt.Errorf("a kiosk can have at most %d presets", maxKioskPresets)
+	}
+	for _, amount := range k.Presets {
+		if err := c.Check(amount); err != nil {
+			return fmt.Errorf("preset %d: %v", amount, err)
+		}
+	}
+	if len(k.Campaign) > maxMetadataValue {
+		return fmt.Errorf("campaign can have at most %d characters", maxMetadataValue)
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package handler
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/csvsafe"
+	"github.com/vedrankolka/donation-server/pkg/currency"
+	"github.com/vedrankolka/donation-server/pkg/listing"
+	"github.com/vedrankolka/donation-server/pkg/store"
+	"go.uber.org/zap"
+)
+
+// LedgerHandler serves the admin API listing the recorded donations and the
+// customers that made them.
+type LedgerHandler struct {
+	donations store.DonationStore
+	customers store.CustomerStore
+	tags      store.TagStore
+}
+
+// NewLedgerHandler creates a LedgerHandler reading from the stores.
+func NewLedgerHandler(donations store.DonationStore, customers store.CustomerStore, tags store.TagStore) *LedgerHandler {
+	return &LedgerHandler{
+		donations: donations,
+		customers: customers,
+		tags:      tags,
+	}
+}
+
+// HandleDonation routes the /admin/donations/{chargeID} endpoints:
+//
+//	GET    /admin/donations/{chargeID}              shows a donation
+//	PUT    /admin/donations/{chargeID}/tags/{tag}   tags the donation
+//	DELETE /admin/donations/{chargeID}/tags/{tag}   untags the donation
+func (lh *LedgerHandler) HandleDonation(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/donations/"), "/"), "/")
+	if parts[0] == "" || !(len(parts) == 1 || len(parts) == 3 && parts[1] == "tags") {
+		http.NotFound(w, r)
+		return
+	}
+
+	donation, err := lh.donations.GetDonation(r.Context(), parts[0])
+	if errors.Is(err, store.ErrNotFound) {
+		writeJSONErrorMessage(w, fmt.Sprintf("donation %q does not exist", parts[0]), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not get donation", zap.String("donation", parts[0]), zap.Error(err))
+		writeJSONErrorMessage(w, "Could not get donation", http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case len(parts) == 3:
+		handleTagging(w, r, lh.tags, store.TaggedDonation, donation.ID, parts[2])
+	case r.Method == "GET":
+		writeJSON(w, donation)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleListDonations returns a page of donations on GET /admin/donations,
+// see store.DonationListSpec for the sort fields and filters.
+func (lh *LedgerHandler) HandleListDonations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	q, ok := parseListQuery(w, r, store.DonationListSpec)
+	if !ok {
+		return
+	}
+
+	donations, next, err := lh.donations.ListDonations(r.Context(), q)
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not list donations", zap.Error(err))
+		writeJSONErrorMessage(w, "Could not list donations", http.StatusInternalServerError)
+		return
+	}
+
+	writeList(w, donations, next)
+}
+
+// HandleListCustomers returns a page of customers on GET /admin/customers,
+// see store.CustomerListSpec for the sort fields and filters.
+func (lh *LedgerHandler) HandleListCustomers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	q, ok := parseListQuery(w, r, store.CustomerListSpec)
+	if !ok {
+		return
+	}
+
+	customers, next, err := lh.customers.ListCustomers(r.Context(), q)
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not list customers", zap.Error(err))
+		writeJSONErrorMessage(w, "Could not list customers", http.StatusInternalServerError)
+		return
+	}
+
+	writeList(w, customers, next)
+}
+
+// HandleSearchDonors finds customers by parts of their name or email on
+// GET /admin/donors/search?q=..., best matches first, see store.CustomerSearchSpec.
+func (lh *LedgerHandler) HandleSearchDonors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	search := strings.TrimSpace(r.URL.Query().Get("q"))
+	if search == "" {
+		writeJSONErrorMessage(w, "a search query q is required", http.StatusBadRequest)
+		return
+	}
+
+	q, ok := parseListQuery(w, r, store.CustomerSearchSpec)
+	if !ok {
+		return
+	}
+
+	matches, next, err := lh.customers.SearchCustomers(r.Context(), search, q)
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not search donors", zap.Error(err))
+		writeJSONErrorMessage(w, "Could not search donors", http.StatusInternalServerError)
+		return
+	}
+
+	writeList(w, matches, next)
+}
+
+// HandleExportCustomers returns every customer matching the filters, e.g. a
+// segment, as a CSV file on GET /admin/customers/export, for email lists.
+// It takes the sort and filters of GET /admin/customers.
+func (lh *LedgerHandler) HandleExportCustomers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	q, ok := parseListQuery(w, r, store.CustomerListSpec)
+	if !ok {
+		return
+	}
+	q.Limit = listing.MaxLimit
+
+	var customers []*store.Customer
+	for {
+		page, next, err := lh.customers.ListCustomers(r.Context(), q)
+		if err != nil {
+			requestLogger(r.Context()).Error("Could not export customers", zap.Error(err))
+			writeJSONErrorMessage(w, "Could not export customers", http.StatusInternalServerError)
+			return
+		}
+		customers = append(customers, page...)
+		if next == "" {
+			break
+		}
+		if q.Cursor, err = listing.DecodeCursor(next); err != nil {
+			requestLogger(r.Context()).Error("Could not export customers", zap.Error(err))
+			writeJSONErrorMessage(w, "Could not export customers", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": "customers.csv"}))
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "name", "email", "donations", "totals", "first_donation", "last_donation", "tags"})
+	for _, c := range customers {
+		currencies := make([]string, 0, len(c.Totals))
+		for code := range c.Totals {
+			currencies = append(currencies, code)
+		}
+		sort.Strings(currencies)
+		totals := make([]string, len(currencies))
+		for i, code := range currencies {
+			totals[i] = currency.Format(c.Totals[code], code)
+		}
+
+		// Names and emails are chosen by donors, they are escaped for spreadsheets.
+		cw.Write(csvsafe.Row(
+			c.ID,
+			c.Name,
+			c.Email,
+			strconv.Itoa(c.Donations),
+			strings.Join(totals, ", "),
+			c.FirstDonationAt.Format(time.RFC3339),
+			c.LastDonationAt.Format(time.RFC3339),
+			strings.Join(c.Tags, ", "),
+		))
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		requestLogger(r.Context()).Error("Could not write customers", zap.Error(err))
+	}
+}
@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"context"
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/store"
+)
+
+// TestExportCustomersEscapesFormulas checks that names and emails of donors
+// that a spreadsheet would read as formulas are exported as text.
+func TestExportCustomersEscapesFormulas(t *testing.T) {
+	donations := store.NewMemoryStore()
+	for i, donor := range []struct{ id, name, email string }{
+		{"cus_equals", `=HYPERLINK("https://evil.example","Refund")`, "ana@example.com"},
+		{"cus_plus", "+1+2", "+cmd@example.com"},
+		{"cus_minus", "-2+3", "-@example.com"},
+		{"cus_at", "@SUM(1,2)", "@example.com"},
+		{"cus_tab", "\t=1", "tab@example.com"},
+		{"cus_cr", "\r=1", "cr@example.com"},
+		{"cus_plain", "Ana Horvat", "ana.horvat@example.com"},
+	} {
+		d := store.Donation{
+			ID:            donor.id + "_charge",
+			CustomerID:    donor.id,
+			CustomerName:  donor.name,
+			CustomerEmail: donor.email,
+			Amount:        1000,
+			Currency:      "eur",
+			Status:        store.StatusSucceeded,
+			CreatedAt:     time.Date(2024, 11, 1, 0, 0, i, 0, time.UTC),
+		}
+		if err := donations.SaveDonation(context.Background(), &d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	NewLedgerHandler(donations, donations, donations).HandleExportCustomers(w, httptest.NewRequest("GET", "/admin/customers/export", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("the export answered %d: %s", w.Code, w.Body)
+	}
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][2]string{
+		"cus_equals": {`'=HYPERLINK("https://evil.example","Refund")`, "ana@example.com"},
+		"cus_plus":   {"'+1+2", "'+cmd@example.com"},
+		"cus_minus":  {"'-2+3", "'-@example.com"},
+		"cus_at":     {"'@SUM(1,2)", "'@example.com"},
+		"cus_tab":    {"'\t=1", "tab@example.com"},
+		"cus_cr":     {"'\r=1", "cr@example.com"},
+		"cus_plain":  {"Ana Horvat", "ana.horvat@example.com"},
+	}
+	if len(records) != len(want)+1 {
+		t.Fatalf("exported %d rows, want a header and %d customers", len(records), len(want))
+	}
+	for _, record := range records[1:] {
+		id, name, email := record[0], record[1], record[2]
+		if got := [2]string{name, email}; got != want[id] {
+			t.Errorf("customer %s is exported as %q, want %q", id, got, want[id])
+		}
+	}
+}
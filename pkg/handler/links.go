@@ -0,0 +1,438 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/auth"
+	"github.com/vedrankolka/donation-server/pkg/currency"
+	"github.com/vedrankolka/donation-server/pkg/store"
+	"go.uber.org/zap"
+)
+
+// LinkParam is the query parameter of the donation page holding the code of a link.
+const LinkParam = "link"
+
+// ReferrerParam is the query parameter of short URLs tagging the source of a
+// click where browsers send no referrer, e.g. "?ref=sms".
+const ReferrerParam = "ref"
+
+// maxReferrer is the length referrers are cut to.
+const maxReferrer = 100
+
+const (
+	// linkCodeLength is the length of generated codes, of 62^7 possible ones.
+	linkCodeLength = 7
+	linkAlphabet   = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+var (
+	// linkCode allows chosen codes like "gala-2024".
+	linkCode = regexp.MustCompile(`^[A-Za-z0-9_-]{3,32}$`)
+	// linkLocale allows locales of Stripe Elements like "de" or "fr-CA".
+	linkLocale = regexp.MustCompile(`^[a-z]{2}(-[A-Z]{2})?$`)
+)
+
+// LinkHandler serves donation links.
+type LinkHandler struct {
+	links store.LinkStore
+	// publicURL is the URL of the donation page the links open.
+	publicURL string
+	// country returns the country of a request, "" if unknown.
+	country func(r *http.Request) string
+	// currencies links can be for, the first is the default.
+	currencies []currency.Currency
+}
+
+// NewLinkHandler creates a LinkHandler of the links in the store, opening
+// the donation page at the public URL of the server. Clicks are recorded with
+// the country the function returns, which may be nil. Links can be for the
+// currencies donations are taken in, only Currency if there are none.
+func NewLinkHandler(links store.LinkStore, publicURL string, currencies []currency.Currency, country func(r *http.Request) string) *LinkHandler {
+	if country == nil {
+		country = func(*http.Request) string { return "" }
+	}
+	if len(currencies) == 0 {
+		currencies = defaultCurrencies()
+	}
+	return &LinkHandler{links: links, publicURL: strings.TrimSuffix(publicURL, "/"), country: country, currencies: currencies}
+}
+
+// linkResponse is a link with its short URL, tracking clicks.
+type linkResponse struct {
+	*store.Link
+	URL string `json:"url"`
+}
+
+func (lh *LinkHandler) response(link *store.Link) linkResponse {
+	return linkResponse{link, lh.publicURL + "/d/" + link.Code}
+}
+
+// pageURL returns the URL of the donation page opened with the link.
+func (lh *LinkHandler) pageURL(code string) string {
+	return lh.publicURL + "/?" + LinkParam + "=" + url.QueryEscape(code)
+}
+
+// HandleLinks routes the /admin/links endpoints:
+//
+//	GET    /admin/links                 lists links, filtered by campaign, with their uses and clicks
+//	POST   /admin/links                 creates a link from {"code", "amount", "currency", "campaign", "locale", "expiresAt", "maxUses"}
+//	POST   /admin/links/bulk            creates a link per recipient of a CSV list, see bulk
+//	GET    /admin/links/{code}          shows a link
+//	DELETE /admin/links/{code}          deletes a link, it stops working
+//	GET    /admin/links/{code}/clicks   reports the clicks of a link by day, referrer and country
+func (lh *LinkHandler) HandleLinks(w http.ResponseWriter, r *http.Request) {
+	code := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/links"), "/")
+
+	switch {
+	case code == "bulk" && r.Method == "POST":
+		lh.bulk(w, r)
+	case strings.HasSuffix(code, "/clicks") && r.Method == "GET":
+		lh.clicks(w, r, strings.TrimSuffix(code, "/clicks"))
+	case code == "" && r.Method == "GET":
+		lh.list(w, r)
+	case code == "" && r.Method == "POST":
+		lh.create(w, r)
+	case code != "" && !strings.Contains(code, "/") && (r.Method == "GET" || r.Method == "DELETE"):
+		lh.link(w, r, code)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (lh *LinkHandler) list(w http.ResponseWriter, r *http.Request) {
+	q, ok := parseListQuery(w, r, store.LinkListSpec)
+	if !ok {
+		return
+	}
+
+	links, next, err := lh.links.ListLinks(r.Context(), q)
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not list links", zap.Error(err))
+		writeJSONErrorMessage(w, "Could not list links", http.StatusInternalServerError)
+		return
+	}
+
+	list := make([]linkResponse, len(links))
+	for i, link := range links {
+		list[i] = lh.response(link)
+	}
+	writeList(w, list, next)
+}
+
+func (lh *LinkHandler) create(w http.ResponseWriter, r *http.Request) {
+	var link store.Link
+	if err := json.NewDecoder(r.Body).Decode(&link); err != nil {
+		writeJSONErrorMessage(w, "invalid link: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateLink(&link, lh.currencies); err != nil {
+		writeJSONErrorMessage(w, "invalid link: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	link.Uses, link.Clicks = 0, 0
+	link.CreatedBy, link.CreatedAt = auth.Principal(r.Context()), time.Now().UTC()
+
+	err := lh.insert(r.Context(), &link)
+	if errors.Is(err, store.ErrExists) {
+		writeJSONErrorMessage(w, fmt.Sprintf("link %q exists", link.Code), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not create link", zap.Error(err))
+		writeJSONErrorMessage(w, "Could not create link", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSONError(w, lh.response(&link), http.StatusCreated)
+}
+
+func (lh *LinkHandler) link(w http.ResponseWriter, r *http.Request, code string) {
+	var link *store.Link
+	var err error
+	if r.Method == "DELETE" {
+		err = lh.links.DeleteLink(r.Context(), code)
+	} else {
+		link, err = lh.links.GetLink(r.Context(), code)
+	}
+
+	if errors.Is(err, store.ErrNotFound) {
+		writeJSONErrorMessage(w, fmt.Sprintf("link %q does not exist", code), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not change link", zap.String("method", r.Method), zap.String("link", code), zap.Error(err))
+		writeJSONErrorMessage(w, "Could not access link", http.StatusInternalServerError)
+		return
+	}
+
+	if link == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, lh.response(link))
+}
+
+// HandleLink serves GET /links/{code}, the configuration of the donation
+// page opened with a link. Expired links and links out of uses are 410 Gone.
+// Opening the page does not use the link, reloads and mail scanners would,
+// the donations made with it do, see WithLinks.
+func (lh *LinkHandler) HandleLink(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	code := strings.Trim(strings.TrimPrefix(r.URL.Path, "/links"), "/")
+
+	link, err := lh.links.GetLink(r.Context(), code)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		writeJSONErrorMessage(w, "This donation link does not exist.", http.StatusNotFound)
+		return
+	case err != nil:
+		requestLogger(r.Context()).Error("Could not get link", zap.String("link", code), zap.Error(err))
+		writeJSONErrorMessage(w, "Could not open donation link", http.StatusInternalServerError)
+		return
+	case !link.Usable(time.Now()):
+		writeJSONErrorMessage(w, "This donation link has expired or was used up.", http.StatusGone)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, struct {
+		Code     string `json:"code"`
+		Amount   int64  `json:"amount,omitempty"`
+		Currency string `json:"currency"`
+		Campaign string `json:"campaign,omitempty"`
+		Locale   string `json:"locale,omitempty"`
+	}{link.Code, link.Amount, link.Currency, link.Campaign, link.Locale})
+}
+
+// clickReport is the click analytics of a link. Uses count the donations
+// made with the link, opened by short URL or not, and Conversion is their
+// share of the clicks.
+type clickReport struct {
+	Code       string         `json:"code"`
+	Clicks     int            `json:"clicks"`
+	Uses       int            `json:"uses"`
+	Conversion float64        `json:"conversion"`
+	ByDay      []dayClicks    `json:"byDay"`
+	ByReferrer map[string]int `json:"byReferrer"`
+	ByCountry  map[string]int `json:"byCountry"`
+}
+
+type dayClicks struct {
+	// Date in UTC, e.g. "2024-03-05".
+	Date   string `json:"date"`
+	Clicks int    `json:"clicks"`
+}
+
+// Keys of clicks without a referrer or country in reports.
+const (
+	noReferrer     = "direct"
+	unknownCountry = "unknown"
+)
+
+func (lh *LinkHandler) clicks(w http.ResponseWriter, r *http.Request, code string) {
+	link, err := lh.links.GetLink(r.Context(), code)
+	var clicks []store.LinkClick
+	if err == nil {
+		clicks, err = lh.links.ListClicks(r.Context(), code)
+	}
+	if errors.Is(err, store.ErrNotFound) {
+		writeJSONErrorMessage(w, fmt.Sprintf("link %q does not exist", code), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not list clicks of link", zap.String("link", code), zap.Error(err))
+		writeJSONErrorMessage(w, "Could not list clicks", http.StatusInternalServerError)
+		return
+	}
+
+	report := clickReport{
+		Code:       link.Code,
+		Clicks:     len(clicks),
+		Uses:       link.Uses,
+		ByDay:      []dayClicks{},
+		ByReferrer: make(map[string]int),
+		ByCountry:  make(map[string]int),
+	}
+	if len(clicks) > 0 {
+		report.Conversion = float64(link.Uses) / float64(len(clicks))
+	}
+	days := make(map[string]int)
+	for _, click := range clicks {
+		days[click.At.UTC().Format("2006-01-02")]++
+		referrer, country := click.Referrer, click.Country
+		if referrer == "" {
+			referrer = noReferrer
+		}
+		if country == "" {
+			country = unknownCountry
+		}
+		report.ByReferrer[referrer]++
+		report.ByCountry[country]++
+	}
+	for date, n := range days {
+		report.ByDay = append(report.ByDay, dayClicks{date, n})
+	}
+	sort.Slice(report.ByDay, func(i, j int) bool { return report.ByDay[i].Date < report.ByDay[j].Date })
+
+	writeJSON(w, report)
+}
+
+// HandleRedirect serves GET /d/{code}, the short URL of a link, recording a
+// click and redirecting to the donation page opened with the link. Expired
+// links are redirected too, the page tells the donor.
+func (lh *LinkHandler) HandleRedirect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	code := strings.Trim(strings.TrimPrefix(r.URL.Path, "/d"), "/")
+
+	// Link previews of chat apps and mail scanners mostly HEAD, they are not clicks.
+	var err error
+	if r.Method == "GET" {
+		err = lh.links.RecordClick(r.Context(), code, store.LinkClick{
+			At:       time.Now().UTC(),
+			Referrer: clickReferrer(r),
+			Country:  lh.country(r),
+		})
+	} else {
+		_, err = lh.links.GetLink(r.Context(), code)
+	}
+	if errors.Is(err, store.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		// The donor still gets to the page, only the click is lost.
+		requestLogger(r.Context()).Error("Could not record click of link", zap.String("link", code), zap.Error(err))
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, lh.pageURL(code), http.StatusFound)
+}
+
+// clickReferrer returns the source of a click, tagged with ReferrerParam or
+// the host of the referring page.
+func clickReferrer(r *http.Request) string {
+	referrer := r.URL.Query().Get(ReferrerParam)
+	if referrer == "" {
+		if u, err := url.Parse(r.Referer()); err == nil {
+			referrer = strings.TrimPrefix(u.Hostname(), "www.")
+		}
+	}
+	referrer = strings.ToLower(referrer)
+	if len(referrer) > maxReferrer {
+		referrer = referrer[:maxReferrer]
+	}
+	return referrer
+}
+
+// validateLink checks a link to be created, defaulting its currency to the
+// first of the currencies.
+func validateLink(link *store.Link, currencies []currency.Currency) error {
+	if link.Code != "" && !linkCode.MatchString(link.Code) {
+		return fmt.Errorf("code must have 3 to 32 letters, digits, dashes or underscores")
+	}
+	if link.Code == "bulk" {
+		return fmt.Errorf("code %q is reserved", link.Code)
+	}
+	if link.Amount < 0 {
+		return fmt.Errorf("amount cannot be negative")
+	}
+	c, err := findCurrency(currencies, link.Currency)
+	if err != nil {
+		return err
+	}
+	link.Currency = c.Code
+	if link.Amount > 0 {
+		if err := c.Check(link.Amount); err != nil {
+			return err
+		}
+	}
+	if len(link.Campaign) > maxMetadataValue {
+		return fmt.Errorf("campaign can have at most %d characters", maxMetadataValue)
+	}
+	if link.Locale != "" && !linkLocale.MatchString(link.Locale) {
+		return fmt.Errorf("locale must be like \"de\" or \"fr-CA\"")
+	}
+	if link.ExpiresAt != nil && !link.ExpiresAt.After(time.Now()) {
+		return fmt.Errorf("expiresAt must be in the future")
+	}
+	if link.MaxUses < 0 {
+		return fmt.Errorf("maxUses cannot be negative")
+	}
+	return nil
+}
+
+// newLinkCode returns a random code of linkCodeLength letters and digits.
+func newLinkCode() (string, error) {
+	code := make([]byte, linkCodeLength)
+	max := big.NewInt(int64(len(linkAlphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = linkAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// WithLinks attributes payments started with the code of a link in LinkParam
+// to the link, in their metadata, and counts a use of the link for each of
+// their donations. Payments with unknown, expired or used up links are refused.
+func WithLinks(links store.LinkStore) Option {
+	return func(dh *DonationHandler) {
+		dh.links = links
+	}
+}
+
+// checkLink checks that a payment can be started with the link of the code.
+func (dh *DonationHandler) checkLink(ctx context.Context, code string) error {
+	if dh.links == nil {
+		return nil
+	}
+	link, err := dh.links.GetLink(ctx, code)
+	if errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("the donation link %s does not exist", code)
+	}
+	if err != nil {
+		// The donation is taken, only not attributed if the link cannot be used later.
+		dh.logger(ctx).Warn("Could not check link", zap.String("link", code), zap.Error(err))
+		return nil
+	}
+	if !link.Usable(time.Now()) {
+		return fmt.Errorf("the donation link %s has expired or was used up", code)
+	}
+	return nil
+}
+
+// useLink counts a use of the link of a new donation. Donations of payments
+// started before the link ran out are taken anyway, and logged.
+func (dh *DonationHandler) useLink(ctx context.Context, donation *store.Donation, logger *zap.Logger) {
+	if dh.links == nil || donation.Link == "" {
+		return
+	}
+	_, err := dh.links.UseLink(ctx, donation.Link, donation.CreatedAt)
+	if errors.Is(err, store.ErrExpired) {
+		logger.Info("Donation was made with a link that expired or was used up meanwhile", zap.String("link", donation.Link), zap.String("donation", donation.ID))
+		return
+	}
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		logger.Warn("Could not count the use of the link", zap.String("link", donation.Link), zap.String("donation", donation.ID), zap.Error(err))
+	}
+}
@@ -0,0 +1,35 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/vedrankolka/donation-server/pkg/listing"
+	"go.uber.org/zap"
+)
+
+// parseListQuery parses the list parameters of the request. If they are
+// invalid, it answers with 400 Bad Request and reports false.
+func parseListQuery(w http.ResponseWriter, r *http.Request, spec listing.Spec) (listing.Query, bool) {
+	q, err := spec.Parse(r.URL.Query())
+	if err != nil {
+		var listErr *listing.Error
+		if errors.As(err, &listErr) {
+			writeJSONErrorMessage(w, err.Error(), http.StatusBadRequest)
+		} else {
+			requestLogger(r.Context()).Error("Could not parse list query", zap.Error(err))
+			writeJSONErrorMessage(w, "Could not parse list query", http.StatusInternalServerError)
+		}
+		return q, false
+	}
+	return q, true
+}
+
+// writeList writes a page of a list.
+func writeList(w http.ResponseWriter, data interface{}, nextCursor string) {
+	writeJSON(w, listing.Page{
+		Data:       data,
+		NextCursor: nextCursor,
+		HasMore:    nextCursor != "",
+	})
+}
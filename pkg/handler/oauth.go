@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/auth"
+	"github.com/vedrankolka/donation-server/pkg/oauth"
+	"github.com/vedrankolka/donation-server/pkg/store"
+	"go.uber.org/zap"
+)
+
+// OAuthClientHandler serves the admin API of OAuth clients.
+type OAuthClientHandler struct {
+	clients store.OAuthStore
+}
+
+// NewOAuthClientHandler creates an OAuthClientHandler managing the clients in the store.
+func NewOAuthClientHandler(clients store.OAuthStore) *OAuthClientHandler {
+	return &OAuthClientHandler{clients: clients}
+}
+
+// createdClient is the response to creating a client, the only one with its secret.
+type createdClient struct {
+	*store.OAuthClient
+	Secret string `json:"secret"`
+}
+
+// HandleClients routes the /admin/oauth/clients endpoints:
+//
+//	GET    /admin/oauth/clients        lists clients
+//	POST   /admin/oauth/clients        creates a client from {"name", "scopes", "redirectURIs"}, responding with its secret
+//	GET    /admin/oauth/clients/{id}   shows a client
+//	DELETE /admin/oauth/clients/{id}   deletes a client and revokes its tokens
+func (oh *OAuthClientHandler) HandleClients(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/oauth/clients"), "/")
+
+	switch {
+	case id == "" && r.Method == "GET":
+		oh.list(w, r)
+	case id == "" && r.Method == "POST":
+		oh.create(w, r)
+	case id != "" && !strings.Contains(id, "/") && (r.Method == "GET" || r.Method == "DELETE"):
+		oh.client(w, r, id)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (oh *OAuthClientHandler) list(w http.ResponseWriter, r *http.Request) {
+	q, ok := parseListQuery(w, r, store.OAuthClientListSpec)
+	if !ok {
+		return
+	}
+
+	clients, next, err := oh.clients.ListOAuthClients(r.Context(), q)
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not list OAuth clients", zap.Error(err))
+		writeJSONErrorMessage(w, "Could not list OAuth clients", http.StatusInternalServerError)
+		return
+	}
+
+	writeList(w, clients, next)
+}
+
+func (oh *OAuthClientHandler) create(w http.ResponseWriter, r *http.Request) {
+	var client store.OAuthClient
+	if err := json.NewDecoder(r.Body).Decode(&client); err != nil {
+		writeJSONErrorMessage(w, "invalid client: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateOAuthClient(&client); err != nil {
+		writeJSONErrorMessage(w, "invalid client: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	secret, err := oauth.NewSecret("cs_")
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not generate OAuth client secret", zap.Error(err))
+		writeJSONErrorMessage(w, "Could not generate client secret", http.StatusInternalServerError)
+		return
+	}
+	client.ID = ""
+	client.SecretHash = oauth.Hash(secret)
+	client.CreatedBy = auth.Principal(r.Context())
+	client.CreatedAt = time.Now().UTC()
+
+	if err := oh.clients.SaveOAuthClient(r.Context(), &client); err != nil {
+		requestLogger(r.Context()).Error("Could not save OAuth client", zap.Error(err))
+		writeJSONErrorMessage(w, "Could not save OAuth client", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSONError(w, createdClient{&client, secret}, http.StatusCreated)
+}
+
+// validateOAuthClient checks the name, scopes and redirect URIs of a client.
+func validateOAuthClient(client *store.OAuthClient) error {
+	if strings.TrimSpace(client.Name) == "" {
+		return fmt.Errorf("name is required")
+	}
+	if len(client.Scopes) == 0 {
+		return fmt.Errorf("scopes are required")
+	}
+	for _, scope := range client.Scopes {
+		if err := oauth.ValidateScope(scope); err != nil {
+			return err
+		}
+	}
+	for _, uri := range client.RedirectURIs {
+		u, err := url.Parse(uri)
+		if err != nil || !u.IsAbs() || u.Fragment != "" {
+			return fmt.Errorf("redirect URIs must be absolute URIs without a fragment")
+		}
+	}
+	return nil
+}
+
+func (oh *OAuthClientHandler) client(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method == "DELETE" {
+		err := oh.clients.DeleteOAuthClient(r.Context(), id)
+		if errors.Is(err, store.ErrNotFound) {
+			writeJSONErrorMessage(w, fmt.Sprintf("client %q does not exist", id), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			requestLogger(r.Context()).Error("Could not delete OAuth client", zap.String("client", id), zap.Error(err))
+			writeJSONErrorMessage(w, "Could not delete OAuth client", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	client, err := oh.clients.GetOAuthClient(r.Context(), id)
+	if errors.Is(err, store.ErrNotFound) {
+		writeJSONErrorMessage(w, fmt.Sprintf("client %q does not exist", id), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not get OAuth client", zap.String("client", id), zap.Error(err))
+		writeJSONErrorMessage(w, "Could not get OAuth client", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, client)
+}
@@ -0,0 +1,160 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/auth"
+	"github.com/vedrankolka/donation-server/pkg/partner"
+	"github.com/vedrankolka/donation-server/pkg/store"
+	"go.uber.org/zap"
+)
+
+// PartnerHandler serves the admin API of partners.
+type PartnerHandler struct {
+	partners store.PartnerStore
+}
+
+// NewPartnerHandler creates a PartnerHandler managing the partners in the store.
+func NewPartnerHandler(partners store.PartnerStore) *PartnerHandler {
+	return &PartnerHandler{partners: partners}
+}
+
+// createdPartner is the response to creating a partner, the only one with its key.
+type createdPartner struct {
+	*store.Partner
+	Key string `json:"key"`
+}
+
+// HandlePartners routes the /admin/partners endpoints:
+//
+//	GET    /admin/partners        lists partners with the totals of their donations
+//	POST   /admin/partners        creates a partner, responding with its API key
+//	GET    /admin/partners/{id}   shows a partner
+//	PUT    /admin/partners/{id}   replaces a partner, keeping its API key
+//	DELETE /admin/partners/{id}   deletes a partner, its key stops working
+func (ph *PartnerHandler) HandlePartners(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/partners"), "/")
+
+	switch {
+	case id == "" && r.Method == "GET":
+		ph.list(w, r)
+	case id == "" && r.Method == "POST":
+		ph.save(w, r, nil)
+	case id != "" && !strings.Contains(id, "/"):
+		ph.partner(w, r, id)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (ph *PartnerHandler) list(w http.ResponseWriter, r *http.Request) {
+	q, ok := parseListQuery(w, r, store.PartnerListSpec)
+	if !ok {
+		return
+	}
+
+	partners, next, err := ph.partners.ListPartners(r.Context(), q)
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not list partners", zap.Error(err))
+		writeJSONErrorMessage(w, "Could not list partners", http.StatusInternalServerError)
+		return
+	}
+
+	writeList(w, partners, next)
+}
+
+func (ph *PartnerHandler) partner(w http.ResponseWriter, r *http.Request, id string) {
+	p, err := ph.partners.GetPartner(r.Context(), id)
+	if errors.Is(err, store.ErrNotFound) {
+		writeJSONErrorMessage(w, fmt.Sprintf("partner %q does not exist", id), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not get partner", zap.String("partner", id), zap.Error(err))
+		writeJSONErrorMessage(w, "Could not get partner", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, p)
+	case "PUT":
+		ph.save(w, r, p)
+	case "DELETE":
+		if err := ph.partners.DeletePartner(r.Context(), id); err != nil {
+			requestLogger(r.Context()).Error("Could not delete partner", zap.String("partner", id), zap.Error(err))
+			writeJSONErrorMessage(w, "Could not delete partner", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// save creates a partner with a new API key, or replaces existing if it is not nil.
+func (ph *PartnerHandler) save(w http.ResponseWriter, r *http.Request, existing *store.Partner) {
+	var p store.Partner
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		writeJSONErrorMessage(w, "invalid partner: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validatePartner(&p); err != nil {
+		writeJSONErrorMessage(w, "invalid partner: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC()
+	var key string
+	if existing != nil {
+		p.ID, p.KeyHash, p.KeyPrefix = existing.ID, existing.KeyHash, existing.KeyPrefix
+		p.CreatedBy, p.CreatedAt = existing.CreatedBy, existing.CreatedAt
+	} else {
+		var err error
+		if key, err = partner.NewKey(); err != nil {
+			requestLogger(r.Context()).Error("Could not generate partner key", zap.Error(err))
+			writeJSONErrorMessage(w, "Could not generate partner key", http.StatusInternalServerError)
+			return
+		}
+		p.ID, p.KeyHash, p.KeyPrefix = "", partner.Hash(key), key[:len(partner.KeyPrefix)+4]
+		p.CreatedBy, p.CreatedAt = auth.Principal(r.Context()), now
+	}
+	p.UpdatedAt = now
+
+	if err := ph.partners.SavePartner(r.Context(), &p); err != nil {
+		requestLogger(r.Context()).Error("Could not save partner", zap.Error(err))
+		writeJSONErrorMessage(w, "Could not save partner", http.StatusInternalServerError)
+		return
+	}
+
+	if existing != nil {
+		p.Donations, p.Totals = existing.Donations, existing.Totals
+		writeJSON(w, p)
+		return
+	}
+	p.Totals = map[string]int64{}
+	writeJSONError(w, createdPartner{&p, key}, http.StatusCreated)
+}
+
+// validatePartner checks the name, origins and limits of a partner.
+func validatePartner(p *store.Partner) error {
+	if strings.TrimSpace(p.Name) == "" {
+		return fmt.Errorf("name is required")
+	}
+	for _, origin := range p.Origins {
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+			return fmt.Errorf("origins must be like https://shop.example.com")
+		}
+	}
+	if p.RateLimit < 0 || p.DailyQuota < 0 {
+		return fmt.Errorf("rateLimit and dailyQuota cannot be negative")
+	}
+	return nil
+}
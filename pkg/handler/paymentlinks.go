@@ -0,0 +1,138 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/vedrankolka/donation-server/pkg/auth"
+	"github.com/vedrankolka/donation-server/pkg/currency"
+	"github.com/vedrankolka/donation-server/pkg/metrics"
+	"github.com/vedrankolka/donation-server/pkg/payments"
+	"go.uber.org/zap"
+)
+
+// Modes of payment links.
+const (
+	PaymentLinkOneTime   = "one_time"
+	PaymentLinkRecurring = "recurring"
+)
+
+var paymentLinks = metrics.NewCounterVec(
+	"donation_server_payment_links_total",
+	"Payment links created or failed, by mode and outcome.",
+	"mode", "outcome",
+)
+
+// paymentLinkRequest is the body of POST /admin/payment-links.
+type paymentLinkRequest struct {
+	// Amount in the smallest currency unit, 0 to let donors choose it.
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+	// Tier of recurring donations donors subscribe to, instead of an amount.
+	Tier     string `json:"tier"`
+	Campaign string `json:"campaign"`
+}
+
+// HandleCreatePaymentLink creates a reusable Stripe payment link for channels
+// where no page can embed the Payment Element, like WhatsApp or SMS, POST
+// /admin/payment-links with {"amount": 2500, "currency": "EUR", "campaign":
+// "gala"}, or {"tier": "friend"} for a recurring donation. Without an amount
+// donors choose it. Donors are redirected to the success URL of Checkout, if
+// it is configured. It returns {"id", "url", "mode"}.
+//
+// The payments of the link are handled by the webhook like any other, with
+// the campaign in their metadata.
+func (dh *DonationHandler) HandleCreatePaymentLink(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var body paymentLinkRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxIntentBody)).Decode(&body); err != nil && err != io.EOF {
+		writeJSONErrorMessage(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if !dh.checkPaused(w) {
+		return
+	}
+
+	params := &payments.PaymentLinkParams{ItemName: CheckoutItemName, Metadata: map[string]string{}}
+	mode := PaymentLinkOneTime
+	if body.Tier != "" {
+		if dh.recurring == nil {
+			writeJSONErrorMessage(w, "recurring donations are not configured", http.StatusBadRequest)
+			return
+		}
+		tier, ok := dh.recurring.Tier(body.Tier)
+		if !ok {
+			writeJSONErrorMessage(w, fmt.Sprintf("tier %q does not exist", body.Tier), http.StatusBadRequest)
+			return
+		}
+		if body.Amount != 0 || body.Currency != "" {
+			writeJSONErrorMessage(w, "the amount and currency of a recurring donation are those of its tier", http.StatusBadRequest)
+			return
+		}
+		mode = PaymentLinkRecurring
+		params.PriceID = tier.PriceID
+		params.Currency = tier.Currency
+	} else {
+		donationCurrency, err := findCurrency(dh.currencies, body.Currency)
+		if err != nil {
+			writeJSONErrorMessage(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if body.Amount != 0 {
+			if err := donationCurrency.Check(body.Amount); err != nil {
+				writeAmountError(w, err.(*currency.AmountError))
+				return
+			}
+		}
+		params.Amount = body.Amount
+		params.Currency = donationCurrency.Code
+	}
+	if body.Campaign != "" {
+		if len(body.Campaign) > maxMetadataValue {
+			writeJSONErrorMessage(w, fmt.Sprintf("the campaign must be at most %d bytes", maxMetadataValue), http.StatusBadRequest)
+			return
+		}
+		if err := dh.checkCampaign(r.Context(), body.Campaign); err != nil {
+			writeJSONErrorMessage(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		params.Metadata[CampaignKey] = body.Campaign
+	}
+	if dh.checkout != nil {
+		params.RedirectURL = dh.checkout.success
+	}
+	var err error
+	if params.IdempotencyKey, err = dh.requestIdempotencyKey(r, "payment-link", params); err != nil {
+		writeJSONErrorMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	logger := dh.logger(r.Context()).With(zap.String("mode", mode), zap.String("staff", auth.Principal(r.Context())))
+	link, err := dh.provider.CreatePaymentLink(r.Context(), params)
+	if err != nil {
+		paymentLinks.Inc(mode, "failed")
+		var providerErr *payments.Error
+		if errors.As(err, &providerErr) {
+			logger.Warn("The payment provider refused the payment link", providerErrorFields(providerErr)...)
+			writeJSONErrorMessage(w, providerErr.Error(), http.StatusBadGateway)
+		} else {
+			logger.Error("Could not create payment link", zap.Error(err))
+			writeJSONErrorMessage(w, "Could not create the payment link", http.StatusInternalServerError)
+		}
+		return
+	}
+	paymentLinks.Inc(mode, "created")
+	logger.Info("Created payment link", zap.String("payment_link", link.ID))
+
+	writeJSON(w, struct {
+		ID   string `json:"id"`
+		URL  string `json:"url"`
+		Mode string `json:"mode"`
+	}{link.ID, link.URL, mode})
+}
@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/receipt"
+	"github.com/vedrankolka/donation-server/pkg/store"
+	"go.uber.org/zap"
+)
+
+// receipts is the configuration of donation receipts.
+type receipts struct {
+	issuer *receipt.Issuer
+	store  store.ReceiptStore
+}
+
+// WithReceipts issues a receipt of every succeeded donation, numbered in the
+// store, and delivers it with the issuer, e.g. by email.
+func WithReceipts(issuer *receipt.Issuer, s store.ReceiptStore) Option {
+	return func(dh *DonationHandler) {
+		dh.receipts = &receipts{issuer: issuer, store: s}
+	}
+}
+
+// sendReceipt issues the receipt of a donation, unless it was issued before,
+// and delivers it unless it was delivered. Receipts are best effort, a
+// failure is logged and the receipt is delivered when the event is
+// redelivered.
+func (dh *DonationHandler) sendReceipt(ctx context.Context, donation *store.Donation) {
+	if dh.receipts == nil {
+		return
+	}
+	logger := dh.logger(ctx).With(zap.String("donation", donation.ID))
+
+	r, err := dh.receipts.store.GetReceiptByDonation(ctx, donation.ID)
+	if errors.Is(err, store.ErrNotFound) {
+		r, err = dh.issueReceipt(ctx, donation)
+	}
+	if err != nil {
+		logger.Warn("Could not issue receipt of donation", zap.Error(err))
+		return
+	}
+	if r.DeliveredAt != nil {
+		return
+	}
+
+	if err := dh.receipts.issuer.Deliver(ctx, r); err != nil {
+		logger.Warn("Could not deliver receipt", zap.String("receipt", r.Number), zap.Error(err))
+		return
+	}
+	deliveredAt := time.Now().UTC()
+	r.DeliveredAt = &deliveredAt
+	if err := dh.receipts.store.SaveReceipt(ctx, r); err != nil {
+		logger.Warn("Could not record delivery of receipt", zap.String("receipt", r.Number), zap.Error(err))
+		return
+	}
+	logger.Info("Delivered receipt", zap.String("receipt", r.Number), zap.String("customer", donation.CustomerID))
+}
+
+// issueReceipt numbers and saves the receipt of a donation. Of payments
+// including purchases only the donated part is receipted, the rest is
+// invoiced.
+func (dh *DonationHandler) issueReceipt(ctx context.Context, donation *store.Donation) (*receipt.Receipt, error) {
+	issuedAt := time.Now().UTC()
+	sequence, err := dh.receipts.store.NextReceiptSequence(ctx, issuedAt.Year())
+	if err != nil {
+		return nil, err
+	}
+	amount := donation.Amount
+	if donation.DonationAmount > 0 {
+		amount = donation.DonationAmount
+	}
+	r := &receipt.Receipt{
+		Number:     dh.receipts.issuer.Number(issuedAt.Year(), sequence),
+		DonationID: donation.ID,
+		DonorName:  donation.CustomerName,
+		DonorEmail: donation.CustomerEmail,
+		Amount:     amount,
+		Currency:   donation.Currency,
+		Campaign:   donation.Campaign,
+		Date:       donation.CreatedAt,
+		IssuedAt:   issuedAt,
+	}
+	if err := dh.receipts.store.SaveReceipt(ctx, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
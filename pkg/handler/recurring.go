@@ -0,0 +1,209 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/mail"
+
+	"github.com/vedrankolka/donation-server/pkg/notifier"
+	"github.com/vedrankolka/donation-server/pkg/partner"
+	"github.com/vedrankolka/donation-server/pkg/payments"
+	"github.com/vedrankolka/donation-server/pkg/recurring"
+	"github.com/vedrankolka/donation-server/pkg/store"
+	"go.uber.org/zap"
+)
+
+// WithRecurring lets donors subscribe to the tiers of recurring donations in
+// the config. Paid invoices of subscriptions are notified as recurring
+// donations instead of their charges.
+func WithRecurring(config *recurring.Config) Option {
+	return func(dh *DonationHandler) {
+		dh.recurring = config
+	}
+}
+
+// HandleCreateSubscription subscribes a donor to a tier of recurring
+// donations, /create-subscription?tier=monthly-10&name=Ana&email=ana@example.com.
+// The response holds the client secret of the first payment, which the donor
+// confirms like a payment intent.
+func (dh *DonationHandler) HandleCreateSubscription(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if dh.recurring == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !dh.checkPaused(w) {
+		return
+	}
+
+	query := r.URL.Query()
+	tier, ok := dh.recurring.Tier(query.Get("tier"))
+	if !ok {
+		writeJSONErrorMessage(w, "Unknown tier", http.StatusBadRequest)
+		return
+	}
+	name, email := query.Get("name"), query.Get("email")
+	if name == "" || len(name) > maxMetadataValue {
+		writeJSONErrorMessage(w, "A name is required", http.StatusBadRequest)
+		return
+	}
+	if _, err := mail.ParseAddress(email); err != nil {
+		writeJSONErrorMessage(w, "A valid email is required", http.StatusBadRequest)
+		return
+	}
+	// Before the customer is created for a campaign that does not run.
+	if err := dh.checkCampaign(r.Context(), query.Get(CampaignKey)); err != nil {
+		writeJSONErrorMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	customerKey, err := dh.requestIdempotencyKey(r, "subscription-customer", query)
+	if err != nil {
+		writeJSONErrorMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	subscriptionKey, _ := dh.requestIdempotencyKey(r, "subscription", query)
+
+	ctx, cancel := context.WithTimeout(r.Context(), Timeout)
+	defer cancel()
+
+	customer, err := dh.subscriptionCustomer(ctx, name, email, customerKey)
+	if err != nil {
+		dh.logger(r.Context()).Error("Could not get customer of subscription", zap.Error(err))
+		writeJSONErrorMessage(w, "Unknown server error", http.StatusInternalServerError)
+		return
+	}
+
+	params := &payments.SubscriptionParams{
+		CustomerID:     customer.ID,
+		PriceID:        tier.PriceID,
+		Metadata:       map[string]string{"tier": tier.ID},
+		IdempotencyKey: subscriptionKey,
+	}
+	if campaign := query.Get(CampaignKey); campaign != "" && len(campaign) <= maxMetadataValue {
+		params.Metadata[CampaignKey] = campaign
+	}
+	if partnerID := partner.ID(r.Context()); partnerID != "" {
+		params.Metadata[PartnerKey] = partnerID
+	}
+
+	subscription, err := dh.provider.CreateSubscription(ctx, params)
+	if err != nil {
+		var providerErr *payments.Error
+		if errors.As(err, &providerErr) {
+			dh.logger(r.Context()).Warn("The payment provider refused the subscription", providerErrorFields(providerErr)...)
+			dh.writeProviderError(w, r, providerErr)
+		} else {
+			dh.logger(r.Context()).Error("Could not create subscription", zap.Error(err))
+			writeJSONErrorMessage(w, "Unknown server error", http.StatusInternalServerError)
+		}
+		return
+	}
+	dh.logger(r.Context()).Info("Created subscription", zap.String("subscription", subscription.ID),
+		zap.String("customer", customer.ID), zap.String("tier", tier.ID))
+
+	writeJSON(w, struct {
+		SubscriptionID string         `json:"subscriptionID"`
+		ClientSecret   string         `json:"clientSecret"`
+		Tier           recurring.Tier `json:"tier"`
+	}{
+		SubscriptionID: subscription.ID,
+		ClientSecret:   subscription.ClientSecret,
+		Tier:           tier,
+	})
+}
+
+// subscriptionCustomer returns the customer with the email, creating it if
+// there is none.
+func (dh *DonationHandler) subscriptionCustomer(ctx context.Context, name, email, idempotencyKey string) (*payments.Customer, error) {
+	customers, err := dh.provider.FindCustomers(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	if len(customers) > 0 {
+		return customers[0], nil
+	}
+	return dh.provider.CreateCustomer(ctx, &payments.CustomerParams{
+		Name:           name,
+		Email:          email,
+		IdempotencyKey: idempotencyKey,
+	})
+}
+
+// isSubscriptionInvoice reports whether the event is about an invoice of a
+// subscription.
+func isSubscriptionInvoice(event *payments.Event) bool {
+	return event.Invoice.SubscriptionID != ""
+}
+
+// recurringDonationEvent reads the payment of a recurring donation from the
+// event of a paid subscription invoice.
+func (dh *DonationHandler) recurringDonationEvent(event *payments.Event) notifier.RecurringDonationEvent {
+	invoice := event.Invoice
+	e := notifier.RecurringDonationEvent{
+		SubscriptionID: invoice.SubscriptionID,
+		CustomerID:     invoice.CustomerID,
+		CustomerName:   invoice.CustomerName,
+		CustomerEmail:  invoice.CustomerEmail,
+		Currency:       invoice.Currency,
+		First:          invoice.BillingReason == "subscription_create",
+	}
+	if amount, ok := eventAmount(invoice.AmountPaid); ok {
+		e.Amount = float64(amount)
+	}
+
+	if len(invoice.Lines) == 0 {
+		return e
+	}
+	line := invoice.Lines[0]
+	if start, ok := eventTime(line.PeriodStart); ok {
+		e.PeriodStart = start
+	}
+	if end, ok := eventTime(line.PeriodEnd); ok {
+		e.PeriodEnd = end
+	}
+	e.Interval = line.Interval
+	if line.PriceID != "" && dh.recurring != nil {
+		if tier, ok := dh.recurring.TierByPrice(line.PriceID); ok {
+			e.Tier = tier.ID
+		}
+	}
+	return e
+}
+
+// notifyRecurring notifies about the payment of a recurring donation in the
+// event of a paid subscription invoice, and dead-letters it if it fails.
+func (dh *DonationHandler) notifyRecurring(w http.ResponseWriter, r *http.Request, event *payments.Event, logger *zap.Logger) string {
+	recurringEvent := dh.recurringDonationEvent(event)
+	paidAt := eventCreated(event.Created)
+	if t, ok := eventTime(event.Invoice.PaidAt); ok {
+		paidAt = t
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), Timeout)
+	defer cancel()
+
+	deferred, err := dh.notifyWithinBudget(ctx, event, NotificationRecurringDonation, recurringEvent, recurringEvent.CustomerID, func(ctx context.Context) error {
+		return dh.notifier.NotifyRecurring(notifier.WithChargedAt(ctx, paidAt), recurringEvent)
+	})
+	if deferred {
+		return store.OutcomeDeferred
+	}
+	if err != nil {
+		logger.Error("Failed to notify about recurring donation", zap.Error(err))
+		if dh.deadLetter(ctx, event, NotificationRecurringDonation, recurringEvent, err) {
+			return store.OutcomeDeadLettered
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return store.OutcomeFailed
+	}
+	dh.recordNotification(ctx, event, NotificationRecurringDonation, recurringEvent.CustomerID)
+	dh.resolveDeadLetter(ctx, event, NotificationRecurringDonation)
+	logger.Info("Notified payment of subscription", zap.String("subscription", recurringEvent.SubscriptionID),
+		zap.String("customer", recurringEvent.CustomerID))
+	return store.OutcomeProcessed
+}
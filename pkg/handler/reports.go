@@ -0,0 +1,221 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/auth"
+	"github.com/vedrankolka/donation-server/pkg/listing"
+	"github.com/vedrankolka/donation-server/pkg/report"
+	"github.com/vedrankolka/donation-server/pkg/store"
+	"go.uber.org/zap"
+)
+
+// ReportHandler serves the admin API of saved reports.
+type ReportHandler struct {
+	reports   store.ReportStore
+	donations store.DonationStore
+	// scheduler delivers reports, it is nil if there is no report notifier.
+	scheduler *report.Scheduler
+}
+
+// NewReportHandler creates a ReportHandler. The scheduler may be nil, then
+// reports can only be downloaded.
+func NewReportHandler(reports store.ReportStore, donations store.DonationStore, scheduler *report.Scheduler) *ReportHandler {
+	return &ReportHandler{
+		reports:   reports,
+		donations: donations,
+		scheduler: scheduler,
+	}
+}
+
+// periodSpec are the parameters of generating a report on demand.
+var periodSpec = listing.Spec{Filters: []string{listing.FilterCreated}}
+
+// HandleReports routes the /admin/reports endpoints:
+//
+//	GET    /admin/reports                 lists saved reports
+//	POST   /admin/reports                 saves a report definition
+//	GET    /admin/reports/{id}            shows a report definition
+//	PUT    /admin/reports/{id}            replaces a report definition
+//	DELETE /admin/reports/{id}            deletes a report definition
+//	GET    /admin/reports/{id}/download   generates the report, see below
+//	POST   /admin/reports/{id}/deliver    generates the report and delivers it to its recipients
+//
+// Generated reports cover the created_gte and created_lte parameters if
+// given, otherwise the last period of the schedule, or the report's own
+// created filter if it is not scheduled.
+func (rh *ReportHandler) HandleReports(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/reports"), "/")
+	parts := strings.Split(path, "/")
+
+	switch {
+	case path == "" && r.Method == "GET":
+		rh.list(w, r)
+	case path == "" && r.Method == "POST":
+		rh.save(w, r, nil)
+	case len(parts) == 1 || len(parts) == 2 && (parts[1] == "download" || parts[1] == "deliver"):
+		def, err := rh.reports.GetReport(r.Context(), parts[0])
+		if errors.Is(err, store.ErrNotFound) {
+			writeJSONErrorMessage(w, fmt.Sprintf("report %q does not exist", parts[0]), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			requestLogger(r.Context()).Error("Could not get report", zap.String("report", parts[0]), zap.Error(err))
+			writeJSONErrorMessage(w, "Could not get report", http.StatusInternalServerError)
+			return
+		}
+		rh.report(w, r, def, parts[1:])
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (rh *ReportHandler) list(w http.ResponseWriter, r *http.Request) {
+	q, ok := parseListQuery(w, r, store.ReportListSpec)
+	if !ok {
+		return
+	}
+
+	reports, next, err := rh.reports.ListReports(r.Context(), q)
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not list reports", zap.Error(err))
+		writeJSONErrorMessage(w, "Could not list reports", http.StatusInternalServerError)
+		return
+	}
+
+	writeList(w, reports, next)
+}
+
+func (rh *ReportHandler) report(w http.ResponseWriter, r *http.Request, def *store.ReportDefinition, action []string) {
+	switch {
+	case len(action) == 0 && r.Method == "GET":
+		writeJSON(w, def)
+	case len(action) == 0 && r.Method == "PUT":
+		rh.save(w, r, def)
+	case len(action) == 0 && r.Method == "DELETE":
+		if err := rh.reports.DeleteReport(r.Context(), def.ID); err != nil {
+			requestLogger(r.Context()).Error("Could not delete report", zap.String("report", def.ID), zap.Error(err))
+			writeJSONErrorMessage(w, "Could not delete report", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(action) == 1 && action[0] == "download" && r.Method == "GET":
+		rh.download(w, r, def)
+	case len(action) == 1 && action[0] == "deliver" && r.Method == "POST":
+		rh.deliver(w, r, def)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// save creates a report definition, or replaces existing if it is not nil.
+func (rh *ReportHandler) save(w http.ResponseWriter, r *http.Request, existing *store.ReportDefinition) {
+	var def store.ReportDefinition
+	if err := json.NewDecoder(r.Body).Decode(&def); err != nil {
+		writeJSONErrorMessage(w, "invalid report: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := report.Validate(&def); err != nil {
+		writeJSONErrorMessage(w, "invalid report: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC()
+	def.ID, def.CreatedBy, def.CreatedAt = "", auth.Principal(r.Context()), now
+	def.LastRunAt, def.NextRunAt, def.LastError = nil, nil, ""
+	if existing != nil {
+		def.ID, def.CreatedBy, def.CreatedAt = existing.ID, existing.CreatedBy, existing.CreatedAt
+		def.LastRunAt, def.LastError = existing.LastRunAt, existing.LastError
+	}
+	def.UpdatedAt = now
+	if def.Schedule != "" {
+		nextRun := report.NextRun(def.Schedule, now)
+		def.NextRunAt = &nextRun
+	}
+
+	if err := rh.reports.SaveReport(r.Context(), &def); err != nil {
+		requestLogger(r.Context()).Error("Could not save report", zap.Error(err))
+		writeJSONErrorMessage(w, "Could not save report", http.StatusInternalServerError)
+		return
+	}
+
+	code := http.StatusCreated
+	if existing != nil {
+		code = http.StatusOK
+	}
+	writeJSONError(w, def, code)
+}
+
+// period returns the period a report generated on demand covers, see HandleReports.
+func period(w http.ResponseWriter, r *http.Request, def *store.ReportDefinition) (time.Time, time.Time, bool) {
+	q, ok := parseListQuery(w, r, periodSpec)
+	if !ok {
+		return time.Time{}, time.Time{}, false
+	}
+
+	var from, to time.Time
+	if def.Schedule != "" {
+		from, to = report.Period(def.Schedule, time.Now())
+	}
+	if !q.Filter.CreatedGTE.IsZero() {
+		from = q.Filter.CreatedGTE
+	}
+	if !q.Filter.CreatedLTE.IsZero() {
+		to = q.Filter.CreatedLTE.Add(time.Nanosecond)
+	}
+	return from, to, true
+}
+
+func (rh *ReportHandler) download(w http.ResponseWriter, r *http.Request, def *store.ReportDefinition) {
+	from, to, ok := period(w, r, def)
+	if !ok {
+		return
+	}
+
+	result, err := report.Generate(r.Context(), rh.donations, def, from, to)
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not generate report", zap.String("report", def.ID), zap.Error(err))
+		writeJSONErrorMessage(w, "Could not generate report", http.StatusInternalServerError)
+		return
+	}
+	body, contentType, filename, err := result.Render(def.Format)
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not render report", zap.String("report", def.ID), zap.Error(err))
+		writeJSONErrorMessage(w, "Could not render report", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	w.Write(body)
+}
+
+func (rh *ReportHandler) deliver(w http.ResponseWriter, r *http.Request, def *store.ReportDefinition) {
+	if rh.scheduler == nil {
+		writeJSONErrorMessage(w, "reports cannot be delivered without DONATION_SERVER_REPORT_NOTIFIER", http.StatusServiceUnavailable)
+		return
+	}
+	if len(def.Recipients) == 0 {
+		writeJSONErrorMessage(w, "the report has no recipients", http.StatusBadRequest)
+		return
+	}
+
+	from, to, ok := period(w, r, def)
+	if !ok {
+		return
+	}
+
+	if err := rh.scheduler.Deliver(r.Context(), def, from, to); err != nil {
+		requestLogger(r.Context()).Error("Could not deliver report", zap.String("report", def.ID), zap.Error(err))
+		writeJSONErrorMessage(w, "Could not deliver report: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
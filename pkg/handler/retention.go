@@ -0,0 +1,43 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/retention"
+)
+
+// RetentionHandler serves the admin API of retention policies.
+type RetentionHandler struct {
+	engine *retention.Engine
+}
+
+// NewRetentionHandler creates a RetentionHandler of the engine's policies.
+func NewRetentionHandler(engine *retention.Engine) *RetentionHandler {
+	return &RetentionHandler{engine: engine}
+}
+
+// HandleRetention routes the /admin/retention endpoints:
+//
+//	GET  /admin/retention       shows the policies and the latest runs
+//	POST /admin/retention/run   runs the policies now, only counting with dry_run=true
+func (rh *RetentionHandler) HandleRetention(w http.ResponseWriter, r *http.Request) {
+	switch path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/retention"), "/"); {
+	case path == "" && r.Method == "GET":
+		writeJSON(w, map[string]interface{}{
+			"policies": rh.engine.Policies(),
+			"runs":     rh.engine.Runs(),
+		})
+	case path == "run" && r.Method == "POST":
+		dryRun, err := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+		if err != nil {
+			writeJSONErrorMessage(w, "dry_run must be true or false", http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, rh.engine.Run(r.Context(), time.Now(), dryRun))
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
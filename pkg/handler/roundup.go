@@ -0,0 +1,135 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/vedrankolka/donation-server/pkg/partner"
+	"github.com/vedrankolka/donation-server/pkg/payments"
+	"go.uber.org/zap"
+)
+
+const (
+	// RoundUpPurchaseAmountKey is the metadata key of the purchase amount a donation rounds up.
+	RoundUpPurchaseAmountKey = "round_up_purchase_amount"
+	// RoundUpOrderKey is the metadata key of the partner's order a donation rounds up.
+	RoundUpOrderKey = "round_up_order"
+	// DefaultRoundUpTo is the multiple purchases are rounded up to, in cents.
+	DefaultRoundUpTo = 100
+	// maxRoundUpTo is the largest multiple a purchase can be rounded up to, in cents.
+	maxRoundUpTo = 10000
+)
+
+// RoundUp returns the donation rounding the purchase amount up to the next
+// multiple of to, zero if the amount is a multiple already.
+func RoundUp(amount, to int64) int64 {
+	if rest := amount % to; rest != 0 {
+		return to - rest
+	}
+	return 0
+}
+
+// roundUp is the response of /round-up.
+type roundUp struct {
+	PurchaseAmount int64  `json:"purchaseAmount"`
+	DonationAmount int64  `json:"donationAmount"`
+	Total          int64  `json:"total"`
+	Currency       string `json:"currency"`
+	// ClientSecret and PaymentIntentID are set if the payment intent was created.
+	ClientSecret    string `json:"clientSecret,omitempty"`
+	PaymentIntentID string `json:"paymentIntentID,omitempty"`
+}
+
+// HandleRoundUp computes the donation rounding up a purchase of a partner's
+// checkout, "round up for charity". It takes the query parameters amount
+// (the purchase in cents), to (the multiple to round up to, DefaultRoundUpTo
+// by default), order (the partner's order reference) and campaign.
+//
+// GET only computes the donation, POST also creates its payment intent, linked
+// to the purchase by its metadata.
+func (dh *DonationHandler) HandleRoundUp(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	amount, err := getAmount(r)
+	if err != nil || amount < 1 {
+		writeJSONErrorMessage(w, "amount must be the purchase amount in cents", http.StatusBadRequest)
+		return
+	}
+	to := int64(DefaultRoundUpTo)
+	if s := query.Get("to"); s != "" {
+		if to, err = strconv.ParseInt(s, 10, 64); err != nil || to < 1 || to > maxRoundUpTo {
+			writeJSONErrorMessage(w, fmt.Sprintf("to must be a number of cents between 1 and %d", maxRoundUpTo), http.StatusBadRequest)
+			return
+		}
+	}
+	order := query.Get("order")
+	if len(order) > maxMetadataValue {
+		writeJSONErrorMessage(w, "order is too long", http.StatusBadRequest)
+		return
+	}
+
+	resp := roundUp{
+		PurchaseAmount: amount,
+		DonationAmount: RoundUp(amount, to),
+		Currency:       dh.currencies[0].Code,
+	}
+	resp.Total = resp.PurchaseAmount + resp.DonationAmount
+	if r.Method == "GET" {
+		writeJSON(w, resp)
+		return
+	}
+	if !dh.checkPaused(w) {
+		return
+	}
+	if resp.DonationAmount == 0 {
+		writeJSONErrorMessage(w, "the amount is round already, there is nothing to donate", http.StatusBadRequest)
+		return
+	}
+
+	params := &payments.IntentParams{
+		Amount:   resp.DonationAmount,
+		Currency: resp.Currency,
+	}
+	params.AddMetadata(RoundUpPurchaseAmountKey, strconv.FormatInt(amount, 10))
+	if order != "" {
+		params.AddMetadata(RoundUpOrderKey, order)
+	}
+	if campaign := query.Get(CampaignKey); campaign != "" && len(campaign) <= maxMetadataValue {
+		if err := dh.checkCampaign(r.Context(), campaign); err != nil {
+			writeJSONErrorMessage(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		params.AddMetadata(CampaignKey, campaign)
+	}
+	if partnerID := partner.ID(r.Context()); partnerID != "" {
+		params.AddMetadata(PartnerKey, partnerID)
+	}
+	key, err := dh.requestIdempotencyKey(r, "round-up-payment-intent", params)
+	if err != nil {
+		writeJSONErrorMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	params.IdempotencyKey = key
+
+	pi, err := dh.createPaymentIntent(r.Context(), params)
+	if err != nil {
+		var providerErr *payments.Error
+		if errors.As(err, &providerErr) {
+			dh.logger(r.Context()).Warn("The payment provider refused the round-up payment intent", providerErrorFields(providerErr)...)
+			dh.writeProviderError(w, r, providerErr)
+		} else {
+			dh.logger(r.Context()).Error("Could not create round-up payment intent", zap.Error(err))
+			writeJSONErrorMessage(w, "Unknown server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	resp.ClientSecret, resp.PaymentIntentID = pi.ClientSecret, pi.ID
+	writeJSON(w, resp)
+}
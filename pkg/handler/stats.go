@@ -0,0 +1,235 @@
+package handler
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/listing"
+	"github.com/vedrankolka/donation-server/pkg/rollup"
+	"github.com/vedrankolka/donation-server/pkg/store"
+	"go.uber.org/zap"
+)
+
+// statsSpec are the parameters of the statistics endpoints.
+var statsSpec = listing.Spec{
+	Filters: []string{listing.FilterCreated, listing.FilterCurrency, listing.FilterCampaign},
+	Params:  []string{"granularity"},
+}
+
+// Default periods of the statistics endpoints.
+const (
+	defaultDailyStats  = 30 * 24 * time.Hour
+	defaultHourlyStats = 2 * 24 * time.Hour
+	defaultHeatmap     = 90 * 24 * time.Hour
+	defaultCampaigns   = 365 * 24 * time.Hour
+)
+
+// WithRollups recomputes the rollups of the day of a donation refunded after
+// rollup.RefreshWindow, which the aggregator no longer refreshes by itself.
+func WithRollups(aggregator *rollup.Aggregator) Option {
+	return func(dh *DonationHandler) {
+		dh.rollups = aggregator
+	}
+}
+
+// StatsHandler serves statistics of donations from their rollups.
+type StatsHandler struct {
+	rollups store.RollupStore
+}
+
+// NewStatsHandler creates a StatsHandler of the rollups in the store.
+func NewStatsHandler(rollups store.RollupStore) *StatsHandler {
+	return &StatsHandler{rollups: rollups}
+}
+
+// point is a time of a series.
+type point struct {
+	Start     time.Time `json:"start"`
+	Currency  string    `json:"currency"`
+	Donations int       `json:"donations"`
+	Amount    int64     `json:"amount"`
+}
+
+// heatmap counts donations by UTC weekday, starting on Monday, and hour.
+type heatmap struct {
+	From      time.Time     `json:"from"`
+	To        time.Time     `json:"to"`
+	Donations [7][24]int    `json:"donations"`
+	Amounts   *[7][24]int64 `json:"amounts,omitempty"`
+}
+
+// campaignTotal sums up the donations of a campaign in a currency.
+type campaignTotal struct {
+	Campaign  string `json:"campaign"`
+	Currency  string `json:"currency"`
+	Donations int    `json:"donations"`
+	Amount    int64  `json:"amount"`
+}
+
+// HandleStats routes the /admin/stats endpoints:
+//
+//	GET /admin/stats             donations and amounts per hour or day and currency
+//	GET /admin/stats/heatmap     donations per weekday and hour
+//	GET /admin/stats/campaigns   donations and amounts per campaign and currency
+//
+// All take the created_gte, created_lte, currency and campaign parameters,
+// /admin/stats also granularity, hour or day (the default).
+func (sh *StatsHandler) HandleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	q, ok := parseListQuery(w, r, statsSpec)
+	if !ok {
+		return
+	}
+
+	switch strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/stats"), "/") {
+	case "":
+		sh.series(w, r, q)
+	case "heatmap":
+		sh.heatmap(w, r, q)
+	case "campaigns":
+		sh.campaigns(w, r, q)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// statsPeriod returns the range of rollups of the query, including the one
+// of its end, the default period before now if it has no created filter.
+func statsPeriod(q listing.Query, granularity string, defaultPeriod time.Duration) (time.Time, time.Time) {
+	to := time.Now()
+	if !q.Filter.CreatedLTE.IsZero() {
+		to = q.Filter.CreatedLTE
+	}
+	from := to.Add(-defaultPeriod)
+	if !q.Filter.CreatedGTE.IsZero() {
+		from = q.Filter.CreatedGTE
+	}
+	bucket := time.Hour
+	if granularity == store.GranularityDay {
+		bucket = 24 * time.Hour
+	}
+	return rollup.Truncate(granularity, from), rollup.Truncate(granularity, to).Add(bucket)
+}
+
+// matchRollup reports whether the rollup matches the currency and campaign filters.
+func matchRollup(f listing.Filter, r *store.Rollup) bool {
+	return (f.Currency == "" || strings.EqualFold(f.Currency, r.Currency)) && (f.Campaign == "" || f.Campaign == r.Campaign)
+}
+
+func (sh *StatsHandler) series(w http.ResponseWriter, r *http.Request, q listing.Query) {
+	granularity := r.URL.Query().Get("granularity")
+	defaultPeriod := defaultDailyStats
+	switch granularity {
+	case "", store.GranularityDay:
+		granularity = store.GranularityDay
+	case store.GranularityHour:
+		defaultPeriod = defaultHourlyStats
+	default:
+		writeJSONErrorMessage(w, "granularity must be hour or day", http.StatusBadRequest)
+		return
+	}
+
+	from, to := statsPeriod(q, granularity, defaultPeriod)
+	rollups, err := sh.rollups.ListRollups(r.Context(), granularity, from, to)
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not list rollups", zap.Error(err))
+		writeJSONErrorMessage(w, "Could not get statistics", http.StatusInternalServerError)
+		return
+	}
+
+	// Campaigns are summed up, rollups are ordered by start.
+	points := make([]*point, 0, len(rollups))
+	byKey := make(map[string]*point)
+	for _, ru := range rollups {
+		if !matchRollup(q.Filter, ru) {
+			continue
+		}
+		key := ru.Start.Format(time.RFC3339) + " " + ru.Currency
+		p, ok := byKey[key]
+		if !ok {
+			p = &point{Start: ru.Start, Currency: ru.Currency}
+			byKey[key] = p
+			points = append(points, p)
+		}
+		p.Donations += ru.Donations
+		p.Amount += ru.Amount
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"granularity": granularity,
+		"data":        points,
+	})
+}
+
+// heatmap sums up the hourly rollups. Amounts are only summed up for a currency.
+func (sh *StatsHandler) heatmap(w http.ResponseWriter, r *http.Request, q listing.Query) {
+	from, to := statsPeriod(q, store.GranularityHour, defaultHeatmap)
+	rollups, err := sh.rollups.ListRollups(r.Context(), store.GranularityHour, from, to)
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not list rollups", zap.Error(err))
+		writeJSONErrorMessage(w, "Could not get statistics", http.StatusInternalServerError)
+		return
+	}
+
+	h := heatmap{From: from, To: to}
+	var amounts [7][24]int64
+	for _, ru := range rollups {
+		if !matchRollup(q.Filter, ru) {
+			continue
+		}
+		weekday := (int(ru.Start.Weekday()) + 6) % 7 // Days since Monday.
+		h.Donations[weekday][ru.Start.Hour()] += ru.Donations
+		amounts[weekday][ru.Start.Hour()] += ru.Amount
+	}
+	if q.Filter.Currency != "" {
+		h.Amounts = &amounts
+	}
+
+	writeJSON(w, h)
+}
+
+// campaigns sums up the daily rollups by campaign and currency, the campaigns
+// with the most donations first. Donations without a campaign are left out.
+func (sh *StatsHandler) campaigns(w http.ResponseWriter, r *http.Request, q listing.Query) {
+	from, to := statsPeriod(q, store.GranularityDay, defaultCampaigns)
+	rollups, err := sh.rollups.ListRollups(r.Context(), store.GranularityDay, from, to)
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not list rollups", zap.Error(err))
+		writeJSONErrorMessage(w, "Could not get statistics", http.StatusInternalServerError)
+		return
+	}
+
+	totals := []*campaignTotal{}
+	byKey := make(map[string]*campaignTotal)
+	for _, ru := range rollups {
+		if ru.Campaign == "" || !matchRollup(q.Filter, ru) {
+			continue
+		}
+		key := ru.Campaign + " " + ru.Currency
+		total, ok := byKey[key]
+		if !ok {
+			total = &campaignTotal{Campaign: ru.Campaign, Currency: ru.Currency}
+			byKey[key] = total
+			totals = append(totals, total)
+		}
+		total.Donations += ru.Donations
+		total.Amount += ru.Amount
+	}
+	sort.SliceStable(totals, func(i, j int) bool {
+		if totals[i].Donations != totals[j].Donations {
+			return totals[i].Donations > totals[j].Donations
+		}
+		return totals[i].Campaign < totals[j].Campaign
+	})
+
+	writeJSON(w, map[string]interface{}{
+		"from": from,
+		"to":   to,
+		"data": totals,
+	})
+}
@@ -0,0 +1,225 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/auth"
+	"github.com/vedrankolka/donation-server/pkg/schema"
+	"github.com/vedrankolka/donation-server/pkg/store"
+	"github.com/vedrankolka/donation-server/pkg/subscription"
+	"go.uber.org/zap"
+)
+
+// SubscriptionHandler serves the admin API of webhook subscriptions of third parties.
+type SubscriptionHandler struct {
+	subscriptions store.SubscriptionStore
+	dispatcher    *subscription.Dispatcher
+}
+
+// NewSubscriptionHandler creates a SubscriptionHandler managing the
+// subscriptions in the store and retrying deliveries with the dispatcher.
+func NewSubscriptionHandler(subscriptions store.SubscriptionStore, dispatcher *subscription.Dispatcher) *SubscriptionHandler {
+	return &SubscriptionHandler{
+		subscriptions: subscriptions,
+		dispatcher:    dispatcher,
+	}
+}
+
+// HandleSubscriptions routes the /admin/subscriptions endpoints:
+//
+//	GET    /admin/subscriptions                                  lists subscriptions
+//	POST   /admin/subscriptions                                  creates a subscription, responding with its secret
+//	GET    /admin/subscriptions/{id}                             shows a subscription
+//	PUT    /admin/subscriptions/{id}                             replaces a subscription, keeping its secret unless given
+//	DELETE /admin/subscriptions/{id}                             deletes a subscription with its deliveries
+//	GET    /admin/subscriptions/{id}/deliveries                  lists the deliveries of a subscription
+//	GET    /admin/subscriptions/{id}/deliveries/{deliveryID}     shows a delivery with its attempts
+//	POST   /admin/subscriptions/{id}/deliveries/{deliveryID}/retry  sends a delivery again
+func (sh *SubscriptionHandler) HandleSubscriptions(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/subscriptions"), "/")
+	parts := strings.Split(path, "/")
+
+	if path == "" {
+		switch r.Method {
+		case "GET":
+			sh.list(w, r)
+		case "POST":
+			sh.save(w, r, nil)
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	s, err := sh.subscriptions.GetSubscription(r.Context(), parts[0])
+	if errors.Is(err, store.ErrNotFound) {
+		writeJSONErrorMessage(w, fmt.Sprintf("subscription %q does not exist", parts[0]), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not get subscription", zap.String("subscription", parts[0]), zap.Error(err))
+		writeJSONErrorMessage(w, "Could not get subscription", http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+		s.Secret = ""
+		writeJSON(w, s)
+	case len(parts) == 1 && r.Method == "PUT":
+		sh.save(w, r, s)
+	case len(parts) == 1 && r.Method == "DELETE":
+		if err := sh.subscriptions.DeleteSubscription(r.Context(), s.ID); err != nil {
+			requestLogger(r.Context()).Error("Could not delete subscription", zap.String("subscription", s.ID), zap.Error(err))
+			writeJSONErrorMessage(w, "Could not delete subscription", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && parts[1] == "deliveries" && r.Method == "GET":
+		sh.listDeliveries(w, r, s)
+	case len(parts) >= 3 && len(parts) <= 4 && parts[1] == "deliveries":
+		sh.delivery(w, r, s, parts[2], parts[3:])
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (sh *SubscriptionHandler) list(w http.ResponseWriter, r *http.Request) {
+	q, ok := parseListQuery(w, r, store.SubscriptionListSpec)
+	if !ok {
+		return
+	}
+
+	subscriptions, next, err := sh.subscriptions.ListSubscriptions(r.Context(), q)
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not list subscriptions", zap.Error(err))
+		writeJSONErrorMessage(w, "Could not list subscriptions", http.StatusInternalServerError)
+		return
+	}
+	for _, s := range subscriptions {
+		s.Secret = ""
+	}
+
+	writeList(w, subscriptions, next)
+}
+
+// save creates a subscription, or replaces existing if it is not nil.
+func (sh *SubscriptionHandler) save(w http.ResponseWriter, r *http.Request, existing *store.Subscription) {
+	var s store.Subscription
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		writeJSONErrorMessage(w, "invalid subscription: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateSubscription(r.Context(), &s); err != nil {
+		writeJSONErrorMessage(w, "invalid subscription: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC()
+	s.ID, s.CreatedBy, s.CreatedAt = "", auth.Principal(r.Context()), now
+	if existing != nil {
+		s.ID, s.CreatedBy, s.CreatedAt = existing.ID, existing.CreatedBy, existing.CreatedAt
+		if s.Secret == "" {
+			s.Secret = existing.Secret
+		}
+	}
+	s.UpdatedAt = now
+	if s.Secret == "" {
+		secret, err := subscription.NewSecret()
+		if err != nil {
+			requestLogger(r.Context()).Error("Could not generate subscription secret", zap.Error(err))
+			writeJSONErrorMessage(w, "Could not generate subscription secret", http.StatusInternalServerError)
+			return
+		}
+		s.Secret = secret
+	}
+
+	if err := sh.subscriptions.SaveSubscription(r.Context(), &s); err != nil {
+		requestLogger(r.Context()).Error("Could not save subscription", zap.Error(err))
+		writeJSONErrorMessage(w, "Could not save subscription", http.StatusInternalServerError)
+		return
+	}
+
+	if existing != nil {
+		s.Secret = ""
+		writeJSON(w, s)
+		return
+	}
+	writeJSONError(w, s, http.StatusCreated)
+}
+
+// validateSubscription checks the URL and the event types of a subscription.
+func validateSubscription(ctx context.Context, s *store.Subscription) error {
+	if err := subscription.ValidateURL(ctx, s.URL); err != nil {
+		return err
+	}
+
+	types := schema.Types()
+	for _, eventType := range s.EventTypes {
+		if !containsString(types, eventType) {
+			return fmt.Errorf("event types must be some of %s", strings.Join(types, ", "))
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (sh *SubscriptionHandler) listDeliveries(w http.ResponseWriter, r *http.Request, s *store.Subscription) {
+	q, ok := parseListQuery(w, r, store.DeliveryListSpec)
+	if !ok {
+		return
+	}
+
+	deliveries, next, err := sh.subscriptions.ListDeliveries(r.Context(), s.ID, q)
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not list deliveries of subscription", zap.String("subscription", s.ID), zap.Error(err))
+		writeJSONErrorMessage(w, "Could not list deliveries", http.StatusInternalServerError)
+		return
+	}
+
+	writeList(w, deliveries, next)
+}
+
+func (sh *SubscriptionHandler) delivery(w http.ResponseWriter, r *http.Request, s *store.Subscription, id string, action []string) {
+	d, err := sh.subscriptions.GetDelivery(r.Context(), id)
+	if errors.Is(err, store.ErrNotFound) || err == nil && d.SubscriptionID != s.ID {
+		writeJSONErrorMessage(w, fmt.Sprintf("delivery %q does not exist", id), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not get delivery", zap.String("delivery", id), zap.Error(err))
+		writeJSONErrorMessage(w, "Could not get delivery", http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case len(action) == 0 && r.Method == "GET":
+		writeJSON(w, d)
+	case len(action) == 1 && action[0] == "retry" && r.Method == "POST":
+		now := time.Now().UTC()
+		d.Status, d.NextAttemptAt = store.DeliveryPending, &now
+		if err := sh.subscriptions.SaveDelivery(r.Context(), d); err != nil {
+			requestLogger(r.Context()).Error("Could not save delivery", zap.String("delivery", id), zap.Error(err))
+			writeJSONErrorMessage(w, "Could not retry delivery", http.StatusInternalServerError)
+			return
+		}
+		sh.dispatcher.Wake()
+		writeJSONError(w, d, http.StatusAccepted)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
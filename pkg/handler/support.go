@@ -0,0 +1,191 @@
+package handler
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/auth"
+	"github.com/vedrankolka/donation-server/pkg/listing"
+	"github.com/vedrankolka/donation-server/pkg/store"
+	"go.uber.org/zap"
+)
+
+const (
+	// SupportLookupsPerMinute is the number of charge lookups a principal can make per minute.
+	SupportLookupsPerMinute = 10
+	// maxChargeMatches is the number of charges a lookup returns.
+	maxChargeMatches = 10
+)
+
+var last4 = regexp.MustCompile(`^[0-9]{4}$`)
+
+// SupportHandler serves the endpoints of donor support.
+type SupportHandler struct {
+	donations store.DonationStore
+
+	mu sync.Mutex
+	// minute and lookups count the lookups of principals in the current minute.
+	minute  time.Time
+	lookups map[string]int
+}
+
+// NewSupportHandler creates a SupportHandler of the donations in the store.
+func NewSupportHandler(donations store.DonationStore) *SupportHandler {
+	return &SupportHandler{
+		donations: donations,
+		lookups:   make(map[string]int),
+	}
+}
+
+// chargeMatch is a donation matching a lookup, with the donor's details masked.
+type chargeMatch struct {
+	ID        string    `json:"id"`
+	Amount    int64     `json:"amount"`
+	Currency  string    `json:"currency"`
+	Status    string    `json:"status"`
+	CardLast4 string    `json:"cardLast4"`
+	Campaign  string    `json:"campaign,omitempty"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// HandleLookupCharge finds the donation behind a charge on a donor's bank
+// statement on GET /support/lookup-charge?last4=4242&amount=2500&date=2024-03-05.
+// The amount is in the smallest currency unit. Charges made a day before or
+// after the date match too, as banks book them late. Names and emails are
+// masked, so the caller can confirm them with the donor but not learn them.
+// Principals can look up SupportLookupsPerMinute charges per minute.
+func (sh *SupportHandler) HandleLookupCharge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if retryAfter := sh.count(auth.Principal(r.Context()), time.Now().UTC()); retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds()+0.5)))
+		writeJSONErrorMessage(w, "too many lookups, try again in a minute", http.StatusTooManyRequests)
+		return
+	}
+
+	params := r.URL.Query()
+	card := params.Get("last4")
+	if !last4.MatchString(card) {
+		writeJSONErrorMessage(w, "last4 must be the last 4 digits of the card", http.StatusBadRequest)
+		return
+	}
+	amount, err := strconv.ParseInt(params.Get("amount"), 10, 64)
+	if err != nil || amount <= 0 {
+		writeJSONErrorMessage(w, "amount must be the charged amount in the smallest currency unit", http.StatusBadRequest)
+		return
+	}
+	date, err := time.Parse("2006-01-02", params.Get("date"))
+	if err != nil {
+		writeJSONErrorMessage(w, "date must be a YYYY-MM-DD date", http.StatusBadRequest)
+		return
+	}
+
+	q, err := store.DonationListSpec.Parse(url.Values{})
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not look up charge", zap.Error(err))
+		writeJSONErrorMessage(w, "Could not look up charge", http.StatusInternalServerError)
+		return
+	}
+	q.Limit = listing.MaxLimit
+	q.Filter.AmountGTE, q.Filter.AmountLTE = &amount, &amount
+	q.Filter.CreatedGTE = date.AddDate(0, 0, -1)
+	q.Filter.CreatedLTE = date.AddDate(0, 0, 2).Add(-time.Nanosecond)
+
+	matches := []chargeMatch{}
+	for len(matches) < maxChargeMatches {
+		donations, next, err := sh.donations.ListDonations(r.Context(), q)
+		if err != nil {
+			requestLogger(r.Context()).Error("Could not look up charge", zap.Error(err))
+			writeJSONErrorMessage(w, "Could not look up charge", http.StatusInternalServerError)
+			return
+		}
+		for _, d := range donations {
+			if d.CardLast4 != card || len(matches) == maxChargeMatches {
+				continue
+			}
+			matches = append(matches, chargeMatch{
+				ID:        d.ID,
+				Amount:    d.Amount,
+				Currency:  d.Currency,
+				Status:    d.Status,
+				CardLast4: d.CardLast4,
+				Campaign:  d.Campaign,
+				Name:      maskName(d.CustomerName),
+				Email:     maskEmail(d.CustomerEmail),
+				CreatedAt: d.CreatedAt,
+			})
+		}
+		if next == "" {
+			break
+		}
+		if q.Cursor, err = listing.DecodeCursor(next); err != nil {
+			requestLogger(r.Context()).Error("Could not look up charge", zap.Error(err))
+			writeJSONErrorMessage(w, "Could not look up charge", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	requestLogger(r.Context()).Info("Looked up charges on a card", zap.String("staff", auth.Principal(r.Context())), zap.Int64("amount", amount),
+		zap.String("card", card), zap.String("date", date.Format("2006-01-02")), zap.Int("matches", len(matches)))
+	writeJSON(w, struct {
+		Data []chargeMatch `json:"data"`
+	}{matches})
+}
+
+// count counts a lookup of the principal, or returns how long to wait if it
+// made SupportLookupsPerMinute lookups this minute.
+func (sh *SupportHandler) count(principal string, now time.Time) time.Duration {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	minute := now.Truncate(time.Minute)
+	if !sh.minute.Equal(minute) {
+		sh.minute, sh.lookups = minute, make(map[string]int)
+	}
+	if sh.lookups[principal] >= SupportLookupsPerMinute {
+		return minute.Add(time.Minute).Sub(now)
+	}
+	sh.lookups[principal]++
+	return 0
+}
+
+// maskName keeps the initials of a name, e.g. "Ana Horvat" is "A** H*****".
+func maskName(name string) string {
+	words := strings.Fields(name)
+	for i, word := range words {
+		words[i] = maskWord(word)
+	}
+	return strings.Join(words, " ")
+}
+
+// maskEmail keeps the first letters of an email's local part and domain and
+// its top-level domain, e.g. "ana@example.org" is "a**@e******.org".
+func maskEmail(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return maskWord(email)
+	}
+	local, domain := email[:at], email[at+1:]
+	tld := ""
+	if dot := strings.LastIndex(domain, "."); dot > 0 {
+		domain, tld = domain[:dot], domain[dot:]
+	}
+	return maskWord(local) + "@" + maskWord(domain) + tld
+}
+
+func maskWord(word string) string {
+	runes := []rune(word)
+	if len(runes) == 0 {
+		return ""
+	}
+	return string(runes[0]) + strings.Repeat("*", len(runes)-1)
+}
@@ -0,0 +1,139 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/store"
+	"go.uber.org/zap"
+)
+
+// TagHandler serves the admin API of tags.
+type TagHandler struct {
+	tags store.TagStore
+}
+
+// NewTagHandler creates a TagHandler managing the tags in the store.
+func NewTagHandler(tags store.TagStore) *TagHandler {
+	return &TagHandler{tags: tags}
+}
+
+// HandleTags routes the /admin/tags endpoints:
+//
+//	GET    /admin/tags          lists tags with the numbers of tagged donors and donations
+//	POST   /admin/tags          creates a tag from {"name", "description"}
+//	GET    /admin/tags/{name}   shows a tag
+//	DELETE /admin/tags/{name}   deletes a tag and removes it from everything tagged with it
+func (th *TagHandler) HandleTags(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/tags"), "/")
+
+	switch {
+	case name == "" && r.Method == "GET":
+		th.list(w, r)
+	case name == "" && r.Method == "POST":
+		th.create(w, r)
+	case name != "" && !strings.Contains(name, "/") && (r.Method == "GET" || r.Method == "DELETE"):
+		th.tag(w, r, name)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (th *TagHandler) list(w http.ResponseWriter, r *http.Request) {
+	q, ok := parseListQuery(w, r, store.TagListSpec)
+	if !ok {
+		return
+	}
+
+	tags, next, err := th.tags.ListTags(r.Context(), q)
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not list tags", zap.Error(err))
+		writeJSONErrorMessage(w, "Could not list tags", http.StatusInternalServerError)
+		return
+	}
+
+	writeList(w, tags, next)
+}
+
+func (th *TagHandler) create(w http.ResponseWriter, r *http.Request) {
+	var tag store.Tag
+	if err := json.NewDecoder(r.Body).Decode(&tag); err != nil {
+		writeJSONErrorMessage(w, "invalid tag: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := store.ValidateTagName(tag.Name); err != nil {
+		writeJSONErrorMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tag.CreatedAt = time.Now().UTC()
+	tag.Donors, tag.Donations = 0, 0
+
+	err := th.tags.CreateTag(r.Context(), &tag)
+	if errors.Is(err, store.ErrExists) {
+		writeJSONErrorMessage(w, fmt.Sprintf("tag %q exists", tag.Name), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not create tag", zap.String("tag", tag.Name), zap.Error(err))
+		writeJSONErrorMessage(w, "Could not create tag", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSONError(w, tag, http.StatusCreated)
+}
+
+func (th *TagHandler) tag(w http.ResponseWriter, r *http.Request, name string) {
+	var tag *store.Tag
+	var err error
+	if r.Method == "DELETE" {
+		err = th.tags.DeleteTag(r.Context(), name)
+	} else {
+		tag, err = th.tags.GetTag(r.Context(), name)
+	}
+
+	if errors.Is(err, store.ErrNotFound) {
+		writeJSONErrorMessage(w, fmt.Sprintf("tag %q does not exist", name), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not change tag", zap.String("method", r.Method), zap.String("tag", name), zap.Error(err))
+		writeJSONErrorMessage(w, "Could not access tag", http.StatusInternalServerError)
+		return
+	}
+
+	if tag == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, tag)
+}
+
+// handleTagging tags (PUT) or untags (DELETE) a donor or donation.
+func handleTagging(w http.ResponseWriter, r *http.Request, tags store.TagStore, kind, id, tag string) {
+	var err error
+	switch r.Method {
+	case "PUT":
+		err = tags.AddTag(r.Context(), kind, id, tag)
+	case "DELETE":
+		err = tags.RemoveTag(r.Context(), kind, id, tag)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if errors.Is(err, store.ErrNotFound) {
+		writeJSONErrorMessage(w, fmt.Sprintf("tag %q does not exist", tag), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		requestLogger(r.Context()).Error("Could not tag", zap.String("kind", kind), zap.String("id", id), zap.String("tag", tag), zap.Error(err))
+		writeJSONErrorMessage(w, "Could not change tags", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,297 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+
+	"github.com/vedrankolka/donation-server/pkg/auth"
+	"github.com/vedrankolka/donation-server/pkg/currency"
+	"github.com/vedrankolka/donation-server/pkg/metrics"
+	"github.com/vedrankolka/donation-server/pkg/payments"
+	"go.uber.org/zap"
+)
+
+// Metadata of in-person payments.
+const (
+	// ChannelKey is the metadata key of the channel a payment was made
+	// through, ChannelInPerson for payments at a card reader.
+	ChannelKey      = "channel"
+	ChannelInPerson = "in_person"
+	// TerminalReaderKey is the metadata key of the reader an in-person
+	// payment was handed to, if the server handed it to one.
+	TerminalReaderKey = "terminal_reader"
+)
+
+var terminalPayments = metrics.NewCounterVec(
+	"donation_server_terminal_payments_total",
+	"In-person payments started for card readers, by outcome.",
+	"outcome",
+)
+
+// terminalConfig configures in-person payments with card readers.
+type terminalConfig struct {
+	// location is the ID of the location of the readers, used when a request
+	// does not name one.
+	location string
+	// customer is the ID of the customer of in-person donations whose donor
+	// is not known.
+	customer string
+}
+
+// WithTerminal takes in-person donations with Stripe Terminal card readers
+// at the location. Donations whose donor is not given are made by the
+// customer, if it is set, and refused otherwise.
+func WithTerminal(location, customer string) Option {
+	return func(dh *DonationHandler) {
+		dh.terminal = &terminalConfig{location: location, customer: customer}
+	}
+}
+
+// HandleTerminalConnectionToken creates a connection token the Stripe
+// Terminal SDK of a point-of-sale app connects to readers with, POST
+// /admin/terminal/connection-token, optionally with {"location": "tml_..."}.
+// It returns {"secret"}.
+func (dh *DonationHandler) HandleTerminalConnectionToken(w http.ResponseWriter, r *http.Request) {
+	if !dh.checkTerminal(w, r) {
+		return
+	}
+	var body struct {
+		Location string `json:"location"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxIntentBody)).Decode(&body); err != nil && err != io.EOF {
+		writeJSONErrorMessage(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if body.Location == "" {
+		body.Location = dh.terminal.location
+	}
+
+	secret, err := dh.provider.CreateConnectionToken(r.Context(), body.Location)
+	if err != nil {
+		dh.writeTerminalError(w, r, "Could not create the connection token", err)
+		return
+	}
+	writeJSON(w, struct {
+		Secret string `json:"secret"`
+	}{secret})
+}
+
+// HandleRegisterReader registers a card reader, POST /admin/terminal/readers
+// with {"registrationCode": "simulated-wpe", "label": "Gala desk"} and
+// optionally the "location", the configured one by default. It returns the
+// reader's {"id", "label", "location", "deviceType", "status"}.
+func (dh *DonationHandler) HandleRegisterReader(w http.ResponseWriter, r *http.Request) {
+	if !dh.checkTerminal(w, r) {
+		return
+	}
+	var body struct {
+		RegistrationCode string `json:"registrationCode"`
+		Label            string `json:"label"`
+		Location         string `json:"location"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxIntentBody)).Decode(&body); err != nil && err != io.EOF {
+		writeJSONErrorMessage(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if body.RegistrationCode == "" {
+		writeJSONErrorMessage(w, "registrationCode is required", http.StatusBadRequest)
+		return
+	}
+	if body.Location == "" {
+		body.Location = dh.terminal.location
+	}
+
+	reader, err := dh.provider.RegisterReader(r.Context(), &payments.ReaderParams{
+		RegistrationCode: body.RegistrationCode,
+		Label:            body.Label,
+		Location:         body.Location,
+	})
+	if err != nil {
+		dh.writeTerminalError(w, r, "Could not register the reader", err)
+		return
+	}
+	dh.logger(r.Context()).Info("Registered card reader", zap.String("reader", reader.ID),
+		zap.String("location", reader.Location), zap.String("staff", auth.Principal(r.Context())))
+	writeJSON(w, struct {
+		ID         string `json:"id"`
+		Label      string `json:"label"`
+		Location   string `json:"location"`
+		DeviceType string `json:"deviceType"`
+		Status     string `json:"status"`
+	}{reader.ID, reader.Label, reader.Location, reader.DeviceType, reader.Status})
+}
+
+// terminalPaymentRequest is the body of POST /admin/terminal/payment-intents.
+type terminalPaymentRequest struct {
+	// Amount in the smallest currency unit.
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+	Campaign string `json:"campaign"`
+	// Reader the payment is handed to, for smart readers. Without it the
+	// point-of-sale app collects the payment with the client secret.
+	Reader     string `json:"reader"`
+	DonorEmail string `json:"donorEmail"`
+	DonorName  string `json:"donorName"`
+}
+
+// HandleCreateTerminalPayment creates the intent of an in-person donation,
+// POST /admin/terminal/payment-intents with {"amount": 2500, "currency":
+// "EUR", "campaign": "gala", "reader": "tmr_...", "donorEmail":
+// "ana.horvat@example.com", "donorName": "Ana Horvat"}. The payment is handed
+// to the reader if one is given. It returns {"id", "clientSecret", "reader"}.
+//
+// The intent is of the donor's customer, found or created by the email, or
+// of the customer of unknown donors. Once paid, the donation is recorded and
+// notified by the webhook like online ones, with ChannelInPerson metadata.
+func (dh *DonationHandler) HandleCreateTerminalPayment(w http.ResponseWriter, r *http.Request) {
+	if !dh.checkTerminal(w, r) {
+		return
+	}
+	var body terminalPaymentRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxIntentBody)).Decode(&body); err != nil && err != io.EOF {
+		writeJSONErrorMessage(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if !dh.checkPaused(w) {
+		return
+	}
+
+	donationCurrency, err := findCurrency(dh.currencies, body.Currency)
+	if err != nil {
+		writeJSONErrorMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := donationCurrency.Check(body.Amount); err != nil {
+		writeAmountError(w, err.(*currency.AmountError))
+		return
+	}
+	if parsed, err := mail.ParseAddress(body.DonorEmail); body.DonorEmail != "" && (err != nil || parsed.Address != body.DonorEmail) {
+		writeJSONErrorMessage(w, "the donor email is not a valid email address", http.StatusBadRequest)
+		return
+	}
+	if body.DonorEmail == "" && dh.terminal.customer == "" {
+		writeJSONErrorMessage(w, "donorEmail is required", http.StatusBadRequest)
+		return
+	}
+	params := &payments.IntentParams{
+		Amount:             body.Amount,
+		Currency:           donationCurrency.Code,
+		PaymentMethodTypes: []string{payments.PaymentMethodCardPresent},
+		ReceiptEmail:       body.DonorEmail,
+	}
+	params.AddMetadata(ChannelKey, ChannelInPerson)
+	if body.Campaign != "" {
+		if len(body.Campaign) > maxMetadataValue {
+			writeJSONErrorMessage(w, fmt.Sprintf("the campaign must be at most %d bytes", maxMetadataValue), http.StatusBadRequest)
+			return
+		}
+		if err := dh.checkCampaign(r.Context(), body.Campaign); err != nil {
+			writeJSONErrorMessage(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		params.AddMetadata(CampaignKey, body.Campaign)
+	}
+	if body.Reader != "" {
+		params.AddMetadata(TerminalReaderKey, body.Reader)
+	}
+	if params.IdempotencyKey, err = dh.requestIdempotencyKey(r, "terminal-payment", params); err != nil {
+		writeJSONErrorMessage(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	logger := dh.logger(r.Context()).With(zap.String("staff", auth.Principal(r.Context())))
+	ctx, cancel := context.WithTimeout(r.Context(), Timeout)
+	defer cancel()
+	if params.CustomerID, err = dh.terminalCustomer(ctx, body, params.IdempotencyKey); err != nil {
+		terminalPayments.Inc("failed")
+		dh.writeTerminalError(w, r, "Could not find the customer of the donor", err)
+		return
+	}
+	intent, err := dh.provider.CreateIntent(ctx, params)
+	if err != nil {
+		terminalPayments.Inc("failed")
+		dh.writeTerminalError(w, r, "Could not create the payment intent", err)
+		return
+	}
+	logger = logger.With(zap.String("payment_intent", intent.ID), zap.String("customer", params.CustomerID))
+	if body.Reader != "" {
+		if err := dh.provider.ProcessPayment(ctx, body.Reader, intent.ID); err != nil {
+			terminalPayments.Inc("failed")
+			dh.writeTerminalError(w, r, "Could not hand the payment to the reader", err)
+			return
+		}
+		logger = logger.With(zap.String("reader", body.Reader))
+	}
+	terminalPayments.Inc("started")
+	logger.Info("Started in-person payment", zap.Int64("amount", body.Amount), zap.String("currency", donationCurrency.Code))
+
+	writeJSON(w, struct {
+		ID           string `json:"id"`
+		ClientSecret string `json:"clientSecret"`
+		Reader       string `json:"reader,omitempty"`
+	}{intent.ID, intent.ClientSecret, body.Reader})
+}
+
+// terminalCustomer returns the ID of the customer of an in-person donation:
+// that of the donor's email, created if there is none, or the customer of
+// unknown donors.
+func (dh *DonationHandler) terminalCustomer(ctx context.Context, body terminalPaymentRequest, key string) (string, error) {
+	if body.DonorEmail == "" {
+		return dh.terminal.customer, nil
+	}
+	customers, err := dh.provider.FindCustomers(ctx, body.DonorEmail)
+	if err != nil {
+		return "", err
+	}
+	for _, c := range customers {
+		if body.DonorName == "" || c.Name == body.DonorName {
+			return c.ID, nil
+		}
+	}
+	if len(customers) > 0 {
+		return customers[0].ID, nil
+	}
+	customer, err := dh.provider.CreateCustomer(ctx, &payments.CustomerParams{
+		Email:          body.DonorEmail,
+		Name:           body.DonorName,
+		IdempotencyKey: idempotencyKey("customer", key),
+	})
+	if err != nil {
+		return "", err
+	}
+	return customer.ID, nil
+}
+
+// checkTerminal answers requests with 404 if in-person donations are not
+// configured, and with 405 if they are not POSTs. It reports whether the
+// request can be handled.
+func (dh *DonationHandler) checkTerminal(w http.ResponseWriter, r *http.Request) bool {
+	if dh.terminal == nil {
+		http.NotFound(w, r)
+		return false
+	}
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+// writeTerminalError answers a failed call to the provider, with the
+// provider's error if it refused the call.
+func (dh *DonationHandler) writeTerminalError(w http.ResponseWriter, r *http.Request, message string, err error) {
+	logger := dh.logger(r.Context())
+	var providerErr *payments.Error
+	if errors.As(err, &providerErr) {
+		logger.Warn("The payment provider refused the terminal request", providerErrorFields(providerErr)...)
+		writeJSONErrorMessage(w, providerErr.Error(), http.StatusBadGateway)
+		return
+	}
+	logger.Error(message, zap.Error(err))
+	writeJSONErrorMessage(w, message, http.StatusInternalServerError)
+}
@@ -0,0 +1,245 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/address"
+	"github.com/vedrankolka/donation-server/pkg/clientip"
+	"github.com/vedrankolka/donation-server/pkg/payments"
+	"github.com/vedrankolka/donation-server/pkg/store"
+	"github.com/vedrankolka/donation-server/pkg/vat"
+	"go.uber.org/zap"
+)
+
+// Metadata keys describing how a payment is split into a donation, purchases and tax.
+const (
+	PurchaseItemsKey  = "purchase_items"
+	DonationAmountKey = "donation_amount"
+	PurchaseAmountKey = "purchase_amount"
+	VATAmountKey      = "vat_amount"
+	TaxCalculationKey = "tax_calculation"
+)
+
+// WithVAT enables payments that combine a donation with purchases from the
+// configured products. VAT is computed by the calculator and an invoice for
+// the purchased part is issued and saved in the invoice store.
+func WithVAT(config *vat.Config, calculator vat.Calculator, invoices store.InvoiceStore) Option {
+	return func(dh *DonationHandler) {
+		dh.vatConfig = config
+		dh.vatCalculator = calculator
+		dh.invoices = invoices
+	}
+}
+
+// WithTaxedDonations sends every payment to the VAT calculator, not only the
+// ones with purchases, for calculators like Stripe Tax that know where
+// donations are taxable.
+func WithTaxedDonations() Option {
+	return func(dh *DonationHandler) {
+		dh.taxDonations = true
+	}
+}
+
+// WithClientIPHeader sets the header holding the client IP when running
+// behind a proxy. The client IP locates donors for tax calculation and is
+// kept with donations to detect bursts from one client, see package anomaly.
+func WithClientIPHeader(header clientip.Header) Option {
+	return func(dh *DonationHandler) {
+		dh.clientIPHeader = header
+	}
+}
+
+// getBreakdown reads the purchased items from the items query parameter and
+// computes the split of the payment. It returns nil if nothing is bought and
+// donations are not taxed.
+func (dh *DonationHandler) getBreakdown(r *http.Request, donation int64, currencyCode string, donorAddress *address.Address) (*vat.Breakdown, error) {
+	itemsParam := r.URL.Query().Get("items")
+	if itemsParam == "" && !dh.taxDonations {
+		return nil, nil
+	}
+	if dh.vatCalculator == nil {
+		return nil, errors.New("purchases are not supported")
+	}
+	// Products are priced in the default currency.
+	if defaultCurrency := dh.currencies[0].Code; !strings.EqualFold(currencyCode, defaultCurrency) {
+		return nil, fmt.Errorf("purchases and taxed donations are only made in %s", defaultCurrency)
+	}
+
+	items, err := vat.ParseItems(itemsParam)
+	if err != nil {
+		return nil, err
+	}
+
+	order := vat.Order{
+		Items:    items,
+		Donation: donation,
+		Currency: currencyCode,
+		Address:  donorAddress,
+	}
+	if donorAddress != nil {
+		order.Country = donorAddress.Country
+	}
+	if ip := clientip.FromRequest(r, dh.clientIPHeader); ip != nil {
+		order.IPAddress = ip.String()
+	}
+
+	return dh.vatCalculator.Calculate(r.Context(), order)
+}
+
+func addBreakdownMetadata(params *payments.IntentParams, items string, b *vat.Breakdown) {
+	if items != "" {
+		params.AddMetadata(PurchaseItemsKey, items)
+	}
+	if b.CalculationID != "" {
+		params.AddMetadata(TaxCalculationKey, b.CalculationID)
+	}
+	params.AddMetadata(DonationAmountKey, strconv.FormatInt(b.Donation, 10))
+	params.AddMetadata(PurchaseAmountKey, strconv.FormatInt(b.Purchase, 10))
+	params.AddMetadata(VATAmountKey, strconv.FormatInt(b.VAT, 10))
+}
+
+// splitPayment records how the charge splits into a donation, purchases and
+// tax on the donation, and issues an invoice if there are purchases or tax,
+// or if the donor requested one. Invoices are issued only once per charge, so
+// redelivered events get the existing invoice.
+func (dh *DonationHandler) splitPayment(ctx context.Context, event *payments.Event, customer *payments.Customer, donation *store.Donation) (*vat.Invoice, error) {
+	itemsParam := event.Charge.Metadata[PurchaseItemsKey]
+	calculationID := event.Charge.Metadata[TaxCalculationKey]
+	requested, err := chargeInvoiceRequest(event)
+	if err != nil {
+		return nil, err
+	}
+	if itemsParam == "" && calculationID == "" && requested == nil {
+		return nil, nil
+	}
+	if dh.vatCalculator == nil {
+		return nil, fmt.Errorf("charge %q includes purchases, tax or an invoice request, but VAT is not configured", donation.ID)
+	}
+
+	if invoice, err := dh.invoices.GetInvoiceByCharge(ctx, donation.ID); err == nil {
+		setSplit(donation, &vat.Breakdown{
+			Rates:         invoice.Rates,
+			Donation:      invoice.Donation,
+			Purchase:      invoice.Gross,
+			VAT:           invoice.VAT + invoice.DonationVAT,
+			CalculationID: calculationID,
+		})
+		donation.InvoiceNumber = invoice.Number
+		return invoice, nil
+	} else if !errors.Is(err, store.ErrNotFound) {
+		return nil, err
+	}
+
+	// A donation invoiced on request alone is not calculated.
+	breakdown := &vat.Breakdown{Donation: donation.Amount, Total: donation.Amount}
+	if itemsParam != "" || calculationID != "" {
+		if breakdown, err = dh.chargeBreakdown(ctx, event, donation, itemsParam, calculationID); err != nil {
+			return nil, err
+		}
+		if committer, ok := dh.vatCalculator.(vat.Committer); ok {
+			if err := committer.Commit(ctx, breakdown, donation.ID); err != nil {
+				return nil, fmt.Errorf("could not commit tax calculation: %w", err)
+			}
+		}
+	}
+
+	setSplit(donation, breakdown)
+	if !breakdown.Taxed() && requested == nil {
+		return nil, nil
+	}
+
+	issuedAt := time.Now().UTC()
+	sequence, err := dh.invoices.NextInvoiceSequence(ctx, issuedAt.Year())
+	if err != nil {
+		return nil, err
+	}
+
+	buyer := vat.Party{Name: customer.Name, Email: customer.Email}
+	if donation.Address != nil {
+		a := donation.Address
+		buyer.Address = strings.Join(nonEmpty(a.Line1, a.Line2, a.PostalCode+" "+a.City, a.State, a.Country), ", ")
+		buyer.Country = a.Country
+	}
+	if requested != nil {
+		buyer.Name = requested.Name
+		buyer.VATID = requested.VATID
+		buyer.ElectronicAddress = requested.ElectronicAddress
+	}
+
+	invoice := vat.NewInvoice(
+		vat.InvoiceNumber(dh.vatConfig.InvoicePrefix, issuedAt.Year(), sequence),
+		issuedAt, donation.ID, dh.vatConfig.Seller, buyer, donation.Currency, breakdown,
+	)
+	if requested != nil {
+		invoice.BuyerReference = requested.Reference
+	}
+	if err := dh.invoices.SaveInvoice(ctx, invoice); err != nil {
+		return nil, err
+	}
+
+	dh.logger(ctx).Info("Issued invoice", zap.String("invoice", invoice.Number), zap.String("donation", donation.ID))
+	donation.InvoiceNumber = invoice.Number
+	return invoice, nil
+}
+
+// chargeBreakdown fetches the calculation the payment intent was created with,
+// or calculates the breakdown again if the calculator does not keep them.
+func (dh *DonationHandler) chargeBreakdown(ctx context.Context, event *payments.Event, donation *store.Donation, itemsParam, calculationID string) (*vat.Breakdown, error) {
+	if retriever, ok := dh.vatCalculator.(vat.Retriever); ok && calculationID != "" {
+		return retriever.Retrieve(ctx, calculationID)
+	}
+
+	items, err := vat.ParseItems(itemsParam)
+	if err != nil {
+		return nil, err
+	}
+	donated, err := strconv.ParseInt(event.Charge.Metadata[DonationAmountKey], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s metadata: %w", DonationAmountKey, err)
+	}
+
+	breakdown, err := dh.vatCalculator.Calculate(ctx, vat.Order{
+		Items:    items,
+		Donation: donated,
+		Currency: donation.Currency,
+		Country:  billingCountry(event),
+		Address:  donation.Address,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if breakdown.Total != donation.Amount {
+		// Prices changed between creating the payment intent and the charge.
+		dh.logger(ctx).Warn("The charge does not match the current price, invoicing the charged amount",
+			zap.String("donation", donation.ID), zap.Int64("amount", donation.Amount), zap.Int64("price", breakdown.Total))
+		breakdown.Donation = donation.Amount - breakdown.Purchase
+		breakdown.Total = donation.Amount
+	}
+
+	return breakdown, nil
+}
+
+func setSplit(donation *store.Donation, b *vat.Breakdown) {
+	donation.DonationAmount = b.Donation
+	donation.PurchaseAmount = b.Purchase
+	donation.VATAmount = b.VAT
+	donation.TaxRates = b.Rates
+	donation.TaxCalculationID = b.CalculationID
+}
+
+func nonEmpty(values ...string) []string {
+	var result []string
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
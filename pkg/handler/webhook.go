@@ -0,0 +1,185 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/notifier"
+	"github.com/vedrankolka/donation-server/pkg/payments"
+	"github.com/vedrankolka/donation-server/pkg/rollup"
+	"github.com/vedrankolka/donation-server/pkg/store"
+	"go.uber.org/zap"
+)
+
+// eventHandler handles a type of Stripe events in HandleWebhook.
+type eventHandler struct {
+	// hasObject reports whether the event has the object handle reads.
+	hasObject func(event *payments.Event) bool
+	// handle processes the event and returns its outcome. If it fails, it
+	// writes the error response and returns store.OutcomeFailed, otherwise
+	// the webhook answers with an empty body.
+	handle func(dh *DonationHandler, w http.ResponseWriter, r *http.Request, event *payments.Event, logger *zap.Logger) string
+}
+
+// eventHandlers are the handlers of the events of the webhook, by type. The
+// webhook endpoint must be subscribed to them in Stripe.
+var eventHandlers = map[string]eventHandler{
+	"charge.succeeded":              {hasCharge, (*DonationHandler).handleChargeSucceeded},
+	"invoice.paid":                  {hasInvoice, (*DonationHandler).handleInvoicePaid},
+	"payment_intent.payment_failed": {hasPaymentIntent, (*DonationHandler).handlePaymentFailed},
+	"charge.refunded":               {hasCharge, (*DonationHandler).handleChargeRefunded},
+	"charge.dispute.created":        {hasDispute, (*DonationHandler).handleDisputeCreated},
+}
+
+func hasCharge(event *payments.Event) bool        { return event.Charge != nil }
+func hasInvoice(event *payments.Event) bool       { return event.Invoice != nil }
+func hasPaymentIntent(event *payments.Event) bool { return event.PaymentIntent != nil }
+func hasDispute(event *payments.Event) bool       { return event.Dispute != nil }
+
+// handlePaymentFailed notifies a payment that failed, e.g. of a declined
+// card. Nothing was charged, so nothing is recorded.
+func (dh *DonationHandler) handlePaymentFailed(w http.ResponseWriter, r *http.Request, event *payments.Event, logger *zap.Logger) string {
+	pi := event.PaymentIntent
+	paymentEvent := notifier.PaymentEvent{
+		Type:            notifier.EventTypePaymentFailed,
+		PaymentIntentID: pi.ID,
+		CustomerID:      pi.CustomerID,
+		CustomerEmail:   pi.Email,
+		Currency:        pi.Currency,
+		Reason:          pi.FailureCode,
+		Campaign:        pi.Metadata[CampaignKey],
+	}
+	if paymentEvent.Reason == "" {
+		paymentEvent.Reason = pi.FailureMessage
+	}
+	if amount, ok := eventAmount(pi.Amount); ok {
+		paymentEvent.Amount = float64(amount)
+	}
+	dh.updateKioskPayment(r.Context(), pi.Metadata, store.KioskPaymentFailed, "", logger)
+	return dh.notifyPayment(w, r, event, paymentEvent, logger)
+}
+
+// handleChargeRefunded marks a donation refunded in full as refunded, and
+// notifies the refund. Refunds made by the server, e.g. by auto-refund
+// rules, are notified too.
+func (dh *DonationHandler) handleChargeRefunded(w http.ResponseWriter, r *http.Request, event *payments.Event, logger *zap.Logger) string {
+	charge := event.Charge
+	paymentEvent := notifier.PaymentEvent{
+		Type:            notifier.EventTypeRefund,
+		PaymentIntentID: charge.PaymentIntentID,
+		ChargeID:        charge.ID,
+		CustomerID:      charge.CustomerID,
+		CustomerEmail:   charge.BillingDetails.Email,
+		Currency:        charge.Currency,
+		Refunded:        charge.Refunded,
+		RefundID:        charge.RefundID,
+		Reason:          charge.RefundReason,
+		Campaign:        charge.Metadata[CampaignKey],
+	}
+	if amount, ok := eventAmount(charge.AmountRefunded); ok {
+		paymentEvent.Amount = float64(amount)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), Timeout)
+	defer cancel()
+
+	donation := dh.paymentDonation(ctx, charge.ID, &paymentEvent, logger)
+	if donation != nil && charge.Refunded && donation.Status != store.StatusRefunded {
+		donation.Status, donation.RefundID = store.StatusRefunded, charge.RefundID
+		if err := dh.store.SaveDonation(ctx, donation); err != nil {
+			logger.Error("Could not record refund of donation", zap.String("donation", donation.ID), zap.Error(err))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return store.OutcomeFailed
+		}
+		logger.Info("Donation was refunded", zap.String("donation", donation.ID), zap.String("refund", charge.RefundID))
+	}
+	// Refunds made by the server already marked the donation refunded, so the
+	// rollups are refreshed whatever its status.
+	if donation != nil && charge.Refunded && dh.rollups != nil && time.Since(donation.CreatedAt) > rollup.RefreshWindow {
+		if err := dh.rollups.RefreshDay(ctx, donation.CreatedAt); err != nil {
+			logger.Error("Could not refresh rollups of refunded donation", zap.String("donation", donation.ID), zap.Error(err))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return store.OutcomeFailed
+		}
+	}
+	if charge.Refunded {
+		dh.updateKioskPayment(ctx, charge.Metadata, store.KioskPaymentRefunded, "", logger)
+	}
+	return dh.notifyPayment(w, r, event, paymentEvent, logger)
+}
+
+// handleDisputeCreated notifies a dispute of a donation, which must be
+// answered in the Stripe Dashboard.
+func (dh *DonationHandler) handleDisputeCreated(w http.ResponseWriter, r *http.Request, event *payments.Event, logger *zap.Logger) string {
+	dispute := event.Dispute
+	paymentEvent := notifier.PaymentEvent{
+		Type:            notifier.EventTypeDispute,
+		PaymentIntentID: dispute.PaymentIntentID,
+		ChargeID:        dispute.ChargeID,
+		Currency:        dispute.Currency,
+		DisputeID:       dispute.ID,
+		Reason:          dispute.Reason,
+	}
+	if amount, ok := eventAmount(dispute.Amount); ok {
+		paymentEvent.Amount = float64(amount)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), Timeout)
+	defer cancel()
+
+	dh.paymentDonation(ctx, dispute.ChargeID, &paymentEvent, logger)
+	logger.Warn("Donation is disputed", zap.String("donation", dispute.ChargeID), zap.String("dispute", dispute.ID))
+	return dh.notifyPayment(w, r, event, paymentEvent, logger)
+}
+
+// paymentDonation returns the recorded donation of the charge, if any, and
+// fills the fields of the payment event the charge did not have from it.
+func (dh *DonationHandler) paymentDonation(ctx context.Context, chargeID string, paymentEvent *notifier.PaymentEvent, logger *zap.Logger) *store.Donation {
+	if dh.store == nil || chargeID == "" {
+		return nil
+	}
+	donation, err := dh.store.GetDonation(ctx, chargeID)
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			logger.Warn("Could not get donation of the charge", zap.String("donation", chargeID), zap.Error(err))
+		}
+		return nil
+	}
+	if paymentEvent.CustomerID == "" {
+		paymentEvent.CustomerID = donation.CustomerID
+	}
+	if donation.CustomerEmail != "" {
+		paymentEvent.CustomerEmail = donation.CustomerEmail
+	}
+	if paymentEvent.Campaign == "" {
+		paymentEvent.Campaign = donation.Campaign
+	}
+	return donation
+}
+
+// notifyPayment notifies the payment event of the Stripe event, and
+// dead-letters it if it fails.
+func (dh *DonationHandler) notifyPayment(w http.ResponseWriter, r *http.Request, event *payments.Event, paymentEvent notifier.PaymentEvent, logger *zap.Logger) string {
+	ctx, cancel := context.WithTimeout(r.Context(), Timeout)
+	defer cancel()
+
+	deferred, err := dh.notifyWithinBudget(ctx, event, paymentEvent.Type, paymentEvent, paymentEvent.Key(), func(ctx context.Context) error {
+		return dh.notifier.NotifyPayment(notifier.WithChargedAt(ctx, eventCreated(event.Created)), paymentEvent)
+	})
+	if deferred {
+		return store.OutcomeDeferred
+	}
+	if err != nil {
+		logger.Error("Failed to notify about payment", zap.String("payment", paymentEvent.Key()), zap.Error(err))
+		if dh.deadLetter(ctx, event, paymentEvent.Type, paymentEvent, err) {
+			return store.OutcomeDeadLettered
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return store.OutcomeFailed
+	}
+	dh.recordNotification(ctx, event, paymentEvent.Type, paymentEvent.Key())
+	dh.resolveDeadLetter(ctx, event, paymentEvent.Type)
+	return store.OutcomeProcessed
+}
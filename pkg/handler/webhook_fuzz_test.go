@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stripe/stripe-go/v76"
+	"github.com/vedrankolka/donation-server/pkg/fixtures"
+	"github.com/vedrankolka/donation-server/pkg/listing"
+	"github.com/vedrankolka/donation-server/pkg/notifier"
+	"github.com/vedrankolka/donation-server/pkg/payments"
+	"github.com/vedrankolka/donation-server/pkg/recurring"
+	"github.com/vedrankolka/donation-server/pkg/store"
+)
+
+const fuzzWebhookSecret = "whsec_fuzz"
+
+// fuzzProvider verifies webhooks like Stripe and answers customer requests
+// from memory, rejecting customers created without an email and name.
+type fuzzProvider struct {
+	payments.Provider
+	t      *testing.T
+	stripe *payments.Stripe
+}
+
+func (p *fuzzProvider) VerifyWebhook(ctx context.Context, payload []byte, header http.Header) (*payments.Event, error) {
+	return p.stripe.VerifyWebhook(ctx, payload, header)
+}
+
+func (p *fuzzProvider) GetCustomer(ctx context.Context, id string) (*payments.Customer, error) {
+	return &payments.Customer{ID: id, Name: "Ana Horvat", Email: "ana.horvat@example.com"}, nil
+}
+
+func (p *fuzzProvider) FindCustomers(ctx context.Context, email string) ([]*payments.Customer, error) {
+	return nil, nil
+}
+
+func (p *fuzzProvider) CreateCustomer(ctx context.Context, params *payments.CustomerParams) (*payments.Customer, error) {
+	if params.Email == "" || params.Name == "" {
+		p.t.Errorf("created a customer without an email or name: %+v", params)
+	}
+	return &payments.Customer{ID: "cus_fuzz", Name: params.Name, Email: params.Email}, nil
+}
+
+func (p *fuzzProvider) UpdateCustomer(ctx context.Context, id string, params *payments.CustomerParams) (*payments.Customer, error) {
+	return &payments.Customer{ID: id}, nil
+}
+
+func (p *fuzzProvider) UpdatePaymentMetadata(ctx context.Context, id string, metadata map[string]string) error {
+	return nil
+}
+
+// fuzzNotifier checks that notifications can be encoded.
+type fuzzNotifier struct {
+	t *testing.T
+}
+
+func (n *fuzzNotifier) Notify(ctx context.Context, event notifier.DonationEvent) error {
+	if _, err := json.Marshal(event); err != nil {
+		n.t.Errorf("could not encode donation event %+v: %v", event, err)
+	}
+	if event.Amount < 0 {
+		n.t.Errorf("negative amount of donation event %+v", event)
+	}
+	return nil
+}
+
+func (n *fuzzNotifier) NotifyRecurring(ctx context.Context, event notifier.RecurringDonationEvent) error {
+	if _, err := json.Marshal(event); err != nil {
+		n.t.Errorf("could not encode recurring donation event %+v: %v", event, err)
+	}
+	if event.Amount < 0 {
+		n.t.Errorf("negative amount of recurring donation event %+v", event)
+	}
+	return nil
+}
+
+func (n *fuzzNotifier) NotifyPayment(ctx context.Context, event notifier.PaymentEvent) error {
+	if _, err := json.Marshal(event); err != nil {
+		n.t.Errorf("could not encode %s event %+v: %v", event.Type, event, err)
+	}
+	if event.Amount < 0 {
+		n.t.Errorf("negative amount of %s event %+v", event.Type, event)
+	}
+	return nil
+}
+
+func (n *fuzzNotifier) Close() error {
+	return nil
+}
+
+// FuzzWebhook delivers signed events of arbitrary payloads to the webhook,
+// which must not panic, and must record and notify only donations that can
+// be encoded.
+func FuzzWebhook(f *testing.F) {
+	f.Add(fixtures.ChargeSucceeded())
+	f.Add(fixtures.ChargeSucceeded(fixtures.Customer("cus_fuzz"), fixtures.Metadata(CampaignKey, "winter")))
+	f.Add(fixtures.ChargeSucceeded(fixtures.Address(nil), fixtures.Donor("", "")))
+	f.Add(fixtures.ChargeSucceeded(fixtures.Invoice("in_fuzz")))
+	f.Add(fixtures.PaymentIntentSucceeded())
+	f.Add(fixtures.ChargeRefunded(""))
+	f.Add(fixtures.DisputeCreated("fraudulent"))
+	f.Add(fixtures.PaymentFailed("card_declined"))
+	// Events of other API versions are rejected before their objects are read.
+	version := fmt.Sprintf(`"api_version": %q`, stripe.APIVersion)
+	f.Add([]byte(`{"id": "evt_1", "object": "event", ` + version + `, "type": "charge.succeeded", "created": 1700000000, "data": {"object": {"id": "ch_1", "amount": 1e300, "created": -1e20, "billing_details": {"email": "a@example.com", "name": "A"}}}}`))
+	f.Add([]byte(`{"id": "evt_2", "object": "event", ` + version + `, "type": "invoice.paid", "created": 1700000000, "data": {"object": {"id": "in_1", "subscription": "sub_1", "amount_paid": -5, "lines": {"data": [{"period": {"start": 1e15, "end": "x"}}]}}}}`))
+	f.Add([]byte(`{"id": "evt_3", "object": "event", ` + version + `, "type": "charge.succeeded", "data": {"object": null}}`))
+
+	// Every delivery is logged, which slows fuzzing down.
+	log.SetOutput(io.Discard)
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		donations := store.NewMemoryStore()
+		dh, err := NewHandler("pk_test_fuzz", fuzzWebhookSecret, &fuzzNotifier{t: t},
+			WithProvider(&fuzzProvider{t: t, stripe: payments.NewStripe("sk_test_fuzz", fuzzWebhookSecret)}),
+			WithStore(donations),
+			WithEventLog(donations),
+			WithDeadLetters(donations),
+			WithRecurring(&recurring.Config{}),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dh.HandleWebhook(httptest.NewRecorder(), fixtures.WebhookRequest("/webhook", payload, fuzzWebhookSecret))
+
+		q, err := store.DonationListSpec.Parse(url.Values{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		q.Limit = listing.MaxLimit
+		recorded, _, err := donations.ListDonations(context.Background(), q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, d := range recorded {
+			if _, err := json.Marshal(d); err != nil {
+				t.Errorf("could not encode recorded donation %+v: %v", d, err)
+			}
+			if d.Amount < 0 {
+				t.Errorf("recorded a negative amount: %+v", d)
+			}
+		}
+	})
+}
@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/vedrankolka/donation-server/pkg/fixtures"
+	"github.com/vedrankolka/donation-server/pkg/notifier"
+	"github.com/vedrankolka/donation-server/pkg/payments"
+	"github.com/vedrankolka/donation-server/pkg/store"
+)
+
+// countingNotifier counts the donations notified.
+type countingNotifier struct {
+	fuzzNotifier
+	donations int
+}
+
+func (n *countingNotifier) Notify(ctx context.Context, event notifier.DonationEvent) error {
+	n.donations++
+	return n.fuzzNotifier.Notify(ctx, event)
+}
+
+// TestRedeliveredChargeSucceeded checks that a redelivered charge.succeeded
+// keeps what happened to its donation since it was recorded.
+func TestRedeliveredChargeSucceeded(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		stored   store.Donation
+		notified int
+	}{
+		{"refunded", store.Donation{Status: store.StatusRefunded, RefundID: "re_1"}, 0},
+		{"held", store.Donation{Status: store.StatusHeld}, 0},
+		{"released", store.Donation{Status: store.StatusSucceeded, DuplicateOf: "ch_0"}, 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			donations := store.NewMemoryStore()
+			stored := tt.stored
+			stored.ID = "ch_redelivered"
+			if err := donations.SaveDonation(ctx, &stored); err != nil {
+				t.Fatal(err)
+			}
+			n := &countingNotifier{fuzzNotifier: fuzzNotifier{t: t}}
+			dh, err := NewHandler("pk_test_fuzz", fuzzWebhookSecret, n,
+				WithProvider(&fuzzProvider{t: t, stripe: payments.NewStripe("sk_test_fuzz", fuzzWebhookSecret)}),
+				WithStore(donations),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			payload := fixtures.ChargeSucceeded(fixtures.ID("ch_redelivered"), fixtures.Customer("cus_fuzz"))
+			dh.HandleWebhook(w, fixtures.WebhookRequest("/webhook", payload, fuzzWebhookSecret))
+			if w.Code != http.StatusOK {
+				t.Fatalf("the webhook answered %d: %s", w.Code, w.Body)
+			}
+
+			got, err := donations.GetDonation(ctx, "ch_redelivered")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Status != tt.stored.Status || got.RefundID != tt.stored.RefundID || got.DuplicateOf != tt.stored.DuplicateOf {
+				t.Errorf("the donation is %s (refund %q, duplicate of %q), want %s (refund %q, duplicate of %q)",
+					got.Status, got.RefundID, got.DuplicateOf, tt.stored.Status, tt.stored.RefundID, tt.stored.DuplicateOf)
+			}
+			if got.CustomerID != "cus_fuzz" {
+				t.Errorf("the donation is of customer %q, want the event's cus_fuzz", got.CustomerID)
+			}
+			if n.donations != tt.notified {
+				t.Errorf("%d donations were notified, want %d", n.donations, tt.notified)
+			}
+		})
+	}
+}
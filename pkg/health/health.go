@@ -0,0 +1,171 @@
+// Package health checks the dependencies of the server, like the notifier and
+// the store, and reports which are degraded and what that means for donors,
+// so frontends can say "receipts may be delayed" instead of failing opaquely.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Interval is how often the components are checked.
+	Interval = 30 * time.Second
+	// Timeout is how long a check may take.
+	Timeout = 5 * time.Second
+)
+
+// Statuses of the server.
+const (
+	StatusOK       = "ok"
+	StatusDegraded = "degraded"
+)
+
+// Impacts of degraded components on donors.
+const (
+	// ImpactReceiptsDelayed means donations are taken, but notifications,
+	// e.g. of receipts, are late.
+	ImpactReceiptsDelayed = "receipts_delayed"
+	// ImpactDonationsDelayed means donations are taken, but recorded late.
+	ImpactDonationsDelayed = "donations_delayed"
+)
+
+// Component is a dependency of the server.
+type Component struct {
+	Name string
+	// Impact on donors while the component is degraded.
+	Impact string
+	// Check returns an error if the component is degraded.
+	Check func(ctx context.Context) error
+}
+
+// Degradation is a degraded component.
+type Degradation struct {
+	Component string    `json:"component"`
+	Impact    string    `json:"impact"`
+	Since     time.Time `json:"since"`
+	// Error is only reported in details.
+	Error string `json:"error,omitempty"`
+}
+
+// Report is the status of the server.
+type Report struct {
+	Status       string        `json:"status"`
+	Degradations []Degradation `json:"degradations,omitempty"`
+}
+
+// Monitor checks components periodically.
+type Monitor struct {
+	mu         sync.RWMutex
+	components []Component
+	degraded   map[string]*Degradation
+}
+
+// NewMonitor creates a Monitor of the components.
+func NewMonitor(components ...Component) *Monitor {
+	return &Monitor{
+		components: components,
+		degraded:   make(map[string]*Degradation),
+	}
+}
+
+// Add adds a component, checked from the next check on.
+func (m *Monitor) Add(c Component) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.components = append(m.components, c)
+}
+
+// Run checks the components every Interval, starting now, until the context is done.
+func (m *Monitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(Interval)
+	defer ticker.Stop()
+
+	for {
+		m.CheckAll(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CheckAll checks every component at once, logging changes of their status.
+func (m *Monitor) CheckAll(ctx context.Context) {
+	m.mu.RLock()
+	components := append([]Component(nil), m.components...)
+	m.mu.RUnlock()
+
+	errs := make([]error, len(components))
+	var wg sync.WaitGroup
+	for i := range components {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, Timeout)
+			defer cancel()
+			errs[i] = components[i].Check(checkCtx)
+		}(i)
+	}
+	wg.Wait()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, c := range components {
+		d, wasDegraded := m.degraded[c.Name]
+		switch {
+		case errs[i] != nil && !wasDegraded:
+			log.Printf("[DEGRADED] %s is degraded (%s): %v\n", c.Name, c.Impact, errs[i])
+			m.degraded[c.Name] = &Degradation{Component: c.Name, Impact: c.Impact, Since: time.Now().UTC(), Error: errs[i].Error()}
+		case errs[i] != nil:
+			d.Error = errs[i].Error()
+		case wasDegraded:
+			log.Printf("[DEGRADED] %s recovered after %v.\n", c.Name, time.Since(d.Since).Round(time.Second))
+			delete(m.degraded, c.Name)
+		}
+	}
+}
+
+// Report returns the status of the server, with the errors of degraded
+// components if details is set.
+func (m *Monitor) Report(details bool) Report {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	report := Report{Status: StatusOK}
+	for _, d := range m.degraded {
+		degradation := *d
+		if !details {
+			degradation.Error = ""
+		}
+		report.Degradations = append(report.Degradations, degradation)
+	}
+	if len(report.Degradations) > 0 {
+		report.Status = StatusDegraded
+		sort.Slice(report.Degradations, func(i, j int) bool {
+			return report.Degradations[i].Component < report.Degradations[j].Component
+		})
+	}
+	return report
+}
+
+// Handler serves the report with details at /healthz. The server answers
+// with 200 OK while it takes donations, degraded or not.
+func (m *Monitor) Handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(m.Report(true)); err != nil {
+		log.Printf("Could not write health report: %v\n", err)
+	}
+}
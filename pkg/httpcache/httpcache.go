@@ -0,0 +1,81 @@
+// Package httpcache makes responses of public read endpoints cacheable, so
+// browsers and CDNs can absorb the read traffic of a popular campaign.
+package httpcache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// DefaultMaxAge is how long shared caches may keep responses if not configured.
+const DefaultMaxAge = time.Minute
+
+// Middleware sets an ETag and Cache-Control on successful GET and HEAD
+// responses and answers conditional requests (If-None-Match and
+// If-Modified-Since) with 304 Not Modified. lastModified is when the
+// content last changed, e.g. the start of the server for content that only
+// changes with a deploy; it is left out if zero. Handlers may set their own
+// ETag, Last-Modified and Cache-Control headers, which are kept.
+func Middleware(maxAge time.Duration, lastModified time.Time) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "GET" && r.Method != "HEAD" {
+				next(w, r)
+				return
+			}
+
+			// The handler always renders the body, http.ServeContent leaves it out for HEAD.
+			get := r
+			if r.Method == "HEAD" {
+				get = r.Clone(r.Context())
+				get.Method = "GET"
+			}
+			rec := &recorder{header: w.Header(), status: http.StatusOK}
+			next(rec, get)
+
+			if rec.status != http.StatusOK {
+				w.WriteHeader(rec.status)
+				w.Write(rec.body.Bytes())
+				return
+			}
+
+			header := w.Header()
+			if header.Get("ETag") == "" {
+				sum := sha256.Sum256(rec.body.Bytes())
+				header.Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+			}
+			if header.Get("Cache-Control") == "" {
+				header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge/time.Second)))
+			}
+			modified := lastModified
+			if t, err := http.ParseTime(header.Get("Last-Modified")); err == nil {
+				modified = t
+			}
+
+			http.ServeContent(w, r, "", modified, bytes.NewReader(rec.body.Bytes()))
+		}
+	}
+}
+
+// recorder keeps the response of a handler, writing headers to the real response.
+type recorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *recorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	rec.status = status
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	return rec.body.Write(b)
+}
@@ -0,0 +1,229 @@
+// Package jobs runs the scheduled jobs of the server, like the digest,
+// lifecycle emails, reports and retention, from their state in the store
+// instead of a cron on the host. Every instance sharing the store runs the
+// scheduler, and a lock per job makes one of them run each scheduled time.
+// Runs are at least once: a job whose instance dies while running it is run
+// again when its lock expires, and failed runs are retried.
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/clock"
+	"github.com/vedrankolka/donation-server/pkg/metrics"
+	"github.com/vedrankolka/donation-server/pkg/store"
+)
+
+const (
+	// PollInterval is how often the scheduler looks for due jobs.
+	PollInterval = 15 * time.Second
+	// DefaultTimeout is how long a job runs at most unless it sets its
+	// Timeout.
+	DefaultTimeout = 30 * time.Minute
+	// lockMargin is how much longer than its timeout a job is locked, so
+	// the lock outlives the run.
+	lockMargin = time.Minute
+	// RetryDelay is how long after a failed run the job is retried,
+	// doubling with every failure up to MaxRetryDelay. A job is never
+	// retried later than its next scheduled time.
+	RetryDelay    = time.Minute
+	MaxRetryDelay = time.Hour
+)
+
+var (
+	jobRuns = metrics.NewCounterVec(
+		"donation_server_job_runs_total",
+		"Runs of scheduled jobs by outcome, success or failure.",
+		"job", "outcome",
+	)
+	jobDuration = metrics.NewHistogramVec(
+		"donation_server_job_duration_seconds",
+		"Duration of the runs of scheduled jobs.",
+		[]float64{.1, 1, 5, 15, 60, 300, 900, 1800},
+		"job",
+	)
+)
+
+// Func runs a job. due is the time the run was scheduled at, which is
+// earlier than now for runs made late, e.g. after all instances were down.
+type Func func(ctx context.Context, due time.Time) error
+
+// Job is a job of a Scheduler.
+type Job struct {
+	// Name identifies the job in the store, e.g. "digest".
+	Name     string
+	Schedule clock.Schedule
+	// Jitter delays every scheduled run by a random duration up to it, so
+	// jobs of the same time do not all start at once.
+	Jitter time.Duration
+	// Timeout is how long a run lasts at most, DefaultTimeout if zero.
+	Timeout time.Duration
+	// Immediately makes the job due as soon as it is registered the first
+	// time, instead of at the first time of its schedule.
+	Immediately bool
+	Run         Func
+}
+
+// Scheduler runs jobs when they are due in the store.
+type Scheduler struct {
+	store  store.JobStore
+	holder string
+	clock  clock.Clock
+
+	mu     sync.Mutex
+	jobs   []*Job
+	random *rand.Rand
+}
+
+// Option configures a Scheduler.
+type Option func(*Scheduler)
+
+// WithClock runs the scheduler by the clock instead of clock.Real.
+func WithClock(c clock.Clock) Option {
+	return func(s *Scheduler) {
+		s.clock = c
+	}
+}
+
+// NewScheduler creates a Scheduler locking the jobs of the store for the
+// holder, e.g. leader.Holder(id).
+func NewScheduler(jobs store.JobStore, holder string, opts ...Option) *Scheduler {
+	s := &Scheduler{
+		store:  jobs,
+		holder: holder,
+		clock:  clock.Real,
+		random: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Add registers a job. Jobs must be added before Run.
+func (s *Scheduler) Add(job Job) {
+	if job.Timeout <= 0 {
+		job.Timeout = DefaultTimeout
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs = append(s.jobs, &job)
+}
+
+// Len returns the number of jobs.
+func (s *Scheduler) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.jobs)
+}
+
+// Run registers the jobs in the store and runs them when due, checking every
+// PollInterval, until the context is done. It returns after the runs in
+// progress end.
+func (s *Scheduler) Run(ctx context.Context) {
+	s.mu.Lock()
+	jobs := append([]*Job(nil), s.jobs...)
+	s.mu.Unlock()
+
+	for _, job := range jobs {
+		now := s.clock.Now()
+		next := s.next(job, now)
+		if job.Immediately {
+			next = now
+		}
+		if _, err := s.store.RegisterJob(ctx, job.Name, fmt.Sprint(job.Schedule), next); err != nil {
+			log.Printf("Could not register job %q: %v\n", job.Name, err)
+		}
+	}
+
+	// Every job polls on its own, so long runs do not delay the others.
+	var wg sync.WaitGroup
+	for _, job := range jobs {
+		wg.Add(1)
+		go func(job *Job) {
+			defer wg.Done()
+			s.poll(ctx, job, s.clock.Now())
+			clock.Run(ctx, s.clock, clock.Every(PollInterval), func(ctx context.Context, now time.Time) {
+				s.poll(ctx, job, now)
+			})
+		}(job)
+	}
+	wg.Wait()
+}
+
+// poll runs the job if it is due at now and no instance runs it.
+func (s *Scheduler) poll(ctx context.Context, job *Job, now time.Time) {
+	state, err := s.store.ClaimJob(ctx, job.Name, s.holder, now, job.Timeout+lockMargin)
+	if err != nil {
+		log.Printf("Could not claim job %q: %v\n", job.Name, err)
+		return
+	}
+	if state != nil {
+		s.run(ctx, job, state)
+	}
+}
+
+// run runs a claimed job and records the run, scheduling the next one.
+func (s *Scheduler) run(ctx context.Context, job *Job, state *store.Job) {
+	runCtx, cancel := context.WithTimeout(ctx, job.Timeout)
+	start := s.clock.Now()
+	err := job.Run(runCtx, state.NextRunAt)
+	cancel()
+	now := s.clock.Now()
+	jobDuration.Observe(now.Sub(start).Seconds(), job.Name)
+
+	var runErr string
+	next := s.next(job, now)
+	if err != nil {
+		runErr = err.Error()
+		jobRuns.Inc(job.Name, "failure")
+		log.Printf("[JOB] %s failed after %d failures before: %v\n", job.Name, state.Failures, err)
+		if retry := now.Add(retryDelay(state.Failures)); retry.Before(next) {
+			next = retry
+		}
+	} else {
+		jobRuns.Inc(job.Name, "success")
+		log.Printf("[JOB] %s ran in %s.\n", job.Name, now.Sub(start).Round(time.Millisecond))
+	}
+
+	// The run is recorded even if the scheduler is stopping, so it is not
+	// run again.
+	completeCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.store.CompleteJob(completeCtx, job.Name, s.holder, now, next, runErr); err != nil {
+		log.Printf("Could not complete job %q: %v\n", job.Name, err)
+	}
+}
+
+// next returns the next scheduled time of the job after t with its jitter,
+// or a time in the far future if the schedule never runs again.
+func (s *Scheduler) next(job *Job, t time.Time) time.Time {
+	next := job.Schedule.Next(t)
+	if next.IsZero() {
+		return t.AddDate(100, 0, 0)
+	}
+	if job.Jitter > 0 {
+		s.mu.Lock()
+		next = next.Add(time.Duration(s.random.Int63n(int64(job.Jitter))))
+		s.mu.Unlock()
+	}
+	return next
+}
+
+// retryDelay returns how long after the failed run the job is retried, given
+// the failures before it.
+func retryDelay(failures int) time.Duration {
+	delay := RetryDelay
+	for i := 0; i < failures && delay < MaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > MaxRetryDelay {
+		delay = MaxRetryDelay
+	}
+	return delay
+}
@@ -0,0 +1,160 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/clock"
+	"github.com/vedrankolka/donation-server/pkg/store"
+)
+
+// start runs the schedulers until the returned function is called.
+func start(schedulers ...*Scheduler) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for _, s := range schedulers {
+		wg.Add(1)
+		go func(s *Scheduler) {
+			defer wg.Done()
+			s.Run(ctx)
+		}(s)
+	}
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// advance moves the clock in steps of the poll interval, waiting for the n
+// jobs of all schedulers to finish their runs and poll again after every step.
+func advance(fake *clock.Fake, n int, d time.Duration) {
+	for passed := time.Duration(0); passed < d; passed += PollInterval {
+		fake.BlockUntil(n)
+		fake.Advance(PollInterval)
+	}
+	fake.BlockUntil(n)
+}
+
+func TestSchedulerRunsOnce(t *testing.T) {
+	now := time.Date(2024, 1, 31, 6, 59, 0, 0, time.UTC)
+	fake := clock.NewFake(now)
+	jobs := store.NewMemoryStore()
+
+	var mu sync.Mutex
+	var runs []time.Time
+	job := Job{
+		Name:     "digest",
+		Schedule: clock.Daily(7 * time.Hour),
+		Run: func(ctx context.Context, due time.Time) error {
+			mu.Lock()
+			defer mu.Unlock()
+			runs = append(runs, due)
+			return nil
+		},
+	}
+	first := NewScheduler(jobs, "first", WithClock(fake))
+	first.Add(job)
+	second := NewScheduler(jobs, "second", WithClock(fake))
+	second.Add(job)
+	stop := start(first, second)
+
+	advance(fake, 2, 2*time.Minute)
+	stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := time.Date(2024, 1, 31, 7, 0, 0, 0, time.UTC); len(runs) != 1 || !runs[0].Equal(want) {
+		t.Fatalf("the job ran at %v, want once at %v", runs, want)
+	}
+	state, err := jobs.ListJobs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 2, 1, 7, 0, 0, 0, time.UTC); len(state) != 1 || !state[0].NextRunAt.Equal(want) || state[0].LastSuccessAt == nil {
+		t.Errorf("the job is %+v, want it next due at %v", state[0], want)
+	}
+}
+
+func TestSchedulerRetries(t *testing.T) {
+	now := time.Date(2024, 1, 31, 7, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(now)
+	jobs := store.NewMemoryStore()
+
+	var mu sync.Mutex
+	attempts := 0
+	s := NewScheduler(jobs, "first", WithClock(fake))
+	s.Add(Job{
+		Name:        "retention",
+		Schedule:    clock.Every(24 * time.Hour),
+		Immediately: true,
+		Run: func(ctx context.Context, due time.Time) error {
+			mu.Lock()
+			defer mu.Unlock()
+			attempts++
+			if attempts < 3 {
+				return errors.New("archive unavailable")
+			}
+			return nil
+		},
+	})
+	stop := start(s)
+
+	// Retried after a minute, then after two.
+	advance(fake, 1, 8*time.Minute)
+	stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts != 3 {
+		t.Errorf("the job ran %d times, want 3", attempts)
+	}
+	state, err := jobs.ListJobs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state[0].Failures != 0 || state[0].LastError != "" {
+		t.Errorf("the job is %+v, want its failures reset", state[0])
+	}
+}
+
+func TestSchedulerTakesOverExpiredLock(t *testing.T) {
+	now := time.Date(2024, 1, 31, 7, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(now)
+	jobs := store.NewMemoryStore()
+	ctx := context.Background()
+
+	// An instance claimed the job and died.
+	if _, err := jobs.RegisterJob(ctx, "lifecycle", "0 7 * * *", now); err != nil {
+		t.Fatal(err)
+	}
+	if claimed, err := jobs.ClaimJob(ctx, "lifecycle", "dead", now, time.Minute); err != nil || claimed == nil {
+		t.Fatalf("ClaimJob returned %v, %v", claimed, err)
+	}
+
+	ran := make(chan time.Time, 1)
+	s := NewScheduler(jobs, "second", WithClock(fake))
+	s.Add(Job{
+		Name:     "lifecycle",
+		Schedule: clock.Daily(7 * time.Hour),
+		Run: func(ctx context.Context, due time.Time) error {
+			ran <- due
+			return nil
+		},
+	})
+	stop := start(s)
+	defer stop()
+
+	advance(fake, 1, 30*time.Second)
+	select {
+	case <-ran:
+		t.Fatal("the job ran while locked")
+	default:
+	}
+	advance(fake, 1, 45*time.Second)
+	if due := <-ran; !due.Equal(now) {
+		t.Errorf("the job ran for %v, want %v", due, now)
+	}
+}
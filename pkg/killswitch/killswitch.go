@@ -0,0 +1,188 @@
+// Package killswitch pauses donations through the payment provider, or
+// through some of its payment methods, e.g. card payments during an incident
+// of the card network while PayPal keeps working. The frontend learns what is
+// paused from /config and hides it, and the server refuses it meanwhile.
+package killswitch
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/metrics"
+)
+
+// ErrUnknown is returned for a name that is neither the provider nor one of
+// its payment methods.
+var ErrUnknown = errors.New("no such payment provider or payment method")
+
+var paused = metrics.NewGaugeVec(
+	"donation_server_paused_payments",
+	"1 while donations through the payment provider or method are paused, by name.",
+	"name",
+)
+
+// State is the state of the payment provider or of one of its payment methods.
+type State struct {
+	Name   string `json:"name"`
+	Paused bool   `json:"paused"`
+	// Reason is shown to donors, e.g. "Card payments are unavailable until 14:00 UTC".
+	Reason   string     `json:"reason,omitempty"`
+	PausedAt *time.Time `json:"pausedAt,omitempty"`
+	// PausedBy is the admin who paused it, if known.
+	PausedBy string `json:"pausedBy,omitempty"`
+}
+
+// Status is the state of the payment provider and of its payment methods.
+type Status struct {
+	State
+	// Methods are the payment methods offered to donors, if they are
+	// configured. Otherwise the provider offers the methods enabled for the
+	// account and only the provider as a whole can be paused.
+	Methods []State `json:"methods,omitempty"`
+}
+
+// Switch keeps what is paused. Pauses are kept by the instance of the
+// server, a pause of every instance is configured with DONATION_SERVER_PAUSED_PAYMENTS.
+type Switch struct {
+	provider string
+	methods  []string
+
+	mu     sync.RWMutex
+	paused map[string]State
+	// changed is when something was last paused or resumed.
+	changed time.Time
+	now     func() time.Time
+}
+
+// New creates a Switch of the provider, e.g. "stripe", offering the payment
+// methods, e.g. "card" and "paypal", nothing paused.
+func New(provider string, methods []string) *Switch {
+	s := &Switch{
+		provider: provider,
+		methods:  methods,
+		paused:   make(map[string]State),
+		now:      time.Now,
+	}
+	for _, name := range s.names() {
+		paused.Set(0, name)
+	}
+	return s
+}
+
+// names returns the provider and its payment methods.
+func (s *Switch) names() []string {
+	return append([]string{s.provider}, s.methods...)
+}
+
+func (s *Switch) known(name string) bool {
+	for _, n := range s.names() {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Pause pauses donations through the provider or payment method of the name,
+// giving donors the reason. by is the admin pausing it, if known.
+func (s *Switch) Pause(name, reason, by string) error {
+	if !s.known(name) {
+		return ErrUnknown
+	}
+	now := s.now().UTC()
+	s.mu.Lock()
+	s.paused[name] = State{Name: name, Paused: true, Reason: reason, PausedAt: &now, PausedBy: by}
+	s.changed = now
+	s.mu.Unlock()
+	paused.Set(1, name)
+	if by == "" {
+		by = "configuration"
+	}
+	log.Printf("[KILL SWITCH] Donations through %s are paused by %s: %q\n", name, by, reason)
+	return nil
+}
+
+// Resume resumes donations through the provider or payment method of the name.
+func (s *Switch) Resume(name string) error {
+	if !s.known(name) {
+		return ErrUnknown
+	}
+	s.mu.Lock()
+	_, was := s.paused[name]
+	delete(s.paused, name)
+	if was {
+		s.changed = s.now().UTC()
+	}
+	s.mu.Unlock()
+	paused.Set(0, name)
+	if was {
+		log.Printf("[KILL SWITCH] Donations through %s are resumed\n", name)
+	}
+	return nil
+}
+
+// Available returns the payment methods donations may be taken with, nil if
+// none are configured and the provider chooses them. ok is false if the
+// provider or every configured method is paused.
+func (s *Switch) Available() (methods []string, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.available()
+}
+
+func (s *Switch) available() (methods []string, ok bool) {
+	if _, p := s.paused[s.provider]; p {
+		return nil, false
+	}
+	if len(s.methods) == 0 {
+		return nil, true
+	}
+	for _, m := range s.methods {
+		if _, p := s.paused[m]; !p {
+			methods = append(methods, m)
+		}
+	}
+	return methods, len(methods) > 0
+}
+
+// Paused returns the state of the provider if it is paused, or of the first
+// paused method if every method is, to tell donors why they cannot donate.
+// ok is false if donations can be taken.
+func (s *Switch) Paused() (state State, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, available := s.available(); available {
+		return State{}, false
+	}
+	if state, p := s.paused[s.provider]; p {
+		return state, true
+	}
+	return s.paused[s.methods[0]], true
+}
+
+// Changed returns when something was last paused or resumed, zero if never.
+func (s *Switch) Changed() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.changed
+}
+
+// Status returns the state of the provider and its payment methods.
+func (s *Switch) Status() Status {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	status := Status{State: s.state(s.provider)}
+	for _, m := range s.methods {
+		status.Methods = append(status.Methods, s.state(m))
+	}
+	return status
+}
+
+func (s *Switch) state(name string) State {
+	if state, p := s.paused[name]; p {
+		return state
+	}
+	return State{Name: name}
+}
@@ -0,0 +1,58 @@
+package killswitch
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSwitch(t *testing.T) {
+	s := New("stripe", []string{"card", "paypal"})
+	if methods, ok := s.Available(); !ok || !reflect.DeepEqual(methods, []string{"card", "paypal"}) {
+		t.Fatalf("Available() = %v, %v, want every method", methods, ok)
+	}
+
+	if err := s.Pause("card", "Card payments are unavailable", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if methods, ok := s.Available(); !ok || !reflect.DeepEqual(methods, []string{"paypal"}) {
+		t.Errorf("Available() with card paused = %v, %v, want paypal", methods, ok)
+	}
+	if _, paused := s.Paused(); paused {
+		t.Error("donations are paused while paypal is not")
+	}
+	if status := s.Status(); status.Paused || !status.Methods[0].Paused || status.Methods[0].PausedBy != "admin" || status.Methods[1].Paused {
+		t.Errorf("Status() = %+v, want card paused by admin", status)
+	}
+
+	s.Pause("paypal", "", "admin")
+	if state, paused := s.Paused(); !paused || state.Name != "card" {
+		t.Errorf("Paused() with every method paused = %+v, %v, want card's pause", state, paused)
+	}
+	s.Resume("card")
+	s.Resume("paypal")
+	s.Pause("stripe", "Stripe is down", "")
+	if state, paused := s.Paused(); !paused || state.Reason != "Stripe is down" {
+		t.Errorf("Paused() with the provider paused = %+v, %v, want its pause", state, paused)
+	}
+	if s.Changed().IsZero() {
+		t.Error("Changed() is zero after pauses")
+	}
+
+	if err := s.Pause("sepa_debit", "", ""); err != ErrUnknown {
+		t.Errorf("Pause of an unknown method = %v, want ErrUnknown", err)
+	}
+}
+
+func TestSwitchWithoutMethods(t *testing.T) {
+	s := New("stripe", nil)
+	if methods, ok := s.Available(); !ok || methods != nil {
+		t.Errorf("Available() = %v, %v, want the provider's methods", methods, ok)
+	}
+	if err := s.Pause("card", "", ""); err != ErrUnknown {
+		t.Errorf("Pause of a method that is not configured = %v, want ErrUnknown", err)
+	}
+	s.Pause("stripe", "", "")
+	if _, ok := s.Available(); ok {
+		t.Error("donations are available with the provider paused")
+	}
+}
@@ -0,0 +1,191 @@
+// Package kiosk authenticates the donation tablets at venues by their
+// device keys, and the PINs staff refund donations at them with.
+package kiosk
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/requestid"
+	"github.com/vedrankolka/donation-server/pkg/store"
+	"go.uber.org/zap"
+)
+
+const (
+	// KeyHeader holds a kiosk's device key.
+	KeyHeader = "X-Kiosk-Key"
+	// KeyPrefix starts every device key.
+	KeyPrefix = "kk_"
+)
+
+const (
+	// MaxPINAttempts is the number of wrong PINs after which a kiosk's PIN is
+	// locked for LockoutPeriod.
+	MaxPINAttempts = 5
+	// LockoutPeriod is how long a PIN stays locked.
+	LockoutPeriod = 15 * time.Minute
+)
+
+// ErrLocked is returned by Gate.CheckPIN while a kiosk's PIN is locked.
+var ErrLocked = errors.New("too many wrong PINs, try again later")
+
+// ErrWrongPIN is returned by Gate.CheckPIN for a wrong PIN.
+var ErrWrongPIN = errors.New("wrong PIN")
+
+// NewKey returns a new device key.
+func NewKey() (string, error) {
+	var b [24]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return KeyPrefix + base64.RawURLEncoding.EncodeToString(b[:]), nil
+}
+
+// Hash returns the hash of a device key, as it is stored.
+func Hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// ValidatePIN checks that a PIN has 4 to 8 digits.
+func ValidatePIN(pin string) error {
+	if len(pin) < 4 || len(pin) > 8 || strings.Trim(pin, "0123456789") != "" {
+		return errors.New("the PIN must have 4 to 8 digits")
+	}
+	return nil
+}
+
+// HashPIN returns the salted hash of a PIN, as it is stored. PINs are short,
+// the lockout of Gate.CheckPIN is what keeps them from being guessed.
+func HashPIN(pin string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(salt) + "$" + pinMAC(salt, pin), nil
+}
+
+func pinMAC(salt []byte, pin string) string {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(pin))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// matchPIN reports whether the PIN has the hash.
+func matchPIN(hash, pin string) bool {
+	i := strings.IndexByte(hash, '$')
+	if i < 0 {
+		return false
+	}
+	salt, err := hex.DecodeString(hash[:i])
+	if err != nil {
+		return false
+	}
+	return hmac.Equal([]byte(hash[i+1:]), []byte(pinMAC(salt, pin)))
+}
+
+type kioskKey struct{}
+
+// WithKiosk returns a context of a request of the kiosk.
+func WithKiosk(ctx context.Context, k *store.Kiosk) context.Context {
+	return context.WithValue(ctx, kioskKey{}, k)
+}
+
+// FromContext returns the kiosk the request of the context was made by, or
+// nil if it was not made by one.
+func FromContext(ctx context.Context) *store.Kiosk {
+	k, _ := ctx.Value(kioskKey{}).(*store.Kiosk)
+	return k
+}
+
+// failures are the wrong PINs entered at a kiosk.
+type failures struct {
+	count int
+	// until is the end of the lockout, once count reached MaxPINAttempts.
+	until time.Time
+}
+
+// Gate checks device keys and PINs. Wrong PINs are counted in memory, so
+// every instance of the server locks PINs on its own.
+type Gate struct {
+	kiosks   store.KioskStore
+	mu       sync.Mutex
+	failures map[string]*failures
+}
+
+// NewGate creates a Gate of the kiosks in the store.
+func NewGate(kiosks store.KioskStore) *Gate {
+	return &Gate{kiosks: kiosks, failures: make(map[string]*failures)}
+}
+
+// Middleware requires the key of an enabled kiosk (401 Unauthorized) and
+// records when the kiosk was last seen. The handler gets the kiosk from
+// FromContext.
+func (g *Gate) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(KeyHeader)
+		if key == "" {
+			writeError(w, "the kiosk key is required", http.StatusUnauthorized)
+			return
+		}
+		k, err := g.kiosks.GetKioskByKey(r.Context(), Hash(key))
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			requestid.Logger(r.Context(), zap.L()).Error("Could not get kiosk", zap.Error(err))
+			writeError(w, "Could not check the kiosk key", http.StatusInternalServerError)
+			return
+		}
+		if err != nil || k.Disabled {
+			writeError(w, "unknown or disabled kiosk key", http.StatusUnauthorized)
+			return
+		}
+
+		// Seen is kept to the minute, so not every request saves the kiosk.
+		if now := time.Now().UTC(); now.Sub(k.LastSeenAt) >= time.Minute {
+			k.LastSeenAt = now
+			if err := g.kiosks.SaveKiosk(r.Context(), k); err != nil {
+				requestid.Logger(r.Context(), zap.L()).Warn("Could not record that the kiosk was seen", zap.String("kiosk", k.ID), zap.Error(err))
+			}
+		}
+		next(w, r.WithContext(WithKiosk(r.Context(), k)))
+	}
+}
+
+// CheckPIN checks the PIN entered at the kiosk. After MaxPINAttempts wrong
+// PINs in a row, it returns ErrLocked for LockoutPeriod.
+func (g *Gate) CheckPIN(k *store.Kiosk, pin string, now time.Time) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	f, ok := g.failures[k.ID]
+	if !ok {
+		f = &failures{}
+		g.failures[k.ID] = f
+	}
+	if now.Before(f.until) {
+		return ErrLocked
+	}
+	if k.PINHash != "" && matchPIN(k.PINHash, pin) {
+		delete(g.failures, k.ID)
+		return nil
+	}
+	if f.count++; f.count >= MaxPINAttempts {
+		f.count, f.until = 0, now.Add(LockoutPeriod)
+	}
+	return ErrWrongPIN
+}
+
+func writeError(w http.ResponseWriter, message string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, "{\"error\":%q}\n", message)
+}
@@ -0,0 +1,33 @@
+package kiosk
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/store"
+)
+
+func TestCheckPIN(t *testing.T) {
+	hash, err := HashPIN("4711")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := &store.Kiosk{ID: "kio_1", PINHash: hash}
+	g := NewGate(store.NewMemoryStore())
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	if err := g.CheckPIN(k, "4711", now); err != nil {
+		t.Fatalf("the right PIN was refused: %v", err)
+	}
+	for i := 1; i <= MaxPINAttempts; i++ {
+		if err := g.CheckPIN(k, "0000", now); err != ErrWrongPIN {
+			t.Fatalf("wrong PIN %d: got %v, want ErrWrongPIN", i, err)
+		}
+	}
+	if err := g.CheckPIN(k, "4711", now.Add(time.Minute)); err != ErrLocked {
+		t.Fatalf("got %v during the lockout, want ErrLocked", err)
+	}
+	if err := g.CheckPIN(k, "4711", now.Add(LockoutPeriod)); err != nil {
+		t.Fatalf("the right PIN was refused after the lockout: %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+// Package leader elects one instance of the server, e.g. of replicas in two
+// regions, to run the scheduled jobs, so they run exactly once. Requests,
+// including Stripe webhooks, are still handled by every instance.
+package leader
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/metrics"
+	"github.com/vedrankolka/donation-server/pkg/store"
+)
+
+const (
+	// LeaseName is the name of the lease of the leader.
+	LeaseName = "scheduled-jobs"
+	// TTL is how long the leader holds the lease without renewing it. After
+	// a leader dies, another instance takes over within TTL.
+	TTL = 30 * time.Second
+	// RenewInterval is how often the lease is renewed, or tried to be taken.
+	RenewInterval = TTL / 3
+)
+
+var isLeader = metrics.NewGaugeVec(
+	"donation_server_leader",
+	"1 if the instance runs the scheduled jobs, otherwise 0.",
+	"instance",
+)
+
+// Holder returns the name of the instance holding the lease: id, e.g. of
+// DONATION_SERVER_INSTANCE_ID, if set, otherwise its hostname and process ID.
+func Holder(id string) string {
+	if id != "" {
+		return id
+	}
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// Elector runs jobs while its instance holds the lease.
+type Elector struct {
+	leases store.LeaseStore
+	holder string
+
+	mu   sync.Mutex
+	jobs []func(ctx context.Context)
+}
+
+// NewElector creates an Elector taking the lease for the holder.
+func NewElector(leases store.LeaseStore, holder string) *Elector {
+	isLeader.Set(0, holder)
+	return &Elector{leases: leases, holder: holder}
+}
+
+// Go registers a job run while the instance is the leader. Its context is
+// done when the instance stops being the leader. Jobs must be registered
+// before Run.
+func (e *Elector) Go(job func(ctx context.Context)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.jobs = append(e.jobs, job)
+}
+
+// Run takes and renews the lease until the context is done, running the
+// jobs while it holds it. Errors of the store end the leadership, so two
+// instances never run the jobs at once.
+func (e *Elector) Run(ctx context.Context) {
+	ticker := time.NewTicker(RenewInterval)
+	defer ticker.Stop()
+
+	var stop context.CancelFunc
+	defer func() {
+		if stop != nil {
+			stop()
+			releaseCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := e.leases.ReleaseLease(releaseCtx, LeaseName, e.holder); err != nil {
+				log.Printf("Could not release the leader lease: %v\n", err)
+			}
+		}
+	}()
+
+	for {
+		acquired, err := e.leases.AcquireLease(ctx, LeaseName, e.holder, TTL)
+		if err != nil {
+			log.Printf("Could not acquire the leader lease: %v\n", err)
+		}
+		switch {
+		case acquired && stop == nil:
+			log.Printf("[LEADER] %s is the leader and runs the scheduled jobs.\n", e.holder)
+			isLeader.Set(1, e.holder)
+			stop = e.start(ctx)
+		case !acquired && stop != nil:
+			log.Printf("[LEADER] %s is no longer the leader.\n", e.holder)
+			isLeader.Set(0, e.holder)
+			stop()
+			stop = nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// start runs the jobs with a context of the leadership, returning its cancel function.
+func (e *Elector) start(ctx context.Context) context.CancelFunc {
+	ctx, cancel := context.WithCancel(ctx)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, job := range e.jobs {
+		go job(ctx)
+	}
+	return cancel
+}
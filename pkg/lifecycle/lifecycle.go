@@ -0,0 +1,276 @@
+// Package lifecycle sends donors emails at moments of their giving, like the
+// anniversary of their first donation or the day their donations passed a
+// milestone, e.g. "you've given €500 in total".
+package lifecycle
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/clock"
+	"github.com/vedrankolka/donation-server/pkg/currency"
+	"github.com/vedrankolka/donation-server/pkg/jobs"
+	"github.com/vedrankolka/donation-server/pkg/listing"
+	"github.com/vedrankolka/donation-server/pkg/notifier"
+	"github.com/vedrankolka/donation-server/pkg/store"
+)
+
+// Kinds of lifecycle emails.
+const (
+	// KindAnniversary is sent to repeat donors on the anniversary of their first donation.
+	KindAnniversary = "anniversary"
+	// KindMilestone is sent to donors whose total passed a milestone the day before.
+	KindMilestone = "milestone"
+)
+
+// DefaultMilestones are the totals, in the smallest currency unit, donors
+// are congratulated on: 100, 250, 500 and 1000.
+var DefaultMilestones = []int64{10000, 25000, 50000, 100000}
+
+// Data is the data templates are executed with.
+type Data struct {
+	Kind  string
+	Name  string
+	Email string
+	// Years since the first donation, for anniversaries.
+	Years           int
+	FirstDonationAt time.Time
+	Donations       int
+	// Total donated, formatted like "512.50 EUR", in the currency of the
+	// milestone for milestones, otherwise in all currencies.
+	Total string
+	// Milestone passed, formatted like "500.00 EUR", for milestones.
+	Milestone string
+}
+
+// Scheduler sends the lifecycle emails on a schedule, usually every day at a
+// time.
+type Scheduler struct {
+	customers store.CustomerStore
+	notifier  notifier.EmailNotifier
+	templates *Templates
+	// milestones sorted ascending.
+	milestones []int64
+	schedule   clock.Schedule
+}
+
+// NewScheduler creates a Scheduler sending the emails rendered with the
+// templates with the notifier at the times of the schedule, e.g.
+// clock.Daily(10*time.Hour).
+func NewScheduler(customers store.CustomerStore, notifier notifier.EmailNotifier, templates *Templates, milestones []int64, schedule clock.Schedule) *Scheduler {
+	milestones = append([]int64(nil), milestones...)
+	sort.Slice(milestones, func(i, j int) bool { return milestones[i] < milestones[j] })
+	return &Scheduler{
+		customers:  customers,
+		notifier:   notifier,
+		templates:  templates,
+		milestones: milestones,
+		schedule:   schedule,
+	}
+}
+
+// NextRun returns when the emails are sent next after t.
+func (s *Scheduler) NextRun(t time.Time) time.Time {
+	return s.schedule.Next(t)
+}
+
+// Job returns the job sending the emails of the day of its scheduled time,
+// to run with a jobs.Scheduler. Runs that failed to send some emails are
+// retried, sending the same emails of the day again.
+func (s *Scheduler) Job() jobs.Job {
+	return jobs.Job{
+		Name:     "lifecycle",
+		Schedule: s.schedule,
+		Run:      s.Send,
+	}
+}
+
+// Send sends the emails of the UTC day of t: anniversaries of the day and
+// milestones passed the day before. Emails failing to send are logged, the
+// others are still sent.
+func (s *Scheduler) Send(ctx context.Context, t time.Time) error {
+	emails, err := s.Emails(ctx, t)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, email := range emails {
+		if err := s.notifier.NotifyEmail(ctx, email); err != nil {
+			log.Printf("Could not send %s email %s: %v\n", email.Kind, email.ID, err)
+			failed++
+		}
+	}
+	log.Printf("Sent %d lifecycle emails.\n", len(emails)-failed)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d emails failed", failed, len(emails))
+	}
+	return nil
+}
+
+// Emails returns the emails of the UTC day of t, without sending them.
+func (s *Scheduler) Emails(ctx context.Context, t time.Time) ([]notifier.Email, error) {
+	t = t.UTC()
+	today := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	yesterday := today.AddDate(0, 0, -1)
+
+	// Donors summed up from all their donations until today, and until yesterday.
+	customers, err := s.listCustomers(ctx, today)
+	if err != nil {
+		return nil, err
+	}
+	before, err := s.listCustomers(ctx, yesterday)
+	if err != nil {
+		return nil, err
+	}
+	previous := make(map[string]*store.Customer, len(before))
+	for _, c := range before {
+		previous[c.ID] = c
+	}
+
+	var emails []notifier.Email
+	for _, c := range customers {
+		if c.Email == "" {
+			continue
+		}
+		if years := anniversary(c.FirstDonationAt, today); years > 0 && c.Donations > 1 {
+			data := s.data(KindAnniversary, c)
+			data.Total = formatTotals(c.Totals)
+			data.Years = years
+			email, err := s.render(data, c, today)
+			if err != nil {
+				return nil, err
+			}
+			emails = append(emails, email)
+		}
+
+		// Donors get at most one milestone email a day, of the highest milestone.
+		var previousTotals map[string]int64
+		if p, ok := previous[c.ID]; ok {
+			previousTotals = p.Totals
+		}
+		currency, milestone := s.passed(previousTotals, c.Totals)
+		if milestone == 0 {
+			continue
+		}
+		data := s.data(KindMilestone, c)
+		data.Total = formatAmount(c.Totals[currency], currency)
+		data.Milestone = formatAmount(milestone, currency)
+		email, err := s.render(data, c, yesterday)
+		if err != nil {
+			return nil, err
+		}
+		emails = append(emails, email)
+	}
+	return emails, nil
+}
+
+func (s *Scheduler) data(kind string, c *store.Customer) Data {
+	return Data{
+		Kind:            kind,
+		Name:            c.Name,
+		Email:           c.Email,
+		FirstDonationAt: c.FirstDonationAt,
+		Donations:       c.Donations,
+	}
+}
+
+// render renders the email of the data for the day, identified by its kind, donor and day.
+func (s *Scheduler) render(data Data, c *store.Customer, day time.Time) (notifier.Email, error) {
+	subject, body, err := s.templates.Render(data)
+	if err != nil {
+		return notifier.Email{}, err
+	}
+	return notifier.Email{
+		ID:      fmt.Sprintf("%s-%s-%s", data.Kind, c.ID, day.Format("2006-01-02")),
+		Kind:    data.Kind,
+		To:      c.Email,
+		Name:    c.Name,
+		Subject: subject,
+		Body:    body,
+	}, nil
+}
+
+// passed returns the highest milestone a total passed from before to after,
+// and its currency, or a zero milestone.
+func (s *Scheduler) passed(before, after map[string]int64) (string, int64) {
+	var currency string
+	var passed int64
+	for c, total := range after {
+		for _, m := range s.milestones {
+			if before[c] < m && m <= total && m > passed {
+				currency, passed = c, m
+			}
+		}
+	}
+	return currency, passed
+}
+
+// listCustomers returns the donors summed up from their donations before the time.
+func (s *Scheduler) listCustomers(ctx context.Context, before time.Time) ([]*store.Customer, error) {
+	q, err := store.CustomerListSpec.Parse(url.Values{})
+	if err != nil {
+		return nil, err
+	}
+	q.Limit = listing.MaxLimit
+	q.Filter.CreatedLTE = before.Add(-time.Nanosecond)
+
+	var customers []*store.Customer
+	for {
+		page, next, err := s.customers.ListCustomers(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		customers = append(customers, page...)
+		if next == "" {
+			return customers, nil
+		}
+		if q.Cursor, err = listing.DecodeCursor(next); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// anniversary returns the number of years since the first donation if the
+// day is its anniversary, otherwise 0. First donations on February 29 have
+// their anniversaries on March 1 in other years.
+func anniversary(first, day time.Time) int {
+	if first.IsZero() {
+		return 0
+	}
+	first = first.UTC()
+	years := day.Year() - first.Year()
+	if years <= 0 {
+		return 0
+	}
+	date := time.Date(first.Year(), first.Month(), first.Day(), 0, 0, 0, 0, time.UTC).AddDate(years, 0, 0)
+	if !date.Equal(day) {
+		return 0
+	}
+	return years
+}
+
+// formatAmount formats an amount in the smallest currency unit like "12.50 EUR".
+func formatAmount(amount int64, code string) string {
+	return currency.Format(amount, code)
+}
+
+// formatTotals formats amounts like "12.50 EUR, 3.00 USD".
+func formatTotals(totals map[string]int64) string {
+	currencies := make([]string, 0, len(totals))
+	for currency := range totals {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+
+	parts := make([]string, len(currencies))
+	for i, currency := range currencies {
+		parts[i] = formatAmount(totals[currency], currency)
+	}
+	return strings.Join(parts, ", ")
+}
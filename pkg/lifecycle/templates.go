@@ -0,0 +1,107 @@
+package lifecycle
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// templateExt is the extension of template files.
+const templateExt = ".tmpl"
+
+// defaultTemplates are used for kinds without a template file.
+var defaultTemplates = map[string]string{
+	KindAnniversary: `Thank you for {{.Years}} {{if eq .Years 1}}year{{else}}years{{end}} of support
+Dear {{with .Name}}{{.}}{{else}}donor{{end}},
+
+{{.Years}} {{if eq .Years 1}}year{{else}}years{{end}} ago today, on {{date "January 2, 2006" .FirstDonationAt}}, you made your first donation.
+Since then you have donated {{.Donations}} times, {{.Total}} in total.
+
+Thank you for standing with us.
+`,
+	KindMilestone: `You've given {{.Milestone}} in total
+Dear {{with .Name}}{{.}}{{else}}donor{{end}},
+
+With your latest donation you have given {{.Milestone}} in total, {{.Total}} over {{.Donations}} {{if eq .Donations 1}}donation{{else}}donations{{end}}.
+
+Thank you for your generosity.
+`,
+}
+
+var funcs = template.FuncMap{
+	// date formats a time with a Go layout, e.g. {{date "2006-01-02" .FirstDonationAt}}.
+	"date": func(layout string, t time.Time) string {
+		return t.Format(layout)
+	},
+}
+
+// Templates render the subject and body of the emails of every kind. The
+// first line of a template is the subject, the rest the body.
+type Templates struct {
+	templates map[string]*template.Template
+}
+
+// DefaultTemplates returns the built-in templates.
+func DefaultTemplates() *Templates {
+	t, err := parseTemplates(defaultTemplates)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// LoadTemplates parses the templates in the directory, "anniversary.tmpl"
+// and "milestone.tmpl", using the built-in template of a missing one.
+func LoadTemplates(dir string) (*Templates, error) {
+	files := make(map[string]string, len(defaultTemplates))
+	for kind, text := range defaultTemplates {
+		files[kind] = text
+		data, err := os.ReadFile(filepath.Join(dir, kind+templateExt))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		files[kind] = string(data)
+	}
+	return parseTemplates(files)
+}
+
+func parseTemplates(files map[string]string) (*Templates, error) {
+	t := &Templates{templates: make(map[string]*template.Template, len(files))}
+	for kind, text := range files {
+		tmpl, err := template.New(kind).Funcs(funcs).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %s template: %v", kind, err)
+		}
+		t.templates[kind] = tmpl
+	}
+	return t, nil
+}
+
+// Render returns the subject and body of the email of the data.
+func (t *Templates) Render(data Data) (string, string, error) {
+	tmpl, ok := t.templates[data.Kind]
+	if !ok {
+		return "", "", fmt.Errorf("no template of %s emails", data.Kind)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", "", fmt.Errorf("could not render %s email: %v", data.Kind, err)
+	}
+
+	subject, body := buf.String(), ""
+	if i := strings.IndexByte(subject, '\n'); i >= 0 {
+		subject, body = subject[:i], subject[i+1:]
+	}
+	subject = strings.TrimSpace(subject)
+	if subject == "" {
+		return "", "", fmt.Errorf("the %s email has no subject", data.Kind)
+	}
+	return subject, strings.TrimLeft(body, "\n"), nil
+}
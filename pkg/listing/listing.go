@@ -0,0 +1,390 @@
+// Package listing implements the conventions of the list endpoints:
+// cursor-based pagination, filtering and sorting.
+//
+// A list endpoint takes the query parameters
+//
+//	limit        number of items, DefaultLimit by default and at most MaxLimit
+//	cursor       nextCursor of the previous page
+//	sort         field to sort by, descending if prefixed with "-", e.g. "-created"
+//	amount_gte   amount range in the smallest currency unit
+//	amount_lte
+//	created_gte  date range, RFC 3339 times or YYYY-MM-DD dates
+//	created_lte
+//	currency, campaign, status, type, reason, outcome, tag, partner
+//	segment      an expression of package segment, e.g. amount > 10000 AND tag = "gala"
+//
+// of which every endpoint supports its own sort fields and filters, and
+// responds with a Page.
+package listing
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/segment"
+)
+
+const (
+	// DefaultLimit is the page size if the limit is not given.
+	DefaultLimit = 50
+	// MaxLimit is the largest page size a client can ask for.
+	MaxLimit = 200
+)
+
+// Filter names.
+const (
+	FilterAmount   = "amount"
+	FilterCreated  = "created"
+	FilterCurrency = "currency"
+	FilterCampaign = "campaign"
+	FilterStatus   = "status"
+	FilterType     = "type"
+	FilterReason   = "reason"
+	FilterOutcome  = "outcome"
+	FilterTag      = "tag"
+	FilterPartner  = "partner"
+	FilterSegment  = "segment"
+	FilterCustomer = "customer"
+	FilterLink     = "link"
+)
+
+// Sort orders items by a field.
+type Sort struct {
+	Field string
+	Desc  bool
+}
+
+func (s Sort) String() string {
+	if s.Desc {
+		return "-" + s.Field
+	}
+	return s.Field
+}
+
+// ParseSort parses a sort parameter like "-created".
+func ParseSort(s string) Sort {
+	if strings.HasPrefix(s, "-") {
+		return Sort{Field: s[1:], Desc: true}
+	}
+	return Sort{Field: s}
+}
+
+// Filter selects items. Zero fields match everything.
+type Filter struct {
+	AmountGTE  *int64
+	AmountLTE  *int64
+	CreatedGTE time.Time
+	CreatedLTE time.Time
+	Currency   string
+	Campaign   string
+	Status     string
+	Type       string
+	Reason     string
+	Outcome    string
+	Tag        string
+	Partner    string
+	// Customer is the ID of a customer, compared case-sensitively.
+	Customer string
+	// Link is the code of a donation link, compared case-sensitively.
+	Link string
+	// Segment selects donors, nil matches every donor.
+	Segment *segment.Expr
+}
+
+// MatchTag reports whether the tags include the tag of the filter.
+func (f Filter) MatchTag(tags []string) bool {
+	if f.Tag == "" {
+		return true
+	}
+	for _, tag := range tags {
+		if tag == f.Tag {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchAmount reports whether the amount is in the range of the filter.
+func (f Filter) MatchAmount(amount int64) bool {
+	return (f.AmountGTE == nil || amount >= *f.AmountGTE) &&
+		(f.AmountLTE == nil || amount <= *f.AmountLTE)
+}
+
+// MatchCreated reports whether the time is in the range of the filter.
+func (f Filter) MatchCreated(t time.Time) bool {
+	return (f.CreatedGTE.IsZero() || !t.Before(f.CreatedGTE)) &&
+		(f.CreatedLTE.IsZero() || !t.After(f.CreatedLTE))
+}
+
+// Match reports whether the value matches a string filter. Currencies and
+// other codes are compared case-insensitively.
+func Match(filter, value string) bool {
+	return filter == "" || strings.EqualFold(filter, value)
+}
+
+// Query is a parsed request for a page of a list.
+type Query struct {
+	Limit  int
+	Cursor *Cursor
+	Sort   Sort
+	Filter Filter
+}
+
+// Spec describes what a list endpoint supports.
+type Spec struct {
+	// Sorts are the fields the list can be sorted by.
+	Sorts []string
+	// DefaultSort is used if the sort is not given, e.g. "-created".
+	DefaultSort string
+	// Filters are the supported filter names.
+	Filters []string
+	// Params are other query parameters of the endpoint, e.g. a search query.
+	Params []string
+}
+
+// Error is returned for invalid list parameters and should be answered with 400 Bad Request.
+type Error struct {
+	Param   string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Param, e.Message)
+}
+
+// Parse parses the query parameters of a list request. Unsupported sort
+// fields and filters are an error rather than being ignored.
+func (spec Spec) Parse(values url.Values) (Query, error) {
+	q := Query{
+		Limit: DefaultLimit,
+		Sort:  ParseSort(spec.DefaultSort),
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return q, &Error{"limit", "must be a positive number"}
+		}
+		if n > MaxLimit {
+			n = MaxLimit
+		}
+		q.Limit = n
+	}
+
+	if s := values.Get("sort"); s != "" {
+		q.Sort = ParseSort(s)
+		if !contains(spec.Sorts, q.Sort.Field) {
+			return q, &Error{"sort", fmt.Sprintf("must be one of %s, optionally prefixed with -", strings.Join(spec.Sorts, ", "))}
+		}
+	}
+
+	if c := values.Get("cursor"); c != "" {
+		cursor, err := DecodeCursor(c)
+		if err != nil {
+			return q, &Error{"cursor", err.Error()}
+		}
+		if cursor.Sort != q.Sort.String() {
+			return q, &Error{"cursor", "was issued for another sort"}
+		}
+		q.Cursor = cursor
+	}
+
+	params := map[string]bool{"limit": true, "cursor": true, "sort": true}
+	for _, param := range spec.Params {
+		params[param] = true
+	}
+	for _, filter := range spec.Filters {
+		if filter == FilterAmount || filter == FilterCreated {
+			params[filter+"_gte"] = true
+			params[filter+"_lte"] = true
+		} else {
+			params[filter] = true
+		}
+	}
+	for name := range values {
+		if !params[name] {
+			return q, &Error{name, "is not a supported parameter"}
+		}
+	}
+
+	var err error
+	f := &q.Filter
+	if f.AmountGTE, err = parseAmount(values, "amount_gte"); err != nil {
+		return q, err
+	}
+	if f.AmountLTE, err = parseAmount(values, "amount_lte"); err != nil {
+		return q, err
+	}
+	if f.CreatedGTE, err = parseTime(values, "created_gte", false); err != nil {
+		return q, err
+	}
+	if f.CreatedLTE, err = parseTime(values, "created_lte", true); err != nil {
+		return q, err
+	}
+	f.Currency = values.Get(FilterCurrency)
+	f.Campaign = values.Get(FilterCampaign)
+	f.Status = values.Get(FilterStatus)
+	f.Type = values.Get(FilterType)
+	f.Reason = values.Get(FilterReason)
+	f.Outcome = values.Get(FilterOutcome)
+	f.Tag = values.Get(FilterTag)
+	f.Partner = values.Get(FilterPartner)
+	f.Customer = values.Get(FilterCustomer)
+	f.Link = values.Get(FilterLink)
+	if s := values.Get(FilterSegment); s != "" {
+		if f.Segment, err = segment.Parse(s); err != nil {
+			return q, &Error{FilterSegment, err.Error()}
+		}
+	}
+
+	return q, nil
+}
+
+func parseAmount(values url.Values, param string) (*int64, error) {
+	s := values.Get(param)
+	if s == "" {
+		return nil, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return nil, &Error{param, "must be an amount in the smallest currency unit"}
+	}
+	return &n, nil
+}
+
+// parseTime parses an RFC 3339 time or a date. A date is the start of the
+// day, or its end if endOfDay is set, so created_lte=2024-01-31 includes that day.
+func parseTime(values url.Values, param string, endOfDay bool) (time.Time, error) {
+	s := values.Get(param)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.UTC(), nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return time.Time{}, &Error{param, "must be an RFC 3339 time or a YYYY-MM-DD date"}
+	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Nanosecond)
+	}
+	return t, nil
+}
+
+// Cursor points after the last item of a page.
+type Cursor struct {
+	Sort string `json:"s"`
+	Key  string `json:"k"`
+	ID   string `json:"i"`
+}
+
+// Encode returns the cursor as an opaque string.
+func (c Cursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// DecodeCursor parses an encoded cursor.
+func DecodeCursor(s string) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("malformed cursor")
+	}
+	var c Cursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("malformed cursor")
+	}
+	return &c, nil
+}
+
+// Page is the response of a list endpoint.
+type Page struct {
+	Data interface{} `json:"data"`
+	// NextCursor is the cursor of the next page, empty on the last page.
+	NextCursor string `json:"nextCursor,omitempty"`
+	HasMore    bool   `json:"hasMore"`
+}
+
+// Paginate sorts n items by the query's sort and returns the indices of the
+// items on the requested page and the cursor of the next page. key returns
+// the sort key of an item for a field, see IntKey and TimeKey; ties are
+// broken by the item's ID. Stores without a database use it to page through
+// the matching items.
+func Paginate(n int, key func(i int, field string) string, id func(i int) string, q Query) ([]int, string) {
+	field := q.Sort.Field
+	indices := make([]int, n)
+	for i := range indices {
+		indices[i] = i
+	}
+
+	less := func(ki, idi, kj, idj string) bool {
+		if ki != kj {
+			return ki < kj
+		}
+		return idi < idj
+	}
+	before := func(ki, idi, kj, idj string) bool {
+		if q.Sort.Desc {
+			return less(kj, idj, ki, idi)
+		}
+		return less(ki, idi, kj, idj)
+	}
+
+	sort.Slice(indices, func(a, b int) bool {
+		i, j := indices[a], indices[b]
+		return before(key(i, field), id(i), key(j, field), id(j))
+	})
+
+	start := 0
+	if q.Cursor != nil {
+		start = sort.Search(len(indices), func(a int) bool {
+			i := indices[a]
+			return before(q.Cursor.Key, q.Cursor.ID, key(i, field), id(i))
+		})
+	}
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	end := start + limit
+	if end >= len(indices) {
+		return indices[start:], ""
+	}
+
+	page := indices[start:end]
+	last := page[len(page)-1]
+	next := Cursor{Sort: q.Sort.String(), Key: key(last, field), ID: id(last)}
+	return page, next.Encode()
+}
+
+// ScoreKey returns a sort key of a score between 0 and 1.
+func ScoreKey(score float64) string {
+	return fmt.Sprintf("%.6f", score)
+}
+
+// IntKey returns a sort key of a non-negative number.
+func IntKey(n int64) string {
+	return fmt.Sprintf("%020d", n)
+}
+
+// TimeKey returns a sort key of a time.
+func TimeKey(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000000000Z")
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
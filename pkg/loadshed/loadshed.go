@@ -0,0 +1,135 @@
+// Package loadshed refuses requests quickly when the server is saturated,
+// rather than letting them time out, so senders like Stripe retry them later
+// and the server stays stable during extreme spikes.
+package loadshed
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/metrics"
+)
+
+const (
+	// DefaultMaxInFlight is the number of requests handled at once if not configured.
+	DefaultMaxInFlight = 32
+	// QueueTimeout is how long a request waits for one in flight to finish.
+	QueueTimeout = time.Second
+	// RetryAfter is sent to shed requests.
+	RetryAfter = 30 * time.Second
+	// alertInterval is how often shedding is logged.
+	alertInterval = time.Minute
+)
+
+var (
+	inFlight = metrics.NewGaugeVec(
+		"donation_server_in_flight_requests",
+		"Requests being handled, by endpoint.",
+		"endpoint",
+	)
+	queued = metrics.NewGaugeVec(
+		"donation_server_queued_requests",
+		"Requests waiting to be handled, by endpoint.",
+		"endpoint",
+	)
+	shed = metrics.NewCounterVec(
+		"donation_server_shed_requests_total",
+		"Requests refused with 429 Too Many Requests because the endpoint was saturated, by endpoint.",
+		"endpoint",
+	)
+)
+
+// Shedder limits the requests of an endpoint handled at once. As many
+// requests as can be handled may wait up to QueueTimeout for a turn, the
+// rest are refused right away.
+type Shedder struct {
+	endpoint string
+	slots    chan struct{}
+	queue    chan struct{}
+
+	mu        sync.Mutex
+	lastAlert time.Time
+	// shedSince is the number of requests shed since the last alert.
+	shedSince int
+}
+
+// NewShedder creates a Shedder handling maxInFlight requests of the endpoint at once.
+func NewShedder(endpoint string, maxInFlight int) *Shedder {
+	if maxInFlight < 1 {
+		maxInFlight = DefaultMaxInFlight
+	}
+	inFlight.Set(0, endpoint)
+	queued.Set(0, endpoint)
+	return &Shedder{
+		endpoint: endpoint,
+		slots:    make(chan struct{}, maxInFlight),
+		queue:    make(chan struct{}, maxInFlight),
+	}
+}
+
+// Middleware answers requests with 429 Too Many Requests and Retry-After
+// when the endpoint is saturated.
+func (s *Shedder) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.acquire() {
+			s.alert()
+			shed.Inc(s.endpoint)
+			w.Header().Set("Retry-After", strconv.Itoa(int(RetryAfter/time.Second)))
+			http.Error(w, "The server is overloaded, retry later.", http.StatusTooManyRequests)
+			return
+		}
+		inFlight.Add(1, s.endpoint)
+		defer func() {
+			inFlight.Add(-1, s.endpoint)
+			<-s.slots
+		}()
+
+		next(w, r)
+	}
+}
+
+// acquire takes a slot, waiting in the queue if there is room, and reports whether it got one.
+func (s *Shedder) acquire() bool {
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	select {
+	case s.queue <- struct{}{}:
+	default:
+		return false
+	}
+	queued.Add(1, s.endpoint)
+	defer func() {
+		queued.Add(-1, s.endpoint)
+		<-s.queue
+	}()
+
+	timer := time.NewTimer(QueueTimeout)
+	defer timer.Stop()
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// alert logs that requests are shed, at most once per alertInterval.
+func (s *Shedder) alert() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.shedSince++
+	if time.Since(s.lastAlert) < alertInterval {
+		return
+	}
+	log.Printf("[OVERLOAD] %s is saturated with %d requests in flight, shed %d requests since the last alert\n",
+		s.endpoint, cap(s.slots), s.shedSince)
+	s.lastAlert, s.shedSince = time.Now(), 0
+}
@@ -0,0 +1,108 @@
+// Package logging sets up the structured logger of the server: leveled, as
+// JSON lines for log aggregation in production or as text for a console.
+//
+// Lines still logged with the log package, or with requestid.Printf, go
+// through the logger too, at the level of their tag, e.g. "[WARN] ...".
+package logging
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Formats of the output.
+const (
+	// FormatJSON logs a JSON object per line, for log aggregation.
+	FormatJSON = "json"
+	// FormatConsole logs tab-separated text, for reading in a terminal.
+	FormatConsole = "console"
+)
+
+// New returns a logger writing to standard error at the level, like "debug",
+// "info", "warn" or "error", in the format. An empty level is "info" and an
+// empty format is FormatConsole.
+func New(level, format string) (*zap.Logger, error) {
+	var lvl zapcore.Level
+	if level != "" {
+		if err := lvl.UnmarshalText([]byte(level)); err != nil {
+			return nil, fmt.Errorf("invalid log level %q", level)
+		}
+	}
+
+	config := zap.NewProductionEncoderConfig()
+	config.TimeKey = "time"
+	config.MessageKey = "message"
+	config.EncodeTime = zapcore.ISO8601TimeEncoder
+	var encoder zapcore.Encoder
+	switch format {
+	case FormatJSON:
+		encoder = zapcore.NewJSONEncoder(config)
+	case FormatConsole, "":
+		config.EncodeLevel = zapcore.CapitalLevelEncoder
+		encoder = zapcore.NewConsoleEncoder(config)
+	default:
+		return nil, fmt.Errorf("invalid log format %q, must be %s or %s", format, FormatJSON, FormatConsole)
+	}
+	core := zapcore.NewCore(encoder, zapcore.Lock(os.Stderr), lvl)
+	return zap.New(core, zap.ErrorOutput(zapcore.Lock(os.Stderr))), nil
+}
+
+// levels of the tags of lines.
+var levels = map[string]zapcore.Level{
+	"DEBUG":   zapcore.DebugLevel,
+	"INFO":    zapcore.InfoLevel,
+	"WARN":    zapcore.WarnLevel,
+	"WARNING": zapcore.WarnLevel,
+	"ERROR":   zapcore.ErrorLevel,
+}
+
+// Print logs the line at the level of its tag, which is removed, or at the
+// info level if it has none. Other tags, like "[REFUND]", are kept.
+func Print(l *zap.Logger, line string) {
+	line = strings.TrimRight(line, "\n")
+	lvl := zapcore.InfoLevel
+	if strings.HasPrefix(line, "[") {
+		if end := strings.Index(line, "]"); end > 0 {
+			if tagged, ok := levels[line[1:end]]; ok {
+				lvl, line = tagged, strings.TrimLeft(line[end+1:], " ")
+			}
+		}
+	}
+	if ce := l.Check(lvl, line); ce != nil {
+		ce.Write()
+	}
+}
+
+// Printf logs like Print, formatted like fmt.Sprintf.
+func Printf(l *zap.Logger, format string, v ...interface{}) {
+	Print(l, fmt.Sprintf(format, v...))
+}
+
+// writer logs the lines written to it.
+type writer struct {
+	l *zap.Logger
+}
+
+func (w writer) Write(p []byte) (int, error) {
+	Print(w.l, string(p))
+	return len(p), nil
+}
+
+// RedirectStdLog makes the log package log with the logger, and returns the
+// function undoing it.
+func RedirectStdLog(l *zap.Logger) func() {
+	flags, prefix, out := log.Flags(), log.Prefix(), log.Writer()
+	log.SetFlags(0)
+	log.SetPrefix("")
+	log.SetOutput(writer{l})
+	return func() {
+		log.SetFlags(flags)
+		log.SetPrefix(prefix)
+		log.SetOutput(out)
+	}
+}
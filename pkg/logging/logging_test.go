@@ -0,0 +1,68 @@
+package logging
+
+import (
+	"log"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestPrintLevels(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	l := zap.New(core)
+
+	Print(l, "[WARN] Disk is almost full.\n")
+	Printf(l, "[ERROR] Could not save %q", "donation")
+	Print(l, "[DEBUG]Details")
+	Print(l, "[REFUND] Donation was refunded.")
+	Print(l, "Plain line")
+
+	want := []struct {
+		level   zapcore.Level
+		message string
+	}{
+		{zapcore.WarnLevel, "Disk is almost full."},
+		{zapcore.ErrorLevel, `Could not save "donation"`},
+		{zapcore.DebugLevel, "Details"},
+		{zapcore.InfoLevel, "[REFUND] Donation was refunded."},
+		{zapcore.InfoLevel, "Plain line"},
+	}
+	entries := logs.All()
+	if len(entries) != len(want) {
+		t.Fatalf("got %d entries, want %d", len(entries), len(want))
+	}
+	for i, w := range want {
+		if entries[i].Level != w.level || entries[i].Message != w.message {
+			t.Errorf("entry %d = %s %q, want %s %q", i, entries[i].Level, entries[i].Message, w.level, w.message)
+		}
+	}
+}
+
+func TestRedirectStdLog(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	restore := RedirectStdLog(zap.New(core))
+	log.Println("[DEBUG] Filtered out.")
+	log.Printf("[WARN] Kept.")
+	restore()
+
+	entries := logs.All()
+	if len(entries) != 1 || entries[0].Level != zapcore.WarnLevel || entries[0].Message != "Kept." {
+		t.Fatalf("got %+v, want one warning", entries)
+	}
+}
+
+func TestNewRejectsInvalidConfig(t *testing.T) {
+	if _, err := New("verbose", ""); err == nil {
+		t.Error("an invalid level was accepted")
+	}
+	if _, err := New("", "xml"); err == nil {
+		t.Error("an invalid format was accepted")
+	}
+	for _, format := range []string{"", FormatConsole, FormatJSON} {
+		if _, err := New("debug", format); err != nil {
+			t.Errorf("format %q: %v", format, err)
+		}
+	}
+}
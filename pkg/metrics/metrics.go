@@ -0,0 +1,347 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Registry holds a set of metrics and renders them in the Prometheus
+// text exposition format.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+// metric is a counter, a gauge or a histogram.
+type metric interface {
+	write(w io.Writer)
+}
+
+// Default is the registry used by the package level constructors.
+var Default = &Registry{}
+
+// CounterVec is a monotonically increasing counter partitioned by labels.
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewCounterVec creates a counter and registers it with the Default registry.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return Default.NewCounterVec(name, help, labels...)
+}
+
+// NewCounterVec creates a counter and registers it with the registry.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+
+	r.register(c)
+	return c
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	r.metrics = append(r.metrics, m)
+	r.mu.Unlock()
+}
+
+// Inc increments the counter for the given label values by one.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increments the counter for the given label values by v.
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	key := labelKey(c.name, c.labels, labelValues)
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writeValues(w, c.name, c.help, "counter", c.labels, c.values)
+}
+
+// GaugeVec is a value that goes up and down, partitioned by labels.
+type GaugeVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewGaugeVec creates a gauge and registers it with the Default registry.
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return Default.NewGaugeVec(name, help, labels...)
+}
+
+// NewGaugeVec creates a gauge and registers it with the registry.
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+
+	r.register(g)
+	return g
+}
+
+// Set sets the gauge for the given label values to v.
+func (g *GaugeVec) Set(v float64, labelValues ...string) {
+	key := labelKey(g.name, g.labels, labelValues)
+	g.mu.Lock()
+	g.values[key] = v
+	g.mu.Unlock()
+}
+
+// Add adds v, which may be negative, to the gauge for the given label values.
+func (g *GaugeVec) Add(v float64, labelValues ...string) {
+	key := labelKey(g.name, g.labels, labelValues)
+	g.mu.Lock()
+	g.values[key] += v
+	g.mu.Unlock()
+}
+
+func (g *GaugeVec) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	writeValues(w, g.name, g.help, "gauge", g.labels, g.values)
+}
+
+// DefaultBuckets are the upper bounds of histogram buckets of durations in
+// seconds, from 5 milliseconds to 10 seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// HistogramVec counts observations, like durations, in buckets, partitioned
+// by labels.
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec creates a histogram with buckets of the given upper bounds,
+// in increasing order, and registers it with the Default registry.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return Default.NewHistogramVec(name, help, buckets, labels...)
+}
+
+// NewHistogramVec creates a histogram with buckets of the given upper bounds,
+// in increasing order, and registers it with the registry.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		values:  make(map[string]*histogram),
+	}
+
+	r.register(h)
+	return h
+}
+
+// Observe adds v to the histogram for the given label values.
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := labelKey(h.name, h.labels, labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	values, ok := h.values[key]
+	if !ok {
+		values = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = values
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			values.counts[i]++
+		}
+	}
+	values.count++
+	values.sum += v
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", h.name, h.help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", h.name)
+
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	bucketLabels := append(append([]string(nil), h.labels...), "le")
+	for _, k := range keys {
+		values := h.values[k]
+		prefix := k
+		if len(h.labels) > 0 {
+			prefix += "\xff"
+		}
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(bucketLabels, prefix+strconv.FormatFloat(bound, 'g', -1, 64)), values.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(bucketLabels, prefix+"+Inf"), values.count)
+		fmt.Fprintf(w, "%s_sum%s %v\n", h.name, formatLabels(h.labels, k), values.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, k), values.count)
+	}
+}
+
+func labelKey(name string, labels, labelValues []string) string {
+	if len(labelValues) != len(labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", name, len(labels), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+func writeValues(w io.Writer, name, help, kind string, labels []string, values map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %v\n", name, formatLabels(labels, k), values[k])
+	}
+}
+
+// Write renders all registered metrics to w.
+func (r *Registry) Write(w io.Writer) {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// Handler serves the metrics of the Default registry.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	Default.Write(w)
+}
+
+func formatLabels(names []string, key string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	values := strings.Split(key, "\xff")
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=%q", name, values[i])
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var requestDuration = NewHistogramVec(
+	"donation_server_http_request_duration_seconds",
+	"Duration of HTTP requests, by route, method and status code.",
+	DefaultBuckets,
+	"route", "method", "code",
+)
+
+// Middleware records the duration of every request in
+// donation_server_http_request_duration_seconds, by the pattern of the mux
+// the request is routed to, e.g. /admin/donations/, so paths with IDs share a
+// route.
+func Middleware(mux *http.ServeMux) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			sw := &statusWriter{ResponseWriter: w}
+			next(sw, r)
+
+			_, route := mux.Handler(r)
+			if route == "" {
+				route = "unmatched"
+			}
+			code := sw.status
+			if code == 0 {
+				code = http.StatusOK
+			}
+			requestDuration.Observe(time.Since(start).Seconds(), route, method(r.Method), strconv.Itoa(code))
+		}
+	}
+}
+
+// method returns the method of a request, or "other" for unknown methods, so
+// clients cannot add labels.
+func method(m string) string {
+	switch m {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions:
+		return m
+	default:
+		return "other"
+	}
+}
+
+// statusWriter records the status code of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+// Flush sends what was written so far, e.g. of a streamed export.
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
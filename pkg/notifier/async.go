@@ -0,0 +1,418 @@
+package notifier
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/metrics"
+	"github.com/vedrankolka/donation-server/pkg/requestid"
+	"github.com/vedrankolka/donation-server/pkg/tracing"
+)
+
+const (
+	// DefaultAsyncWorkers is the number of notifications an AsyncNotifier
+	// delivers at once.
+	DefaultAsyncWorkers = 4
+	// DefaultAsyncQueueSize is the number of notifications an AsyncNotifier
+	// queues before notifications wait for room.
+	DefaultAsyncQueueSize = 1000
+	// DefaultAsyncTimeout is how long the delivery of a queued notification
+	// may take, including its retries.
+	DefaultAsyncTimeout = 10 * time.Second
+)
+
+var asyncQueued = metrics.NewGaugeVec(
+	"donation_server_async_notifications",
+	"Notifications accepted by the asynchronous dispatcher and not yet delivered or dead-lettered.",
+)
+
+// QueuedEvent is a notification queued by an AsyncNotifier.
+type QueuedEvent struct {
+	ID string `json:"id"`
+	// EventID is the ID of the Stripe event it is about, see WithEventID.
+	EventID   string `json:"eventID,omitempty"`
+	RequestID string `json:"requestID,omitempty"`
+	// Traceparent continues the trace of the notification when it is delivered.
+	Traceparent string `json:"traceparent,omitempty"`
+	// Type is the type of the event, e.g. EventTypeDonation, and Payload the
+	// event as JSON.
+	Type      string          `json:"type"`
+	Payload   json.RawMessage `json:"payload"`
+	ChargedAt time.Time       `json:"chargedAt"`
+	QueuedAt  time.Time       `json:"queuedAt"`
+}
+
+// AsyncNotifier accepts notifications as soon as they are queued and
+// delivers them with a pool of workers, so a slow notifier does not slow the
+// webhook down. Notifications wait for room in the queue while it is full.
+// With a Journal, queued notifications survive a crash and are delivered
+// when the server restarts. Notifications that fail are dead-lettered.
+type AsyncNotifier struct {
+	// pending is first to be aligned for atomic operations, see Len.
+	pending int64
+
+	next       Notifier
+	workers    int
+	timeout    time.Duration
+	journal    Journal
+	deadLetter DeadLetterFunc
+	queues     func(ctx context.Context) bool
+
+	queue chan QueuedEvent
+	stop  chan struct{}
+	// running counts the workers, and inflight the notifications that are
+	// accepted and not yet delivered or dead-lettered.
+	running  sync.WaitGroup
+	inflight sync.WaitGroup
+
+	// mu guards closed, report and draining.
+	mu     sync.Mutex
+	closed bool
+	// report counts the notifications delivered or dead-lettered after
+	// Shutdown started, if draining.
+	report   FlushReport
+	draining bool
+}
+
+// AsyncOption configures an AsyncNotifier.
+type AsyncOption func(*AsyncNotifier)
+
+// AsyncWorkers sets the number of notifications delivered at once.
+func AsyncWorkers(workers int) AsyncOption {
+	return func(a *AsyncNotifier) {
+		if workers > 0 {
+			a.workers = workers
+		}
+	}
+}
+
+// AsyncQueueSize sets the number of notifications queued before
+// notifications wait for room.
+func AsyncQueueSize(size int) AsyncOption {
+	return func(a *AsyncNotifier) {
+		if size > 0 {
+			a.queue = make(chan QueuedEvent, size)
+		}
+	}
+}
+
+// AsyncTimeout sets how long the delivery of a queued notification may take.
+func AsyncTimeout(timeout time.Duration) AsyncOption {
+	return func(a *AsyncNotifier) {
+		a.timeout = timeout
+	}
+}
+
+// AsyncJournal keeps the queued notifications in the journal, and delivers
+// those it has pending.
+func AsyncJournal(journal Journal) AsyncOption {
+	return func(a *AsyncNotifier) {
+		a.journal = journal
+	}
+}
+
+// AsyncDeadLetters saves the notifications that could not be delivered.
+// Without it they are logged.
+func AsyncDeadLetters(deadLetter DeadLetterFunc) AsyncOption {
+	return func(a *AsyncNotifier) {
+		a.deadLetter = deadLetter
+	}
+}
+
+// AsyncIf queues only the notifications for which queues returns true, e.g.
+// by a feature flag. The others are delivered with the next notifier at once.
+func AsyncIf(queues func(ctx context.Context) bool) AsyncOption {
+	return func(a *AsyncNotifier) {
+		a.queues = queues
+	}
+}
+
+// NewAsync creates an AsyncNotifier delivering with next, and starts its
+// workers. The pending notifications of its journal are queued first.
+func NewAsync(next Notifier, opts ...AsyncOption) (*AsyncNotifier, error) {
+	a := &AsyncNotifier{
+		next:    next,
+		workers: DefaultAsyncWorkers,
+		timeout: DefaultAsyncTimeout,
+		queue:   make(chan QueuedEvent, DefaultAsyncQueueSize),
+		stop:    make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+
+	var pending []QueuedEvent
+	if a.journal != nil {
+		var err error
+		if pending, err = a.journal.Pending(); err != nil {
+			return nil, err
+		}
+	}
+	for i := 0; i < a.workers; i++ {
+		a.running.Add(1)
+		go a.work()
+	}
+	if len(pending) > 0 {
+		log.Printf("Delivering %d notifications queued before the restart.\n", len(pending))
+		a.inflight.Add(len(pending))
+		a.count(int64(len(pending)))
+		go func() {
+			for i, event := range pending {
+				select {
+				case a.queue <- event:
+				case <-a.stop:
+					for _, event := range pending[i:] {
+						a.fail(event, ErrClosed)
+					}
+					return
+				}
+			}
+		}()
+	}
+	return a, nil
+}
+
+func (a *AsyncNotifier) Notify(ctx context.Context, event DonationEvent) error {
+	if !a.queued(ctx) {
+		return a.next.Notify(ctx, event)
+	}
+	return a.enqueue(ctx, EventTypeDonation, event)
+}
+
+func (a *AsyncNotifier) NotifyRecurring(ctx context.Context, event RecurringDonationEvent) error {
+	if !a.queued(ctx) {
+		return a.next.NotifyRecurring(ctx, event)
+	}
+	return a.enqueue(ctx, EventTypeRecurringDonation, event)
+}
+
+func (a *AsyncNotifier) NotifyPayment(ctx context.Context, event PaymentEvent) error {
+	if !a.queued(ctx) {
+		return a.next.NotifyPayment(ctx, event)
+	}
+	return a.enqueue(ctx, event.Type, event)
+}
+
+// queued reports whether a notification of the context is queued, see AsyncIf.
+func (a *AsyncNotifier) queued(ctx context.Context) bool {
+	return a.queues == nil || a.queues(ctx)
+}
+
+// enqueue saves the event to the journal and queues it, waiting for room
+// until the context is done.
+func (a *AsyncNotifier) enqueue(ctx context.Context, eventType string, event interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("could not marshal the %s event: %v", eventType, err)
+	}
+	queued := QueuedEvent{
+		ID:          newQueuedID(),
+		EventID:     EventID(ctx),
+		RequestID:   requestid.FromContext(ctx),
+		Traceparent: tracing.Traceparent(ctx),
+		Type:        eventType,
+		Payload:     payload,
+		QueuedAt:    time.Now().UTC(),
+	}
+	if chargedAt, ok := ChargedAt(ctx); ok {
+		queued.ChargedAt = chargedAt
+	}
+
+	// Shutdown waits for the accepted notifications once it marked the
+	// notifier closed, so none are accepted after that.
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return ErrClosed
+	}
+	a.inflight.Add(1)
+	a.mu.Unlock()
+	a.count(1)
+
+	if a.journal != nil {
+		if err := a.journal.Append(queued); err != nil {
+			a.count(-1)
+			a.inflight.Done()
+			return fmt.Errorf("could not journal the %s event: %v", eventType, err)
+		}
+	}
+	select {
+	case a.queue <- queued:
+		return nil
+	case <-ctx.Done():
+		a.done(queued)
+		a.count(-1)
+		a.inflight.Done()
+		return ctx.Err()
+	}
+}
+
+func newQueuedID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// count adds delta to the notifications that are accepted and not yet
+// delivered or dead-lettered.
+func (a *AsyncNotifier) count(delta int64) {
+	asyncQueued.Set(float64(atomic.AddInt64(&a.pending, delta)))
+}
+
+// Len returns the number of notifications that are accepted and not yet
+// delivered or dead-lettered.
+func (a *AsyncNotifier) Len() int {
+	return int(atomic.LoadInt64(&a.pending))
+}
+
+// work delivers queued notifications until the notifier is stopped.
+func (a *AsyncNotifier) work() {
+	defer a.running.Done()
+	for {
+		select {
+		case event := <-a.queue:
+			a.deliver(event)
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+// deliver sends the queued notification with the next notifier, and
+// dead-letters it if that fails.
+func (a *AsyncNotifier) deliver(event QueuedEvent) {
+	ctx := WithEventID(context.Background(), event.EventID)
+	if event.RequestID != "" {
+		ctx = requestid.WithID(ctx, event.RequestID)
+	}
+	ctx = tracing.WithTraceparent(ctx, event.Traceparent)
+	if !event.ChargedAt.IsZero() {
+		ctx = WithChargedAt(ctx, event.ChargedAt)
+	}
+	ctx, cancel := context.WithTimeout(ctx, a.timeout)
+	defer cancel()
+
+	var err error
+	switch event.Type {
+	case EventTypeDonation:
+		var e DonationEvent
+		if err = json.Unmarshal(event.Payload, &e); err == nil {
+			err = a.next.Notify(ctx, e)
+		}
+	case EventTypeRecurringDonation:
+		var e RecurringDonationEvent
+		if err = json.Unmarshal(event.Payload, &e); err == nil {
+			err = a.next.NotifyRecurring(ctx, e)
+		}
+	case EventTypePaymentFailed, EventTypeRefund, EventTypeDispute:
+		var e PaymentEvent
+		if err = json.Unmarshal(event.Payload, &e); err == nil {
+			err = a.next.NotifyPayment(ctx, e)
+		}
+	default:
+		err = fmt.Errorf("cannot deliver events of type %q", event.Type)
+	}
+	if err != nil {
+		a.fail(event, err)
+		return
+	}
+
+	a.done(event)
+	a.mu.Lock()
+	if a.draining {
+		a.report.Flushed++
+	}
+	a.mu.Unlock()
+	a.count(-1)
+	a.inflight.Done()
+}
+
+// fail dead-letters a queued notification that could not be delivered.
+func (a *AsyncNotifier) fail(event QueuedEvent, err error) {
+	if a.deadLetter != nil {
+		a.deadLetter(event.EventID, event.Type, event.Payload, err)
+	} else {
+		log.Printf("Could not deliver the queued %s event %s: %v\n", event.Type, event.Payload, err)
+	}
+	a.done(event)
+	a.mu.Lock()
+	if a.draining {
+		a.report.DeadLettered++
+	}
+	a.mu.Unlock()
+	a.count(-1)
+	a.inflight.Done()
+}
+
+// done removes a queued notification from the journal.
+func (a *AsyncNotifier) done(event QueuedEvent) {
+	if a.journal == nil {
+		return
+	}
+	if err := a.journal.Done(event.ID); err != nil {
+		log.Printf("Could not remove the %s event %s from the journal: %v\n", event.Type, event.ID, err)
+	}
+}
+
+func (a *AsyncNotifier) Close() error {
+	_, err := a.Shutdown(context.Background())
+	return err
+}
+
+// Shutdown stops accepting notifications, delivers the queued ones until the
+// context is done, dead-letters the rest and shuts the next notifier down.
+func (a *AsyncNotifier) Shutdown(ctx context.Context) (FlushReport, error) {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return FlushReport{}, nil
+	}
+	a.closed = true
+	a.draining = true
+	a.mu.Unlock()
+
+	idle := make(chan struct{})
+	go func() {
+		a.inflight.Wait()
+		close(idle)
+	}()
+	select {
+	case <-idle:
+	case <-ctx.Done():
+	}
+	close(a.stop)
+	a.running.Wait()
+drain:
+	for {
+		select {
+		case event := <-a.queue:
+			a.fail(event, ctx.Err())
+		default:
+			break drain
+		}
+	}
+
+	a.mu.Lock()
+	report := a.report
+	a.mu.Unlock()
+	nextReport, err := Shutdown(ctx, a.next)
+	report.Add(nextReport)
+	if a.journal != nil {
+		if closeErr := a.journal.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return report, err
+}
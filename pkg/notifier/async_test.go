@@ -0,0 +1,150 @@
+package notifier_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/notifier"
+	"github.com/vedrankolka/donation-server/pkg/notifier/notifiertest"
+)
+
+// waitIdle waits until the notifier delivered or dead-lettered all the
+// notifications it accepted.
+func waitIdle(t *testing.T, a *notifier.AsyncNotifier) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); a.Len() > 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d notifications are still queued", a.Len())
+		}
+	}
+}
+
+func TestAsyncNotifier(t *testing.T) {
+	notifiertest.TestNotifier(t, func(t *testing.T) (notifier.Notifier, func() [][]byte) {
+		r := &recorder{}
+		a, err := notifier.NewAsync(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a, func() [][]byte {
+			waitIdle(t, a)
+			return r.delivered()
+		}
+	})
+}
+
+func TestAsyncJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.jsonl")
+	journal, err := notifier.OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The notifier fails with the first event, which is dead-lettered, and
+	// is stuck on the second when the server crashes.
+	var mu sync.Mutex
+	var deadLettered []string
+	deadLetter := func(eventID, eventType string, payload []byte, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		deadLettered = append(deadLettered, eventID)
+	}
+	stuck := make(chan struct{})
+	r := &recorder{err: errors.New("broker not available")}
+	blocking := &blockingNotifier{recorder: r, block: stuck}
+	a, err := notifier.NewAsync(blocking, notifier.AsyncWorkers(1), notifier.AsyncJournal(journal), notifier.AsyncDeadLetters(deadLetter))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := notifier.WithEventID(context.Background(), "evt_1")
+	if err := a.Notify(ctx, notifier.DonationEvent{CustomerID: "cus_1", Amount: 10, Currency: "eur"}); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		mu.Lock()
+		n := len(deadLettered)
+		mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the failed notification was not dead-lettered")
+		}
+	}
+	blocking.blockNext()
+	ctx = notifier.WithEventID(context.Background(), "evt_2")
+	if err := a.Notify(ctx, notifier.DonationEvent{CustomerID: "cus_2", Amount: 20, Currency: "eur"}); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	journal.Close()
+
+	journal, err = notifier.OpenJournal(path)
+	if err != nil {
+		t.Fatalf("OpenJournal after a crash: %v", err)
+	}
+	pending, _ := journal.Pending()
+	if len(pending) != 1 || pending[0].EventID != "evt_2" {
+		t.Fatalf("pending = %+v, want the notification of evt_2", pending)
+	}
+	delivered := &recorder{}
+	restarted, err := notifier.NewAsync(delivered, notifier.AsyncJournal(journal))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitIdle(t, restarted)
+	if err := restarted.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if payloads := delivered.delivered(); len(payloads) != 1 {
+		t.Errorf("%d notifications were delivered after the restart, want 1", len(payloads))
+	}
+	close(stuck)
+}
+
+func TestAsyncIf(t *testing.T) {
+	r := &recorder{err: errors.New("broker not available")}
+	a, err := notifier.NewAsync(r, notifier.AsyncDeadLetters(func(string, string, []byte, error) {}),
+		notifier.AsyncIf(func(ctx context.Context) bool { return notifier.EventID(ctx) != "evt_inline" }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	event := notifier.DonationEvent{CustomerID: "cus_1", Amount: 10, Currency: "eur"}
+	// Queued notifications are accepted, inline ones fail with the notifier.
+	if err := a.Notify(notifier.WithEventID(context.Background(), "evt_queued"), event); err != nil {
+		t.Errorf("queued Notify: %v", err)
+	}
+	if err := a.Notify(notifier.WithEventID(context.Background(), "evt_inline"), event); err == nil {
+		t.Error("inline Notify succeeded")
+	}
+	waitIdle(t, a)
+}
+
+// blockingNotifier blocks notifications after blockNext until block is closed.
+type blockingNotifier struct {
+	*recorder
+	block chan struct{}
+
+	mu      sync.Mutex
+	blocked bool
+}
+
+func (b *blockingNotifier) blockNext() {
+	b.mu.Lock()
+	b.blocked = true
+	b.mu.Unlock()
+}
+
+func (b *blockingNotifier) Notify(ctx context.Context, event notifier.DonationEvent) error {
+	b.mu.Lock()
+	blocked := b.blocked
+	b.mu.Unlock()
+	if blocked {
+		<-b.block
+	}
+	return b.recorder.Notify(ctx, event)
+}
@@ -0,0 +1,137 @@
+package email
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Message is an email of plain text, with an optional attachment.
+type Message struct {
+	// ID is the Message-ID, without angle brackets, so receivers can drop
+	// duplicates. Left to the mail server if empty.
+	ID      string
+	From    mail.Address
+	To      []mail.Address
+	Subject string
+	// Body is plain text.
+	Body       string
+	Attachment *Attachment
+}
+
+// Attachment is a file attached to a message.
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// Recipients returns the addresses of the recipients.
+func (m *Message) Recipients() []string {
+	recipients := make([]string, len(m.To))
+	for i, to := range m.To {
+		recipients[i] = to.Address
+	}
+	return recipients
+}
+
+// Bytes renders the message in the Internet Message Format, with the body in
+// quoted-printable, so lines of any length can be sent over SMTP.
+func (m *Message) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	header := func(name, value string) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", name, value)
+	}
+	to := make([]string, len(m.To))
+	for i, addr := range m.To {
+		// Names are left out, as they may be longer than a header line.
+		to[i] = (&mail.Address{Address: addr.Address}).String()
+	}
+
+	header("From", m.From.String())
+	header("To", strings.Join(to, ", "))
+	header("Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	header("Date", time.Now().UTC().Format(time.RFC1123Z))
+	if m.ID != "" {
+		header("Message-ID", "<"+m.ID+">")
+	}
+	header("MIME-Version", "1.0")
+
+	if m.Attachment == nil {
+		header("Content-Type", "text/plain; charset=utf-8")
+		header("Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		if err := writeText(&buf, m.Body); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	mw := multipart.NewWriter(&buf)
+	header("Content-Type", mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": mw.Boundary()}))
+	buf.WriteString("\r\n")
+
+	text, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := writeText(text, m.Body); err != nil {
+		return nil, err
+	}
+
+	a := m.Attachment
+	contentType := a.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	file, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename})},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := writeBase64(file, a.Data); err != nil {
+		return nil, err
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeText(w interface{ Write([]byte) (int, error) }, text string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(text)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// writeBase64 writes data in base64 in lines of 76 characters.
+func writeBase64(w interface{ Write([]byte) (int, error) }, data []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 0 {
+		n := 76
+		if n > len(encoded) {
+			n = len(encoded)
+		}
+		if _, err := fmt.Fprintf(w, "%s\r\n", encoded[:n]); err != nil {
+			return err
+		}
+		encoded = encoded[n:]
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+// Package email notifies by email: donors are thanked for their donations
+// and the administrators of the charity are notified of them, through an
+// SMTP server or SendGrid.
+package email
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/notifier"
+	"github.com/vedrankolka/donation-server/pkg/requestid"
+	"go.uber.org/zap"
+)
+
+// Sender sends messages, e.g. SMTPSender or SendGridSender.
+type Sender interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+// EmailNotifier sends a thank-you email to the donor and a notification to
+// the administrators of every donation, and notifies the administrators of
+// failed payments, refunds and disputes. It also sends the emails of
+// notifier.EmailNotifier and the reports of notifier.ReportNotifier.
+type EmailNotifier struct {
+	from      mail.Address
+	sender    Sender
+	admins    []mail.Address
+	templates *Templates
+	log       *zap.Logger
+
+	// mu guards closed.
+	mu     sync.Mutex
+	closed bool
+}
+
+// Option configures an EmailNotifier.
+type Option func(*EmailNotifier)
+
+// WithAdmins notifies the administrators of every donation. Without them only
+// donors are emailed.
+func WithAdmins(admins ...mail.Address) Option {
+	return func(en *EmailNotifier) {
+		en.admins = admins
+	}
+}
+
+// WithTemplates renders the emails with the templates instead of the default ones.
+func WithTemplates(templates *Templates) Option {
+	return func(en *EmailNotifier) {
+		en.templates = templates
+	}
+}
+
+// WithLogger logs with the logger instead of the global logger of zap.
+func WithLogger(l *zap.Logger) Option {
+	return func(en *EmailNotifier) {
+		en.log = l
+	}
+}
+
+// NewEmailNotifier creates an EmailNotifier sending emails from the address,
+// like "Charity <donations@example.org>", whose name is the Organization of
+// the templates.
+func NewEmailNotifier(from string, sender Sender, opts ...Option) (*EmailNotifier, error) {
+	if from == "" {
+		return nil, fmt.Errorf("the sender address is required")
+	}
+	fromAddress, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender address %q: %v", from, err)
+	}
+	if sender == nil {
+		return nil, fmt.Errorf("a sender is required")
+	}
+
+	en := &EmailNotifier{
+		from:   *fromAddress,
+		sender: sender,
+		log:    zap.L(),
+	}
+	for _, opt := range opts {
+		opt(en)
+	}
+	if en.templates == nil {
+		if en.templates, err = NewTemplates(nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return en, nil
+}
+
+// Notify thanks the donor and notifies the administrators of the donation.
+func (en *EmailNotifier) Notify(ctx context.Context, event notifier.DonationEvent) error {
+	data := DonationData{Organization: en.from.Name, Time: time.Now().UTC(), DonationEvent: event}
+	donor := mail.Address{Name: event.CustomerName, Address: event.CustomerEmail}
+	return en.notify(ctx, notifier.EventTypeDonation, donor, data)
+}
+
+// NotifyRecurring thanks the donor and notifies the administrators of the
+// payment of a recurring donation.
+func (en *EmailNotifier) NotifyRecurring(ctx context.Context, event notifier.RecurringDonationEvent) error {
+	data := RecurringDonationData{Organization: en.from.Name, Time: time.Now().UTC(), RecurringDonationEvent: event}
+	donor := mail.Address{Name: event.CustomerName, Address: event.CustomerEmail}
+	return en.notify(ctx, notifier.EventTypeRecurringDonation, donor, data)
+}
+
+// NotifyPayment notifies the administrators of a failed payment, a refund or
+// a dispute. Donors are not emailed, and without administrators nothing is sent.
+func (en *EmailNotifier) NotifyPayment(ctx context.Context, event notifier.PaymentEvent) error {
+	data := PaymentData{Organization: en.from.Name, Time: time.Now().UTC(), PaymentEvent: event}
+	return en.notify(ctx, event.Type, mail.Address{}, data)
+}
+
+// notify sends the emails of an event, first to the donor, if the donor has
+// an email address. An event that fails is notified again in full, so the
+// donor may get the email twice if only the administrators' failed.
+func (en *EmailNotifier) notify(ctx context.Context, eventType string, donor mail.Address, data interface{}) error {
+	if err := en.ready(ctx); err != nil {
+		return err
+	}
+	if donor.Address != "" {
+		if err := en.render(ctx, Donor, eventType, []mail.Address{donor}, data); err != nil {
+			return err
+		}
+	}
+	if len(en.admins) > 0 {
+		if err := en.render(ctx, Admin, eventType, en.admins, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// render sends the email of the template of the recipient and event type.
+func (en *EmailNotifier) render(ctx context.Context, recipient, eventType string, to []mail.Address, data interface{}) error {
+	subject, body, err := en.templates.Render(recipient, eventType, data)
+	if err != nil {
+		return err
+	}
+	return en.send(ctx, &Message{To: to, Subject: subject, Body: body})
+}
+
+// NotifyEmail sends the email to the donor, with its attachment if any.
+func (en *EmailNotifier) NotifyEmail(ctx context.Context, email notifier.Email) error {
+	msg := &Message{
+		ID:      email.ID + "@" + hostOf(en.from.Address),
+		To:      []mail.Address{{Name: email.Name, Address: email.To}},
+		Subject: email.Subject,
+		Body:    email.Body,
+	}
+	if a := email.Attachment; a != nil {
+		msg.Attachment = &Attachment{Filename: a.Filename, ContentType: a.ContentType, Data: a.Data}
+	}
+	return en.send(ctx, msg)
+}
+
+// NotifyReport sends the report as an attachment to its recipients, or to the
+// administrators if it has none.
+func (en *EmailNotifier) NotifyReport(ctx context.Context, report notifier.Report) error {
+	to := en.admins
+	if len(report.Recipients) > 0 {
+		to = make([]mail.Address, len(report.Recipients))
+		for i, recipient := range report.Recipients {
+			to[i] = mail.Address{Address: recipient}
+		}
+	}
+	if len(to) == 0 {
+		return fmt.Errorf("report %q has no recipients and there are no administrators", report.Name)
+	}
+
+	period := fmt.Sprintf("%s to %s", report.From.Format("2006-01-02"), report.To.Format("2006-01-02"))
+	return en.send(ctx, &Message{
+		ID:      report.ID + "@" + hostOf(en.from.Address),
+		To:      to,
+		Subject: fmt.Sprintf("%s, %s", report.Name, period),
+		Body:    fmt.Sprintf("The report %s of %s is attached.\n", report.Name, period),
+		Attachment: &Attachment{
+			Filename:    report.Filename,
+			ContentType: report.ContentType,
+			Data:        report.Body,
+		},
+	})
+}
+
+func (en *EmailNotifier) send(ctx context.Context, msg *Message) error {
+	if err := en.ready(ctx); err != nil {
+		return err
+	}
+	msg.From = en.from
+	if err := en.sender.Send(ctx, msg); err != nil {
+		return err
+	}
+	// Neither recipients nor subjects are logged, they may hold personal data.
+	requestid.Logger(ctx, en.log).Debug("Email sent", zap.Int("recipients", len(msg.To)))
+	return nil
+}
+
+// ready returns why nothing may be sent, if the notifier is closed or the
+// context is done.
+func (en *EmailNotifier) ready(ctx context.Context) error {
+	en.mu.Lock()
+	closed := en.closed
+	en.mu.Unlock()
+	if closed {
+		return notifier.ErrClosed
+	}
+	return ctx.Err()
+}
+
+// Check checks the sender, if it can be checked. Nothing is sent.
+func (en *EmailNotifier) Check(ctx context.Context) error {
+	if checker, ok := en.sender.(interface{ Check(context.Context) error }); ok {
+		return checker.Check(ctx)
+	}
+	return nil
+}
+
+// Close makes the notifier refuse further events.
+func (en *EmailNotifier) Close() error {
+	en.mu.Lock()
+	en.closed = true
+	en.mu.Unlock()
+	return nil
+}
+
+// hostOf returns the domain of an email address, the right side of Message-IDs.
+func hostOf(address string) string {
+	return address[strings.LastIndex(address, "@")+1:]
+}
@@ -0,0 +1,272 @@
+package email
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/vedrankolka/donation-server/pkg/notifier"
+	"github.com/vedrankolka/donation-server/pkg/notifier/notifiertest"
+)
+
+// testTemplates render the IDs of events as JSON, as the suite expects.
+var testTemplates = map[string]string{
+	"donor.donation.tmpl":           "Subject: Thank you\n\n{{json .CustomerID}} {{.CustomerName}}\n",
+	"donor.recurring_donation.tmpl": "Subject: Thank you\n\n{{json .SubscriptionID}}\n",
+}
+
+func TestEmailNotifier(t *testing.T) {
+	templates, err := NewTemplates(testTemplates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notifiertest.TestNotifier(t, func(t *testing.T) (notifier.Notifier, func() [][]byte) {
+		addr, delivered := newTestServer(t)
+		en, err := NewEmailNotifier("Charity <donations@example.org>", &SMTPSender{Addr: addr}, WithTemplates(templates))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return en, func() [][]byte {
+			var bodies [][]byte
+			for _, msg := range delivered() {
+				bodies = append(bodies, []byte(msg.body))
+			}
+			return bodies
+		}
+	})
+}
+
+func TestEmailNotifierAdmins(t *testing.T) {
+	addr, delivered := newTestServer(t)
+	en, err := NewEmailNotifier("Charity <donations@example.org>", &SMTPSender{Addr: addr},
+		WithAdmins(mail.Address{Address: "board@example.org"}, mail.Address{Address: "treasurer@example.org"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer en.Close()
+
+	event := notifier.DonationEvent{CustomerID: "cus_1", CustomerName: "Ana Horvat", CustomerEmail: "ana@example.com", Amount: 2550, Currency: "eur"}
+	if err := en.Notify(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := delivered()
+	if len(messages) != 2 {
+		t.Fatalf("%d emails were sent, want 2", len(messages))
+	}
+	donor, admin := messages[0], messages[1]
+	if got := strings.Join(donor.to, ","); got != "ana@example.com" {
+		t.Errorf("the thank-you email was sent to %s", got)
+	}
+	if donor.subject != "Thank you for your donation to Charity" || !strings.Contains(donor.body, "25.50 EUR") {
+		t.Errorf("unexpected thank-you email %q: %q", donor.subject, donor.body)
+	}
+	if got := strings.Join(admin.to, ","); got != "board@example.org,treasurer@example.org" {
+		t.Errorf("the notification was sent to %s", got)
+	}
+	if !strings.Contains(admin.body, "cus_1") {
+		t.Errorf("the notification is missing the customer: %q", admin.body)
+	}
+}
+
+func TestEmailNotifierPayment(t *testing.T) {
+	addr, delivered := newTestServer(t)
+	en, err := NewEmailNotifier("Charity <donations@example.org>", &SMTPSender{Addr: addr},
+		WithAdmins(mail.Address{Address: "board@example.org"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer en.Close()
+
+	event := notifier.PaymentEvent{Type: notifier.EventTypeDispute, ChargeID: "ch_1", DisputeID: "dp_1",
+		CustomerEmail: "ana@example.com", Amount: 2550, Currency: "eur", Reason: "fraudulent"}
+	if err := en.NotifyPayment(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := delivered()
+	if len(messages) != 1 {
+		t.Fatalf("%d emails were sent, want only the administrators'", len(messages))
+	}
+	if got := strings.Join(messages[0].to, ","); got != "board@example.org" {
+		t.Errorf("the notification was sent to %s", got)
+	}
+	if messages[0].subject != "Donation ch_1 is disputed" || !strings.Contains(messages[0].body, "25.50 EUR") || !strings.Contains(messages[0].body, "dp_1") {
+		t.Errorf("unexpected notification %q: %q", messages[0].subject, messages[0].body)
+	}
+}
+
+func TestEmailNotifierReport(t *testing.T) {
+	addr, delivered := newTestServer(t)
+	en, err := NewEmailNotifier("donations@example.org", &SMTPSender{Addr: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer en.Close()
+
+	report := notifier.Report{ID: "rep_1", Name: "Monthly donations", Recipients: []string{"board@example.org"},
+		Filename: "donations.csv", ContentType: "text/csv", Body: []byte("id,amount\nch_1,1000\n")}
+	if err := en.NotifyReport(context.Background(), report); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := delivered()
+	if len(messages) != 1 {
+		t.Fatalf("%d emails were sent, want 1", len(messages))
+	}
+	if got := messages[0].attachments["donations.csv"]; got != string(report.Body) {
+		t.Errorf("the attached report is %q, want %q", got, report.Body)
+	}
+}
+
+func TestTemplatesInvalid(t *testing.T) {
+	for name, files := range map[string]map[string]string{
+		"unknown":    {"donor.refund.tmpl": "Subject: x\n\ny"},
+		"no subject": {"admin.donation.tmpl": "{{.CustomerID}}"},
+		"missing":    {"admin.donation.tmpl": "Subject: {{.Missing}}\n\n"},
+	} {
+		if _, err := NewTemplates(files); err == nil {
+			t.Errorf("%s: NewTemplates succeeded, want an error", name)
+		}
+	}
+}
+
+// testMessage is a message received by a test server.
+type testMessage struct {
+	to          []string
+	subject     string
+	body        string
+	attachments map[string]string
+}
+
+// newTestServer starts an SMTP server recording the messages it receives.
+func newTestServer(t *testing.T) (string, func() []testMessage) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	var mu sync.Mutex
+	var messages []testMessage
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serveSMTP(t, conn, func(msg testMessage) {
+					mu.Lock()
+					messages = append(messages, msg)
+					mu.Unlock()
+				})
+			}()
+		}
+	}()
+
+	return listener.Addr().String(), func() []testMessage {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]testMessage(nil), messages...)
+	}
+}
+
+// serveSMTP answers the commands of an SMTP session, without extensions.
+func serveSMTP(t *testing.T, conn net.Conn, receive func(testMessage)) {
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 localhost")
+	var to []string
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch command {
+		case "EHLO", "HELO":
+			text.PrintfLine("250 localhost")
+		case "MAIL":
+			to = nil
+			text.PrintfLine("250 OK")
+		case "RCPT":
+			to = append(to, strings.Trim(strings.TrimPrefix(line[len("RCPT TO:"):], " "), "<>"))
+			text.PrintfLine("250 OK")
+		case "DATA":
+			text.PrintfLine("354 Go ahead")
+			data, err := io.ReadAll(text.DotReader())
+			if err != nil {
+				return
+			}
+			msg, err := parseMessage(data)
+			if err != nil {
+				t.Errorf("could not parse the email: %v", err)
+			}
+			msg.to = to
+			receive(msg)
+			text.PrintfLine("250 OK")
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+		default:
+			text.PrintfLine("502 Not implemented")
+		}
+	}
+}
+
+func parseMessage(data []byte) (testMessage, error) {
+	m, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(string(data))))
+	if err != nil {
+		return testMessage{}, err
+	}
+	msg := testMessage{attachments: make(map[string]string)}
+	if msg.subject, err = new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject")); err != nil {
+		return msg, err
+	}
+
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil {
+		return msg, err
+	}
+	if mediaType != "multipart/mixed" {
+		body, err := io.ReadAll(quotedprintable.NewReader(m.Body))
+		msg.body = string(body)
+		return msg, err
+	}
+
+	parts := multipart.NewReader(m.Body, params["boundary"])
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			return msg, nil
+		}
+		if err != nil {
+			return msg, err
+		}
+		// Quoted-printable parts are decoded by the multipart reader.
+		var r io.Reader = part
+		if part.Header.Get("Content-Transfer-Encoding") == "base64" {
+			r = base64.NewDecoder(base64.StdEncoding, part)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return msg, err
+		}
+		if filename := part.FileName(); filename != "" {
+			msg.attachments[filename] = string(data)
+		} else {
+			msg.body = string(data)
+		}
+	}
+}
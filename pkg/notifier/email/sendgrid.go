@@ -0,0 +1,128 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// SendGridURL is the endpoint of SendGrid's v3 Mail Send API.
+const SendGridURL = "https://api.sendgrid.com/v3/mail/send"
+
+// maxErrorBody is the maximum length of an error response kept in errors.
+const maxErrorBody = 200
+
+// SendGridSender sends messages with SendGrid's v3 Mail Send API.
+type SendGridSender struct {
+	APIKey string
+	// URL is SendGridURL if empty.
+	URL string
+	// Client is http.DefaultClient if nil.
+	Client *http.Client
+}
+
+type sendGridAddress struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+type sendGridContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sendGridAttachment struct {
+	Content     string `json:"content"`
+	Filename    string `json:"filename"`
+	Type        string `json:"type,omitempty"`
+	Disposition string `json:"disposition"`
+}
+
+type sendGridPersonalization struct {
+	To []sendGridAddress `json:"to"`
+}
+
+type sendGridMail struct {
+	Personalizations []sendGridPersonalization `json:"personalizations"`
+	From             sendGridAddress           `json:"from"`
+	Subject          string                    `json:"subject"`
+	Content          []sendGridContent         `json:"content"`
+	Attachments      []sendGridAttachment      `json:"attachments,omitempty"`
+	Headers          map[string]string         `json:"headers,omitempty"`
+}
+
+// Send posts the message to SendGrid.
+func (s *SendGridSender) Send(ctx context.Context, msg *Message) error {
+	mail := sendGridMail{
+		From:    sendGridAddress{Email: msg.From.Address, Name: msg.From.Name},
+		Subject: msg.Subject,
+		Content: []sendGridContent{{Type: "text/plain", Value: msg.Body}},
+	}
+	var personalization sendGridPersonalization
+	for _, to := range msg.To {
+		personalization.To = append(personalization.To, sendGridAddress{Email: to.Address, Name: to.Name})
+	}
+	mail.Personalizations = []sendGridPersonalization{personalization}
+	if msg.ID != "" {
+		mail.Headers = map[string]string{"Message-ID": "<" + msg.ID + ">"}
+	}
+	if a := msg.Attachment; a != nil {
+		mail.Attachments = []sendGridAttachment{{
+			Content:     base64.StdEncoding.EncodeToString(a.Data),
+			Filename:    a.Filename,
+			Type:        a.ContentType,
+			Disposition: "attachment",
+		}}
+	}
+
+	body, err := json.Marshal(mail)
+	if err != nil {
+		return err
+	}
+	return s.do(ctx, http.MethodPost, s.url(), body)
+}
+
+// Check checks that the API key is accepted by listing its scopes. Nothing
+// is sent.
+func (s *SendGridSender) Check(ctx context.Context) error {
+	return s.do(ctx, http.MethodGet, strings.TrimSuffix(s.url(), "/mail/send")+"/scopes", nil)
+}
+
+func (s *SendGridSender) do(ctx context.Context, method, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.APIKey)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return fmt.Errorf("SendGrid responded with %s: %s", resp.Status, bytes.TrimSpace(data))
+	}
+	return nil
+}
+
+func (s *SendGridSender) url() string {
+	if s.URL == "" {
+		return SendGridURL
+	}
+	return s.URL
+}
@@ -0,0 +1,123 @@
+package email
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+)
+
+// SMTPSender sends messages through an SMTP server, upgrading the connection
+// with STARTTLS if the server supports it, or with TLS from the start on port
+// 465.
+type SMTPSender struct {
+	// Addr is the host and port of the server, e.g. smtp.example.org:587.
+	Addr string
+	// Username and Password authenticate with PLAIN auth, if Username is set.
+	Username string
+	Password string
+}
+
+// Send sends the message in a new connection, closed when the context is done.
+func (s *SMTPSender) Send(ctx context.Context, msg *Message) error {
+	data, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+
+	err = s.session(ctx, func(c *smtp.Client) error {
+		if err := c.Mail(msg.From.Address); err != nil {
+			return err
+		}
+		for _, to := range msg.Recipients() {
+			if err := c.Rcpt(to); err != nil {
+				return err
+			}
+		}
+		w, err := c.Data()
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		return w.Close()
+	})
+	if err != nil {
+		return fmt.Errorf("could not send email with %s: %w", s.Addr, err)
+	}
+	return nil
+}
+
+// Check connects and authenticates with the server. Nothing is sent.
+func (s *SMTPSender) Check(ctx context.Context) error {
+	if err := s.session(ctx, func(c *smtp.Client) error { return nil }); err != nil {
+		return fmt.Errorf("could not reach %s: %w", s.Addr, err)
+	}
+	return nil
+}
+
+// session runs send in an authenticated session with the server.
+func (s *SMTPSender) session(ctx context.Context, send func(c *smtp.Client) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	host, port, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return err
+	}
+
+	tlsConfig := &tls.Config{ServerName: host}
+	var conn net.Conn
+	if port == "465" {
+		conn, err = (&tls.Dialer{Config: tlsConfig}).DialContext(ctx, "tcp", s.Addr)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", s.Addr)
+	}
+	if err != nil {
+		return err
+	}
+	// net/smtp has no contexts, the connection is closed to interrupt it.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	err = s.run(conn, host, tlsConfig, send)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+func (s *SMTPSender) run(conn net.Conn, host string, tlsConfig *tls.Config, send func(c *smtp.Client) error) error {
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if _, isTLS := conn.(*tls.Conn); !isTLS {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+		}
+	}
+	if s.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := send(c); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,310 @@
+package email
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/currency"
+	"github.com/vedrankolka/donation-server/pkg/notifier"
+)
+
+// templateExt is the extension of template files.
+const templateExt = ".tmpl"
+
+// Recipients of the emails of an event.
+const (
+	// Donor is the donor, thanked for the donation.
+	Donor = "donor"
+	// Admin are the administrators of the charity, notified of the donation.
+	Admin = "admin"
+)
+
+// DonationData is the data templates of donation events are executed with.
+// The fields of the event are promoted, so a template can use
+// {{.CustomerName}} directly.
+type DonationData struct {
+	// Organization is the name of the charity, the name of the sender.
+	Organization string
+	// Time the email was sent.
+	Time time.Time
+	notifier.DonationEvent
+}
+
+// RecurringDonationData is the data templates of recurring donation events
+// are executed with.
+type RecurringDonationData struct {
+	Organization string
+	Time         time.Time
+	notifier.RecurringDonationEvent
+}
+
+// PaymentData is the data templates of failed payments, refunds and disputes
+// are executed with. Only the administrators are emailed about them.
+type PaymentData struct {
+	Organization string
+	Time         time.Time
+	notifier.PaymentEvent
+}
+
+// paymentEventTypes are the types of PaymentData.
+var paymentEventTypes = []string{notifier.EventTypePaymentFailed, notifier.EventTypeRefund, notifier.EventTypeDispute}
+
+// defaultTemplates are the templates of the emails, by "<recipient>.<type>".
+// A template renders the Subject header, an empty line and the body.
+var defaultTemplates = map[string]string{
+	Donor + "." + notifier.EventTypeDonation: `Subject: Thank you for your donation{{with .Organization}} to {{.}}{{end}}
+
+Dear {{.CustomerName}},
+
+thank you for your donation of {{money .Amount .Currency}}{{with .Organization}} to {{.}}{{end}}.
+{{- with .InvoiceNumber}} The number of your invoice is {{.}}.{{end}}
+
+Kind regards,
+{{with .Organization}}{{.}}{{else}}The team{{end}}
+`,
+	Admin + "." + notifier.EventTypeDonation: `Subject: New donation of {{money .Amount .Currency}}
+
+{{.CustomerName}} <{{.CustomerEmail}}> donated {{money .Amount .Currency}}.
+{{- if .PurchaseAmount}} {{money .PurchaseAmount .Currency}} of it paid for purchases.{{end}}
+
+Customer: {{.CustomerID}}
+{{- with .InvoiceNumber}}
+Invoice: {{.}}{{end}}
+`,
+	Donor + "." + notifier.EventTypeRecurringDonation: `Subject: {{if .First}}Thank you for your {{.Interval}}ly donation{{else}}Your {{.Interval}}ly donation was received{{end}}
+
+Dear {{.CustomerName}},
+
+{{if .First -}}
+thank you for supporting us{{with .Organization}} at {{.}}{{end}} with {{money .Amount .Currency}} every {{.Interval}}.
+{{- else -}}
+we received your {{.Interval}}ly donation of {{money .Amount .Currency}}, covering {{date "2 January 2006" .PeriodStart}} to {{date "2 January 2006" .PeriodEnd}}. Thank you!
+{{- end}}
+
+Kind regards,
+{{with .Organization}}{{.}}{{else}}The team{{end}}
+`,
+	Admin + "." + notifier.EventTypeRecurringDonation: `Subject: {{if .First}}New{{else}}Renewed{{end}} {{.Interval}}ly donation of {{money .Amount .Currency}}
+
+{{.CustomerName}} <{{.CustomerEmail}}> {{if .First}}subscribed to donate{{else}}renewed their donation of{{end}} {{money .Amount .Currency}} every {{.Interval}}.
+
+Customer: {{.CustomerID}}
+Subscription: {{.SubscriptionID}}
+{{- with .Tier}}
+Tier: {{.}}{{end}}
+Period: {{date "2006-01-02" .PeriodStart}} to {{date "2006-01-02" .PeriodEnd}}
+`,
+	Admin + "." + notifier.EventTypePaymentFailed: `Subject: Payment of {{money .Amount .Currency}} failed
+
+A payment of {{money .Amount .Currency}}{{with .CustomerEmail}} by {{.}}{{end}} failed{{with .Reason}}: {{.}}{{end}}.
+
+Payment intent: {{.PaymentIntentID}}
+{{- with .Campaign}}
+Campaign: {{.}}{{end}}
+`,
+	Admin + "." + notifier.EventTypeRefund: `Subject: Donation {{.ChargeID}} was {{if not .Refunded}}partially {{end}}refunded
+
+{{money .Amount .Currency}} of donation {{.ChargeID}}{{with .CustomerEmail}} by {{.}}{{end}} {{if .Refunded}}was refunded in full{{else}}were refunded{{end}}.
+{{- with .Reason}} Reason: {{.}}.{{end}}
+
+Refund: {{.RefundID}}
+{{- with .CustomerID}}
+Customer: {{.}}{{end}}
+`,
+	Admin + "." + notifier.EventTypeDispute: `Subject: Donation {{.ChargeID}} is disputed
+
+The donor disputed {{money .Amount .Currency}} of donation {{.ChargeID}}{{with .CustomerEmail}} by {{.}}{{end}}{{with .Reason}}, for the reason {{.}}{{end}}.
+Respond to the dispute in the Stripe Dashboard before it is due.
+
+Dispute: {{.DisputeID}}
+{{- with .CustomerID}}
+Customer: {{.}}{{end}}
+`,
+}
+
+// funcs are the functions available to templates besides the builtin ones.
+var funcs = template.FuncMap{
+	// money formats an amount in the smallest unit of the currency, e.g.
+	// {{money .Amount .Currency}} gives "12.50 EUR".
+	"money": func(amount float64, code string) string {
+		return currency.Format(int64(math.Round(amount)), code)
+	},
+	// json encodes a value as JSON, e.g. {{json .CustomerID}} gives a quoted string.
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	// date formats a time with a Go layout, e.g. {{date "2006-01-02" .Time}}.
+	"date": func(layout string, t time.Time) string {
+		return t.Format(layout)
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// Templates render the subjects and bodies of the emails of events.
+type Templates struct {
+	templates map[string]*template.Template
+}
+
+// LoadTemplates parses the templates in the directory, which replace the
+// default ones. Every file is named "<recipient>.<type>.tmpl", e.g.
+// "donor.donation.tmpl", and renders "Subject: ...", an empty line and the
+// plain text body.
+func LoadTemplates(dir string) (*Templates, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+templateExt))
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]string, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		files[filepath.Base(path)] = string(data)
+	}
+
+	return NewTemplates(files)
+}
+
+// NewTemplates parses templates given by file name, as in LoadTemplates, and
+// checks them by rendering sample events.
+func NewTemplates(files map[string]string) (*Templates, error) {
+	t := &Templates{templates: make(map[string]*template.Template, len(defaultTemplates))}
+	for name, text := range defaultTemplates {
+		t.templates[name] = template.Must(template.New(name + templateExt).Funcs(funcs).Option("missingkey=error").Parse(text))
+	}
+
+	for file, text := range files {
+		name := strings.TrimSuffix(file, templateExt)
+		if _, ok := defaultTemplates[name]; !ok {
+			return nil, fmt.Errorf("unknown email template %q, templates are <%s|%s>.<%s|%s>%s and %s.<%s>%s", file,
+				Donor, Admin, notifier.EventTypeDonation, notifier.EventTypeRecurringDonation, templateExt,
+				Admin, strings.Join(paymentEventTypes, "|"), templateExt)
+		}
+		tmpl, err := template.New(file).Funcs(funcs).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		t.templates[name] = tmpl
+	}
+
+	if err := t.check(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Render executes the template of the recipient and event type, returning
+// the subject and body of the email.
+func (t *Templates) Render(recipient, eventType string, data interface{}) (string, string, error) {
+	name := recipient + "." + eventType
+	tmpl, ok := t.templates[name]
+	if !ok {
+		return "", "", fmt.Errorf("no email template %q", name)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", "", fmt.Errorf("could not render email %s: %v", name, err)
+	}
+	subject, body, err := parse(buf.String())
+	if err != nil {
+		return "", "", fmt.Errorf("could not render email %s: %v", name, err)
+	}
+	return subject, body, nil
+}
+
+// parse splits a rendered template into its subject and body.
+func parse(rendered string) (string, string, error) {
+	header, body, _ := cut(strings.ReplaceAll(rendered, "\r\n", "\n"), "\n\n")
+	name, subject, ok := cut(header, ":")
+	if !ok || !strings.EqualFold(name, "Subject") || strings.Contains(subject, "\n") {
+		return "", "", fmt.Errorf("the email must start with a Subject header and an empty line")
+	}
+	if subject = strings.TrimSpace(subject); subject == "" {
+		return "", "", fmt.Errorf("the subject is empty")
+	}
+	return subject, body, nil
+}
+
+// cut is strings.Cut of Go 1.18.
+func cut(s, sep string) (string, string, bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// sampleDonation, sampleRecurringDonation and samplePayment fill every field, so check
+// finds templates using missing ones.
+var (
+	sampleDonation = notifier.DonationEvent{
+		CustomerID:     "cus_sample",
+		CustomerName:   "Jane Doe",
+		CustomerEmail:  "jane@example.com",
+		Amount:         1220,
+		Currency:       "eur",
+		DonationAmount: 1000,
+		PurchaseAmount: 220,
+		VATAmount:      20,
+		InvoiceNumber:  "INV-0001",
+		TaxRates:       []notifier.TaxRate{{Rate: 10, Jurisdiction: "HR", Taxable: 200, Amount: 20}},
+	}
+	sampleRecurringDonation = notifier.RecurringDonationEvent{
+		SubscriptionID: "sub_sample",
+		CustomerID:     "cus_sample",
+		CustomerName:   "Jane Doe",
+		CustomerEmail:  "jane@example.com",
+		Amount:         1000,
+		Currency:       "eur",
+		Interval:       "month",
+		Tier:           "friend",
+		First:          true,
+		PeriodStart:    time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		PeriodEnd:      time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+	}
+	samplePayment = notifier.PaymentEvent{
+		PaymentIntentID: "pi_sample",
+		ChargeID:        "ch_sample",
+		CustomerID:      "cus_sample",
+		CustomerEmail:   "jane@example.com",
+		Amount:          1000,
+		Currency:        "eur",
+		Refunded:        true,
+		RefundID:        "re_sample",
+		DisputeID:       "dp_sample",
+		Reason:          "requested_by_customer",
+		Campaign:        "winter",
+	}
+)
+
+// check renders every template with a sample event of its type.
+func (t *Templates) check() error {
+	now := time.Now().UTC()
+	for _, recipient := range []string{Donor, Admin} {
+		if _, _, err := t.Render(recipient, notifier.EventTypeDonation, DonationData{"Sample", now, sampleDonation}); err != nil {
+			return err
+		}
+		if _, _, err := t.Render(recipient, notifier.EventTypeRecurringDonation, RecurringDonationData{"Sample", now, sampleRecurringDonation}); err != nil {
+			return err
+		}
+	}
+	for _, eventType := range paymentEventTypes {
+		event := samplePayment
+		event.Type = eventType
+		if _, _, err := t.Render(Admin, eventType, PaymentData{"Sample", now, event}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package notifier
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Journal keeps the events queued by an AsyncNotifier durably, so the events
+// that were not delivered when the server crashed are delivered after it
+// restarts.
+type Journal interface {
+	// Append saves a queued event before it is accepted.
+	Append(event QueuedEvent) error
+	// Done removes an event that was delivered or dead-lettered.
+	Done(id string) error
+	// Pending returns the events that were queued but not done, oldest first.
+	Pending() ([]QueuedEvent, error)
+	Close() error
+}
+
+// journalEntry is a line of a FileJournal: a queued event, or the ID of an
+// event that is done.
+type journalEntry struct {
+	Event *QueuedEvent `json:"event,omitempty"`
+	Done  string       `json:"done,omitempty"`
+}
+
+// FileJournal is a Journal appending the queued events and the IDs of those
+// that are done to a file as lines of JSON. Events are synced to disk before
+// Append returns; done lines are not, so a crash may deliver an event again.
+// The file is compacted to the pending events when it is opened.
+type FileJournal struct {
+	pending []QueuedEvent
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// OpenJournal opens the FileJournal of the file at the path, creating it if
+// it does not exist.
+func OpenJournal(path string) (*FileJournal, error) {
+	pending, err := readJournal(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// The pending events are written to a new file that replaces the old one.
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(tmp)
+	for i := range pending {
+		line, err := json.Marshal(journalEntry{Event: &pending[i]})
+		if err == nil {
+			_, err = w.Write(append(line, '\n'))
+		}
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return nil, err
+		}
+	}
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileJournal{pending: pending, file: file}, nil
+}
+
+// readJournal returns the pending events of the file, oldest first.
+func readJournal(path string) ([]QueuedEvent, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	queued := make(map[string]QueuedEvent)
+	var torn error
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+	for n := 1; scanner.Scan(); n++ {
+		if torn != nil {
+			return nil, torn
+		}
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// Only the last line can be cut short by a crash, its event
+			// was not accepted or is delivered again.
+			torn = fmt.Errorf("%s:%d: %v", path, n, err)
+			continue
+		}
+		if entry.Event != nil {
+			queued[entry.Event.ID] = *entry.Event
+		} else {
+			delete(queued, entry.Done)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	pending := make([]QueuedEvent, 0, len(queued))
+	for _, event := range queued {
+		pending = append(pending, event)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		if !pending[i].QueuedAt.Equal(pending[j].QueuedAt) {
+			return pending[i].QueuedAt.Before(pending[j].QueuedAt)
+		}
+		return pending[i].ID < pending[j].ID
+	})
+	return pending, nil
+}
+
+func (j *FileJournal) Append(event QueuedEvent) error {
+	if err := j.write(journalEntry{Event: &event}); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+func (j *FileJournal) Done(id string) error {
+	return j.write(journalEntry{Done: id})
+}
+
+func (j *FileJournal) write(entry journalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, err = j.file.Write(append(line, '\n'))
+	return err
+}
+
+// Pending returns the events that were pending when the journal was opened.
+func (j *FileJournal) Pending() ([]QueuedEvent, error) {
+	return j.pending, nil
+}
+
+func (j *FileJournal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
@@ -6,49 +6,338 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"sync"
+	"time"
 
 	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/protocol/metadata"
 	"github.com/segmentio/kafka-go/sasl/scram"
+	"github.com/vedrankolka/donation-server/pkg/cloudevents"
 	"github.com/vedrankolka/donation-server/pkg/notifier"
+	"github.com/vedrankolka/donation-server/pkg/requestid"
+	"github.com/vedrankolka/donation-server/pkg/schema"
+	"github.com/vedrankolka/donation-server/pkg/tracing"
+	"go.uber.org/zap"
 )
 
+// requestIDHeader holds the ID of the request an event is about, see package requestid.
+const requestIDHeader = "request-id"
+
 type KafkaNotifier struct {
-	writer kafka.Writer
+	writer      kafka.Writer
+	cloudEvents *cloudevents.Config
+	// brokers, topic and transport are used by Check.
+	brokers   []string
+	topic     string
+	transport kafka.RoundTripper
+	log       *zap.Logger
+
+	// Events are written in bulk if batchSize is above 1, see WithBatching.
+	batchSize    int
+	batchTimeout time.Duration
+	deadLetter   notifier.DeadLetterFunc
+
+	// mu guards the events in batches that are not written yet.
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]pendingEvent
+	// draining counts the pending events delivered or dead-lettered during Shutdown.
+	draining *notifier.FlushReport
+}
+
+// pendingEvent is an event in a batch, identified by the WriterData of its message.
+type pendingEvent struct {
+	eventID   string
+	eventType string
+	payload   []byte
+}
+
+// Option configures a KafkaNotifier.
+type Option func(*KafkaNotifier)
+
+// WithLogger logs with the logger instead of the global logger of zap.
+func WithLogger(l *zap.Logger) Option {
+	return func(kn *KafkaNotifier) {
+		kn.log = l
+	}
+}
+
+// WithCloudEvents sends events as CloudEvents in the configured content mode.
+// In binary mode the attributes are "ce_" prefixed message headers.
+func WithCloudEvents(config *cloudevents.Config) Option {
+	return func(kn *KafkaNotifier) {
+		kn.cloudEvents = config
+	}
+}
+
+// WithBatching writes events in bulk: up to size events are written at once,
+// after at most timeout. Notifications return once the event is queued,
+// without waiting for Kafka, which raises the throughput at the cost of
+// delivery guarantees: events that fail, or are not written when the
+// notifier is shut down, are dead-lettered with WithDeadLetters, or else
+// logged.
+func WithBatching(size int, timeout time.Duration) Option {
+	return func(kn *KafkaNotifier) {
+		kn.batchSize = size
+		kn.batchTimeout = timeout
+	}
+}
+
+// WithDeadLetters saves the batched events that could not be written.
+func WithDeadLetters(deadLetter notifier.DeadLetterFunc) Option {
+	return func(kn *KafkaNotifier) {
+		kn.deadLetter = deadLetter
+	}
 }
 
 func (kn *KafkaNotifier) Notify(ctx context.Context, event notifier.DonationEvent) error {
+	return kn.write(ctx, notifier.EventTypeDonation, event.CustomerID, event)
+}
+
+func (kn *KafkaNotifier) NotifyRecurring(ctx context.Context, event notifier.RecurringDonationEvent) error {
+	return kn.write(ctx, notifier.EventTypeRecurringDonation, event.CustomerID, event)
+}
+
+// NotifyPayment writes the event keyed by the customer, so it follows the
+// donation event in its partition, or by the charge without a customer.
+func (kn *KafkaNotifier) NotifyPayment(ctx context.Context, event notifier.PaymentEvent) error {
+	key := event.CustomerID
+	if key == "" {
+		key = event.Key()
+	}
+	return kn.write(ctx, event.Type, key, event)
+}
+
+// write sends the event as JSON, keyed by the customer.
+func (kn *KafkaNotifier) write(ctx context.Context, eventType, customerID string, event interface{}) error {
 	data, err := json.Marshal(event)
 	if err != nil {
 		return errors.New(fmt.Sprintf("Could not marshal given event %v: %v", event, err))
 	}
 
-	return kn.writer.WriteMessages(ctx, kafka.Message{
-		Key:   []byte(event.CustomerID),
+	msg := kafka.Message{
+		Key:   []byte(customerID),
 		Value: data,
+	}
+	if id := requestid.FromContext(ctx); id != "" {
+		msg.Headers = append(msg.Headers, kafka.Header{Key: requestIDHeader, Value: []byte(id)})
+	}
+	// Consumers continue the trace of the notification.
+	if traceparent := tracing.Traceparent(ctx); traceparent != "" {
+		msg.Headers = append(msg.Headers, kafka.Header{Key: tracing.Header, Value: []byte(traceparent)})
+	}
+	if kn.cloudEvents != nil {
+		if err := kn.wrap(ctx, &msg, eventType, customerID); err != nil {
+			return err
+		}
+	}
+
+	if kn.pending != nil {
+		return kn.enqueue(ctx, msg, eventType, customerID, data)
+	}
+
+	err = kn.writer.WriteMessages(ctx, msg)
+	if errors.Is(err, io.ErrClosedPipe) {
+		return notifier.ErrClosed
+	}
+	if err == nil {
+		requestid.Logger(ctx, kn.log).Debug("Event written to Kafka",
+			zap.String("topic", kn.topic), zap.String("event_type", eventType), zap.String("key", customerID))
+	}
+	return err
+}
+
+// enqueue adds the message to a batch, keeping the event until it is written.
+func (kn *KafkaNotifier) enqueue(ctx context.Context, msg kafka.Message, eventType, key string, data []byte) error {
+	kn.mu.Lock()
+	kn.nextID++
+	id := kn.nextID
+	kn.pending[id] = pendingEvent{eventID: notifier.EventID(ctx), eventType: eventType, payload: data}
+	kn.mu.Unlock()
+
+	msg.WriterData = id
+	err := kn.writer.WriteMessages(ctx, msg)
+	if err != nil {
+		kn.mu.Lock()
+		delete(kn.pending, id)
+		kn.mu.Unlock()
+		if errors.Is(err, io.ErrClosedPipe) {
+			return notifier.ErrClosed
+		}
+		return err
+	}
+	requestid.Logger(ctx, kn.log).Debug("Event queued for Kafka",
+		zap.String("topic", kn.topic), zap.String("event_type", eventType), zap.String("key", key))
+	return nil
+}
+
+// complete is called by the writer with the messages of a batch once it is
+// written, or failed after its attempts.
+func (kn *KafkaNotifier) complete(messages []kafka.Message, err error) {
+	kn.mu.Lock()
+	var failed []pendingEvent
+	for _, msg := range messages {
+		id, _ := msg.WriterData.(uint64)
+		event, ok := kn.pending[id]
+		if !ok {
+			// Dead-lettered when the shutdown timed out.
+			continue
+		}
+		delete(kn.pending, id)
+		if err != nil {
+			failed = append(failed, event)
+		}
+		if kn.draining != nil {
+			if err != nil {
+				kn.draining.DeadLettered++
+			} else {
+				kn.draining.Flushed++
+			}
+		}
+	}
+	kn.mu.Unlock()
+
+	for _, event := range failed {
+		kn.deadLetterEvent(event, err)
+	}
+}
+
+// deadLetterEvent saves an event that could not be written.
+func (kn *KafkaNotifier) deadLetterEvent(event pendingEvent, err error) {
+	if kn.deadLetter == nil {
+		kn.log.Error("Could not write batched event to Kafka, it is dropped",
+			zap.String("event_id", event.eventID), zap.String("event_type", event.eventType),
+			zap.ByteString("event", event.payload), zap.Error(err))
+		return
+	}
+	kn.log.Warn("Could not write batched event to Kafka, it is dead-lettered",
+		zap.String("event_id", event.eventID), zap.String("event_type", event.eventType), zap.Error(err))
+	kn.deadLetter(event.eventID, event.eventType, event.payload, err)
+}
+
+// wrap turns the message into a CloudEvent.
+func (kn *KafkaNotifier) wrap(ctx context.Context, msg *kafka.Message, eventType, subject string) error {
+	ce, err := kn.cloudEvents.NewEvent(eventType, schema.Version(ctx, eventType), subject, msg.Value, "application/json")
+	if err != nil {
+		return err
+	}
+	ce.RequestID = requestid.FromContext(ctx)
+
+	if kn.cloudEvents.Mode == cloudevents.ModeBinary {
+		msg.Headers = append(msg.Headers, kafka.Header{Key: "content-type", Value: []byte(ce.DataContentType)})
+		for name, value := range ce.Attributes() {
+			msg.Headers = append(msg.Headers, kafka.Header{Key: "ce_" + name, Value: []byte(value)})
+		}
+		return nil
+	}
+
+	if msg.Value, err = ce.Structured(); err != nil {
+		return err
+	}
+	msg.Headers = append(msg.Headers, kafka.Header{Key: "content-type", Value: []byte(cloudevents.ContentType)})
+	return nil
+}
+
+// Check connects to the brokers and checks that the topic exists and, if the
+// brokers report the operations the user is authorized to, that it may write
+// to the topic. Nothing is written.
+func (kn *KafkaNotifier) Check(ctx context.Context) error {
+	resp, err := kn.transport.RoundTrip(ctx, kafka.TCP(kn.brokers...), &metadata.Request{
+		TopicNames:                       []string{kn.topic},
+		IncludeTopicAuthorizedOperations: true,
 	})
+	if err != nil {
+		return fmt.Errorf("could not connect to the brokers: %v", err)
+	}
+
+	for _, topic := range resp.(*metadata.Response).Topics {
+		if topic.Name != kn.topic {
+			continue
+		}
+		if topic.ErrorCode != 0 {
+			return fmt.Errorf("topic %q: %v", kn.topic, kafka.Error(topic.ErrorCode))
+		}
+		// The operations are a bit set, zero or negative if the brokers do not report them.
+		ops := topic.TopicAuthorizedOperations
+		if ops > 0 && ops&(1<<kafka.ACLOperationTypeWrite) == 0 && ops&(1<<kafka.ACLOperationTypeAll) == 0 {
+			return fmt.Errorf("the user is not allowed to write to topic %q", kn.topic)
+		}
+		return nil
+	}
+	return fmt.Errorf("topic %q does not exist", kn.topic)
 }
 
+// Close writes the batched events and closes the writer.
 func (kn *KafkaNotifier) Close() error {
-	return kn.writer.Close()
+	_, err := kn.Shutdown(context.Background())
+	return err
 }
 
-func NewKafkaNotifier(bootstrapServers []string, topic, username, password string) (*KafkaNotifier, error) {
-	log.Println("bootstrapServers: ", bootstrapServers)
-	log.Println("topic: ", topic)
+// Shutdown writes the batched events until the context is done and closes
+// the writer. Events that are not written by then are dead-lettered.
+func (kn *KafkaNotifier) Shutdown(ctx context.Context) (notifier.FlushReport, error) {
+	if kn.pending == nil {
+		return notifier.FlushReport{}, kn.writer.Close()
+	}
+
+	var report notifier.FlushReport
+	kn.mu.Lock()
+	kn.draining = &report
+	kn.mu.Unlock()
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- kn.writer.Close()
+	}()
+	var err error
+	select {
+	case err = <-closed:
+	case <-ctx.Done():
+		err = fmt.Errorf("batched events were not written in time: %v", ctx.Err())
+	}
+
+	kn.mu.Lock()
+	unwritten := kn.pending
+	kn.pending = make(map[uint64]pendingEvent)
+	kn.draining = nil
+	report.DeadLettered += len(unwritten)
+	kn.mu.Unlock()
+	reason := err
+	if reason == nil {
+		reason = errors.New("the event was not written before the writer was closed")
+	}
+	for _, event := range unwritten {
+		kn.deadLetterEvent(event, reason)
+	}
+	return report, err
+}
 
-	var dialer *kafka.Dialer
+// dial returns the dialer and transport of brokers, with SCRAM-SHA-256 over
+// TLS if there are credentials, as on Upstash.
+func dial(username, password string) (*kafka.Dialer, kafka.RoundTripper, error) {
 	if username == "" && password == "" {
-		dialer = kafka.DefaultDialer
-	} else {
-		scramMechanism, err := scram.Mechanism(scram.SHA256, username, password)
-		if err != nil {
-			return nil, err
-		}
-		dialer = &kafka.Dialer{
-			SASLMechanism: scramMechanism,
-			TLS:           &tls.Config{},
-		}
+		return kafka.DefaultDialer, kafka.DefaultTransport, nil
+	}
+	scramMechanism, err := scram.Mechanism(scram.SHA256, username, password)
+	if err != nil {
+		return nil, nil, err
+	}
+	dialer := &kafka.Dialer{
+		SASLMechanism: scramMechanism,
+		TLS:           &tls.Config{},
+	}
+	transport := &kafka.Transport{
+		SASL: scramMechanism,
+		TLS:  &tls.Config{},
+	}
+	return dialer, transport, nil
+}
+
+func NewKafkaNotifier(bootstrapServers []string, topic, username, password string, opts ...Option) (*KafkaNotifier, error) {
+	dialer, transport, err := dial(username, password)
+	if err != nil {
+		return nil, err
 	}
 	config := kafka.WriterConfig{
 		Brokers:   bootstrapServers,
@@ -57,5 +346,25 @@ func NewKafkaNotifier(bootstrapServers []string, topic, username, password strin
 		BatchSize: 1,
 	}
 
-	return &KafkaNotifier{*kafka.NewWriter(config)}, nil
+	kn := &KafkaNotifier{
+		writer:    *kafka.NewWriter(config),
+		brokers:   bootstrapServers,
+		topic:     topic,
+		transport: transport,
+		log:       zap.L(),
+	}
+	for _, opt := range opts {
+		opt(kn)
+	}
+	kn.log.Info("Notifying to Kafka", zap.Strings("brokers", bootstrapServers), zap.String("topic", topic))
+	if kn.batchSize > 1 {
+		kn.writer.BatchSize = kn.batchSize
+		kn.writer.BatchTimeout = kn.batchTimeout
+		kn.writer.Async = true
+		kn.writer.Completion = kn.complete
+		kn.pending = make(map[uint64]pendingEvent)
+		kn.log.Info("Events are written to Kafka in batches", zap.Int("batch_size", kn.batchSize), zap.Duration("batch_timeout", kn.batchTimeout))
+	}
+
+	return kn, nil
 }
@@ -0,0 +1,39 @@
+package kafka
+
+import (
+	"context"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// TopicWriter writes single messages to a topic, e.g. the dead letters of
+// package deadletter to a topic of their own.
+type TopicWriter struct {
+	writer *kafka.Writer
+}
+
+// NewTopicWriter creates a TopicWriter to the topic of the brokers, with the
+// credentials of the notifier.
+func NewTopicWriter(bootstrapServers []string, topic, username, password string) (*TopicWriter, error) {
+	dialer, _, err := dial(username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &TopicWriter{writer: kafka.NewWriter(kafka.WriterConfig{
+		Brokers: bootstrapServers,
+		Topic:   topic,
+		Dialer:  dialer,
+		// Versions of a message with the same key stay in order.
+		Balancer:  &kafka.Hash{},
+		BatchSize: 1,
+	})}, nil
+}
+
+// WriteMessage writes a message with the key and value.
+func (tw *TopicWriter) WriteMessage(ctx context.Context, key string, value []byte) error {
+	return tw.writer.WriteMessages(ctx, kafka.Message{Key: []byte(key), Value: value})
+}
+
+func (tw *TopicWriter) Close() error {
+	return tw.writer.Close()
+}
@@ -0,0 +1,201 @@
+package notifier
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// Sink is a notifier of a Multi, named in its errors.
+type Sink struct {
+	Name string
+	Notifier
+}
+
+// SinkError is the failure of a sink of a Multi.
+type SinkError struct {
+	Name string
+	Err  error
+}
+
+func (e *SinkError) Error() string {
+	return e.Name + ": " + e.Err.Error()
+}
+
+func (e *SinkError) Unwrap() error {
+	return e.Err
+}
+
+// MultiError is the failures of the sinks of a Multi. errors.Is and errors.As
+// match any of them, so a notification that timed out in one sink is a
+// timeout.
+type MultiError []*SinkError
+
+func (e MultiError) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e MultiError) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e MultiError) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Multi sends every notification to several notifiers, e.g. Kafka and email.
+// A notification fails if any of the sinks failed, with a MultiError, so it is
+// retried or dead-lettered and sinks that had delivered it get it again.
+type Multi struct {
+	sinks    []Sink
+	failFast bool
+
+	// mu guards closed.
+	mu     sync.Mutex
+	closed bool
+}
+
+// MultiOption configures a Multi.
+type MultiOption func(*Multi)
+
+// FailFast notifies the sinks in order, stopping at the first that fails, so
+// the sinks after it do not get a notification that will be retried. By
+// default every sink is notified at once, even if others fail.
+func FailFast() MultiOption {
+	return func(m *Multi) {
+		m.failFast = true
+	}
+}
+
+// NewMulti creates a Multi of the sinks, which it closes when it is closed.
+func NewMulti(sinks []Sink, opts ...MultiOption) *Multi {
+	m := &Multi{sinks: sinks}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+func (m *Multi) Notify(ctx context.Context, event DonationEvent) error {
+	return m.notify(ctx, func(n Notifier) error {
+		return n.Notify(ctx, event)
+	})
+}
+
+func (m *Multi) NotifyRecurring(ctx context.Context, event RecurringDonationEvent) error {
+	return m.notify(ctx, func(n Notifier) error {
+		return n.NotifyRecurring(ctx, event)
+	})
+}
+
+func (m *Multi) NotifyPayment(ctx context.Context, event PaymentEvent) error {
+	return m.notify(ctx, func(n Notifier) error {
+		return n.NotifyPayment(ctx, event)
+	})
+}
+
+// notify sends a notification to the sinks, in order if failing fast, or else
+// at once.
+func (m *Multi) notify(ctx context.Context, notify func(n Notifier) error) error {
+	m.mu.Lock()
+	closed := m.closed
+	m.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if m.failFast {
+		for _, sink := range m.sinks {
+			if err := notify(sink.Notifier); err != nil {
+				return MultiError{{Name: sink.Name, Err: err}}
+			}
+		}
+		return nil
+	}
+
+	errs := make([]error, len(m.sinks))
+	var wg sync.WaitGroup
+	for i, sink := range m.sinks {
+		wg.Add(1)
+		go func(i int, n Notifier) {
+			defer wg.Done()
+			errs[i] = notify(n)
+		}(i, sink.Notifier)
+	}
+	wg.Wait()
+	return m.collect(errs)
+}
+
+// Check checks the sinks that can be checked.
+func (m *Multi) Check(ctx context.Context) error {
+	errs := make([]error, len(m.sinks))
+	for i, sink := range m.sinks {
+		if checker, ok := sink.Notifier.(interface{ Check(context.Context) error }); ok {
+			errs[i] = checker.Check(ctx)
+		}
+	}
+	return m.collect(errs)
+}
+
+// Close closes every sink.
+func (m *Multi) Close() error {
+	m.mu.Lock()
+	m.closed = true
+	m.mu.Unlock()
+
+	errs := make([]error, len(m.sinks))
+	for i, sink := range m.sinks {
+		errs[i] = sink.Close()
+	}
+	return m.collect(errs)
+}
+
+// Shutdown shuts every sink down, flushing their queued events until the
+// context is done.
+func (m *Multi) Shutdown(ctx context.Context) (FlushReport, error) {
+	m.mu.Lock()
+	m.closed = true
+	m.mu.Unlock()
+
+	var report FlushReport
+	errs := make([]error, len(m.sinks))
+	for i, sink := range m.sinks {
+		var sinkReport FlushReport
+		sinkReport, errs[i] = Shutdown(ctx, sink.Notifier)
+		report.Add(sinkReport)
+	}
+	return report, m.collect(errs)
+}
+
+// collect returns the errors of the sinks, by index, as a MultiError, or nil
+// if there are none.
+func (m *Multi) collect(errs []error) error {
+	var multiErr MultiError
+	for i, err := range errs {
+		if err != nil {
+			multiErr = append(multiErr, &SinkError{Name: m.sinks[i].Name, Err: err})
+		}
+	}
+	if multiErr == nil {
+		return nil
+	}
+	return multiErr
+}
@@ -0,0 +1,145 @@
+package notifier_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/vedrankolka/donation-server/pkg/notifier"
+	"github.com/vedrankolka/donation-server/pkg/notifier/notifiertest"
+)
+
+// recorder records the events it is notified of as JSON, failing with err if
+// it is set.
+type recorder struct {
+	err error
+
+	mu       sync.Mutex
+	closed   bool
+	payloads [][]byte
+}
+
+func (r *recorder) Notify(ctx context.Context, event notifier.DonationEvent) error {
+	return r.record(ctx, event)
+}
+
+func (r *recorder) NotifyRecurring(ctx context.Context, event notifier.RecurringDonationEvent) error {
+	return r.record(ctx, event)
+}
+
+func (r *recorder) NotifyPayment(ctx context.Context, event notifier.PaymentEvent) error {
+	return r.record(ctx, event)
+}
+
+func (r *recorder) record(ctx context.Context, event interface{}) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return notifier.ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if r.err != nil {
+		return r.err
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	r.payloads = append(r.payloads, payload)
+	return nil
+}
+
+func (r *recorder) delivered() [][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([][]byte(nil), r.payloads...)
+}
+
+func (r *recorder) Close() error {
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+	return nil
+}
+
+func TestMulti(t *testing.T) {
+	for name, opts := range map[string][]notifier.MultiOption{"best effort": nil, "fail fast": {notifier.FailFast()}} {
+		t.Run(name, func(t *testing.T) {
+			notifiertest.TestNotifier(t, func(t *testing.T) (notifier.Notifier, func() [][]byte) {
+				first, second := &recorder{}, &recorder{}
+				m := notifier.NewMulti([]notifier.Sink{{Name: "first", Notifier: first}, {Name: "second", Notifier: second}}, opts...)
+				return m, func() [][]byte {
+					if got, want := len(second.delivered()), len(first.delivered()); got != want {
+						t.Errorf("the second sink got %d events, the first %d", got, want)
+					}
+					return first.delivered()
+				}
+			})
+		})
+	}
+}
+
+func TestMultiFailure(t *testing.T) {
+	failure := errors.New("broker unavailable")
+	event := notifier.DonationEvent{CustomerID: "cus_1"}
+
+	t.Run("best effort", func(t *testing.T) {
+		failing, last := &recorder{err: failure}, &recorder{}
+		m := notifier.NewMulti([]notifier.Sink{{Name: "kafka", Notifier: failing}, {Name: "email", Notifier: last}})
+		err := m.Notify(context.Background(), event)
+		if !errors.Is(err, failure) {
+			t.Fatalf("Notify returned %v, want the failure of the sink", err)
+		}
+		var multiErr notifier.MultiError
+		if !errors.As(err, &multiErr) || len(multiErr) != 1 || multiErr[0].Name != "kafka" {
+			t.Errorf("Notify returned %#v, want the failure of the kafka sink", err)
+		}
+		if len(last.delivered()) != 1 {
+			t.Errorf("the sink after the failing one was not notified")
+		}
+	})
+
+	t.Run("fail fast", func(t *testing.T) {
+		failing, last := &recorder{err: failure}, &recorder{}
+		m := notifier.NewMulti([]notifier.Sink{{Name: "kafka", Notifier: failing}, {Name: "email", Notifier: last}}, notifier.FailFast())
+		if err := m.Notify(context.Background(), event); !errors.Is(err, failure) {
+			t.Fatalf("Notify returned %v, want the failure of the sink", err)
+		}
+		if len(last.delivered()) != 0 {
+			t.Errorf("the sink after the failing one was notified")
+		}
+	})
+}
+
+// queue is a recorder with queued events, flushed or dead-lettered by Shutdown.
+type queue struct {
+	recorder
+	report notifier.FlushReport
+}
+
+func (q *queue) Shutdown(ctx context.Context) (notifier.FlushReport, error) {
+	return q.report, q.Close()
+}
+
+func TestMultiShutdown(t *testing.T) {
+	batched, plain := &queue{report: notifier.FlushReport{Flushed: 3, DeadLettered: 1}}, &recorder{}
+	m := notifier.NewMulti([]notifier.Sink{{Name: "kafka", Notifier: batched}, {Name: "email", Notifier: plain}})
+
+	report, err := notifier.Shutdown(context.Background(), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report != batched.report {
+		t.Errorf("Shutdown reported %+v, want the report of the batching sink %+v", report, batched.report)
+	}
+	if !batched.closed || !plain.closed {
+		t.Error("Shutdown did not close every sink")
+	}
+	if err := m.Notify(context.Background(), notifier.DonationEvent{}); err != notifier.ErrClosed {
+		t.Errorf("Notify after Shutdown returned %v, want ErrClosed", err)
+	}
+}
@@ -2,17 +2,202 @@ package notifier
 
 import (
 	"context"
+	"errors"
+	"time"
 )
 
+// ErrClosed is returned by notifiers that are notified after they were closed.
+var ErrClosed = errors.New("the notifier is closed")
+
+// EventTypeDonation is the type of events about donations.
+const EventTypeDonation = "donation"
+
 type DonationEvent struct {
 	CustomerID    string  `json:"customerID"`
 	CustomerName  string  `json:"customerName"`
 	CustomerEmail string  `json:"customerEmail"`
 	Amount        float64 `json:"amount"`
 	Currency      string  `json:"currency"`
+	// If the payment included purchases or tax, Amount is split into the
+	// donated and the purchased part. VATAmount is the tax included in both.
+	DonationAmount float64 `json:"donationAmount,omitempty"`
+	PurchaseAmount float64 `json:"purchaseAmount,omitempty"`
+	VATAmount      float64 `json:"vatAmount,omitempty"`
+	InvoiceNumber  string  `json:"invoiceNumber,omitempty"`
+	// TaxRates breaks VATAmount down by rate and jurisdiction.
+	TaxRates []TaxRate `json:"taxRates,omitempty"`
+	// The donor's message and choices, if any. Anonymous donors' names must
+	// not be shown publicly, see PublicName.
+	Message         string `json:"message,omitempty"`
+	DisplayName     string `json:"displayName,omitempty"`
+	Anonymous       bool   `json:"anonymous,omitempty"`
+	NewsletterOptIn bool   `json:"newsletterOptIn,omitempty"`
+}
+
+// PublicName returns the name of the donor that may be shown publicly: the
+// display name the donor chose or its name, and "" if it is anonymous.
+func (e DonationEvent) PublicName() string {
+	if e.Anonymous {
+		return ""
+	}
+	if e.DisplayName != "" {
+		return e.DisplayName
+	}
+	return e.CustomerName
+}
+
+// TaxRate is the tax collected at one rate.
+type TaxRate struct {
+	Rate         float64 `json:"rate"`
+	Jurisdiction string  `json:"jurisdiction,omitempty"`
+	Taxable      float64 `json:"taxable"`
+	Amount       float64 `json:"amount"`
+}
+
+// EventTypeRecurringDonation is the type of events about payments of recurring donations.
+const EventTypeRecurringDonation = "recurring_donation"
+
+// RecurringDonationEvent is a payment of a recurring donation, the first one
+// or a renewal.
+type RecurringDonationEvent struct {
+	// SubscriptionID is the ID of the Stripe subscription.
+	SubscriptionID string  `json:"subscriptionID"`
+	CustomerID     string  `json:"customerID"`
+	CustomerName   string  `json:"customerName"`
+	CustomerEmail  string  `json:"customerEmail"`
+	Amount         float64 `json:"amount"`
+	Currency       string  `json:"currency"`
+	// Interval of the payments, "month" or "year".
+	Interval string `json:"interval"`
+	// Tier is the ID of the tier the donor chose, if it is configured.
+	Tier string `json:"tier,omitempty"`
+	// First is set for the first payment, when the donor subscribed.
+	First bool `json:"first"`
+	// PeriodStart and PeriodEnd are the period the payment covers.
+	PeriodStart time.Time `json:"periodStart"`
+	PeriodEnd   time.Time `json:"periodEnd"`
+}
+
+// Types of events about payments that changed after, or instead of, their
+// donation events.
+const (
+	// EventTypePaymentFailed is the type of events about payments that failed.
+	EventTypePaymentFailed = "payment_failed"
+	// EventTypeRefund is the type of events about refunded charges.
+	EventTypeRefund = "refund"
+	// EventTypeDispute is the type of events about disputed charges.
+	EventTypeDispute = "dispute"
+)
+
+// PaymentEvent is a failed payment, a refund or a dispute, so downstream
+// systems can reconcile the donations they were notified of.
+type PaymentEvent struct {
+	// Type is EventTypePaymentFailed, EventTypeRefund or EventTypeDispute.
+	Type            string `json:"type"`
+	PaymentIntentID string `json:"paymentIntentID,omitempty"`
+	// ChargeID is the ID of the donation, empty for payments that failed
+	// before they were charged.
+	ChargeID      string `json:"chargeID,omitempty"`
+	CustomerID    string `json:"customerID,omitempty"`
+	CustomerEmail string `json:"customerEmail,omitempty"`
+	// Amount of the failed payment, refunded in total, or disputed.
+	Amount   float64 `json:"amount"`
+	Currency string  `json:"currency"`
+	// Refunded is set if the charge was refunded in full.
+	Refunded bool `json:"refunded,omitempty"`
+	// RefundID or DisputeID is the ID of the latest refund or the dispute.
+	RefundID  string `json:"refundID,omitempty"`
+	DisputeID string `json:"disputeID,omitempty"`
+	// Reason is why the payment failed, or the reason of the refund or
+	// dispute, if it is known.
+	Reason string `json:"reason,omitempty"`
+	// Campaign the payment was made for, if any.
+	Campaign string `json:"campaign,omitempty"`
+}
+
+// Key returns the ID of the charge of the event, or of the payment intent if
+// it was not charged.
+func (e PaymentEvent) Key() string {
+	if e.ChargeID != "" {
+		return e.ChargeID
+	}
+	return e.PaymentIntentID
 }
 
+// Notifier delivers notifications. Implementations are safe for concurrent
+// use, fail without delivering when the context is done, and return ErrClosed
+// after Close, which may be called more than once. Package notifiertest
+// checks them.
 type Notifier interface {
 	Notify(ctx context.Context, event DonationEvent) error
+	NotifyRecurring(ctx context.Context, event RecurringDonationEvent) error
+	NotifyPayment(ctx context.Context, event PaymentEvent) error
 	Close() error
 }
+
+// EventTypeReport is the type of scheduled reports.
+const EventTypeReport = "report"
+
+// Report is a generated report to be delivered to its recipients.
+type Report struct {
+	ID         string
+	Name       string
+	Recipients []string
+	// Period the report covers.
+	From time.Time
+	To   time.Time
+	// Filename, ContentType and Body are the generated report, e.g. a CSV file.
+	Filename    string
+	ContentType string
+	Body        []byte
+}
+
+// ReportNotifier delivers generated reports.
+type ReportNotifier interface {
+	NotifyReport(ctx context.Context, report Report) error
+}
+
+// EventTypeEmail is the type of emails to donors.
+const EventTypeEmail = "email"
+
+// Email is an email to a donor, rendered by the server, to be sent by the
+// notifier or the service it delivers to.
+type Email struct {
+	// ID identifies the email, so receivers can drop duplicates.
+	ID string `json:"id"`
+	// Kind of the email, e.g. "anniversary".
+	Kind    string `json:"kind"`
+	To      string `json:"to"`
+	Name    string `json:"name,omitempty"`
+	Subject string `json:"subject"`
+	// Body is plain text.
+	Body string `json:"body"`
+	// Attachment is an optional file attached to the email, e.g. a receipt.
+	Attachment *Attachment `json:"attachment,omitempty"`
+}
+
+// Attachment is a file attached to an email. Its data is base64 in JSON.
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"`
+	Data        []byte `json:"data"`
+}
+
+// EmailNotifier delivers emails to donors.
+type EmailNotifier interface {
+	NotifyEmail(ctx context.Context, email Email) error
+}
+
+type chargedAtKey struct{}
+
+// WithChargedAt returns a context of notifying about a charge made at the time.
+func WithChargedAt(ctx context.Context, t time.Time) context.Context {
+	return context.WithValue(ctx, chargedAtKey{}, t)
+}
+
+// ChargedAt returns the time of the charge a notification of the context is
+// about, and whether it is known.
+func ChargedAt(ctx context.Context) (time.Time, bool) {
+	t, ok := ctx.Value(chargedAtKey{}).(time.Time)
+	return t, ok
+}
@@ -0,0 +1,204 @@
+// Package notifiertest checks that implementations of notifier.Notifier
+// behave like the notifiers of the server, so a new backend can be swapped in:
+//
+//	func TestNotifier(t *testing.T) {
+//		notifiertest.TestNotifier(t, func(t *testing.T) (notifier.Notifier, func() [][]byte) {
+//			...
+//		})
+//	}
+package notifiertest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/notifier"
+)
+
+// LargePayload is the size of the customer name of the large payload check,
+// larger than the defaults of most brokers' and servers' buffers.
+const LargePayload = 256 << 10
+
+// Concurrency is the number of notifications sent at once by the concurrency check.
+const Concurrency = 20
+
+// Factory creates a notifier under test, closed by the suite if it is not,
+// and a function returning the payloads it delivered so far, in any order.
+// Payloads must contain the IDs of the events, e.g. as JSON.
+type Factory func(t *testing.T) (n notifier.Notifier, delivered func() [][]byte)
+
+// TestNotifier runs the suite against new notifiers of the factory:
+//
+//   - donation and recurring donation events are delivered once,
+//   - nothing is delivered and the context's error is returned if the context
+//     is cancelled or its deadline has passed,
+//   - Close may be called more than once, and events after it fail with
+//     notifier.ErrClosed without being delivered,
+//   - events of LargePayload bytes are delivered whole,
+//   - Concurrency events notified at once are all delivered.
+func TestNotifier(t *testing.T, newNotifier Factory) {
+	t.Run("Notify", func(t *testing.T) {
+		n, delivered := start(t, newNotifier)
+		event := donationEvent("cus_notify")
+		if err := n.Notify(context.Background(), event); err != nil {
+			t.Fatalf("Notify: %v", err)
+		}
+		expectDelivered(t, delivered, event.CustomerID)
+	})
+
+	t.Run("NotifyRecurring", func(t *testing.T) {
+		n, delivered := start(t, newNotifier)
+		event := notifier.RecurringDonationEvent{
+			SubscriptionID: "sub_notify_recurring",
+			CustomerID:     "cus_notify_recurring",
+			CustomerName:   "Ana Horvat",
+			CustomerEmail:  "ana.horvat@example.com",
+			Amount:         1000,
+			Currency:       "eur",
+			Interval:       "month",
+			First:          true,
+			PeriodStart:    time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			PeriodEnd:      time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+		}
+		if err := n.NotifyRecurring(context.Background(), event); err != nil {
+			t.Fatalf("NotifyRecurring: %v", err)
+		}
+		expectDelivered(t, delivered, event.SubscriptionID)
+	})
+
+	t.Run("CancelledContext", func(t *testing.T) {
+		n, delivered := start(t, newNotifier)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := n.Notify(ctx, donationEvent("cus_cancelled"))
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Notify with a cancelled context returned %v, want context.Canceled", err)
+		}
+		expectNotDelivered(t, delivered)
+	})
+
+	t.Run("ExpiredDeadline", func(t *testing.T) {
+		n, delivered := start(t, newNotifier)
+		ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+		defer cancel()
+		err := n.NotifyRecurring(ctx, notifier.RecurringDonationEvent{SubscriptionID: "sub_expired", CustomerID: "cus_expired"})
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("NotifyRecurring with an expired deadline returned %v, want context.DeadlineExceeded", err)
+		}
+		expectNotDelivered(t, delivered)
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		n, delivered := start(t, newNotifier)
+		if err := n.Notify(context.Background(), donationEvent("cus_before_close")); err != nil {
+			t.Fatalf("Notify: %v", err)
+		}
+		if err := n.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		if err := n.Close(); err != nil {
+			t.Errorf("second Close: %v", err)
+		}
+		if err := n.Notify(context.Background(), donationEvent("cus_after_close")); !errors.Is(err, notifier.ErrClosed) {
+			t.Errorf("Notify after Close returned %v, want notifier.ErrClosed", err)
+		}
+		err := n.NotifyRecurring(context.Background(), notifier.RecurringDonationEvent{SubscriptionID: "sub_after_close", CustomerID: "cus_after_close"})
+		if !errors.Is(err, notifier.ErrClosed) {
+			t.Errorf("NotifyRecurring after Close returned %v, want notifier.ErrClosed", err)
+		}
+		err = n.NotifyPayment(context.Background(), notifier.PaymentEvent{Type: notifier.EventTypeRefund, ChargeID: "ch_after_close", Currency: "eur"})
+		if !errors.Is(err, notifier.ErrClosed) {
+			t.Errorf("NotifyPayment after Close returned %v, want notifier.ErrClosed", err)
+		}
+		expectDelivered(t, delivered, "cus_before_close")
+	})
+
+	t.Run("LargePayload", func(t *testing.T) {
+		n, delivered := start(t, newNotifier)
+		event := donationEvent("cus_large")
+		event.CustomerName = strings.Repeat("a", LargePayload)
+		if err := n.Notify(context.Background(), event); err != nil {
+			t.Fatalf("Notify of %d bytes: %v", LargePayload, err)
+		}
+		expectDelivered(t, delivered, event.CustomerID)
+		if payload := delivered()[0]; !bytes.Contains(payload, []byte(event.CustomerName)) {
+			t.Errorf("the delivered payload of %d bytes is missing the customer name of %d bytes", len(payload), LargePayload)
+		}
+	})
+
+	t.Run("ConcurrentNotify", func(t *testing.T) {
+		n, delivered := start(t, newNotifier)
+		var wg sync.WaitGroup
+		errs := make(chan error, Concurrency)
+		ids := make([]string, Concurrency)
+		for i := range ids {
+			ids[i] = fmt.Sprintf("cus_concurrent_%02d", i)
+			wg.Add(1)
+			go func(id string) {
+				defer wg.Done()
+				if err := n.Notify(context.Background(), donationEvent(id)); err != nil {
+					errs <- err
+				}
+			}(ids[i])
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Errorf("concurrent Notify: %v", err)
+		}
+		expectDelivered(t, delivered, ids...)
+	})
+}
+
+// start creates a notifier closed when the test ends.
+func start(t *testing.T, newNotifier Factory) (notifier.Notifier, func() [][]byte) {
+	t.Helper()
+	n, delivered := newNotifier(t)
+	t.Cleanup(func() {
+		n.Close()
+	})
+	return n, delivered
+}
+
+func donationEvent(customerID string) notifier.DonationEvent {
+	return notifier.DonationEvent{
+		CustomerID:    customerID,
+		CustomerName:  "Ana Horvat",
+		CustomerEmail: "ana.horvat@example.com",
+		Amount:        1000,
+		Currency:      "eur",
+	}
+}
+
+// expectDelivered checks that exactly one payload was delivered per ID.
+func expectDelivered(t *testing.T, delivered func() [][]byte, ids ...string) {
+	t.Helper()
+	payloads := delivered()
+	if len(payloads) != len(ids) {
+		t.Errorf("%d payloads were delivered, want %d", len(payloads), len(ids))
+	}
+	for _, id := range ids {
+		found := 0
+		for _, payload := range payloads {
+			if bytes.Contains(payload, []byte(`"`+id+`"`)) {
+				found++
+			}
+		}
+		if found != 1 {
+			t.Errorf("%q was delivered %d times, want once", id, found)
+		}
+	}
+}
+
+func expectNotDelivered(t *testing.T, delivered func() [][]byte) {
+	t.Helper()
+	if payloads := delivered(); len(payloads) != 0 {
+		t.Errorf("%d payloads were delivered, want none", len(payloads))
+	}
+}
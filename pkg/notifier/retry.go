@@ -0,0 +1,148 @@
+package notifier
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRetryAttempts is the number of attempts of a notification,
+	// including the first one.
+	DefaultRetryAttempts = 3
+	// DefaultRetryBackoff is the wait before the first retry, doubling with
+	// every retry up to DefaultMaxRetryBackoff.
+	DefaultRetryBackoff    = 100 * time.Millisecond
+	DefaultMaxRetryBackoff = 2 * time.Second
+)
+
+// RetryNotifier retries failed notifications of a notifier with exponential
+// backoff and jitter, so a short outage of a broker or endpoint does not
+// fail the webhook and make Stripe redeliver the whole event.
+type RetryNotifier struct {
+	next       Notifier
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	retryable  func(error) bool
+
+	// mu guards random.
+	mu     sync.Mutex
+	random *rand.Rand
+}
+
+// RetryOption configures a RetryNotifier.
+type RetryOption func(*RetryNotifier)
+
+// RetryAttempts sets the number of attempts of a notification, including the
+// first one. 1 does not retry.
+func RetryAttempts(attempts int) RetryOption {
+	return func(r *RetryNotifier) {
+		if attempts > 0 {
+			r.attempts = attempts
+		}
+	}
+}
+
+// RetryBackoff sets the wait before the first retry, doubling with every
+// retry up to max. Every wait is between half of it and all of it.
+func RetryBackoff(backoff, max time.Duration) RetryOption {
+	return func(r *RetryNotifier) {
+		r.backoff = backoff
+		r.maxBackoff = max
+	}
+}
+
+// RetryIf retries only the errors for which retryable returns true. By
+// default every error is retried, except ErrClosed and the context's.
+func RetryIf(retryable func(error) bool) RetryOption {
+	return func(r *RetryNotifier) {
+		r.retryable = retryable
+	}
+}
+
+// WithRetry returns a RetryNotifier retrying the failed notifications of next.
+func WithRetry(next Notifier, opts ...RetryOption) *RetryNotifier {
+	r := &RetryNotifier{
+		next:       next,
+		attempts:   DefaultRetryAttempts,
+		backoff:    DefaultRetryBackoff,
+		maxBackoff: DefaultMaxRetryBackoff,
+		retryable:  retryable,
+		random:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+func retryable(err error) bool {
+	return !errors.Is(err, ErrClosed) && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+func (r *RetryNotifier) Notify(ctx context.Context, event DonationEvent) error {
+	return r.retry(ctx, func() error {
+		return r.next.Notify(ctx, event)
+	})
+}
+
+func (r *RetryNotifier) NotifyRecurring(ctx context.Context, event RecurringDonationEvent) error {
+	return r.retry(ctx, func() error {
+		return r.next.NotifyRecurring(ctx, event)
+	})
+}
+
+func (r *RetryNotifier) NotifyPayment(ctx context.Context, event PaymentEvent) error {
+	return r.retry(ctx, func() error {
+		return r.next.NotifyPayment(ctx, event)
+	})
+}
+
+func (r *RetryNotifier) Close() error {
+	return r.next.Close()
+}
+
+func (r *RetryNotifier) Shutdown(ctx context.Context) (FlushReport, error) {
+	return Shutdown(ctx, r.next)
+}
+
+// retry calls notify until it succeeds, fails with an error that is not
+// retryable, runs out of attempts or the context is done, and returns its
+// last error.
+func (r *RetryNotifier) retry(ctx context.Context, notify func() error) error {
+	backoff := r.backoff
+	for attempt := 1; ; attempt++ {
+		err := notify()
+		if err == nil || attempt >= r.attempts || !r.retryable(err) || ctx.Err() != nil {
+			return err
+		}
+
+		wait := r.jitter(backoff)
+		log.Printf("Notification failed, retrying in %v (attempt %d of %d): %v\n", wait.Round(time.Millisecond), attempt+1, r.attempts, err)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		if backoff *= 2; backoff > r.maxBackoff {
+			backoff = r.maxBackoff
+		}
+	}
+}
+
+// jitter returns a random wait between half of the backoff and all of it, so
+// retries of notifications that failed together spread out.
+func (r *RetryNotifier) jitter(backoff time.Duration) time.Duration {
+	if backoff <= 1 {
+		return backoff
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return backoff/2 + time.Duration(r.random.Int63n(int64(backoff/2)+1))
+}
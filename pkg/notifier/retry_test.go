@@ -0,0 +1,69 @@
+package notifier_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/notifier"
+	"github.com/vedrankolka/donation-server/pkg/notifier/notifiertest"
+)
+
+// flaky fails its first failures notifications, then records them.
+type flaky struct {
+	recorder
+	failures int
+	calls    int
+}
+
+func (f *flaky) Notify(ctx context.Context, event notifier.DonationEvent) error {
+	f.calls++
+	if f.calls <= f.failures {
+		return errors.New("broker not available")
+	}
+	return f.recorder.Notify(ctx, event)
+}
+
+func TestRetryNotifier(t *testing.T) {
+	notifiertest.TestNotifier(t, func(t *testing.T) (notifier.Notifier, func() [][]byte) {
+		r := &recorder{}
+		return notifier.WithRetry(r), r.delivered
+	})
+}
+
+func TestRetry(t *testing.T) {
+	backoff := notifier.RetryBackoff(time.Millisecond, 2*time.Millisecond)
+	event := notifier.DonationEvent{CustomerID: "cus_1", Amount: 10, Currency: "eur"}
+
+	f := &flaky{failures: 2}
+	if err := notifier.WithRetry(f, backoff).Notify(context.Background(), event); err != nil {
+		t.Fatalf("Notify after two failures: %v", err)
+	}
+	if f.calls != 3 || len(f.delivered()) != 1 {
+		t.Errorf("%d calls delivered %d events, want 3 calls delivering 1", f.calls, len(f.delivered()))
+	}
+
+	f = &flaky{failures: 5}
+	if err := notifier.WithRetry(f, backoff, notifier.RetryAttempts(4)).Notify(context.Background(), event); err == nil {
+		t.Error("Notify succeeded after running out of attempts")
+	}
+	if f.calls != 4 {
+		t.Errorf("%d calls, want 4 attempts", f.calls)
+	}
+
+	f = &flaky{failures: 5}
+	permanent := notifier.RetryIf(func(err error) bool { return false })
+	if err := notifier.WithRetry(f, backoff, permanent).Notify(context.Background(), event); err == nil || f.calls != 1 {
+		t.Errorf("an error that is not retryable was retried: %d calls, %v", f.calls, err)
+	}
+
+	f = &flaky{failures: 5}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := notifier.WithRetry(f, notifier.RetryAttempts(10), notifier.RetryBackoff(time.Second, time.Second)).Notify(ctx, event)
+	if err == nil || time.Since(start) > time.Second {
+		t.Errorf("Notify waited for a retry after the context was done: %v after %v", err, time.Since(start))
+	}
+}
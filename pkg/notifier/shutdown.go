@@ -0,0 +1,55 @@
+package notifier
+
+import (
+	"context"
+)
+
+// FlushReport counts the queued events a notifier delivered or dead-lettered
+// when it was shut down.
+type FlushReport struct {
+	// Flushed events were delivered while shutting down.
+	Flushed int `json:"flushed"`
+	// DeadLettered events failed, or were not delivered before the deadline.
+	DeadLettered int `json:"deadLettered"`
+}
+
+// Add adds the counts of another report.
+func (r *FlushReport) Add(other FlushReport) {
+	r.Flushed += other.Flushed
+	r.DeadLettered += other.DeadLettered
+}
+
+// Shutdowner is a notifier that queues events before delivering them, e.g. to
+// write them in bulk, or that wraps such notifiers. Shutdown closes it after
+// delivering the queued events until the context is done, and dead-letters
+// those that could not be delivered.
+type Shutdowner interface {
+	Shutdown(ctx context.Context) (FlushReport, error)
+}
+
+// Shutdown shuts the notifier down if it is a Shutdowner, or else closes it.
+func Shutdown(ctx context.Context, n Notifier) (FlushReport, error) {
+	if s, ok := n.(Shutdowner); ok {
+		return s.Shutdown(ctx)
+	}
+	return FlushReport{}, n.Close()
+}
+
+// DeadLetterFunc saves an event a notifier accepted but could not deliver,
+// e.g. a queued one, so it can be redriven. The payload is the event as JSON
+// and eventID the ID of the Stripe event it is about, if it is known.
+type DeadLetterFunc func(eventID, eventType string, payload []byte, err error)
+
+type eventIDKey struct{}
+
+// WithEventID returns a context of notifying about the Stripe event with the ID.
+func WithEventID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, eventIDKey{}, id)
+}
+
+// EventID returns the ID of the Stripe event a notification of the context is
+// about, or "".
+func EventID(ctx context.Context) string {
+	id, _ := ctx.Value(eventIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,247 @@
+package sqs
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Credentials are AWS credentials, temporary ones with a session token and an
+// expiration.
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// Expires is when temporary credentials expire, zero for those of an IAM user.
+	Expires time.Time
+}
+
+// CredentialProvider provides the credentials requests are signed with.
+type CredentialProvider interface {
+	Credentials(ctx context.Context) (Credentials, error)
+}
+
+// StaticCredentials are fixed credentials, e.g. of an IAM user.
+type StaticCredentials Credentials
+
+func (c StaticCredentials) Credentials(ctx context.Context) (Credentials, error) {
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return Credentials{}, errors.New("the access key ID and secret access key are required")
+	}
+	return Credentials(c), nil
+}
+
+// Endpoints of the role credentials.
+const (
+	// ecsEndpoint is the host of AWS_CONTAINER_CREDENTIALS_RELATIVE_URI.
+	ecsEndpoint = "http://169.254.170.2"
+	// imdsEndpoint is the EC2 instance metadata service.
+	imdsEndpoint = "http://169.254.169.254"
+)
+
+// stsEndpoint returns the endpoint of STS in the region, the global one if
+// the region is not known.
+func stsEndpoint(region string) string {
+	if region == "" {
+		return "https://sts.amazonaws.com/"
+	}
+	return "https://sts." + region + ".amazonaws.com/"
+}
+
+const (
+	// refreshBefore is how long before they expire role credentials are refreshed.
+	refreshBefore = 5 * time.Minute
+	// imdsTimeout limits the calls to the instance metadata service, which
+	// does not answer outside of EC2.
+	imdsTimeout = 2 * time.Second
+)
+
+// RoleCredentials are the temporary credentials of the IAM role the server
+// runs with, refreshed before they expire. The role is found like the AWS
+// SDKs do, from the variables the platform sets: a web identity token of
+// EKS (AWS_WEB_IDENTITY_TOKEN_FILE and AWS_ROLE_ARN), the container
+// credentials of ECS (AWS_CONTAINER_CREDENTIALS_RELATIVE_URI or _FULL_URI),
+// or else the instance profile of EC2.
+type RoleCredentials struct {
+	client *http.Client
+	region string
+	getenv func(string) string
+
+	mu     sync.Mutex
+	cached Credentials
+}
+
+// NewRoleCredentials creates RoleCredentials fetched with the client, from
+// STS of the region for web identities.
+func NewRoleCredentials(client *http.Client, region string) *RoleCredentials {
+	return &RoleCredentials{client: client, region: region, getenv: os.Getenv}
+}
+
+func (rc *RoleCredentials) Credentials(ctx context.Context) (Credentials, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.cached.AccessKeyID != "" && time.Until(rc.cached.Expires) > refreshBefore {
+		return rc.cached, nil
+	}
+
+	var creds Credentials
+	var err error
+	switch {
+	case rc.getenv("AWS_WEB_IDENTITY_TOKEN_FILE") != "":
+		creds, err = rc.webIdentity(ctx)
+	case rc.getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI") != "" || rc.getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") != "":
+		creds, err = rc.container(ctx)
+	default:
+		creds, err = rc.instanceProfile(ctx)
+	}
+	if err != nil {
+		return Credentials{}, fmt.Errorf("could not get the credentials of the IAM role: %v", err)
+	}
+	rc.cached = creds
+	return creds, nil
+}
+
+// webIdentity exchanges the web identity token for credentials of the role
+// with STS AssumeRoleWithWebIdentity, which is not signed.
+func (rc *RoleCredentials) webIdentity(ctx context.Context) (Credentials, error) {
+	token, err := os.ReadFile(rc.getenv("AWS_WEB_IDENTITY_TOKEN_FILE"))
+	if err != nil {
+		return Credentials{}, err
+	}
+	session := rc.getenv("AWS_ROLE_SESSION_NAME")
+	if session == "" {
+		session = "donation-server"
+	}
+	query := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {rc.getenv("AWS_ROLE_ARN")},
+		"RoleSessionName":  {session},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", stsEndpoint(rc.region), strings.NewReader(query.Encode()))
+	if err != nil {
+		return Credentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	data, err := rc.do(req)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	var resp struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.Unmarshal(data, &resp); err != nil {
+		return Credentials{}, fmt.Errorf("invalid response of STS: %v", err)
+	}
+	c := resp.Credentials
+	return Credentials{AccessKeyID: c.AccessKeyID, SecretAccessKey: c.SecretAccessKey, SessionToken: c.SessionToken, Expires: c.Expiration}, nil
+}
+
+// container fetches the credentials of the ECS task.
+func (rc *RoleCredentials) container(ctx context.Context) (Credentials, error) {
+	endpoint := rc.getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if relative := rc.getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relative != "" {
+		endpoint = ecsEndpoint + relative
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return Credentials{}, err
+	}
+	token := rc.getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if file := rc.getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return Credentials{}, err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	data, err := rc.do(req)
+	if err != nil {
+		return Credentials{}, err
+	}
+	return parseRoleJSON(data)
+}
+
+// instanceProfile fetches the credentials of the role of the EC2 instance
+// with IMDSv2.
+func (rc *RoleCredentials) instanceProfile(ctx context.Context) (Credentials, error) {
+	ctx, cancel := context.WithTimeout(ctx, imdsTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "PUT", imdsEndpoint+"/latest/api/token", nil)
+	if err != nil {
+		return Credentials{}, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	token, err := rc.do(req)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("no IAM role is configured and the instance metadata service cannot be reached: %v", err)
+	}
+
+	get := func(path string) ([]byte, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", imdsEndpoint+"/latest/meta-data/iam/security-credentials/"+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", string(token))
+		return rc.do(req)
+	}
+	role, err := get("")
+	if err != nil {
+		return Credentials{}, fmt.Errorf("the instance has no IAM role: %v", err)
+	}
+	data, err := get(strings.TrimSpace(strings.SplitN(string(role), "\n", 2)[0]))
+	if err != nil {
+		return Credentials{}, err
+	}
+	return parseRoleJSON(data)
+}
+
+// parseRoleJSON parses the credentials of the ECS and EC2 endpoints.
+func parseRoleJSON(data []byte) (Credentials, error) {
+	var c struct {
+		AccessKeyID     string    `json:"AccessKeyId"`
+		SecretAccessKey string    `json:"SecretAccessKey"`
+		Token           string    `json:"Token"`
+		Expiration      time.Time `json:"Expiration"`
+	}
+	if err := json.Unmarshal(data, &c); err != nil || c.AccessKeyID == "" {
+		return Credentials{}, fmt.Errorf("invalid credentials response: %s", truncate(data))
+	}
+	return Credentials{AccessKeyID: c.AccessKeyID, SecretAccessKey: c.SecretAccessKey, SessionToken: c.Token, Expires: c.Expiration}, nil
+}
+
+// do sends the request and returns the body of a successful response.
+func (rc *RoleCredentials) do(req *http.Request) ([]byte, error) {
+	resp, err := rc.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s responded with %s: %s", req.URL.Host, resp.Status, truncate(data))
+	}
+	return data, nil
+}
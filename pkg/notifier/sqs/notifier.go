@@ -0,0 +1,362 @@
+// Package sqs notifies to an AWS SQS queue, or to an SNS topic fanning out to
+// queues and other subscribers, so deployments on AWS get events without
+// running Kafka. Requests are signed with AWS Signature Version 4, with static
+// credentials or those of the IAM role the server runs with.
+package sqs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/cloudevents"
+	"github.com/vedrankolka/donation-server/pkg/notifier"
+	"github.com/vedrankolka/donation-server/pkg/requestid"
+	"github.com/vedrankolka/donation-server/pkg/schema"
+	"go.uber.org/zap"
+)
+
+// Message attributes of the notifications, which SNS subscriptions can
+// filter on.
+const (
+	// EventTypeAttribute holds the type of the event.
+	EventTypeAttribute = "event_type"
+	// RequestIDAttribute holds the ID of the request the event is about, see
+	// package requestid. CloudEvents carry it in ce_requestid instead.
+	RequestIDAttribute = "request_id"
+)
+
+const (
+	sqsVersion = "2012-11-05"
+	snsVersion = "2010-03-31"
+	// maxErrorBody is the maximum length of a response kept in errors.
+	maxErrorBody = 200
+)
+
+// SQSNotifier sends events as JSON messages to an SQS queue or an SNS topic.
+// Messages of FIFO queues and topics are grouped by customer, so the events
+// of a donor are received in order.
+type SQSNotifier struct {
+	// queueURL or topicARN is the target, endpoint where requests are sent.
+	queueURL    string
+	topicARN    string
+	endpoint    string
+	region      string
+	fifo        bool
+	credentials CredentialProvider
+	client      *http.Client
+	cloudEvents *cloudevents.Config
+	log         *zap.Logger
+
+	// mu guards closed.
+	mu     sync.Mutex
+	closed bool
+}
+
+// Option configures an SQSNotifier.
+type Option func(*SQSNotifier)
+
+// WithCredentials signs requests with the credentials instead of those of the
+// IAM role of the server.
+func WithCredentials(credentials CredentialProvider) Option {
+	return func(sn *SQSNotifier) {
+		sn.credentials = credentials
+	}
+}
+
+// WithRegion sets the region of the queue or topic, if it is not the one of
+// its URL or ARN.
+func WithRegion(region string) Option {
+	return func(sn *SQSNotifier) {
+		sn.region = region
+	}
+}
+
+// WithEndpoint sends requests of an SNS topic to the endpoint instead of
+// SNS of its region, e.g. to LocalStack. Requests of a queue go to its URL.
+func WithEndpoint(endpoint string) Option {
+	return func(sn *SQSNotifier) {
+		if sn.topicARN != "" {
+			sn.endpoint = endpoint
+		}
+	}
+}
+
+// WithClient sends requests with the client instead of http.DefaultClient.
+func WithClient(client *http.Client) Option {
+	return func(sn *SQSNotifier) {
+		sn.client = client
+	}
+}
+
+// WithCloudEvents sends events as CloudEvents in the configured content mode.
+// In binary mode the attributes are "ce_" prefixed message attributes.
+func WithCloudEvents(config *cloudevents.Config) Option {
+	return func(sn *SQSNotifier) {
+		sn.cloudEvents = config
+	}
+}
+
+// WithLogger logs with the logger instead of the global logger of zap.
+func WithLogger(l *zap.Logger) Option {
+	return func(sn *SQSNotifier) {
+		sn.log = l
+	}
+}
+
+// NewSQSNotifier creates an SQSNotifier sending to the target, the URL of an
+// SQS queue like https://sqs.eu-west-1.amazonaws.com/123456789012/donations,
+// or the ARN of an SNS topic like arn:aws:sns:eu-west-1:123456789012:donations.
+func NewSQSNotifier(target string, opts ...Option) (*SQSNotifier, error) {
+	sn := &SQSNotifier{
+		client: http.DefaultClient,
+		log:    zap.L(),
+	}
+	if strings.HasPrefix(target, "arn:") {
+		// arn:partition:sns:region:account:name
+		parts := strings.Split(target, ":")
+		if len(parts) != 6 || parts[2] != "sns" || parts[5] == "" {
+			return nil, fmt.Errorf("%q is not the ARN of an SNS topic", target)
+		}
+		sn.topicARN, sn.region = target, parts[3]
+		sn.fifo = strings.HasSuffix(parts[5], ".fifo")
+	} else {
+		u, err := url.Parse(target)
+		if err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+			return nil, fmt.Errorf("%q is neither the URL of an SQS queue nor the ARN of an SNS topic", target)
+		}
+		sn.queueURL, sn.endpoint, sn.region = target, target, regionOfHost(u.Hostname())
+		sn.fifo = strings.HasSuffix(u.Path, ".fifo")
+	}
+	for _, opt := range opts {
+		opt(sn)
+	}
+
+	if sn.region == "" {
+		return nil, fmt.Errorf("the region of %s is not known, it must be configured", target)
+	}
+	if sn.topicARN != "" && sn.endpoint == "" {
+		sn.endpoint = "https://sns." + sn.region + ".amazonaws.com/"
+		if strings.HasPrefix(sn.region, "cn-") {
+			sn.endpoint = "https://sns." + sn.region + ".amazonaws.com.cn/"
+		}
+	}
+	if sn.credentials == nil {
+		sn.credentials = NewRoleCredentials(sn.client, sn.region)
+	}
+	sn.log.Info("Notifying to AWS", zap.String("target", target), zap.String("region", sn.region), zap.Bool("fifo", sn.fifo))
+	return sn, nil
+}
+
+// regionOfHost returns the region of an SQS host, like
+// sqs.eu-west-1.amazonaws.com or eu-west-1.queue.amazonaws.com, or "".
+func regionOfHost(host string) string {
+	parts := strings.Split(host, ".")
+	switch {
+	case len(parts) >= 4 && parts[0] == "sqs" && parts[2] == "amazonaws":
+		return parts[1]
+	case len(parts) >= 4 && parts[1] == "queue" && parts[2] == "amazonaws":
+		return parts[0]
+	}
+	return ""
+}
+
+func (sn *SQSNotifier) Notify(ctx context.Context, event notifier.DonationEvent) error {
+	return sn.send(ctx, notifier.EventTypeDonation, event.CustomerID, event)
+}
+
+func (sn *SQSNotifier) NotifyRecurring(ctx context.Context, event notifier.RecurringDonationEvent) error {
+	return sn.send(ctx, notifier.EventTypeRecurringDonation, event.CustomerID, event)
+}
+
+// NotifyPayment groups the event by the customer, so it follows the donation
+// event in a FIFO queue, or by the charge without a customer.
+func (sn *SQSNotifier) NotifyPayment(ctx context.Context, event notifier.PaymentEvent) error {
+	key := event.CustomerID
+	if key == "" {
+		key = event.Key()
+	}
+	return sn.send(ctx, event.Type, key, event)
+}
+
+// NotifyEmail sends the email as JSON, for a consumer to send, e.g. with SES.
+// It is grouped by its ID, keeping the donor's address out of FIFO group IDs.
+func (sn *SQSNotifier) NotifyEmail(ctx context.Context, email notifier.Email) error {
+	return sn.send(ctx, notifier.EventTypeEmail, email.ID, email)
+}
+
+// send sends the event as JSON, grouped by the key in FIFO queues and topics.
+func (sn *SQSNotifier) send(ctx context.Context, eventType, key string, event interface{}) error {
+	sn.mu.Lock()
+	closed := sn.closed
+	sn.mu.Unlock()
+	if closed {
+		return notifier.ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("could not marshal %s event: %v", eventType, err)
+	}
+	attributes := map[string]string{EventTypeAttribute: eventType}
+	if sn.cloudEvents != nil {
+		if body, err = sn.wrap(ctx, attributes, eventType, key, body); err != nil {
+			return err
+		}
+	} else if id := requestid.FromContext(ctx); id != "" {
+		attributes[RequestIDAttribute] = id
+	}
+
+	params := url.Values{}
+	prefix := "MessageAttribute."
+	if sn.topicARN != "" {
+		params.Set("Action", "Publish")
+		params.Set("TopicArn", sn.topicARN)
+		params.Set("Message", string(body))
+		prefix = "MessageAttributes.entry."
+	} else {
+		params.Set("Action", "SendMessage")
+		params.Set("MessageBody", string(body))
+	}
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		n := prefix + strconv.Itoa(i+1)
+		params.Set(n+".Name", name)
+		params.Set(n+".Value.DataType", "String")
+		params.Set(n+".Value.StringValue", attributes[name])
+	}
+	if sn.fifo {
+		// Retried notifications of the same event are delivered once.
+		sum := sha256.Sum256(body)
+		params.Set("MessageGroupId", key)
+		params.Set("MessageDeduplicationId", hex.EncodeToString(sum[:]))
+	}
+
+	data, err := sn.call(ctx, params)
+	if err != nil {
+		return err
+	}
+	var resp struct {
+		SQS string `xml:"SendMessageResult>MessageId"`
+		SNS string `xml:"PublishResult>MessageId"`
+	}
+	xml.Unmarshal(data, &resp)
+	requestid.Logger(ctx, sn.log).Debug("Event sent to AWS", zap.String("event_type", eventType),
+		zap.String("key", key), zap.String("message_id", resp.SQS+resp.SNS))
+	return nil
+}
+
+// wrap turns the body into a CloudEvent, setting its attributes in binary mode.
+func (sn *SQSNotifier) wrap(ctx context.Context, attributes map[string]string, eventType, subject string, body []byte) ([]byte, error) {
+	ce, err := sn.cloudEvents.NewEvent(eventType, schema.Version(ctx, eventType), subject, body, "application/json")
+	if err != nil {
+		return nil, err
+	}
+	ce.RequestID = requestid.FromContext(ctx)
+
+	if sn.cloudEvents.Mode == cloudevents.ModeBinary {
+		attributes["content-type"] = ce.DataContentType
+		for name, value := range ce.Attributes() {
+			attributes["ce_"+name] = value
+		}
+		return body, nil
+	}
+	attributes["content-type"] = cloudevents.ContentType
+	return ce.Structured()
+}
+
+// call sends a signed request of the Query API of SQS or SNS and returns the
+// body of its response.
+func (sn *SQSNotifier) call(ctx context.Context, params url.Values) ([]byte, error) {
+	service, version := "sqs", sqsVersion
+	if sn.topicARN != "" {
+		service, version = "sns", snsVersion
+	}
+	params.Set("Version", version)
+	creds, err := sn.credentials.Credentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	body := []byte(params.Encode())
+	req, err := http.NewRequestWithContext(ctx, "POST", sn.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signV4(req, body, creds, sn.region, service, time.Now())
+
+	resp, err := sn.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var awsErr struct {
+			Code      string `xml:"Error>Code"`
+			Message   string `xml:"Error>Message"`
+			RequestID string `xml:"RequestId"`
+		}
+		if xml.Unmarshal(data, &awsErr) != nil || awsErr.Code == "" {
+			return nil, fmt.Errorf("%s responded with %s: %s", strings.ToUpper(service), resp.Status, truncate(data))
+		}
+		return nil, fmt.Errorf("%s responded with %s: %s: %s (request ID %s)",
+			strings.ToUpper(service), resp.Status, awsErr.Code, awsErr.Message, awsErr.RequestID)
+	}
+	return data, nil
+}
+
+// Check gets the attributes of the queue or topic, which checks the
+// credentials and that it exists. Nothing is sent.
+func (sn *SQSNotifier) Check(ctx context.Context) error {
+	params := url.Values{}
+	if sn.topicARN != "" {
+		params.Set("Action", "GetTopicAttributes")
+		params.Set("TopicArn", sn.topicARN)
+	} else {
+		params.Set("Action", "GetQueueAttributes")
+		params.Set("AttributeName.1", "QueueArn")
+	}
+	_, err := sn.call(ctx, params)
+	return err
+}
+
+// Close makes the notifier refuse further events and closes idle connections.
+func (sn *SQSNotifier) Close() error {
+	sn.mu.Lock()
+	sn.closed = true
+	sn.mu.Unlock()
+	sn.client.CloseIdleConnections()
+	return nil
+}
+
+func truncate(data []byte) []byte {
+	data = bytes.TrimSpace(data)
+	if len(data) > maxErrorBody {
+		data = data[:maxErrorBody]
+	}
+	return data
+}
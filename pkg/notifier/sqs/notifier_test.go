@@ -0,0 +1,175 @@
+package sqs
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/cloudevents"
+	"github.com/vedrankolka/donation-server/pkg/notifier"
+	"github.com/vedrankolka/donation-server/pkg/notifier/notifiertest"
+)
+
+var testCredentials = StaticCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+
+func TestSQSNotifier(t *testing.T) {
+	notifiertest.TestNotifier(t, func(t *testing.T) (notifier.Notifier, func() [][]byte) {
+		server, delivered := newTestServer(t)
+		return newTestNotifier(t, server.URL+"/123456789012/donations"), delivered
+	})
+}
+
+func TestSQSNotifierCloudEvents(t *testing.T) {
+	for _, mode := range []string{cloudevents.ModeStructured, cloudevents.ModeBinary} {
+		t.Run(mode, func(t *testing.T) {
+			config, err := cloudevents.NewConfig(mode, "https://donate.example.org", "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			notifiertest.TestNotifier(t, func(t *testing.T) (notifier.Notifier, func() [][]byte) {
+				server, delivered := newTestServer(t)
+				return newTestNotifier(t, server.URL+"/123456789012/donations", WithCloudEvents(config)), delivered
+			})
+		})
+	}
+}
+
+func TestSNSFIFOTopic(t *testing.T) {
+	var form map[string][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form = r.PostForm
+		w.Write([]byte(`<PublishResponse><PublishResult><MessageId>m-1</MessageId></PublishResult></PublishResponse>`))
+	}))
+	defer server.Close()
+
+	sn := newTestNotifier(t, "arn:aws:sns:eu-west-1:123456789012:donations.fifo", WithEndpoint(server.URL))
+	if err := sn.Notify(context.Background(), notifier.DonationEvent{CustomerID: "cus_1", Amount: 10, Currency: "eur"}); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"Action":                         "Publish",
+		"TopicArn":                       "arn:aws:sns:eu-west-1:123456789012:donations.fifo",
+		"MessageGroupId":                 "cus_1",
+		"MessageAttributes.entry.1.Name": EventTypeAttribute,
+		"MessageAttributes.entry.1.Value.StringValue": notifier.EventTypeDonation,
+	} {
+		if got := strings.Join(form[name], ","); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if len(strings.Join(form["MessageDeduplicationId"], "")) != 64 {
+		t.Errorf("MessageDeduplicationId = %q, want a SHA-256 of the message", form["MessageDeduplicationId"])
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`<ErrorResponse><Error><Type>Sender</Type><Code>AWS.SimpleQueueService.NonExistentQueue</Code>` +
+			`<Message>The specified queue does not exist.</Message></Error><RequestId>r-1</RequestId></ErrorResponse>`))
+	}))
+	defer server.Close()
+
+	err := newTestNotifier(t, server.URL+"/123456789012/missing").Check(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "NonExistentQueue") || !strings.Contains(err.Error(), "r-1") {
+		t.Errorf("Check of a missing queue = %v, want its error code and request ID", err)
+	}
+}
+
+func TestRegion(t *testing.T) {
+	for target, want := range map[string]string{
+		"https://sqs.eu-west-1.amazonaws.com/123456789012/donations":   "eu-west-1",
+		"https://us-east-2.queue.amazonaws.com/123456789012/donations": "us-east-2",
+		"arn:aws:sns:ap-south-1:123456789012:donations":                "ap-south-1",
+	} {
+		sn, err := NewSQSNotifier(target, WithCredentials(testCredentials))
+		if err != nil {
+			t.Errorf("NewSQSNotifier(%q): %v", target, err)
+		} else if sn.region != want {
+			t.Errorf("the region of %s is %q, want %q", target, sn.region, want)
+		}
+	}
+	if _, err := NewSQSNotifier("http://localhost:4566/000000000000/donations"); err == nil {
+		t.Error("NewSQSNotifier of a queue without a known region succeeded")
+	}
+}
+
+// TestSignV4 signs the get-vanilla request of the AWS Signature Version 4 test suite.
+func TestSignV4(t *testing.T) {
+	req := httptest.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	req.Header = make(http.Header)
+	signV4(req, nil, Credentials(testCredentials), "us-east-1", "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("Authorization = %s, want %s", got, want)
+	}
+}
+
+func TestContainerCredentials(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"AccessKeyId": "ASIA1", "SecretAccessKey": "secret", "Token": "session", "Expiration": "` +
+			time.Now().Add(time.Hour).UTC().Format(time.RFC3339) + `"}`))
+	}))
+	defer server.Close()
+
+	env := map[string]string{"AWS_CONTAINER_CREDENTIALS_FULL_URI": server.URL + "/creds", "AWS_CONTAINER_AUTHORIZATION_TOKEN": "token"}
+	rc := NewRoleCredentials(server.Client(), "eu-west-1")
+	rc.getenv = func(name string) string { return env[name] }
+	creds, err := rc.Credentials(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.AccessKeyID != "ASIA1" || creds.SessionToken != "session" {
+		t.Errorf("the credentials are %+v, want those of the endpoint", creds)
+	}
+	server.Close()
+	if cached, err := rc.Credentials(context.Background()); err != nil || cached != creds {
+		t.Errorf("the credentials are not cached until they expire: %+v, %v", cached, err)
+	}
+}
+
+// newTestServer returns a server answering SendMessage like SQS and
+// recording the bodies of the messages.
+func newTestServer(t *testing.T) (*httptest.Server, func() [][]byte) {
+	var mu sync.Mutex
+	var bodies [][]byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if err := r.ParseForm(); err != nil || r.PostForm.Get("Action") != "SendMessage" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		bodies = append(bodies, []byte(r.PostForm.Get("MessageBody")))
+		mu.Unlock()
+		w.Write([]byte(`<SendMessageResponse><SendMessageResult><MessageId>m-1</MessageId></SendMessageResult></SendMessageResponse>`))
+	}))
+	t.Cleanup(server.Close)
+	return server, func() [][]byte {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([][]byte(nil), bodies...)
+	}
+}
+
+func newTestNotifier(t *testing.T, target string, opts ...Option) *SQSNotifier {
+	opts = append([]Option{WithRegion("eu-west-1"), WithCredentials(testCredentials)}, opts...)
+	sn, err := NewSQSNotifier(target, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sn
+}
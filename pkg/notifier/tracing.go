@@ -0,0 +1,65 @@
+package notifier
+
+import (
+	"context"
+
+	"github.com/vedrankolka/donation-server/pkg/tracing"
+)
+
+// TracingNotifier records a span of every notification of a notifier,
+// including its retries, whose context the notifier may send on, like the
+// traceparent header of Kafka messages.
+type TracingNotifier struct {
+	next Notifier
+	name string
+}
+
+// WithTracing returns a TracingNotifier recording the notifications of next,
+// the notifier of the name, e.g. kafka.
+func WithTracing(next Notifier, name string) *TracingNotifier {
+	return &TracingNotifier{next: next, name: name}
+}
+
+func (t *TracingNotifier) Notify(ctx context.Context, event DonationEvent) error {
+	ctx, span := t.start(ctx, EventTypeDonation)
+	defer span.End()
+	err := t.next.Notify(ctx, event)
+	span.SetError(err)
+	return err
+}
+
+func (t *TracingNotifier) NotifyRecurring(ctx context.Context, event RecurringDonationEvent) error {
+	ctx, span := t.start(ctx, EventTypeRecurringDonation)
+	defer span.End()
+	err := t.next.NotifyRecurring(ctx, event)
+	span.SetError(err)
+	return err
+}
+
+func (t *TracingNotifier) NotifyPayment(ctx context.Context, event PaymentEvent) error {
+	ctx, span := t.start(ctx, event.Type)
+	defer span.End()
+	err := t.next.NotifyPayment(ctx, event)
+	span.SetError(err)
+	return err
+}
+
+// start starts the span of a notification, like "notify kafka donation".
+func (t *TracingNotifier) start(ctx context.Context, eventType string) (context.Context, *tracing.Span) {
+	ctx, span := tracing.Start(ctx, "notify "+t.name+" "+eventType, tracing.KindProducer,
+		tracing.String("notifier", t.name),
+		tracing.String("event.type", eventType),
+	)
+	if id := EventID(ctx); id != "" {
+		span.SetAttributes(tracing.String("stripe.event_id", id))
+	}
+	return ctx, span
+}
+
+func (t *TracingNotifier) Close() error {
+	return t.next.Close()
+}
+
+func (t *TracingNotifier) Shutdown(ctx context.Context) (FlushReport, error) {
+	return Shutdown(ctx, t.next)
+}
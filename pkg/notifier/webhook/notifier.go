@@ -0,0 +1,255 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/cloudevents"
+	"github.com/vedrankolka/donation-server/pkg/notifier"
+	"github.com/vedrankolka/donation-server/pkg/requestid"
+	"github.com/vedrankolka/donation-server/pkg/schema"
+	"go.uber.org/zap"
+)
+
+// Request headers of the notifications.
+const (
+	// EventTypeHeader holds the type of the event.
+	EventTypeHeader = "X-Donation-Event"
+	// ReportNameHeader and ReportRecipientsHeader describe a report.
+	ReportNameHeader       = "X-Report-Name"
+	ReportRecipientsHeader = "X-Report-Recipients"
+)
+
+// maxErrorBody is the maximum length of a receiver's error response kept in errors.
+const maxErrorBody = 200
+
+// WebhookNotifier POSTs events to an HTTP endpoint. Events are sent as JSON
+// unless there is a template for their type.
+type WebhookNotifier struct {
+	url         string
+	client      *http.Client
+	templates   *Templates
+	cloudEvents *cloudevents.Config
+	log         *zap.Logger
+
+	// mu guards closed.
+	mu     sync.Mutex
+	closed bool
+}
+
+// Option configures a WebhookNotifier.
+type Option func(*WebhookNotifier)
+
+// WithTemplates renders the payload of events with the templates of their type.
+func WithTemplates(templates *Templates) Option {
+	return func(wn *WebhookNotifier) {
+		wn.templates = templates
+	}
+}
+
+// WithCloudEvents sends events as CloudEvents in the configured content mode.
+// In binary mode the attributes are "ce-" prefixed headers.
+func WithCloudEvents(config *cloudevents.Config) Option {
+	return func(wn *WebhookNotifier) {
+		wn.cloudEvents = config
+	}
+}
+
+// WithClient sends requests with the client instead of http.DefaultClient.
+func WithClient(client *http.Client) Option {
+	return func(wn *WebhookNotifier) {
+		wn.client = client
+	}
+}
+
+// WithLogger logs with the logger instead of the global logger of zap.
+func WithLogger(l *zap.Logger) Option {
+	return func(wn *WebhookNotifier) {
+		wn.log = l
+	}
+}
+
+// NewWebhookNotifier creates a WebhookNotifier sending events to the URL.
+func NewWebhookNotifier(url string, opts ...Option) (*WebhookNotifier, error) {
+	if url == "" {
+		return nil, fmt.Errorf("webhook URL is required")
+	}
+
+	wn := &WebhookNotifier{
+		url:    url,
+		client: http.DefaultClient,
+		log:    zap.L(),
+	}
+	for _, opt := range opts {
+		opt(wn)
+	}
+
+	return wn, nil
+}
+
+func (wn *WebhookNotifier) Notify(ctx context.Context, event notifier.DonationEvent) error {
+	return wn.send(ctx, Message{
+		Type:          notifier.EventTypeDonation,
+		Time:          time.Now().UTC(),
+		DonationEvent: event,
+	})
+}
+
+func (wn *WebhookNotifier) send(ctx context.Context, msg Message) error {
+	body, contentType, err := wn.render(msg)
+	if err != nil {
+		return err
+	}
+
+	return wn.post(ctx, make(http.Header), msg.Type, msg.CustomerID, msg.Time, body, contentType)
+}
+
+// NotifyRecurring posts the event as JSON, templates only render donation events.
+func (wn *WebhookNotifier) NotifyRecurring(ctx context.Context, event notifier.RecurringDonationEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("could not marshal %s event: %v", notifier.EventTypeRecurringDonation, err)
+	}
+	return wn.post(ctx, make(http.Header), notifier.EventTypeRecurringDonation, event.CustomerID, time.Now().UTC(), body, "application/json")
+}
+
+// NotifyPayment posts the event as JSON, with its type in the event type header.
+func (wn *WebhookNotifier) NotifyPayment(ctx context.Context, event notifier.PaymentEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("could not marshal %s event: %v", event.Type, err)
+	}
+	return wn.post(ctx, make(http.Header), event.Type, event.Key(), time.Now().UTC(), body, "application/json")
+}
+
+// NotifyReport posts the report as it is, with its name, file name and
+// recipients in headers.
+func (wn *WebhookNotifier) NotifyReport(ctx context.Context, report notifier.Report) error {
+	header := make(http.Header)
+	header.Set(ReportNameHeader, report.Name)
+	header.Set(ReportRecipientsHeader, strings.Join(report.Recipients, ", "))
+	header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": report.Filename}))
+	return wn.post(ctx, header, notifier.EventTypeReport, report.ID, report.To, report.Body, report.ContentType)
+}
+
+// NotifyEmail posts the email as JSON.
+func (wn *WebhookNotifier) NotifyEmail(ctx context.Context, email notifier.Email) error {
+	body, err := json.Marshal(email)
+	if err != nil {
+		return fmt.Errorf("could not marshal %s event: %v", notifier.EventTypeEmail, err)
+	}
+	return wn.post(ctx, make(http.Header), notifier.EventTypeEmail, email.ID, time.Now().UTC(), body, "application/json")
+}
+
+// post sends the body of an event, wrapped in a CloudEvent if configured.
+func (wn *WebhookNotifier) post(ctx context.Context, header http.Header, eventType, subject string, at time.Time, body []byte, contentType string) error {
+	wn.mu.Lock()
+	closed := wn.closed
+	wn.mu.Unlock()
+	if closed {
+		return notifier.ErrClosed
+	}
+
+	header.Set(EventTypeHeader, eventType)
+	if id := requestid.FromContext(ctx); id != "" {
+		header.Set(requestid.Header, id)
+	}
+	if wn.cloudEvents != nil {
+		var err error
+		if body, err = wn.wrap(ctx, header, eventType, subject, at, body, contentType); err != nil {
+			return err
+		}
+	} else {
+		header.Set("Content-Type", contentType)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", wn.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header = header
+
+	start := time.Now()
+	resp, err := wn.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return fmt.Errorf("webhook responded with %s: %s", resp.Status, bytes.TrimSpace(data))
+	}
+
+	requestid.Logger(ctx, wn.log).Debug("Event posted to webhook", zap.String("event_type", eventType),
+		zap.Int("status", resp.StatusCode), zap.Duration("duration", time.Since(start)))
+	return nil
+}
+
+// wrap sets the CloudEvents headers of the request and returns its body.
+func (wn *WebhookNotifier) wrap(ctx context.Context, header http.Header, eventType, subject string, at time.Time, body []byte, contentType string) ([]byte, error) {
+	ce, err := wn.cloudEvents.NewEvent(eventType, schema.Version(ctx, eventType), subject, body, contentType)
+	if err != nil {
+		return nil, err
+	}
+	ce.Time = at
+	ce.RequestID = requestid.FromContext(ctx)
+
+	if wn.cloudEvents.Mode == cloudevents.ModeBinary {
+		header.Set("Content-Type", contentType)
+		for name, value := range ce.Attributes() {
+			header.Set("ce-"+name, value)
+		}
+		return body, nil
+	}
+
+	header.Set("Content-Type", cloudevents.ContentType)
+	return ce.Structured()
+}
+
+// render returns the payload of the message and its content type.
+func (wn *WebhookNotifier) render(msg Message) ([]byte, string, error) {
+	if wn.templates != nil {
+		if body, contentType, ok, err := wn.templates.Render(msg); ok || err != nil {
+			return body, contentType, err
+		}
+	}
+
+	body, err := json.Marshal(msg.DonationEvent)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not marshal %s event: %v", msg.Type, err)
+	}
+	return body, "application/json", nil
+}
+
+// Check checks that the endpoint responds to a HEAD request, with any
+// status. Nothing is sent.
+func (wn *WebhookNotifier) Check(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", wn.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := wn.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not reach the webhook: %v", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Close makes the notifier refuse further events and closes idle connections.
+func (wn *WebhookNotifier) Close() error {
+	wn.mu.Lock()
+	wn.closed = true
+	wn.mu.Unlock()
+	wn.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,63 @@
+package webhook
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/vedrankolka/donation-server/pkg/cloudevents"
+	"github.com/vedrankolka/donation-server/pkg/notifier"
+	"github.com/vedrankolka/donation-server/pkg/notifier/notifiertest"
+)
+
+func TestWebhookNotifier(t *testing.T) {
+	notifiertest.TestNotifier(t, func(t *testing.T) (notifier.Notifier, func() [][]byte) {
+		return newTestNotifier(t)
+	})
+}
+
+func TestWebhookNotifierCloudEvents(t *testing.T) {
+	for _, mode := range []string{cloudevents.ModeStructured, cloudevents.ModeBinary} {
+		t.Run(mode, func(t *testing.T) {
+			config, err := cloudevents.NewConfig(mode, "https://donate.example.org", "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			notifiertest.TestNotifier(t, func(t *testing.T) (notifier.Notifier, func() [][]byte) {
+				return newTestNotifier(t, WithCloudEvents(config))
+			})
+		})
+	}
+}
+
+// newTestNotifier returns a notifier of a test server recording the bodies it receives.
+func newTestNotifier(t *testing.T, opts ...Option) (*WebhookNotifier, func() [][]byte) {
+	var mu sync.Mutex
+	var bodies [][]byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		bodies = append(bodies, body)
+		mu.Unlock()
+	}))
+	t.Cleanup(server.Close)
+
+	wn, err := NewWebhookNotifier(server.URL, WithClient(server.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, opt := range opts {
+		opt(wn)
+	}
+	return wn, func() [][]byte {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([][]byte(nil), bodies...)
+	}
+}
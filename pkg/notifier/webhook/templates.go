@@ -0,0 +1,175 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/currency"
+	"github.com/vedrankolka/donation-server/pkg/notifier"
+)
+
+// templateExt is the extension of template files.
+const templateExt = ".tmpl"
+
+// Message is the data templates are executed with. The fields of the event
+// are promoted, so a template can use {{.CustomerEmail}} directly.
+type Message struct {
+	// Type of the event, e.g. "donation".
+	Type string
+	// Time the event was sent.
+	Time time.Time
+	notifier.DonationEvent
+}
+
+// Templates render payloads per event type, so receivers with a fixed schema
+// can be fed without a transformer in between.
+type Templates struct {
+	templates    map[string]*template.Template
+	contentTypes map[string]string
+}
+
+// funcs are the functions available to templates besides the builtin ones.
+var funcs = template.FuncMap{
+	// json encodes a value as JSON, e.g. {{json .CustomerName}} gives a quoted string.
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	// xml escapes a string for XML text and attributes.
+	"xml": func(s string) (string, error) {
+		var buf bytes.Buffer
+		err := xml.EscapeText(&buf, []byte(s))
+		return buf.String(), err
+	},
+	// cents gives an amount, which events have in the smallest currency
+	// unit already, as an integer, e.g. {{cents .Amount}} gives 2500.
+	"cents": func(amount float64) int64 {
+		return int64(math.Round(amount))
+	},
+	// money formats an amount in the smallest unit of the currency, e.g.
+	// {{money .Amount .Currency}} gives "25.00 EUR", or "2500 JPY".
+	"money": func(amount float64, code string) string {
+		return currency.Format(int64(math.Round(amount)), code)
+	},
+	// date formats a time with a Go layout, e.g. {{date "2006-01-02" .Time}}.
+	"date": func(layout string, t time.Time) string {
+		return t.Format(layout)
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// LoadTemplates parses the templates in the directory. Every file named
+// "<type>.<ext>.tmpl" renders events of the type, sent with the content type
+// of the extension, e.g. "donation.xml.tmpl" sends donations as XML.
+// Without an extension, e.g. "donation.tmpl", the payload is sent as JSON.
+func LoadTemplates(dir string) (*Templates, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+templateExt))
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]string, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		files[filepath.Base(path)] = string(data)
+	}
+
+	return NewTemplates(files)
+}
+
+// NewTemplates parses templates given by file name, as in LoadTemplates.
+func NewTemplates(files map[string]string) (*Templates, error) {
+	t := &Templates{
+		templates:    make(map[string]*template.Template, len(files)),
+		contentTypes: make(map[string]string, len(files)),
+	}
+
+	for name, text := range files {
+		eventType := strings.TrimSuffix(name, templateExt)
+		contentType := "application/json"
+		if ext := filepath.Ext(eventType); ext != "" {
+			eventType = strings.TrimSuffix(eventType, ext)
+			if contentType = mime.TypeByExtension(ext); contentType == "" {
+				return nil, fmt.Errorf("unknown content type of template %q", name)
+			}
+		}
+		if _, ok := t.templates[eventType]; ok {
+			return nil, fmt.Errorf("more than one template for %q events", eventType)
+		}
+
+		tmpl, err := template.New(name).Funcs(funcs).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		t.templates[eventType] = tmpl
+		t.contentTypes[eventType] = contentType
+	}
+
+	return t, nil
+}
+
+// Types returns the event types with a template.
+func (t *Templates) Types() []string {
+	types := make([]string, 0, len(t.templates))
+	for eventType := range t.templates {
+		types = append(types, eventType)
+	}
+	return types
+}
+
+// Render executes the template of the message's type. It reports false if
+// there is no template for the type.
+func (t *Templates) Render(msg Message) ([]byte, string, bool, error) {
+	tmpl, ok := t.templates[msg.Type]
+	if !ok {
+		return nil, "", false, nil
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, msg); err != nil {
+		return nil, "", true, fmt.Errorf("could not render %s event: %v", msg.Type, err)
+	}
+	return buf.Bytes(), t.contentTypes[msg.Type], true, nil
+}
+
+// sampleEvent fills every field, so Check finds templates using missing ones.
+// Amounts are in the smallest currency unit, like those of events.
+var sampleEvent = notifier.DonationEvent{
+	CustomerID:      "cus_sample",
+	CustomerName:    "Jane Doe",
+	CustomerEmail:   "jane@example.com",
+	Amount:          1220,
+	Currency:        "eur",
+	DonationAmount:  1000,
+	PurchaseAmount:  220,
+	VATAmount:       20,
+	InvoiceNumber:   "INV-0001",
+	TaxRates:        []notifier.TaxRate{{Rate: 10, Jurisdiction: "HR", Taxable: 200, Amount: 20}},
+	Message:         "For the winter appeal",
+	DisplayName:     "Jane",
+	NewsletterOptIn: true,
+}
+
+// Check renders every template with a sample event of its type.
+func (t *Templates) Check() error {
+	for eventType := range t.templates {
+		msg := Message{Type: eventType, Time: time.Now().UTC(), DonationEvent: sampleEvent}
+		if _, _, _, err := t.Render(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
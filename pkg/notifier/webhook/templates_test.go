@@ -0,0 +1,34 @@
+package webhook
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/notifier"
+)
+
+func TestTemplateAmounts(t *testing.T) {
+	templates, err := NewTemplates(map[string]string{
+		"donation.xml.tmpl": `<gift cents="{{cents .Amount}}" amount="{{money .Amount .Currency}}"/>`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		amount   float64
+		currency string
+		want     string
+	}{
+		{2500, "eur", `<gift cents="2500" amount="25.00 EUR"/>`},
+		{2500, "jpy", `<gift cents="2500" amount="2500 JPY"/>`},
+	} {
+		msg := Message{Type: notifier.EventTypeDonation, Time: time.Now(), DonationEvent: notifier.DonationEvent{Amount: tc.amount, Currency: tc.currency}}
+		body, _, _, err := templates.Render(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != tc.want {
+			t.Errorf("got %s, want %s", body, tc.want)
+		}
+	}
+}
@@ -0,0 +1,452 @@
+package oauth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/auth"
+	"github.com/vedrankolka/donation-server/pkg/requestid"
+	"github.com/vedrankolka/donation-server/pkg/store"
+	"go.uber.org/zap"
+)
+
+const (
+	// AccessTokenTTL is how long access tokens are valid.
+	AccessTokenTTL = time.Hour
+	// RefreshTokenTTL is how long refresh tokens of the authorization code grant are valid.
+	RefreshTokenTTL = 30 * 24 * time.Hour
+	// CodeTTL is how long an authorization code can be exchanged for tokens.
+	CodeTTL = 10 * time.Minute
+)
+
+// Server issues tokens for the admin API and checks them.
+type Server struct {
+	store store.OAuthStore
+	// apiKey reports whether a key is an admin API key, which approves
+	// authorization requests and is still accepted by Require.
+	apiKey func(key string) bool
+}
+
+// NewServer creates a Server of the clients in the store, approving
+// authorization requests with the admin API keys apiKey matches, e.g.
+// auth.Authenticator.MatchAPIKey.
+func NewServer(s store.OAuthStore, apiKey func(key string) bool) *Server {
+	return &Server{
+		store:  s,
+		apiKey: apiKey,
+	}
+}
+
+// NewSecret returns a random token or client secret with the prefix.
+func NewSecret(prefix string) (string, error) {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return prefix + base64.RawURLEncoding.EncodeToString(b[:]), nil
+}
+
+// Hash returns the hash of a token or secret, as it is stored.
+func Hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Require allows requests authorized with an admin API key, made by
+// auth.AdminPrincipal, or with an access token having the RequiredScope,
+// made by the token's principal. Other requests get 401 Unauthorized or
+// 403 Forbidden.
+func (s *Server) Require(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := auth.BearerToken(r)
+		if token != "" && s.apiKey(token) {
+			next(w, r.WithContext(auth.WithPrincipal(r.Context(), auth.AdminPrincipal)))
+			return
+		}
+
+		t, err := s.store.GetOAuthToken(r.Context(), Hash(token))
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			requestid.Logger(r.Context(), zap.L()).Error("Could not get OAuth token", zap.Error(err))
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if err != nil || t.Kind != store.TokenAccess {
+			requestid.Logger(r.Context(), zap.L()).Info("Unauthorized request", zap.String("path", r.URL.Path))
+			w.Header().Set("WWW-Authenticate", `Bearer realm="donation-server", error="invalid_token"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		scope := RequiredScope(r)
+		if !Allows(t.Scopes, scope) {
+			requestid.Logger(r.Context(), zap.L()).Info("Request without the required scope", zap.String("principal", t.Principal),
+				zap.String("path", r.URL.Path), zap.String("scope", scope))
+			w.Header().Set("WWW-Authenticate", `Bearer realm="donation-server", error="insufficient_scope", scope="`+scope+`"`)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		next(w, r.WithContext(auth.WithPrincipal(r.Context(), t.Principal)))
+	}
+}
+
+// tokenResponse is the response of the token endpoint.
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope"`
+}
+
+// Error is an OAuth error response.
+type Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+	status      int
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+func writeError(w http.ResponseWriter, err *Error) {
+	if err.Code == "invalid_client" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="donation-server"`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(err.status)
+	json.NewEncoder(w).Encode(err)
+}
+
+// HandleToken is the token endpoint, POST /oauth/token. Clients authenticate
+// with HTTP Basic or the client_id and client_secret parameters.
+func (s *Server) HandleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	client, oerr := s.authenticate(r)
+	if oerr != nil {
+		writeError(w, oerr)
+		return
+	}
+
+	var resp *tokenResponse
+	switch grant := r.PostForm.Get("grant_type"); grant {
+	case "client_credentials":
+		resp, oerr = s.clientCredentials(r, client)
+	case "authorization_code":
+		resp, oerr = s.authorizationCode(r, client)
+	case "refresh_token":
+		resp, oerr = s.refreshToken(r, client)
+	default:
+		oerr = &Error{"unsupported_grant_type", "grant_type must be client_credentials, authorization_code or refresh_token", http.StatusBadRequest}
+	}
+	if oerr != nil {
+		writeError(w, oerr)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// authenticate returns the client of the request, parsing its form.
+func (s *Server) authenticate(r *http.Request) (*store.OAuthClient, *Error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, &Error{"invalid_request", err.Error(), http.StatusBadRequest}
+	}
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	client, err := s.store.GetOAuthClient(r.Context(), id)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		requestid.Logger(r.Context(), zap.L()).Error("Could not get OAuth client", zap.String("client", id), zap.Error(err))
+		return nil, &Error{"server_error", "", http.StatusInternalServerError}
+	}
+	if err != nil || subtle.ConstantTimeCompare([]byte(Hash(secret)), []byte(client.SecretHash)) != 1 {
+		return nil, &Error{"invalid_client", "unknown client or wrong secret", http.StatusUnauthorized}
+	}
+	return client, nil
+}
+
+func (s *Server) clientCredentials(r *http.Request, client *store.OAuthClient) (*tokenResponse, *Error) {
+	scopes, oerr := grantedScopes(client, r.PostForm.Get("scope"))
+	if oerr != nil {
+		return nil, oerr
+	}
+	return s.issue(r, client, scopes, "client:"+client.ID, "", false)
+}
+
+func (s *Server) authorizationCode(r *http.Request, client *store.OAuthClient) (*tokenResponse, *Error) {
+	code, oerr := s.take(r, r.PostForm.Get("code"), store.TokenCode, client)
+	if oerr != nil {
+		return nil, oerr
+	}
+	if code.RedirectURI != r.PostForm.Get("redirect_uri") {
+		return nil, &Error{"invalid_grant", "redirect_uri does not match the authorization request", http.StatusBadRequest}
+	}
+	if code.CodeChallenge != "" {
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(sum[:]) != code.CodeChallenge {
+			return nil, &Error{"invalid_grant", "code_verifier does not match the code_challenge", http.StatusBadRequest}
+		}
+	}
+	return s.issue(r, client, code.Scopes, code.Principal, code.Grant, true)
+}
+
+func (s *Server) refreshToken(r *http.Request, client *store.OAuthClient) (*tokenResponse, *Error) {
+	refresh, oerr := s.take(r, r.PostForm.Get("refresh_token"), store.TokenRefresh, client)
+	if oerr != nil {
+		return nil, oerr
+	}
+	return s.issue(r, client, refresh.Scopes, refresh.Principal, refresh.Grant, true)
+}
+
+// take uses up and returns a code or refresh token of the client, which can
+// only be used once. Using one again revokes the tokens issued from its
+// authorization code, as it may have been stolen (RFC 6749, 4.1.2 and 10.4).
+func (s *Server) take(r *http.Request, secret, kind string, client *store.OAuthClient) (*store.OAuthToken, *Error) {
+	invalid := &Error{"invalid_grant", "the " + kind + " is invalid, expired or used", http.StatusBadRequest}
+	t, err := s.store.TakeOAuthToken(r.Context(), Hash(secret))
+	if errors.Is(err, store.ErrUsed) && t.Kind == kind && t.ClientID == client.ID {
+		requestid.Logger(r.Context(), zap.L()).Warn("OAuth token used again, revoking the tokens of its grant", zap.String("kind", kind), zap.String("client", client.ID))
+		if err := s.store.RevokeOAuthGrant(r.Context(), t.Grant); err != nil {
+			requestid.Logger(r.Context(), zap.L()).Error("Could not revoke OAuth tokens", zap.Error(err))
+			return nil, &Error{"server_error", "", http.StatusInternalServerError}
+		}
+		return nil, invalid
+	}
+	if err != nil && !errors.Is(err, store.ErrNotFound) && !errors.Is(err, store.ErrUsed) {
+		requestid.Logger(r.Context(), zap.L()).Error("Could not take OAuth token", zap.Error(err))
+		return nil, &Error{"server_error", "", http.StatusInternalServerError}
+	}
+	if err != nil || t.Kind != kind || t.ClientID != client.ID {
+		return nil, invalid
+	}
+	return t, nil
+}
+
+// issue saves a new access token, and a refresh token if asked, of the grant
+// (see store.OAuthToken.Grant) and returns them.
+func (s *Server) issue(r *http.Request, client *store.OAuthClient, scopes []string, principal, grant string, refresh bool) (*tokenResponse, *Error) {
+	resp := &tokenResponse{
+		TokenType: "Bearer",
+		ExpiresIn: int(AccessTokenTTL / time.Second),
+		Scope:     strings.Join(scopes, " "),
+	}
+
+	fill := func(t *store.OAuthToken) { t.Grant = grant }
+	var err error
+	if resp.AccessToken, err = s.save(r, store.TokenAccess, client, scopes, principal, AccessTokenTTL, fill); err == nil && refresh {
+		resp.RefreshToken, err = s.save(r, store.TokenRefresh, client, scopes, principal, RefreshTokenTTL, fill)
+	}
+	if err != nil {
+		requestid.Logger(r.Context(), zap.L()).Error("Could not issue OAuth token", zap.Error(err))
+		return nil, &Error{"server_error", "", http.StatusInternalServerError}
+	}
+	return resp, nil
+}
+
+// save creates and stores a token, completed by fill if it is not nil, and returns its secret.
+func (s *Server) save(r *http.Request, kind string, client *store.OAuthClient, scopes []string, principal string, ttl time.Duration, fill func(*store.OAuthToken)) (string, error) {
+	prefix := map[string]string{store.TokenAccess: "at_", store.TokenRefresh: "rt_", store.TokenCode: "ac_"}[kind]
+	secret, err := NewSecret(prefix)
+	if err != nil {
+		return "", err
+	}
+
+	t := &store.OAuthToken{
+		Hash:      Hash(secret),
+		Kind:      kind,
+		ClientID:  client.ID,
+		Scopes:    scopes,
+		Principal: principal,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	if fill != nil {
+		fill(t)
+	}
+	return secret, s.store.SaveOAuthToken(r.Context(), t)
+}
+
+// grantedScopes returns the requested scopes, or all of the client's if none
+// are requested, refusing scopes the client does not have.
+func grantedScopes(client *store.OAuthClient, requested string) ([]string, *Error) {
+	if strings.TrimSpace(requested) == "" {
+		return client.Scopes, nil
+	}
+	scopes, err := ParseScopes(requested)
+	if err != nil {
+		return nil, &Error{"invalid_scope", err.Error(), http.StatusBadRequest}
+	}
+	for _, scope := range scopes {
+		if !Allows(client.Scopes, scope) {
+			return nil, &Error{"invalid_scope", "the client does not have the scope " + scope, http.StatusBadRequest}
+		}
+	}
+	return scopes, nil
+}
+
+// HandleRevoke revokes an access or refresh token of the client, POST /oauth/revoke (RFC 7009).
+func (s *Server) HandleRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	client, oerr := s.authenticate(r)
+	if oerr != nil {
+		writeError(w, oerr)
+		return
+	}
+
+	hash := Hash(r.PostForm.Get("token"))
+	t, err := s.store.GetOAuthToken(r.Context(), hash)
+	if err == nil && t.ClientID == client.ID {
+		err = s.store.DeleteOAuthToken(r.Context(), hash)
+	}
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		requestid.Logger(r.Context(), zap.L()).Error("Could not revoke OAuth token", zap.Error(err))
+		writeError(w, &Error{"server_error", "", http.StatusInternalServerError})
+		return
+	}
+	// Unknown tokens are not an error, so clients cannot probe for tokens.
+	w.WriteHeader(http.StatusOK)
+}
+
+var consentPage = template.Must(template.New("consent").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Authorize {{.Client.Name}}</title></head>
+<body>
+<h1>Authorize {{.Client.Name}}</h1>
+<p>{{.Client.Name}} asks for access to the donation server's admin API with the scopes:</p>
+<ul>{{range .Scopes}}<li><code>{{.}}</code></li>{{end}}</ul>
+{{if .Error}}<p><strong>{{.Error}}</strong></p>{{end}}
+<form method="post">
+{{range $name, $values := .Params}}{{range $values}}<input type="hidden" name="{{$name}}" value="{{.}}">{{end}}{{end}}
+<label>Admin API key <input type="password" name="api_key" autocomplete="off"></label>
+<button type="submit" name="decision" value="allow">Allow</button>
+<button type="submit" name="decision" value="deny">Deny</button>
+</form>
+</body>
+</html>
+`))
+
+// HandleAuthorize is the authorization endpoint of the authorization code
+// grant, /oauth/authorize. An admin approves the request on a consent page
+// with the admin API key and is redirected back to the client with a code.
+func (s *Server) HandleAuthorize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	params := r.Form
+
+	// Without a valid client and redirect URI there is nowhere to redirect errors to.
+	client, err := s.store.GetOAuthClient(r.Context(), params.Get("client_id"))
+	if err != nil {
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+		return
+	}
+	redirectURI := params.Get("redirect_uri")
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+	if !contains(client.RedirectURIs, redirectURI) {
+		http.Error(w, "redirect_uri is not registered for the client", http.StatusBadRequest)
+		return
+	}
+
+	redirect := func(values url.Values) {
+		u, _ := url.Parse(redirectURI)
+		q := u.Query()
+		for name := range values {
+			q.Set(name, values.Get(name))
+		}
+		if state := params.Get("state"); state != "" {
+			q.Set("state", state)
+		}
+		u.RawQuery = q.Encode()
+		http.Redirect(w, r, u.String(), http.StatusFound)
+	}
+	fail := func(code, description string) {
+		redirect(url.Values{"error": {code}, "error_description": {description}})
+	}
+
+	if params.Get("response_type") != "code" {
+		fail("unsupported_response_type", "response_type must be code")
+		return
+	}
+	if method := params.Get("code_challenge_method"); params.Get("code_challenge") != "" && method != "S256" {
+		fail("invalid_request", "code_challenge_method must be S256")
+		return
+	}
+	scopes, oerr := grantedScopes(client, params.Get("scope"))
+	if oerr != nil {
+		fail(oerr.Code, oerr.Description)
+		return
+	}
+
+	page := struct {
+		Client *store.OAuthClient
+		Scopes []string
+		Params url.Values
+		Error  string
+	}{client, scopes, url.Values{}, ""}
+	for _, name := range []string{"response_type", "client_id", "redirect_uri", "scope", "state", "code_challenge", "code_challenge_method"} {
+		if value := params.Get(name); value != "" {
+			page.Params.Set(name, value)
+		}
+	}
+
+	if r.Method == "POST" {
+		if r.PostForm.Get("decision") != "allow" {
+			fail("access_denied", "the admin denied the request")
+			return
+		}
+		if !s.apiKey(r.PostForm.Get("api_key")) {
+			page.Error = "Wrong admin API key."
+		} else {
+			code, err := s.save(r, store.TokenCode, client, scopes, auth.AdminPrincipal+"+client:"+client.ID, CodeTTL, func(t *store.OAuthToken) {
+				t.RedirectURI = params.Get("redirect_uri")
+				t.CodeChallenge = params.Get("code_challenge")
+				t.Grant = t.Hash
+			})
+			if err != nil {
+				requestid.Logger(r.Context(), zap.L()).Error("Could not issue OAuth code", zap.Error(err))
+				fail("server_error", "")
+				return
+			}
+			redirect(url.Values{"code": {code}})
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	if err := consentPage.Execute(w, page); err != nil {
+		requestid.Logger(r.Context(), zap.L()).Error("Could not render the OAuth consent page", zap.Error(err))
+	}
+}
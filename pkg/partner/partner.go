@@ -0,0 +1,192 @@
+// Package partner authenticates the API keys of partner websites embedding
+// the widget, enforcing their allowed origins, rate limits and quotas, so
+// their donations can be attributed to them.
+package partner
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/requestid"
+	"github.com/vedrankolka/donation-server/pkg/store"
+)
+
+const (
+	// KeyParam is the query parameter of a partner's API key, as sent by the widget.
+	KeyParam = "partner_key"
+	// KeyHeader holds a partner's API key on requests of its servers.
+	KeyHeader = "X-Partner-Key"
+	// KeyPrefix starts every partner API key.
+	KeyPrefix = "pk_partner_"
+)
+
+// NewKey returns a new API key.
+func NewKey() (string, error) {
+	var b [24]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return KeyPrefix + base64.RawURLEncoding.EncodeToString(b[:]), nil
+}
+
+// Hash returns the hash of an API key, as it is stored.
+func Hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+type partnerKey struct{}
+
+// WithID returns a context of a request made with the API key of the partner.
+func WithID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, partnerKey{}, id)
+}
+
+// ID returns the ID of the partner whose API key the request of the context
+// was made with, or "" if it was made without one.
+func ID(ctx context.Context) string {
+	id, _ := ctx.Value(partnerKey{}).(string)
+	return id
+}
+
+// usage counts the requests of a partner in the current minute and day.
+type usage struct {
+	minute   time.Time
+	requests int
+	day      time.Time
+	daily    int
+}
+
+// Gate checks partner API keys and counts their usage. Usage is kept in
+// memory, so every instance of the server enforces the limits on its own.
+type Gate struct {
+	partners store.PartnerStore
+	mu       sync.Mutex
+	usage    map[string]*usage
+}
+
+// NewGate creates a Gate of the partners in the store.
+func NewGate(partners store.PartnerStore) *Gate {
+	return &Gate{
+		partners: partners,
+		usage:    make(map[string]*usage),
+	}
+}
+
+// Middleware lets requests without a partner key through as they are. With
+// a key, the partner must exist and be enabled (401 Unauthorized), the
+// request must come from one of its origins if it has any, by its Origin or
+// Referer header, which must be set then (403 Forbidden), and within its
+// rate limit and daily quota (429 Too Many Requests with Retry-After).
+// The handler gets the partner's ID from ID.
+func (g *Gate) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(KeyHeader)
+		if key == "" {
+			key = r.URL.Query().Get(KeyParam)
+		}
+		if key == "" {
+			next(w, r)
+			return
+		}
+
+		p, err := g.partners.GetPartnerByKey(r.Context(), Hash(key))
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			requestid.Printf(r.Context(), "Could not get partner: %v\n", err)
+			writeError(w, "Could not check the partner key", http.StatusInternalServerError)
+			return
+		}
+		if err != nil || p.Disabled {
+			writeError(w, "unknown or disabled partner key", http.StatusUnauthorized)
+			return
+		}
+		if origin := requestOrigin(r); len(p.Origins) > 0 && !contains(p.Origins, origin) {
+			requestid.Printf(r.Context(), "Partner %s used from %q\n", p.ID, origin)
+			if origin == "" {
+				writeError(w, "the partner key requires an Origin or Referer header", http.StatusForbidden)
+			} else {
+				writeError(w, "the partner key is not allowed on "+origin, http.StatusForbidden)
+			}
+			return
+		}
+		if retryAfter, message := g.count(p, time.Now().UTC()); retryAfter > 0 {
+			requestid.Printf(r.Context(), "Partner %s is over its limits: %s\n", p.ID, message)
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds()+0.5)))
+			writeError(w, message, http.StatusTooManyRequests)
+			return
+		}
+
+		next(w, r.WithContext(WithID(r.Context(), p.ID)))
+	}
+}
+
+// count counts a request of the partner, or returns how long to wait if it
+// is over the rate limit or the daily quota.
+func (g *Gate) count(p *store.Partner, now time.Time) (time.Duration, string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	u, ok := g.usage[p.ID]
+	if !ok {
+		u = &usage{}
+		g.usage[p.ID] = u
+	}
+	minute := now.Truncate(time.Minute)
+	if !u.minute.Equal(minute) {
+		u.minute, u.requests = minute, 0
+	}
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if !u.day.Equal(day) {
+		u.day, u.daily = day, 0
+	}
+
+	if p.DailyQuota > 0 && u.daily >= p.DailyQuota {
+		return day.AddDate(0, 0, 1).Sub(now), fmt.Sprintf("the daily quota of %d requests is used up", p.DailyQuota)
+	}
+	if p.RateLimit > 0 && u.requests >= p.RateLimit {
+		return minute.Add(time.Minute).Sub(now), fmt.Sprintf("the rate limit of %d requests per minute is exceeded", p.RateLimit)
+	}
+	u.requests++
+	u.daily++
+	return 0, ""
+}
+
+// requestOrigin returns the origin of the page a request was made from, by
+// its Origin header or else its Referer, or "" if it has neither. Keys are
+// public in the pages embedding the widget, so requests without either
+// cannot use the keys of partners with origins, and their quotas.
+func requestOrigin(r *http.Request) string {
+	if origin := r.Header.Get("Origin"); origin != "" && origin != "null" {
+		return origin
+	}
+	referer, err := url.Parse(r.Header.Get("Referer"))
+	if err != nil || referer.Scheme == "" || referer.Host == "" {
+		return ""
+	}
+	return referer.Scheme + "://" + referer.Host
+}
+
+func writeError(w http.ResponseWriter, message string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, "{\"error\":%q}\n", message)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,513 @@
+// Package fake is a payment provider simulating Stripe without it, for
+// demos, workshops and load tests. Every payment intent succeeds, or is
+// declined, on its own after a delay: the provider delivers the signed
+// charge.succeeded or payment_intent.payment_failed webhook to the server,
+// which handles it like one of Stripe. Refunds deliver charge.refunded.
+//
+// Outcomes and IDs are drawn from a seeded source, so the same requests in
+// the same order give the same donations.
+package fake
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/fixtures"
+	"github.com/vedrankolka/donation-server/pkg/payments"
+)
+
+// DefaultDelay is how long after an intent is created its webhook is delivered.
+const DefaultDelay = 3 * time.Second
+
+// WebhookSecret is the signing secret of the webhooks if none is given.
+const WebhookSecret = "whsec_fake"
+
+// DeclineCodes are the reasons of declined payments, drawn at random.
+var DeclineCodes = []string{"insufficient_funds", "generic_decline", "expired_card", "incorrect_cvc"}
+
+// donors are the names of the donors of intents without a receipt email.
+var donors = []string{"Ana Horvat", "Ivo Kovač", "Maja Babić", "Luka Novak", "Petra Jurić", "Marko Knežević"}
+
+// ErrUnavailable is returned by the calls failed by the error rate.
+var ErrUnavailable = errors.New("fake: the payment provider is unavailable")
+
+// Provider is a payments.Provider keeping customers and payments in memory.
+type Provider struct {
+	webhookURL    string
+	webhookSecret string
+	delay         time.Duration
+	declineRate   float64
+	errorRate     float64
+	client        *http.Client
+	// verifier verifies and decodes the webhooks, which are Stripe's.
+	verifier *payments.Stripe
+
+	// mu guards the fields below.
+	mu        sync.Mutex
+	rand      *rand.Rand
+	customers map[string]*payments.Customer
+	// intents by idempotency key, and charges by ID.
+	intents map[string]*payments.Intent
+	charges map[string]*fixtures.Charge
+	refunds map[string]*payments.Refund
+	// readers by ID, and the in-person intents waiting for one by ID.
+	readers  map[string]*payments.Reader
+	inPerson map[string]*payments.IntentParams
+	// pending are the webhooks to deliver, in the order they are due.
+	pending []delivery
+	wake    chan struct{}
+}
+
+// delivery is a webhook to deliver.
+type delivery struct {
+	at      time.Time
+	payload []byte
+}
+
+// Option configures a Provider.
+type Option func(*Provider)
+
+// WithDelay delivers the webhook of an intent after the delay instead of DefaultDelay.
+func WithDelay(delay time.Duration) Option {
+	return func(p *Provider) {
+		p.delay = delay
+	}
+}
+
+// WithDeclineRate declines the rate of payments, between 0 and 1, with one of DeclineCodes.
+func WithDeclineRate(rate float64) Option {
+	return func(p *Provider) {
+		p.declineRate = rate
+	}
+}
+
+// WithErrorRate fails the rate of calls, between 0 and 1, with ErrUnavailable,
+// as if the provider was down.
+func WithErrorRate(rate float64) Option {
+	return func(p *Provider) {
+		p.errorRate = rate
+	}
+}
+
+// WithSeed seeds the outcomes and IDs, 1 by default.
+func WithSeed(seed int64) Option {
+	return func(p *Provider) {
+		p.rand = rand.New(rand.NewSource(seed))
+	}
+}
+
+// New creates a Provider delivering webhooks signed with the secret, or
+// WebhookSecret if it is empty, to the URL of the server's webhook. Webhooks
+// are only delivered while Run runs.
+func New(webhookURL, webhookSecret string, opts ...Option) *Provider {
+	if webhookSecret == "" {
+		webhookSecret = WebhookSecret
+	}
+	p := &Provider{
+		webhookURL:    webhookURL,
+		webhookSecret: webhookSecret,
+		delay:         DefaultDelay,
+		client:        &http.Client{Timeout: payments.DefaultTimeout},
+		verifier:      payments.NewStripe("", webhookSecret),
+		rand:          rand.New(rand.NewSource(1)),
+		customers:     make(map[string]*payments.Customer),
+		intents:       make(map[string]*payments.Intent),
+		charges:       make(map[string]*fixtures.Charge),
+		refunds:       make(map[string]*payments.Refund),
+		readers:       make(map[string]*payments.Reader),
+		inPerson:      make(map[string]*payments.IntentParams),
+		wake:          make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// newID returns an ID with the prefix of a Stripe object, e.g. "pi".
+// p.mu must be held.
+func (p *Provider) newID(prefix string) string {
+	b := make([]byte, 12)
+	p.rand.Read(b)
+	return prefix + "_fake_" + hex.EncodeToString(b)
+}
+
+// fail reports whether the call fails by the error rate. p.mu must be held.
+func (p *Provider) fail() bool {
+	return p.errorRate > 0 && p.rand.Float64() < p.errorRate
+}
+
+// schedule queues the webhook of the payload to be delivered after the
+// delay. p.mu must be held.
+func (p *Provider) schedule(payload []byte) {
+	p.pending = append(p.pending, delivery{at: time.Now().Add(p.delay), payload: payload})
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// CreateIntent creates an intent, which succeeds or is declined after the
+// delay. The receipt email is the donor's, a demo donor pays otherwise.
+// In-person intents wait until they are handed to a reader, see ProcessPayment.
+func (p *Provider) CreateIntent(ctx context.Context, params *payments.IntentParams) (*payments.Intent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if intent, ok := p.intents[params.IdempotencyKey]; ok && params.IdempotencyKey != "" {
+		return intent, nil
+	}
+	if p.fail() {
+		return nil, ErrUnavailable
+	}
+
+	intent := &payments.Intent{ID: p.newID("pi")}
+	intent.ClientSecret = intent.ID + "_secret_" + p.newID("cs")[len("cs_fake_"):]
+	if params.IdempotencyKey != "" {
+		p.intents[params.IdempotencyKey] = intent
+	}
+	if len(params.PaymentMethodTypes) == 1 && params.PaymentMethodTypes[0] == payments.PaymentMethodCardPresent {
+		p.inPerson[intent.ID] = params
+		return intent, nil
+	}
+	p.pay(intent.ID, params.Amount, params.Currency, params.ReceiptEmail, params.Metadata)
+	return intent, nil
+}
+
+// pay schedules the webhook of the payment of an intent, succeeded or
+// declined. p.mu must be held.
+func (p *Provider) pay(intentID string, amount int64, currency, email string, metadata map[string]string) {
+	name := donors[p.rand.Intn(len(donors))]
+	if email == "" {
+		email = strings.ToLower(strings.Replace(name, " ", ".", 1)) + "@example.com"
+	}
+	opts := []fixtures.Option{
+		fixtures.ID(p.newID("ch")),
+		fixtures.PaymentIntent(intentID),
+		fixtures.Amount(amount, strings.ToLower(currency)),
+		fixtures.Donor(name, email),
+	}
+	for key, value := range metadata {
+		opts = append(opts, fixtures.Metadata(key, value))
+	}
+
+	if p.declineRate > 0 && p.rand.Float64() < p.declineRate {
+		p.schedule(fixtures.PaymentFailed(DeclineCodes[p.rand.Intn(len(DeclineCodes))], opts...))
+		return
+	}
+	charge := fixtures.NewCharge(opts...)
+	p.charges[charge.ID] = charge
+	p.schedule(fixtures.ChargeSucceeded(opts...))
+}
+
+// VerifyWebhook verifies the signature of a webhook of the provider, like Stripe's.
+func (p *Provider) VerifyWebhook(ctx context.Context, payload []byte, header http.Header) (*payments.Event, error) {
+	return p.verifier.VerifyWebhook(ctx, payload, header)
+}
+
+func (p *Provider) GetCustomer(ctx context.Context, id string) (*payments.Customer, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.fail() {
+		return nil, ErrUnavailable
+	}
+	c, ok := p.customers[id]
+	if !ok {
+		return nil, &payments.Error{Type: payments.ErrorTypeInvalidRequest, Code: "resource_missing", Param: "id",
+			Message: fmt.Sprintf("No such customer: '%s'", id)}
+	}
+	return copyCustomer(c), nil
+}
+
+func (p *Provider) FindCustomers(ctx context.Context, email string) ([]*payments.Customer, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.fail() {
+		return nil, ErrUnavailable
+	}
+	var found []*payments.Customer
+	for _, c := range p.customers {
+		if c.Email == email {
+			found = append(found, copyCustomer(c))
+		}
+	}
+	return found, nil
+}
+
+func (p *Provider) CreateCustomer(ctx context.Context, params *payments.CustomerParams) (*payments.Customer, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.fail() {
+		return nil, ErrUnavailable
+	}
+	c := &payments.Customer{ID: p.newID("cus"), Metadata: make(map[string]string)}
+	update(c, params)
+	p.customers[c.ID] = c
+	return copyCustomer(c), nil
+}
+
+func (p *Provider) UpdateCustomer(ctx context.Context, id string, params *payments.CustomerParams) (*payments.Customer, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.fail() {
+		return nil, ErrUnavailable
+	}
+	c, ok := p.customers[id]
+	if !ok {
+		return nil, &payments.Error{Type: payments.ErrorTypeInvalidRequest, Code: "resource_missing", Param: "id",
+			Message: fmt.Sprintf("No such customer: '%s'", id)}
+	}
+	update(c, params)
+	return copyCustomer(c), nil
+}
+
+// UpdatePaymentMetadata sets the metadata of a charge. Webhooks delivered
+// already are not changed.
+func (p *Provider) UpdatePaymentMetadata(ctx context.Context, id string, metadata map[string]string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.fail() {
+		return ErrUnavailable
+	}
+	charge, ok := p.charges[id]
+	if !ok {
+		return &payments.Error{Type: payments.ErrorTypeInvalidRequest, Code: "resource_missing", Param: "id",
+			Message: fmt.Sprintf("No such charge: '%s'", id)}
+	}
+	for key, value := range metadata {
+		fixtures.Metadata(key, value)(charge)
+	}
+	return nil
+}
+
+// Refund refunds a charge, and delivers charge.refunded after the delay.
+func (p *Provider) Refund(ctx context.Context, params *payments.RefundParams) (*payments.Refund, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if refund, ok := p.refunds[params.PaymentID]; ok {
+		return refund, nil
+	}
+	if p.fail() {
+		return nil, ErrUnavailable
+	}
+	charge, ok := p.charges[params.PaymentID]
+	if !ok {
+		return nil, &payments.Error{Type: payments.ErrorTypeInvalidRequest, Code: "resource_missing", Param: "charge",
+			Message: fmt.Sprintf("No such charge: '%s'", params.PaymentID)}
+	}
+
+	refund := &payments.Refund{ID: p.newID("re"), Status: "succeeded"}
+	p.refunds[charge.ID] = refund
+	opts := []fixtures.Option{
+		fixtures.ID(charge.ID),
+		fixtures.PaymentIntent(charge.PaymentIntentID),
+		fixtures.Amount(charge.Amount, charge.Currency),
+		fixtures.Donor(charge.Name, charge.Email),
+		fixtures.Created(charge.Created),
+	}
+	for key, value := range charge.Metadata {
+		opts = append(opts, fixtures.Metadata(key, value))
+	}
+	p.schedule(fixtures.ChargeRefunded(params.Reason, opts...))
+	return refund, nil
+}
+
+// CreateSubscription is not simulated, recurring donations need Stripe.
+func (p *Provider) CreateSubscription(ctx context.Context, params *payments.SubscriptionParams) (*payments.Subscription, error) {
+	return nil, &payments.Error{Type: payments.ErrorTypeInvalidRequest, Message: "recurring donations are not simulated by the fake payment provider"}
+}
+
+// CreateCheckoutSession creates a session whose page is the success URL, as
+// if the donor paid right away, and pays it like an intent.
+func (p *Provider) CreateCheckoutSession(ctx context.Context, params *payments.CheckoutParams) (*payments.CheckoutSession, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.fail() {
+		return nil, ErrUnavailable
+	}
+
+	session := &payments.CheckoutSession{ID: p.newID("cs")}
+	session.URL = strings.ReplaceAll(params.SuccessURL, "{CHECKOUT_SESSION_ID}", session.ID)
+	p.pay(p.newID("pi"), params.Amount, params.Currency, params.CustomerEmail, params.Metadata)
+	return session, nil
+}
+
+// CreatePaymentLink creates a link to its redirect URL, or to a page that
+// does not exist, and pays it once like an intent, as if a donor opened it
+// right away. Donors choosing the amount give between 5 and 100 units.
+// Recurring links are not simulated.
+func (p *Provider) CreatePaymentLink(ctx context.Context, params *payments.PaymentLinkParams) (*payments.PaymentLink, error) {
+	if params.PriceID != "" {
+		return nil, &payments.Error{Type: payments.ErrorTypeInvalidRequest, Message: "recurring donations are not simulated by the fake payment provider"}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.fail() {
+		return nil, ErrUnavailable
+	}
+
+	link := &payments.PaymentLink{ID: p.newID("plink")}
+	link.URL = params.RedirectURL
+	if link.URL == "" {
+		link.URL = "https://pay.fake.invalid/" + link.ID
+	}
+	amount := params.Amount
+	if amount == 0 {
+		amount = int64(5+p.rand.Intn(96)) * 100
+	}
+	p.pay(p.newID("pi"), amount, params.Currency, "", params.Metadata)
+	return link, nil
+}
+
+// CreateConnectionToken returns a token no terminal SDK can connect with.
+func (p *Provider) CreateConnectionToken(ctx context.Context, location string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.fail() {
+		return "", ErrUnavailable
+	}
+	return p.newID("pst"), nil
+}
+
+// RegisterReader registers a simulated reader with any registration code.
+func (p *Provider) RegisterReader(ctx context.Context, params *payments.ReaderParams) (*payments.Reader, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.fail() {
+		return nil, ErrUnavailable
+	}
+	reader := &payments.Reader{ID: p.newID("tmr"), Label: params.Label, Location: params.Location,
+		DeviceType: "simulated_wisepos_e", Status: "online"}
+	if reader.Label == "" {
+		reader.Label = params.RegistrationCode
+	}
+	p.readers[reader.ID] = reader
+	return reader, nil
+}
+
+// ProcessPayment pays an in-person intent like an online one, as if the
+// donor presented a card right away. In-person intents are only paid this way.
+func (p *Provider) ProcessPayment(ctx context.Context, readerID, intentID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.fail() {
+		return ErrUnavailable
+	}
+	if _, ok := p.readers[readerID]; !ok {
+		return &payments.Error{Type: payments.ErrorTypeInvalidRequest, Code: "resource_missing", Param: "reader",
+			Message: fmt.Sprintf("No such terminal.reader: '%s'", readerID)}
+	}
+	params, ok := p.inPerson[intentID]
+	if !ok {
+		return &payments.Error{Type: payments.ErrorTypeInvalidRequest, Code: "resource_missing", Param: "payment_intent",
+			Message: fmt.Sprintf("No such in-person payment_intent: '%s'", intentID)}
+	}
+	delete(p.inPerson, intentID)
+	p.pay(intentID, params.Amount, params.Currency, params.ReceiptEmail, params.Metadata)
+	return nil
+}
+
+// Run delivers the webhooks when they are due until the context is done.
+// Webhooks that are not delivered by then are dropped.
+func (p *Provider) Run(ctx context.Context) {
+	var inFlight sync.WaitGroup
+	defer inFlight.Wait()
+	for {
+		p.mu.Lock()
+		var next delivery
+		if len(p.pending) > 0 {
+			next = p.pending[0]
+		}
+		p.mu.Unlock()
+
+		if next.payload == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-p.wake:
+				continue
+			}
+		}
+		timer := time.NewTimer(time.Until(next.at))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		p.mu.Lock()
+		d := p.pending[0]
+		p.pending = p.pending[1:]
+		p.mu.Unlock()
+		inFlight.Add(1)
+		go func() {
+			defer inFlight.Done()
+			if err := p.deliver(ctx, d.payload); err != nil {
+				log.Printf("[FAKE] Could not deliver webhook: %v\n", err)
+			}
+		}()
+	}
+}
+
+// deliver posts a webhook to the server, signed like Stripe signs it.
+func (p *Provider) deliver(ctx context.Context, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", p.webhookURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set(payments.SignatureHeader, fixtures.Signature(payload, p.webhookSecret, time.Now()))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("the webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// update sets the fields of the customer given in the params.
+func update(c *payments.Customer, params *payments.CustomerParams) {
+	if params.Name != "" {
+		c.Name = params.Name
+	}
+	if params.Email != "" {
+		c.Email = params.Email
+	}
+	if params.Address != nil {
+		c.Address = *params.Address
+	}
+	for key, value := range params.Metadata {
+		c.Metadata[key] = value
+	}
+}
+
+func copyCustomer(c *payments.Customer) *payments.Customer {
+	cp := *c
+	cp.Metadata = make(map[string]string, len(c.Metadata))
+	for key, value := range c.Metadata {
+		cp.Metadata[key] = value
+	}
+	return &cp
+}
@@ -0,0 +1,119 @@
+package fake
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/payments"
+)
+
+// newWebhook returns a provider delivering to a server that verifies the
+// webhooks with it, and the channel of the events it received.
+func newWebhook(t *testing.T, opts ...Option) (*Provider, <-chan *payments.Event) {
+	t.Helper()
+	events := make(chan *payments.Event, 10)
+	var p *Provider
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, _ := io.ReadAll(r.Body)
+		event, err := p.VerifyWebhook(r.Context(), payload, r.Header)
+		if err != nil {
+			t.Errorf("VerifyWebhook: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		events <- event
+	}))
+	t.Cleanup(server.Close)
+
+	p = New(server.URL, "", append([]Option{WithDelay(10 * time.Millisecond)}, opts...)...)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return p, events
+}
+
+func receive(t *testing.T, events <-chan *payments.Event) *payments.Event {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no webhook was delivered")
+		return nil
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	p, events := newWebhook(t)
+	ctx := context.Background()
+	intent, err := p.CreateIntent(ctx, &payments.IntentParams{Amount: 2500, Currency: "EUR", ReceiptEmail: "ana@example.org",
+		Metadata: map[string]string{"campaign": "winter"}, IdempotencyKey: "key_1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := p.CreateIntent(ctx, &payments.IntentParams{Amount: 2500, Currency: "EUR", IdempotencyKey: "key_1"}); again.ID != intent.ID {
+		t.Errorf("the retried intent is %s, want %s", again.ID, intent.ID)
+	}
+
+	event := receive(t, events)
+	if event.Type != "charge.succeeded" || event.Charge.PaymentIntentID != intent.ID || event.Charge.Amount != 2500 ||
+		event.Charge.Currency != "eur" || event.Charge.BillingDetails.Email != "ana@example.org" || event.Charge.Metadata["campaign"] != "winter" {
+		t.Fatalf("unexpected event %s %+v", event.Type, event.Charge)
+	}
+
+	if _, err := p.Refund(ctx, &payments.RefundParams{PaymentID: event.Charge.ID, Reason: payments.RefundReasonDuplicate}); err != nil {
+		t.Fatal(err)
+	}
+	refunded := receive(t, events)
+	if refunded.Type != "charge.refunded" || refunded.Charge.ID != event.Charge.ID || !refunded.Charge.Refunded || refunded.Charge.RefundReason != payments.RefundReasonDuplicate {
+		t.Errorf("unexpected event %s %+v", refunded.Type, refunded.Charge)
+	}
+}
+
+func TestDeclined(t *testing.T) {
+	p, events := newWebhook(t, WithDeclineRate(1))
+	intent, err := p.CreateIntent(context.Background(), &payments.IntentParams{Amount: 1000, Currency: "eur"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := receive(t, events)
+	if event.Type != "payment_intent.payment_failed" || event.PaymentIntent.ID != intent.ID || event.PaymentIntent.FailureCode == "" {
+		t.Errorf("unexpected event %s %+v", event.Type, event.PaymentIntent)
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	ids := func(seed int64) []string {
+		p := New("http://localhost/webhook", "", WithSeed(seed), WithDeclineRate(0.5), WithErrorRate(0.2))
+		var ids []string
+		for i := 0; i < 20; i++ {
+			intent, err := p.CreateIntent(context.Background(), &payments.IntentParams{Amount: 1000, Currency: "eur"})
+			if err != nil {
+				ids = append(ids, err.Error())
+				continue
+			}
+			ids = append(ids, intent.ID)
+		}
+		return ids
+	}
+	a, b, c := ids(7), ids(7), ids(8)
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("intent %d is %s and %s with the same seed", i, a[i], b[i])
+		}
+	}
+	if a[0] == c[0] && a[1] == c[1] {
+		t.Error("different seeds gave the same intents")
+	}
+}
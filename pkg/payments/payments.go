@@ -0,0 +1,388 @@
+// Package payments abstracts the payment processor the server takes donations
+// with, so processors other than Stripe, like PayPal, Mollie or Adyen, can be
+// plugged in by implementing Provider.
+//
+// Events carry the object they are about as a typed Charge or Invoice, and
+// errors keep the shape of Stripe's, with Stripe's types and codes. Other
+// providers translate to them.
+package payments
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/vedrankolka/donation-server/pkg/address"
+)
+
+// ErrObjectUnavailable is returned by VerifyWebhook for a verified event
+// whose object could not be fetched, so the event can be retried.
+var ErrObjectUnavailable = errors.New("could not fetch the object of the event")
+
+// Provider is a payment processor.
+type Provider interface {
+	// CreateIntent creates an intent to pay, confirmed by the donor in the browser.
+	CreateIntent(ctx context.Context, params *IntentParams) (*Intent, error)
+	// VerifyWebhook checks the signature of a webhook request of the provider
+	// and returns its event. Objects the event only references are fetched.
+	VerifyWebhook(ctx context.Context, payload []byte, header http.Header) (*Event, error)
+	// GetCustomer returns a customer by ID.
+	GetCustomer(ctx context.Context, id string) (*Customer, error)
+	// FindCustomers returns the customers with the email.
+	FindCustomers(ctx context.Context, email string) ([]*Customer, error)
+	// CreateCustomer creates a customer.
+	CreateCustomer(ctx context.Context, params *CustomerParams) (*Customer, error)
+	// UpdateCustomer sets the fields of a customer given in the params.
+	UpdateCustomer(ctx context.Context, id string, params *CustomerParams) (*Customer, error)
+	// UpdatePaymentMetadata sets metadata of a payment, e.g. a Stripe charge.
+	UpdatePaymentMetadata(ctx context.Context, id string, metadata map[string]string) error
+	// Refund refunds a payment in full.
+	Refund(ctx context.Context, params *RefundParams) (*Refund, error)
+	// CreateSubscription subscribes a customer to a recurring price. The first
+	// payment is confirmed by the donor in the browser, like an intent.
+	CreateSubscription(ctx context.Context, params *SubscriptionParams) (*Subscription, error)
+	// CreateCheckoutSession creates a payment page hosted by the provider,
+	// which the donor is redirected to.
+	CreateCheckoutSession(ctx context.Context, params *CheckoutParams) (*CheckoutSession, error)
+	// CreatePaymentLink creates a reusable link to a payment page hosted by
+	// the provider, which can be shared where no page can embed a payment.
+	CreatePaymentLink(ctx context.Context, params *PaymentLinkParams) (*PaymentLink, error)
+	// CreateConnectionToken creates a token the provider's terminal SDK
+	// connects to card readers with, only those of the location if it is set.
+	CreateConnectionToken(ctx context.Context, location string) (string, error)
+	// RegisterReader registers a card reader for in-person payments.
+	RegisterReader(ctx context.Context, params *ReaderParams) (*Reader, error)
+	// ProcessPayment hands an intent of an in-person payment to a reader,
+	// which collects the payment from the donor's card.
+	ProcessPayment(ctx context.Context, readerID, intentID string) error
+}
+
+// PaymentMethodCardPresent is the payment method of in-person payments with
+// a card reader.
+const PaymentMethodCardPresent = "card_present"
+
+// IntentParams describe an intent to pay.
+type IntentParams struct {
+	// Amount in the smallest currency unit.
+	Amount   int64
+	Currency string
+	// PaymentMethodTypes restricts the payment methods, e.g. to "card". The
+	// provider offers the methods enabled for the account if empty.
+	PaymentMethodTypes []string
+	// ReceiptEmail is the email the provider sends the receipt to, if set.
+	ReceiptEmail string
+	// CustomerID is the customer paying, if it is known beforehand.
+	CustomerID string
+	Metadata   map[string]string
+	// IdempotencyKey makes retried requests create a single intent, if set.
+	IdempotencyKey string
+}
+
+// AddMetadata sets a metadata value.
+func (p *IntentParams) AddMetadata(key, value string) {
+	if p.Metadata == nil {
+		p.Metadata = make(map[string]string)
+	}
+	p.Metadata[key] = value
+}
+
+// Intent is an intent to pay.
+type Intent struct {
+	ID string
+	// ClientSecret lets the browser confirm the intent.
+	ClientSecret string
+}
+
+// Customer is a customer of the provider, a donor.
+type Customer struct {
+	ID       string
+	Name     string
+	Email    string
+	Address  address.Address
+	Metadata map[string]string
+}
+
+// CustomerParams are the fields of a customer to create or update. Empty
+// fields are not changed.
+type CustomerParams struct {
+	Name     string
+	Email    string
+	Address  *address.Address
+	Metadata map[string]string
+	// IdempotencyKey makes retried requests create a single customer, if set.
+	IdempotencyKey string
+}
+
+// Reasons of refunds.
+const (
+	RefundReasonDuplicate           = "duplicate"
+	RefundReasonFraudulent          = "fraudulent"
+	RefundReasonRequestedByCustomer = "requested_by_customer"
+)
+
+// RefundParams describe a refund.
+type RefundParams struct {
+	// PaymentID is the payment to refund, e.g. a Stripe charge.
+	PaymentID string
+	// Reason is one of the RefundReason constants, if given.
+	Reason   string
+	Metadata map[string]string
+	// IdempotencyKey makes retried requests refund the payment once, if set.
+	IdempotencyKey string
+}
+
+// Refund is a refund of a payment.
+type Refund struct {
+	ID string
+	// Status of the refund, e.g. "succeeded" or "pending".
+	Status string
+}
+
+// SubscriptionParams describe a subscription to a recurring price.
+type SubscriptionParams struct {
+	CustomerID string
+	// PriceID is the provider's recurring price, e.g. a Stripe price.
+	PriceID  string
+	Metadata map[string]string
+	// IdempotencyKey makes retried requests create a single subscription, if set.
+	IdempotencyKey string
+}
+
+// Subscription is a subscription to a recurring price.
+type Subscription struct {
+	ID string
+	// Status of the subscription, "incomplete" until the first payment.
+	Status string
+	// ClientSecret lets the browser confirm the first payment.
+	ClientSecret string
+}
+
+// CheckoutParams describe a hosted payment page of a single line item.
+type CheckoutParams struct {
+	// Amount in the smallest currency unit.
+	Amount   int64
+	Currency string
+	// ItemName is the name of the line item, e.g. "Donation".
+	ItemName string
+	// CustomerEmail prefills the email of the page, if set.
+	CustomerEmail string
+	// SuccessURL is where the donor is redirected after paying, CancelURL
+	// where the donor goes back to without paying.
+	SuccessURL string
+	CancelURL  string
+	// Metadata of the payment the page creates.
+	Metadata map[string]string
+	// PaymentMethodTypes restricts the payment methods of the page, like
+	// those of an intent.
+	PaymentMethodTypes []string
+	// IdempotencyKey makes retried requests create a single page, if set.
+	IdempotencyKey string
+}
+
+// CheckoutSession is a hosted payment page.
+type CheckoutSession struct {
+	ID string
+	// URL of the page the donor is redirected to.
+	URL string
+}
+
+// PaymentLinkParams describe a payment link of a single line item, paid once
+// or subscribed to.
+type PaymentLinkParams struct {
+	// Amount in the smallest currency unit of a one-time payment, or 0 to let
+	// donors choose it.
+	Amount   int64
+	Currency string
+	// ItemName is the name of the line item of one-time payments.
+	ItemName string
+	// PriceID is the recurring price subscribed to, instead of a one-time
+	// payment, e.g. the price of a tier of recurring donations.
+	PriceID string
+	// Metadata of the payments, or the subscriptions, the link creates.
+	Metadata map[string]string
+	// RedirectURL is where donors are redirected after paying, if set.
+	RedirectURL string
+	// IdempotencyKey makes retried requests create a single link, if set.
+	IdempotencyKey string
+}
+
+// PaymentLink is a reusable link to a hosted payment page.
+type PaymentLink struct {
+	ID  string
+	URL string
+}
+
+// ReaderParams describe a card reader to register.
+type ReaderParams struct {
+	// RegistrationCode is the code the reader shows when it is set up.
+	RegistrationCode string
+	Label            string
+	// Location is the ID of the provider's location the reader is at.
+	Location string
+}
+
+// Reader is a card reader for in-person payments.
+type Reader struct {
+	ID       string
+	Label    string
+	Location string
+	// DeviceType is the model of the reader, e.g. "bbpos_wisepos_e".
+	DeviceType string
+	// Status is "online" or "offline", if the reader is connected to the internet.
+	Status string
+}
+
+// Event is a webhook event of the provider.
+type Event struct {
+	ID string
+	// Type of the event, e.g. "charge.succeeded".
+	Type string
+	// Created is the Unix time the event was created.
+	Created int64
+	// Charge is the object of "charge.*" events, nil for other events.
+	Charge *Charge
+	// Invoice is the object of "invoice.*" events, nil for other events.
+	Invoice *Invoice
+	// PaymentIntent is the object of "payment_intent.*" events, nil for
+	// other events.
+	PaymentIntent *PaymentIntent
+	// Dispute is the object of "charge.dispute.*" events, whose Charge is nil.
+	Dispute *Dispute
+}
+
+// Charge is a payment.
+type Charge struct {
+	ID              string
+	PaymentIntentID string
+	// CustomerID is empty if the charge has no customer.
+	CustomerID string
+	// InvoiceID is the invoice the charge pays, if any.
+	InvoiceID string
+	// Amount in the smallest unit of the currency.
+	Amount   int64
+	Currency string
+	// Created is the Unix time the charge was created.
+	Created        int64
+	Metadata       map[string]string
+	BillingDetails BillingDetails
+	// CardLast4 are the last four digits of the card, if paid by card.
+	CardLast4 string
+	// AmountRefunded in total, Refunded if the charge was refunded in full.
+	AmountRefunded int64
+	Refunded       bool
+	// RefundID and RefundReason are of the latest refund, if any.
+	RefundID     string
+	RefundReason string
+}
+
+// PaymentIntent is a payment being made, which is charged once it succeeds.
+type PaymentIntent struct {
+	ID string
+	// CustomerID is empty if the payment has no customer.
+	CustomerID string
+	// Amount in the smallest unit of the currency.
+	Amount   int64
+	Currency string
+	Metadata map[string]string
+	// Email is the receipt email, or the billing email of the payment method
+	// that failed.
+	Email string
+	// FailureCode and FailureMessage are of the last error, e.g.
+	// "card_declined", empty if the payment did not fail.
+	FailureCode    string
+	FailureMessage string
+}
+
+// Dispute is a charge the donor disputed with their bank.
+type Dispute struct {
+	ID              string
+	ChargeID        string
+	PaymentIntentID string
+	// Amount disputed in the smallest unit of the currency.
+	Amount   int64
+	Currency string
+	// Reason the donor gave, e.g. "fraudulent".
+	Reason string
+	// Status of the dispute, e.g. "needs_response".
+	Status string
+}
+
+// BillingDetails are collected with the payment method of a charge.
+type BillingDetails struct {
+	Name    string
+	Email   string
+	Address address.Address
+}
+
+// Invoice is a bill, e.g. of a period of a subscription.
+type Invoice struct {
+	ID string
+	// SubscriptionID is empty if the invoice is not of a subscription.
+	SubscriptionID string
+	CustomerID     string
+	CustomerName   string
+	CustomerEmail  string
+	// AmountPaid in the smallest unit of the currency.
+	AmountPaid int64
+	Currency   string
+	// BillingReason is why the invoice was created, "subscription_create"
+	// for the first invoice of a subscription.
+	BillingReason string
+	// PaidAt is the Unix time the invoice was paid, 0 if it is not paid.
+	PaidAt int64
+	Lines  []InvoiceLine
+}
+
+// InvoiceLine is a line of an invoice.
+type InvoiceLine struct {
+	// PeriodStart and PeriodEnd are the Unix times of the period billed.
+	PeriodStart int64
+	PeriodEnd   int64
+	PriceID     string
+	// Interval of a recurring price, e.g. "month".
+	Interval string
+}
+
+// Types of errors.
+const (
+	// ErrorTypeAPI means the provider failed.
+	ErrorTypeAPI = "api_error"
+	// ErrorTypeInvalidRequest means the provider refused the request.
+	ErrorTypeInvalidRequest = "invalid_request_error"
+	// ErrorTypeCard means the card was declined.
+	ErrorTypeCard = "card_error"
+)
+
+// Codes of errors.
+const (
+	ErrorCodeAmountTooSmall = "amount_too_small"
+	ErrorCodeAmountTooLarge = "amount_too_large"
+)
+
+// Error is an error the provider responded with.
+type Error struct {
+	Type string
+	Code string
+	// DeclineCode is the reason of the issuer of a declined card, e.g.
+	// "insufficient_funds".
+	DeclineCode string
+	// Param is the request parameter the error is about, if any.
+	Param   string
+	Message string
+	// RequestID is the provider's ID of the failed request, e.g. "req_..."
+	// of Stripe, for its support.
+	RequestID string
+	// Err is the provider's own error.
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
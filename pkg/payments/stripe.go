@@ -0,0 +1,649 @@
+package payments
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/client"
+	"github.com/stripe/stripe-go/v76/webhook"
+	"github.com/vedrankolka/donation-server/pkg/address"
+)
+
+// SignatureHeader is the header of Stripe's webhook signatures.
+const SignatureHeader = "Stripe-Signature"
+
+// DefaultTimeout is how long a call to Stripe may take, so a slow Stripe API
+// cannot hold the requests waiting for it indefinitely.
+const DefaultTimeout = 10 * time.Second
+
+// Stripe is the Provider of Stripe.
+type Stripe struct {
+	client        *client.API
+	webhookSecret string
+	timeout       time.Duration
+}
+
+// StripeOption configures a Stripe provider.
+type StripeOption func(*Stripe)
+
+// WithTimeout limits every call to Stripe to the timeout instead of
+// DefaultTimeout. Calls end earlier if their context does.
+func WithTimeout(timeout time.Duration) StripeOption {
+	return func(s *Stripe) {
+		s.timeout = timeout
+	}
+}
+
+// NewStripe creates a Stripe provider with the secret API key, verifying
+// webhooks with the signing secret of the endpoint.
+func NewStripe(key, webhookSecret string, opts ...StripeOption) *Stripe {
+	s := &Stripe{
+		client:        client.New(key, nil),
+		webhookSecret: webhookSecret,
+		timeout:       DefaultTimeout,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+func (s *Stripe) CreateIntent(ctx context.Context, p *IntentParams) (*Intent, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	params := &stripe.PaymentIntentParams{
+		Amount:   stripe.Int64(p.Amount),
+		Currency: stripe.String(p.Currency),
+	}
+	if p.ReceiptEmail != "" {
+		params.ReceiptEmail = stripe.String(p.ReceiptEmail)
+	}
+	if p.CustomerID != "" {
+		params.Customer = stripe.String(p.CustomerID)
+	}
+	if len(p.PaymentMethodTypes) > 0 {
+		params.PaymentMethodTypes = stripe.StringSlice(p.PaymentMethodTypes)
+	} else {
+		params.AutomaticPaymentMethods = &stripe.PaymentIntentAutomaticPaymentMethodsParams{
+			Enabled: stripe.Bool(true),
+		}
+	}
+	setParams(ctx, &params.Params, p.Metadata, p.IdempotencyKey)
+
+	pi, err := s.client.PaymentIntents.New(params)
+	if err != nil {
+		return nil, StripeError(err)
+	}
+	return &Intent{ID: pi.ID, ClientSecret: pi.ClientSecret}, nil
+}
+
+// VerifyWebhook verifies the event and decodes its charge, invoice, payment
+// intent or dispute. Events
+// of an API version other than stripe.APIVersion, which the objects are
+// decoded as, are rejected, so the webhook endpoint must be created with it.
+// Thin events of event destinations only reference their object, which is
+// fetched from the API instead, in the version of the client.
+func (s *Stripe) VerifyWebhook(ctx context.Context, payload []byte, header http.Header) (*Event, error) {
+	var peek struct {
+		Object string `json:"object"`
+	}
+	if json.Unmarshal(payload, &peek) == nil && peek.Object == thinEventObject {
+		return s.verifyThinEvent(ctx, payload, header)
+	}
+
+	event, err := webhook.ConstructEvent(payload, header.Get(SignatureHeader), s.webhookSecret)
+	if err != nil {
+		return nil, err
+	}
+	e := &Event{ID: event.ID, Type: string(event.Type), Created: event.Created}
+	switch {
+	case strings.HasPrefix(e.Type, "charge.dispute."):
+		var d stripe.Dispute
+		if err := decodeObject(event, &d); err != nil {
+			return nil, err
+		}
+		e.Dispute = dispute(&d)
+	case strings.HasPrefix(e.Type, "charge."):
+		var c stripe.Charge
+		if err := decodeObject(event, &c); err != nil {
+			return nil, err
+		}
+		e.Charge = charge(&c)
+	case strings.HasPrefix(e.Type, "invoice."):
+		var i stripe.Invoice
+		if err := decodeObject(event, &i); err != nil {
+			return nil, err
+		}
+		e.Invoice = invoice(&i)
+	case strings.HasPrefix(e.Type, "payment_intent."):
+		var pi stripe.PaymentIntent
+		if err := decodeObject(event, &pi); err != nil {
+			return nil, err
+		}
+		e.PaymentIntent = paymentIntent(&pi)
+	}
+	return e, nil
+}
+
+// thinEventObject is the object of thin events.
+const thinEventObject = "v2.core.event"
+
+// thinEvent is an event with a thin payload, which references the object it
+// is about instead of holding a snapshot of it.
+type thinEvent struct {
+	ID string `json:"id"`
+	// Type of the event, of v1 objects with a "v1." prefix, e.g. "v1.charge.succeeded".
+	Type          string    `json:"type"`
+	Created       time.Time `json:"created"`
+	RelatedObject *struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+	} `json:"related_object"`
+}
+
+// verifyThinEvent verifies a thin event and fetches the charge, invoice,
+// payment intent or dispute it references. The object is fetched as it is now, not as it was when the
+// event happened.
+func (s *Stripe) verifyThinEvent(ctx context.Context, payload []byte, header http.Header) (*Event, error) {
+	if err := webhook.ValidatePayload(payload, header.Get(SignatureHeader), s.webhookSecret); err != nil {
+		return nil, err
+	}
+	var thin thinEvent
+	if err := json.Unmarshal(payload, &thin); err != nil {
+		return nil, fmt.Errorf("could not decode thin event: %v", err)
+	}
+	e := &Event{ID: thin.ID, Type: strings.TrimPrefix(thin.Type, "v1."), Created: thin.Created.Unix()}
+	if thin.RelatedObject == nil || thin.RelatedObject.ID == "" {
+		return e, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	switch {
+	case strings.HasPrefix(e.Type, "charge.") && thin.RelatedObject.Type == "charge":
+		params := &stripe.ChargeParams{}
+		params.Context = ctx
+		c, err := s.client.Charges.Get(thin.RelatedObject.ID, params)
+		if err != nil {
+			return nil, fmt.Errorf("%w: charge %s of event %s: %v", ErrObjectUnavailable, thin.RelatedObject.ID, thin.ID, StripeError(err))
+		}
+		e.Charge = charge(c)
+	case strings.HasPrefix(e.Type, "invoice.") && thin.RelatedObject.Type == "invoice":
+		params := &stripe.InvoiceParams{}
+		params.Context = ctx
+		i, err := s.client.Invoices.Get(thin.RelatedObject.ID, params)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invoice %s of event %s: %v", ErrObjectUnavailable, thin.RelatedObject.ID, thin.ID, StripeError(err))
+		}
+		e.Invoice = invoice(i)
+	case strings.HasPrefix(e.Type, "payment_intent.") && thin.RelatedObject.Type == "payment_intent":
+		params := &stripe.PaymentIntentParams{}
+		params.Context = ctx
+		pi, err := s.client.PaymentIntents.Get(thin.RelatedObject.ID, params)
+		if err != nil {
+			return nil, fmt.Errorf("%w: payment intent %s of event %s: %v", ErrObjectUnavailable, thin.RelatedObject.ID, thin.ID, StripeError(err))
+		}
+		e.PaymentIntent = paymentIntent(pi)
+	case strings.HasPrefix(e.Type, "charge.dispute.") && thin.RelatedObject.Type == "dispute":
+		params := &stripe.DisputeParams{}
+		params.Context = ctx
+		d, err := s.client.Disputes.Get(thin.RelatedObject.ID, params)
+		if err != nil {
+			return nil, fmt.Errorf("%w: dispute %s of event %s: %v", ErrObjectUnavailable, thin.RelatedObject.ID, thin.ID, StripeError(err))
+		}
+		e.Dispute = dispute(d)
+	}
+	return e, nil
+}
+
+// decodeObject decodes the object of the event.
+func decodeObject(event stripe.Event, v interface{}) error {
+	if event.Data == nil || len(event.Data.Raw) == 0 {
+		return fmt.Errorf("event %s has no object", event.ID)
+	}
+	if err := json.Unmarshal(event.Data.Raw, v); err != nil {
+		return fmt.Errorf("could not decode the object of event %s: %v", event.ID, err)
+	}
+	return nil
+}
+
+func (s *Stripe) GetCustomer(ctx context.Context, id string) (*Customer, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	params := &stripe.CustomerParams{}
+	params.Context = ctx
+	c, err := s.client.Customers.Get(id, params)
+	if err != nil {
+		return nil, StripeError(err)
+	}
+	return customer(c), nil
+}
+
+func (s *Stripe) FindCustomers(ctx context.Context, email string) ([]*Customer, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	params := &stripe.CustomerListParams{Email: stripe.String(email)}
+	params.Context = ctx
+	iter := s.client.Customers.List(params)
+	if err := iter.Err(); err != nil {
+		return nil, StripeError(err)
+	}
+
+	list := iter.CustomerList().Data
+	customers := make([]*Customer, len(list))
+	for i, c := range list {
+		customers[i] = customer(c)
+	}
+	return customers, nil
+}
+
+func (s *Stripe) CreateCustomer(ctx context.Context, p *CustomerParams) (*Customer, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	c, err := s.client.Customers.New(customerParams(ctx, p))
+	if err != nil {
+		return nil, StripeError(err)
+	}
+	return customer(c), nil
+}
+
+func (s *Stripe) UpdateCustomer(ctx context.Context, id string, p *CustomerParams) (*Customer, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	c, err := s.client.Customers.Update(id, customerParams(ctx, p))
+	if err != nil {
+		return nil, StripeError(err)
+	}
+	return customer(c), nil
+}
+
+func (s *Stripe) UpdatePaymentMetadata(ctx context.Context, id string, metadata map[string]string) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	params := &stripe.ChargeParams{}
+	setParams(ctx, &params.Params, metadata, "")
+	if _, err := s.client.Charges.Update(id, params); err != nil {
+		return StripeError(err)
+	}
+	return nil
+}
+
+func (s *Stripe) Refund(ctx context.Context, p *RefundParams) (*Refund, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	params := &stripe.RefundParams{Charge: stripe.String(p.PaymentID)}
+	if p.Reason != "" {
+		params.Reason = stripe.String(p.Reason)
+	}
+	setParams(ctx, &params.Params, p.Metadata, p.IdempotencyKey)
+
+	refund, err := s.client.Refunds.New(params)
+	if err != nil {
+		return nil, StripeError(err)
+	}
+	return &Refund{ID: refund.ID, Status: string(refund.Status)}, nil
+}
+
+func (s *Stripe) CreateSubscription(ctx context.Context, p *SubscriptionParams) (*Subscription, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	params := &stripe.SubscriptionParams{
+		Customer: stripe.String(p.CustomerID),
+		Items:    []*stripe.SubscriptionItemsParams{{Price: stripe.String(p.PriceID)}},
+		// The subscription waits for the donor to confirm the first payment,
+		// whose payment method pays the renewals.
+		PaymentBehavior: stripe.String("default_incomplete"),
+		PaymentSettings: &stripe.SubscriptionPaymentSettingsParams{
+			SaveDefaultPaymentMethod: stripe.String("on_subscription"),
+		},
+	}
+	params.AddExpand("latest_invoice.payment_intent")
+	setParams(ctx, &params.Params, p.Metadata, p.IdempotencyKey)
+
+	sub, err := s.client.Subscriptions.New(params)
+	if err != nil {
+		return nil, StripeError(err)
+	}
+	subscription := &Subscription{ID: sub.ID, Status: string(sub.Status)}
+	if sub.LatestInvoice != nil && sub.LatestInvoice.PaymentIntent != nil {
+		subscription.ClientSecret = sub.LatestInvoice.PaymentIntent.ClientSecret
+	}
+	return subscription, nil
+}
+
+// CreateCheckoutSession creates a Stripe Checkout session in payment mode,
+// with the metadata on its payment intent, so its charge is handled like
+// those of the Payment Element.
+func (s *Stripe) CreateCheckoutSession(ctx context.Context, p *CheckoutParams) (*CheckoutSession, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	params := &stripe.CheckoutSessionParams{
+		Mode:       stripe.String(string(stripe.CheckoutSessionModePayment)),
+		SubmitType: stripe.String(string(stripe.CheckoutSessionSubmitTypeDonate)),
+		LineItems: []*stripe.CheckoutSessionLineItemParams{{
+			PriceData: &stripe.CheckoutSessionLineItemPriceDataParams{
+				Currency:    stripe.String(strings.ToLower(p.Currency)),
+				UnitAmount:  stripe.Int64(p.Amount),
+				ProductData: &stripe.CheckoutSessionLineItemPriceDataProductDataParams{Name: stripe.String(p.ItemName)},
+			},
+			Quantity: stripe.Int64(1),
+		}},
+		SuccessURL:        stripe.String(p.SuccessURL),
+		CancelURL:         stripe.String(p.CancelURL),
+		PaymentIntentData: &stripe.CheckoutSessionPaymentIntentDataParams{Metadata: p.Metadata},
+	}
+	if p.CustomerEmail != "" {
+		params.CustomerEmail = stripe.String(p.CustomerEmail)
+	}
+	if len(p.PaymentMethodTypes) > 0 {
+		params.PaymentMethodTypes = stripe.StringSlice(p.PaymentMethodTypes)
+	}
+	setParams(ctx, &params.Params, p.Metadata, p.IdempotencyKey)
+
+	session, err := s.client.CheckoutSessions.New(params)
+	if err != nil {
+		return nil, StripeError(err)
+	}
+	return &CheckoutSession{ID: session.ID, URL: session.URL}, nil
+}
+
+// CreatePaymentLink creates a link of the recurring price, or of a new
+// one-time price of the amount, which donors choose if it is 0.
+func (s *Stripe) CreatePaymentLink(ctx context.Context, p *PaymentLinkParams) (*PaymentLink, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	params := &stripe.PaymentLinkParams{}
+	priceID := p.PriceID
+	if priceID != "" {
+		params.SubscriptionData = &stripe.PaymentLinkSubscriptionDataParams{Metadata: p.Metadata}
+	} else {
+		priceParams := &stripe.PriceParams{
+			Currency:    stripe.String(strings.ToLower(p.Currency)),
+			ProductData: &stripe.PriceProductDataParams{Name: stripe.String(p.ItemName)},
+		}
+		if p.Amount > 0 {
+			priceParams.UnitAmount = stripe.Int64(p.Amount)
+		} else {
+			priceParams.CustomUnitAmount = &stripe.PriceCustomUnitAmountParams{Enabled: stripe.Bool(true)}
+		}
+		setParams(ctx, &priceParams.Params, nil, idempotencyKeyOf(p.IdempotencyKey, "price"))
+		price, err := s.client.Prices.New(priceParams)
+		if err != nil {
+			return nil, StripeError(err)
+		}
+		priceID = price.ID
+		params.SubmitType = stripe.String(string(stripe.PaymentLinkSubmitTypeDonate))
+		params.PaymentIntentData = &stripe.PaymentLinkPaymentIntentDataParams{Metadata: p.Metadata}
+	}
+	params.LineItems = []*stripe.PaymentLinkLineItemParams{{Price: stripe.String(priceID), Quantity: stripe.Int64(1)}}
+	if p.RedirectURL != "" {
+		params.AfterCompletion = &stripe.PaymentLinkAfterCompletionParams{
+			Type:     stripe.String(string(stripe.PaymentLinkAfterCompletionTypeRedirect)),
+			Redirect: &stripe.PaymentLinkAfterCompletionRedirectParams{URL: stripe.String(p.RedirectURL)},
+		}
+	}
+	setParams(ctx, &params.Params, p.Metadata, p.IdempotencyKey)
+
+	link, err := s.client.PaymentLinks.New(params)
+	if err != nil {
+		return nil, StripeError(err)
+	}
+	return &PaymentLink{ID: link.ID, URL: link.URL}, nil
+}
+
+// CreateConnectionToken creates a connection token of Stripe Terminal.
+func (s *Stripe) CreateConnectionToken(ctx context.Context, location string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	params := &stripe.TerminalConnectionTokenParams{}
+	if location != "" {
+		params.Location = stripe.String(location)
+	}
+	params.Context = ctx
+	token, err := s.client.TerminalConnectionTokens.New(params)
+	if err != nil {
+		return "", StripeError(err)
+	}
+	return token.Secret, nil
+}
+
+// RegisterReader registers a Stripe Terminal reader at a location.
+func (s *Stripe) RegisterReader(ctx context.Context, p *ReaderParams) (*Reader, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	params := &stripe.TerminalReaderParams{
+		RegistrationCode: stripe.String(p.RegistrationCode),
+		Location:         stripe.String(p.Location),
+	}
+	if p.Label != "" {
+		params.Label = stripe.String(p.Label)
+	}
+	params.Context = ctx
+	r, err := s.client.TerminalReaders.New(params)
+	if err != nil {
+		return nil, StripeError(err)
+	}
+	reader := &Reader{ID: r.ID, Label: r.Label, DeviceType: string(r.DeviceType), Status: r.Status}
+	if r.Location != nil {
+		reader.Location = r.Location.ID
+	}
+	return reader, nil
+}
+
+// ProcessPayment hands the intent to a smart reader of Stripe Terminal,
+// which asks the donor to present a card.
+func (s *Stripe) ProcessPayment(ctx context.Context, readerID, intentID string) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	params := &stripe.TerminalReaderProcessPaymentIntentParams{PaymentIntent: stripe.String(intentID)}
+	params.Context = ctx
+	if _, err := s.client.TerminalReaders.ProcessPaymentIntent(readerID, params); err != nil {
+		return StripeError(err)
+	}
+	return nil
+}
+
+// idempotencyKeyOf returns the idempotency key of another request made for
+// the one with the key, or "" if the key is.
+func idempotencyKeyOf(key, request string) string {
+	if key == "" {
+		return ""
+	}
+	return key + "-" + request
+}
+
+func setParams(ctx context.Context, params *stripe.Params, metadata map[string]string, idempotencyKey string) {
+	params.Context = ctx
+	for key, value := range metadata {
+		params.AddMetadata(key, value)
+	}
+	if idempotencyKey != "" {
+		params.SetIdempotencyKey(idempotencyKey)
+	}
+}
+
+func customerParams(ctx context.Context, p *CustomerParams) *stripe.CustomerParams {
+	params := &stripe.CustomerParams{}
+	if p.Name != "" {
+		params.Name = stripe.String(p.Name)
+	}
+	if p.Email != "" {
+		params.Email = stripe.String(p.Email)
+	}
+	if a := p.Address; a != nil {
+		params.Address = &stripe.AddressParams{
+			Line1:      stripe.String(a.Line1),
+			Line2:      stripe.String(a.Line2),
+			City:       stripe.String(a.City),
+			PostalCode: stripe.String(a.PostalCode),
+			State:      stripe.String(a.State),
+			Country:    stripe.String(a.Country),
+		}
+	}
+	setParams(ctx, &params.Params, p.Metadata, p.IdempotencyKey)
+	return params
+}
+
+func customer(c *stripe.Customer) *Customer {
+	cus := &Customer{
+		ID:       c.ID,
+		Name:     c.Name,
+		Email:    c.Email,
+		Metadata: c.Metadata,
+	}
+	if c.Address != nil {
+		cus.Address = stripeAddress(c.Address)
+	}
+	return cus
+}
+
+func charge(c *stripe.Charge) *Charge {
+	ch := &Charge{
+		ID:       c.ID,
+		Amount:   c.Amount,
+		Currency: string(c.Currency),
+		Created:  c.Created,
+		Metadata: c.Metadata,
+	}
+	if c.PaymentIntent != nil {
+		ch.PaymentIntentID = c.PaymentIntent.ID
+	}
+	if c.Customer != nil {
+		ch.CustomerID = c.Customer.ID
+	}
+	if c.Invoice != nil {
+		ch.InvoiceID = c.Invoice.ID
+	}
+	if b := c.BillingDetails; b != nil {
+		ch.BillingDetails.Name = b.Name
+		ch.BillingDetails.Email = b.Email
+		if b.Address != nil {
+			ch.BillingDetails.Address = stripeAddress(b.Address)
+		}
+	}
+	if d := c.PaymentMethodDetails; d != nil && d.Card != nil {
+		ch.CardLast4 = d.Card.Last4
+	} else if d != nil && d.CardPresent != nil {
+		ch.CardLast4 = d.CardPresent.Last4
+	}
+	ch.AmountRefunded, ch.Refunded = c.AmountRefunded, c.Refunded
+	// Refunds are listed newest first.
+	if c.Refunds != nil && len(c.Refunds.Data) > 0 && c.Refunds.Data[0] != nil {
+		ch.RefundID = c.Refunds.Data[0].ID
+		ch.RefundReason = string(c.Refunds.Data[0].Reason)
+	}
+	return ch
+}
+
+func paymentIntent(pi *stripe.PaymentIntent) *PaymentIntent {
+	p := &PaymentIntent{
+		ID:       pi.ID,
+		Amount:   pi.Amount,
+		Currency: string(pi.Currency),
+		Metadata: pi.Metadata,
+		Email:    pi.ReceiptEmail,
+	}
+	if pi.Customer != nil {
+		p.CustomerID = pi.Customer.ID
+	}
+	if e := pi.LastPaymentError; e != nil {
+		p.FailureCode, p.FailureMessage = string(e.Code), e.Msg
+		if e.DeclineCode != "" {
+			p.FailureCode = string(e.DeclineCode)
+		}
+		if pm := e.PaymentMethod; p.Email == "" && pm != nil && pm.BillingDetails != nil {
+			p.Email = pm.BillingDetails.Email
+		}
+	}
+	return p
+}
+
+func dispute(d *stripe.Dispute) *Dispute {
+	dp := &Dispute{
+		ID:       d.ID,
+		Amount:   d.Amount,
+		Currency: string(d.Currency),
+		Reason:   string(d.Reason),
+		Status:   string(d.Status),
+	}
+	if d.Charge != nil {
+		dp.ChargeID = d.Charge.ID
+	}
+	if d.PaymentIntent != nil {
+		dp.PaymentIntentID = d.PaymentIntent.ID
+	}
+	return dp
+}
+
+func invoice(i *stripe.Invoice) *Invoice {
+	inv := &Invoice{
+		ID:            i.ID,
+		CustomerName:  i.CustomerName,
+		CustomerEmail: i.CustomerEmail,
+		AmountPaid:    i.AmountPaid,
+		Currency:      string(i.Currency),
+		BillingReason: string(i.BillingReason),
+	}
+	if i.Subscription != nil {
+		inv.SubscriptionID = i.Subscription.ID
+	}
+	if i.Customer != nil {
+		inv.CustomerID = i.Customer.ID
+	}
+	if i.StatusTransitions != nil {
+		inv.PaidAt = i.StatusTransitions.PaidAt
+	}
+	if i.Lines != nil {
+		for _, l := range i.Lines.Data {
+			if l == nil {
+				continue
+			}
+			var line InvoiceLine
+			if l.Period != nil {
+				line.PeriodStart, line.PeriodEnd = l.Period.Start, l.Period.End
+			}
+			if l.Price != nil {
+				line.PriceID = l.Price.ID
+				if l.Price.Recurring != nil {
+					line.Interval = string(l.Price.Recurring.Interval)
+				}
+			}
+			inv.Lines = append(inv.Lines, line)
+		}
+	}
+	return inv
+}
+
+func stripeAddress(a *stripe.Address) address.Address {
+	return address.Address{
+		Line1:      a.Line1,
+		Line2:      a.Line2,
+		City:       a.City,
+		PostalCode: a.PostalCode,
+		State:      a.State,
+		Country:    a.Country,
+	}
+}
+
+// StripeError returns a Stripe error as an Error, keeping it as Err. Other
+// errors are returned as they are.
+func StripeError(err error) error {
+	stripeErr, ok := err.(*stripe.Error)
+	if !ok {
+		return err
+	}
+	return &Error{
+		Type:        string(stripeErr.Type),
+		Code:        string(stripeErr.Code),
+		DeclineCode: string(stripeErr.DeclineCode),
+		Param:       stripeErr.Param,
+		Message:     stripeErr.Msg,
+		RequestID:   stripeErr.RequestID,
+		Err:         stripeErr,
+	}
+}
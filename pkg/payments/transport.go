@@ -0,0 +1,65 @@
+package payments
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/metrics"
+	"github.com/vedrankolka/donation-server/pkg/tracing"
+)
+
+var stripeRequestDuration = metrics.NewHistogramVec(
+	"donation_server_stripe_request_duration_seconds",
+	"Duration of requests to the Stripe API, by method, resource and status code, error if there was no response.",
+	metrics.DefaultBuckets,
+	"method", "resource", "code",
+)
+
+// Transport records the duration of requests to the Stripe API in
+// donation_server_stripe_request_duration_seconds, by the resource of their
+// path, e.g. customers for /v1/customers/cus_123, and a span of each, like
+// "stripe POST payment_intents". Stripe does not get the trace context.
+type Transport struct {
+	// Base makes the requests. http.DefaultTransport if nil.
+	Base http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	start := time.Now()
+	ctx, span := tracing.Start(r.Context(), "stripe "+r.Method+" "+resource(r.URL.Path), tracing.KindClient,
+		tracing.String("http.request.method", r.Method),
+		tracing.String("url.path", r.URL.Path),
+	)
+	defer span.End()
+	resp, err := base.RoundTrip(r.WithContext(ctx))
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+		span.SetAttributes(tracing.Int("http.response.status_code", resp.StatusCode))
+		if resp.StatusCode >= 400 {
+			span.SetError(errors.New(resp.Status))
+		}
+	} else {
+		span.SetError(err)
+	}
+	stripeRequestDuration.Observe(time.Since(start).Seconds(), r.Method, resource(r.URL.Path), code)
+	return resp, err
+}
+
+// resource returns the resource of a path of the Stripe API, the segment
+// after the version.
+func resource(path string) string {
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(segments) < 2 || segments[1] == "" {
+		return "other"
+	}
+	return segments[1]
+}
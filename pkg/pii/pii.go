@@ -0,0 +1,143 @@
+// Package pii encrypts the personal data of donors, their names, emails and
+// addresses, before they are saved in a durable store, so a copy of the
+// database does not disclose them. Fields are sealed with AES-GCM under a
+// keyring of named keys: new values are encrypted with the first key, the
+// others only decrypt, so keys are rotated by adding a new key in front and
+// re-encrypting the stored donations.
+package pii
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// prefix starts every encrypted value, followed by the key ID, a colon and
+// the nonce and ciphertext in base64.
+const prefix = "enc:v1:"
+
+// KeySize is the size of keys, for AES-256.
+const KeySize = 32
+
+// keyID is the format of key IDs, e.g. "2024-06".
+var keyID = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,32}$`)
+
+// Keyring holds the keys of encrypted values.
+type Keyring struct {
+	primary string
+	keys    map[string]cipher.AEAD
+	// ids in the order they were given.
+	ids []string
+}
+
+// ParseKeys parses a list of keys like "2024-06:<64 hex digits>,2023-01:<...>",
+// separated by commas, spaces or new lines. The first key encrypts.
+func ParseKeys(s string) (*Keyring, error) {
+	entries := strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' || r == '\n' || r == '\r' || r == '\t' })
+	if len(entries) == 0 {
+		return nil, errors.New("no keys")
+	}
+	kr := &Keyring{keys: make(map[string]cipher.AEAD)}
+	for _, entry := range entries {
+		i := strings.Index(entry, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("key %q is not an ID and a key separated by a colon", redact(entry))
+		}
+		id, hexKey := entry[:i], entry[i+1:]
+		if !keyID.MatchString(id) {
+			return nil, fmt.Errorf("key ID %q must be up to 32 letters, digits, dots, dashes and underscores", id)
+		}
+		if _, ok := kr.keys[id]; ok {
+			return nil, fmt.Errorf("key ID %q is given twice", id)
+		}
+		key, err := hex.DecodeString(hexKey)
+		if err != nil || len(key) != KeySize {
+			return nil, fmt.Errorf("key %q must be %d hex digits", id, 2*KeySize)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		kr.keys[id] = aead
+		kr.ids = append(kr.ids, id)
+	}
+	kr.primary = kr.ids[0]
+	return kr, nil
+}
+
+// redact hides the key of an invalid entry in errors.
+func redact(entry string) string {
+	if len(entry) > 8 {
+		return entry[:4] + "…"
+	}
+	return "…"
+}
+
+// Primary returns the ID of the key new values are encrypted with.
+func (kr *Keyring) Primary() string {
+	return kr.primary
+}
+
+// IDs returns the IDs of the keys, the primary first.
+func (kr *Keyring) IDs() []string {
+	return append([]string(nil), kr.ids...)
+}
+
+// Encrypt seals the value with the primary key. The context, e.g. the ID of
+// the record and the field, is authenticated, so an encrypted value cannot be
+// moved to another record or field. Empty values stay empty.
+func (kr *Keyring) Encrypt(value, context string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	aead := kr.keys[kr.primary]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(value)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(context))
+	return prefix + kr.primary + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a value encrypted with any key of the keyring and the same
+// context. Values that are not encrypted, saved before encryption was
+// enabled, are returned as they are.
+func (kr *Keyring) Decrypt(value, context string) (string, error) {
+	if !strings.HasPrefix(value, prefix) {
+		return value, nil
+	}
+	rest := value[len(prefix):]
+	i := strings.Index(rest, ":")
+	if i < 0 {
+		return "", errors.New("encrypted value without a key ID")
+	}
+	id := rest[:i]
+	aead, ok := kr.keys[id]
+	if !ok {
+		return "", fmt.Errorf("value encrypted with the unknown key %q", id)
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(rest[i+1:])
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("invalid value encrypted with key %q", id)
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(context))
+	if err != nil {
+		return "", fmt.Errorf("value encrypted with key %q cannot be decrypted: %w", id, err)
+	}
+	return string(plain), nil
+}
+
+// Current reports whether the value is empty or encrypted with the primary key.
+func (kr *Keyring) Current(value string) bool {
+	return value == "" || strings.HasPrefix(value, prefix+kr.primary+":")
+}
@@ -0,0 +1,161 @@
+package pii
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/address"
+	"github.com/vedrankolka/donation-server/pkg/listing"
+	"github.com/vedrankolka/donation-server/pkg/store"
+)
+
+var (
+	oldKey = "2023-01:" + strings.Repeat("11", KeySize)
+	newKey = "2024-06:" + strings.Repeat("22", KeySize)
+)
+
+func mustKeys(t *testing.T, s string) *Keyring {
+	t.Helper()
+	kr, err := ParseKeys(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kr
+}
+
+func TestParseKeys(t *testing.T) {
+	kr := mustKeys(t, newKey+", "+oldKey)
+	if kr.Primary() != "2024-06" || len(kr.IDs()) != 2 {
+		t.Errorf("keys %v, primary %s", kr.IDs(), kr.Primary())
+	}
+	for _, s := range []string{"", "2024-06", "a:b", "a/b:" + strings.Repeat("11", KeySize), newKey + "," + newKey} {
+		if _, err := ParseKeys(s); err == nil {
+			t.Errorf("ParseKeys(%q) succeeded", s)
+		}
+	}
+	if _, err := ParseKeys("2024-06:" + strings.Repeat("zz", KeySize)); err == nil || strings.Contains(err.Error(), "zz") {
+		t.Errorf("invalid key: err = %v", err)
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	kr := mustKeys(t, newKey)
+	sealed, err := kr.Encrypt("ana@example.org", "ch_1/customerEmail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(sealed, "ana") || !kr.Current(sealed) {
+		t.Fatalf("Encrypt = %s", sealed)
+	}
+	if plain, err := kr.Decrypt(sealed, "ch_1/customerEmail"); err != nil || plain != "ana@example.org" {
+		t.Errorf("Decrypt = %q, %v", plain, err)
+	}
+	if _, err := kr.Decrypt(sealed, "ch_2/customerEmail"); err == nil {
+		t.Error("decrypted a value moved to another donation")
+	}
+	if plain, err := kr.Decrypt("ana@example.org", "ch_1/customerEmail"); err != nil || plain != "ana@example.org" {
+		t.Errorf("Decrypt of a plain value = %q, %v", plain, err)
+	}
+	if sealed, _ := kr.Encrypt("", "ch_1/customerName"); sealed != "" {
+		t.Errorf("Encrypt of an empty value = %q", sealed)
+	}
+}
+
+func TestDonationStoreRotation(t *testing.T) {
+	ctx := context.Background()
+	durable := store.NewMemoryStore()
+	d := &store.Donation{
+		ID:            "ch_1",
+		CustomerName:  "Ana Horvat",
+		CustomerEmail: "ana@example.org",
+		Address:       &address.Address{Line1: "Ilica 1", City: "Zagreb", PostalCode: "10000", Country: "HR"},
+		Amount:        2500,
+		Currency:      "eur",
+		Status:        store.StatusSucceeded,
+		CreatedAt:     time.Now(),
+	}
+	if err := NewDonationStore(durable, mustKeys(t, oldKey)).SaveDonation(ctx, d); err != nil {
+		t.Fatal(err)
+	}
+	if d.CustomerName != "Ana Horvat" || d.Address.Line1 != "Ilica 1" {
+		t.Error("the saved donation was changed")
+	}
+	plain := &store.Donation{ID: "ch_2", CustomerEmail: "ivo@example.org", Status: store.StatusSucceeded, CreatedAt: time.Now()}
+	if err := durable.SaveDonation(ctx, plain); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, _ := durable.GetDonation(ctx, "ch_1")
+	for _, value := range []string{raw.CustomerName, raw.CustomerEmail, raw.Address.Line1, raw.Address.City, raw.Address.PostalCode} {
+		if !strings.HasPrefix(value, prefix+"2023-01:") {
+			t.Errorf("stored value %q is not encrypted", value)
+		}
+	}
+	if raw.Address.Country != "HR" {
+		t.Fatalf("stored donation = %+v, %+v", raw, raw.Address)
+	}
+
+	// The new key encrypts, the old one still decrypts.
+	rotated := mustKeys(t, newKey+","+oldKey)
+	s := NewDonationStore(durable, rotated)
+	got, err := s.GetDonation(ctx, "ch_1")
+	if err != nil || got.CustomerEmail != "ana@example.org" || got.Address.PostalCode != "10000" {
+		t.Fatalf("GetDonation = %+v, %v", got, err)
+	}
+	n, err := Reencrypt(ctx, durable, rotated)
+	if err != nil || n != 2 {
+		t.Fatalf("Reencrypt = %d, %v, want both donations", n, err)
+	}
+	if n, err := Reencrypt(ctx, durable, rotated); err != nil || n != 0 {
+		t.Errorf("second Reencrypt = %d, %v", n, err)
+	}
+
+	// Without the old key, all donations can be read.
+	s = NewDonationStore(durable, mustKeys(t, newKey))
+	q, _ := store.DonationListSpec.Parse(nil)
+	list, _, err := s.ListDonations(ctx, q)
+	if err != nil || len(list) != 2 {
+		t.Fatalf("ListDonations = %d, %v", len(list), err)
+	}
+	for _, d := range list {
+		if !strings.HasSuffix(d.CustomerEmail, "@example.org") {
+			t.Errorf("donation %s has email %q", d.ID, d.CustomerEmail)
+		}
+	}
+}
+
+// changingStore refunds the donations it lists, as the server would while
+// they are re-encrypted.
+type changingStore struct {
+	*store.MemoryStore
+}
+
+func (s changingStore) ListDonations(ctx context.Context, q listing.Query) ([]*store.Donation, string, error) {
+	page, next, err := s.MemoryStore.ListDonations(ctx, q)
+	for _, d := range page {
+		refunded := *d
+		refunded.Status = store.StatusRefunded
+		s.MemoryStore.SaveDonation(ctx, &refunded)
+	}
+	return page, next, err
+}
+
+func TestReencryptConcurrentChange(t *testing.T) {
+	ctx := context.Background()
+	durable := store.NewMemoryStore()
+	d := &store.Donation{ID: "ch_1", CustomerEmail: "ana@example.org", Status: store.StatusSucceeded, CreatedAt: time.Now()}
+	if err := NewDonationStore(durable, mustKeys(t, oldKey)).SaveDonation(ctx, d); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := mustKeys(t, newKey+","+oldKey)
+	if n, err := Reencrypt(ctx, changingStore{durable}, rotated); err != nil || n != 1 {
+		t.Fatalf("Reencrypt = %d, %v", n, err)
+	}
+	got, _ := durable.GetDonation(ctx, "ch_1")
+	if got.Status != store.StatusRefunded || !rotated.current(got) {
+		t.Errorf("stored donation = %+v", got)
+	}
+}
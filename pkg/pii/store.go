@@ -0,0 +1,196 @@
+package pii
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/vedrankolka/donation-server/pkg/listing"
+	"github.com/vedrankolka/donation-server/pkg/store"
+)
+
+// field is a personal field of donations, by its JSON name.
+type field struct {
+	name  string
+	value func(d *store.Donation) *string
+}
+
+// fields are encrypted. The country of addresses is not, as reports and
+// taxes are by country and it does not identify anyone.
+var fields = []field{
+	{"customerName", func(d *store.Donation) *string { return &d.CustomerName }},
+	{"customerEmail", func(d *store.Donation) *string { return &d.CustomerEmail }},
+	{"clientIP", func(d *store.Donation) *string { return &d.ClientIP }},
+	{"message", func(d *store.Donation) *string { return &d.Message }},
+	{"displayName", func(d *store.Donation) *string { return &d.DisplayName }},
+	{"address.line1", func(d *store.Donation) *string { return &d.Address.Line1 }},
+	{"address.line2", func(d *store.Donation) *string { return &d.Address.Line2 }},
+	{"address.city", func(d *store.Donation) *string { return &d.Address.City }},
+	{"address.postalCode", func(d *store.Donation) *string { return &d.Address.PostalCode }},
+	{"address.state", func(d *store.Donation) *string { return &d.Address.State }},
+}
+
+// each calls fn with the context and the value of every personal field of a
+// copy of the donation, and returns the copy.
+func each(d *store.Donation, fn func(context string, value *string) error) (*store.Donation, error) {
+	c := *d
+	if d.Address != nil {
+		a := *d.Address
+		c.Address = &a
+	}
+	for _, f := range fields {
+		if c.Address == nil && strings.HasPrefix(f.name, "address.") {
+			continue
+		}
+		if err := fn(d.ID+"/"+f.name, f.value(&c)); err != nil {
+			return nil, fmt.Errorf("%s of donation %s: %w", f.name, d.ID, err)
+		}
+	}
+	return &c, nil
+}
+
+func (kr *Keyring) encryptDonation(d *store.Donation) (*store.Donation, error) {
+	return each(d, func(context string, value *string) (err error) {
+		*value, err = kr.Encrypt(*value, context)
+		return err
+	})
+}
+
+func (kr *Keyring) decryptDonation(d *store.Donation) (*store.Donation, error) {
+	return each(d, func(context string, value *string) (err error) {
+		*value, err = kr.Decrypt(*value, context)
+		return err
+	})
+}
+
+// current reports whether all personal fields of the donation are encrypted
+// with the primary key.
+func (kr *Keyring) current(d *store.Donation) bool {
+	current := true
+	each(d, func(_ string, value *string) error {
+		current = current && kr.Current(*value)
+		return nil
+	})
+	return current
+}
+
+// DonationStore is a store.DonationStore encrypting the personal fields of
+// donations before they are saved, and decrypting them when they are read.
+type DonationStore struct {
+	store.DonationStore
+	keys *Keyring
+}
+
+// NewDonationStore returns the store encrypting the donations it saves in donations.
+func NewDonationStore(donations store.DonationStore, keys *Keyring) *DonationStore {
+	return &DonationStore{DonationStore: donations, keys: keys}
+}
+
+func (s *DonationStore) SaveDonation(ctx context.Context, d *store.Donation) error {
+	encrypted, err := s.keys.encryptDonation(d)
+	if err != nil {
+		return err
+	}
+	return s.DonationStore.SaveDonation(ctx, encrypted)
+}
+
+func (s *DonationStore) GetDonation(ctx context.Context, id string) (*store.Donation, error) {
+	d, err := s.DonationStore.GetDonation(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.keys.decryptDonation(d)
+}
+
+func (s *DonationStore) ListDonations(ctx context.Context, q listing.Query) ([]*store.Donation, string, error) {
+	page, next, err := s.DonationStore.ListDonations(ctx, q)
+	if err != nil {
+		return nil, "", err
+	}
+	for i, d := range page {
+		if page[i], err = s.keys.decryptDonation(d); err != nil {
+			return nil, "", err
+		}
+	}
+	return page, next, nil
+}
+
+// ReencryptStore is the store of the donations Reencrypt encrypts in place.
+type ReencryptStore interface {
+	store.DonationStore
+	store.DonationUpdater
+}
+
+// conflictRetries is how many times a donation changed while it is
+// re-encrypted is read again.
+const conflictRetries = 3
+
+// Reencrypt encrypts the personal fields of the donations in the store with
+// the primary key, where they are not encrypted or encrypted with another
+// key, and returns the number of donations it updated. Donations are updated
+// only if they did not change since they were read, and read again if they
+// did, so it can run while the server saves donations. Once it is done, the
+// other keys can be removed.
+func Reencrypt(ctx context.Context, donations ReencryptStore, keys *Keyring) (int, error) {
+	q, err := store.DonationListSpec.Parse(url.Values{"sort": {"created"}})
+	if err != nil {
+		return 0, err
+	}
+	q.Limit = listing.MaxLimit
+
+	saved := 0
+	for {
+		page, next, err := donations.ListDonations(ctx, q)
+		if err != nil {
+			return saved, err
+		}
+		for _, d := range page {
+			updated, err := reencrypt(ctx, donations, keys, d)
+			if err != nil {
+				return saved, err
+			}
+			if updated {
+				saved++
+			}
+		}
+		if next == "" {
+			return saved, nil
+		}
+		if q.Cursor, err = listing.DecodeCursor(next); err != nil {
+			return saved, err
+		}
+	}
+}
+
+// reencrypt encrypts the personal fields of a donation with the primary key
+// and reports whether it was updated, which it is not if it is current or
+// was deleted.
+func reencrypt(ctx context.Context, donations ReencryptStore, keys *Keyring, d *store.Donation) (bool, error) {
+	for attempt := 0; ; attempt++ {
+		if keys.current(d) {
+			return false, nil
+		}
+		plain, err := keys.decryptDonation(d)
+		if err != nil {
+			return false, err
+		}
+		encrypted, err := keys.encryptDonation(plain)
+		if err != nil {
+			return false, err
+		}
+		err = donations.UpdateDonation(ctx, d, encrypted)
+		if !errors.Is(err, store.ErrConflict) {
+			return err == nil, err
+		}
+		if attempt == conflictRetries {
+			return false, fmt.Errorf("donation %s: %w", d.ID, err)
+		}
+		if d, err = donations.GetDonation(ctx, d.ID); errors.Is(err, store.ErrNotFound) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+	}
+}
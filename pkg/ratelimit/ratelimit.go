@@ -0,0 +1,258 @@
+// Package ratelimit limits the requests of each client IP address to the
+// public endpoints, so a script cannot create thousands of payment intents.
+// Every address has a token bucket: it holds up to a burst of requests and
+// refills at the configured rate. Requests finding the bucket empty are
+// refused with 429 Too Many Requests and Retry-After.
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/clientip"
+	"github.com/vedrankolka/donation-server/pkg/cors"
+	"github.com/vedrankolka/donation-server/pkg/metrics"
+	"github.com/vedrankolka/donation-server/pkg/requestid"
+)
+
+const (
+	// ErrorCode is the code of the error limited requests are answered with.
+	ErrorCode = "rate_limited"
+	// sweepInterval is how often the buckets of idle clients are dropped.
+	sweepInterval = time.Minute
+	// alertInterval is how often limited requests are logged.
+	alertInterval = time.Minute
+	// ipv6PrefixBits is the prefix IPv6 clients are limited by, as one
+	// client usually has a whole /64.
+	ipv6PrefixBits = 64
+)
+
+var (
+	limited = metrics.NewCounterVec(
+		"donation_server_rate_limited_requests_total",
+		"Requests refused with 429 Too Many Requests because their client was over the rate limit, by endpoint.",
+		"endpoint",
+	)
+	trackedClients = metrics.NewGaugeVec(
+		"donation_server_rate_limited_clients",
+		"Client addresses whose requests are counted by the rate limiter.",
+	)
+)
+
+// Rate is a number of requests per period, e.g. 20 a minute.
+type Rate struct {
+	Requests int
+	Per      time.Duration
+}
+
+// ParseRate parses a rate like "20/m", with a period of "s", "m" or "h", or
+// a duration like "20/10m".
+func ParseRate(s string) (Rate, error) {
+	i := strings.Index(s, "/")
+	if i < 0 {
+		return Rate{}, fmt.Errorf("invalid rate %q, it must be like 20/m", s)
+	}
+	requests, err := strconv.Atoi(strings.TrimSpace(s[:i]))
+	if err != nil || requests < 1 {
+		return Rate{}, fmt.Errorf("invalid rate %q, the number of requests must be positive", s)
+	}
+	period := strings.TrimSpace(s[i+1:])
+	switch period {
+	case "s", "m", "h":
+		period = "1" + period
+	}
+	per, err := time.ParseDuration(period)
+	if err != nil || per <= 0 {
+		return Rate{}, fmt.Errorf("invalid rate %q, the period must be s, m, h or a duration", s)
+	}
+	return Rate{Requests: requests, Per: per}, nil
+}
+
+func (r Rate) String() string {
+	return fmt.Sprintf("%d/%s", r.Requests, r.Per)
+}
+
+// perSecond returns the tokens a bucket gets back per second.
+func (r Rate) perSecond() float64 {
+	return float64(r.Requests) / r.Per.Seconds()
+}
+
+// Config describes the rate limit and the clients exempt from it.
+type Config struct {
+	Rate Rate
+	// Burst is the number of requests a client can make at once, Rate.Requests
+	// if not set.
+	Burst int
+	// AllowedCIDRs are never limited, e.g. the charity's office or a partner's
+	// servers.
+	AllowedCIDRs []*net.IPNet
+	// AllowedOrigins are origins, as matched by cors.Policy, whose requests are
+	// never limited, e.g. "https://*.example.org". Browsers set the Origin
+	// header, other clients can send any, so they only exempt pages of trusted
+	// sites that many donors share an address behind, like a kiosk network.
+	AllowedOrigins []string
+	// ClientIPHeader is the header holding the client IP when running behind a proxy.
+	ClientIPHeader clientip.Header
+}
+
+// bucket holds the tokens of a client.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter limits the requests of client addresses.
+type Limiter struct {
+	config  Config
+	origins cors.Policy
+	// now returns the current time, replaced in tests.
+	now func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	lastAlert time.Time
+	// limitedSince is the number of requests limited since the last alert.
+	limitedSince int
+}
+
+// NewLimiter creates a Limiter from the config.
+func NewLimiter(config Config) *Limiter {
+	if config.Burst < 1 {
+		config.Burst = config.Rate.Requests
+	}
+	return &Limiter{
+		config:  config,
+		origins: cors.Policy{Origins: config.AllowedOrigins},
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Middleware answers requests of clients over the limit with 429 Too Many
+// Requests and Retry-After.
+func (l *Limiter) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if l.exempt(r) {
+			next(w, r)
+			return
+		}
+		ip := clientip.FromRequest(r, l.config.ClientIPHeader)
+		if ip == nil {
+			// Without an address there is nothing to limit by.
+			next(w, r)
+			return
+		}
+
+		if retryAfter := l.Take(ip); retryAfter > 0 {
+			limited.Inc(r.URL.Path)
+			l.alert(r, ip)
+			seconds := int(math.Ceil(retryAfter.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error": map[string]string{
+					"message":   fmt.Sprintf("Too many requests, please try again in %d seconds.", seconds),
+					"code":      ErrorCode,
+					"requestId": requestid.FromContext(r.Context()),
+				},
+			})
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// exempt reports whether the request comes from an allowed address or origin.
+func (l *Limiter) exempt(r *http.Request) bool {
+	if origin := r.Header.Get("Origin"); origin != "" && l.origins.Allows(origin) {
+		return true
+	}
+	if len(l.config.AllowedCIDRs) == 0 {
+		return false
+	}
+	ip := clientip.FromRequest(r, l.config.ClientIPHeader)
+	for _, n := range l.config.AllowedCIDRs {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Take takes a token of the client's bucket, or returns how long until it
+// has one if it is empty.
+func (l *Limiter) Take(ip net.IP) time.Duration {
+	key := clientKey(ip)
+	now := l.now()
+	rate := l.config.Rate.perSecond()
+	burst := float64(l.config.Burst)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[key] = b
+		trackedClients.Set(float64(len(l.buckets)))
+	}
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(burst, b.tokens+elapsed*rate)
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	b.tokens--
+	return 0
+}
+
+// sweep drops the buckets that have refilled, as if their clients were new,
+// at most once per sweepInterval.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	refill := time.Duration(float64(l.config.Burst) / l.config.Rate.perSecond() * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= refill {
+			delete(l.buckets, key)
+		}
+	}
+	trackedClients.Set(float64(len(l.buckets)))
+}
+
+// alert logs that requests are limited, at most once per alertInterval.
+func (l *Limiter) alert(r *http.Request, ip net.IP) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.limitedSince++
+	if l.now().Sub(l.lastAlert) < alertInterval {
+		return
+	}
+	requestid.Printf(r.Context(), "[RATE LIMIT] %s is over %s on %s, limited %d requests since the last alert\n",
+		ip, l.config.Rate, r.URL.Path, l.limitedSince)
+	l.lastAlert, l.limitedSince = l.now(), 0
+}
+
+// clientKey returns the key of the bucket of an address, the /64 prefix of
+// IPv6 addresses.
+func clientKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	return ip.Mask(net.CIDRMask(ipv6PrefixBits, 8*net.IPv6len)).String()
+}
@@ -0,0 +1,107 @@
+package ratelimit
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/geoblock"
+)
+
+func TestParseRate(t *testing.T) {
+	for s, want := range map[string]Rate{
+		"20/m":   {20, time.Minute},
+		"5 / s":  {5, time.Second},
+		"100/h":  {100, time.Hour},
+		"30/10m": {30, 10 * time.Minute},
+	} {
+		if got, err := ParseRate(s); err != nil || got != want {
+			t.Errorf("ParseRate(%q) = %v, %v, want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "20", "0/m", "x/m", "20/day", "20/-1m"} {
+		if _, err := ParseRate(s); err == nil {
+			t.Errorf("ParseRate(%q) succeeded, want an error", s)
+		}
+	}
+}
+
+func TestTake(t *testing.T) {
+	now := time.Date(2024, time.May, 4, 10, 0, 0, 0, time.UTC)
+	l := NewLimiter(Config{Rate: Rate{Requests: 2, Per: time.Minute}, Burst: 3})
+	l.now = func() time.Time { return now }
+
+	ip := net.ParseIP("192.0.2.1")
+	for i := 0; i < 3; i++ {
+		if retryAfter := l.Take(ip); retryAfter != 0 {
+			t.Fatalf("request %d of the burst must wait %s", i+1, retryAfter)
+		}
+	}
+	if retryAfter := l.Take(ip); retryAfter != 30*time.Second {
+		t.Errorf("request over the burst must wait %s, want 30s", retryAfter)
+	}
+	if retryAfter := l.Take(net.ParseIP("192.0.2.2")); retryAfter != 0 {
+		t.Errorf("another client must wait %s", retryAfter)
+	}
+
+	now = now.Add(30 * time.Second)
+	if retryAfter := l.Take(ip); retryAfter != 0 {
+		t.Errorf("request after a refill must wait %s", retryAfter)
+	}
+
+	// Addresses of the same IPv6 /64 share a bucket.
+	for i, s := range []string{"2001:db8::1", "2001:db8::2", "2001:db8::3"} {
+		if retryAfter := l.Take(net.ParseIP(s)); retryAfter != 0 {
+			t.Fatalf("request %d of the /64 must wait %s", i+1, retryAfter)
+		}
+	}
+	if retryAfter := l.Take(net.ParseIP("2001:db8::ffff")); retryAfter == 0 {
+		t.Error("the /64 is not limited")
+	}
+
+	now = now.Add(2 * time.Minute)
+	l.Take(net.ParseIP("192.0.2.3"))
+	if len(l.buckets) != 1 {
+		t.Errorf("%d buckets are kept after the others refilled, want 1", len(l.buckets))
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	allowed, err := geoblock.ParseCIDRs("198.51.100.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewLimiter(Config{
+		Rate:           Rate{Requests: 1, Per: time.Minute},
+		AllowedCIDRs:   allowed,
+		AllowedOrigins: []string{"https://*.example.org"},
+	})
+	handler := l.Middleware(func(w http.ResponseWriter, r *http.Request) {})
+
+	serve := func(addr, origin string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/create-payment-intent", nil)
+		r.RemoteAddr = addr + ":1234"
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	serve("192.0.2.1", "")
+	w := serve("192.0.2.1", "https://evil.example")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" {
+		t.Errorf("the second request got %d with Retry-After %q, want 429 with 60", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := serve("192.0.2.1", "https://kiosk.example.org"); w.Code != http.StatusOK {
+		t.Errorf("a request of an allowed origin got %d", w.Code)
+	}
+	for i := 0; i < 3; i++ {
+		if w := serve("198.51.100.7", ""); w.Code != http.StatusOK {
+			t.Errorf("request %d of an allowed CIDR got %d", i+1, w.Code)
+		}
+	}
+}
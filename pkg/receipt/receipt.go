@@ -0,0 +1,170 @@
+// Package receipt issues donation receipts: numbered documents of donations,
+// rendered from templates and delivered to the donors, e.g. attached to an
+// email. Receipts are issued once per donation and keep their number when
+// delivered again.
+package receipt
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/notifier"
+)
+
+// EmailKind is the kind of the emails receipts are delivered with.
+const EmailKind = "receipt"
+
+// Receipt is the receipt of a donation.
+type Receipt struct {
+	Number     string `json:"number"`
+	DonationID string `json:"donationID"`
+	DonorName  string `json:"donorName"`
+	DonorEmail string `json:"donorEmail"`
+	// Amount donated in the smallest unit of the currency.
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+	Campaign string `json:"campaign,omitempty"`
+	// Date of the donation.
+	Date     time.Time `json:"date"`
+	IssuedAt time.Time `json:"issuedAt"`
+	// DeliveredAt is when the receipt was delivered, nil until then.
+	DeliveredAt *time.Time `json:"deliveredAt,omitempty"`
+}
+
+// Number formats the number of a receipt, e.g. "R-2024-000042".
+func Number(prefix string, year int, sequence int64) string {
+	return fmt.Sprintf("%s%d-%06d", prefix, year, sequence)
+}
+
+// Document is a rendered receipt.
+type Document struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// Delivery is a receipt rendered for delivery.
+type Delivery struct {
+	Receipt *Receipt
+	// Subject and Body of the message accompanying the document, plain text.
+	Subject  string
+	Body     string
+	Document Document
+}
+
+// Deliverer delivers receipts to donors.
+type Deliverer interface {
+	Deliver(ctx context.Context, delivery *Delivery) error
+}
+
+// EmailDeliverer emails receipts to donors with the document attached, through
+// the email or webhook notifier.
+type EmailDeliverer struct {
+	Notifier notifier.EmailNotifier
+}
+
+// Deliver emails the receipt. The email has the same ID when the receipt is
+// delivered again, so receivers can drop repeats.
+func (d EmailDeliverer) Deliver(ctx context.Context, delivery *Delivery) error {
+	r := delivery.Receipt
+	if r.DonorEmail == "" {
+		return fmt.Errorf("donor of receipt %s has no email", r.Number)
+	}
+	return d.Notifier.NotifyEmail(ctx, notifier.Email{
+		ID:      EmailKind + "-" + r.Number,
+		Kind:    EmailKind,
+		To:      r.DonorEmail,
+		Name:    r.DonorName,
+		Subject: delivery.Subject,
+		Body:    delivery.Body,
+		Attachment: &notifier.Attachment{
+			Filename:    delivery.Document.Filename,
+			ContentType: delivery.Document.ContentType,
+			Data:        delivery.Document.Data,
+		},
+	})
+}
+
+// DirDeliverer writes the documents of receipts to a directory, e.g. to print
+// and post them, or for a service sending them.
+type DirDeliverer struct {
+	Dir string
+}
+
+// Deliver writes the document, replacing an earlier one of the receipt.
+func (d DirDeliverer) Deliver(ctx context.Context, delivery *Delivery) error {
+	path := filepath.Join(d.Dir, delivery.Document.Filename)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, delivery.Document.Data, 0o640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Issuer renders receipts and delivers them.
+type Issuer struct {
+	deliverer    Deliverer
+	templates    *Templates
+	organization string
+	prefix       string
+}
+
+// Option configures an Issuer.
+type Option func(*Issuer)
+
+// WithTemplates replaces the built-in templates.
+func WithTemplates(t *Templates) Option {
+	return func(i *Issuer) {
+		i.templates = t
+	}
+}
+
+// WithOrganization sets the name of the charity on the receipts.
+func WithOrganization(name string) Option {
+	return func(i *Issuer) {
+		i.organization = name
+	}
+}
+
+// WithPrefix sets the prefix of receipt numbers, "R-" by default.
+func WithPrefix(prefix string) Option {
+	return func(i *Issuer) {
+		i.prefix = prefix
+	}
+}
+
+// NewIssuer returns an Issuer delivering receipts with the deliverer.
+func NewIssuer(deliverer Deliverer, opts ...Option) *Issuer {
+	i := &Issuer{deliverer: deliverer, prefix: "R-"}
+	for _, opt := range opts {
+		opt(i)
+	}
+	if i.templates == nil {
+		i.templates = DefaultTemplates()
+	}
+	return i
+}
+
+// Number returns the number of the receipt with the sequence number in the
+// year.
+func (i *Issuer) Number(year int, sequence int64) string {
+	return Number(i.prefix, year, sequence)
+}
+
+// Render renders the receipt for delivery.
+func (i *Issuer) Render(r *Receipt) (*Delivery, error) {
+	return i.templates.render(Data{Receipt: *r, Organization: i.organization})
+}
+
+// Deliver renders the receipt and delivers it.
+func (i *Issuer) Deliver(ctx context.Context, r *Receipt) error {
+	delivery, err := i.Render(r)
+	if err != nil {
+		return err
+	}
+	delivery.Receipt = r
+	return i.deliverer.Deliver(ctx, delivery)
+}
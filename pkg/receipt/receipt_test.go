@@ -0,0 +1,77 @@
+package receipt
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/notifier"
+)
+
+type emails []notifier.Email
+
+func (e *emails) NotifyEmail(ctx context.Context, email notifier.Email) error {
+	*e = append(*e, email)
+	return nil
+}
+
+func testReceipt() *Receipt {
+	date := time.Date(2024, time.May, 4, 10, 0, 0, 0, time.UTC)
+	return &Receipt{Number: Number("R-", 2024, 42), DonationID: "ch_1", DonorName: "Ana <Horvat>",
+		DonorEmail: "ana@example.org", Amount: 2550, Currency: "eur", Campaign: "winter", Date: date, IssuedAt: date}
+}
+
+func TestEmailDeliverer(t *testing.T) {
+	var sent emails
+	issuer := NewIssuer(EmailDeliverer{Notifier: &sent}, WithOrganization("Charity"))
+	if err := issuer.Deliver(context.Background(), testReceipt()); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 1 {
+		t.Fatalf("%d emails were sent, want 1", len(sent))
+	}
+	email := sent[0]
+	if email.ID != "receipt-R-2024-000042" || email.To != "ana@example.org" || email.Subject != "Your donation receipt R-2024-000042" {
+		t.Errorf("unexpected email %+v", email)
+	}
+	if !strings.Contains(email.Body, "25.50 EUR on May 4, 2024 to Charity") {
+		t.Errorf("unexpected body %q", email.Body)
+	}
+	a := email.Attachment
+	if a == nil || a.Filename != "receipt-R-2024-000042.html" || !strings.HasPrefix(a.ContentType, "text/html") {
+		t.Fatalf("unexpected attachment %+v", a)
+	}
+	if document := string(a.Data); !strings.Contains(document, "Ana &lt;Horvat&gt;") || !strings.Contains(document, "25.50 EUR") {
+		t.Errorf("the document is missing the escaped donor or the amount: %s", document)
+	}
+}
+
+func TestDirDeliverer(t *testing.T) {
+	dir := t.TempDir()
+	if err := NewIssuer(DirDeliverer{Dir: dir}).Deliver(context.Background(), testReceipt()); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "receipt-R-2024-000042.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "R-2024-000042") {
+		t.Errorf("the written receipt is missing its number: %s", data)
+	}
+}
+
+func TestTemplatesInvalid(t *testing.T) {
+	for name, files := range map[string]map[string]string{
+		"unknown":    {DocumentTemplate: "x", EmailTemplate: "Subject\n", "pdf": "x"},
+		"missing":    {DocumentTemplate: "x"},
+		"no subject": {DocumentTemplate: "x", EmailTemplate: "\nbody"},
+		"field":      {DocumentTemplate: "{{.Missing}}", EmailTemplate: "Subject\n"},
+	} {
+		if _, err := NewTemplates(files); err == nil {
+			t.Errorf("%s: NewTemplates succeeded, want an error", name)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package receipt
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/currency"
+)
+
+// Names of the templates.
+const (
+	// DocumentTemplate renders the receipt as an HTML document.
+	DocumentTemplate = "receipt.html"
+	// EmailTemplate renders the message accompanying it, the first line is the
+	// subject and the rest the body.
+	EmailTemplate = "email"
+)
+
+// templateExt is the extension of template files.
+const templateExt = ".tmpl"
+
+// Data is the data templates are executed with. The fields of the receipt are
+// promoted, so a template can use {{.Number}} directly.
+type Data struct {
+	Receipt
+	// Organization is the name of the charity.
+	Organization string
+}
+
+// defaultTemplates are used for templates without a file.
+var defaultTemplates = map[string]string{
+	DocumentTemplate: `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Donation receipt {{.Number}}</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 2em auto; color: #222; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 0.4em 0; border-bottom: 1px solid #ddd; }
+</style>
+</head>
+<body>
+<h1>Donation receipt</h1>
+{{with .Organization}}<p>{{.}}</p>{{end}}
+<table>
+<tr><th>Receipt number</th><td>{{.Number}}</td></tr>
+<tr><th>Donor</th><td>{{.DonorName}}{{with .DonorEmail}}<br>{{.}}{{end}}</td></tr>
+<tr><th>Amount</th><td>{{money .Amount .Currency}}</td></tr>
+<tr><th>Date of donation</th><td>{{date "January 2, 2006" .Date}}</td></tr>
+{{with .Campaign}}<tr><th>Campaign</th><td>{{.}}</td></tr>{{end}}
+<tr><th>Issued</th><td>{{date "January 2, 2006" .IssuedAt}}</td></tr>
+</table>
+<p>Thank you for your donation{{with .Organization}} to {{.}}{{end}}.</p>
+</body>
+</html>
+`,
+	EmailTemplate: `Your donation receipt {{.Number}}
+Dear {{with .DonorName}}{{.}}{{else}}donor{{end}},
+
+thank you for your donation of {{money .Amount .Currency}} on {{date "January 2, 2006" .Date}}{{with .Organization}} to {{.}}{{end}}.
+Your receipt {{.Number}} is attached.
+
+Kind regards,
+{{with .Organization}}{{.}}{{else}}The team{{end}}
+`,
+}
+
+var funcs = map[string]interface{}{
+	// money formats an amount in the smallest unit of the currency, e.g.
+	// {{money .Amount .Currency}} is "25.00 EUR".
+	"money": currency.Format,
+	// date formats a time with a Go layout, e.g. {{date "2006-01-02" .Date}}.
+	"date": func(layout string, t time.Time) string {
+		return t.Format(layout)
+	},
+}
+
+// Templates render receipts and the emails they are delivered with.
+type Templates struct {
+	document *htmltemplate.Template
+	email    *template.Template
+}
+
+// DefaultTemplates returns the built-in templates.
+func DefaultTemplates() *Templates {
+	t, err := NewTemplates(defaultTemplates)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// LoadTemplates parses the templates in the directory, "receipt.html.tmpl"
+// and "email.tmpl", using the built-in template of a missing one.
+func LoadTemplates(dir string) (*Templates, error) {
+	files := make(map[string]string, len(defaultTemplates))
+	for name, text := range defaultTemplates {
+		files[name] = text
+		data, err := os.ReadFile(filepath.Join(dir, name+templateExt))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		files[name] = string(data)
+	}
+	return NewTemplates(files)
+}
+
+// NewTemplates parses the templates by name, which must be DocumentTemplate
+// and EmailTemplate. They are checked by rendering a sample receipt.
+func NewTemplates(files map[string]string) (*Templates, error) {
+	t := &Templates{}
+	for name, text := range files {
+		var err error
+		switch name {
+		case DocumentTemplate:
+			t.document, err = htmltemplate.New(name).Funcs(funcs).Option("missingkey=error").Parse(text)
+		case EmailTemplate:
+			t.email, err = template.New(name).Funcs(funcs).Option("missingkey=error").Parse(text)
+		default:
+			return nil, fmt.Errorf("unknown receipt template %q, it must be %s or %s", name, DocumentTemplate, EmailTemplate)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %s template: %v", name, err)
+		}
+	}
+	if t.document == nil || t.email == nil {
+		return nil, fmt.Errorf("receipt templates need %s and %s", DocumentTemplate, EmailTemplate)
+	}
+
+	date := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	sample := Data{Receipt: Receipt{Number: Number("R-", 2024, 1), DonationID: "ch_1", DonorName: "Ana Horvat",
+		DonorEmail: "ana@example.org", Amount: 2500, Currency: "eur", Date: date, IssuedAt: date}, Organization: "Charity"}
+	if _, err := t.render(sample); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// render renders the document and email of a receipt.
+func (t *Templates) render(data Data) (*Delivery, error) {
+	var document, email bytes.Buffer
+	if err := t.document.Execute(&document, data); err != nil {
+		return nil, fmt.Errorf("could not render %s template: %v", DocumentTemplate, err)
+	}
+	if err := t.email.Execute(&email, data); err != nil {
+		return nil, fmt.Errorf("could not render %s template: %v", EmailTemplate, err)
+	}
+	subject, body := email.String(), ""
+	if i := strings.Index(subject, "\n"); i >= 0 {
+		subject, body = subject[:i], subject[i+1:]
+	}
+	if strings.TrimSpace(subject) == "" {
+		return nil, fmt.Errorf("%s template renders no subject", EmailTemplate)
+	}
+	return &Delivery{
+		Subject: strings.TrimSpace(subject),
+		Body:    body,
+		Document: Document{
+			Filename:    "receipt-" + data.Number + ".html",
+			ContentType: "text/html; charset=utf-8",
+			Data:        document.Bytes(),
+		},
+	}, nil
+}
@@ -0,0 +1,79 @@
+// Package recurring configures the tiers of recurring donations, monthly or
+// yearly amounts donors subscribe to, each backed by a recurring price of the
+// payment provider.
+package recurring
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Intervals of tiers.
+const (
+	IntervalMonth = "month"
+	IntervalYear  = "year"
+)
+
+// Tier is an amount donated every interval.
+type Tier struct {
+	ID string `json:"id"`
+	// Name is shown to donors, e.g. "Friend".
+	Name     string `json:"name,omitempty"`
+	Interval string `json:"interval"`
+	// Amount in the smallest currency unit.
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+	// PriceID is the recurring price of the payment provider with the same
+	// amount and interval, e.g. a Stripe price.
+	PriceID string `json:"priceID"`
+}
+
+// Config holds the tiers donors can choose from.
+type Config struct {
+	Tiers []Tier `json:"tiers"`
+}
+
+// LoadConfig reads a JSON configuration of tiers from path.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("could not parse recurring donation config: %w", err)
+	}
+
+	ids := make(map[string]bool, len(config.Tiers))
+	for _, t := range config.Tiers {
+		if t.ID == "" || ids[t.ID] || t.Amount < 1 || t.Currency == "" || t.PriceID == "" ||
+			(t.Interval != IntervalMonth && t.Interval != IntervalYear) {
+			return nil, fmt.Errorf("invalid tier %+v", t)
+		}
+		ids[t.ID] = true
+	}
+
+	return &config, nil
+}
+
+// Tier returns the tier with the given ID.
+func (c *Config) Tier(id string) (Tier, bool) {
+	for _, t := range c.Tiers {
+		if t.ID == id {
+			return t, true
+		}
+	}
+	return Tier{}, false
+}
+
+// TierByPrice returns the tier of the provider's price.
+func (c *Config) TierByPrice(priceID string) (Tier, bool) {
+	for _, t := range c.Tiers {
+		if t.PriceID == priceID {
+			return t, true
+		}
+	}
+	return Tier{}, false
+}
@@ -0,0 +1,240 @@
+package report
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/csvsafe"
+	"github.com/vedrankolka/donation-server/pkg/currency"
+	"github.com/vedrankolka/donation-server/pkg/listing"
+	"github.com/vedrankolka/donation-server/pkg/store"
+)
+
+// Groupings of donations.
+const (
+	GroupNone     = "none"
+	GroupDay      = "day"
+	GroupWeek     = "week"
+	GroupMonth    = "month"
+	GroupCampaign = "campaign"
+	GroupCurrency = "currency"
+	GroupStatus   = "status"
+	// GroupTag counts donations with several tags in every one of them.
+	GroupTag = "tag"
+)
+
+// Groupings are all ways to group donations.
+var Groupings = []string{GroupNone, GroupDay, GroupWeek, GroupMonth, GroupCampaign, GroupCurrency, GroupStatus, GroupTag}
+
+// Formats of generated reports.
+const (
+	FormatCSV  = "csv"
+	FormatJSON = "json"
+)
+
+// Row sums up the donations of a group in one currency.
+type Row struct {
+	Group     string `json:"group"`
+	Currency  string `json:"currency"`
+	Donations int    `json:"donations"`
+	// Amount and Average are in the smallest currency unit.
+	Amount  int64 `json:"amount"`
+	Average int64 `json:"average"`
+}
+
+// Result is a generated report.
+type Result struct {
+	Name        string    `json:"name"`
+	GroupBy     string    `json:"groupBy"`
+	From        time.Time `json:"from"`
+	To          time.Time `json:"to"`
+	GeneratedAt time.Time `json:"generatedAt"`
+	Rows        []Row     `json:"rows"`
+}
+
+// Validate checks the grouping, format, schedule and filters of a definition,
+// defaulting the grouping to GroupNone and the format to FormatCSV.
+func Validate(def *store.ReportDefinition) error {
+	if strings.TrimSpace(def.Name) == "" {
+		return fmt.Errorf("name is required")
+	}
+	if def.GroupBy == "" {
+		def.GroupBy = GroupNone
+	}
+	if !contains(Groupings, def.GroupBy) {
+		return fmt.Errorf("groupBy must be one of %s", strings.Join(Groupings, ", "))
+	}
+	if def.Format == "" {
+		def.Format = FormatCSV
+	}
+	if def.Format != FormatCSV && def.Format != FormatJSON {
+		return fmt.Errorf("format must be %s or %s", FormatCSV, FormatJSON)
+	}
+	switch def.Schedule {
+	case "", store.ScheduleDaily, store.ScheduleWeekly, store.ScheduleMonthly:
+	default:
+		return fmt.Errorf("schedule must be %s, %s or %s", store.ScheduleDaily, store.ScheduleWeekly, store.ScheduleMonthly)
+	}
+	if def.Schedule != "" && len(def.Recipients) == 0 {
+		return fmt.Errorf("a scheduled report needs recipients")
+	}
+
+	_, err := query(def, time.Time{}, time.Time{})
+	return err
+}
+
+// query returns the query of the donations in the report. A zero from or to
+// keeps the created filter of the definition.
+func query(def *store.ReportDefinition, from, to time.Time) (listing.Query, error) {
+	values := url.Values{}
+	for name, value := range def.Filter {
+		values.Set(name, value)
+	}
+	q, err := store.DonationListSpec.Parse(values)
+	if err != nil {
+		return q, err
+	}
+
+	q.Limit = listing.MaxLimit
+	if !from.IsZero() {
+		q.Filter.CreatedGTE = from
+	}
+	if !to.IsZero() {
+		// The period ends right before to.
+		q.Filter.CreatedLTE = to.Add(-time.Nanosecond)
+	}
+	return q, nil
+}
+
+// Generate sums up the donations of the report created in [from, to).
+func Generate(ctx context.Context, donations store.DonationStore, def *store.ReportDefinition, from, to time.Time) (*Result, error) {
+	q, err := query(def, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := make(map[[2]string]*Row)
+	for {
+		page, next, err := donations.ListDonations(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range page {
+			for _, group := range groups(def.GroupBy, d) {
+				key := [2]string{group, d.Currency}
+				row, ok := rows[key]
+				if !ok {
+					row = &Row{Group: group, Currency: d.Currency}
+					rows[key] = row
+				}
+				row.Donations++
+				row.Amount += d.Amount
+			}
+		}
+		if next == "" {
+			break
+		}
+		if q.Cursor, err = listing.DecodeCursor(next); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &Result{
+		Name:        def.Name,
+		GroupBy:     def.GroupBy,
+		From:        q.Filter.CreatedGTE,
+		To:          to,
+		GeneratedAt: time.Now().UTC(),
+		Rows:        make([]Row, 0, len(rows)),
+	}
+	for _, row := range rows {
+		row.Average = row.Amount / int64(row.Donations)
+		result.Rows = append(result.Rows, *row)
+	}
+	sort.Slice(result.Rows, func(i, j int) bool {
+		if result.Rows[i].Group != result.Rows[j].Group {
+			return result.Rows[i].Group < result.Rows[j].Group
+		}
+		return result.Rows[i].Currency < result.Rows[j].Currency
+	})
+
+	return result, nil
+}
+
+func groups(groupBy string, d *store.Donation) []string {
+	switch groupBy {
+	case GroupDay:
+		return []string{d.CreatedAt.UTC().Format("2006-01-02")}
+	case GroupWeek:
+		year, week := d.CreatedAt.UTC().ISOWeek()
+		return []string{fmt.Sprintf("%d-W%02d", year, week)}
+	case GroupMonth:
+		return []string{d.CreatedAt.UTC().Format("2006-01")}
+	case GroupCampaign:
+		return []string{d.Campaign}
+	case GroupCurrency:
+		return []string{strings.ToUpper(d.Currency)}
+	case GroupStatus:
+		return []string{d.Status}
+	case GroupTag:
+		if len(d.Tags) == 0 {
+			return []string{""}
+		}
+		return d.Tags
+	default:
+		return []string{"all"}
+	}
+}
+
+// Render returns the report in the format, its content type and a file name.
+func (r *Result) Render(format string) ([]byte, string, string, error) {
+	filename := fmt.Sprintf("%s-%s.%s", slug(r.Name), r.GeneratedAt.Format("2006-01-02"), format)
+
+	if format == FormatJSON {
+		data, err := json.MarshalIndent(r, "", "  ")
+		return data, "application/json", filename, err
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{r.GroupBy, "currency", "donations", "amount", "average"})
+	for _, row := range r.Rows {
+		w.Write([]string{
+			// Groups may be campaigns chosen by donors.
+			csvsafe.Cell(row.Group),
+			row.Currency,
+			strconv.Itoa(row.Donations),
+			currency.FormatNumber(row.Amount, row.Currency),
+			currency.FormatNumber(row.Average, row.Currency),
+		})
+	}
+	w.Flush()
+	return buf.Bytes(), "text/csv; charset=utf-8", filename, w.Error()
+}
+
+func slug(name string) string {
+	s := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(name))
+	return strings.Trim(s, "-")
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
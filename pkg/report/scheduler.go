@@ -0,0 +1,153 @@
+package report
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/clock"
+	"github.com/vedrankolka/donation-server/pkg/jobs"
+	"github.com/vedrankolka/donation-server/pkg/notifier"
+	"github.com/vedrankolka/donation-server/pkg/store"
+)
+
+// CheckInterval is how often the scheduler looks for due reports.
+const CheckInterval = time.Minute
+
+// Period returns the schedule's period that ended last at or before t, in UTC:
+// the previous day, the previous week (from Monday) or the previous month.
+func Period(schedule string, t time.Time) (time.Time, time.Time) {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+
+	switch schedule {
+	case store.ScheduleWeekly:
+		weekday := (int(day.Weekday()) + 6) % 7 // Days since Monday.
+		to := day.AddDate(0, 0, -weekday)
+		return to.AddDate(0, 0, -7), to
+	case store.ScheduleMonthly:
+		to := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return to.AddDate(0, -1, 0), to
+	default:
+		return day.AddDate(0, 0, -1), day
+	}
+}
+
+// NextRun returns the end of the schedule's period containing t, when the
+// report of that period is delivered.
+func NextRun(schedule string, t time.Time) time.Time {
+	_, to := Period(schedule, t)
+	switch schedule {
+	case store.ScheduleWeekly:
+		return to.AddDate(0, 0, 7)
+	case store.ScheduleMonthly:
+		return to.AddDate(0, 1, 0)
+	default:
+		return to.AddDate(0, 0, 1)
+	}
+}
+
+// Scheduler generates the scheduled reports at the end of their periods and
+// delivers them with the notifier.
+type Scheduler struct {
+	reports   store.ReportStore
+	donations store.DonationStore
+	notifier  notifier.ReportNotifier
+	clock     clock.Clock
+}
+
+// Option configures a Scheduler.
+type Option func(*Scheduler)
+
+// WithClock tells the time of due reports by the clock instead of clock.Real.
+func WithClock(c clock.Clock) Option {
+	return func(s *Scheduler) {
+		s.clock = c
+	}
+}
+
+// NewScheduler creates a Scheduler of the reports in the store.
+func NewScheduler(reports store.ReportStore, donations store.DonationStore, notifier notifier.ReportNotifier, opts ...Option) *Scheduler {
+	s := &Scheduler{
+		reports:   reports,
+		donations: donations,
+		notifier:  notifier,
+		clock:     clock.Real,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Job returns the job delivering the due reports every CheckInterval, to run
+// with a jobs.Scheduler. Failed deliveries are not retried, their error is
+// kept in the report's LastError.
+func (s *Scheduler) Job() jobs.Job {
+	return jobs.Job{
+		Name:     "reports",
+		Schedule: clock.Every(CheckInterval),
+		Timeout:  CheckInterval * 10,
+		// Reports due before the job was registered are delivered at once.
+		Immediately: true,
+		Run: func(ctx context.Context, due time.Time) error {
+			return s.RunDue(ctx, s.clock.Now())
+		},
+	}
+}
+
+// RunDue delivers the reports due at now.
+func (s *Scheduler) RunDue(ctx context.Context, now time.Time) error {
+	due, err := s.reports.DueReports(ctx, now)
+	if err != nil {
+		return fmt.Errorf("could not get due reports: %w", err)
+	}
+
+	for _, def := range due {
+		from, to := Period(def.Schedule, *def.NextRunAt)
+		// Missed periods are skipped rather than delivered late.
+		run := store.ReportRun{Due: *def.NextRunAt, At: now.UTC(), Next: NextRun(def.Schedule, now)}
+		if err := s.Deliver(ctx, def, from, to); err != nil {
+			log.Printf("Could not deliver report %q: %v\n", def.ID, err)
+			run.Error = err.Error()
+		}
+
+		// Only the run is recorded, so changes of the report made during the
+		// delivery are kept, and a deleted report stays deleted.
+		err := s.reports.RecordReportRun(ctx, def.ID, run)
+		switch {
+		case errors.Is(err, store.ErrNotFound):
+			log.Printf("Report %q was deleted during its delivery.\n", def.ID)
+		case errors.Is(err, store.ErrConflict):
+			log.Printf("Report %q was rescheduled during its delivery.\n", def.ID)
+		case err != nil:
+			log.Printf("Could not record the delivery of report %q: %v\n", def.ID, err)
+		}
+	}
+	return nil
+}
+
+// Deliver generates the report of donations created in [from, to) and sends it to its recipients.
+func (s *Scheduler) Deliver(ctx context.Context, def *store.ReportDefinition, from, to time.Time) error {
+	result, err := Generate(ctx, s.donations, def, from, to)
+	if err != nil {
+		return err
+	}
+	body, contentType, filename, err := result.Render(def.Format)
+	if err != nil {
+		return err
+	}
+
+	return s.notifier.NotifyReport(ctx, notifier.Report{
+		ID:          def.ID,
+		Name:        def.Name,
+		Recipients:  def.Recipients,
+		From:        from,
+		To:          to,
+		Filename:    filename,
+		ContentType: contentType,
+		Body:        body,
+	})
+}
@@ -0,0 +1,87 @@
+// Package requestid gives every request an ID, returned in the X-Request-ID
+// header and error responses, added to log lines, sent to Stripe in
+// idempotency keys and to receivers of notifications, so a donor's complaint
+// can be traced across systems from a single ID.
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+
+	"github.com/vedrankolka/donation-server/pkg/logging"
+	"go.uber.org/zap"
+)
+
+// Header holds the ID of a request in responses and notifications.
+const Header = "X-Request-ID"
+
+// LogField holds the ID of a request in log lines.
+const LogField = "request_id"
+
+// prefix of IDs, making them recognizable in complaints.
+const prefix = "req_"
+
+type key struct{}
+
+// New returns a random ID.
+func New() string {
+	var b [12]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("requestid: could not read random bytes: %v", err))
+	}
+	return prefix + hex.EncodeToString(b[:])
+}
+
+// WithID returns a context of the request with the ID.
+func WithID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, key{}, id)
+}
+
+// FromContext returns the ID of the request of the context, or "" if it has none.
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(key{}).(string)
+	return id
+}
+
+// Middleware gives the request a new ID and sets it in the response header.
+// IDs sent by clients are not trusted, as they end up in idempotency keys.
+func Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := New()
+		w.Header().Set(Header, id)
+		next(w, r.WithContext(WithID(r.Context(), id)))
+	}
+}
+
+// Logger returns the logger adding the ID of the request of the context to
+// its lines, or the logger itself if the context has none.
+func Logger(ctx context.Context, l *zap.Logger) *zap.Logger {
+	if id := FromContext(ctx); id != "" {
+		return l.With(zap.String(LogField, id))
+	}
+	return l
+}
+
+// Printf logs like logging.Printf with the global logger of zap, with the ID
+// of the request of the context.
+func Printf(ctx context.Context, format string, v ...interface{}) {
+	logging.Printf(Logger(ctx, zap.L()), format, v...)
+}
+
+// Println logs like Printf, formatted like fmt.Sprintln.
+func Println(ctx context.Context, v ...interface{}) {
+	logging.Print(Logger(ctx, zap.L()), fmt.Sprintln(v...))
+}
+
+// IdempotencyKey returns the Stripe idempotency key of an operation of the
+// request of the context, e.g. "payment-intent-req_...", or "" if it has no ID.
+func IdempotencyKey(ctx context.Context, operation string) string {
+	id := FromContext(ctx)
+	if id == "" {
+		return ""
+	}
+	return operation + "-" + id
+}
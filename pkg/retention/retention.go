@@ -0,0 +1,323 @@
+// Package retention moves donations past their retention period to an
+// archival sink and prunes them from the store, keeping it small. Every run
+// is audited, and dry runs only report what would be archived.
+package retention
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/clock"
+	"github.com/vedrankolka/donation-server/pkg/jobs"
+	"github.com/vedrankolka/donation-server/pkg/listing"
+	"github.com/vedrankolka/donation-server/pkg/store"
+)
+
+const (
+	// RunInterval is how often the scheduled job runs.
+	RunInterval = 24 * time.Hour
+	// maxRuns is the number of runs kept for the admin API.
+	maxRuns = 50
+)
+
+// Policy archives the donations matching its filter older than its years.
+type Policy struct {
+	Name  string `json:"name"`
+	Years int    `json:"years"`
+	// Filter holds filters of /admin/donations except created, e.g. {"status": "held"}.
+	Filter map[string]string `json:"filter,omitempty"`
+}
+
+// query returns the query of the policy's donations created before the cutoff.
+func (p *Policy) query(cutoff time.Time) (listing.Query, error) {
+	values := url.Values{}
+	for name, value := range p.Filter {
+		values.Set(name, value)
+	}
+	q, err := store.DonationListSpec.Parse(values)
+	if err != nil {
+		return q, err
+	}
+	q.Limit = listing.MaxLimit
+	q.Filter.CreatedGTE = time.Time{}
+	q.Filter.CreatedLTE = cutoff.Add(-time.Nanosecond)
+	return q, nil
+}
+
+// LoadPolicies reads a JSON array of policies from the file.
+func LoadPolicies(path string) ([]Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var policies []Policy
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return nil, fmt.Errorf("invalid retention policies %s: %v", path, err)
+	}
+	for i := range policies {
+		if err := Validate(&policies[i]); err != nil {
+			return nil, fmt.Errorf("invalid retention policy %q: %v", policies[i].Name, err)
+		}
+	}
+	return policies, nil
+}
+
+// Validate checks the name, years and filters of a policy.
+func Validate(p *Policy) error {
+	if strings.TrimSpace(p.Name) == "" || strings.ContainsAny(p.Name, `/\`) {
+		return fmt.Errorf("name is required and cannot contain slashes")
+	}
+	if p.Years < 1 {
+		return fmt.Errorf("years must be at least 1")
+	}
+	for name := range p.Filter {
+		if strings.HasPrefix(name, listing.FilterCreated) {
+			return fmt.Errorf("the created filter is set by years")
+		}
+	}
+	_, err := p.query(time.Now())
+	return err
+}
+
+// Sink keeps archived donations and the audit trail of runs.
+type Sink interface {
+	// Archive appends donations to the archive of a policy's run and returns
+	// where they are kept.
+	Archive(ctx context.Context, runID, policy string, donations []*store.Donation) (string, error)
+	// Audit records a run.
+	Audit(ctx context.Context, run *Run) error
+}
+
+// FileSink archives donations as gzipped JSON lines in a directory, e.g. a
+// mounted bucket, one file per policy and run, and appends runs to audit.jsonl.
+type FileSink struct {
+	Dir string
+}
+
+func (fs *FileSink) Archive(ctx context.Context, runID, policy string, donations []*store.Donation) (string, error) {
+	path := filepath.Join(fs.Dir, fmt.Sprintf("%s-%s.jsonl.gz", runID, policy))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// Every batch is a gzip member, readers decompress them as one stream.
+	zw := gzip.NewWriter(f)
+	enc := json.NewEncoder(zw)
+	for _, d := range donations {
+		if err := enc.Encode(d); err != nil {
+			return "", err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	return path, f.Sync()
+}
+
+func (fs *FileSink) Audit(ctx context.Context, run *Run) error {
+	f, err := os.OpenFile(filepath.Join(fs.Dir, "audit.jsonl"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(run)
+}
+
+// Result is the outcome of a policy in a run.
+type Result struct {
+	Policy string    `json:"policy"`
+	Cutoff time.Time `json:"cutoff"`
+	// Matched donations were created before the cutoff, Archived of them
+	// are in the archive and pruned from the store.
+	Matched  int    `json:"matched"`
+	Archived int    `json:"archived"`
+	Archive  string `json:"archive,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Run is the audit record of a run of the policies.
+type Run struct {
+	ID         string    `json:"id"`
+	DryRun     bool      `json:"dryRun"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	Results    []Result  `json:"results"`
+}
+
+// Engine runs retention policies.
+type Engine struct {
+	donations store.DonationStore
+	sink      Sink
+	policies  []Policy
+	// dryRun makes scheduled runs dry runs.
+	dryRun   bool
+	schedule clock.Schedule
+	clock    clock.Clock
+
+	// mu makes runs exclusive and guards runs.
+	mu   sync.Mutex
+	runs []Run
+}
+
+// Option configures an Engine.
+type Option func(*Engine)
+
+// WithSchedule runs the job of the engine at the times of the schedule
+// instead of every RunInterval.
+func WithSchedule(schedule clock.Schedule) Option {
+	return func(e *Engine) {
+		e.schedule = schedule
+	}
+}
+
+// WithClock tells the time runs finish by the clock instead of clock.Real.
+func WithClock(c clock.Clock) Option {
+	return func(e *Engine) {
+		e.clock = c
+	}
+}
+
+// NewEngine creates an Engine archiving the donations of the policies to
+// the sink. Scheduled runs are dry runs if dryRun is set.
+func NewEngine(donations store.DonationStore, sink Sink, policies []Policy, dryRun bool, opts ...Option) *Engine {
+	e := &Engine{
+		donations: donations,
+		sink:      sink,
+		policies:  policies,
+		dryRun:    dryRun,
+		schedule:  clock.Every(RunInterval),
+		clock:     clock.Real,
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
+}
+
+// Policies returns the policies of the engine.
+func (e *Engine) Policies() []Policy {
+	return e.policies
+}
+
+// Runs returns the latest runs, newest first.
+func (e *Engine) Runs() []Run {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	runs := make([]Run, len(e.runs))
+	for i, run := range e.runs {
+		runs[len(runs)-1-i] = run
+	}
+	return runs
+}
+
+// Job returns the job running the policies at the times of the schedule,
+// every RunInterval by default, to run with a jobs.Scheduler. Scheduled runs
+// are dry runs if the engine's are. A run fails if a policy failed.
+func (e *Engine) Job() jobs.Job {
+	return jobs.Job{
+		Name:     "retention",
+		Schedule: e.schedule,
+		Timeout:  time.Hour,
+		// The policies run at once the first time, then on the schedule.
+		Immediately: true,
+		Run: func(ctx context.Context, due time.Time) error {
+			run := e.Run(ctx, due, e.dryRun)
+			for _, result := range run.Results {
+				if result.Error != "" {
+					return fmt.Errorf("policy %q failed: %s", result.Policy, result.Error)
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// Run archives and prunes the donations of every policy past its years at
+// now, or only counts them in a dry run, and audits the run.
+func (e *Engine) Run(ctx context.Context, now time.Time, dryRun bool) *Run {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	run := &Run{
+		ID:        now.UTC().Format("20060102T150405Z"),
+		DryRun:    dryRun,
+		StartedAt: now.UTC(),
+	}
+	for i := range e.policies {
+		result := e.apply(ctx, run.ID, &e.policies[i], now, dryRun)
+		if result.Error != "" {
+			log.Printf("Could not apply retention policy %q: %s\n", result.Policy, result.Error)
+		}
+		log.Printf("[RETENTION] Policy %q (dry run: %t): %d donations created before %s, %d archived.\n",
+			result.Policy, dryRun, result.Matched, result.Cutoff.Format("2006-01-02"), result.Archived)
+		run.Results = append(run.Results, result)
+	}
+	run.FinishedAt = e.clock.Now().UTC()
+
+	if err := e.sink.Audit(ctx, run); err != nil {
+		log.Printf("Could not audit retention run %s: %v\n", run.ID, err)
+	}
+	e.runs = append(e.runs, *run)
+	if len(e.runs) > maxRuns {
+		e.runs = e.runs[len(e.runs)-maxRuns:]
+	}
+	return run
+}
+
+// apply archives and prunes the policy's donations in batches of a page.
+func (e *Engine) apply(ctx context.Context, runID string, p *Policy, now time.Time, dryRun bool) Result {
+	result := Result{Policy: p.Name, Cutoff: now.UTC().AddDate(-p.Years, 0, 0)}
+	q, err := p.query(result.Cutoff)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	for {
+		page, next, err := e.donations.ListDonations(ctx, q)
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		result.Matched += len(page)
+
+		if dryRun {
+			if next == "" {
+				return result
+			}
+			if q.Cursor, err = listing.DecodeCursor(next); err != nil {
+				result.Error = err.Error()
+				return result
+			}
+			continue
+		}
+
+		// Pruned donations leave the list, so the first page is always the next batch.
+		if len(page) == 0 {
+			return result
+		}
+		if result.Archive, err = e.sink.Archive(ctx, runID, p.Name, page); err != nil {
+			result.Error = fmt.Sprintf("could not archive donations: %v", err)
+			return result
+		}
+		for _, d := range page {
+			if err := e.donations.DeleteDonation(ctx, d.ID); err != nil {
+				result.Error = fmt.Sprintf("could not prune donation %q: %v", d.ID, err)
+				return result
+			}
+			result.Archived++
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Package rollup maintains hourly and daily rollups of donations in the
+// store, so statistics answer instantly however many donations there are.
+package rollup
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/clock"
+	"github.com/vedrankolka/donation-server/pkg/listing"
+	"github.com/vedrankolka/donation-server/pkg/store"
+)
+
+const (
+	// RefreshInterval is how often the recent rollups are recomputed.
+	RefreshInterval = time.Minute
+	// RefreshWindow is how far back donations may still change, e.g. by
+	// webhooks Stripe retries for up to three days.
+	RefreshWindow = 4 * 24 * time.Hour
+)
+
+// Granularities are the sizes of rollups.
+var Granularities = []string{store.GranularityHour, store.GranularityDay}
+
+// Truncate returns the start of the hour or day of t, in UTC.
+func Truncate(granularity string, t time.Time) time.Time {
+	t = t.UTC()
+	if granularity == store.GranularityDay {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return t.Truncate(time.Hour)
+}
+
+// Aggregator computes the rollups of donations.
+type Aggregator struct {
+	donations store.DonationStore
+	rollups   store.RollupStore
+	clock     clock.Clock
+}
+
+// Option configures an Aggregator.
+type Option func(*Aggregator)
+
+// WithClock refreshes the rollups by the clock instead of clock.Real.
+func WithClock(c clock.Clock) Option {
+	return func(a *Aggregator) {
+		a.clock = c
+	}
+}
+
+// NewAggregator creates an Aggregator of the donations keeping the rollups in the store.
+func NewAggregator(donations store.DonationStore, rollups store.RollupStore, opts ...Option) *Aggregator {
+	a := &Aggregator{donations: donations, rollups: rollups, clock: clock.Real}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// Run backfills the rollups of every donation, then keeps the recent ones
+// up to date until the context is done.
+func (a *Aggregator) Run(ctx context.Context) {
+	start := a.clock.Now()
+	if err := a.Aggregate(ctx, time.Time{}, start); err != nil {
+		log.Printf("Could not backfill rollups: %v\n", err)
+	} else {
+		log.Printf("Backfilled rollups in %v.\n", a.clock.Now().Sub(start).Round(time.Millisecond))
+	}
+
+	clock.Run(ctx, a.clock, clock.Every(RefreshInterval), func(ctx context.Context, now time.Time) {
+		if err := a.Aggregate(ctx, now.Add(-RefreshWindow), now); err != nil {
+			log.Printf("Could not refresh rollups: %v\n", err)
+		}
+	})
+}
+
+// RefreshDay recomputes the rollups of the day of t, e.g. of a donation
+// refunded after RefreshWindow.
+func (a *Aggregator) RefreshDay(ctx context.Context, t time.Time) error {
+	return a.Aggregate(ctx, t, t)
+}
+
+// Aggregate recomputes the rollups of the days from from to now. If from is
+// zero, it recomputes them from the day of the oldest donation, so rollups of
+// donations archived by package retention are kept.
+func (a *Aggregator) Aggregate(ctx context.Context, from, now time.Time) error {
+	backfill := from.IsZero()
+	if !backfill {
+		from = Truncate(store.GranularityDay, from)
+	}
+	to := Truncate(store.GranularityDay, now).AddDate(0, 0, 1)
+
+	q, err := store.DonationListSpec.Parse(url.Values{})
+	if err != nil {
+		return err
+	}
+	q.Limit = listing.MaxLimit
+	q.Filter.CreatedGTE = from
+	q.Filter.CreatedLTE = to.Add(-time.Nanosecond)
+
+	oldest := to
+	rollups := make(map[string]map[[3]string]*store.Rollup, len(Granularities))
+	for _, granularity := range Granularities {
+		rollups[granularity] = make(map[[3]string]*store.Rollup)
+	}
+	for {
+		page, next, err := a.donations.ListDonations(ctx, q)
+		if err != nil {
+			return err
+		}
+		for _, d := range page {
+			if d.CreatedAt.Before(oldest) {
+				oldest = d.CreatedAt
+			}
+			if d.Status == store.StatusHeld || d.Status == store.StatusRefunded {
+				continue
+			}
+			for _, granularity := range Granularities {
+				start := Truncate(granularity, d.CreatedAt)
+				key := [3]string{start.Format(time.RFC3339), d.Currency, d.Campaign}
+				r, ok := rollups[granularity][key]
+				if !ok {
+					r = &store.Rollup{Granularity: granularity, Start: start, Currency: d.Currency, Campaign: d.Campaign}
+					rollups[granularity][key] = r
+				}
+				r.Donations++
+				r.Amount += d.Amount
+			}
+		}
+		if next == "" {
+			break
+		}
+		if q.Cursor, err = listing.DecodeCursor(next); err != nil {
+			return err
+		}
+	}
+
+	if backfill {
+		from = Truncate(store.GranularityDay, oldest)
+	}
+	for granularity, byKey := range rollups {
+		list := make([]store.Rollup, 0, len(byKey))
+		for _, r := range byKey {
+			list = append(list, *r)
+		}
+		if err := a.rollups.ReplaceRollups(ctx, granularity, from, to, list); err != nil {
+			return err
+		}
+	}
+	return nil
+}
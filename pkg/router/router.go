@@ -0,0 +1,116 @@
+// Package router registers handlers with the methods they allow. Requests of
+// other methods are answered with 405 Method Not Allowed and an accurate Allow
+// header, OPTIONS requests with the Allow header, and HEAD requests of routes
+// allowing GET are handled like GET without a body, so monitoring probes and
+// embedding pages get an answer from every route.
+package router
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// order is the order methods are listed in Allow headers.
+var order = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+	http.MethodOptions,
+}
+
+// Router registers handlers on a ServeMux.
+type Router struct {
+	mux *http.ServeMux
+}
+
+// New returns a Router registering handlers on the mux.
+func New(mux *http.ServeMux) *Router {
+	return &Router{mux: mux}
+}
+
+// HandleFunc registers the handler of the pattern, as http.ServeMux does,
+// allowing the methods.
+func (rt *Router) HandleFunc(pattern string, handler http.HandlerFunc, methods ...string) {
+	handle := Methods(methods...)(handler)
+	if pattern == "/" {
+		// The catch-all pattern matches every path, those of other routes
+		// are left to the handler to answer 404 Not Found.
+		routed := handle
+		handle = func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/" {
+				handler(w, r)
+				return
+			}
+			routed(w, r)
+		}
+	}
+	rt.mux.HandleFunc(pattern, handle)
+}
+
+// Methods is a middleware allowing the methods, and HEAD and OPTIONS. HEAD
+// requests are handled as GET if only GET is allowed, the server discards the
+// body of their responses. OPTIONS requests are answered with 204 No Content
+// unless OPTIONS is allowed, then the handler answers them. CORS preflight
+// requests are answered by package cors before they are routed.
+func Methods(methods ...string) func(http.HandlerFunc) http.HandlerFunc {
+	allowed := make(map[string]bool, len(methods)+2)
+	for _, m := range methods {
+		allowed[strings.ToUpper(m)] = true
+	}
+	handlesOptions := allowed[http.MethodOptions]
+	headAsGet := allowed[http.MethodGet] && !allowed[http.MethodHead]
+	if allowed[http.MethodGet] {
+		allowed[http.MethodHead] = true
+	}
+	allowed[http.MethodOptions] = true
+	allow := allowHeader(allowed)
+
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.Method == http.MethodOptions && !handlesOptions:
+				w.Header().Set("Allow", allow)
+				w.WriteHeader(http.StatusNoContent)
+			case !allowed[r.Method]:
+				w.Header().Set("Allow", allow)
+				http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			case r.Method == http.MethodHead && headAsGet:
+				get := *r
+				get.Method = http.MethodGet
+				next(w, &get)
+			default:
+				next(w, r)
+			}
+		}
+	}
+}
+
+// allowHeader returns the value of the Allow header of the methods.
+func allowHeader(methods map[string]bool) string {
+	var list, other []string
+	for _, m := range order {
+		if methods[m] {
+			list = append(list, m)
+		}
+	}
+	for m := range methods {
+		if !contains(order, m) {
+			other = append(other, m)
+		}
+	}
+	sort.Strings(other)
+	return strings.Join(append(list, other...), ", ")
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
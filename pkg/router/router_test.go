@@ -0,0 +1,59 @@
+package router
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	mux := http.NewServeMux()
+	routes := New(mux)
+	routes.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			t.Errorf("the handler got %s, want GET", r.Method)
+		}
+		io.WriteString(w, "config")
+	}, http.MethodGet)
+	routes.HandleFunc("/admin/tags/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}, http.MethodGet, http.MethodPost, http.MethodDelete)
+	routes.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+		}
+	}, http.MethodGet, http.MethodHead)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	for _, test := range []struct {
+		method, path string
+		status       int
+		allow, body  string
+	}{
+		{"GET", "/config", http.StatusOK, "", "config"},
+		{"HEAD", "/config", http.StatusOK, "", ""},
+		{"OPTIONS", "/config", http.StatusNoContent, "GET, HEAD, OPTIONS", ""},
+		{"POST", "/config", http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS", "Method Not Allowed\n"},
+		{"OPTIONS", "/admin/tags/vip", http.StatusNoContent, "GET, HEAD, POST, DELETE, OPTIONS", ""},
+		{"PUT", "/admin/tags/vip", http.StatusMethodNotAllowed, "GET, HEAD, POST, DELETE, OPTIONS", "Method Not Allowed\n"},
+		{"OPTIONS", "/", http.StatusNoContent, "GET, HEAD, OPTIONS", ""},
+		{"OPTIONS", "/missing", http.StatusNotFound, "", "404 page not found\n"},
+	} {
+		req, err := http.NewRequest(test.method, server.URL+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != test.status || resp.Header.Get("Allow") != test.allow || string(body) != test.body {
+			t.Errorf("%s %s = %d with Allow %q and body %q, want %d with %q and %q", test.method, test.path,
+				resp.StatusCode, resp.Header.Get("Allow"), body, test.status, test.allow, test.body)
+		}
+	}
+}
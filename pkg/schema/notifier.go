@@ -0,0 +1,94 @@
+package schema
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/vedrankolka/donation-server/pkg/notifier"
+	"github.com/vedrankolka/donation-server/pkg/requestid"
+)
+
+// ValidatingNotifier checks every event against the schema of its type and version
+// before passing it on, so drift between the events and the published schemas
+// is caught early. Invalid events are not sent.
+type ValidatingNotifier struct {
+	notifier.Notifier
+}
+
+// NewValidatingNotifier wraps the notifier with schema validation.
+func NewValidatingNotifier(n notifier.Notifier) *ValidatingNotifier {
+	return &ValidatingNotifier{Notifier: n}
+}
+
+func (vn *ValidatingNotifier) Notify(ctx context.Context, event notifier.DonationEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	eventType := notifier.EventTypeDonation
+	if err := Validate(eventType, Version(ctx, eventType), data); err != nil {
+		requestid.Printf(ctx, "[SCHEMA] Invalid %s event %s: %v\n", eventType, data, err)
+		return err
+	}
+
+	return vn.Notifier.Notify(ctx, event)
+}
+
+func (vn *ValidatingNotifier) NotifyRecurring(ctx context.Context, event notifier.RecurringDonationEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	eventType := notifier.EventTypeRecurringDonation
+	if err := Validate(eventType, Version(ctx, eventType), data); err != nil {
+		requestid.Printf(ctx, "[SCHEMA] Invalid %s event %s: %v\n", eventType, data, err)
+		return err
+	}
+
+	return vn.Notifier.NotifyRecurring(ctx, event)
+}
+
+func (vn *ValidatingNotifier) NotifyPayment(ctx context.Context, event notifier.PaymentEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	if err := Validate(event.Type, Version(ctx, event.Type), data); err != nil {
+		requestid.Printf(ctx, "[SCHEMA] Invalid %s event %s: %v\n", event.Type, data, err)
+		return err
+	}
+
+	return vn.Notifier.NotifyPayment(ctx, event)
+}
+
+func (vn *ValidatingNotifier) Shutdown(ctx context.Context) (notifier.FlushReport, error) {
+	return notifier.Shutdown(ctx, vn.Notifier)
+}
+
+// VersionNotifier sends the donation events for which latest returns false
+// with the v1 schema, without the fields v2 added, and the others with the
+// latest, so consumers can be moved to v2 gradually.
+type VersionNotifier struct {
+	notifier.Notifier
+	latest func(ctx context.Context) bool
+}
+
+// NewVersionNotifier wraps the notifier, asking latest about every donation event.
+func NewVersionNotifier(n notifier.Notifier, latest func(ctx context.Context) bool) *VersionNotifier {
+	return &VersionNotifier{Notifier: n, latest: latest}
+}
+
+func (vn *VersionNotifier) Notify(ctx context.Context, event notifier.DonationEvent) error {
+	if !vn.latest(ctx) {
+		event.Message, event.DisplayName, event.Anonymous, event.NewsletterOptIn = "", "", false, false
+		ctx = WithVersion(ctx, notifier.EventTypeDonation, "v1")
+	}
+	return vn.Notifier.Notify(ctx, event)
+}
+
+func (vn *VersionNotifier) Shutdown(ctx context.Context) (notifier.FlushReport, error) {
+	return notifier.Shutdown(ctx, vn.Notifier)
+}
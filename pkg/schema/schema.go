@@ -0,0 +1,140 @@
+package schema
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ErrNotFound is returned for event types or versions without a schema.
+var ErrNotFound = errors.New("schema not found")
+
+// files holds the schemas as schemas/{type}/{version}.json.
+//
+//go:embed schemas
+var files embed.FS
+
+// Get returns the JSON Schema of the event type's version, e.g. ("donation", "v1").
+func Get(eventType, version string) ([]byte, error) {
+	if strings.Contains(eventType, "/") || strings.Contains(version, "/") {
+		return nil, ErrNotFound
+	}
+
+	data, err := files.ReadFile(path.Join("schemas", eventType, version+".json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+// Versions returns the schema versions of the event type, oldest first.
+func Versions(eventType string) []string {
+	entries, err := files.ReadDir(path.Join("schemas", eventType))
+	if err != nil {
+		return nil
+	}
+
+	versions := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		versions = append(versions, strings.TrimSuffix(entry.Name(), ".json"))
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		// "v10" comes after "v9".
+		if len(versions[i]) != len(versions[j]) {
+			return len(versions[i]) < len(versions[j])
+		}
+		return versions[i] < versions[j]
+	})
+	return versions
+}
+
+// Latest returns the latest schema version of the event type, or "" if it has none.
+func Latest(eventType string) string {
+	versions := Versions(eventType)
+	if len(versions) == 0 {
+		return ""
+	}
+	return versions[len(versions)-1]
+}
+
+type versionKey struct{ eventType string }
+
+// WithVersion returns a context of sending events of the type with an older
+// schema version than the latest, e.g. while the latest is rolled out.
+func WithVersion(ctx context.Context, eventType, version string) context.Context {
+	return context.WithValue(ctx, versionKey{eventType}, version)
+}
+
+// Version returns the schema version of the events of the type sent with the
+// context, the one of WithVersion or else the latest.
+func Version(ctx context.Context, eventType string) string {
+	if version, ok := ctx.Value(versionKey{eventType}).(string); ok {
+		return version
+	}
+	return Latest(eventType)
+}
+
+// Types returns the event types with a schema.
+func Types() []string {
+	entries, _ := files.ReadDir("schemas")
+	types := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		types = append(types, entry.Name())
+	}
+	return types
+}
+
+// Validate checks the JSON encoded event against the schema of the event type's version.
+func Validate(eventType, version string, event []byte) error {
+	data, err := Get(eventType, version)
+	if err != nil {
+		return err
+	}
+
+	var s Schema
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("invalid schema %s/%s: %v", eventType, version, err)
+	}
+	return s.Validate(event)
+}
+
+// Handler serves the schemas at /schemas/{type}/{version} and
+// lists the versions of every event type at /schemas.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	p := strings.Trim(strings.TrimPrefix(r.URL.Path, "/schemas"), "/")
+	if p == "" {
+		index := make(map[string][]string)
+		for _, eventType := range Types() {
+			index[eventType] = Versions(eventType)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(index)
+		return
+	}
+
+	parts := strings.Split(p, "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	data, err := Get(parts[0], parts[1])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(data)
+}
@@ -0,0 +1,110 @@
+package screening
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+type listEntry struct {
+	name    string
+	tokens  map[string]bool
+	email   string
+	country string
+	source  string
+}
+
+// CSVList is a Provider backed by a denied-party list in a CSV file with the
+// columns "name,email,country,source". Any column except source may be empty,
+// but every entry needs at least one of name, email or country. An entry with
+// only a country denies every party from that country.
+//
+// Names match if they consist of the same words in any order, ignoring case
+// and punctuation. Emails and countries match case-insensitively.
+type CSVList struct {
+	entries []listEntry
+}
+
+// LoadCSVList reads the denied-party list at path.
+func LoadCSVList(path string) (*CSVList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return NewCSVList(f)
+}
+
+// NewCSVList reads a denied-party list from r. A header row starting with
+// "name" is skipped.
+func NewCSVList(r io.Reader) (*CSVList, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+
+	list := &CSVList{}
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if line == 1 && strings.EqualFold(strings.TrimSpace(record[0]), "name") {
+			continue
+		}
+
+		field := func(i int) string {
+			if i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		entry := listEntry{
+			name:    field(0),
+			tokens:  nameTokens(field(0)),
+			email:   strings.ToLower(field(1)),
+			country: strings.ToUpper(field(2)),
+			source:  field(3),
+		}
+		if len(entry.tokens) == 0 && entry.email == "" && entry.country == "" {
+			return nil, fmt.Errorf("line %d: entry needs a name, email or country", line)
+		}
+
+		list.entries = append(list.entries, entry)
+	}
+
+	return list, nil
+}
+
+// Len returns the number of entries in the list.
+func (l *CSVList) Len() int {
+	return len(l.entries)
+}
+
+// Screen returns every entry matching the party.
+func (l *CSVList) Screen(ctx context.Context, party Party) ([]Match, error) {
+	tokens := nameTokens(party.Name)
+	email := strings.ToLower(strings.TrimSpace(party.Email))
+	country := strings.ToUpper(strings.TrimSpace(party.Country))
+
+	var matches []Match
+	for _, e := range l.entries {
+		switch {
+		case len(e.tokens) > 0 && sameName(e.tokens, tokens):
+			matches = append(matches, Match{Entry: e.name, Field: "name", Source: e.source})
+		case e.email != "" && e.email == email:
+			matches = append(matches, Match{Entry: e.email, Field: "email", Source: e.source})
+		case e.name == "" && e.email == "" && e.country != "" && e.country == country:
+			matches = append(matches, Match{Entry: e.country, Field: "country", Source: e.source})
+		}
+	}
+
+	return matches, nil
+}
@@ -0,0 +1,74 @@
+package screening
+
+import (
+	"context"
+	"strings"
+	"unicode"
+)
+
+// Status values stored on screened customers.
+const (
+	StatusCleared = "cleared"
+	StatusHeld    = "held"
+)
+
+// Party is the donor being screened.
+type Party struct {
+	Name    string
+	Email   string
+	Country string
+}
+
+// Match is an entry of a denied-party list that matched the screened party.
+type Match struct {
+	// Entry identifies the list entry, e.g. the listed name.
+	Entry string
+	// Field is the party field that matched: "name", "email" or "country".
+	Field string
+	// Source is the list the entry comes from, if known.
+	Source string
+}
+
+// Provider screens parties against a denied-party list.
+type Provider interface {
+	Screen(ctx context.Context, party Party) ([]Match, error)
+}
+
+// Status returns the status a party with the given matches should get.
+func Status(matches []Match) string {
+	if len(matches) > 0 {
+		return StatusHeld
+	}
+	return StatusCleared
+}
+
+// NormalizeName lowercases a name and collapses punctuation and whitespace
+// into single spaces, so "Doe,  John" becomes "doe john".
+func NormalizeName(name string) string {
+	fields := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return strings.Join(fields, " ")
+}
+
+// nameTokens returns the set of normalized tokens of a name.
+func nameTokens(name string) map[string]bool {
+	tokens := make(map[string]bool)
+	for _, t := range strings.Fields(NormalizeName(name)) {
+		tokens[t] = true
+	}
+	return tokens
+}
+
+// sameName reports whether two names consist of the same tokens, in any order.
+func sameName(a, b map[string]bool) bool {
+	if len(a) == 0 || len(a) != len(b) {
+		return false
+	}
+	for t := range a {
+		if !b[t] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,175 @@
+package search
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// MinScore is the lowest score of a result, the share of the query's
+// trigrams a document must contain.
+const MinScore = 0.5
+
+// Result is a document matching a query.
+type Result struct {
+	ID string
+	// Score is 1 for documents containing the query, otherwise the share of
+	// the query's trigrams in the document.
+	Score float64
+}
+
+// TrigramIndex finds documents by parts of their text, tolerating typos.
+// Texts are normalized to lowercase letters and digits without accents,
+// so "Žana" is found by "zana".
+type TrigramIndex struct {
+	mu       sync.RWMutex
+	texts    map[string]string
+	trigrams map[string]map[string]struct{}
+}
+
+// NewTrigramIndex creates an empty index.
+func NewTrigramIndex() *TrigramIndex {
+	return &TrigramIndex{
+		texts:    make(map[string]string),
+		trigrams: make(map[string]map[string]struct{}),
+	}
+}
+
+// Put indexes the texts of a document, replacing what was indexed for it before.
+func (ti *TrigramIndex) Put(id string, texts ...string) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+
+	ti.remove(id)
+
+	normalized := make([]string, 0, len(texts))
+	for _, text := range texts {
+		if text = Normalize(text); text != "" {
+			normalized = append(normalized, text)
+		}
+	}
+	text := strings.Join(normalized, " ")
+	ti.texts[id] = text
+
+	for _, trigram := range trigrams(text) {
+		ids, ok := ti.trigrams[trigram]
+		if !ok {
+			ids = make(map[string]struct{})
+			ti.trigrams[trigram] = ids
+		}
+		ids[id] = struct{}{}
+	}
+}
+
+// Remove drops a document from the index.
+func (ti *TrigramIndex) Remove(id string) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+
+	ti.remove(id)
+}
+
+func (ti *TrigramIndex) remove(id string) {
+	text, ok := ti.texts[id]
+	if !ok {
+		return
+	}
+	for _, trigram := range trigrams(text) {
+		delete(ti.trigrams[trigram], id)
+		if len(ti.trigrams[trigram]) == 0 {
+			delete(ti.trigrams, trigram)
+		}
+	}
+	delete(ti.texts, id)
+}
+
+// Search returns the documents matching the query, best first.
+func (ti *TrigramIndex) Search(query string) []Result {
+	query = Normalize(query)
+	if query == "" {
+		return nil
+	}
+
+	ti.mu.RLock()
+	defer ti.mu.RUnlock()
+
+	scores := make(map[string]float64)
+	queryTrigrams := trigrams(query)
+	if len(query) < 3 {
+		// Too short for trigrams, but short enough to scan.
+		for id, text := range ti.texts {
+			if strings.Contains(text, query) {
+				scores[id] = 1
+			}
+		}
+	} else {
+		counts := make(map[string]int)
+		for _, trigram := range queryTrigrams {
+			for id := range ti.trigrams[trigram] {
+				counts[id]++
+			}
+		}
+		for id, count := range counts {
+			score := float64(count) / float64(len(queryTrigrams))
+			if strings.Contains(ti.texts[id], query) {
+				score = 1
+			}
+			if score >= MinScore {
+				scores[id] = score
+			}
+		}
+	}
+
+	results := make([]Result, 0, len(scores))
+	for id, score := range scores {
+		results = append(results, Result{ID: id, Score: score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].ID < results[j].ID
+	})
+	return results
+}
+
+// Normalize lowercases the text, strips accents and replaces everything but
+// letters and digits with single spaces.
+func Normalize(text string) string {
+	var b strings.Builder
+	space := true
+	for _, r := range norm.NFD.String(text) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+			// A combining accent.
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(unicode.ToLower(r))
+			space = false
+		case !space:
+			b.WriteByte(' ')
+			space = true
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// trigrams returns the distinct trigrams of the words of a normalized text.
+// Words are padded, so "ana" gives "  a", " an", "ana" and "na ".
+func trigrams(text string) []string {
+	seen := make(map[string]struct{})
+	var list []string
+	for _, word := range strings.Fields(text) {
+		runes := []rune("  " + word + " ")
+		for i := 0; i+3 <= len(runes); i++ {
+			trigram := string(runes[i : i+3])
+			if _, ok := seen[trigram]; !ok {
+				seen[trigram] = struct{}{}
+				list = append(list, trigram)
+			}
+		}
+	}
+	return list
+}
@@ -0,0 +1,114 @@
+// Package secheaders sets security headers on responses: a Content Security
+// Policy, HSTS, X-Content-Type-Options and Referrer-Policy. Pages embedded
+// on other sites, like the donation page, use a policy allowing them to be
+// framed, everything else refuses to be framed.
+package secheaders
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultContentSecurityPolicy allows the widget and Stripe.js, which loads
+// Stripe Elements in frames and talks to Stripe's API.
+const DefaultContentSecurityPolicy = "default-src 'self'; " +
+	"script-src 'self' https://js.stripe.com; " +
+	"frame-src https://js.stripe.com https://hooks.stripe.com; " +
+	"connect-src 'self' https://api.stripe.com; " +
+	"img-src 'self' data: https://*.stripe.com; " +
+	"style-src 'self' 'unsafe-inline'; " +
+	"object-src 'none'; base-uri 'none'; form-action 'self'"
+
+const (
+	// DefaultHSTSMaxAge is how long browsers only use HTTPS for the server.
+	DefaultHSTSMaxAge = 365 * 24 * time.Hour
+	// DefaultReferrerPolicy sends only the origin to other sites.
+	DefaultReferrerPolicy = "strict-origin-when-cross-origin"
+)
+
+// names are the headers set by policies.
+var names = []string{
+	"Content-Security-Policy",
+	"Referrer-Policy",
+	"Strict-Transport-Security",
+	"X-Content-Type-Options",
+	"X-Frame-Options",
+}
+
+// Policy holds the values of the headers. Empty values leave their headers unset.
+type Policy struct {
+	// ContentSecurityPolicy without frame-ancestors, which is set from FrameAncestors.
+	ContentSecurityPolicy string
+	// FrameAncestors are the sources allowed to frame responses, e.g.
+	// "https://example.org" or "*". None may if empty.
+	FrameAncestors []string
+	// HSTSMaxAge of zero sends no Strict-Transport-Security.
+	HSTSMaxAge     time.Duration
+	ReferrerPolicy string
+}
+
+// Default returns the policy of responses that cannot be framed.
+func Default() Policy {
+	return Policy{
+		ContentSecurityPolicy: DefaultContentSecurityPolicy,
+		HSTSMaxAge:            DefaultHSTSMaxAge,
+		ReferrerPolicy:        DefaultReferrerPolicy,
+	}
+}
+
+// Embed returns a copy of the policy allowing responses to be framed by the
+// frame ancestors.
+func (p Policy) Embed(frameAncestors ...string) Policy {
+	p.FrameAncestors = frameAncestors
+	return p
+}
+
+// Headers returns the headers of the policy.
+func (p Policy) Headers() http.Header {
+	h := make(http.Header)
+	h.Set("X-Content-Type-Options", "nosniff")
+
+	frameAncestors := "'none'"
+	if len(p.FrameAncestors) > 0 {
+		frameAncestors = strings.Join(p.FrameAncestors, " ")
+	}
+	csp := "frame-ancestors " + frameAncestors
+	if p.ContentSecurityPolicy != "" {
+		csp = strings.TrimRight(strings.TrimSpace(p.ContentSecurityPolicy), ";") + "; " + csp
+	}
+	h.Set("Content-Security-Policy", csp)
+	// X-Frame-Options is for browsers without frame-ancestors.
+	switch frameAncestors {
+	case "'none'":
+		h.Set("X-Frame-Options", "DENY")
+	case "'self'":
+		h.Set("X-Frame-Options", "SAMEORIGIN")
+	}
+
+	if p.HSTSMaxAge > 0 {
+		h.Set("Strict-Transport-Security", "max-age="+strconv.FormatInt(int64(p.HSTSMaxAge/time.Second), 10)+"; includeSubDomains")
+	}
+	if p.ReferrerPolicy != "" {
+		h.Set("Referrer-Policy", p.ReferrerPolicy)
+	}
+	return h
+}
+
+// Middleware sets the headers of the policy, replacing any set by an outer
+// middleware, so a handler can be given a policy of its own.
+func Middleware(p Policy) func(http.HandlerFunc) http.HandlerFunc {
+	headers := p.Headers()
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			for _, name := range names {
+				w.Header().Del(name)
+			}
+			for name, values := range headers {
+				w.Header()[name] = values
+			}
+			next(w, r)
+		}
+	}
+}
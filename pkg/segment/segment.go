@@ -0,0 +1,360 @@
+// Package segment implements a small language selecting donors, so staff can
+// define segments for exports and email lists themselves, e.g.
+//
+//	amount > 10000 AND last_donation < 2024-01-01 AND tag = "gala"
+//
+// An expression compares fields of a donor with values, combined with AND, OR,
+// NOT and parentheses. The fields are
+//
+//	amount          total donated in all currencies, in the smallest currency unit
+//	donations       number of donations
+//	first_donation  time of the first donation, an RFC 3339 time or a YYYY-MM-DD date
+//	last_donation   time of the last donation
+//	tag             a tag of the donor, = and != test whether the donor has it
+//	email, name     compared case-insensitively
+//
+// with the operators =, !=, <, <=, > and >=. Strings are double-quoted, keywords
+// are case-insensitive. A date compares as its whole UTC day, so
+// last_donation <= 2024-01-31 includes that day.
+package segment
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxLength is the length of the longest expression.
+const MaxLength = 1000
+
+// Donor is what expressions select.
+type Donor struct {
+	Amount        int64
+	Donations     int
+	FirstDonation time.Time
+	LastDonation  time.Time
+	Tags          []string
+	Email         string
+	Name          string
+}
+
+// Expr is a parsed expression.
+type Expr struct {
+	node   node
+	source string
+}
+
+// Match reports whether the donor is in the segment. A nil Expr matches every donor.
+func (e *Expr) Match(d Donor) bool {
+	return e == nil || e.node.match(d)
+}
+
+// String returns the expression as it was parsed.
+func (e *Expr) String() string {
+	return e.source
+}
+
+// Parse parses an expression.
+func Parse(s string) (*Expr, error) {
+	if len(s) > MaxLength {
+		return nil, fmt.Errorf("the expression can have at most %d characters", MaxLength)
+	}
+	tokens, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	n, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEnd {
+		return nil, fmt.Errorf("unexpected %s at position %d", t, t.pos+1)
+	}
+	return &Expr{node: n, source: s}, nil
+}
+
+type node interface {
+	match(d Donor) bool
+}
+
+type and struct{ left, right node }
+
+func (n and) match(d Donor) bool { return n.left.match(d) && n.right.match(d) }
+
+type or struct{ left, right node }
+
+func (n or) match(d Donor) bool { return n.left.match(d) || n.right.match(d) }
+
+type not struct{ n node }
+
+func (n not) match(d Donor) bool { return !n.n.match(d) }
+
+// Comparison operators.
+const (
+	opEQ = "="
+	opNE = "!="
+	opLT = "<"
+	opLE = "<="
+	opGT = ">"
+	opGE = ">="
+)
+
+// numberComparison compares amount or donations.
+type numberComparison struct {
+	field string
+	op    string
+	value int64
+}
+
+func (c numberComparison) match(d Donor) bool {
+	v := d.Amount
+	if c.field == "donations" {
+		v = int64(d.Donations)
+	}
+	return compare(c.op, compareInts(v, c.value))
+}
+
+// timeComparison compares first_donation or last_donation with a time, or
+// with a day if the value was a date.
+type timeComparison struct {
+	field string
+	op    string
+	value time.Time
+	day   bool
+}
+
+func (c timeComparison) match(d Donor) bool {
+	t := d.LastDonation
+	if c.field == "first_donation" {
+		t = d.FirstDonation
+	}
+	if t.IsZero() {
+		return false
+	}
+	if !c.day {
+		return compare(c.op, compareTimes(t, c.value))
+	}
+	// A time within the day is equal to it.
+	end := c.value.AddDate(0, 0, 1)
+	switch {
+	case t.Before(c.value):
+		return compare(c.op, -1)
+	case !t.Before(end):
+		return compare(c.op, 1)
+	default:
+		return compare(c.op, 0)
+	}
+}
+
+// stringComparison compares email or name.
+type stringComparison struct {
+	field string
+	op    string
+	value string
+}
+
+func (c stringComparison) match(d Donor) bool {
+	v := d.Email
+	if c.field == "name" {
+		v = d.Name
+	}
+	return compare(c.op, strings.Compare(strings.ToLower(v), strings.ToLower(c.value)))
+}
+
+// tagComparison tests whether the donor has a tag.
+type tagComparison struct {
+	op    string
+	value string
+}
+
+func (c tagComparison) match(d Donor) bool {
+	has := false
+	for _, tag := range d.Tags {
+		if tag == c.value {
+			has = true
+			break
+		}
+	}
+	return has == (c.op == opEQ)
+}
+
+// compare reports whether the result of a comparison, -1, 0 or 1, satisfies the operator.
+func compare(op string, result int) bool {
+	switch op {
+	case opEQ:
+		return result == 0
+	case opNE:
+		return result != 0
+	case opLT:
+		return result < 0
+	case opLE:
+		return result <= 0
+	case opGT:
+		return result > 0
+	default:
+		return result >= 0
+	}
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func compareTimes(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Field types.
+const (
+	typeNumber = "number"
+	typeTime   = "time"
+	typeString = "string"
+	typeTag    = "tag"
+)
+
+var fields = map[string]string{
+	"amount":         typeNumber,
+	"donations":      typeNumber,
+	"first_donation": typeTime,
+	"last_donation":  typeTime,
+	"tag":            typeTag,
+	"email":          typeString,
+	"name":           typeString,
+}
+
+type parser struct {
+	tokens []token
+	i      int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.i]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.i]
+	if t.kind != tokenEnd {
+		p.i++
+	}
+	return t
+}
+
+func (p *parser) or() (node, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().isKeyword("OR") {
+		p.next()
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = or{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) and() (node, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().isKeyword("AND") {
+		p.next()
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = and{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) unary() (node, error) {
+	t := p.next()
+	switch {
+	case t.isKeyword("NOT"):
+		n, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return not{n}, nil
+	case t.kind == tokenLParen:
+		n, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokenRParen {
+			return nil, fmt.Errorf("expected ) at position %d, got %s", closing.pos+1, closing)
+		}
+		return n, nil
+	case t.kind == tokenWord:
+		return p.comparison(t)
+	default:
+		return nil, fmt.Errorf("expected a field at position %d, got %s", t.pos+1, t)
+	}
+}
+
+func (p *parser) comparison(field token) (node, error) {
+	name := strings.ToLower(field.text)
+	fieldType, ok := fields[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown field %q at position %d", field.text, field.pos+1)
+	}
+	op := p.next()
+	if op.kind != tokenOp {
+		return nil, fmt.Errorf("expected an operator after %s at position %d, got %s", name, op.pos+1, op)
+	}
+	value := p.next()
+	if value.kind != tokenWord && value.kind != tokenString {
+		return nil, fmt.Errorf("expected a value after %s %s at position %d, got %s", name, op.text, value.pos+1, value)
+	}
+	invalid := func(what string) error {
+		return fmt.Errorf("%s must be compared with %s, got %s at position %d", name, what, value, value.pos+1)
+	}
+
+	switch fieldType {
+	case typeNumber:
+		n, err := strconv.ParseInt(value.text, 10, 64)
+		if err != nil || value.kind != tokenWord {
+			return nil, invalid("a whole number")
+		}
+		return numberComparison{name, op.text, n}, nil
+	case typeTime:
+		if t, err := time.Parse(time.RFC3339, value.text); err == nil {
+			return timeComparison{name, op.text, t.UTC(), false}, nil
+		}
+		t, err := time.Parse("2006-01-02", value.text)
+		if err != nil {
+			return nil, invalid("an RFC 3339 time or a YYYY-MM-DD date")
+		}
+		return timeComparison{name, op.text, t, true}, nil
+	case typeTag:
+		if op.text != opEQ && op.text != opNE {
+			return nil, fmt.Errorf("tag can only be compared with = or !=")
+		}
+		return tagComparison{op.text, value.text}, nil
+	default:
+		if value.kind != tokenString {
+			return nil, invalid("a quoted string")
+		}
+		return stringComparison{name, op.text, value.text}, nil
+	}
+}
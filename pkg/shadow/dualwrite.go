@@ -0,0 +1,233 @@
+package shadow
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/notifier"
+	"github.com/vedrankolka/donation-server/pkg/requestid"
+)
+
+// latencySamples is the number of latest deliveries latency percentiles are computed from.
+const latencySamples = 1000
+
+// DualWriter sends every event to the primary and the secondary notifier at
+// once, to migrate to another broker without dropping events. Only a failure
+// of the primary fails the notification. Swapping the two cuts over, and the
+// old primary keeps receiving events until it is removed.
+type DualWriter struct {
+	primary   notifier.Notifier
+	secondary notifier.Notifier
+	since     time.Time
+
+	mu             sync.Mutex
+	primaryStats   *deliveryStats
+	secondaryStats *deliveryStats
+	// mismatches counts events delivered by only one of the notifiers.
+	mismatches int64
+}
+
+// NewDualWriter creates a DualWriter. The names identify the notifiers in the report.
+func NewDualWriter(primaryName string, primary notifier.Notifier, secondaryName string, secondary notifier.Notifier) *DualWriter {
+	return &DualWriter{
+		primary:        primary,
+		secondary:      secondary,
+		since:          time.Now().UTC(),
+		primaryStats:   newDeliveryStats(primaryName),
+		secondaryStats: newDeliveryStats(secondaryName),
+	}
+}
+
+func (d *DualWriter) Notify(ctx context.Context, event notifier.DonationEvent) error {
+	return d.write(ctx, func(n notifier.Notifier) error {
+		return n.Notify(ctx, event)
+	})
+}
+
+func (d *DualWriter) NotifyRecurring(ctx context.Context, event notifier.RecurringDonationEvent) error {
+	return d.write(ctx, func(n notifier.Notifier) error {
+		return n.NotifyRecurring(ctx, event)
+	})
+}
+
+func (d *DualWriter) NotifyPayment(ctx context.Context, event notifier.PaymentEvent) error {
+	return d.write(ctx, func(n notifier.Notifier) error {
+		return n.NotifyPayment(ctx, event)
+	})
+}
+
+// write sends a notification with both notifiers and records their deliveries.
+func (d *DualWriter) write(ctx context.Context, notify func(n notifier.Notifier) error) error {
+	var secondaryErr error
+	var secondaryDuration time.Duration
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		start := time.Now()
+		secondaryErr = notify(d.secondary)
+		secondaryDuration = time.Since(start)
+	}()
+
+	start := time.Now()
+	primaryErr := notify(d.primary)
+	primaryDuration := time.Since(start)
+	<-done
+
+	if secondaryErr != nil {
+		requestid.Printf(ctx, "[DUAL-WRITE] Secondary notifier %s failed: %v\n", d.secondaryStats.Name, secondaryErr)
+	}
+
+	d.mu.Lock()
+	d.primaryStats.add(primaryDuration, primaryErr)
+	d.secondaryStats.add(secondaryDuration, secondaryErr)
+	if (primaryErr == nil) != (secondaryErr == nil) {
+		d.mismatches++
+	}
+	d.mu.Unlock()
+
+	return primaryErr
+}
+
+// Close closes both notifiers and returns the first error.
+func (d *DualWriter) Close() error {
+	secondaryErr := d.secondary.Close()
+	if err := d.primary.Close(); err != nil {
+		return err
+	}
+	return secondaryErr
+}
+
+// Shutdown shuts both notifiers down, flushing their queued events until the
+// context is done, and returns the first error.
+func (d *DualWriter) Shutdown(ctx context.Context) (notifier.FlushReport, error) {
+	report, secondaryErr := notifier.Shutdown(ctx, d.secondary)
+	primaryReport, err := notifier.Shutdown(ctx, d.primary)
+	report.Add(primaryReport)
+	if err != nil {
+		return report, err
+	}
+	return report, secondaryErr
+}
+
+// Report compares the deliveries of the two notifiers.
+type Report struct {
+	Since     time.Time `json:"since"`
+	Primary   Stats     `json:"primary"`
+	Secondary Stats     `json:"secondary"`
+	// Mismatches is the number of events delivered by only one of the notifiers.
+	Mismatches int64 `json:"mismatches"`
+}
+
+// Stats are the delivery statistics of a notifier.
+type Stats struct {
+	Name        string  `json:"name"`
+	Sent        int64   `json:"sent"`
+	Succeeded   int64   `json:"succeeded"`
+	Failed      int64   `json:"failed"`
+	SuccessRate float64 `json:"successRate"`
+	LastError   string  `json:"lastError,omitempty"`
+	// Latencies in milliseconds, percentiles are of the latest deliveries.
+	AvgLatency float64 `json:"avgLatencyMs"`
+	P50Latency float64 `json:"p50LatencyMs"`
+	P95Latency float64 `json:"p95LatencyMs"`
+	P99Latency float64 `json:"p99LatencyMs"`
+	MaxLatency float64 `json:"maxLatencyMs"`
+}
+
+// Report returns the comparison of the notifiers so far.
+func (d *DualWriter) Report() Report {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return Report{
+		Since:      d.since,
+		Primary:    d.primaryStats.stats(),
+		Secondary:  d.secondaryStats.stats(),
+		Mismatches: d.mismatches,
+	}
+}
+
+// HandleReport serves the comparison report as JSON.
+func (d *DualWriter) HandleReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d.Report())
+}
+
+type deliveryStats struct {
+	Stats
+	total   time.Duration
+	max     time.Duration
+	samples []time.Duration
+	next    int
+}
+
+func newDeliveryStats(name string) *deliveryStats {
+	return &deliveryStats{
+		Stats:   Stats{Name: name},
+		samples: make([]time.Duration, 0, latencySamples),
+	}
+}
+
+func (s *deliveryStats) add(d time.Duration, err error) {
+	s.Sent++
+	if err != nil {
+		s.Failed++
+		s.LastError = err.Error()
+	} else {
+		s.Succeeded++
+	}
+
+	s.total += d
+	if d > s.max {
+		s.max = d
+	}
+	if len(s.samples) < latencySamples {
+		s.samples = append(s.samples, d)
+	} else {
+		s.samples[s.next] = d
+		s.next = (s.next + 1) % latencySamples
+	}
+}
+
+func (s *deliveryStats) stats() Stats {
+	stats := s.Stats
+	if stats.Sent == 0 {
+		return stats
+	}
+
+	stats.SuccessRate = float64(stats.Succeeded) / float64(stats.Sent)
+	stats.AvgLatency = milliseconds(s.total / time.Duration(stats.Sent))
+	stats.MaxLatency = milliseconds(s.max)
+
+	sorted := append([]time.Duration(nil), s.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	stats.P50Latency = milliseconds(percentile(sorted, 0.50))
+	stats.P95Latency = milliseconds(percentile(sorted, 0.95))
+	stats.P99Latency = milliseconds(percentile(sorted, 0.99))
+
+	return stats
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(p*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,97 @@
+package shadow
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/metrics"
+)
+
+// Timeout of a mirrored request or notification.
+const Timeout = 5 * time.Second
+
+// MaxInFlight is the number of mirrored requests or notifications in progress
+// at a time. Traffic beyond that is dropped rather than slowing the server down.
+const MaxInFlight = 16
+
+var shadowed = metrics.NewCounterVec(
+	"donation_server_shadowed_total",
+	"Requests and notifications mirrored to the shadow target by outcome.",
+	"kind", "outcome",
+)
+
+// Mirror copies incoming requests to a shadow endpoint, e.g. a new pipeline
+// being validated against production traffic. Mirroring is asynchronous and
+// fire-and-forget: the response of the shadow is only logged.
+type Mirror struct {
+	url      string
+	client   *http.Client
+	inFlight chan struct{}
+}
+
+// NewMirror creates a Mirror sending requests to the URL.
+func NewMirror(url string) *Mirror {
+	return &Mirror{
+		url:      url,
+		client:   &http.Client{Timeout: Timeout},
+		inFlight: make(chan struct{}, MaxInFlight),
+	}
+}
+
+// Middleware mirrors requests to the shadow endpoint before handling them. The
+// headers are copied as they are, so the shadow can verify Stripe signatures.
+func (m *Mirror) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		select {
+		case m.inFlight <- struct{}{}:
+			go func(header http.Header) {
+				defer func() { <-m.inFlight }()
+				m.send(r.Method, header, body)
+			}(r.Header.Clone())
+		default:
+			shadowed.Inc("request", "dropped")
+		}
+
+		next(w, r)
+	}
+}
+
+func (m *Mirror) send(method string, header http.Header, body []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, m.url, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("[SHADOW] Could not create request: %v\n", err)
+		shadowed.Inc("request", "failed")
+		return
+	}
+	req.Header = header
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		log.Printf("[SHADOW] Could not mirror request: %v\n", err)
+		shadowed.Inc("request", "failed")
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		log.Printf("[SHADOW] Mirrored request failed with %s\n", resp.Status)
+		shadowed.Inc("request", "failed")
+		return
+	}
+	shadowed.Inc("request", "succeeded")
+}
@@ -0,0 +1,104 @@
+package shadow
+
+import (
+	"context"
+	"log"
+
+	"github.com/vedrankolka/donation-server/pkg/notifier"
+)
+
+// Notifier sends every event to the primary notifier and mirrors it to the
+// shadow notifier in the background. Only the primary's result is returned.
+type Notifier struct {
+	primary  notifier.Notifier
+	shadow   notifier.Notifier
+	inFlight chan struct{}
+}
+
+// NewNotifier creates a Notifier mirroring the primary's events to the shadow.
+func NewNotifier(primary, shadow notifier.Notifier) *Notifier {
+	return &Notifier{
+		primary:  primary,
+		shadow:   shadow,
+		inFlight: make(chan struct{}, MaxInFlight),
+	}
+}
+
+func (n *Notifier) Notify(ctx context.Context, event notifier.DonationEvent) error {
+	n.mirror(func(ctx context.Context) error {
+		return n.shadow.Notify(ctx, event)
+	})
+	return n.primary.Notify(ctx, event)
+}
+
+func (n *Notifier) NotifyRecurring(ctx context.Context, event notifier.RecurringDonationEvent) error {
+	n.mirror(func(ctx context.Context) error {
+		return n.shadow.NotifyRecurring(ctx, event)
+	})
+	return n.primary.NotifyRecurring(ctx, event)
+}
+
+func (n *Notifier) NotifyPayment(ctx context.Context, event notifier.PaymentEvent) error {
+	n.mirror(func(ctx context.Context) error {
+		return n.shadow.NotifyPayment(ctx, event)
+	})
+	return n.primary.NotifyPayment(ctx, event)
+}
+
+// mirror sends a notification to the shadow in the background, or drops it
+// if MaxInFlight are being sent.
+func (n *Notifier) mirror(notify func(ctx context.Context) error) {
+	select {
+	case n.inFlight <- struct{}{}:
+		go func() {
+			defer func() { <-n.inFlight }()
+			n.send(notify)
+		}()
+	default:
+		shadowed.Inc("notification", "dropped")
+	}
+}
+
+func (n *Notifier) send(notify func(ctx context.Context) error) {
+	// The shadow must not be canceled together with the request of the primary.
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+
+	if err := notify(ctx); err != nil {
+		log.Printf("[SHADOW] Could not mirror notification: %v\n", err)
+		shadowed.Inc("notification", "failed")
+		return
+	}
+	shadowed.Inc("notification", "succeeded")
+}
+
+// Close closes both notifiers and returns the first error.
+func (n *Notifier) Close() error {
+	shadowErr := n.shadow.Close()
+	if err := n.primary.Close(); err != nil {
+		return err
+	}
+	return shadowErr
+}
+
+// Shutdown waits for the notifications being mirrored until the context is
+// done, then shuts both notifiers down. Only the events of the primary are
+// counted, and its error is returned first.
+func (n *Notifier) Shutdown(ctx context.Context) (notifier.FlushReport, error) {
+	// Taking every slot drops further mirrors.
+wait:
+	for i := 0; i < cap(n.inFlight); i++ {
+		select {
+		case n.inFlight <- struct{}{}:
+		case <-ctx.Done():
+			break wait
+		}
+	}
+
+	_, shadowErr := notifier.Shutdown(ctx, n.shadow)
+	report, err := notifier.Shutdown(ctx, n.primary)
+	if err != nil {
+		return report, err
+	}
+	return report, shadowErr
+}
@@ -0,0 +1,270 @@
+// Package sla tracks the delivery success rate and end-to-end latency of
+// every notifier, from the charge to the notification being written, and
+// alerts when they breach their thresholds.
+package sla
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/metrics"
+	"github.com/vedrankolka/donation-server/pkg/notifier"
+)
+
+const (
+	// Window is the number of recent deliveries of a notifier the success
+	// rate and latency are computed over.
+	Window = 100
+	// MinDeliveries is the number of deliveries needed before alerting.
+	MinDeliveries = 10
+	// AlertInterval is how often the same breach is alerted at most.
+	AlertInterval = 15 * time.Minute
+)
+
+var (
+	deliveries = metrics.NewCounterVec(
+		"donation_server_notifier_deliveries_total",
+		"Notifications written or failed, by notifier and outcome (delivered or failed).",
+		"notifier", "outcome",
+	)
+	successRate = metrics.NewGaugeVec(
+		"donation_server_notifier_success_ratio",
+		"Share of the recent notifications delivered, by notifier.",
+		"notifier",
+	)
+	latency = metrics.NewGaugeVec(
+		"donation_server_notifier_latency_p95_seconds",
+		"95th percentile of the time from the charge to the notification being written, of recent notifications, by notifier.",
+		"notifier",
+	)
+)
+
+// Thresholds are the service levels of notifiers. Zero values are not checked.
+type Thresholds struct {
+	// MinSuccessRate is the lowest share of deliveries that must succeed, from 0 to 1.
+	MinSuccessRate float64
+	// MaxLatency is the highest 95th percentile of the latency.
+	MaxLatency time.Duration
+}
+
+// Alerter sends alerts about breached thresholds.
+type Alerter interface {
+	Alert(ctx context.Context, message string) error
+}
+
+// delivery is the outcome of a notification.
+type delivery struct {
+	ok      bool
+	latency time.Duration
+	// timed is false if the time of the charge was unknown.
+	timed bool
+}
+
+// Tracker keeps the recent deliveries of notifiers.
+type Tracker struct {
+	thresholds Thresholds
+	alerter    Alerter
+
+	mu         sync.Mutex
+	deliveries map[string][]delivery
+	alertedAt  map[string]time.Time
+}
+
+// NewTracker creates a Tracker alerting breaches of the thresholds with the
+// alerter, or only logging them if it is nil.
+func NewTracker(thresholds Thresholds, alerter Alerter) *Tracker {
+	return &Tracker{
+		thresholds: thresholds,
+		alerter:    alerter,
+		deliveries: make(map[string][]delivery),
+		alertedAt:  make(map[string]time.Time),
+	}
+}
+
+// Notifier tracks the deliveries of a notifier.
+type Notifier struct {
+	name    string
+	next    notifier.Notifier
+	tracker *Tracker
+}
+
+// Track returns a Notifier tracking the deliveries of the named notifier.
+func (t *Tracker) Track(name string, next notifier.Notifier) *Notifier {
+	return &Notifier{name: name, next: next, tracker: t}
+}
+
+func (n *Notifier) Notify(ctx context.Context, event notifier.DonationEvent) error {
+	err := n.next.Notify(ctx, event)
+	n.record(ctx, err)
+	return err
+}
+
+func (n *Notifier) NotifyRecurring(ctx context.Context, event notifier.RecurringDonationEvent) error {
+	err := n.next.NotifyRecurring(ctx, event)
+	n.record(ctx, err)
+	return err
+}
+
+func (n *Notifier) NotifyPayment(ctx context.Context, event notifier.PaymentEvent) error {
+	err := n.next.NotifyPayment(ctx, event)
+	n.record(ctx, err)
+	return err
+}
+
+// record records the delivery of a notification that failed with err, if not nil.
+func (n *Notifier) record(ctx context.Context, err error) {
+	d := delivery{ok: err == nil}
+	if chargedAt, ok := notifier.ChargedAt(ctx); ok {
+		d.latency, d.timed = time.Since(chargedAt), true
+	}
+	n.tracker.record(n.name, d)
+}
+
+func (n *Notifier) Close() error {
+	return n.next.Close()
+}
+
+func (n *Notifier) Shutdown(ctx context.Context) (notifier.FlushReport, error) {
+	return notifier.Shutdown(ctx, n.next)
+}
+
+// record adds the delivery to the window of the notifier, updates its
+// metrics and alerts if a threshold is breached.
+func (t *Tracker) record(name string, d delivery) {
+	outcome := "delivered"
+	if !d.ok {
+		outcome = "failed"
+	}
+	deliveries.Inc(name, outcome)
+
+	t.mu.Lock()
+	window := append(t.deliveries[name], d)
+	if len(window) > Window {
+		window = window[len(window)-Window:]
+	}
+	t.deliveries[name] = window
+	rate, p95 := stats(window)
+	t.mu.Unlock()
+
+	successRate.Set(rate, name)
+	latency.Set(p95.Seconds(), name)
+
+	if len(window) < MinDeliveries {
+		return
+	}
+	if t.thresholds.MinSuccessRate > 0 && rate < t.thresholds.MinSuccessRate {
+		t.alert(name+"/success", fmt.Sprintf("Only %.1f%% of the last %d %s notifications were delivered, below the SLA of %.1f%%.",
+			rate*100, len(window), name, t.thresholds.MinSuccessRate*100))
+	}
+	if t.thresholds.MaxLatency > 0 && p95 > t.thresholds.MaxLatency {
+		t.alert(name+"/latency", fmt.Sprintf("%s notifications take %v from the charge (95th percentile), above the SLA of %v.",
+			name, p95.Round(time.Millisecond), t.thresholds.MaxLatency))
+	}
+}
+
+// Check returns an error if the recent deliveries of the named notifier
+// breach a threshold, e.g. for health checks.
+func (t *Tracker) Check(name string) error {
+	t.mu.Lock()
+	window := t.deliveries[name]
+	rate, p95 := stats(window)
+	t.mu.Unlock()
+
+	if len(window) < MinDeliveries {
+		return nil
+	}
+	if t.thresholds.MinSuccessRate > 0 && rate < t.thresholds.MinSuccessRate {
+		return fmt.Errorf("only %.1f%% of the last %d notifications were delivered", rate*100, len(window))
+	}
+	if t.thresholds.MaxLatency > 0 && p95 > t.thresholds.MaxLatency {
+		return fmt.Errorf("notifications take %v from the charge (95th percentile)", p95.Round(time.Millisecond))
+	}
+	return nil
+}
+
+// stats returns the success rate of the deliveries and the 95th percentile
+// of the latency of the timed ones.
+func stats(window []delivery) (float64, time.Duration) {
+	var ok int
+	latencies := make([]time.Duration, 0, len(window))
+	for _, d := range window {
+		if d.ok {
+			ok++
+		}
+		if d.timed {
+			latencies = append(latencies, d.latency)
+		}
+	}
+
+	var p95 time.Duration
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		p95 = latencies[(len(latencies)*95-1)/100]
+	}
+	return float64(ok) / float64(len(window)), p95
+}
+
+// alert logs the message and sends it with the alerter, at most once per
+// AlertInterval for the same breach.
+func (t *Tracker) alert(breach, message string) {
+	t.mu.Lock()
+	if time.Since(t.alertedAt[breach]) < AlertInterval {
+		t.mu.Unlock()
+		return
+	}
+	t.alertedAt[breach] = time.Now()
+	t.mu.Unlock()
+
+	log.Printf("[SLA] %s\n", message)
+	if t.alerter == nil {
+		return
+	}
+	// Alerting must not hold up the notification.
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := t.alerter.Alert(ctx, message); err != nil {
+			log.Printf("Could not send SLA alert: %v\n", err)
+		}
+	}()
+}
+
+// WebhookAlerter posts alerts as {"text": "..."}, the format of Slack
+// incoming webhooks and compatible chat tools.
+type WebhookAlerter struct {
+	URL    string
+	Client *http.Client
+}
+
+func (a *WebhookAlerter) Alert(ctx context.Context, message string) error {
+	body, err := json.Marshal(map[string]string{"text": message})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", a.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := a.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("alert webhook responded with %s", resp.Status)
+	}
+	return nil
+}
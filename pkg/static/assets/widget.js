@@ -0,0 +1,180 @@
+// Default donation widget. Include it with
+//
+//   <div id="donation-widget" data-campaign="gala-2024" data-currency="USD" data-partner-key="pk_partner_..."></div>
+//   <script src="https://donate.example.org/static/widget.js"></script>
+//
+// It asks for an amount, creates a PaymentIntent and takes the payment with
+// the Stripe Payment Element. A donation link, in data-link or the "link"
+// parameter of the page, sets the amount, currency, campaign and locale.
+// Without a currency, donations are in the default currency of the server.
+(function () {
+  var script = document.currentScript;
+  var server = new URL(script.src).origin;
+
+  function loadStripe(callback) {
+    if (window.Stripe) {
+      callback();
+      return;
+    }
+    var s = document.createElement("script");
+    s.src = "https://js.stripe.com/v3/";
+    s.onload = callback;
+    document.head.appendChild(s);
+  }
+
+  function request(path) {
+    return fetch(server + path).then(function (resp) {
+      return resp.json().then(function (body) {
+        if (!resp.ok) {
+          var error = body.error || {};
+          throw new Error([error.message || resp.statusText, error.action].filter(Boolean).join(" "));
+        }
+        return body;
+      });
+    });
+  }
+
+  // newKey returns a random idempotency key, so a retried request creates a
+  // single PaymentIntent.
+  function newKey() {
+    var bytes = new Uint8Array(16);
+    window.crypto.getRandomValues(bytes);
+    return Array.prototype.map
+      .call(bytes, function (b) {
+        return ("0" + b.toString(16)).slice(-2);
+      })
+      .join("");
+  }
+
+  // Messages for donors about degraded parts of the server, by impact.
+  var degradedMessages = {
+    receipts_delayed: "Receipts may be delayed.",
+    donations_delayed: "Your donation may take a while to show up.",
+  };
+
+  function degradedMessage(config) {
+    return (config.degradations || [])
+      .map(function (d) {
+        return degradedMessages[d.impact];
+      })
+      .filter(function (m, i, all) {
+        return m && all.indexOf(m) === i;
+      })
+      .join(" ");
+  }
+
+  function mount(root) {
+    var campaign = root.getAttribute("data-campaign") || "";
+    var partnerKey = root.getAttribute("data-partner-key") || "";
+    // A donation link, of the page or the widget, pre-configures the donation.
+    var link = root.getAttribute("data-link") || new URLSearchParams(window.location.search).get("link") || "";
+    var locale = "";
+    var currency = (root.getAttribute("data-currency") || "").toUpperCase();
+    root.classList.add("donation-widget");
+    root.innerHTML =
+      '<form class="donation-widget__amount">' +
+      '<label>Amount (<span class="donation-widget__currency"></span>) <input name="amount" type="number" min="0" step="0.01" value="10" required></label>' +
+      '<button type="submit">Donate</button>' +
+      "</form>" +
+      '<form class="donation-widget__payment" hidden>' +
+      '<div class="donation-widget__element"></div>' +
+      '<button type="submit">Pay</button>' +
+      "</form>" +
+      '<p class="donation-widget__message" role="status"></p>';
+
+    var amountForm = root.querySelector(".donation-widget__amount");
+    var paymentForm = root.querySelector(".donation-widget__payment");
+    var message = root.querySelector(".donation-widget__message");
+    // An anonymous session of this page counts the donation funnel on the
+    // server, without cookies (see "Donation funnel" in the README).
+    var session = newKey();
+    var configRequest = request("/config?funnel_session=" + session);
+
+    // decimals returns the digits of the smallest unit of the currency, as
+    // amounts are sent in it, e.g. 0 for JPY.
+    function decimals(config) {
+      var c = (config.currencies || []).filter(function (c) {
+        return c.code === currency;
+      })[0];
+      return c ? c.decimals : 2;
+    }
+
+    function showCurrency(config) {
+      currency = currency || config.currency;
+      root.querySelector(".donation-widget__currency").textContent = currency;
+      amountForm.amount.step = Math.pow(10, -decimals(config));
+    }
+    // A new amount is a new attempt to donate.
+    var key = newKey();
+    amountForm.amount.addEventListener("input", function () {
+      key = newKey();
+    });
+
+    var ready = configRequest;
+    if (link) {
+      ready = Promise.all([configRequest, request("/links/" + encodeURIComponent(link))]).then(function (results) {
+        var linkConfig = results[1];
+        currency = linkConfig.currency || currency;
+        if (linkConfig.amount) {
+          var digits = decimals(results[0]);
+          amountForm.amount.value = (linkConfig.amount / Math.pow(10, digits)).toFixed(digits);
+        }
+        campaign = linkConfig.campaign || campaign;
+        locale = linkConfig.locale || "";
+        return results[0];
+      });
+    }
+    ready.then(showCurrency).catch(function (err) {
+      message.textContent = err.message;
+    });
+
+    amountForm.addEventListener("submit", function (e) {
+      e.preventDefault();
+      message.textContent = "";
+
+      ready
+        .then(function (config) {
+          var amount = Math.round(parseFloat(amountForm.amount.value) * Math.pow(10, decimals(config)));
+          var query = "?amount=" + amount + "&currency=" + currency + "&idempotency_key=" + key + "&funnel_session=" + session;
+          if (campaign) {
+            query += "&campaign=" + encodeURIComponent(campaign);
+          }
+          if (partnerKey) {
+            query += "&partner_key=" + encodeURIComponent(partnerKey);
+          }
+          if (link) {
+            query += "&link=" + encodeURIComponent(link);
+          }
+          return request("/create-payment-intent" + query).then(function (intent) {
+            var stripe = window.Stripe(config.publishableKey);
+            var elements = stripe.elements({ clientSecret: intent.clientSecret, locale: locale || "auto" });
+            elements.create("payment").mount(root.querySelector(".donation-widget__element"));
+            amountForm.hidden = true;
+            paymentForm.hidden = false;
+            message.textContent = degradedMessage(config);
+
+            paymentForm.addEventListener("submit", function (e) {
+              e.preventDefault();
+              stripe
+                .confirmPayment({ elements: elements, confirmParams: { return_url: window.location.href } })
+                .then(function (result) {
+                  if (result.error) {
+                    message.textContent = result.error.message;
+                  }
+                });
+            });
+          });
+        })
+        .catch(function (err) {
+          message.textContent = err.message;
+        });
+    });
+  }
+
+  loadStripe(function () {
+    var roots = document.querySelectorAll("#donation-widget, [data-donation-widget]");
+    for (var i = 0; i < roots.length; i++) {
+      mount(roots[i]);
+    }
+  });
+})();
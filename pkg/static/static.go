@@ -0,0 +1,141 @@
+// Package static serves the default donation widget, embedded in the binary.
+//
+// Every asset is served under its name, e.g. /static/widget.js, for pages
+// embedding the widget, and under a name with the hash of its content, e.g.
+// /static/widget.3f2a1b9c.js, which can be cached forever because a changed
+// asset gets a new name.
+package static
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/requestid"
+)
+
+// Prefix is the path the assets are served at.
+const Prefix = "/static/"
+
+// NameCacheControl is the Cache-Control of assets requested by name, which
+// must be revalidated to pick up a new version.
+const NameCacheControl = "public, max-age=300, must-revalidate"
+
+// HashedCacheControl is the Cache-Control of assets requested by hashed name.
+const HashedCacheControl = "public, max-age=31536000, immutable"
+
+//go:embed assets
+var files embed.FS
+
+// asset is an embedded file.
+type asset struct {
+	content []byte
+	hashed  string
+	etag    string
+}
+
+var (
+	// assets by name and by hashed name.
+	assets = make(map[string]*asset)
+	hashed = make(map[string]*asset)
+	// loaded is when the assets were loaded, their modification time.
+	loaded = time.Now()
+)
+
+func init() {
+	entries, err := fs.ReadDir(files, "assets")
+	if err != nil {
+		panic(err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || name == "index.html" {
+			continue
+		}
+		content, err := files.ReadFile("assets/" + name)
+		if err != nil {
+			panic(err)
+		}
+
+		sum := sha256.Sum256(content)
+		hash := hex.EncodeToString(sum[:])
+		ext := path.Ext(name)
+		a := &asset{
+			content: content,
+			hashed:  strings.TrimSuffix(name, ext) + "." + hash[:8] + ext,
+			etag:    `"` + hash[:32] + `"`,
+		}
+		assets[name] = a
+		hashed[a.hashed] = a
+	}
+}
+
+// Path returns the path of an asset by its hashed name, e.g. for links in
+// pages, or by its name if there is no such asset.
+func Path(name string) string {
+	if a, ok := assets[name]; ok {
+		return Prefix + a.hashed
+	}
+	return Prefix + name
+}
+
+// Handler serves the assets under Prefix.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, Prefix)
+	cacheControl := HashedCacheControl
+	a, ok := hashed[name]
+	if !ok {
+		a, ok = assets[name]
+		cacheControl = NameCacheControl
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Header().Set("ETag", a.etag)
+	// Pages on other sites load the widget.
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	http.ServeContent(w, r, name, loaded, bytes.NewReader(a.content))
+}
+
+var index = template.Must(template.New("index.html").
+	Funcs(template.FuncMap{"asset": Path}).
+	ParseFS(files, "assets/index.html"))
+
+// HandleIndex serves a page with the widget at /, so the server works as a
+// donation page on its own.
+func HandleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := index.Execute(&buf, nil); err != nil {
+		requestid.Printf(r.Context(), "Could not render the index page: %v\n", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, "index.html", loaded, bytes.NewReader(buf.Bytes()))
+}
@@ -0,0 +1,71 @@
+package store
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/listing"
+)
+
+// Campaign is a named fundraising campaign with a target amount. Payments
+// are made for it with its ID as their campaign metadata.
+type Campaign struct {
+	// ID is chosen when the campaign is created, e.g. "winter-appeal-2024".
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// Target is the goal in the smallest unit of Currency. Donations in
+	// other currencies count towards it converted with exchange rates.
+	Target   int64  `json:"target"`
+	Currency string `json:"currency"`
+	// Goals are optional sub-goals by currency, in its smallest unit.
+	Goals map[string]int64 `json:"goals,omitempty"`
+	// StartsAt and EndsAt limit when donations are taken for the campaign,
+	// without an end it runs until it is deleted.
+	StartsAt  time.Time  `json:"startsAt"`
+	EndsAt    *time.Time `json:"endsAt,omitempty"`
+	CreatedBy string     `json:"createdBy"`
+	CreatedAt time.Time  `json:"createdAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+	// Donations and Totals (in the smallest unit by currency) sum up the
+	// donations made for the campaign that were not refunded or held.
+	Donations int              `json:"donations"`
+	Totals    map[string]int64 `json:"totals"`
+}
+
+// Active reports whether donations are taken for the campaign at the time.
+func (c *Campaign) Active(at time.Time) bool {
+	return !at.Before(c.StartsAt) && (c.EndsAt == nil || at.Before(*c.EndsAt))
+}
+
+// Sort fields of campaign lists.
+var CampaignListSpec = listing.Spec{
+	Sorts:       []string{"name", "created", "starts"},
+	DefaultSort: "-starts",
+}
+
+// campaignSortKey returns the key of the campaign by a sort field of CampaignListSpec.
+func campaignSortKey(c *Campaign, field string) string {
+	switch field {
+	case "created":
+		return listing.TimeKey(c.CreatedAt)
+	case "starts":
+		return listing.TimeKey(c.StartsAt)
+	default:
+		return strings.ToLower(c.Name)
+	}
+}
+
+// CampaignStore keeps campaigns. Campaigns read from the store carry the
+// totals of their donations.
+type CampaignStore interface {
+	// SaveCampaign creates the campaign or replaces the one with its ID.
+	SaveCampaign(ctx context.Context, c *Campaign) error
+	// GetCampaign returns a campaign or ErrNotFound.
+	GetCampaign(ctx context.Context, id string) (*Campaign, error)
+	// ListCampaigns returns a page of campaigns, see CampaignListSpec, and the cursor of the next page.
+	ListCampaigns(ctx context.Context, q listing.Query) ([]*Campaign, string, error)
+	// DeleteCampaign deletes a campaign or returns ErrNotFound. Its donations keep their campaign.
+	DeleteCampaign(ctx context.Context, id string) error
+}
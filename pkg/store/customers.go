@@ -0,0 +1,127 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/listing"
+	"github.com/vedrankolka/donation-server/pkg/segment"
+)
+
+// Customer summarizes the donations of a Stripe customer.
+type Customer struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Email string `json:"email"`
+	// Donations is the number of donations.
+	Donations int `json:"donations"`
+	// Totals are the donated amounts by currency.
+	Totals          map[string]int64 `json:"totals"`
+	FirstDonationAt time.Time        `json:"firstDonationAt"`
+	LastDonationAt  time.Time        `json:"lastDonationAt"`
+	// Tags of the donor, see TagStore.
+	Tags []string `json:"tags,omitempty"`
+}
+
+// Segment returns the customer as a donor of package segment.
+func (c *Customer) Segment() segment.Donor {
+	var amount int64
+	for _, total := range c.Totals {
+		amount += total
+	}
+	return segment.Donor{
+		Amount:        amount,
+		Donations:     c.Donations,
+		FirstDonation: c.FirstDonationAt,
+		LastDonation:  c.LastDonationAt,
+		Tags:          c.Tags,
+		Email:         c.Email,
+		Name:          c.Name,
+	}
+}
+
+// customerSummaries sums up donations by customer.
+type customerSummaries struct {
+	byID map[string]*Customer
+	// list holds the customers in the order of their first summed donation.
+	list []*Customer
+}
+
+// add sums up the donation, unless it was made without a customer.
+func (cs *customerSummaries) add(d *Donation) {
+	if d.CustomerID == "" {
+		return
+	}
+	if cs.byID == nil {
+		cs.byID = make(map[string]*Customer)
+	}
+	c, ok := cs.byID[d.CustomerID]
+	if !ok {
+		c = &Customer{ID: d.CustomerID, Totals: make(map[string]int64)}
+		cs.byID[d.CustomerID] = c
+		cs.list = append(cs.list, c)
+	}
+	c.Donations++
+	c.Totals[d.Currency] += d.Amount
+	if c.FirstDonationAt.IsZero() || d.CreatedAt.Before(c.FirstDonationAt) {
+		c.FirstDonationAt = d.CreatedAt
+	}
+	if !d.CreatedAt.Before(c.LastDonationAt) {
+		c.LastDonationAt = d.CreatedAt
+		c.Name = d.CustomerName
+		c.Email = d.CustomerEmail
+	}
+}
+
+// matching sets the tags of the customers by tagsOf and returns the ones
+// matching the tag and segment filters.
+func (cs *customerSummaries) matching(f listing.Filter, tagsOf func(id string) []string) []*Customer {
+	var customers []*Customer
+	for _, c := range cs.list {
+		c.Tags = tagsOf(c.ID)
+		if f.MatchTag(c.Tags) && f.Segment.Match(c.Segment()) {
+			customers = append(customers, c)
+		}
+	}
+	return customers
+}
+
+// Sort fields and filters of customer lists. The filters select the donations
+// customers are summarized from, customers without any are left out, except
+// the tag filter, which matches the tags of the donor, and the segment, which
+// selects customers by what they are summarized to.
+var CustomerListSpec = listing.Spec{
+	Sorts:       []string{"lastDonation", "firstDonation", "donations", "name"},
+	DefaultSort: "-lastDonation",
+	Filters: []string{listing.FilterAmount, listing.FilterCreated, listing.FilterCurrency,
+		listing.FilterCampaign, listing.FilterTag, listing.FilterSegment},
+}
+
+// CustomerMatch is a customer found by a search.
+type CustomerMatch struct {
+	Customer
+	// Score is 1 if the name or email contains the search, and lower for
+	// partial matches, e.g. with typos.
+	Score float64 `json:"score"`
+}
+
+// Sort fields and filters of customer searches. The search is the "q" parameter.
+var CustomerSearchSpec = listing.Spec{
+	Sorts:       []string{"score", "lastDonation", "name"},
+	DefaultSort: "-score",
+	Filters: []string{listing.FilterAmount, listing.FilterCreated, listing.FilterCurrency,
+		listing.FilterCampaign, listing.FilterTag, listing.FilterSegment},
+	Params: []string{"q"},
+}
+
+// CustomerStore lists the customers that donated.
+type CustomerStore interface {
+	// ListCustomers returns a page of customers, see CustomerListSpec,
+	// and the cursor of the next page.
+	ListCustomers(ctx context.Context, q listing.Query) ([]*Customer, string, error)
+	// GetCustomer returns the summary of a customer's donations or ErrNotFound.
+	GetCustomer(ctx context.Context, id string) (*Customer, error)
+	// SearchCustomers finds customers by parts of their name or email, see
+	// CustomerSearchSpec, and returns a page of them and the cursor of the next page.
+	SearchCustomers(ctx context.Context, search string, q listing.Query) ([]*CustomerMatch, string, error)
+}
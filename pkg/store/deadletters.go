@@ -0,0 +1,58 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/listing"
+)
+
+// Dead letter statuses.
+const (
+	// DeadLetterPending notifications still need to be delivered.
+	DeadLetterPending = "pending"
+	// DeadLetterDelivered notifications were delivered by a redrive or by a
+	// later delivery of the Stripe event.
+	DeadLetterDelivered = "delivered"
+	// DeadLetterDiscarded notifications were dropped by an admin.
+	DeadLetterDiscarded = "discarded"
+)
+
+// DeadLetter is a notification that could not be delivered.
+type DeadLetter struct {
+	// ID identifies the notification: the Stripe event ID and the notification type.
+	ID      string `json:"id"`
+	EventID string `json:"eventID"`
+	// Type of the notification, e.g. "donation".
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+	// Reason is the category of the last failure, e.g. "timeout".
+	Reason    string    `json:"reason"`
+	Error     string    `json:"error"`
+	Attempts  int       `json:"attempts"`
+	Status    string    `json:"status"`
+	FailedAt  time.Time `json:"failedAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Sort fields and filters of dead letter lists. The created filter applies to FailedAt.
+var DeadLetterListSpec = listing.Spec{
+	Sorts:       []string{"failed", "updated"},
+	DefaultSort: "failed",
+	Filters:     []string{listing.FilterCreated, listing.FilterStatus, listing.FilterReason, listing.FilterType},
+}
+
+// DeadLetterStore keeps notifications that could not be delivered.
+type DeadLetterStore interface {
+	// AddDeadLetter saves a failed notification. If one with the same ID
+	// exists, its failure and attempts are updated and it is pending again.
+	AddDeadLetter(ctx context.Context, dl *DeadLetter) error
+	// GetDeadLetter returns the dead letter or ErrNotFound.
+	GetDeadLetter(ctx context.Context, id string) (*DeadLetter, error)
+	// ListDeadLetters returns a page of dead letters, see DeadLetterListSpec,
+	// and the cursor of the next page.
+	ListDeadLetters(ctx context.Context, q listing.Query) ([]*DeadLetter, string, error)
+	// SetDeadLetterStatus changes the status of a dead letter, or returns ErrNotFound.
+	SetDeadLetterStatus(ctx context.Context, id, status string) error
+}
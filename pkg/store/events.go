@@ -0,0 +1,75 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/listing"
+)
+
+// Outcomes of processing a Stripe event.
+const (
+	OutcomeProcessed = "processed"
+	OutcomeIgnored   = "ignored"
+	OutcomeHeld      = "held"
+	OutcomeFailed    = "failed"
+	// OutcomeDeadLettered events had notifications that failed and were
+	// saved to a durable dead-letter sink, so they were acknowledged.
+	OutcomeDeadLettered = "dead_lettered"
+	// OutcomeDeferred events were acknowledged while their notifications,
+	// which outlasted the webhook budget, were still being sent.
+	OutcomeDeferred = "deferred"
+)
+
+// EventAttempt is one delivery of a Stripe event to the webhook.
+type EventAttempt struct {
+	At         time.Time     `json:"at"`
+	Outcome    string        `json:"outcome"`
+	StatusCode int           `json:"statusCode"`
+	Error      string        `json:"error,omitempty"`
+	Duration   time.Duration `json:"duration"`
+	// RequestID is the ID of the webhook request, see package requestid.
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// EmittedNotification is a notification sent while processing an event.
+type EmittedNotification struct {
+	At       time.Time `json:"at"`
+	Notifier string    `json:"notifier"`
+	Type     string    `json:"type"`
+	Key      string    `json:"key"`
+}
+
+// EventRecord describes how the server processed a Stripe event.
+type EventRecord struct {
+	ID         string    `json:"id"`
+	Type       string    `json:"type"`
+	ReceivedAt time.Time `json:"receivedAt"`
+	// Outcome is the outcome of the latest attempt.
+	Outcome string `json:"outcome"`
+	// Retries is the number of attempts after the first one.
+	Retries       int                   `json:"retries"`
+	Attempts      []EventAttempt        `json:"attempts"`
+	Notifications []EmittedNotification `json:"notifications"`
+}
+
+// Sort fields and filters of event lists. The created filter applies to ReceivedAt.
+var EventListSpec = listing.Spec{
+	Sorts:       []string{"received"},
+	DefaultSort: "-received",
+	Filters:     []string{listing.FilterCreated, listing.FilterType, listing.FilterOutcome},
+}
+
+// EventStore keeps a log of processed Stripe events.
+type EventStore interface {
+	// RecordEventAttempt appends an attempt to the record of the event,
+	// creating the record on the first attempt.
+	RecordEventAttempt(ctx context.Context, id, eventType string, attempt EventAttempt) error
+	// RecordNotification appends a notification to the record of the event.
+	RecordNotification(ctx context.Context, id string, notification EmittedNotification) error
+	// GetEvent returns the record of the event or ErrNotFound.
+	GetEvent(ctx context.Context, id string) (*EventRecord, error)
+	// ListEvents returns a page of event records, see EventListSpec,
+	// and the cursor of the next page.
+	ListEvents(ctx context.Context, q listing.Query) ([]*EventRecord, string, error)
+}
@@ -0,0 +1,64 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/listing"
+)
+
+// Kinds of interactions with donors.
+const (
+	InteractionNote    = "note"
+	InteractionCall    = "call"
+	InteractionEmail   = "email"
+	InteractionMeeting = "meeting"
+)
+
+// InteractionKinds are all kinds of interactions.
+var InteractionKinds = []string{InteractionNote, InteractionCall, InteractionEmail, InteractionMeeting}
+
+// Interaction is a note about a donor or a logged call, email or meeting with them.
+type Interaction struct {
+	ID         string `json:"id"`
+	CustomerID string `json:"customerID"`
+	// Type is one of InteractionKinds.
+	Type string `json:"type"`
+	Text string `json:"text"`
+	// Author is who wrote the note or had the interaction.
+	Author string `json:"author"`
+	// CreatedBy is the principal of the admin API request that logged it.
+	CreatedBy string `json:"createdBy"`
+	// OccurredAt is when the interaction happened, CreatedAt when it was logged.
+	OccurredAt time.Time `json:"occurredAt"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// Sort fields and filters of interaction lists. The created filter applies to OccurredAt.
+var InteractionListSpec = listing.Spec{
+	Sorts:       []string{"occurred", "created"},
+	DefaultSort: "-occurred",
+	Filters:     []string{listing.FilterCreated, listing.FilterType},
+}
+
+// InteractionStore keeps the interaction history of donors.
+type InteractionStore interface {
+	// AddInteraction saves a new interaction, setting its ID.
+	AddInteraction(ctx context.Context, interaction *Interaction) error
+	// GetInteraction returns an interaction of the customer or ErrNotFound.
+	GetInteraction(ctx context.Context, customerID, id string) (*Interaction, error)
+	// ListInteractions returns a page of the customer's interactions, see
+	// InteractionListSpec, and the cursor of the next page.
+	ListInteractions(ctx context.Context, customerID string, q listing.Query) ([]*Interaction, string, error)
+	// DeleteInteraction deletes an interaction of the customer or returns ErrNotFound.
+	DeleteInteraction(ctx context.Context, customerID, id string) error
+}
+
+// newID returns a random ID with the prefix, e.g. "int_3f2a...".
+func newID(prefix string) string {
+	var b [12]byte
+	rand.Read(b[:])
+	return prefix + hex.EncodeToString(b[:])
+}
@@ -0,0 +1,48 @@
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// Job is the state of a scheduled job, see package jobs. Instances of the
+// server sharing the store run every job once per scheduled time.
+type Job struct {
+	Name string `json:"name"`
+	// Schedule is the schedule of the job as text, e.g. "0 7 * * *".
+	Schedule string `json:"schedule"`
+	// NextRunAt is when the job is due. A run due while no instance ran is
+	// made when one starts.
+	NextRunAt time.Time `json:"nextRunAt"`
+	// LastRunAt is when the last run finished, and LastSuccessAt when the
+	// last successful one did.
+	LastRunAt     *time.Time `json:"lastRunAt,omitempty"`
+	LastSuccessAt *time.Time `json:"lastSuccessAt,omitempty"`
+	// LastError is the error of the last run, if it failed.
+	LastError string `json:"lastError,omitempty"`
+	// Failures counts the runs failed since the last successful one.
+	Failures int `json:"failures"`
+	// LockedBy is the instance running the job, until LockedUntil. A lock
+	// of an instance that died expires, and another instance runs the job.
+	LockedBy    string     `json:"lockedBy,omitempty"`
+	LockedUntil *time.Time `json:"lockedUntil,omitempty"`
+}
+
+// JobStore keeps the state of scheduled jobs. It must be shared by the
+// instances running them.
+type JobStore interface {
+	// RegisterJob creates the job due at next if it does not exist. If it
+	// does, the job keeps when it is due, unless its schedule changed.
+	RegisterJob(ctx context.Context, name, schedule string, next time.Time) (*Job, error)
+	// ClaimJob locks the job for the holder until ttl after now if it is due
+	// at now and not locked, and returns it, or nil if it is not claimed.
+	ClaimJob(ctx context.Context, name, holder string, now time.Time, ttl time.Duration) (*Job, error)
+	// CompleteJob records a run of the job finished at now by the holder,
+	// with the error if it failed, makes it due at next and unlocks it. It
+	// returns ErrNotFound if the holder does not have the lock anymore.
+	CompleteJob(ctx context.Context, name, holder string, now, next time.Time, runErr string) error
+	// TriggerJob makes the job due at now, or returns ErrNotFound.
+	TriggerJob(ctx context.Context, name string, now time.Time) error
+	// ListJobs returns the jobs by name.
+	ListJobs(ctx context.Context) ([]*Job, error)
+}
@@ -0,0 +1,96 @@
+package store
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/listing"
+)
+
+// Kiosk is a donation tablet at a venue, registered with its own device key.
+type Kiosk struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// KeyHash is the SHA-256 of the device key, which is only shown when the kiosk is registered.
+	KeyHash string `json:"-"`
+	// KeyPrefix is the start of the device key, to recognize it.
+	KeyPrefix string `json:"keyPrefix"`
+	// PINHash is the salted hash of the PIN staff refund donations at the kiosk with, see package kiosk.
+	PINHash string `json:"-"`
+	// Campaign the donations at the kiosk are made for, if any.
+	Campaign string `json:"campaign,omitempty"`
+	Currency string `json:"currency"`
+	// Presets are the amounts the kiosk offers, in the smallest currency unit.
+	Presets []int64 `json:"presets"`
+	// CustomAmounts lets donors enter other amounts than the presets.
+	CustomAmounts bool `json:"customAmounts,omitempty"`
+	// Reader is the ID of the card reader of the kiosk, if donors pay with one.
+	Reader     string    `json:"reader,omitempty"`
+	Disabled   bool      `json:"disabled"`
+	CreatedBy  string    `json:"createdBy"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+	LastSeenAt time.Time `json:"lastSeenAt,omitempty"`
+}
+
+// Statuses of kiosk payments.
+const (
+	KioskPaymentCreated   = "created"
+	KioskPaymentSucceeded = "succeeded"
+	KioskPaymentFailed    = "failed"
+	KioskPaymentRefunded  = "refunded"
+)
+
+// KioskPayment is a payment started by a kiosk, by the ID the kiosk gave it
+// in its offline queue, so the kiosk can reconcile its queue.
+type KioskPayment struct {
+	KioskID   string `json:"kioskID"`
+	OfflineID string `json:"offlineID"`
+	// PaymentIntentID is the intent of the payment, and DonationID the
+	// charge once it succeeded.
+	PaymentIntentID string    `json:"paymentIntentID"`
+	DonationID      string    `json:"donationID,omitempty"`
+	Amount          int64     `json:"amount"`
+	Currency        string    `json:"currency"`
+	Status          string    `json:"status"`
+	QueuedAt        time.Time `json:"queuedAt"`
+	CreatedAt       time.Time `json:"createdAt"`
+	UpdatedAt       time.Time `json:"updatedAt"`
+}
+
+// Sort fields of kiosk lists.
+var KioskListSpec = listing.Spec{
+	Sorts:       []string{"name", "created", "seen"},
+	DefaultSort: "name",
+}
+
+// kioskSortKey returns the key of the kiosk by a sort field of KioskListSpec.
+func kioskSortKey(k *Kiosk, field string) string {
+	switch field {
+	case "created":
+		return listing.TimeKey(k.CreatedAt)
+	case "seen":
+		return listing.TimeKey(k.LastSeenAt)
+	default:
+		return strings.ToLower(k.Name)
+	}
+}
+
+// KioskStore keeps kiosks and their payments.
+type KioskStore interface {
+	// SaveKiosk creates the kiosk, setting its ID if it is empty, or replaces the one with its ID.
+	SaveKiosk(ctx context.Context, k *Kiosk) error
+	// GetKiosk returns a kiosk or ErrNotFound.
+	GetKiosk(ctx context.Context, id string) (*Kiosk, error)
+	// GetKioskByKey returns the kiosk with the hash of a device key or ErrNotFound.
+	GetKioskByKey(ctx context.Context, keyHash string) (*Kiosk, error)
+	// ListKiosks returns a page of kiosks, see KioskListSpec, and the cursor of the next page.
+	ListKiosks(ctx context.Context, q listing.Query) ([]*Kiosk, string, error)
+	// DeleteKiosk deletes a kiosk and its payments or returns ErrNotFound.
+	DeleteKiosk(ctx context.Context, id string) error
+	// SaveKioskPayment inserts the payment or replaces the one with its kiosk and offline ID.
+	SaveKioskPayment(ctx context.Context, p *KioskPayment) error
+	// GetKioskPayment returns a payment of a kiosk by its offline ID or ErrNotFound.
+	GetKioskPayment(ctx context.Context, kioskID, offlineID string) (*KioskPayment, error)
+}
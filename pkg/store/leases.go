@@ -0,0 +1,23 @@
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// Lease is held by one instance of the server at a time, see package leader.
+type Lease struct {
+	Name      string    `json:"name"`
+	Holder    string    `json:"holder"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// LeaseStore keeps leases. It must be shared by the instances electing a leader.
+type LeaseStore interface {
+	// AcquireLease takes the lease for the holder until ttl from now if it
+	// is free, expired or held by the holder already, and reports whether
+	// the holder has it.
+	AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error)
+	// ReleaseLease frees the lease if the holder has it.
+	ReleaseLease(ctx context.Context, name, holder string) error
+}
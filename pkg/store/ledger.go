@@ -0,0 +1,213 @@
+package store
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/vedrankolka/donation-server/pkg/listing"
+	"github.com/vedrankolka/donation-server/pkg/search"
+)
+
+// Ledger is a DonationStore and a CustomerStore of donations in a durable
+// store, e.g. a PostgresStore, with the tags of a MemoryStore. Donations are
+// not cached, every read goes to the durable store, so instances sharing it
+// see each other's donations and memory does not grow with the ledger.
+// Customers are summed up from the donations of each request.
+type Ledger struct {
+	// tags holds the tags of donors and donations, see TagStore.
+	tags    *MemoryStore
+	durable DonationStore
+}
+
+// NewLedger returns the Ledger of the durable store, with the tags of the
+// memory store.
+func NewLedger(tags *MemoryStore, durable DonationStore) *Ledger {
+	return &Ledger{tags: tags, durable: durable}
+}
+
+func (l *Ledger) SaveDonation(ctx context.Context, d *Donation) error {
+	return l.durable.SaveDonation(ctx, d)
+}
+
+func (l *Ledger) GetDonation(ctx context.Context, id string) (*Donation, error) {
+	d, err := l.durable.GetDonation(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	d.Tags = l.tagsOf(TaggedDonation, d.ID)
+	return d, nil
+}
+
+// ListDonations pages through the durable store. With the tag filter, which
+// the durable store need not support, all donations matching the other
+// filters are read to find the tagged ones.
+func (l *Ledger) ListDonations(ctx context.Context, q listing.Query) ([]*Donation, string, error) {
+	if q.Filter.Tag == "" {
+		list, next, err := l.durable.ListDonations(ctx, q)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, d := range list {
+			d.Tags = l.tagsOf(TaggedDonation, d.ID)
+		}
+		return list, next, nil
+	}
+
+	var matching []*Donation
+	err := l.scan(ctx, q.Filter, func(d *Donation) {
+		d.Tags = l.tagsOf(TaggedDonation, d.ID)
+		if q.Filter.MatchTag(append(l.tagsOf(TaggedDonor, d.CustomerID), d.Tags...)) {
+			matching = append(matching, d)
+		}
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	key := func(i int, field string) string {
+		if field == "amount" {
+			return listing.IntKey(matching[i].Amount)
+		}
+		return listing.TimeKey(matching[i].CreatedAt)
+	}
+	id := func(i int) string { return matching[i].ID }
+	page, next := listing.Paginate(len(matching), key, id, q)
+
+	list := make([]*Donation, len(page))
+	for n, i := range page {
+		list[n] = matching[i]
+	}
+	return list, next, nil
+}
+
+// DeleteDonation deletes the donation from the durable store and its tags.
+func (l *Ledger) DeleteDonation(ctx context.Context, id string) error {
+	if err := l.durable.DeleteDonation(ctx, id); err != nil {
+		return err
+	}
+	l.tags.mu.Lock()
+	defer l.tags.mu.Unlock()
+	delete(l.tags.tagged, taggedKey(TaggedDonation, id))
+	return nil
+}
+
+func (l *Ledger) ListCustomers(ctx context.Context, q listing.Query) ([]*Customer, string, error) {
+	customers, err := l.customers(ctx, q.Filter)
+	if err != nil {
+		return nil, "", err
+	}
+
+	key := func(i int, field string) string { return customerKey(customers[i], field) }
+	id := func(i int) string { return customers[i].ID }
+	page, next := listing.Paginate(len(customers), key, id, q)
+
+	list := make([]*Customer, len(page))
+	for n, i := range page {
+		list[n] = customers[i]
+	}
+	return list, next, nil
+}
+
+// SearchCustomers searches the names and emails of the customers summed up
+// from the donations matching the filters.
+func (l *Ledger) SearchCustomers(ctx context.Context, query string, q listing.Query) ([]*CustomerMatch, string, error) {
+	customers, err := l.customers(ctx, q.Filter)
+	if err != nil {
+		return nil, "", err
+	}
+	donors := search.NewTrigramIndex()
+	for _, c := range customers {
+		donors.Put(c.ID, c.Name, c.Email)
+	}
+	scores := make(map[string]float64)
+	for _, result := range donors.Search(query) {
+		scores[result.ID] = result.Score
+	}
+	found := customers[:0]
+	for _, c := range customers {
+		if _, ok := scores[c.ID]; ok {
+			found = append(found, c)
+		}
+	}
+
+	key := func(i int, field string) string {
+		if field == "score" {
+			return listing.ScoreKey(scores[found[i].ID])
+		}
+		return customerKey(found[i], field)
+	}
+	id := func(i int) string { return found[i].ID }
+	page, next := listing.Paginate(len(found), key, id, q)
+
+	list := make([]*CustomerMatch, len(page))
+	for n, i := range page {
+		list[n] = &CustomerMatch{Customer: *found[i], Score: scores[found[i].ID]}
+	}
+	return list, next, nil
+}
+
+func (l *Ledger) GetCustomer(ctx context.Context, id string) (*Customer, error) {
+	customers, err := l.customers(ctx, listing.Filter{Customer: id})
+	if err != nil {
+		return nil, err
+	}
+	if len(customers) == 0 {
+		return nil, ErrNotFound
+	}
+	return customers[0], nil
+}
+
+// customers summarizes the donations of the durable store matching the
+// filter by customer.
+func (l *Ledger) customers(ctx context.Context, f listing.Filter) ([]*Customer, error) {
+	var summaries customerSummaries
+	if err := l.scan(ctx, f, summaries.add); err != nil {
+		return nil, err
+	}
+	return summaries.matching(f, func(id string) []string { return l.tagsOf(TaggedDonor, id) }), nil
+}
+
+// scan calls fn with every donation of the durable store matching the
+// filter, without its tag and segment, page by page.
+func (l *Ledger) scan(ctx context.Context, f listing.Filter, fn func(d *Donation)) error {
+	q, err := DonationListSpec.Parse(url.Values{"sort": {"created"}})
+	if err != nil {
+		return err
+	}
+	q.Filter = f
+	q.Filter.Tag, q.Filter.Segment = "", nil
+	q.Limit = listing.MaxLimit
+
+	for {
+		page, next, err := l.durable.ListDonations(ctx, q)
+		if err != nil {
+			return err
+		}
+		for _, d := range page {
+			fn(d)
+		}
+		if next == "" {
+			return nil
+		}
+		if q.Cursor, err = listing.DecodeCursor(next); err != nil {
+			return err
+		}
+	}
+}
+
+// tagsOf returns the sorted tags of a donor or donation.
+func (l *Ledger) tagsOf(kind, id string) []string {
+	l.tags.mu.RLock()
+	defer l.tags.mu.RUnlock()
+	return l.tags.tagsOf(kind, id)
+}
+
+// Ping checks the durable store.
+func (l *Ledger) Ping(ctx context.Context) error {
+	return l.durable.Ping(ctx)
+}
+
+// Close closes the durable store.
+func (l *Ledger) Close() error {
+	return l.durable.Close()
+}
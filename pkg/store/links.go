@@ -0,0 +1,89 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/listing"
+)
+
+// ErrExpired is returned when a link is used after it expired or ran out of uses.
+var ErrExpired = errors.New("expired")
+
+// Link is a short, pre-configured donation URL, shared in emails and SMS appeals.
+type Link struct {
+	Code string `json:"code"`
+	// Amount in the smallest currency unit, chosen by the donor if zero.
+	Amount   int64  `json:"amount,omitempty"`
+	Currency string `json:"currency"`
+	Campaign string `json:"campaign,omitempty"`
+	// Recipient is the email of the appeal recipient the link was made for, if any.
+	Recipient string `json:"recipient,omitempty"`
+	// Locale of the payment form, e.g. "de", the browser's if empty.
+	Locale    string     `json:"locale,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// MaxUses is the number of times the link can be used, unlimited if zero.
+	MaxUses int `json:"maxUses,omitempty"`
+	// Uses is the number of times the link was used.
+	Uses int `json:"uses"`
+	// Clicks is the number of times the short URL of the link was opened.
+	Clicks    int       `json:"clicks"`
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Usable reports whether the link can be used at the time.
+func (l *Link) Usable(at time.Time) bool {
+	if l.ExpiresAt != nil && !at.Before(*l.ExpiresAt) {
+		return false
+	}
+	return l.MaxUses == 0 || l.Uses < l.MaxUses
+}
+
+// LinkClick is an opening of the short URL of a link.
+type LinkClick struct {
+	At time.Time `json:"at"`
+	// Referrer is the host of the page the link was on, or the source the
+	// appeal tagged the link with, e.g. "sms". Empty if unknown.
+	Referrer string `json:"referrer,omitempty"`
+	// Country is the ISO 3166-1 alpha-2 code of the donor's country, empty if unknown.
+	Country string `json:"country,omitempty"`
+}
+
+// Sort fields and filters of link lists.
+var LinkListSpec = listing.Spec{
+	Sorts:       []string{"created", "uses", "clicks"},
+	DefaultSort: "-created",
+	Filters:     []string{listing.FilterCampaign},
+}
+
+// linkSortKey returns the key of the link by a sort field of LinkListSpec.
+func linkSortKey(l *Link, field string) string {
+	switch field {
+	case "uses":
+		return listing.IntKey(int64(l.Uses))
+	case "clicks":
+		return listing.IntKey(int64(l.Clicks))
+	}
+	return listing.TimeKey(l.CreatedAt)
+}
+
+// LinkStore keeps donation links.
+type LinkStore interface {
+	// CreateLink creates a link or returns ErrExists if its code is taken.
+	CreateLink(ctx context.Context, link *Link) error
+	// GetLink returns a link or ErrNotFound.
+	GetLink(ctx context.Context, code string) (*Link, error)
+	// ListLinks returns a page of links, see LinkListSpec, and the cursor of the next page.
+	ListLinks(ctx context.Context, q listing.Query) ([]*Link, string, error)
+	// DeleteLink deletes a link or returns ErrNotFound.
+	DeleteLink(ctx context.Context, code string) error
+	// UseLink counts a use of a link at the time and returns it, or returns
+	// ErrNotFound, or ErrExpired if it is not usable.
+	UseLink(ctx context.Context, code string, at time.Time) (*Link, error)
+	// RecordClick records a click of a link, counting it, or returns ErrNotFound.
+	RecordClick(ctx context.Context, code string, click LinkClick) error
+	// ListClicks returns the clicks of a link in the order they were recorded, or ErrNotFound.
+	ListClicks(ctx context.Context, code string) ([]LinkClick, error)
+}
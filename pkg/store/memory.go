@@ -0,0 +1,1457 @@
+package store
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/listing"
+	"github.com/vedrankolka/donation-server/pkg/receipt"
+	"github.com/vedrankolka/donation-server/pkg/search"
+	"github.com/vedrankolka/donation-server/pkg/vat"
+)
+
+// MemoryStore keeps donations in memory. It is meant for development and
+// for running without a database; everything is lost on restart.
+type MemoryStore struct {
+	mu        sync.RWMutex
+	donations map[string]Donation
+	invoices  map[string]vat.Invoice
+	sequences map[int]int64
+	// receipts by donation ID, and their sequences by year.
+	receipts         map[string]receipt.Receipt
+	receiptSequences map[int]int64
+	events           map[string]*EventRecord
+	dead             map[string]DeadLetter
+	// interactions of customers by ID.
+	interactions map[string]Interaction
+	tags         map[string]Tag
+	// tagged holds the tags of donors and donations by taggedKey.
+	tagged  map[string]map[string]struct{}
+	reports map[string]ReportDefinition
+	// subscriptions of third parties and their deliveries by ID.
+	subscriptions map[string]Subscription
+	deliveries    map[string]Delivery
+	oauthClients  map[string]OAuthClient
+	// oauthTokens by their hashes.
+	oauthTokens map[string]OAuthToken
+	partners    map[string]Partner
+	campaigns   map[string]Campaign
+	kiosks      map[string]Kiosk
+	// kioskPayments by kioskPaymentKey.
+	kioskPayments map[string]KioskPayment
+	// rollups by granularity, then by rollupKey.
+	rollups map[string]map[string]Rollup
+	leases  map[string]Lease
+	jobs    map[string]Job
+	links   map[string]Link
+	// clicks of links by code.
+	clicks map[string][]LinkClick
+	// donors indexes the names and emails of customers for searches.
+	donors *search.TrigramIndex
+}
+
+// NewMemoryStore creates an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		donations:        make(map[string]Donation),
+		invoices:         make(map[string]vat.Invoice),
+		sequences:        make(map[int]int64),
+		receipts:         make(map[string]receipt.Receipt),
+		receiptSequences: make(map[int]int64),
+		events:           make(map[string]*EventRecord),
+		dead:             make(map[string]DeadLetter),
+		interactions:     make(map[string]Interaction),
+		tags:             make(map[string]Tag),
+		tagged:           make(map[string]map[string]struct{}),
+		reports:          make(map[string]ReportDefinition),
+		subscriptions:    make(map[string]Subscription),
+		deliveries:       make(map[string]Delivery),
+		oauthClients:     make(map[string]OAuthClient),
+		oauthTokens:      make(map[string]OAuthToken),
+		partners:         make(map[string]Partner),
+		kiosks:           make(map[string]Kiosk),
+		kioskPayments:    make(map[string]KioskPayment),
+		campaigns:        make(map[string]Campaign),
+		rollups:          make(map[string]map[string]Rollup),
+		leases:           make(map[string]Lease),
+		jobs:             make(map[string]Job),
+		links:            make(map[string]Link),
+		clicks:           make(map[string][]LinkClick),
+		donors:           search.NewTrigramIndex(),
+	}
+}
+
+func (ms *MemoryStore) SaveDonation(ctx context.Context, d *Donation) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.donations[d.ID] = *d
+	if d.CustomerID != "" {
+		ms.donors.Put(d.CustomerID, d.CustomerName, d.CustomerEmail)
+	}
+	return nil
+}
+
+func (ms *MemoryStore) UpdateDonation(ctx context.Context, old, d *Donation) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	current, ok := ms.donations[old.ID]
+	expected := *old
+	current.Tags, expected.Tags = nil, nil
+	if !ok || !reflect.DeepEqual(current, expected) {
+		return ErrConflict
+	}
+	ms.donations[d.ID] = *d
+	if d.CustomerID != "" {
+		ms.donors.Put(d.CustomerID, d.CustomerName, d.CustomerEmail)
+	}
+	return nil
+}
+
+func (ms *MemoryStore) GetDonation(ctx context.Context, id string) (*Donation, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	d, ok := ms.donations[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	d.Tags = ms.tagsOf(TaggedDonation, d.ID)
+	return &d, nil
+}
+
+func (ms *MemoryStore) DeleteDonation(ctx context.Context, id string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.donations[id]; !ok {
+		return ErrNotFound
+	}
+	delete(ms.donations, id)
+	delete(ms.tagged, taggedKey(TaggedDonation, id))
+	return nil
+}
+
+func (ms *MemoryStore) ListDonations(ctx context.Context, q listing.Query) ([]*Donation, string, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	var matching []Donation
+	for _, d := range ms.donations {
+		d.Tags = ms.tagsOf(TaggedDonation, d.ID)
+		tags := append(ms.tagsOf(TaggedDonor, d.CustomerID), d.Tags...)
+		if matchDonation(q.Filter, &d) && listing.Match(q.Filter.Status, d.Status) && q.Filter.MatchTag(tags) {
+			matching = append(matching, d)
+		}
+	}
+
+	key := func(i int, field string) string {
+		if field == "amount" {
+			return listing.IntKey(matching[i].Amount)
+		}
+		return listing.TimeKey(matching[i].CreatedAt)
+	}
+	id := func(i int) string { return matching[i].ID }
+	page, next := listing.Paginate(len(matching), key, id, q)
+
+	list := make([]*Donation, len(page))
+	for n, i := range page {
+		list[n] = &matching[i]
+	}
+	return list, next, nil
+}
+
+func (ms *MemoryStore) ListCustomers(ctx context.Context, q listing.Query) ([]*Customer, string, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	customers := ms.customers(q.Filter, nil)
+
+	key := func(i int, field string) string { return customerKey(customers[i], field) }
+	id := func(i int) string { return customers[i].ID }
+	page, next := listing.Paginate(len(customers), key, id, q)
+
+	list := make([]*Customer, len(page))
+	for n, i := range page {
+		list[n] = customers[i]
+	}
+	return list, next, nil
+}
+
+func (ms *MemoryStore) SearchCustomers(ctx context.Context, search string, q listing.Query) ([]*CustomerMatch, string, error) {
+	results := ms.donors.Search(search)
+	scores := make(map[string]float64, len(results))
+	for _, result := range results {
+		scores[result.ID] = result.Score
+	}
+
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	customers := ms.customers(q.Filter, scores)
+
+	key := func(i int, field string) string {
+		if field == "score" {
+			return listing.ScoreKey(scores[customers[i].ID])
+		}
+		return customerKey(customers[i], field)
+	}
+	id := func(i int) string { return customers[i].ID }
+	page, next := listing.Paginate(len(customers), key, id, q)
+
+	list := make([]*CustomerMatch, len(page))
+	for n, i := range page {
+		list[n] = &CustomerMatch{Customer: *customers[i], Score: scores[customers[i].ID]}
+	}
+	return list, next, nil
+}
+
+func (ms *MemoryStore) GetCustomer(ctx context.Context, id string) (*Customer, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	customers := ms.customers(listing.Filter{}, map[string]float64{id: 1})
+	if len(customers) == 0 {
+		return nil, ErrNotFound
+	}
+	return customers[0], nil
+}
+
+// customers summarizes the donations matching the filter by customer. If
+// only is not nil, only the customers in it are summarized. ms.mu must be held.
+func (ms *MemoryStore) customers(f listing.Filter, only map[string]float64) []*Customer {
+	var summaries customerSummaries
+	for _, d := range ms.donations {
+		if !matchDonation(f, &d) {
+			continue
+		}
+		if _, ok := only[d.CustomerID]; only != nil && !ok {
+			continue
+		}
+		summaries.add(&d)
+	}
+	return summaries.matching(f, func(id string) []string { return ms.tagsOf(TaggedDonor, id) })
+}
+
+func customerKey(c *Customer, field string) string {
+	switch field {
+	case "firstDonation":
+		return listing.TimeKey(c.FirstDonationAt)
+	case "donations":
+		return listing.IntKey(int64(c.Donations))
+	case "name":
+		return strings.ToLower(c.Name)
+	default:
+		return listing.TimeKey(c.LastDonationAt)
+	}
+}
+
+// matchDonation reports whether the donation matches the amount, created,
+// currency, campaign, partner, customer and link filters.
+func matchDonation(f listing.Filter, d *Donation) bool {
+	return f.MatchAmount(d.Amount) && f.MatchCreated(d.CreatedAt) &&
+		listing.Match(f.Currency, d.Currency) && listing.Match(f.Campaign, d.Campaign) &&
+		listing.Match(f.Partner, d.Partner) && (f.Customer == "" || f.Customer == d.CustomerID) &&
+		(f.Link == "" || f.Link == d.Link)
+}
+
+func (ms *MemoryStore) NextInvoiceSequence(ctx context.Context, year int) (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.sequences[year]++
+	return ms.sequences[year], nil
+}
+
+func (ms *MemoryStore) SaveInvoice(ctx context.Context, invoice *vat.Invoice) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.invoices[invoice.ChargeID] = *invoice
+	return nil
+}
+
+func (ms *MemoryStore) GetInvoiceByCharge(ctx context.Context, chargeID string) (*vat.Invoice, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	invoice, ok := ms.invoices[chargeID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &invoice, nil
+}
+
+func (ms *MemoryStore) GetInvoice(ctx context.Context, number string) (*vat.Invoice, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	for _, invoice := range ms.invoices {
+		if invoice.Number == number {
+			return &invoice, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (ms *MemoryStore) RecordEventAttempt(ctx context.Context, id, eventType string, attempt EventAttempt) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	record := ms.event(id)
+	if record.Type == "" {
+		record.Type = eventType
+	}
+	if record.ReceivedAt.IsZero() {
+		record.ReceivedAt = attempt.At
+	}
+	record.Attempts = append(record.Attempts, attempt)
+	record.Retries = len(record.Attempts) - 1
+	record.Outcome = attempt.Outcome
+	return nil
+}
+
+func (ms *MemoryStore) RecordNotification(ctx context.Context, id string, notification EmittedNotification) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	record := ms.event(id)
+	record.Notifications = append(record.Notifications, notification)
+	return nil
+}
+
+func (ms *MemoryStore) GetEvent(ctx context.Context, id string) (*EventRecord, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	record, ok := ms.events[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	copied := *record
+	copied.Attempts = append([]EventAttempt(nil), record.Attempts...)
+	copied.Notifications = append([]EmittedNotification(nil), record.Notifications...)
+	return &copied, nil
+}
+
+func (ms *MemoryStore) ListEvents(ctx context.Context, q listing.Query) ([]*EventRecord, string, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	f := q.Filter
+	var matching []*EventRecord
+	for _, record := range ms.events {
+		// Records without attempts only have notifications recorded so far.
+		if record.ReceivedAt.IsZero() {
+			continue
+		}
+		if f.MatchCreated(record.ReceivedAt) && listing.Match(f.Type, record.Type) && listing.Match(f.Outcome, record.Outcome) {
+			matching = append(matching, record)
+		}
+	}
+
+	key := func(i int, field string) string { return listing.TimeKey(matching[i].ReceivedAt) }
+	id := func(i int) string { return matching[i].ID }
+	page, next := listing.Paginate(len(matching), key, id, q)
+
+	list := make([]*EventRecord, len(page))
+	for n, i := range page {
+		copied := *matching[i]
+		copied.Attempts = append([]EventAttempt(nil), matching[i].Attempts...)
+		copied.Notifications = append([]EmittedNotification(nil), matching[i].Notifications...)
+		list[n] = &copied
+	}
+	return list, next, nil
+}
+
+// event returns the record of the event, creating it if needed. ms.mu must be held.
+func (ms *MemoryStore) event(id string) *EventRecord {
+	record, ok := ms.events[id]
+	if !ok {
+		record = &EventRecord{ID: id}
+		ms.events[id] = record
+	}
+	return record
+}
+
+func (ms *MemoryStore) AddDeadLetter(ctx context.Context, dl *DeadLetter) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	added := *dl
+	if existing, ok := ms.dead[dl.ID]; ok {
+		added.FailedAt = existing.FailedAt
+		added.Attempts += existing.Attempts
+	}
+	added.Status = DeadLetterPending
+	ms.dead[dl.ID] = added
+	return nil
+}
+
+func (ms *MemoryStore) GetDeadLetter(ctx context.Context, id string) (*DeadLetter, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	dl, ok := ms.dead[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &dl, nil
+}
+
+func (ms *MemoryStore) ListDeadLetters(ctx context.Context, q listing.Query) ([]*DeadLetter, string, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	f := q.Filter
+	var matching []DeadLetter
+	for _, dl := range ms.dead {
+		if f.MatchCreated(dl.FailedAt) && listing.Match(f.Status, dl.Status) &&
+			listing.Match(f.Reason, dl.Reason) && listing.Match(f.Type, dl.Type) {
+			matching = append(matching, dl)
+		}
+	}
+
+	key := func(i int, field string) string {
+		if field == "updated" {
+			return listing.TimeKey(matching[i].UpdatedAt)
+		}
+		return listing.TimeKey(matching[i].FailedAt)
+	}
+	id := func(i int) string { return matching[i].ID }
+	page, next := listing.Paginate(len(matching), key, id, q)
+
+	list := make([]*DeadLetter, len(page))
+	for n, i := range page {
+		list[n] = &matching[i]
+	}
+	return list, next, nil
+}
+
+func (ms *MemoryStore) SetDeadLetterStatus(ctx context.Context, id, status string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	dl, ok := ms.dead[id]
+	if !ok {
+		return ErrNotFound
+	}
+	dl.Status = status
+	dl.UpdatedAt = time.Now().UTC()
+	ms.dead[id] = dl
+	return nil
+}
+
+func (ms *MemoryStore) AddInteraction(ctx context.Context, interaction *Interaction) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	interaction.ID = newID("int_")
+	ms.interactions[interaction.ID] = *interaction
+	return nil
+}
+
+func (ms *MemoryStore) GetInteraction(ctx context.Context, customerID, id string) (*Interaction, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	interaction, ok := ms.interactions[id]
+	if !ok || interaction.CustomerID != customerID {
+		return nil, ErrNotFound
+	}
+	return &interaction, nil
+}
+
+func (ms *MemoryStore) ListInteractions(ctx context.Context, customerID string, q listing.Query) ([]*Interaction, string, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	var matching []Interaction
+	for _, interaction := range ms.interactions {
+		if interaction.CustomerID == customerID && q.Filter.MatchCreated(interaction.OccurredAt) &&
+			listing.Match(q.Filter.Type, interaction.Type) {
+			matching = append(matching, interaction)
+		}
+	}
+
+	key := func(i int, field string) string {
+		if field == "created" {
+			return listing.TimeKey(matching[i].CreatedAt)
+		}
+		return listing.TimeKey(matching[i].OccurredAt)
+	}
+	id := func(i int) string { return matching[i].ID }
+	page, next := listing.Paginate(len(matching), key, id, q)
+
+	list := make([]*Interaction, len(page))
+	for n, i := range page {
+		list[n] = &matching[i]
+	}
+	return list, next, nil
+}
+
+func (ms *MemoryStore) DeleteInteraction(ctx context.Context, customerID, id string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	interaction, ok := ms.interactions[id]
+	if !ok || interaction.CustomerID != customerID {
+		return ErrNotFound
+	}
+	delete(ms.interactions, id)
+	return nil
+}
+
+func (ms *MemoryStore) CreateTag(ctx context.Context, tag *Tag) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.tags[tag.Name]; ok {
+		return ErrExists
+	}
+	ms.tags[tag.Name] = *tag
+	return nil
+}
+
+func (ms *MemoryStore) GetTag(ctx context.Context, name string) (*Tag, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	tag, ok := ms.tags[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	ms.countTagged(&tag)
+	return &tag, nil
+}
+
+func (ms *MemoryStore) ListTags(ctx context.Context, q listing.Query) ([]*Tag, string, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	tags := make([]Tag, 0, len(ms.tags))
+	for _, tag := range ms.tags {
+		tags = append(tags, tag)
+	}
+
+	key := func(i int, field string) string {
+		if field == "created" {
+			return listing.TimeKey(tags[i].CreatedAt)
+		}
+		return tags[i].Name
+	}
+	id := func(i int) string { return tags[i].Name }
+	page, next := listing.Paginate(len(tags), key, id, q)
+
+	list := make([]*Tag, len(page))
+	for n, i := range page {
+		ms.countTagged(&tags[i])
+		list[n] = &tags[i]
+	}
+	return list, next, nil
+}
+
+func (ms *MemoryStore) DeleteTag(ctx context.Context, name string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.tags[name]; !ok {
+		return ErrNotFound
+	}
+	delete(ms.tags, name)
+	for key, tags := range ms.tagged {
+		delete(tags, name)
+		if len(tags) == 0 {
+			delete(ms.tagged, key)
+		}
+	}
+	return nil
+}
+
+func (ms *MemoryStore) AddTag(ctx context.Context, kind, id, tag string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.tags[tag]; !ok {
+		return ErrNotFound
+	}
+	key := taggedKey(kind, id)
+	if ms.tagged[key] == nil {
+		ms.tagged[key] = make(map[string]struct{})
+	}
+	ms.tagged[key][tag] = struct{}{}
+	return nil
+}
+
+func (ms *MemoryStore) RemoveTag(ctx context.Context, kind, id, tag string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	key := taggedKey(kind, id)
+	delete(ms.tagged[key], tag)
+	if len(ms.tagged[key]) == 0 {
+		delete(ms.tagged, key)
+	}
+	return nil
+}
+
+// tagsOf returns the sorted tags of a donor or donation. ms.mu must be held.
+func (ms *MemoryStore) tagsOf(kind, id string) []string {
+	set := ms.tagged[taggedKey(kind, id)]
+	if len(set) == 0 {
+		return nil
+	}
+	tags := make([]string, 0, len(set))
+	for tag := range set {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// countTagged sets the numbers of donors and donations with the tag. ms.mu must be held.
+func (ms *MemoryStore) countTagged(tag *Tag) {
+	tag.Donors, tag.Donations = 0, 0
+	for key, tags := range ms.tagged {
+		if _, ok := tags[tag.Name]; !ok {
+			continue
+		}
+		if strings.HasPrefix(key, TaggedDonor+"/") {
+			tag.Donors++
+		} else {
+			tag.Donations++
+		}
+	}
+}
+
+func taggedKey(kind, id string) string {
+	return kind + "/" + id
+}
+
+func (ms *MemoryStore) SaveReport(ctx context.Context, report *ReportDefinition) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if report.ID == "" {
+		report.ID = newID("rep_")
+	}
+	ms.reports[report.ID] = *report
+	return nil
+}
+
+func (ms *MemoryStore) GetReport(ctx context.Context, id string) (*ReportDefinition, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	report, ok := ms.reports[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &report, nil
+}
+
+func (ms *MemoryStore) ListReports(ctx context.Context, q listing.Query) ([]*ReportDefinition, string, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	reports := make([]ReportDefinition, 0, len(ms.reports))
+	for _, report := range ms.reports {
+		reports = append(reports, report)
+	}
+
+	key := func(i int, field string) string {
+		if field == "created" {
+			return listing.TimeKey(reports[i].CreatedAt)
+		}
+		return strings.ToLower(reports[i].Name)
+	}
+	id := func(i int) string { return reports[i].ID }
+	page, next := listing.Paginate(len(reports), key, id, q)
+
+	list := make([]*ReportDefinition, len(page))
+	for n, i := range page {
+		list[n] = &reports[i]
+	}
+	return list, next, nil
+}
+
+func (ms *MemoryStore) DeleteReport(ctx context.Context, id string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.reports[id]; !ok {
+		return ErrNotFound
+	}
+	delete(ms.reports, id)
+	return nil
+}
+
+func (ms *MemoryStore) DueReports(ctx context.Context, now time.Time) ([]*ReportDefinition, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	var due []*ReportDefinition
+	for _, report := range ms.reports {
+		report := report
+		if report.Schedule != "" && report.NextRunAt != nil && !report.NextRunAt.After(now) {
+			due = append(due, &report)
+		}
+	}
+	return due, nil
+}
+
+func (ms *MemoryStore) RecordReportRun(ctx context.Context, id string, run ReportRun) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	report, ok := ms.reports[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if report.NextRunAt == nil || !report.NextRunAt.Equal(run.Due) {
+		return ErrConflict
+	}
+	at, next := run.At, run.Next
+	report.LastRunAt, report.NextRunAt, report.LastError = &at, &next, run.Error
+	ms.reports[id] = report
+	return nil
+}
+
+func (ms *MemoryStore) SaveSubscription(ctx context.Context, s *Subscription) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if s.ID == "" {
+		s.ID = newID("sub_")
+	}
+	ms.subscriptions[s.ID] = *s
+	return nil
+}
+
+func (ms *MemoryStore) GetSubscription(ctx context.Context, id string) (*Subscription, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	s, ok := ms.subscriptions[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &s, nil
+}
+
+func (ms *MemoryStore) ListSubscriptions(ctx context.Context, q listing.Query) ([]*Subscription, string, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	subscriptions := make([]Subscription, 0, len(ms.subscriptions))
+	for _, s := range ms.subscriptions {
+		subscriptions = append(subscriptions, s)
+	}
+
+	key := func(i int, field string) string { return listing.TimeKey(subscriptions[i].CreatedAt) }
+	id := func(i int) string { return subscriptions[i].ID }
+	page, next := listing.Paginate(len(subscriptions), key, id, q)
+
+	list := make([]*Subscription, len(page))
+	for n, i := range page {
+		list[n] = &subscriptions[i]
+	}
+	return list, next, nil
+}
+
+func (ms *MemoryStore) DeleteSubscription(ctx context.Context, id string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.subscriptions[id]; !ok {
+		return ErrNotFound
+	}
+	delete(ms.subscriptions, id)
+	for deliveryID, d := range ms.deliveries {
+		if d.SubscriptionID == id {
+			delete(ms.deliveries, deliveryID)
+		}
+	}
+	return nil
+}
+
+func (ms *MemoryStore) SaveDelivery(ctx context.Context, d *Delivery) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if d.ID == "" {
+		d.ID = newID("dlv_")
+	}
+	saved := *d
+	saved.Attempts = append([]DeliveryAttempt(nil), d.Attempts...)
+	ms.deliveries[d.ID] = saved
+	return nil
+}
+
+func (ms *MemoryStore) GetDelivery(ctx context.Context, id string) (*Delivery, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	d, ok := ms.deliveries[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &d, nil
+}
+
+func (ms *MemoryStore) ListDeliveries(ctx context.Context, subscriptionID string, q listing.Query) ([]*Delivery, string, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	var deliveries []Delivery
+	for _, d := range ms.deliveries {
+		if d.SubscriptionID == subscriptionID && q.Filter.MatchCreated(d.CreatedAt) &&
+			listing.Match(q.Filter.Status, d.Status) && listing.Match(q.Filter.Type, d.Type) {
+			deliveries = append(deliveries, d)
+		}
+	}
+
+	key := func(i int, field string) string { return listing.TimeKey(deliveries[i].CreatedAt) }
+	id := func(i int) string { return deliveries[i].ID }
+	page, next := listing.Paginate(len(deliveries), key, id, q)
+
+	list := make([]*Delivery, len(page))
+	for n, i := range page {
+		list[n] = &deliveries[i]
+	}
+	return list, next, nil
+}
+
+func (ms *MemoryStore) DueDeliveries(ctx context.Context, now time.Time) ([]*Delivery, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	var due []*Delivery
+	for _, d := range ms.deliveries {
+		d := d
+		if d.Status == DeliveryPending && d.NextAttemptAt != nil && !d.NextAttemptAt.After(now) {
+			due = append(due, &d)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].NextAttemptAt.Before(*due[j].NextAttemptAt) })
+	return due, nil
+}
+
+func (ms *MemoryStore) SaveOAuthClient(ctx context.Context, client *OAuthClient) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if client.ID == "" {
+		client.ID = newID("cli_")
+	}
+	ms.oauthClients[client.ID] = *client
+	return nil
+}
+
+func (ms *MemoryStore) GetOAuthClient(ctx context.Context, id string) (*OAuthClient, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	client, ok := ms.oauthClients[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &client, nil
+}
+
+func (ms *MemoryStore) ListOAuthClients(ctx context.Context, q listing.Query) ([]*OAuthClient, string, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	clients := make([]OAuthClient, 0, len(ms.oauthClients))
+	for _, client := range ms.oauthClients {
+		clients = append(clients, client)
+	}
+
+	key := func(i int, field string) string {
+		if field == "name" {
+			return strings.ToLower(clients[i].Name)
+		}
+		return listing.TimeKey(clients[i].CreatedAt)
+	}
+	id := func(i int) string { return clients[i].ID }
+	page, next := listing.Paginate(len(clients), key, id, q)
+
+	list := make([]*OAuthClient, len(page))
+	for n, i := range page {
+		list[n] = &clients[i]
+	}
+	return list, next, nil
+}
+
+func (ms *MemoryStore) DeleteOAuthClient(ctx context.Context, id string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.oauthClients[id]; !ok {
+		return ErrNotFound
+	}
+	delete(ms.oauthClients, id)
+	for hash, token := range ms.oauthTokens {
+		if token.ClientID == id {
+			delete(ms.oauthTokens, hash)
+		}
+	}
+	return nil
+}
+
+func (ms *MemoryStore) SaveOAuthToken(ctx context.Context, token *OAuthToken) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	// Expired tokens are dropped when new ones are issued.
+	now := time.Now()
+	for hash, t := range ms.oauthTokens {
+		if now.After(t.ExpiresAt) {
+			delete(ms.oauthTokens, hash)
+		}
+	}
+	ms.oauthTokens[token.Hash] = *token
+	return nil
+}
+
+func (ms *MemoryStore) GetOAuthToken(ctx context.Context, hash string) (*OAuthToken, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	token, ok := ms.oauthTokens[hash]
+	if !ok || token.Used || time.Now().After(token.ExpiresAt) {
+		return nil, ErrNotFound
+	}
+	return &token, nil
+}
+
+func (ms *MemoryStore) TakeOAuthToken(ctx context.Context, hash string) (*OAuthToken, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	token, ok := ms.oauthTokens[hash]
+	if !ok || time.Now().After(token.ExpiresAt) {
+		return nil, ErrNotFound
+	}
+	if token.Used {
+		return &token, ErrUsed
+	}
+	used := token
+	used.Used = true
+	ms.oauthTokens[hash] = used
+	return &token, nil
+}
+
+func (ms *MemoryStore) RevokeOAuthGrant(ctx context.Context, grant string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for hash, token := range ms.oauthTokens {
+		if token.Grant == grant {
+			delete(ms.oauthTokens, hash)
+		}
+	}
+	return nil
+}
+
+func (ms *MemoryStore) DeleteOAuthToken(ctx context.Context, hash string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	delete(ms.oauthTokens, hash)
+	return nil
+}
+
+func (ms *MemoryStore) SavePartner(ctx context.Context, p *Partner) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if p.ID == "" {
+		p.ID = newID("par_")
+	}
+	saved := *p
+	saved.Donations, saved.Totals = 0, nil
+	ms.partners[p.ID] = saved
+	return nil
+}
+
+func (ms *MemoryStore) GetPartner(ctx context.Context, id string) (*Partner, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	p, ok := ms.partners[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	ms.sumPartner(&p)
+	return &p, nil
+}
+
+func (ms *MemoryStore) GetPartnerByKey(ctx context.Context, keyHash string) (*Partner, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	for _, p := range ms.partners {
+		if p.KeyHash == keyHash {
+			return &p, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (ms *MemoryStore) ListPartners(ctx context.Context, q listing.Query) ([]*Partner, string, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	partners := make([]Partner, 0, len(ms.partners))
+	for _, p := range ms.partners {
+		ms.sumPartner(&p)
+		partners = append(partners, p)
+	}
+
+	key := func(i int, field string) string { return partnerSortKey(&partners[i], field) }
+	id := func(i int) string { return partners[i].ID }
+	page, next := listing.Paginate(len(partners), key, id, q)
+
+	list := make([]*Partner, len(page))
+	for n, i := range page {
+		list[n] = &partners[i]
+	}
+	return list, next, nil
+}
+
+func (ms *MemoryStore) DeletePartner(ctx context.Context, id string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.partners[id]; !ok {
+		return ErrNotFound
+	}
+	delete(ms.partners, id)
+	return nil
+}
+
+// sumPartner sets the totals of the donations attributed to the partner.
+func (ms *MemoryStore) sumPartner(p *Partner) {
+	p.Donations, p.Totals = 0, make(map[string]int64)
+	for _, d := range ms.donations {
+		if d.Partner == p.ID {
+			p.Donations++
+			p.Totals[d.Currency] += d.Amount
+		}
+	}
+}
+
+func (ms *MemoryStore) SaveKiosk(ctx context.Context, k *Kiosk) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if k.ID == "" {
+		k.ID = newID("kio_")
+	}
+	saved := *k
+	saved.Presets = append([]int64(nil), k.Presets...)
+	ms.kiosks[k.ID] = saved
+	return nil
+}
+
+func (ms *MemoryStore) GetKiosk(ctx context.Context, id string) (*Kiosk, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	k, ok := ms.kiosks[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &k, nil
+}
+
+func (ms *MemoryStore) GetKioskByKey(ctx context.Context, keyHash string) (*Kiosk, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	for _, k := range ms.kiosks {
+		if k.KeyHash == keyHash {
+			return &k, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (ms *MemoryStore) ListKiosks(ctx context.Context, q listing.Query) ([]*Kiosk, string, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	kiosks := make([]Kiosk, 0, len(ms.kiosks))
+	for _, k := range ms.kiosks {
+		kiosks = append(kiosks, k)
+	}
+
+	key := func(i int, field string) string { return kioskSortKey(&kiosks[i], field) }
+	id := func(i int) string { return kiosks[i].ID }
+	page, next := listing.Paginate(len(kiosks), key, id, q)
+
+	list := make([]*Kiosk, len(page))
+	for n, i := range page {
+		list[n] = &kiosks[i]
+	}
+	return list, next, nil
+}
+
+func (ms *MemoryStore) DeleteKiosk(ctx context.Context, id string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.kiosks[id]; !ok {
+		return ErrNotFound
+	}
+	delete(ms.kiosks, id)
+	for key, p := range ms.kioskPayments {
+		if p.KioskID == id {
+			delete(ms.kioskPayments, key)
+		}
+	}
+	return nil
+}
+
+// kioskPaymentKey is the key of a payment of a kiosk in the map.
+func kioskPaymentKey(kioskID, offlineID string) string {
+	return kioskID + "/" + offlineID
+}
+
+func (ms *MemoryStore) SaveKioskPayment(ctx context.Context, p *KioskPayment) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.kioskPayments[kioskPaymentKey(p.KioskID, p.OfflineID)] = *p
+	return nil
+}
+
+func (ms *MemoryStore) GetKioskPayment(ctx context.Context, kioskID, offlineID string) (*KioskPayment, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	p, ok := ms.kioskPayments[kioskPaymentKey(kioskID, offlineID)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &p, nil
+}
+
+func (ms *MemoryStore) SaveCampaign(ctx context.Context, c *Campaign) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	saved := *c
+	saved.Donations, saved.Totals = 0, nil
+	ms.campaigns[c.ID] = saved
+	return nil
+}
+
+func (ms *MemoryStore) GetCampaign(ctx context.Context, id string) (*Campaign, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	c, ok := ms.campaigns[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	ms.sumCampaign(&c)
+	return &c, nil
+}
+
+func (ms *MemoryStore) ListCampaigns(ctx context.Context, q listing.Query) ([]*Campaign, string, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	campaigns := make([]Campaign, 0, len(ms.campaigns))
+	for _, c := range ms.campaigns {
+		ms.sumCampaign(&c)
+		campaigns = append(campaigns, c)
+	}
+
+	key := func(i int, field string) string { return campaignSortKey(&campaigns[i], field) }
+	id := func(i int) string { return campaigns[i].ID }
+	page, next := listing.Paginate(len(campaigns), key, id, q)
+
+	list := make([]*Campaign, len(page))
+	for n, i := range page {
+		list[n] = &campaigns[i]
+	}
+	return list, next, nil
+}
+
+func (ms *MemoryStore) DeleteCampaign(ctx context.Context, id string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.campaigns[id]; !ok {
+		return ErrNotFound
+	}
+	delete(ms.campaigns, id)
+	return nil
+}
+
+// sumCampaign sets the totals of the donations made for the campaign.
+func (ms *MemoryStore) sumCampaign(c *Campaign) {
+	c.Donations, c.Totals = 0, make(map[string]int64)
+	for _, d := range ms.donations {
+		if d.Campaign == c.ID && d.Status == StatusSucceeded {
+			c.Donations++
+			c.Totals[d.Currency] += d.Amount
+		}
+	}
+}
+
+// Ping always succeeds, the store is in memory.
+func (ms *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (ms *MemoryStore) Close() error {
+	return nil
+}
+
+func rollupKey(r *Rollup) string {
+	return r.Start.UTC().Format(time.RFC3339) + "\x00" + r.Currency + "\x00" + r.Campaign
+}
+
+func (ms *MemoryStore) ReplaceRollups(ctx context.Context, granularity string, from, to time.Time, rollups []Rollup) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	existing, ok := ms.rollups[granularity]
+	if !ok {
+		existing = make(map[string]Rollup)
+		ms.rollups[granularity] = existing
+	}
+	for key, r := range existing {
+		if !r.Start.Before(from) && r.Start.Before(to) {
+			delete(existing, key)
+		}
+	}
+	for _, r := range rollups {
+		existing[rollupKey(&r)] = r
+	}
+	return nil
+}
+
+func (ms *MemoryStore) ListRollups(ctx context.Context, granularity string, from, to time.Time) ([]*Rollup, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	var rollups []*Rollup
+	for _, r := range ms.rollups[granularity] {
+		r := r
+		if !r.Start.Before(from) && r.Start.Before(to) {
+			rollups = append(rollups, &r)
+		}
+	}
+	sort.Slice(rollups, func(i, j int) bool {
+		if !rollups[i].Start.Equal(rollups[j].Start) {
+			return rollups[i].Start.Before(rollups[j].Start)
+		}
+		return rollupKey(rollups[i]) < rollupKey(rollups[j])
+	})
+	return rollups, nil
+}
+
+func (ms *MemoryStore) AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := time.Now()
+	if lease, ok := ms.leases[name]; ok && lease.Holder != holder && lease.ExpiresAt.After(now) {
+		return false, nil
+	}
+	ms.leases[name] = Lease{Name: name, Holder: holder, ExpiresAt: now.Add(ttl)}
+	return true, nil
+}
+
+func (ms *MemoryStore) ReleaseLease(ctx context.Context, name, holder string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if lease, ok := ms.leases[name]; ok && lease.Holder == holder {
+		delete(ms.leases, name)
+	}
+	return nil
+}
+
+func (ms *MemoryStore) RegisterJob(ctx context.Context, name, schedule string, next time.Time) (*Job, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	job, ok := ms.jobs[name]
+	if !ok || job.Schedule != schedule {
+		job.Name, job.Schedule, job.NextRunAt = name, schedule, next
+		ms.jobs[name] = job
+	}
+	return &job, nil
+}
+
+func (ms *MemoryStore) ClaimJob(ctx context.Context, name, holder string, now time.Time, ttl time.Duration) (*Job, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	job, ok := ms.jobs[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if job.NextRunAt.After(now) || (job.LockedUntil != nil && job.LockedUntil.After(now)) {
+		return nil, nil
+	}
+	lockedUntil := now.Add(ttl)
+	job.LockedBy, job.LockedUntil = holder, &lockedUntil
+	ms.jobs[name] = job
+	return &job, nil
+}
+
+func (ms *MemoryStore) CompleteJob(ctx context.Context, name, holder string, now, next time.Time, runErr string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	job, ok := ms.jobs[name]
+	if !ok || job.LockedBy != holder {
+		return ErrNotFound
+	}
+	job.LastRunAt, job.LastError = &now, runErr
+	if runErr == "" {
+		job.LastSuccessAt, job.Failures = &now, 0
+	} else {
+		job.Failures++
+	}
+	job.NextRunAt = next
+	job.LockedBy, job.LockedUntil = "", nil
+	ms.jobs[name] = job
+	return nil
+}
+
+func (ms *MemoryStore) TriggerJob(ctx context.Context, name string, now time.Time) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	job, ok := ms.jobs[name]
+	if !ok {
+		return ErrNotFound
+	}
+	job.NextRunAt = now
+	ms.jobs[name] = job
+	return nil
+}
+
+func (ms *MemoryStore) ListJobs(ctx context.Context) ([]*Job, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	jobs := make([]*Job, 0, len(ms.jobs))
+	for _, job := range ms.jobs {
+		job := job
+		jobs = append(jobs, &job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Name < jobs[j].Name })
+	return jobs, nil
+}
+
+func (ms *MemoryStore) CreateLink(ctx context.Context, link *Link) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.links[link.Code]; ok {
+		return ErrExists
+	}
+	ms.links[link.Code] = *link
+	return nil
+}
+
+func (ms *MemoryStore) GetLink(ctx context.Context, code string) (*Link, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	link, ok := ms.links[code]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &link, nil
+}
+
+func (ms *MemoryStore) ListLinks(ctx context.Context, q listing.Query) ([]*Link, string, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	links := make([]Link, 0, len(ms.links))
+	for _, link := range ms.links {
+		if listing.Match(q.Filter.Campaign, link.Campaign) {
+			links = append(links, link)
+		}
+	}
+
+	key := func(i int, field string) string { return linkSortKey(&links[i], field) }
+	id := func(i int) string { return links[i].Code }
+	page, next := listing.Paginate(len(links), key, id, q)
+
+	list := make([]*Link, len(page))
+	for n, i := range page {
+		list[n] = &links[i]
+	}
+	return list, next, nil
+}
+
+func (ms *MemoryStore) DeleteLink(ctx context.Context, code string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.links[code]; !ok {
+		return ErrNotFound
+	}
+	delete(ms.links, code)
+	delete(ms.clicks, code)
+	return nil
+}
+
+func (ms *MemoryStore) UseLink(ctx context.Context, code string, at time.Time) (*Link, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	link, ok := ms.links[code]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if !link.Usable(at) {
+		return nil, ErrExpired
+	}
+	link.Uses++
+	ms.links[code] = link
+	return &link, nil
+}
+
+func (ms *MemoryStore) RecordClick(ctx context.Context, code string, click LinkClick) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	link, ok := ms.links[code]
+	if !ok {
+		return ErrNotFound
+	}
+	link.Clicks++
+	ms.links[code] = link
+	ms.clicks[code] = append(ms.clicks[code], click)
+	return nil
+}
+
+func (ms *MemoryStore) ListClicks(ctx context.Context, code string) ([]LinkClick, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	if _, ok := ms.links[code]; !ok {
+		return nil, ErrNotFound
+	}
+	return append([]LinkClick(nil), ms.clicks[code]...), nil
+}
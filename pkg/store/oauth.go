@@ -0,0 +1,85 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/listing"
+)
+
+// ErrUsed is returned when a code or refresh token is taken again.
+var ErrUsed = errors.New("used")
+
+// OAuthClient is a third-party app allowed to get tokens for the admin API.
+type OAuthClient struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// SecretHash is the SHA-256 of the client secret, which is only shown when the client is created.
+	SecretHash string `json:"-"`
+	// RedirectURIs are where the authorization code flow may redirect to.
+	RedirectURIs []string `json:"redirectURIs,omitempty"`
+	// Scopes are the most a token of the client can get.
+	Scopes    []string  `json:"scopes"`
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Kinds of OAuth tokens.
+const (
+	TokenAccess  = "access"
+	TokenRefresh = "refresh"
+	TokenCode    = "code"
+)
+
+// OAuthToken is an issued access token, refresh token or authorization code.
+type OAuthToken struct {
+	// Hash is the SHA-256 of the token, the token itself is never stored.
+	Hash     string   `json:"-"`
+	Kind     string   `json:"kind"`
+	ClientID string   `json:"clientID"`
+	Scopes   []string `json:"scopes"`
+	// Principal is who the token acts for, e.g. the client or the admin who authorized it.
+	Principal string `json:"principal"`
+	// RedirectURI and CodeChallenge (PKCE, S256) of an authorization code.
+	RedirectURI   string `json:"redirectURI,omitempty"`
+	CodeChallenge string `json:"-"`
+	// Grant is the hash of the authorization code the token was issued from,
+	// directly or through refresh tokens, so they can all be revoked together.
+	Grant string `json:"grant,omitempty"`
+	// Used marks a taken code or refresh token, kept until it expires to
+	// recognize it if it is used again.
+	Used      bool      `json:"used,omitempty"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Sort fields of OAuth client lists.
+var OAuthClientListSpec = listing.Spec{
+	Sorts:       []string{"created", "name"},
+	DefaultSort: "created",
+}
+
+// OAuthStore keeps OAuth clients and the tokens issued to them.
+type OAuthStore interface {
+	// SaveOAuthClient creates the client, setting its ID if it is empty, or replaces the one with its ID.
+	SaveOAuthClient(ctx context.Context, client *OAuthClient) error
+	// GetOAuthClient returns a client or ErrNotFound.
+	GetOAuthClient(ctx context.Context, id string) (*OAuthClient, error)
+	// ListOAuthClients returns a page of clients, see OAuthClientListSpec, and the cursor of the next page.
+	ListOAuthClients(ctx context.Context, q listing.Query) ([]*OAuthClient, string, error)
+	// DeleteOAuthClient deletes a client and revokes its tokens, or returns ErrNotFound.
+	DeleteOAuthClient(ctx context.Context, id string) error
+
+	// SaveOAuthToken saves an issued token.
+	SaveOAuthToken(ctx context.Context, token *OAuthToken) error
+	// GetOAuthToken returns the token with the hash or ErrNotFound, also if it expired or was used.
+	GetOAuthToken(ctx context.Context, hash string) (*OAuthToken, error)
+	// TakeOAuthToken marks a code or refresh token used and returns it, atomically, so that it
+	// is taken once. It returns ErrNotFound, also if it expired, or the token and ErrUsed if it was
+	// taken before.
+	TakeOAuthToken(ctx context.Context, hash string) (*OAuthToken, error)
+	// RevokeOAuthGrant revokes the tokens issued from an authorization code, see OAuthToken.Grant.
+	RevokeOAuthGrant(ctx context.Context, grant string) error
+	// DeleteOAuthToken revokes a token. Revoking a missing token is not an error.
+	DeleteOAuthToken(ctx context.Context, hash string) error
+}
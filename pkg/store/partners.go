@@ -0,0 +1,67 @@
+package store
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/listing"
+)
+
+// Partner is a website embedding the widget with its own API key, to which
+// its donations are attributed.
+type Partner struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// KeyHash is the SHA-256 of the partner's API key, which is only shown when the partner is created.
+	KeyHash string `json:"-"`
+	// KeyPrefix is the start of the API key, to recognize it.
+	KeyPrefix string `json:"keyPrefix"`
+	// Origins are the sites allowed to use the key, e.g. "https://shop.example.com", any if empty.
+	Origins []string `json:"origins,omitempty"`
+	// RateLimit is the number of requests per minute, unlimited if zero.
+	RateLimit int `json:"rateLimit,omitempty"`
+	// DailyQuota is the number of requests per day (UTC), unlimited if zero.
+	DailyQuota int       `json:"dailyQuota,omitempty"`
+	Disabled   bool      `json:"disabled"`
+	CreatedBy  string    `json:"createdBy"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+	// Donations and Totals (in the smallest unit by currency) sum up the
+	// donations attributed to the partner.
+	Donations int              `json:"donations"`
+	Totals    map[string]int64 `json:"totals"`
+}
+
+// Sort fields of partner lists.
+var PartnerListSpec = listing.Spec{
+	Sorts:       []string{"name", "created", "donations"},
+	DefaultSort: "name",
+}
+
+// partnerSortKey returns the key of the partner by a sort field of PartnerListSpec.
+func partnerSortKey(p *Partner, field string) string {
+	switch field {
+	case "created":
+		return listing.TimeKey(p.CreatedAt)
+	case "donations":
+		return listing.IntKey(int64(p.Donations))
+	default:
+		return strings.ToLower(p.Name)
+	}
+}
+
+// PartnerStore keeps partners. Partners read from the store carry the totals
+// of their donations.
+type PartnerStore interface {
+	// SavePartner creates the partner, setting its ID if it is empty, or replaces the one with its ID.
+	SavePartner(ctx context.Context, p *Partner) error
+	// GetPartner returns a partner or ErrNotFound.
+	GetPartner(ctx context.Context, id string) (*Partner, error)
+	// GetPartnerByKey returns the partner with the hash of an API key or ErrNotFound.
+	GetPartnerByKey(ctx context.Context, keyHash string) (*Partner, error)
+	// ListPartners returns a page of partners, see PartnerListSpec, and the cursor of the next page.
+	ListPartners(ctx context.Context, q listing.Query) ([]*Partner, string, error)
+	// DeletePartner deletes a partner or returns ErrNotFound. Its donations stay attributed to it.
+	DeletePartner(ctx context.Context, id string) error
+}
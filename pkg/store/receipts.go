@@ -0,0 +1,46 @@
+package store
+
+import (
+	"context"
+
+	"github.com/vedrankolka/donation-server/pkg/receipt"
+)
+
+// ReceiptStore keeps the receipts issued for donations and their numbering,
+// see package receipt.
+type ReceiptStore interface {
+	// NextReceiptSequence returns the next sequence number of receipts issued
+	// in the given year, starting with 1. The PostgresStore never hands out a
+	// number twice, the MemoryStore starts again with every restart.
+	NextReceiptSequence(ctx context.Context, year int) (int64, error)
+	SaveReceipt(ctx context.Context, r *receipt.Receipt) error
+	// GetReceiptByDonation returns the receipt of a donation or ErrNotFound.
+	GetReceiptByDonation(ctx context.Context, donationID string) (*receipt.Receipt, error)
+}
+
+func (ms *MemoryStore) NextReceiptSequence(ctx context.Context, year int) (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.receiptSequences[year]++
+	return ms.receiptSequences[year], nil
+}
+
+func (ms *MemoryStore) SaveReceipt(ctx context.Context, r *receipt.Receipt) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.receipts[r.DonationID] = *r
+	return nil
+}
+
+func (ms *MemoryStore) GetReceiptByDonation(ctx context.Context, donationID string) (*receipt.Receipt, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	r, ok := ms.receipts[donationID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &r, nil
+}
@@ -0,0 +1,75 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/listing"
+)
+
+// Report schedules.
+const (
+	ScheduleDaily   = "daily"
+	ScheduleWeekly  = "weekly"
+	ScheduleMonthly = "monthly"
+)
+
+// ReportDefinition is a saved report of donations.
+type ReportDefinition struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Filter holds the filters of /admin/donations, e.g. {"currency": "eur", "tag": "gala-2024"}.
+	Filter map[string]string `json:"filter,omitempty"`
+	// GroupBy is how donations are grouped, see package report.
+	GroupBy string `json:"groupBy"`
+	// Format is "csv" or "json".
+	Format string `json:"format"`
+	// Schedule is ScheduleDaily, ScheduleWeekly, ScheduleMonthly or empty
+	// for reports that are only run on demand.
+	Schedule string `json:"schedule,omitempty"`
+	// Recipients of the scheduled report, e.g. email addresses.
+	Recipients []string  `json:"recipients,omitempty"`
+	CreatedBy  string    `json:"createdBy"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+	// LastRunAt and NextRunAt are the times of the last and the next scheduled delivery.
+	LastRunAt *time.Time `json:"lastRunAt,omitempty"`
+	NextRunAt *time.Time `json:"nextRunAt,omitempty"`
+	// LastError is the error of the last scheduled delivery, if it failed.
+	LastError string `json:"lastError,omitempty"`
+}
+
+// ReportRun is a scheduled delivery of a report, see ReportStore.RecordReportRun.
+type ReportRun struct {
+	// Due is the NextRunAt of the report the delivery was made for.
+	Due time.Time
+	// At is when it was made, and Next when the next one is due.
+	At   time.Time
+	Next time.Time
+	// Error is the error of the delivery, if it failed.
+	Error string
+}
+
+// Sort fields of report lists.
+var ReportListSpec = listing.Spec{
+	Sorts:       []string{"name", "created"},
+	DefaultSort: "name",
+}
+
+// ReportStore keeps saved report definitions.
+type ReportStore interface {
+	// SaveReport creates the report, setting its ID if it is empty, or replaces the one with its ID.
+	SaveReport(ctx context.Context, report *ReportDefinition) error
+	// GetReport returns a report or ErrNotFound.
+	GetReport(ctx context.Context, id string) (*ReportDefinition, error)
+	// ListReports returns a page of reports, see ReportListSpec, and the cursor of the next page.
+	ListReports(ctx context.Context, q listing.Query) ([]*ReportDefinition, string, error)
+	// DeleteReport deletes a report or returns ErrNotFound.
+	DeleteReport(ctx context.Context, id string) error
+	// DueReports returns the scheduled reports with NextRunAt not after now.
+	DueReports(ctx context.Context, now time.Time) ([]*ReportDefinition, error)
+	// RecordReportRun sets the LastRunAt, NextRunAt and LastError of a report
+	// after a delivery, leaving the rest as it is. It returns ErrNotFound if the
+	// report was deleted, or ErrConflict if it was rescheduled since run.Due.
+	RecordReportRun(ctx context.Context, id string, run ReportRun) error
+}
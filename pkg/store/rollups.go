@@ -0,0 +1,36 @@
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// Rollup granularities.
+const (
+	GranularityHour = "hour"
+	GranularityDay  = "day"
+)
+
+// Rollup sums up the succeeded donations of a campaign in a currency
+// created in an hour or a day, so statistics do not scan every donation.
+type Rollup struct {
+	Granularity string `json:"granularity"`
+	// Start of the hour or day, in UTC.
+	Start    time.Time `json:"start"`
+	Currency string    `json:"currency"`
+	// Campaign is empty for donations without one.
+	Campaign  string `json:"campaign,omitempty"`
+	Donations int    `json:"donations"`
+	// Amount is in the smallest currency unit.
+	Amount int64 `json:"amount"`
+}
+
+// RollupStore keeps pre-computed rollups of donations, see package rollup.
+type RollupStore interface {
+	// ReplaceRollups replaces the rollups of the granularity starting in
+	// [from, to) with the given ones.
+	ReplaceRollups(ctx context.Context, granularity string, from, to time.Time, rollups []Rollup) error
+	// ListRollups returns the rollups of the granularity starting in
+	// [from, to), oldest first.
+	ListRollups(ctx context.Context, granularity string, from, to time.Time) ([]*Rollup, error)
+}
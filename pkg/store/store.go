@@ -0,0 +1,128 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/address"
+	"github.com/vedrankolka/donation-server/pkg/listing"
+	"github.com/vedrankolka/donation-server/pkg/vat"
+)
+
+// ErrNotFound is returned when a requested record does not exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrConflict is returned when a record was changed since it was read.
+var ErrConflict = errors.New("changed concurrently")
+
+// Donation statuses.
+const (
+	StatusSucceeded = "succeeded"
+	StatusHeld      = "held"
+	StatusRefunded  = "refunded"
+)
+
+// Donation is a successful charge recorded in the store.
+type Donation struct {
+	// ID is the Stripe charge ID.
+	ID              string           `json:"id"`
+	PaymentIntentID string           `json:"paymentIntentID,omitempty"`
+	CustomerID      string           `json:"customerID"`
+	CustomerName    string           `json:"customerName"`
+	CustomerEmail   string           `json:"customerEmail"`
+	Amount          int64            `json:"amount"`
+	Currency        string           `json:"currency"`
+	Status          string           `json:"status"`
+	Address         *address.Address `json:"address,omitempty"`
+	CreatedAt       time.Time        `json:"createdAt"`
+	// The split of Amount for payments that include purchases, see package vat.
+	// DonationAmount is zero when the whole payment is a donation.
+	DonationAmount int64  `json:"donationAmount,omitempty"`
+	PurchaseAmount int64  `json:"purchaseAmount,omitempty"`
+	VATAmount      int64  `json:"vatAmount,omitempty"`
+	InvoiceNumber  string `json:"invoiceNumber,omitempty"`
+	// TaxRates is the tax breakdown of VATAmount.
+	TaxRates []vat.RateSummary `json:"taxRates,omitempty"`
+	// TaxCalculationID is set if the tax was calculated by Stripe Tax.
+	TaxCalculationID string `json:"taxCalculationID,omitempty"`
+	// Campaign the donation was made for, if any.
+	Campaign string `json:"campaign,omitempty"`
+	// RoundUpOrder and RoundUpPurchaseAmount link a round-up donation to the
+	// partner's order it rounded up.
+	RoundUpOrder          string `json:"roundUpOrder,omitempty"`
+	RoundUpPurchaseAmount int64  `json:"roundUpPurchaseAmount,omitempty"`
+	// Partner is the ID of the partner whose API key the payment was made with, if any.
+	Partner string `json:"partner,omitempty"`
+	// Link is the code of the donation link the payment was made with, if any.
+	Link string `json:"link,omitempty"`
+	// Tags of the donation, see TagStore.
+	Tags []string `json:"tags,omitempty"`
+	// CardLast4 are the last digits of the card charged, if paid by card.
+	CardLast4 string `json:"cardLast4,omitempty"`
+	// Channel is "in_person" for donations at a card reader, empty for
+	// online ones.
+	Channel string `json:"channel,omitempty"`
+	// ClientIP is the IP the payment was started from, see package anomaly.
+	ClientIP string `json:"clientIP,omitempty"`
+	// DuplicateOf is the ID of the donation this one likely duplicates, see
+	// package duplicate.
+	DuplicateOf string `json:"duplicateOf,omitempty"`
+	// RefundID is the ID of the refund of a refunded donation.
+	RefundID string `json:"refundID,omitempty"`
+	// Message is the donor's message, if any.
+	Message string `json:"message,omitempty"`
+	// DisplayName is the name the donor chose to be shown publicly, and
+	// Anonymous whether the donor's name must not be shown publicly at all.
+	DisplayName string `json:"displayName,omitempty"`
+	Anonymous   bool   `json:"anonymous,omitempty"`
+	// NewsletterOptIn is whether the donor subscribed to the newsletter.
+	NewsletterOptIn bool `json:"newsletterOptIn,omitempty"`
+}
+
+// Sort fields and filters of donation lists. The tag filter matches donations
+// tagged directly or through their donor.
+var DonationListSpec = listing.Spec{
+	Sorts:       []string{"created", "amount"},
+	DefaultSort: "-created",
+	Filters: []string{listing.FilterAmount, listing.FilterCreated, listing.FilterCurrency,
+		listing.FilterCampaign, listing.FilterStatus, listing.FilterTag, listing.FilterPartner, listing.FilterCustomer,
+		listing.FilterLink},
+}
+
+// DonationStore is a durable ledger of donations.
+type DonationStore interface {
+	// SaveDonation inserts the donation or replaces the one with the same ID.
+	SaveDonation(ctx context.Context, d *Donation) error
+	// GetDonation returns the donation with the given ID or ErrNotFound.
+	GetDonation(ctx context.Context, id string) (*Donation, error)
+	// ListDonations returns a page of donations, see DonationListSpec,
+	// and the cursor of the next page.
+	ListDonations(ctx context.Context, q listing.Query) ([]*Donation, string, error)
+	// DeleteDonation deletes a donation and its tags, or returns ErrNotFound.
+	DeleteDonation(ctx context.Context, id string) error
+	// Ping checks that the store can be reached.
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// DonationUpdater changes donations that are not changed by their events
+// alone, e.g. when re-encrypting them, without reverting concurrent changes.
+type DonationUpdater interface {
+	// UpdateDonation replaces the donation old, as it was read, with d, or
+	// returns ErrConflict if it was changed or deleted since. Tags are ignored.
+	UpdateDonation(ctx context.Context, old, d *Donation) error
+}
+
+// InvoiceStore keeps VAT invoices and their numbering.
+type InvoiceStore interface {
+	// NextInvoiceSequence returns the next sequence number of invoices issued
+	// in the given year, starting with 1. The PostgresStore never hands out a
+	// number twice, the MemoryStore starts again with every restart.
+	NextInvoiceSequence(ctx context.Context, year int) (int64, error)
+	SaveInvoice(ctx context.Context, invoice *vat.Invoice) error
+	// GetInvoiceByCharge returns the invoice issued for a charge or ErrNotFound.
+	GetInvoiceByCharge(ctx context.Context, chargeID string) (*vat.Invoice, error)
+	// GetInvoice returns the invoice with the number or ErrNotFound.
+	GetInvoice(ctx context.Context, number string) (*vat.Invoice, error)
+}
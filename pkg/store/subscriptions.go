@@ -0,0 +1,108 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/listing"
+)
+
+// Subscription is an endpoint of a third party receiving events.
+type Subscription struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Secret signs the deliveries, it is only shown when the subscription is created.
+	Secret string `json:"secret,omitempty"`
+	// EventTypes are the types of events delivered, all of them if empty.
+	EventTypes  []string  `json:"eventTypes,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Disabled    bool      `json:"disabled"`
+	CreatedBy   string    `json:"createdBy"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// Wants reports whether the subscription receives events of the type.
+func (s *Subscription) Wants(eventType string) bool {
+	if s.Disabled {
+		return false
+	}
+	if len(s.EventTypes) == 0 {
+		return true
+	}
+	for _, t := range s.EventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Delivery statuses.
+const (
+	// DeliveryPending deliveries are still being attempted.
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	// DeliveryFailed deliveries ran out of attempts.
+	DeliveryFailed = "failed"
+)
+
+// DeliveryAttempt is one request of a delivery to the subscription's endpoint.
+type DeliveryAttempt struct {
+	At         time.Time     `json:"at"`
+	StatusCode int           `json:"statusCode,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	Duration   time.Duration `json:"duration"`
+}
+
+// Delivery is an event sent to a subscription.
+type Delivery struct {
+	ID             string            `json:"id"`
+	SubscriptionID string            `json:"subscriptionID"`
+	Type           string            `json:"type"`
+	Payload        json.RawMessage   `json:"payload"`
+	Status         string            `json:"status"`
+	Attempts       []DeliveryAttempt `json:"attempts"`
+	CreatedAt      time.Time         `json:"createdAt"`
+	// NextAttemptAt is when a pending delivery is attempted again.
+	NextAttemptAt *time.Time `json:"nextAttemptAt,omitempty"`
+}
+
+// Sort fields of subscription lists.
+var SubscriptionListSpec = listing.Spec{
+	Sorts:       []string{"created"},
+	DefaultSort: "created",
+}
+
+// Sort fields and filters of delivery lists.
+var DeliveryListSpec = listing.Spec{
+	Sorts:       []string{"created"},
+	DefaultSort: "-created",
+	Filters:     []string{listing.FilterCreated, listing.FilterStatus, listing.FilterType},
+}
+
+// SubscriptionStore keeps the subscriptions of third parties and their deliveries.
+type SubscriptionStore interface {
+	// SaveSubscription creates the subscription, setting its ID if it is empty, or replaces the one with its ID.
+	SaveSubscription(ctx context.Context, s *Subscription) error
+	// GetSubscription returns a subscription or ErrNotFound.
+	GetSubscription(ctx context.Context, id string) (*Subscription, error)
+	// ListSubscriptions returns a page of subscriptions, see SubscriptionListSpec,
+	// and the cursor of the next page.
+	ListSubscriptions(ctx context.Context, q listing.Query) ([]*Subscription, string, error)
+	// DeleteSubscription deletes a subscription with its deliveries or returns ErrNotFound.
+	DeleteSubscription(ctx context.Context, id string) error
+
+	// SaveDelivery creates the delivery, setting its ID if it is empty, or replaces the one with its ID.
+	SaveDelivery(ctx context.Context, d *Delivery) error
+	// GetDelivery returns a delivery or ErrNotFound.
+	GetDelivery(ctx context.Context, id string) (*Delivery, error)
+	// ListDeliveries returns a page of the subscription's deliveries, see
+	// DeliveryListSpec, and the cursor of the next page.
+	ListDeliveries(ctx context.Context, subscriptionID string, q listing.Query) ([]*Delivery, string, error)
+	// DueDeliveries returns the pending deliveries with NextAttemptAt not after now.
+	// The PostgresStore claims them for a while, so that another instance does
+	// not return them too.
+	DueDeliveries(ctx context.Context, now time.Time) ([]*Delivery, error)
+}
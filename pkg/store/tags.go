@@ -0,0 +1,67 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/listing"
+)
+
+// ErrExists is returned when a record to be created exists already.
+var ErrExists = errors.New("already exists")
+
+// Kinds of tagged resources.
+const (
+	TaggedDonor    = "donor"
+	TaggedDonation = "donation"
+)
+
+// tagName allows tags like "gala-2024" or "major-donor-prospect".
+var tagName = regexp.MustCompile(`^[a-z0-9][a-z0-9_:-]{0,63}$`)
+
+// Tag marks a segment of donors or donations.
+type Tag struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	// Donors and Donations are the numbers of tagged resources.
+	Donors    int `json:"donors"`
+	Donations int `json:"donations"`
+}
+
+// ValidateTagName checks that a tag name is lowercase letters, digits, "-", "_"
+// and ":", at most 64 characters long.
+func ValidateTagName(name string) error {
+	if !tagName.MatchString(name) {
+		return fmt.Errorf("tag %q must be up to 64 lowercase letters, digits, '-', '_' or ':'", name)
+	}
+	return nil
+}
+
+// Sort fields of tag lists.
+var TagListSpec = listing.Spec{
+	Sorts:       []string{"name", "created"},
+	DefaultSort: "name",
+}
+
+// TagStore keeps tags and the donors and donations tagged with them.
+// Donations and customers read from the store carry their tags.
+type TagStore interface {
+	// CreateTag creates a tag or returns ErrExists.
+	CreateTag(ctx context.Context, tag *Tag) error
+	// GetTag returns a tag or ErrNotFound.
+	GetTag(ctx context.Context, name string) (*Tag, error)
+	// ListTags returns a page of tags, see TagListSpec, and the cursor of the next page.
+	ListTags(ctx context.Context, q listing.Query) ([]*Tag, string, error)
+	// DeleteTag deletes a tag and removes it from everything tagged with it,
+	// or returns ErrNotFound.
+	DeleteTag(ctx context.Context, name string) error
+	// AddTag tags a donor or donation (TaggedDonor or TaggedDonation) with an
+	// existing tag, or returns ErrNotFound if the tag does not exist.
+	AddTag(ctx context.Context, kind, id, tag string) error
+	// RemoveTag removes a tag from a donor or donation.
+	RemoveTag(ctx context.Context, kind, id, tag string) error
+}
@@ -0,0 +1,140 @@
+// Package stripeip refuses webhook requests that do not come from Stripe's
+// published webhook IP addresses, as defense in depth alongside signature
+// verification.
+package stripeip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/clientip"
+	"github.com/vedrankolka/donation-server/pkg/metrics"
+	"github.com/vedrankolka/donation-server/pkg/requestid"
+)
+
+const (
+	// URL lists the IP addresses Stripe sends webhooks from.
+	URL = "https://stripe.com/files/ips/ips_webhooks.json"
+	// RefreshInterval is how often the list is fetched.
+	RefreshInterval = 24 * time.Hour
+)
+
+// DefaultIPs are the webhook IP addresses published by Stripe, used until
+// the list is fetched or if it cannot be.
+var DefaultIPs = []string{
+	"3.18.12.63", "3.130.192.231", "13.235.14.237", "13.235.122.149",
+	"18.211.135.69", "35.154.171.200", "52.15.183.38", "54.88.130.119",
+	"54.88.130.237", "54.187.174.169", "54.187.205.235", "54.187.216.72",
+}
+
+var refused = metrics.NewCounterVec(
+	"donation_server_refused_webhooks_total",
+	"Webhook requests refused because they did not come from Stripe's IP addresses.",
+)
+
+// Allowlist holds Stripe's webhook IP addresses.
+type Allowlist struct {
+	url            string
+	client         *http.Client
+	clientIPHeader clientip.Header
+
+	mu  sync.RWMutex
+	ips map[string]bool
+}
+
+// NewAllowlist creates an Allowlist of DefaultIPs, refreshed from the URL by
+// Run. Client IPs are taken from the header if set, see clientip.FromRequest.
+func NewAllowlist(url string, client *http.Client, clientIPHeader clientip.Header) *Allowlist {
+	al := &Allowlist{url: url, client: client, clientIPHeader: clientIPHeader}
+	al.set(DefaultIPs)
+	return al
+}
+
+func (al *Allowlist) set(ips []string) {
+	set := make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		if parsed := net.ParseIP(ip); parsed != nil {
+			set[parsed.String()] = true
+		}
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	al.ips = set
+}
+
+// Allowed reports whether the IP address is one of Stripe's.
+func (al *Allowlist) Allowed(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	al.mu.RLock()
+	defer al.mu.RUnlock()
+	return al.ips[ip.String()]
+}
+
+// Refresh fetches the list. The current list is kept if it fails.
+func (al *Allowlist) Refresh(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", al.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := al.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded with %s", al.url, resp.Status)
+	}
+
+	var list struct {
+		Webhooks []string `json:"WEBHOOKS"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return fmt.Errorf("invalid IP list: %v", err)
+	}
+	if len(list.Webhooks) == 0 {
+		return fmt.Errorf("the IP list has no webhook addresses")
+	}
+	al.set(list.Webhooks)
+	return nil
+}
+
+// Run refreshes the list every RefreshInterval, starting now, until the context is done.
+func (al *Allowlist) Run(ctx context.Context) {
+	ticker := time.NewTicker(RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := al.Refresh(ctx); err != nil {
+			log.Printf("[WARN] Could not refresh Stripe's webhook IP addresses, keeping the current ones: %v\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Middleware refuses requests from other IP addresses with 403 Forbidden.
+func (al *Allowlist) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := clientip.FromRequest(r, al.clientIPHeader)
+		if !al.Allowed(ip) {
+			refused.Inc()
+			requestid.Printf(r.Context(), "Refused webhook from %v, not one of Stripe's IP addresses\n", ip)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
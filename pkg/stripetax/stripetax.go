@@ -0,0 +1,280 @@
+package stripetax
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/tax/calculation"
+	"github.com/stripe/stripe-go/v76/tax/transaction"
+	"github.com/vedrankolka/donation-server/pkg/payments"
+	"github.com/vedrankolka/donation-server/pkg/vat"
+)
+
+// Tax behaviors of line items.
+const (
+	// Inclusive taxes are included in the price the donor chose.
+	Inclusive = "inclusive"
+	// Exclusive taxes are added on top of the price.
+	Exclusive = "exclusive"
+)
+
+// donationReference is the line item reference of the donated amount.
+const donationReference = "donation"
+
+// Calculator is a vat.Calculator using the Stripe Tax calculation API, so
+// both purchases and, where applicable, donations are taxed by the location
+// of the customer.
+type Calculator struct {
+	// Config holds the products that can be bought. May be nil.
+	Config *vat.Config
+	// DonationTaxCode is the Stripe tax code of donations. If empty, the
+	// default tax code of the Stripe account is used.
+	DonationTaxCode string
+	// Behavior is Inclusive or Exclusive. Inclusive if empty.
+	Behavior string
+	// Timeout limits every request to Stripe. payments.DefaultTimeout if zero.
+	Timeout time.Duration
+}
+
+// Calculate creates a Stripe tax calculation for the order.
+func (c *Calculator) Calculate(ctx context.Context, order vat.Order) (*vat.Breakdown, error) {
+	behavior := c.Behavior
+	if behavior == "" {
+		behavior = Inclusive
+	}
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	params := &stripe.TaxCalculationParams{
+		Currency:        stripe.String(strings.ToLower(order.Currency)),
+		CustomerDetails: &stripe.TaxCalculationCustomerDetailsParams{},
+	}
+	params.Context = ctx
+	params.AddExpand("line_items")
+
+	switch {
+	case order.Address != nil:
+		a := order.Address
+		params.CustomerDetails.Address = &stripe.AddressParams{
+			Line1:      stripe.String(a.Line1),
+			Line2:      stripe.String(a.Line2),
+			City:       stripe.String(a.City),
+			PostalCode: stripe.String(a.PostalCode),
+			State:      stripe.String(a.State),
+			Country:    stripe.String(a.Country),
+		}
+		params.CustomerDetails.AddressSource = stripe.String("billing")
+	case order.IPAddress != "":
+		params.CustomerDetails.IPAddress = stripe.String(order.IPAddress)
+	case order.Country != "":
+		params.CustomerDetails.Address = &stripe.AddressParams{Country: stripe.String(order.Country)}
+		params.CustomerDetails.AddressSource = stripe.String("billing")
+	default:
+		return nil, errors.New("the location of the customer is unknown")
+	}
+
+	for _, item := range order.Items {
+		if c.Config == nil {
+			return nil, fmt.Errorf("unknown product %q", item.ProductID)
+		}
+		product, ok := c.Config.Product(item.ProductID)
+		if !ok {
+			return nil, fmt.Errorf("unknown product %q", item.ProductID)
+		}
+		amount, err := vat.LineAmount(product, item.Quantity)
+		if err != nil {
+			return nil, err
+		}
+
+		line := &stripe.TaxCalculationLineItemParams{
+			Amount:      stripe.Int64(amount),
+			Quantity:    stripe.Int64(item.Quantity),
+			Reference:   stripe.String(product.ID),
+			TaxBehavior: stripe.String(behavior),
+		}
+		if product.TaxCode != "" {
+			line.TaxCode = stripe.String(product.TaxCode)
+		}
+		params.LineItems = append(params.LineItems, line)
+	}
+
+	if order.Donation > 0 {
+		line := &stripe.TaxCalculationLineItemParams{
+			Amount:      stripe.Int64(order.Donation),
+			Reference:   stripe.String(donationReference),
+			TaxBehavior: stripe.String(behavior),
+		}
+		if c.DonationTaxCode != "" {
+			line.TaxCode = stripe.String(c.DonationTaxCode)
+		}
+		params.LineItems = append(params.LineItems, line)
+	}
+
+	calc, err := calculation.New(params)
+	if err != nil {
+		return nil, providerError(err)
+	}
+
+	var items []*stripe.TaxCalculationLineItem
+	if calc.LineItems != nil {
+		items = calc.LineItems.Data
+	}
+	return c.breakdown(calc, items)
+}
+
+// Retrieve fetches a previous calculation. stripe-go has no client for
+// retrieving calculations, so it is fetched with the generic backend.
+func (c *Calculator) Retrieve(ctx context.Context, calculationID string) (*vat.Breakdown, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	params := &stripe.Params{Context: ctx}
+	calc := &stripe.TaxCalculation{}
+	if err := backend().Call(http.MethodGet, "/v1/tax/calculations/"+calculationID, stripe.Key, params, calc); err != nil {
+		return nil, providerError(err)
+	}
+
+	lineItemParams := &stripe.TaxCalculationListLineItemsParams{Calculation: stripe.String(calculationID)}
+	lineItemParams.Context = ctx
+	var items []*stripe.TaxCalculationLineItem
+	iter := calculation.ListLineItems(lineItemParams)
+	for iter.Next() {
+		items = append(items, iter.TaxCalculationLineItem())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, providerError(err)
+	}
+
+	return c.breakdown(calc, items)
+}
+
+// Commit records the calculation as a tax transaction for Stripe Tax reporting.
+func (c *Calculator) Commit(ctx context.Context, b *vat.Breakdown, reference string) error {
+	if b.CalculationID == "" {
+		return nil
+	}
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	params := &stripe.TaxTransactionCreateFromCalculationParams{
+		Calculation: stripe.String(b.CalculationID),
+		Reference:   stripe.String(reference),
+	}
+	params.Context = ctx
+	// Redelivered webhooks must not record the transaction twice.
+	params.SetIdempotencyKey("tax-transaction-" + reference)
+
+	if _, err := transaction.CreateFromCalculation(params); err != nil {
+		return providerError(err)
+	}
+	return nil
+}
+
+// providerError returns an error of Stripe as a payments.Error, so it is
+// answered like the errors of the payment provider, without Stripe's message.
+// Other errors, e.g. of the network or a deadline, are returned as they are,
+// like the payment provider does.
+func providerError(err error) error {
+	var stripeErr *stripe.Error
+	if errors.As(err, &stripeErr) {
+		return payments.StripeError(stripeErr)
+	}
+	return err
+}
+
+func (c *Calculator) breakdown(calc *stripe.TaxCalculation, items []*stripe.TaxCalculationLineItem) (*vat.Breakdown, error) {
+	b := &vat.Breakdown{
+		Total:         calc.AmountTotal,
+		CalculationID: calc.ID,
+	}
+
+	for _, item := range items {
+		gross := item.Amount
+		if string(item.TaxBehavior) == Exclusive {
+			gross += item.AmountTax
+		}
+
+		if item.Reference == donationReference {
+			b.Donation = gross
+			b.DonationVAT = item.AmountTax
+			continue
+		}
+
+		line := vat.Line{
+			ProductID: item.Reference,
+			Quantity:  item.Quantity,
+			Gross:     gross,
+			Net:       gross - item.AmountTax,
+			VAT:       item.AmountTax,
+		}
+		if line.Quantity > 0 {
+			line.UnitAmount = gross / line.Quantity
+		}
+		if line.Net > 0 {
+			line.Rate = float64(line.VAT) * 100 / float64(line.Net)
+		}
+		if c.Config != nil {
+			if product, ok := c.Config.Product(item.Reference); ok {
+				line.Description = product.Description
+			}
+		}
+
+		b.Lines = append(b.Lines, line)
+		b.Purchase += gross
+	}
+
+	for _, tb := range calc.TaxBreakdown {
+		details := tb.TaxRateDetails
+		if details == nil {
+			details = &stripe.TaxCalculationTaxBreakdownTaxRateDetails{}
+		}
+		rate, err := strconv.ParseFloat(details.PercentageDecimal, 64)
+		if err != nil && details.PercentageDecimal != "" {
+			return nil, fmt.Errorf("invalid tax rate %q: %w", details.PercentageDecimal, err)
+		}
+
+		jurisdiction := details.Country
+		if details.State != "" {
+			jurisdiction += "-" + details.State
+		}
+		if details.TaxType != "" {
+			jurisdiction += " " + string(details.TaxType)
+		}
+
+		b.Rates = append(b.Rates, vat.RateSummary{
+			Rate:         rate,
+			Jurisdiction: jurisdiction,
+			Gross:        tb.TaxableAmount + tb.Amount,
+			Net:          tb.TaxableAmount,
+			VAT:          tb.Amount,
+		})
+		b.VAT += tb.Amount
+	}
+	sort.Slice(b.Rates, func(i, j int) bool {
+		return b.Rates[i].Rate > b.Rates[j].Rate
+	})
+
+	return b, nil
+}
+
+// withTimeout returns the context of a call to Stripe, done after Timeout.
+func (c *Calculator) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = payments.DefaultTimeout
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func backend() stripe.Backend {
+	return stripe.GetBackend(stripe.APIBackend)
+}
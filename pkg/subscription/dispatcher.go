@@ -0,0 +1,254 @@
+// Package subscription delivers events to the webhook endpoints third parties
+// subscribed with the admin API, making the server an event source for other apps.
+package subscription
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/clock"
+	"github.com/vedrankolka/donation-server/pkg/listing"
+	"github.com/vedrankolka/donation-server/pkg/store"
+)
+
+// Headers of deliveries.
+const (
+	// EventTypeHeader holds the type of the event, like in webhook notifications.
+	EventTypeHeader = "X-Donation-Event"
+	// DeliveryHeader holds the delivery ID, the same in every attempt.
+	DeliveryHeader = "X-Donation-Delivery"
+	// SignatureHeader holds "t=<unix time>,v1=<signature>", see Sign.
+	SignatureHeader = "X-Donation-Signature"
+)
+
+const (
+	// MaxAttempts is the number of attempts before a delivery fails.
+	MaxAttempts = 8
+	// CheckInterval is how often the dispatcher looks for deliveries to retry.
+	CheckInterval = 30 * time.Second
+	// Timeout of a delivery request.
+	Timeout = 10 * time.Second
+)
+
+// Backoff returns how long to wait after the given number of failed
+// attempts: a minute after the first, doubling up to about an hour.
+func Backoff(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+	if attempts > 7 {
+		attempts = 7
+	}
+	return time.Minute << (attempts - 1)
+}
+
+// Sign returns the signature of a delivery, the hex HMAC-SHA256 of
+// "<unix time>.<body>" with the subscription's secret, in the format
+// of SignatureHeader.
+func Sign(secret string, t time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return fmt.Sprintf("t=%s,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// NewSecret returns a random signing secret.
+func NewSecret() (string, error) {
+	var b [24]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b[:]), nil
+}
+
+// Dispatcher records a delivery of every event for every subscription
+// wanting it and sends them, retrying failed ones with Backoff.
+type Dispatcher struct {
+	store  store.SubscriptionStore
+	client *http.Client
+	clock  clock.Clock
+	// wake makes Run send new deliveries without waiting for the next check.
+	wake chan struct{}
+}
+
+// Option configures a Dispatcher.
+type Option func(*Dispatcher)
+
+// WithClock times deliveries and their retries by the clock instead of
+// clock.Real.
+func WithClock(c clock.Clock) Option {
+	return func(d *Dispatcher) {
+		d.clock = c
+	}
+}
+
+// NewDispatcher creates a Dispatcher of the subscriptions in the store.
+func NewDispatcher(s store.SubscriptionStore, opts ...Option) *Dispatcher {
+	d := &Dispatcher{
+		store:  s,
+		client: newClient(),
+		clock:  clock.Real,
+		wake:   make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// Dispatch records the deliveries of an event. They are sent by Run.
+func (d *Dispatcher) Dispatch(ctx context.Context, eventType string, payload []byte) error {
+	now := d.clock.Now().UTC()
+	q := listing.Query{Limit: listing.MaxLimit, Sort: listing.ParseSort(store.SubscriptionListSpec.DefaultSort)}
+	for {
+		subscriptions, next, err := d.store.ListSubscriptions(ctx, q)
+		if err != nil {
+			return err
+		}
+		for _, s := range subscriptions {
+			if !s.Wants(eventType) {
+				continue
+			}
+			delivery := &store.Delivery{
+				SubscriptionID: s.ID,
+				Type:           eventType,
+				Payload:        payload,
+				Status:         store.DeliveryPending,
+				CreatedAt:      now,
+				NextAttemptAt:  &now,
+			}
+			if err := d.store.SaveDelivery(ctx, delivery); err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			break
+		}
+		if q.Cursor, err = listing.DecodeCursor(next); err != nil {
+			return err
+		}
+	}
+
+	d.Wake()
+	return nil
+}
+
+// Wake makes Run send pending deliveries right away.
+func (d *Dispatcher) Wake() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run sends due deliveries until the context is done.
+func (d *Dispatcher) Run(ctx context.Context) {
+	for {
+		d.runDue(ctx, d.clock.Now())
+
+		timer := d.clock.NewTimer(CheckInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+		case <-d.wake:
+			timer.Stop()
+		}
+	}
+}
+
+func (d *Dispatcher) runDue(ctx context.Context, now time.Time) {
+	due, err := d.store.DueDeliveries(ctx, now)
+	if err != nil {
+		log.Printf("Could not get due deliveries: %v\n", err)
+		return
+	}
+
+	for _, delivery := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		s, err := d.store.GetSubscription(ctx, delivery.SubscriptionID)
+		if err != nil {
+			log.Printf("Could not get subscription %q: %v\n", delivery.SubscriptionID, err)
+			continue
+		}
+		if s.Disabled {
+			// Kept pending, so they are sent once it is enabled again.
+			continue
+		}
+
+		d.attempt(ctx, s, delivery)
+		if err := d.store.SaveDelivery(ctx, delivery); err != nil {
+			log.Printf("Could not save delivery %q: %v\n", delivery.ID, err)
+		}
+	}
+}
+
+// attempt sends the delivery once and records the attempt in it.
+func (d *Dispatcher) attempt(ctx context.Context, s *store.Subscription, delivery *store.Delivery) {
+	start := d.clock.Now()
+	statusCode, err := d.send(ctx, s, delivery)
+	attempt := store.DeliveryAttempt{
+		At:         start.UTC(),
+		StatusCode: statusCode,
+		Duration:   d.clock.Now().Sub(start),
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	delivery.Attempts = append(delivery.Attempts, attempt)
+
+	switch {
+	case err == nil:
+		delivery.Status, delivery.NextAttemptAt = store.DeliveryDelivered, nil
+	case len(delivery.Attempts) >= MaxAttempts:
+		log.Printf("[WARN] Delivery %q to %s failed %d times, giving up: %v\n", delivery.ID, s.URL, len(delivery.Attempts), err)
+		delivery.Status, delivery.NextAttemptAt = store.DeliveryFailed, nil
+	default:
+		next := d.clock.Now().UTC().Add(Backoff(len(delivery.Attempts)))
+		delivery.NextAttemptAt = &next
+	}
+}
+
+// send POSTs the payload to the endpoint and returns the status code of the response.
+func (d *Dispatcher) send(ctx context.Context, s *store.Subscription, delivery *store.Delivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", s.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventTypeHeader, delivery.Type)
+	req.Header.Set(DeliveryHeader, delivery.ID)
+	req.Header.Set(SignatureHeader, Sign(s.Secret, d.clock.Now(), delivery.Payload))
+
+	resp, err := d.client.Do(req)
+	if errors.Is(err, ErrForbiddenAddress) {
+		return 0, ErrForbiddenAddress
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// The body is not kept, as subscribers read attempts back: it could be
+	// of a service they should not reach.
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint responded with %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,74 @@
+package subscription
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+)
+
+// ErrForbiddenAddress is returned for endpoints on loopback, private,
+// link-local or unspecified addresses, which would let subscribers reach
+// services inside the server's network.
+var ErrForbiddenAddress = errors.New("endpoint address is not public")
+
+// ValidateURL checks that the URL of an endpoint is an absolute HTTPS URL
+// whose host resolves only to public addresses.
+func ValidateURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "https" || u.Hostname() == "" {
+		return fmt.Errorf("url must be an absolute HTTPS URL")
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return fmt.Errorf("url host %q cannot be resolved", u.Hostname())
+	}
+	for _, addr := range addrs {
+		if !publicIP(addr.IP) {
+			return fmt.Errorf("url host %q: %w", u.Hostname(), ErrForbiddenAddress)
+		}
+	}
+	return nil
+}
+
+// publicIP reports whether deliveries may be sent to the IP.
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast())
+}
+
+// dialControl refuses connections to addresses that are not public. The
+// host was checked by ValidateURL when the subscription was saved, but it is
+// checked again as dialled, as its DNS records may have changed since.
+func dialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+		return ErrForbiddenAddress
+	}
+	return nil
+}
+
+// newClient returns the client of deliveries. It connects only to public
+// addresses, directly rather than through a proxy, and does not follow
+// redirects, which count as failed deliveries.
+func newClient() *http.Client {
+	dialer := &net.Dialer{Timeout: Timeout, Control: dialControl}
+	return &http.Client{
+		Timeout: Timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: Timeout,
+			MaxIdleConnsPerHost: 2,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
@@ -0,0 +1,43 @@
+package subscription
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestValidateURL(t *testing.T) {
+	for _, u := range []string{
+		"http://93.184.216.34/hooks",
+		"https://127.0.0.1/hooks",
+		"https://localhost:8080/hooks",
+		"https://10.0.0.5/hooks",
+		"https://192.168.1.1/hooks",
+		"https://169.254.169.254/latest/meta-data",
+		"https://[::1]/hooks",
+		"https://[fd00::1]/hooks",
+		"https://0.0.0.0/hooks",
+		"/hooks",
+	} {
+		if err := ValidateURL(context.Background(), u); err == nil {
+			t.Errorf("ValidateURL(%q) accepted it", u)
+		}
+	}
+	if err := ValidateURL(context.Background(), "https://93.184.216.34/hooks"); err != nil {
+		t.Errorf("a public endpoint was refused: %v", err)
+	}
+}
+
+func TestClientRefusesPrivateAddresses(t *testing.T) {
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("a delivery reached a loopback address")
+	}))
+	defer internal.Close()
+
+	_, err := newClient().Get(internal.URL)
+	if !errors.Is(err, ErrForbiddenAddress) {
+		t.Errorf("got %v, want ErrForbiddenAddress", err)
+	}
+}
@@ -0,0 +1,77 @@
+package subscription
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/vedrankolka/donation-server/pkg/notifier"
+	"github.com/vedrankolka/donation-server/pkg/requestid"
+)
+
+// Notifier sends every event to the primary notifier and, once it is
+// delivered there, dispatches it to the subscriptions. Only the primary's
+// result is returned, so a failing subscriber never makes Stripe retry.
+type Notifier struct {
+	primary    notifier.Notifier
+	dispatcher *Dispatcher
+}
+
+// NewNotifier creates a Notifier dispatching the primary's events.
+func NewNotifier(primary notifier.Notifier, dispatcher *Dispatcher) *Notifier {
+	return &Notifier{
+		primary:    primary,
+		dispatcher: dispatcher,
+	}
+}
+
+func (n *Notifier) Notify(ctx context.Context, event notifier.DonationEvent) error {
+	if err := n.primary.Notify(ctx, event); err != nil {
+		return err
+	}
+	n.dispatch(ctx, notifier.EventTypeDonation, public(event))
+	return nil
+}
+
+// public returns the event without the names of anonymous donors, as
+// subscribers may show donations publicly.
+func public(event notifier.DonationEvent) notifier.DonationEvent {
+	if event.Anonymous {
+		event.CustomerName = ""
+		event.DisplayName = ""
+	}
+	return event
+}
+
+func (n *Notifier) NotifyRecurring(ctx context.Context, event notifier.RecurringDonationEvent) error {
+	if err := n.primary.NotifyRecurring(ctx, event); err != nil {
+		return err
+	}
+	n.dispatch(ctx, notifier.EventTypeRecurringDonation, event)
+	return nil
+}
+
+func (n *Notifier) NotifyPayment(ctx context.Context, event notifier.PaymentEvent) error {
+	if err := n.primary.NotifyPayment(ctx, event); err != nil {
+		return err
+	}
+	n.dispatch(ctx, event.Type, event)
+	return nil
+}
+
+func (n *Notifier) dispatch(ctx context.Context, eventType string, event interface{}) {
+	payload, err := json.Marshal(event)
+	if err == nil {
+		err = n.dispatcher.Dispatch(ctx, eventType, payload)
+	}
+	if err != nil {
+		requestid.Printf(ctx, "Could not dispatch event to subscriptions: %v\n", err)
+	}
+}
+
+func (n *Notifier) Close() error {
+	return n.primary.Close()
+}
+
+func (n *Notifier) Shutdown(ctx context.Context) (notifier.FlushReport, error) {
+	return notifier.Shutdown(ctx, n.primary)
+}
@@ -0,0 +1,81 @@
+package tracing
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/vedrankolka/donation-server/pkg/requestid"
+)
+
+// Middleware records a server span of every request, named by its method
+// and the route of the mux it matched, e.g. "POST /admin/refunds/", so paths
+// with IDs share a name. Requests with a traceparent header continue the
+// caller's trace. It is inside requestid.Middleware, the span has the ID.
+func Middleware(mux *http.ServeMux) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if Default == nil {
+				next(w, r)
+				return
+			}
+			_, route := mux.Handler(r)
+			if route == "" {
+				route = "unmatched"
+			}
+			ctx, span := Start(WithTraceparent(r.Context(), r.Header.Get(Header)), r.Method+" "+route, KindServer,
+				String("http.request.method", r.Method),
+				String("http.route", route),
+				String("url.path", r.URL.Path),
+			)
+			defer span.End()
+			if id := requestid.FromContext(ctx); id != "" {
+				span.SetAttributes(String("request.id", id))
+			}
+
+			sw := &statusWriter{ResponseWriter: w}
+			next(sw, r.WithContext(ctx))
+			code := sw.status
+			if code == 0 {
+				code = http.StatusOK
+			}
+			span.SetAttributes(Int("http.response.status_code", code))
+			if code >= 500 {
+				span.SetError(errorStatus(code))
+			}
+		}
+	}
+}
+
+// errorStatus is the error of a span of a failed request.
+type errorStatus int
+
+func (code errorStatus) Error() string {
+	return strconv.Itoa(int(code)) + " " + http.StatusText(int(code))
+}
+
+// statusWriter records the status code of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+// Flush sends what was written so far, e.g. of a streamed export.
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
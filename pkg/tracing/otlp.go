@@ -0,0 +1,265 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vedrankolka/donation-server/pkg/metrics"
+)
+
+const (
+	// DefaultBatchSize is the number of spans exported at once.
+	DefaultBatchSize = 512
+	// DefaultBatchTimeout is how long spans wait for a batch to fill.
+	DefaultBatchTimeout = 5 * time.Second
+	// queueSize is the number of spans waiting to be exported. Spans ended
+	// while it is full are dropped, a slow backend does not slow requests.
+	queueSize = 4 * DefaultBatchSize
+)
+
+var exportedSpans = metrics.NewCounterVec(
+	"donation_server_trace_spans_total",
+	"Spans exported to the OTLP endpoint, failed to export or dropped because the queue was full.",
+	"outcome",
+)
+
+// OTLPExporter exports spans in batches to an OTLP/HTTP endpoint, encoded as
+// JSON, e.g. to an OpenTelemetry Collector, Jaeger or Grafana Tempo.
+type OTLPExporter struct {
+	url      string
+	headers  map[string]string
+	resource []Attribute
+	client   *http.Client
+
+	queue chan *Span
+	// closing is closed by Close, and done once the queued spans are exported.
+	closing chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+// NewOTLPExporter creates an OTLPExporter posting to the /v1/traces path of
+// the endpoint, e.g. http://otel-collector:4318, with the headers, e.g. of
+// authentication. Spans are of the resource of the attributes, e.g.
+// service.name. It exports until it is closed.
+func NewOTLPExporter(endpoint string, headers map[string]string, resource ...Attribute) *OTLPExporter {
+	e := &OTLPExporter{
+		url:      strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		headers:  headers,
+		resource: resource,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan *Span, queueSize),
+		closing:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+// ParseHeaders parses headers like "Authorization=Basic abc,X-Scope-OrgID=donations",
+// as OTEL_EXPORTER_OTLP_HEADERS.
+func ParseHeaders(s string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		i := strings.IndexByte(pair, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("header %q is not name=value", pair)
+		}
+		headers[strings.TrimSpace(pair[:i])] = strings.TrimSpace(pair[i+1:])
+	}
+	return headers, nil
+}
+
+// Export queues the span, or drops it if the queue is full.
+func (e *OTLPExporter) Export(s *Span) {
+	select {
+	case e.queue <- s:
+	default:
+		exportedSpans.Inc("dropped")
+	}
+}
+
+// Close exports the queued spans and stops the exporter. Spans ended later are dropped.
+func (e *OTLPExporter) Close() error {
+	e.once.Do(func() {
+		close(e.closing)
+		<-e.done
+	})
+	return nil
+}
+
+func (e *OTLPExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(DefaultBatchTimeout)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, DefaultBatchSize)
+	for {
+		select {
+		case s := <-e.queue:
+			if batch = append(batch, s); len(batch) >= DefaultBatchSize {
+				e.export(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			e.export(batch)
+			batch = batch[:0]
+		case <-e.closing:
+			for {
+				select {
+				case s := <-e.queue:
+					batch = append(batch, s)
+				default:
+					e.export(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// export posts the spans, in batches of at most DefaultBatchSize.
+func (e *OTLPExporter) export(spans []*Span) {
+	for len(spans) > 0 {
+		n := len(spans)
+		if n > DefaultBatchSize {
+			n = DefaultBatchSize
+		}
+		if err := e.post(spans[:n]); err != nil {
+			log.Printf("[WARN] Could not export %d spans: %v\n", n, err)
+			exportedSpans.Add(float64(n), "failed")
+		} else {
+			exportedSpans.Add(float64(n), "exported")
+		}
+		spans = spans[n:]
+	}
+}
+
+func (e *OTLPExporter) post(spans []*Span) error {
+	body, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), e.client.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range e.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s responded with %s: %s", e.url, resp.Status, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+// The OTLP/HTTP JSON encoding of spans, see
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpSpan struct {
+		TraceID      string          `json:"traceId"`
+		SpanID       string          `json:"spanId"`
+		ParentSpanID string          `json:"parentSpanId,omitempty"`
+		Name         string          `json:"name"`
+		Kind         Kind            `json:"kind"`
+		Start        string          `json:"startTimeUnixNano"`
+		End          string          `json:"endTimeUnixNano"`
+		Attributes   []otlpAttribute `json:"attributes,omitempty"`
+		Status       otlpStatus      `json:"status"`
+	}
+	otlpAttribute struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	}
+	otlpStatus struct {
+		// Code is 0 unset, 1 ok or 2 error.
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+func (e *OTLPExporter) request(spans []*Span) otlpRequest {
+	scope := otlpScopeSpans{Spans: make([]otlpSpan, 0, len(spans))}
+	scope.Scope.Name = "github.com/vedrankolka/donation-server/pkg/tracing"
+	for _, s := range spans {
+		s.mu.Lock()
+		span := otlpSpan{
+			TraceID:    hex.EncodeToString(s.sc.TraceID[:]),
+			SpanID:     hex.EncodeToString(s.sc.SpanID[:]),
+			Name:       s.name,
+			Kind:       s.kind,
+			Start:      strconv.FormatInt(s.start.UnixNano(), 10),
+			End:        strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes: attributes(s.attributes),
+		}
+		if s.err != "" {
+			span.Status = otlpStatus{Code: 2, Message: s.err}
+		}
+		s.mu.Unlock()
+		if s.parent != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		scope.Spans = append(scope.Spans, span)
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: attributes(e.resource)},
+		ScopeSpans: []otlpScopeSpans{scope},
+	}}}
+}
+
+func attributes(attrs []Attribute) []otlpAttribute {
+	encoded := make([]otlpAttribute, 0, len(attrs))
+	for _, a := range attrs {
+		var value map[string]interface{}
+		switch v := a.Value.(type) {
+		case string:
+			value = map[string]interface{}{"stringValue": v}
+		case int64:
+			// 64-bit integers are strings in JSON.
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		encoded = append(encoded, otlpAttribute{Key: a.Key, Value: value})
+	}
+	return encoded
+}
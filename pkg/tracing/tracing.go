@@ -0,0 +1,279 @@
+// Package tracing records spans of requests, Stripe calls and notifications,
+// exported with the OpenTelemetry protocol (OTLP), and propagates their
+// trace context in W3C traceparent headers, so a donation can be followed
+// from the webhook to the consumers of its events.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Header holds the trace context in requests and Kafka messages.
+const Header = "traceparent"
+
+// LogField holds the trace ID in log lines.
+const LogField = "trace_id"
+
+// SpanContext identifies a span across services.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	// Sampled spans are exported, by the server and the services it calls.
+	Sampled bool
+}
+
+// IsValid reports whether the trace and span IDs are set.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// TraceIDString returns the trace ID in hex, as tracing backends show it.
+func (sc SpanContext) TraceIDString() string {
+	return hex.EncodeToString(sc.TraceID[:])
+}
+
+// Traceparent returns the W3C traceparent header of the span context.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceIDString(), hex.EncodeToString(sc.SpanID[:]), flags)
+}
+
+// ParseTraceparent parses a W3C traceparent header, reporting whether it is valid.
+func ParseTraceparent(header string) (SpanContext, bool) {
+	var sc SpanContext
+	// version-traceid-spanid-flags, later versions may append fields.
+	if len(header) < 55 || header[2] != '-' || header[35] != '-' || header[52] != '-' || (len(header) > 55 && header[55] != '-') {
+		return sc, false
+	}
+	version, err := hex.DecodeString(header[:2])
+	if err != nil || version[0] == 0xff || (version[0] == 0 && len(header) != 55) {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(header[3:35])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(header[36:52])); err != nil {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(header[53:55])
+	if err != nil {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.IsValid()
+}
+
+// Kind is the role of a span, as in OTLP.
+type Kind int
+
+// Kinds of spans.
+const (
+	KindInternal Kind = iota + 1
+	KindServer
+	KindClient
+	KindProducer
+	KindConsumer
+)
+
+// Attribute is a key and a string, int64 or bool value of a span.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// String returns a string attribute.
+func String(key, value string) Attribute {
+	return Attribute{key, value}
+}
+
+// Int returns an integer attribute.
+func Int(key string, value int) Attribute {
+	return Attribute{key, int64(value)}
+}
+
+// Bool returns a boolean attribute.
+func Bool(key string, value bool) Attribute {
+	return Attribute{key, value}
+}
+
+// Span is an operation of a trace. The methods of a nil span do nothing, so
+// code does not check whether tracing is enabled.
+type Span struct {
+	tracer *Tracer
+	sc     SpanContext
+	parent [8]byte
+	name   string
+	kind   Kind
+	start  time.Time
+
+	mu         sync.Mutex
+	end        time.Time
+	attributes []Attribute
+	// err is the message of the error of a failed span.
+	err   string
+	ended bool
+}
+
+// Context returns the span context of the span.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// SetAttributes adds attributes to the span.
+func (s *Span) SetAttributes(attributes ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attributes = append(s.attributes, attributes...)
+	s.mu.Unlock()
+}
+
+// SetError marks the span failed with the error, if it is not nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.err = err.Error()
+	s.mu.Unlock()
+}
+
+// End ends the span, exporting it if it is sampled. Ending it again does nothing.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended, s.end = true, time.Now()
+	s.mu.Unlock()
+	if s.sc.Sampled {
+		s.tracer.exporter.Export(s)
+	}
+}
+
+// Exporter sends ended spans to a tracing backend. Export must not block.
+type Exporter interface {
+	Export(s *Span)
+}
+
+// Tracer starts spans, sampling the traces started by the server.
+type Tracer struct {
+	exporter Exporter
+	// threshold of the random trace IDs of sampled traces, see NewTracer.
+	threshold uint64
+}
+
+// NewTracer creates a Tracer exporting the spans of a share of the traces
+// from 0 to 1, sampleRate. Traces started by a caller are sampled if the
+// caller sampled them.
+func NewTracer(exporter Exporter, sampleRate float64) *Tracer {
+	t := &Tracer{exporter: exporter}
+	switch {
+	case sampleRate >= 1:
+		t.threshold = math.MaxUint64
+	case sampleRate > 0:
+		t.threshold = uint64(sampleRate * math.MaxUint64)
+	}
+	return t
+}
+
+// Default is the tracer of Start, nil while tracing is disabled. It is set
+// when the server starts, before it serves requests.
+var Default *Tracer
+
+type spanKey struct{}
+
+type remoteKey struct{}
+
+// Start starts a span of the Default tracer, a child of the span of the
+// context or the remote span of WithTraceparent, and returns it with a
+// context of it. It returns a nil span while tracing is disabled.
+func Start(ctx context.Context, name string, kind Kind, attributes ...Attribute) (context.Context, *Span) {
+	return Default.Start(ctx, name, kind, attributes...)
+}
+
+// Start starts a span like the package level Start.
+func (t *Tracer) Start(ctx context.Context, name string, kind Kind, attributes ...Attribute) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := &Span{tracer: t, name: name, kind: kind, start: time.Now(), attributes: attributes}
+	if parent := FromContext(ctx); parent.IsValid() {
+		s.sc.TraceID, s.parent, s.sc.Sampled = parent.TraceID, parent.SpanID, parent.Sampled
+	} else {
+		randomID(s.sc.TraceID[:])
+		s.sc.Sampled = t.sampled(s.sc.TraceID)
+	}
+	randomID(s.sc.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// sampled samples a trace by the last 8 bytes of its random ID, as all
+// instances of the server do.
+func (t *Tracer) sampled(traceID [16]byte) bool {
+	var n uint64
+	for _, b := range traceID[8:] {
+		n = n<<8 | uint64(b)
+	}
+	return t.threshold == math.MaxUint64 || n < t.threshold
+}
+
+func randomID(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("tracing: could not read random bytes: %v", err))
+	}
+}
+
+// SpanFromContext returns the span of the context, or nil if it has none.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// FromContext returns the span context of the span of the context, or of the
+// remote span of WithTraceparent, or an invalid one if it has neither.
+func FromContext(ctx context.Context) SpanContext {
+	if s := SpanFromContext(ctx); s != nil {
+		return s.sc
+	}
+	sc, _ := ctx.Value(remoteKey{}).(SpanContext)
+	return sc
+}
+
+// WithTraceparent returns a context continuing the trace of a traceparent
+// header, e.g. of a caller or of a queued notification. Invalid headers are
+// ignored.
+func WithTraceparent(ctx context.Context, header string) context.Context {
+	sc, ok := ParseTraceparent(header)
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// Traceparent returns the traceparent header of the trace of the context, or
+// "" if it has none.
+func Traceparent(ctx context.Context) string {
+	sc := FromContext(ctx)
+	if !sc.IsValid() {
+		return ""
+	}
+	return sc.Traceparent()
+}
@@ -0,0 +1,116 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	header := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := ParseTraceparent(header)
+	if !ok || !sc.Sampled {
+		t.Fatalf("ParseTraceparent(%q) = %+v, %v", header, sc, ok)
+	}
+	if got := sc.Traceparent(); got != header {
+		t.Errorf("Traceparent() = %q, want %q", got, header)
+	}
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+	} {
+		if _, ok := ParseTraceparent(invalid); ok {
+			t.Errorf("ParseTraceparent(%q) is valid", invalid)
+		}
+	}
+}
+
+type recorder []*Span
+
+func (r *recorder) Export(s *Span) {
+	*r = append(*r, s)
+}
+
+func TestStartContinuesTrace(t *testing.T) {
+	var spans recorder
+	tracer := NewTracer(&spans, 0)
+
+	// Traces started by the server are not sampled at a rate of 0.
+	_, root := tracer.Start(context.Background(), "root", KindInternal)
+	root.End()
+	if root.Context().Sampled || len(spans) != 0 {
+		t.Fatalf("a trace was sampled at a rate of 0")
+	}
+
+	// Traces of callers are sampled as the caller sampled them.
+	ctx := WithTraceparent(context.Background(), "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, server := tracer.Start(ctx, "server", KindServer)
+	_, client := tracer.Start(ctx, "client", KindClient)
+	client.SetError(errors.New("timeout"))
+	client.End()
+	client.End()
+	server.End()
+
+	if len(spans) != 2 {
+		t.Fatalf("%d spans were exported, want 2", len(spans))
+	}
+	if got := server.Context().TraceIDString(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("the server span has trace %s", got)
+	}
+	if server.parent != [8]byte{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7} {
+		t.Errorf("the server span has parent %x", server.parent)
+	}
+	if client.sc.TraceID != server.sc.TraceID || client.parent != server.sc.SpanID {
+		t.Errorf("the client span is not a child of the server span")
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	requests := make(chan otlpRequest, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("X-Scope-OrgID") != "donations" {
+			t.Errorf("spans were posted to %s with %v", r.URL.Path, r.Header)
+		}
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		requests <- req
+	}))
+	defer backend.Close()
+
+	exporter := NewOTLPExporter(backend.URL+"/", map[string]string{"X-Scope-OrgID": "donations"}, String("service.name", "donation-server"))
+	tracer := NewTracer(exporter, 1)
+	_, span := tracer.Start(context.Background(), "POST /webhook", KindServer, Int("http.response.status_code", 500))
+	span.SetError(errors.New("500 Internal Server Error"))
+	span.End()
+	exporter.Close()
+
+	req := <-requests
+	if len(req.ResourceSpans) != 1 || len(req.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("unexpected request %+v", req)
+	}
+	if got := req.ResourceSpans[0].Resource.Attributes[0].Value["stringValue"]; got != "donation-server" {
+		t.Errorf("service.name = %v", got)
+	}
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 1 {
+		t.Fatalf("%d spans were exported, want 1", len(spans))
+	}
+	got := spans[0]
+	if got.Name != "POST /webhook" || got.Kind != KindServer || got.TraceID != span.Context().TraceIDString() || got.ParentSpanID != "" {
+		t.Errorf("unexpected span %+v", got)
+	}
+	if got.Status.Code != 2 || got.Attributes[0].Value["intValue"] != "500" {
+		t.Errorf("unexpected status %+v or attributes %+v", got.Status, got.Attributes)
+	}
+}
@@ -0,0 +1,57 @@
+package vat
+
+import (
+	"fmt"
+	"time"
+)
+
+// Invoice is issued for the purchased part of a payment. The donated part is
+// listed separately, with its tax if donations are taxable.
+type Invoice struct {
+	Number   string    `json:"number"`
+	IssuedAt time.Time `json:"issuedAt"`
+	// ChargeID is the Stripe charge the invoice was issued for.
+	ChargeID string `json:"chargeID"`
+	Seller   Party  `json:"seller"`
+	Buyer    Party  `json:"buyer"`
+	// BuyerReference is the reference the buyer asked to be invoiced with,
+	// e.g. a purchase order number.
+	BuyerReference string        `json:"buyerReference,omitempty"`
+	Currency       string        `json:"currency"`
+	Lines          []Line        `json:"lines"`
+	Rates          []RateSummary `json:"rates"`
+	Net            int64         `json:"net"`
+	VAT            int64         `json:"vat"`
+	Gross          int64         `json:"gross"`
+	Donation       int64         `json:"donation"`
+	// DonationVAT is the tax included in Donation, where donations are taxable.
+	DonationVAT int64 `json:"donationVAT,omitempty"`
+	TotalPaid   int64 `json:"totalPaid"`
+}
+
+// InvoiceNumber formats the sequence number of an invoice issued in year.
+func InvoiceNumber(prefix string, year int, sequence int64) string {
+	return fmt.Sprintf("%s%d-%06d", prefix, year, sequence)
+}
+
+// NewInvoice creates an invoice for the breakdown of a charge.
+func NewInvoice(number string, issuedAt time.Time, chargeID string, seller, buyer Party, currency string, b *Breakdown) *Invoice {
+	invoice := &Invoice{
+		Number:      number,
+		IssuedAt:    issuedAt,
+		ChargeID:    chargeID,
+		Seller:      seller,
+		Buyer:       buyer,
+		Currency:    currency,
+		Lines:       b.Lines,
+		Rates:       b.Rates,
+		VAT:         b.VAT - b.DonationVAT,
+		Gross:       b.Purchase,
+		Donation:    b.Donation,
+		DonationVAT: b.DonationVAT,
+		TotalPaid:   b.Total,
+	}
+	invoice.Net = invoice.Gross - invoice.VAT
+
+	return invoice
+}
@@ -0,0 +1,340 @@
+package vat
+
+import (
+	"encoding/xml"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/vedrankolka/donation-server/pkg/currency"
+)
+
+// Identifiers of Peppol BIS Billing 3.0, the EN 16931 e-invoices exchanged
+// over the Peppol network.
+const (
+	PeppolCustomizationID = "urn:cen.eu:en16931:2017#compliant#urn:fdc:peppol.eu:2017:poacc:billing:3.0"
+	PeppolProfileID       = "urn:fdc:peppol.eu:2017:poacc:billing:01:1.0"
+)
+
+// VAT category codes of EN 16931 (UNCL5305).
+const (
+	categoryStandard   = "S"
+	categoryZeroRated  = "Z"
+	categoryExempt     = "E"
+	categoryNotSubject = "O"
+)
+
+type ublInvoice struct {
+	XMLName xml.Name `xml:"Invoice"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Cac     string   `xml:"xmlns:cac,attr"`
+	Cbc     string   `xml:"xmlns:cbc,attr"`
+
+	CustomizationID         string           `xml:"cbc:CustomizationID"`
+	ProfileID               string           `xml:"cbc:ProfileID"`
+	ID                      string           `xml:"cbc:ID"`
+	IssueDate               string           `xml:"cbc:IssueDate"`
+	InvoiceTypeCode         string           `xml:"cbc:InvoiceTypeCode"`
+	DocumentCurrencyCode    string           `xml:"cbc:DocumentCurrencyCode"`
+	BuyerReference          string           `xml:"cbc:BuyerReference,omitempty"`
+	OrderReference          *ublReference    `xml:"cac:OrderReference,omitempty"`
+	AccountingSupplierParty ublPartyWrapper  `xml:"cac:AccountingSupplierParty"`
+	AccountingCustomerParty ublPartyWrapper  `xml:"cac:AccountingCustomerParty"`
+	PaymentMeans            ublPaymentMeans  `xml:"cac:PaymentMeans"`
+	TaxTotal                ublTaxTotal      `xml:"cac:TaxTotal"`
+	LegalMonetaryTotal      ublMonetaryTotal `xml:"cac:LegalMonetaryTotal"`
+	InvoiceLines            []ublInvoiceLine `xml:"cac:InvoiceLine"`
+}
+
+type ublReference struct {
+	ID string `xml:"cbc:ID"`
+}
+
+type ublPartyWrapper struct {
+	Party ublParty `xml:"cac:Party"`
+}
+
+type ublParty struct {
+	EndpointID    ublID `xml:"cbc:EndpointID"`
+	PostalAddress struct {
+		StreetName string `xml:"cbc:StreetName,omitempty"`
+		Country    struct {
+			IdentificationCode string `xml:"cbc:IdentificationCode"`
+		} `xml:"cac:Country"`
+	} `xml:"cac:PostalAddress"`
+	PartyTaxScheme *struct {
+		CompanyID string       `xml:"cbc:CompanyID"`
+		TaxScheme ublTaxScheme `xml:"cac:TaxScheme"`
+	} `xml:"cac:PartyTaxScheme,omitempty"`
+	PartyLegalEntity struct {
+		RegistrationName string `xml:"cbc:RegistrationName"`
+	} `xml:"cac:PartyLegalEntity"`
+	Contact *struct {
+		ElectronicMail string `xml:"cbc:ElectronicMail"`
+	} `xml:"cac:Contact,omitempty"`
+}
+
+type ublID struct {
+	SchemeID string `xml:"schemeID,attr,omitempty"`
+	Value    string `xml:",chardata"`
+}
+
+type ublAmount struct {
+	CurrencyID string `xml:"currencyID,attr"`
+	Value      string `xml:",chardata"`
+}
+
+type ublQuantity struct {
+	UnitCode string `xml:"unitCode,attr"`
+	Value    int64  `xml:",chardata"`
+}
+
+type ublPaymentMeans struct {
+	PaymentMeansCode string `xml:"cbc:PaymentMeansCode"`
+	PaymentID        string `xml:"cbc:PaymentID,omitempty"`
+}
+
+type ublTaxScheme struct {
+	ID string `xml:"cbc:ID"`
+}
+
+type ublTaxCategory struct {
+	ID                     string       `xml:"cbc:ID"`
+	Percent                string       `xml:"cbc:Percent,omitempty"`
+	TaxExemptionReasonCode string       `xml:"cbc:TaxExemptionReasonCode,omitempty"`
+	TaxExemptionReason     string       `xml:"cbc:TaxExemptionReason,omitempty"`
+	TaxScheme              ublTaxScheme `xml:"cac:TaxScheme"`
+}
+
+type ublTaxTotal struct {
+	TaxAmount    ublAmount        `xml:"cbc:TaxAmount"`
+	TaxSubtotals []ublTaxSubtotal `xml:"cac:TaxSubtotal"`
+}
+
+type ublTaxSubtotal struct {
+	TaxableAmount ublAmount      `xml:"cbc:TaxableAmount"`
+	TaxAmount     ublAmount      `xml:"cbc:TaxAmount"`
+	TaxCategory   ublTaxCategory `xml:"cac:TaxCategory"`
+}
+
+type ublMonetaryTotal struct {
+	LineExtensionAmount ublAmount `xml:"cbc:LineExtensionAmount"`
+	TaxExclusiveAmount  ublAmount `xml:"cbc:TaxExclusiveAmount"`
+	TaxInclusiveAmount  ublAmount `xml:"cbc:TaxInclusiveAmount"`
+	PrepaidAmount       ublAmount `xml:"cbc:PrepaidAmount"`
+	PayableAmount       ublAmount `xml:"cbc:PayableAmount"`
+}
+
+type ublInvoiceLine struct {
+	ID                  string      `xml:"cbc:ID"`
+	InvoicedQuantity    ublQuantity `xml:"cbc:InvoicedQuantity"`
+	LineExtensionAmount ublAmount   `xml:"cbc:LineExtensionAmount"`
+	Item                struct {
+		Name                      string         `xml:"cbc:Name"`
+		SellersItemIdentification *ublReference  `xml:"cac:SellersItemIdentification,omitempty"`
+		ClassifiedTaxCategory     ublTaxCategory `xml:"cac:ClassifiedTaxCategory"`
+	} `xml:"cac:Item"`
+	Price struct {
+		PriceAmount  ublAmount   `xml:"cbc:PriceAmount"`
+		BaseQuantity ublQuantity `xml:"cbc:BaseQuantity"`
+	} `xml:"cac:Price"`
+}
+
+// ublLine is a line of an e-invoice before it is marshalled.
+type ublLine struct {
+	id, name      string
+	quantity      int64
+	net, vat      int64
+	category      ublTaxCategory
+	exemptionCode string
+	exemption     string
+}
+
+// UBL returns the invoice as a Peppol BIS Billing 3.0 e-invoice, UBL 2.1 XML
+// compliant with EN 16931. The donated part is a line of its own, exempt from
+// VAT next to purchases, not subject to it on its own, or taxed where
+// donations are. The invoice is paid by card, so nothing is payable.
+//
+// Both parties need a country and an electronic address, or else an email
+// address.
+func (inv *Invoice) UBL() ([]byte, error) {
+	code := strings.ToUpper(inv.Currency)
+	amount := func(v int64) ublAmount {
+		return ublAmount{CurrencyID: code, Value: strings.TrimSuffix(currency.Format(v, code), " "+code)}
+	}
+
+	var lines []ublLine
+	for _, l := range inv.Lines {
+		category := categoryStandard
+		if l.Rate == 0 {
+			category = categoryZeroRated
+		}
+		lines = append(lines, ublLine{
+			id: l.ProductID, name: l.Description, quantity: l.Quantity, net: l.Net, vat: l.VAT,
+			category: ublTaxCategory{ID: category, Percent: formatRate(l.Rate)},
+		})
+	}
+	notSubject := false
+	if inv.Donation > 0 {
+		donation := ublLine{name: "Donation", quantity: 1, net: inv.Donation - inv.DonationVAT, vat: inv.DonationVAT}
+		switch {
+		case inv.DonationVAT > 0:
+			rate := math.Round(float64(inv.DonationVAT)/float64(donation.net)*10000) / 100
+			donation.category = ublTaxCategory{ID: categoryStandard, Percent: formatRate(rate)}
+		case len(inv.Lines) == 0:
+			notSubject = true
+			donation.category = ublTaxCategory{ID: categoryNotSubject}
+			donation.exemptionCode, donation.exemption = "VATEX-EU-O", "Donation, not subject to VAT"
+		default:
+			donation.category = ublTaxCategory{ID: categoryExempt, Percent: "0"}
+			donation.exemption = "Donation, not a supply of goods or services"
+		}
+		lines = append(lines, donation)
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("invoice %s has no lines", inv.Number)
+	}
+
+	// Invoices not subject to VAT carry no VAT identifiers.
+	seller, err := ublPartyOf("seller", inv.Seller, !notSubject)
+	if err != nil {
+		return nil, err
+	}
+	buyer, err := ublPartyOf("buyer", inv.Buyer, !notSubject)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := ublInvoice{
+		Xmlns:                   "urn:oasis:names:specification:ubl:schema:xsd:Invoice-2",
+		Cac:                     "urn:oasis:names:specification:ubl:schema:xsd:CommonAggregateComponents-2",
+		Cbc:                     "urn:oasis:names:specification:ubl:schema:xsd:CommonBasicComponents-2",
+		CustomizationID:         PeppolCustomizationID,
+		ProfileID:               PeppolProfileID,
+		ID:                      inv.Number,
+		IssueDate:               inv.IssuedAt.Format("2006-01-02"),
+		InvoiceTypeCode:         "380",
+		DocumentCurrencyCode:    code,
+		BuyerReference:          inv.BuyerReference,
+		AccountingSupplierParty: ublPartyWrapper{Party: seller},
+		AccountingCustomerParty: ublPartyWrapper{Party: buyer},
+		// 48 is a payment by bank card.
+		PaymentMeans: ublPaymentMeans{PaymentMeansCode: "48", PaymentID: inv.ChargeID},
+	}
+	// Peppol requires the buyer reference or an order reference.
+	if inv.BuyerReference == "" {
+		doc.OrderReference = &ublReference{ID: inv.ChargeID}
+	}
+
+	// Lines are summed up per VAT category and rate.
+	type subtotal struct {
+		category ublTaxCategory
+		net, vat int64
+	}
+	var net, tax int64
+	var groups []*subtotal
+	byCategory := make(map[string]*subtotal)
+	for i, l := range lines {
+		net += l.net
+		tax += l.vat
+		l.category.TaxScheme.ID = "VAT"
+
+		key := l.category.ID + "/" + l.category.Percent
+		group, ok := byCategory[key]
+		if !ok {
+			group = &subtotal{category: l.category}
+			group.category.TaxExemptionReasonCode, group.category.TaxExemptionReason = l.exemptionCode, l.exemption
+			byCategory[key] = group
+			groups = append(groups, group)
+		}
+		group.net += l.net
+		group.vat += l.vat
+
+		line := ublInvoiceLine{
+			ID:                  strconv.Itoa(i + 1),
+			InvoicedQuantity:    ublQuantity{UnitCode: "C62", Value: l.quantity},
+			LineExtensionAmount: amount(l.net),
+		}
+		line.Item.Name = l.name
+		if l.id != "" {
+			line.Item.SellersItemIdentification = &ublReference{ID: l.id}
+		}
+		line.Item.ClassifiedTaxCategory = l.category
+		// The price is of the whole quantity, so the quantity times the
+		// price is the net amount exactly.
+		line.Price.PriceAmount = amount(l.net)
+		line.Price.BaseQuantity = ublQuantity{UnitCode: "C62", Value: l.quantity}
+		doc.InvoiceLines = append(doc.InvoiceLines, line)
+	}
+	subtotals := make([]ublTaxSubtotal, len(groups))
+	for i, group := range groups {
+		subtotals[i] = ublTaxSubtotal{TaxableAmount: amount(group.net), TaxAmount: amount(group.vat), TaxCategory: group.category}
+	}
+	doc.TaxTotal = ublTaxTotal{TaxAmount: amount(tax), TaxSubtotals: subtotals}
+	doc.LegalMonetaryTotal = ublMonetaryTotal{
+		LineExtensionAmount: amount(net),
+		TaxExclusiveAmount:  amount(net),
+		TaxInclusiveAmount:  amount(net + tax),
+		PrepaidAmount:       amount(net + tax),
+		PayableAmount:       amount(0),
+	}
+
+	out, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), out...), nil
+}
+
+// ublPartyOf returns the party of an e-invoice, with its VAT identifier if
+// withVATID.
+func ublPartyOf(role string, p Party, withVATID bool) (ublParty, error) {
+	var party ublParty
+	switch scheme, id, ok := cutEndpoint(p.ElectronicAddress); {
+	case ok:
+		party.EndpointID = ublID{SchemeID: scheme, Value: id}
+	case p.ElectronicAddress != "":
+		return party, fmt.Errorf("the %s's electronic address %q must be like 0088:7300010000001", role, p.ElectronicAddress)
+	case p.Email != "":
+		// EM is the electronic address scheme of email addresses.
+		party.EndpointID = ublID{SchemeID: "EM", Value: p.Email}
+	default:
+		return party, fmt.Errorf("the %s has no electronic address or email address", role)
+	}
+	if len(p.Country) != 2 {
+		return party, fmt.Errorf("the %s has no country", role)
+	}
+	if p.Name == "" {
+		return party, fmt.Errorf("the %s has no name", role)
+	}
+
+	party.PostalAddress.StreetName = p.Address
+	party.PostalAddress.Country.IdentificationCode = strings.ToUpper(p.Country)
+	if withVATID && p.VATID != "" {
+		party.PartyTaxScheme = &struct {
+			CompanyID string       `xml:"cbc:CompanyID"`
+			TaxScheme ublTaxScheme `xml:"cac:TaxScheme"`
+		}{CompanyID: p.VATID, TaxScheme: ublTaxScheme{ID: "VAT"}}
+	}
+	party.PartyLegalEntity.RegistrationName = p.Name
+	if p.Email != "" {
+		party.Contact = &struct {
+			ElectronicMail string `xml:"cbc:ElectronicMail"`
+		}{ElectronicMail: p.Email}
+	}
+	return party, nil
+}
+
+// cutEndpoint splits a Peppol participant ID into its scheme and identifier.
+func cutEndpoint(address string) (scheme, id string, ok bool) {
+	i := strings.Index(address, ":")
+	if i <= 0 || i == len(address)-1 {
+		return "", "", false
+	}
+	return address[:i], address[i+1:], true
+}
+
+func formatRate(rate float64) string {
+	return strconv.FormatFloat(rate, 'f', -1, 64)
+}
@@ -0,0 +1,288 @@
+package vat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vedrankolka/donation-server/pkg/address"
+)
+
+// Product is something that can be bought together with a donation, e.g. an
+// event ticket. Prices include VAT.
+type Product struct {
+	ID          string `json:"id"`
+	Description string `json:"description"`
+	// UnitAmount is the gross price in the smallest currency unit.
+	UnitAmount int64 `json:"unitAmount"`
+	// Rate is the VAT rate in percent, e.g. 25 for 25%.
+	Rate float64 `json:"rate"`
+	// TaxCode is the Stripe Tax product tax code, used when Stripe calculates the tax.
+	TaxCode string `json:"taxCode,omitempty"`
+}
+
+// Party is the seller or the buyer on an invoice.
+type Party struct {
+	Name    string `json:"name"`
+	Address string `json:"address,omitempty"`
+	// Country is the ISO 3166-1 alpha-2 code of the address, required by
+	// e-invoices.
+	Country string `json:"country,omitempty"`
+	VATID   string `json:"vatID,omitempty"`
+	Email   string `json:"email,omitempty"`
+	// ElectronicAddress receives e-invoices, a Peppol participant ID like
+	// "0088:7300010000001" or "9930:DE123456789". E-invoices use the email
+	// address without it.
+	ElectronicAddress string `json:"electronicAddress,omitempty"`
+}
+
+// Config is the VAT configuration: the seller issuing invoices and the
+// products that can be bought.
+type Config struct {
+	Seller        Party     `json:"seller"`
+	InvoicePrefix string    `json:"invoicePrefix"`
+	Products      []Product `json:"products"`
+}
+
+// LoadConfig reads a JSON VAT configuration from path.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("could not parse VAT config: %w", err)
+	}
+
+	for _, p := range config.Products {
+		if p.ID == "" || p.UnitAmount < 1 || p.Rate < 0 || p.Rate > 100 {
+			return nil, fmt.Errorf("invalid product %+v", p)
+		}
+	}
+
+	return &config, nil
+}
+
+// Product returns the product with the given ID.
+func (c *Config) Product(id string) (Product, bool) {
+	for _, p := range c.Products {
+		if p.ID == id {
+			return p, true
+		}
+	}
+	return Product{}, false
+}
+
+// MaxQuantity is the most of a product an order can have.
+const MaxQuantity = 100
+
+// LineAmount returns the gross amount of a quantity of a product. The
+// quantity must be from 1 to MaxQuantity, and the amount must not overflow.
+func LineAmount(product Product, quantity int64) (int64, error) {
+	if quantity < 1 || quantity > MaxQuantity {
+		return 0, fmt.Errorf("invalid quantity %d of product %q, it must be from 1 to %d", quantity, product.ID, MaxQuantity)
+	}
+	if product.UnitAmount > math.MaxInt64/quantity {
+		return 0, fmt.Errorf("the amount of %d of product %q is too large", quantity, product.ID)
+	}
+	return product.UnitAmount * quantity, nil
+}
+
+// addAmounts returns the sum of two non-negative amounts, or an error if it overflows.
+func addAmounts(a, b int64) (int64, error) {
+	if a > math.MaxInt64-b {
+		return 0, errors.New("the order total is too large")
+	}
+	return a + b, nil
+}
+
+// OrderItem is a product and the quantity bought.
+type OrderItem struct {
+	ProductID string `json:"productID"`
+	Quantity  int64  `json:"quantity"`
+}
+
+// Order is a payment consisting of purchased items and a donation.
+type Order struct {
+	Items []OrderItem
+	// Donation is the donated part of the payment. The InternalCalculator
+	// treats it as not subject to VAT.
+	Donation int64
+	Currency string
+	// Country of the buyer, used by calculators that depend on it.
+	Country string
+	// Address and IPAddress locate the buyer for calculators that need more
+	// than the country. Either may be empty.
+	Address   *address.Address
+	IPAddress string
+}
+
+// Line is a purchased item with its amounts.
+type Line struct {
+	ProductID   string  `json:"productID"`
+	Description string  `json:"description"`
+	Quantity    int64   `json:"quantity"`
+	UnitAmount  int64   `json:"unitAmount"`
+	Rate        float64 `json:"rate"`
+	Gross       int64   `json:"gross"`
+	Net         int64   `json:"net"`
+	VAT         int64   `json:"vat"`
+}
+
+// RateSummary sums up the lines with the same VAT rate.
+type RateSummary struct {
+	Rate float64 `json:"rate"`
+	// Jurisdiction is set by calculators that know it, e.g. "HR vat" or "US-CA sales_tax".
+	Jurisdiction string `json:"jurisdiction,omitempty"`
+	Gross        int64  `json:"gross"`
+	Net          int64  `json:"net"`
+	VAT          int64  `json:"vat"`
+}
+
+// Breakdown splits a payment into its donated and purchased parts.
+type Breakdown struct {
+	Lines    []Line        `json:"lines"`
+	Rates    []RateSummary `json:"rates"`
+	Donation int64         `json:"donation"`
+	Purchase int64         `json:"purchase"`
+	// VAT is the total tax, including DonationVAT.
+	VAT int64 `json:"vat"`
+	// DonationVAT is the tax included in the donation, where donations are taxable.
+	DonationVAT int64 `json:"donationVAT,omitempty"`
+	Total       int64 `json:"total"`
+	// CalculationID identifies the calculation at an external tax service.
+	CalculationID string `json:"calculationID,omitempty"`
+}
+
+// Taxed reports whether the breakdown needs an invoice.
+func (b *Breakdown) Taxed() bool {
+	return len(b.Lines) > 0 || b.VAT > 0
+}
+
+// Calculator computes the VAT breakdown of an order.
+type Calculator interface {
+	Calculate(ctx context.Context, order Order) (*Breakdown, error)
+}
+
+// Retriever is implemented by calculators that keep their calculations, so the
+// breakdown of a paid order can be fetched instead of calculated again.
+type Retriever interface {
+	Retrieve(ctx context.Context, calculationID string) (*Breakdown, error)
+}
+
+// Committer is implemented by calculators that must be told when a calculated
+// order is paid, e.g. to report the collected tax. reference identifies the payment.
+type Committer interface {
+	Commit(ctx context.Context, b *Breakdown, reference string) error
+}
+
+// InternalCalculator computes VAT from the rates in the product catalog.
+type InternalCalculator struct {
+	Config *Config
+}
+
+// Calculate computes VAT per line and per rate. The VAT of each rate is
+// computed from the rate's gross total, so the rate summaries are exact and
+// line VAT amounts may be off by a cent in total.
+func (ic *InternalCalculator) Calculate(ctx context.Context, order Order) (*Breakdown, error) {
+	breakdown := &Breakdown{Donation: order.Donation}
+	rates := make(map[float64]*RateSummary)
+
+	for _, item := range order.Items {
+		product, ok := ic.Config.Product(item.ProductID)
+		if !ok {
+			return nil, fmt.Errorf("unknown product %q", item.ProductID)
+		}
+		gross, err := LineAmount(product, item.Quantity)
+		if err != nil {
+			return nil, err
+		}
+		vat := includedVAT(gross, product.Rate)
+		breakdown.Lines = append(breakdown.Lines, Line{
+			ProductID:   product.ID,
+			Description: product.Description,
+			Quantity:    item.Quantity,
+			UnitAmount:  product.UnitAmount,
+			Rate:        product.Rate,
+			Gross:       gross,
+			Net:         gross - vat,
+			VAT:         vat,
+		})
+
+		summary, ok := rates[product.Rate]
+		if !ok {
+			summary = &RateSummary{Rate: product.Rate}
+			rates[product.Rate] = summary
+		}
+		if summary.Gross, err = addAmounts(summary.Gross, gross); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, summary := range rates {
+		var err error
+		if breakdown.Purchase, err = addAmounts(breakdown.Purchase, summary.Gross); err != nil {
+			return nil, err
+		}
+		summary.VAT = includedVAT(summary.Gross, summary.Rate)
+		summary.Net = summary.Gross - summary.VAT
+		breakdown.Rates = append(breakdown.Rates, *summary)
+		breakdown.VAT += summary.VAT
+	}
+	sort.Slice(breakdown.Rates, func(i, j int) bool {
+		return breakdown.Rates[i].Rate > breakdown.Rates[j].Rate
+	})
+
+	var err error
+	if breakdown.Total, err = addAmounts(breakdown.Purchase, breakdown.Donation); err != nil {
+		return nil, err
+	}
+	return breakdown, nil
+}
+
+// includedVAT returns the VAT included in a gross amount.
+func includedVAT(gross int64, rate float64) int64 {
+	return int64(math.Round(float64(gross) * rate / (100 + rate)))
+}
+
+// ParseItems parses items in the "productID:quantity,productID:quantity" format
+// used in query parameters and Stripe metadata. The quantity defaults to 1
+// and is at most MaxQuantity.
+func ParseItems(s string) ([]OrderItem, error) {
+	var items []OrderItem
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		item := OrderItem{ProductID: part, Quantity: 1}
+		if i := strings.LastIndex(part, ":"); i >= 0 {
+			quantity, err := strconv.ParseInt(part[i+1:], 10, 64)
+			if err != nil || quantity < 1 || quantity > MaxQuantity {
+				return nil, fmt.Errorf("invalid quantity in item %q", part)
+			}
+			item.ProductID, item.Quantity = part[:i], quantity
+		}
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// FormatItems is the inverse of ParseItems.
+func FormatItems(items []OrderItem) string {
+	parts := make([]string, len(items))
+	for i, item := range items {
+		parts[i] = fmt.Sprintf("%s:%d", item.ProductID, item.Quantity)
+	}
+	return strings.Join(parts, ",")
+}